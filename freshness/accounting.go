@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transfer costs are estimated from ingested events: the bytes of every
+// successful transfer are egress from its source site, priced with that
+// site's cost model from SITES_CONFIG and charged to the event's tenant.
+// Tiers apply to the source site's running total for the calendar month
+// (UTC), as cloud providers bill them. Totals per month, tenant, source and
+// VO are kept in ACCOUNTING_FILE for ACCOUNTING_RETENTION_MONTHS.
+var (
+	accountingPath      = envOr("ACCOUNTING_FILE", filepath.Join(dataDir, "accounting.json"))
+	accountingCurrency  = envOr("ACCOUNTING_CURRENCY", "USD")
+	accountingRetention = envOrInt("ACCOUNTING_RETENTION_MONTHS", 13)
+)
+
+var transferCost = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_transfer_cost_total", Help: "Estimated egress cost of transfers, in ACCOUNTING_CURRENCY"},
+	[]string{"tenant", "source"},
+)
+
+func init() {
+	prometheus.MustRegister(transferCost)
+}
+
+type costTier struct {
+	UpTo  string  `yaml:"up_to"`
+	PerGB float64 `yaml:"per_gb"`
+
+	upTo float64
+}
+
+// costModel prices egress from a site. per_gb is shorthand for a single
+// open-ended tier.
+type costModel struct {
+	PerGB float64    `yaml:"per_gb"`
+	Tiers []costTier `yaml:"tiers"`
+}
+
+func (m *costModel) compile() error {
+	if len(m.Tiers) == 0 {
+		m.Tiers = []costTier{{PerGB: m.PerGB}}
+	}
+	prev := 0.0
+	for i := range m.Tiers {
+		t := &m.Tiers[i]
+		if t.UpTo == "" {
+			if i != len(m.Tiers)-1 {
+				return fmt.Errorf("only the last tier may omit up_to")
+			}
+			continue
+		}
+		v, err := parseBytes(t.UpTo)
+		if err != nil {
+			return err
+		}
+		if v <= prev {
+			return fmt.Errorf("tier up_to values must increase")
+		}
+		t.upTo, prev = v, v
+	}
+	return nil
+}
+
+// price returns the cost of bytes transferred once the month's total
+// already stands at used. Past a last tier with up_to, the last price
+// keeps applying.
+func (m *costModel) price(used, bytes float64) float64 {
+	cost, lower := 0.0, 0.0
+	for i, t := range m.Tiers {
+		upper := t.upTo
+		if upper == 0 || i == len(m.Tiers)-1 {
+			upper = used + bytes
+		}
+		lo, hi := maxFloat(used, lower), minFloat(used+bytes, upper)
+		if hi > lo {
+			cost += (hi - lo) / 1e9 * t.PerGB
+		}
+		lower = upper
+	}
+	return cost
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type accountingKey struct {
+	Month  string `json:"month"`
+	Tenant string `json:"tenant"`
+	Source string `json:"source"`
+	VO     string `json:"vo,omitempty"`
+}
+
+// AccountingRow is one tenant's egress from one source in one month, for
+// one VO.
+type AccountingRow struct {
+	accountingKey
+	Bytes int64   `json:"bytes"`
+	Cost  float64 `json:"cost"`
+}
+
+type accountingStore struct {
+	mu    sync.Mutex
+	rows  map[accountingKey]*AccountingRow
+	dirty bool
+}
+
+var accounting = &accountingStore{rows: map[accountingKey]*AccountingRow{}}
+
+func (a *accountingStore) Load() error {
+	raw, err := os.ReadFile(accountingPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rows []*AccountingRow
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		return fmt.Errorf("%s: %w", accountingPath, err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range rows {
+		a.rows[r.accountingKey] = r
+	}
+	return nil
+}
+
+// sourceUsage is the source site's egress so far in month, across tenants.
+func (a *accountingStore) sourceUsage(month, source string) float64 {
+	var n int64
+	for k, r := range a.rows {
+		if k.Month == month && k.Source == source {
+			n += r.Bytes
+		}
+	}
+	return float64(n)
+}
+
+// Observe charges a successful transfer to its tenant.
+func (a *accountingStore) Observe(ev TransferEvent) {
+	if ev.Status != "success" || ev.Source == "" || ev.Bytes <= 0 {
+		return
+	}
+	month := unixTime(ev.Timestamp).UTC().Format(historyMonthLayout)
+	k := accountingKey{Month: month, Tenant: eventTenant(ev), Source: ev.Source, VO: ev.VO}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cost := 0.0
+	if m := siteRegistry().lookup(ev.Source).Cost; m != nil {
+		cost = m.price(a.sourceUsage(month, ev.Source), float64(ev.Bytes))
+	}
+	r := a.rows[k]
+	if r == nil {
+		r = &AccountingRow{accountingKey: k}
+		a.rows[k] = r
+	}
+	r.Bytes += ev.Bytes
+	r.Cost += cost
+	a.dirty = true
+	if cost > 0 {
+		transferCost.WithLabelValues(k.Tenant, k.Source).Add(cost)
+	}
+}
+
+// Rows returns month's totals, optionally for one tenant and one VO,
+// ordered by tenant, source and VO.
+func (a *accountingStore) Rows(month, tenant, vo string) []AccountingRow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []AccountingRow{}
+	for k, r := range a.rows {
+		if k.Month == month && (tenant == "" || k.Tenant == tenant) && (vo == "" || k.VO == vo) {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Tenant != out[j].Tenant {
+			return out[i].Tenant < out[j].Tenant
+		}
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].VO < out[j].VO
+	})
+	return out
+}
+
+// flushLoop persists totals and drops months past retention.
+func (a *accountingStore) flushLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		oldest := time.Now().UTC().AddDate(0, -accountingRetention+1, 0).Format(historyMonthLayout)
+		a.mu.Lock()
+		rows := make([]*AccountingRow, 0, len(a.rows))
+		for k, r := range a.rows {
+			if k.Month < oldest {
+				delete(a.rows, k)
+				a.dirty = true
+				continue
+			}
+			rows = append(rows, r)
+		}
+		if a.dirty {
+			raw, err := json.Marshal(rows)
+			if err == nil {
+				err = writeFileAtomic(accountingPath, raw)
+			}
+			if err != nil {
+				fmt.Printf("[accounting] save: %v\n", err)
+			} else {
+				a.dirty = false
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+type tenantCost struct {
+	Tenant  string          `json:"tenant"`
+	Bytes   int64           `json:"bytes"`
+	Cost    float64         `json:"cost"`
+	Sources []AccountingRow `json:"sources"`
+}
+
+// handleAccounting serves GET /api/v1/accounting?month=YYYY-MM&tenant=&vo=,
+// defaulting to the current month. format=csv returns the same rows as a
+// report with one line per tenant, source and VO.
+func handleAccounting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	month := q.Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format(historyMonthLayout)
+	} else if _, err := time.Parse(historyMonthLayout, month); err != nil {
+		http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	rows := accounting.Rows(month, q.Get("tenant"), q.Get("vo"))
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=dtms-costs-%s.csv", month))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"month", "tenant", "source", "bytes", "cost_" + accountingCurrency, "vo"})
+		for _, row := range rows {
+			cw.Write([]string{row.Month, row.Tenant, row.Source, strconv.FormatInt(row.Bytes, 10), strconv.FormatFloat(row.Cost, 'f', 2, 64), row.VO})
+		}
+		cw.Flush()
+		return
+	}
+
+	tenants := []*tenantCost{}
+	total := 0.0
+	for _, row := range rows {
+		if len(tenants) == 0 || tenants[len(tenants)-1].Tenant != row.Tenant {
+			tenants = append(tenants, &tenantCost{Tenant: row.Tenant})
+		}
+		t := tenants[len(tenants)-1]
+		t.Bytes += row.Bytes
+		t.Cost += row.Cost
+		t.Sources = append(t.Sources, row)
+		total += row.Cost
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"month":    month,
+		"currency": accountingCurrency,
+		"total":    total,
+		"tenants":  tenants,
+	})
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Agents of sites nobody has set up yet register themselves. Such an agent
+// holds the shared AGENT_REGISTRATION_TOKEN instead of a per-site
+// bootstrap token and names its site when it asks for an ingestion token
+// ({"site": ..., "key": ..., "hostname": ..., "version": ...}). The key
+// is a secret the agent makes up at first contact and keeps; the first
+// request files a pending registration bound to it and is answered 202.
+// The agent keeps asking, and gets tokens once an admin has approved the
+// site, but only while it presents the same key: the registration token
+// alone does not let one site's agent write for another. An agent that
+// lost its key registers afresh after its registration is deleted. Sites
+// with a bootstrap token in AGENT_BOOTSTRAP_TOKENS cannot register.
+//
+//	GET    /api/v1/agent/registrations?status=       list, pending first
+//	GET    /api/v1/agent/registrations/{site}        one registration
+//	POST   /api/v1/agent/registrations/{site}/approve
+//	POST   /api/v1/agent/registrations/{site}/reject {"reason": ...}
+//	DELETE /api/v1/agent/registrations/{site}        forget; the agent registers afresh
+//
+// The approve body is a site spec as for /api/v1/managed/sites plus the
+// shorthands tier (a tag) and tenant (metadata). It is kept with the
+// registration and layered over SITES_CONFIG, below any managed entry of
+// the same name, so a controller that owns /api/v1/managed (dtms-operator)
+// does not prune it; with an empty body the site keeps its settings.
+// Rejecting or deleting the registration drops the spec. A rejected agent
+// gets 403 until its registration is deleted. Tokens already issued stay valid until they expire, so a site
+// that is rejected or deleted later stops within AGENT_TOKEN_TTL_SECONDS.
+// Sites can be approved before their agent first calls. dtmsctl agents
+// wraps the API.
+var (
+	agentRegistrationToken = envOr("AGENT_REGISTRATION_TOKEN", "")
+	agentRegistrationsFile = envOr("AGENT_REGISTRATIONS", filepath.Join(dataDir, "agent-registrations.json"))
+)
+
+// Registration states.
+const (
+	registrationPending  = "pending"
+	registrationApproved = "approved"
+	registrationRejected = "rejected"
+)
+
+type AgentRegistration struct {
+	Site      string  `json:"site"`
+	Status    string  `json:"status"`
+	Requested float64 `json:"requested"`
+	LastSeen  float64 `json:"last_seen,omitempty"`
+	Decided   float64 `json:"decided,omitempty"`
+	DecidedBy string  `json:"decided_by,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Hostname  string  `json:"hostname,omitempty"`
+	Version   string  `json:"version,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	// KeySHA256 is the hash of the key the agent registered with.
+	KeySHA256 string `json:"key_sha256,omitempty"`
+	// Spec is the site's settings as approved.
+	Spec json.RawMessage `json:"spec,omitempty"`
+
+	key string // as presented by the caller
+}
+
+// agentKeyMinLength keeps agents from registering with guessable keys.
+const agentKeyMinLength = 16
+
+var (
+	errRegistrationKey  = errors.New("the site is registered to another agent")
+	errSiteBootstrapped = errors.New("the site has a bootstrap token and cannot register")
+)
+
+func agentKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+var agentRegistrationEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_agent_registrations_total", Help: "Agent registrations by what became of them"},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(agentRegistrationEvents)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "dtms_agent_registrations_pending", Help: "Agent registrations waiting for an admin"},
+		func() float64 { return float64(agentRegistrations.Pending()) },
+	))
+}
+
+type agentRegistrationStore struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]*AgentRegistration
+	sites map[string]siteConfig // compiled specs of approved registrations
+}
+
+var agentRegistrations = &agentRegistrationStore{path: agentRegistrationsFile, items: map[string]*AgentRegistration{}, sites: map[string]siteConfig{}}
+
+func (s *agentRegistrationStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*AgentRegistration
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	for _, reg := range list {
+		s.items[reg.Site] = reg
+		if reg.Status != registrationApproved || reg.Spec == nil {
+			continue
+		}
+		c, err := compileSiteSpec(reg.Spec)
+		if err != nil {
+			fmt.Printf("[agents] %s: approved spec: %v\n", reg.Site, err)
+			continue
+		}
+		s.sites[reg.Site] = c
+	}
+	s.mu.Unlock()
+	rebuildSiteRegistry()
+	return nil
+}
+
+// approvedSites returns the settings of the approved registrations.
+func (s *agentRegistrationStore) approvedSites() map[string]siteConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]siteConfig, len(s.sites))
+	for site, c := range s.sites {
+		out[site] = c
+	}
+	return out
+}
+
+func (s *agentRegistrationStore) save() error {
+	raw, err := json.Marshal(s.sorted(""))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+// sorted returns the registrations with status (all when empty), pending
+// first and otherwise by site.
+func (s *agentRegistrationStore) sorted(status string) []AgentRegistration {
+	list := []AgentRegistration{}
+	for _, reg := range s.items {
+		if status == "" || reg.Status == status {
+			list = append(list, *reg)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if pi, pj := list[i].Status == registrationPending, list[j].Status == registrationPending; pi != pj {
+			return pi
+		}
+		return list[i].Site < list[j].Site
+	})
+	return list
+}
+
+func (s *agentRegistrationStore) List(status string) []AgentRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(status)
+}
+
+func (s *agentRegistrationStore) Get(site string) (AgentRegistration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.items[site]
+	if !ok {
+		return AgentRegistration{}, false
+	}
+	return *reg, true
+}
+
+func (s *agentRegistrationStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, reg := range s.items {
+		if reg.Status == registrationPending {
+			n++
+		}
+	}
+	return n
+}
+
+// Request records a call from an agent and returns its registration,
+// filing a pending one for a site seen for the first time. It fails with
+// errRegistrationKey when the caller's key is not the one the site
+// registered with; a site approved before its agent called is bound to
+// the first key presented.
+func (s *agentRegistrationStore) Request(in AgentRegistration) (AgentRegistration, error) {
+	now := float64(time.Now().Unix())
+	sum := agentKeyHash(in.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.items[in.Site]
+	switch {
+	case !ok:
+		reg = &AgentRegistration{Site: in.Site, Status: registrationPending, Requested: now, KeySHA256: sum}
+		s.items[in.Site] = reg
+		agentRegistrationEvents.WithLabelValues("requested").Inc()
+		fmt.Printf("[agents] %s registered from %s (%s), waiting for approval\n", in.Site, in.Address, in.Hostname)
+	case reg.KeySHA256 == "":
+		reg.KeySHA256 = sum
+		fmt.Printf("[agents] %s bound to the key of the agent at %s (%s)\n", in.Site, in.Address, in.Hostname)
+	case subtle.ConstantTimeCompare([]byte(sum), []byte(reg.KeySHA256)) != 1:
+		agentRegistrationEvents.WithLabelValues("wrong_key").Inc()
+		fmt.Printf("[agents] %s: refused a caller at %s (%s) with another key\n", in.Site, in.Address, in.Hostname)
+		return AgentRegistration{}, errRegistrationKey
+	}
+	reg.LastSeen, reg.Hostname, reg.Version, reg.Address = now, in.Hostname, in.Version, in.Address
+	return *reg, s.save()
+}
+
+// Decide approves or rejects site, filing the registration if the agent
+// has not called yet. An approval with a spec (compiled as c) replaces the
+// site's approved settings, one without keeps them; a rejection drops them.
+func (s *agentRegistrationStore) Decide(site, status, by, reason string, spec json.RawMessage, c siteConfig) (AgentRegistration, error) {
+	s.mu.Lock()
+	now := float64(time.Now().Unix())
+	reg, ok := s.items[site]
+	if !ok {
+		reg = &AgentRegistration{Site: site, Requested: now}
+		s.items[site] = reg
+	}
+	reg.Status, reg.Decided, reg.DecidedBy, reg.Reason = status, now, by, reason
+	switch {
+	case status != registrationApproved:
+		reg.Spec = nil
+		delete(s.sites, site)
+	case spec != nil:
+		reg.Spec = spec
+		s.sites[site] = c
+	}
+	agentRegistrationEvents.WithLabelValues(status).Inc()
+	out, err := *reg, s.save()
+	s.mu.Unlock()
+	rebuildSiteRegistry()
+	return out, err
+}
+
+func (s *agentRegistrationStore) Delete(site string) error {
+	s.mu.Lock()
+	if _, ok := s.items[site]; !ok {
+		s.mu.Unlock()
+		return os.ErrNotExist
+	}
+	delete(s.items, site)
+	delete(s.sites, site)
+	err := s.save()
+	s.mu.Unlock()
+	rebuildSiteRegistry()
+	return err
+}
+
+// registrationRequest reads a registering agent's call to
+// /api/v1/agent/token, or reports false when tok is not the registration
+// token.
+func registrationRequest(r *http.Request, tok string) (AgentRegistration, bool, error) {
+	var in struct {
+		Site     string `json:"site"`
+		Key      string `json:"key"`
+		Hostname string `json:"hostname"`
+		Version  string `json:"version"`
+	}
+	if agentRegistrationToken == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(agentRegistrationToken)) != 1 {
+		return AgentRegistration{}, false, nil
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil && err != io.EOF {
+		return AgentRegistration{}, true, err
+	}
+	reg := AgentRegistration{Site: strings.TrimSpace(in.Site), Hostname: in.Hostname, Version: in.Version, Address: r.RemoteAddr, key: in.Key}
+	if reg.Site == "" || strings.ContainsAny(reg.Site, "/ ") {
+		return reg, true, errors.New("a registering agent must name its site")
+	}
+	if len(in.Key) < agentKeyMinLength {
+		return reg, true, fmt.Errorf("a registering agent must send a key of at least %d characters", agentKeyMinLength)
+	}
+	if _, ok := agentBootstrapTokens[reg.Site]; ok {
+		return reg, true, errSiteBootstrapped
+	}
+	return reg, true, nil
+}
+
+// approvalSpec turns an approve body into the site's managed spec, or nil
+// when the body is empty and the site's configuration should stay as it is.
+func approvalSpec(site string, body []byte) ([]byte, error) {
+	var spec map[string]interface{}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &spec); err != nil {
+			return nil, err
+		}
+	}
+	if len(spec) == 0 {
+		if _, ok := siteRegistry().Sites[site]; ok {
+			return nil, nil
+		}
+		return []byte("{}"), nil
+	}
+	into := func(field, key string, v interface{}) error {
+		m, _ := spec[field].(map[string]interface{})
+		if m == nil {
+			if spec[field] != nil {
+				return fmt.Errorf("%s must be an object", field)
+			}
+			m = map[string]interface{}{}
+		}
+		m[key] = fmt.Sprint(v)
+		spec[field] = m
+		return nil
+	}
+	if v, ok := spec["tier"]; ok {
+		delete(spec, "tier")
+		if err := into("tags", "tier", v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := spec["tenant"]; ok {
+		delete(spec, "tenant")
+		if err := into("metadata", "tenant", v); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(spec)
+}
+
+// handleAgentRegistrations serves GET /api/v1/agent/registrations.
+func handleAgentRegistrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"registrations": agentRegistrations.List(r.URL.Query().Get("status")),
+	})
+}
+
+// handleAgentRegistration serves /api/v1/agent/registrations/{site}[/approve|/reject].
+func handleAgentRegistration(w http.ResponseWriter, r *http.Request) {
+	site, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/agent/registrations/"), "/")
+	if site == "" {
+		http.Error(w, "want /api/v1/agent/registrations/{site}", http.StatusNotFound)
+		return
+	}
+	p := apiPrincipal(r)
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	by := "admin"
+	if p != nil && p.Name != "" {
+		by = p.Name
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		reg, ok := agentRegistrations.Get(site)
+		if !ok {
+			http.Error(w, "no registration for "+site, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, reg)
+	case action == "" && r.Method == http.MethodDelete:
+		err := agentRegistrations.Delete(site)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "no registration for "+site, http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			fmt.Printf("[agents] %s registration deleted by %s\n", site, by)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case action == "approve" && r.Method == http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec, err := approvalSpec(site, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var c siteConfig
+		if spec != nil {
+			if spec, err = canonicalJSON(spec); err == nil {
+				c, err = compileSiteSpec(spec)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("sites/%s: %v", site, err), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		reg, err := agentRegistrations.Decide(site, registrationApproved, by, "", spec, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("[agents] %s approved by %s\n", site, by)
+		writeJSON(w, http.StatusOK, reg)
+	case action == "reject" && r.Method == http.MethodPost:
+		var in struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reg, err := agentRegistrations.Decide(site, registrationRejected, by, in.Reason, nil, siteConfig{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("[agents] %s rejected by %s\n", site, by)
+		writeJSON(w, http.StatusOK, reg)
+	case action == "" || action == "approve" || action == "reject":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "unknown action "+action, http.StatusNotFound)
+	}
+}
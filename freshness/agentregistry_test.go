@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withAgentRegistry points the registration, managed and site stores at
+// fresh state for one test.
+func withAgentRegistry(t *testing.T) {
+	t.Helper()
+	savedRegs, savedManaged, savedToken, savedBoot, savedAPI := agentRegistrations, managed, agentRegistrationToken, agentBootstrapTokens, apiToken
+	savedFile, savedSites := sitesFromFile, sitesCurrent.Load()
+	t.Cleanup(func() {
+		agentRegistrations, managed, agentRegistrationToken, agentBootstrapTokens, apiToken = savedRegs, savedManaged, savedToken, savedBoot, savedAPI
+		sitesFromFile = savedFile
+		sitesCurrent.Store(savedSites)
+		forgottenSites.Range(func(k, _ any) bool { forgottenSites.Delete(k); return true })
+	})
+	dir := t.TempDir()
+	agentRegistrations = &agentRegistrationStore{path: filepath.Join(dir, "registrations.json"), items: map[string]*AgentRegistration{}, sites: map[string]siteConfig{}}
+	managed = &managedStore{
+		path:   filepath.Join(dir, "managed.json"),
+		specs:  map[string]map[string]json.RawMessage{"sites": {}, "checks": {}, "routes": {}},
+		sites:  map[string]siteConfig{},
+		checks: map[string]*managedCheck{},
+	}
+	agentRegistrationToken, apiToken = "reg-token", "admin-token"
+	agentBootstrapTokens = map[string]string{"SITE_BOOT": "boot-token"}
+	sitesFromFile = &sitesFile{Sites: map[string]siteConfig{}}
+	rebuildSiteRegistry()
+}
+
+// exchange asks for an ingestion token with the registration token.
+func exchange(site, key string) (int, string) {
+	body, _ := json.Marshal(map[string]string{"site": site, "key": key})
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/agent/token", strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Bearer reg-token")
+	w := httptest.NewRecorder()
+	handleAgentToken(w, r)
+	var out struct{ Site string }
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out.Site
+}
+
+func adminCall(method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(path, "/api/v1/managed/") {
+		handleManagedEntry(w, r)
+	} else {
+		handleAgentRegistration(w, r)
+	}
+	return w
+}
+
+func TestAgentRegistrationKey(t *testing.T) {
+	withAgentRegistry(t)
+	const keyA, keyB, keyC = "key-of-agent-a-0001", "key-of-agent-b-0002", "key-of-agent-c-0003"
+	for _, tc := range []struct {
+		name      string
+		approve   string // site an admin approves before the call
+		site, key string
+		want      int
+	}{
+		{"first contact files a registration", "", "SITE_A", keyA, http.StatusAccepted},
+		{"same agent asks again", "", "SITE_A", keyA, http.StatusAccepted},
+		{"another agent names the site", "", "SITE_A", keyB, http.StatusForbidden},
+		{"no key", "", "SITE_X", "", http.StatusBadRequest},
+		{"short key", "", "SITE_X", "short", http.StatusBadRequest},
+		{"site with a bootstrap token", "", "SITE_BOOT", keyB, http.StatusForbidden},
+		{"approved", "SITE_A", "SITE_A", keyA, http.StatusOK},
+		{"approved, wrong key", "", "SITE_A", keyB, http.StatusForbidden},
+		{"pre-approved site binds the first key", "SITE_C", "SITE_C", keyC, http.StatusOK},
+		{"then refuses others", "", "SITE_C", keyA, http.StatusForbidden},
+	} {
+		if tc.approve != "" {
+			if w := adminCall(http.MethodPost, "/api/v1/agent/registrations/"+tc.approve+"/approve", ""); w.Code != http.StatusOK {
+				t.Fatalf("%s: approve %s: %d %s", tc.name, tc.approve, w.Code, w.Body)
+			}
+		}
+		code, site := exchange(tc.site, tc.key)
+		if code != tc.want || code == http.StatusOK && site != tc.site {
+			t.Errorf("%s: %d for %q, want %d", tc.name, code, site, tc.want)
+		}
+	}
+	if reg, _ := agentRegistrations.Get("SITE_A"); reg.KeySHA256 != agentKeyHash(keyA) || strings.Contains(reg.KeySHA256, keyA) {
+		t.Errorf("SITE_A key hash %q", reg.KeySHA256)
+	}
+}
+
+// dtms-operator deletes every managed entry no resource backs, so an
+// approved site must not depend on one.
+func TestApprovedSiteOutlivesOperatorPrune(t *testing.T) {
+	withAgentRegistry(t)
+	tenant := func() string { return siteRegistry().lookup("SITE_A").Metadata["tenant"] }
+	if w := adminCall(http.MethodPost, "/api/v1/agent/registrations/SITE_A/approve", `{"tenant": "t1", "tier": 2}`); w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	if _, listed := managed.Snapshot()["sites"]["SITE_A"]; listed {
+		t.Fatal("the approval became a managed entry the operator would prune")
+	}
+	if tenant() != "t1" || siteRegistry().lookup("SITE_A").Metadata["tier"] != "2" {
+		t.Fatalf("approved settings not in effect: %v", siteRegistry().lookup("SITE_A").Metadata)
+	}
+
+	// a Site resource of the same name overrides the approval while it
+	// exists, and the approval is back once the operator prunes it
+	if w := adminCall(http.MethodPut, "/api/v1/managed/sites/SITE_A", `{"metadata": {"tenant": "t2"}}`); w.Code/100 != 2 {
+		t.Fatalf("operator put: %d %s", w.Code, w.Body)
+	}
+	if tenant() != "t2" {
+		t.Errorf("managed entry not layered over the approval: tenant %q", tenant())
+	}
+	if w := adminCall(http.MethodDelete, "/api/v1/managed/sites/SITE_A", ""); w.Code/100 != 2 {
+		t.Fatalf("operator delete: %d %s", w.Code, w.Body)
+	}
+	if tenant() != "t1" {
+		t.Errorf("after the operator pruned its entry tenant is %q, want the approved t1", tenant())
+	}
+
+	// re-approving without a body keeps the settings; rejecting drops them
+	if w := adminCall(http.MethodPost, "/api/v1/agent/registrations/SITE_A/approve", ""); w.Code != http.StatusOK || tenant() != "t1" {
+		t.Errorf("re-approve: %d, tenant %q", w.Code, tenant())
+	}
+	if w := adminCall(http.MethodPost, "/api/v1/agent/registrations/SITE_A/reject", `{"reason": "gone"}`); w.Code != http.StatusOK || tenant() != "" {
+		t.Errorf("reject: %d, tenant %q", w.Code, tenant())
+	}
+}
+
+func TestAgentRegistrationsReload(t *testing.T) {
+	withAgentRegistry(t)
+	if w := adminCall(http.MethodPost, "/api/v1/agent/registrations/SITE_A/approve", `{"tenant": "t1"}`); w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	if code, _ := exchange("SITE_A", "key-of-agent-a-0001"); code != http.StatusOK {
+		t.Fatalf("exchange: %d", code)
+	}
+	agentRegistrations = &agentRegistrationStore{path: agentRegistrations.path, items: map[string]*AgentRegistration{}, sites: map[string]siteConfig{}}
+	rebuildSiteRegistry()
+	if err := agentRegistrations.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := siteRegistry().lookup("SITE_A").Metadata["tenant"]; got != "t1" {
+		t.Errorf("tenant after reload %q", got)
+	}
+	if code, _ := exchange("SITE_A", "key-of-agent-b-0002"); code != http.StatusForbidden {
+		t.Errorf("another key after reload: %d", code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Site agents should not hold a long-lived credential that can write for
+// every site. Each agent instead keeps a bootstrap token for its own site
+// (AGENT_BOOTSTRAP_TOKENS=SITE_A=...,SITE_B=...) and exchanges it at
+// POST /api/v1/agent/token for an ingestion token that expires after
+// AGENT_TOKEN_TTL_SECONDS. The ingestion token is accepted as the bearer
+// token of any /webhooks/ source, but only for events of its site.
+//
+// Tokens are signed with AGENT_TOKEN_KEY; without one a key is generated
+// at startup and agents simply exchange again after a restart.
+var (
+	agentBootstrapTokens = parseKeyValues(envOr("AGENT_BOOTSTRAP_TOKENS", ""))
+	agentTokenTTL        = time.Duration(envOrInt("AGENT_TOKEN_TTL_SECONDS", 900)) * time.Second
+	agentTokenKey        = agentSigningKey(envOr("AGENT_TOKEN_KEY", ""))
+)
+
+const agentTokenPrefix = "dtms1."
+
+var errAgentToken = errors.New("invalid or expired agent token")
+
+var agentTokensIssued = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_agent_tokens_issued_total", Help: "Site-scoped ingestion tokens issued to agents"},
+	[]string{"site"},
+)
+
+func init() {
+	prometheus.MustRegister(agentTokensIssued)
+}
+
+func agentSigningKey(configured string) []byte {
+	if configured != "" {
+		return []byte(configured)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+type agentClaims struct {
+	Site    string `json:"site"`
+	Issued  int64  `json:"iat"`
+	Expires int64  `json:"exp"`
+}
+
+func signAgentToken(c agentClaims) string {
+	payload, _ := json.Marshal(c)
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, agentTokenKey)
+	mac.Write([]byte(body))
+	return agentTokenPrefix + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAgentToken verifies tok and returns the site it may write for.
+func parseAgentToken(tok string, now time.Time) (string, error) {
+	rest, ok := strings.CutPrefix(tok, agentTokenPrefix)
+	body, sig, ok2 := strings.Cut(rest, ".")
+	if !ok || !ok2 {
+		return "", errAgentToken
+	}
+	mac := hmac.New(sha256.New, agentTokenKey)
+	mac.Write([]byte(body))
+	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(want)) != 1 {
+		return "", errAgentToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", errAgentToken
+	}
+	var c agentClaims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Site == "" || now.Unix() >= c.Expires {
+		return "", errAgentToken
+	}
+	return c.Site, nil
+}
+
+// bootstrapSite returns the site whose bootstrap token tok is.
+func bootstrapSite(tok string) (string, bool) {
+	if tok == "" {
+		return "", false
+	}
+	for site, want := range agentBootstrapTokens {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(want)) == 1 {
+			return site, true
+		}
+	}
+	return "", false
+}
+
+// handleAgentToken serves POST /api/v1/agent/token, exchanging a bootstrap
+// bearer token for a short-lived ingestion token for its site, or the
+// registration token for one for an approved site (agentregistry.go).
+func handleAgentToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	site, ok := bootstrapSite(tok)
+	if !ok {
+		in, registering, err := registrationRequest(r, tok)
+		switch {
+		case !registering:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case errors.Is(err, errSiteBootstrapped):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reg, err := agentRegistrations.Request(in)
+		switch {
+		case errors.Is(err, errRegistrationKey):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch reg.Status {
+		case registrationPending:
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"site": reg.Site, "status": reg.Status})
+			return
+		case registrationRejected:
+			http.Error(w, "registration of "+reg.Site+" was rejected: "+reg.Reason, http.StatusForbidden)
+			return
+		}
+		site = reg.Site
+	}
+	now := time.Now()
+	c := agentClaims{Site: site, Issued: now.Unix(), Expires: now.Add(agentTokenTTL).Unix()}
+	agentTokensIssued.WithLabelValues(site).Inc()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      signAgentToken(c),
+		"site":       site,
+		"expires_at": c.Expires,
+	})
+}
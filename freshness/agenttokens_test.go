@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAgentToken(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	valid := signAgentToken(agentClaims{Site: "SITE_A", Issued: now.Unix(), Expires: now.Add(15 * time.Minute).Unix()})
+	body, sig, _ := strings.Cut(strings.TrimPrefix(valid, agentTokenPrefix), ".")
+	forged := agentTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"site":"SITE_B","iat":1,"exp":9999999999}`)) + "." + sig
+	for _, tc := range []struct {
+		name, token string
+		at          time.Time
+		site        string
+	}{
+		{"valid", valid, now, "SITE_A"},
+		{"just before expiry", valid, now.Add(15*time.Minute - time.Second), "SITE_A"},
+		{"expired", valid, now.Add(15 * time.Minute), ""},
+		{"claims swapped under the signature", forged, now, ""},
+		{"signature cut", agentTokenPrefix + body + "." + sig[:len(sig)-2], now, ""},
+		{"no signature", agentTokenPrefix + body, now, ""},
+		{"wrong prefix", "dtms0." + body + "." + sig, now, ""},
+		{"no site", signAgentToken(agentClaims{Expires: now.Add(time.Hour).Unix()}), now, ""},
+		{"not base64", signedBody("!!!"), now, ""},
+		{"not JSON", signedBody(base64.RawURLEncoding.EncodeToString([]byte("site=SITE_A"))), now, ""},
+		{"empty", "", now, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			site, err := parseAgentToken(tc.token, tc.at)
+			if site != tc.site || (tc.site == "") != (err != nil) {
+				t.Errorf("got %q, %v, want %q", site, err, tc.site)
+			}
+		})
+	}
+}
+
+// signedBody is a token with a valid signature over an arbitrary body.
+func signedBody(body string) string {
+	return agentTokenPrefix + body + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(agentTokenKey, body))
+}
+
+func TestParseAgentTokenOtherKey(t *testing.T) {
+	saved := agentTokenKey
+	t.Cleanup(func() { agentTokenKey = saved })
+	agentTokenKey = []byte("first")
+	tok := signAgentToken(agentClaims{Site: "SITE_A", Expires: time.Now().Add(time.Hour).Unix()})
+	agentTokenKey = []byte("second")
+	if site, err := parseAgentToken(tok, time.Now()); err == nil {
+		t.Fatalf("token signed with another key accepted for %s", site)
+	}
+}
+
+func TestBootstrapSite(t *testing.T) {
+	saved := agentBootstrapTokens
+	t.Cleanup(func() { agentBootstrapTokens = saved })
+	agentBootstrapTokens = map[string]string{"SITE_A": "boot-a", "SITE_B": "boot-b"}
+	for _, tc := range []struct {
+		token, site string
+		ok          bool
+	}{
+		{"boot-a", "SITE_A", true},
+		{"boot-b", "SITE_B", true},
+		{"boot-c", "", false},
+		{"boot-", "", false},
+		{"", "", false},
+	} {
+		if site, ok := bootstrapSite(tc.token); site != tc.site || ok != tc.ok {
+			t.Errorf("bootstrapSite(%q) = %q, %v", tc.token, site, ok)
+		}
+	}
+}
+
+// An agent token authorizes any webhook source, scoped to its site.
+func TestWebhookVerifyAgentToken(t *testing.T) {
+	tok := signAgentToken(agentClaims{Site: "SITE_A", Expires: time.Now().Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		name, bearer, reason, scope string
+	}{
+		{"valid", tok, "", "SITE_A"},
+		{"bad", tok + "x", "agent_token", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/webhooks/rclone", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.bearer)
+			if reason, scope := webhookVerify("rclone", r, nil); reason != tc.reason || scope != tc.scope {
+				t.Errorf("got %q, %q, want %q, %q", reason, scope, tc.reason, tc.scope)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/events"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// Alert routes deliver incident notifications straight to webhooks, for
+// teams without an Alertmanager of their own. A route picks sites by name
+// or tag selector and lists the events it wants:
+//
+//	{"tags": "tier=1,region=eu-west", "url": "https://hooks.example.org/dtms",
+//	 "events": ["opened", "resolved"], "headers": {"X-Team": "storage"}}
+//
+// Besides incidents being opened and resolved, routes can take
+// arrival_missed and arrival_late for expected arrivals. Each matching
+// event is POSTed as {"event", "route", "site", "tags", and "incident" or
+// "expected_arrival"}, or as rendered by the route's `template` (templates.go),
+// retried twice; content_type overrides the type guessed from the body.
+// Routes are part of the managed configuration (managed.go), normally
+// from AlertRoute resources.
+type alertRoute struct {
+	name        string
+	Tags        string            `yaml:"tags"`
+	Sites       []string          `yaml:"sites"`
+	URL         string            `yaml:"url"`
+	Events      []string          `yaml:"events"`
+	Headers     map[string]string `yaml:"headers"`
+	Template    string            `yaml:"template"`
+	ContentType string            `yaml:"content_type"`
+
+	sel  tagSelector
+	tmpl *texttemplate.Template
+}
+
+const (
+	routeEventOpened   = "opened"
+	routeEventResolved = "resolved"
+	routeEventMissed   = "arrival_missed"
+	routeEventLate     = "arrival_late"
+)
+
+var routeNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_alert_route_notifications_total", Help: "Incident notifications sent through alert routes, by route and result"},
+	[]string{"route", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(routeNotifications)
+}
+
+func compileAlertRoute(name string, raw []byte) (*alertRoute, error) {
+	r := &alertRoute{name: name}
+	if err := yamlenv.Unmarshal(raw, r); err != nil {
+		return nil, err
+	}
+	if r.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	if len(r.Events) == 0 {
+		r.Events = []string{routeEventOpened, routeEventResolved}
+	}
+	for _, e := range r.Events {
+		switch e {
+		case routeEventOpened, routeEventResolved, routeEventMissed, routeEventLate:
+		default:
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+	var err error
+	if r.sel, err = parseTagSelector(r.Tags); err != nil {
+		return nil, err
+	}
+	if r.Template != "" {
+		if r.tmpl, err = parseMessageTemplate(name, r.Template); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *alertRoute) wants(event, site string) bool {
+	found := false
+	for _, e := range r.Events {
+		found = found || e == event
+	}
+	if !found {
+		return false
+	}
+	if len(r.Sites) > 0 {
+		for _, s := range r.Sites {
+			if s == site {
+				return r.sel.selects(site)
+			}
+		}
+		return false
+	}
+	return r.sel.selects(site)
+}
+
+type alertRouteTable struct {
+	mu     sync.RWMutex
+	routes map[string]*alertRoute
+}
+
+var alertRoutes = &alertRouteTable{routes: map[string]*alertRoute{}}
+
+func (t *alertRouteTable) Set(r *alertRoute) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes[r.name] = r
+}
+
+func (t *alertRouteTable) Delete(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.routes, name)
+}
+
+// Start subscribes the routes to the incident and arrival events on the
+// bus.
+func (t *alertRouteTable) Start(ctx context.Context) {
+	sub := bus.Subscribe("alert-routes", 256, "incident.*", "arrival.*")
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-sub.C:
+				switch ev.Type {
+				case eventIncidentOpened:
+					t.Notify(routeEventOpened, ev)
+				case eventIncidentResolved:
+					t.Notify(routeEventResolved, ev)
+				case eventArrivalMissed:
+					t.Notify(routeEventMissed, ev)
+				case eventArrivalLate:
+					t.Notify(routeEventLate, ev)
+				}
+			}
+		}
+	}()
+}
+
+// Notify sends event for the incident or expected arrival in ev to every
+// route that wants it, in the background.
+func (t *alertRouteTable) Notify(event string, ev events.Event) {
+	var site, key string
+	switch d := ev.Data.(type) {
+	case Incident:
+		site, key = d.Site, "incident"
+	case ExpectedArrival:
+		site, key = d.Site, "expected_arrival"
+	default:
+		return
+	}
+	t.mu.RLock()
+	var matched []*alertRoute
+	for _, r := range t.routes {
+		if r.wants(event, site) {
+			matched = append(matched, r)
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(matched, func(i, j int) bool { return matched[i].name < matched[j].name })
+	tags := siteRegistry().lookup(site).Metadata
+	for _, r := range matched {
+		body, _ := json.Marshal(map[string]interface{}{
+			"event": event,
+			"route": r.name,
+			"site":  site,
+			"tags":  tags,
+			key:     ev.Data,
+		})
+		ctype := "application/json"
+		if r.tmpl != nil {
+			text, err := renderTemplate(r.tmpl, eventMessage(ev))
+			if err != nil {
+				routeNotifications.WithLabelValues(r.name, "error").Inc()
+				fmt.Printf("[alert-routes] route=%s: template: %v\n", r.name, err)
+				continue
+			}
+			body, ctype = []byte(text), triggerContentType(text)
+		}
+		if r.ContentType != "" {
+			ctype = r.ContentType
+		}
+		go r.deliver(body, ctype)
+	}
+}
+
+func (r *alertRoute) deliver(body []byte, ctype string) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		if err = r.post(body, ctype); err == nil {
+			routeNotifications.WithLabelValues(r.name, "ok").Inc()
+			return
+		}
+	}
+	routeNotifications.WithLabelValues(r.name, "error").Inc()
+	fmt.Printf("[alert-routes] route=%s: %v\n", r.name, err)
+}
+
+func (r *alertRoute) post(body []byte, ctype string) error {
+	req, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ctype)
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// -alert-rules FILE writes a Prometheus rule file for this deployment and
+// exits instead of serving ("-" writes it to stdout). The rules are built
+// from the same configuration the service would run with:
+//
+//   - staleness: DTMSSiteStale on dtms_data_fresh_ok, and DTMSSiteVeryStale
+//     once a site is -alert-rules-critical-factor times past its
+//     SITES_CONFIG threshold, one rule per distinct threshold, and
+//     DTMSBacklogGrowing while a fresh site's age keeps climbing
+//   - SLOs: the multi-window burn-rate alerts for every distinct SLO
+//     window, scaled so each fires at the same share of the budget whatever
+//     the window, from the SLO_BURN_WINDOWS that are exported
+//   - exporters: any of -alert-rules-jobs down, or a source that has not
+//     collected for ten poll intervals
+//   - buffers: agent-reported buffer areas past their warn_percent of space
+//     or inodes, or no longer reported
+//   - expected arrivals: a scheduled arrival that was missed, whatever the
+//     site's age
+//   - cardinality: a job scraping more than -alert-rules-max-series
+//     samples, or adding a tenth of that in new series within an hour
+//
+// Sites managed through the API are not in the file and get the default
+// threshold and SLO. Regenerate the file whenever SITES_CONFIG changes.
+var (
+	alertRulesPath   = flag.String("alert-rules", "", "write Prometheus alerting rules for the configuration to this file (- for stdout) and exit")
+	alertRulesJobs   = flag.String("alert-rules-jobs", "dtms_exporters,dtms_anomaly,dtms_freshness", "comma-separated Prometheus jobs to alert on when down")
+	alertRulesFactor = flag.Float64("alert-rules-critical-factor", 4, "multiple of a site's threshold at which staleness becomes critical")
+	alertRulesSeries = flag.Int("alert-rules-max-series", 50000, "samples per scrape above which a job's cardinality is alerted on")
+)
+
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+type alertRuleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+// A burn-rate alert fires when both windows spend the budget at the rate
+// that uses up Budget of it within Long.
+type burnAlert struct {
+	Name        string
+	Long, Short time.Duration
+	Budget      float64
+	Severity    string
+}
+
+var burnAlerts = []burnAlert{
+	{"DTMSFreshnessBudgetFastBurn", time.Hour, 5 * time.Minute, 0.02, "critical"},
+	{"DTMSFreshnessBudgetSlowBurn", 6 * time.Hour, 30 * time.Minute, 0.05, "warning"},
+	{"DTMSFreshnessBudgetDrain", 72 * time.Hour, 6 * time.Hour, 0.10, "info"},
+}
+
+// siteSelector groups sites by a per-site value: the sites with their own
+// value are matched by name and every other site falls to the default.
+type siteSelector struct {
+	Value   string
+	Matcher string // label matcher on site, empty for all sites
+}
+
+func siteSelectors(values map[string]string, def string) []siteSelector {
+	bySite := map[string][]string{}
+	var others []string
+	for site, v := range values {
+		if v == def {
+			continue
+		}
+		bySite[v] = append(bySite[v], regexp.QuoteMeta(site))
+		others = append(others, regexp.QuoteMeta(site))
+	}
+	var out []siteSelector
+	if def != "" {
+		s := siteSelector{Value: def}
+		if len(others) > 0 {
+			sort.Strings(others)
+			s.Matcher = fmt.Sprintf(`site!~"%s"`, strings.Join(others, "|"))
+		}
+		out = append(out, s)
+	}
+	vals := make([]string, 0, len(bySite))
+	for v := range bySite {
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	for _, v := range vals {
+		sites := bySite[v]
+		sort.Strings(sites)
+		out = append(out, siteSelector{Value: v, Matcher: fmt.Sprintf(`site=~"%s"`, strings.Join(sites, "|"))})
+	}
+	return out
+}
+
+// selector renders matchers as a PromQL label selector.
+func selector(matchers ...string) string {
+	var nonEmpty []string
+	for _, m := range matchers {
+		if m != "" {
+			nonEmpty = append(nonEmpty, m)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(nonEmpty, ", ") + "}"
+}
+
+func promFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func freshnessRules(reg *sitesFile) []alertRule {
+	stale := "dtms_data_fresh_ok == 0 unless on (site) dtms_site_in_downtime == 1"
+	if len(metricsTagLabels) > 0 {
+		stale = fmt.Sprintf("(%s) * on (site) group_left (%s) dtms_site_tags", stale, strings.Join(metricsTagLabels, ", "))
+	}
+	rules := []alertRule{{
+		Alert:  "DTMSSiteStale",
+		Expr:   stale,
+		For:    model.Duration(2 * time.Duration(interval) * time.Second).String(),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "{{ $labels.site }} is stale",
+			"description": "No fresh data at {{ $labels.site }}.\n" +
+				"{{ with printf \"dtms_stale_hint{site='%s'}\" $labels.site | query }}{{ range . }}- {{ .Labels.hint }}\n" +
+				"{{ end }}{{ else }}No hints gathered.{{ end }}\n",
+		},
+	}}
+
+	thresholds := map[string]string{}
+	for site, c := range reg.Sites {
+		if c.Threshold > 0 {
+			thresholds[site] = promFloat(c.Threshold)
+		}
+	}
+	for _, s := range siteSelectors(thresholds, promFloat(reg.lookup("").Threshold)) {
+		t, _ := strconv.ParseFloat(s.Value, 64)
+		limit := t * *alertRulesFactor
+		rules = append(rules, alertRule{
+			Alert:  "DTMSSiteVeryStale",
+			Expr:   fmt.Sprintf("dtms_data_fresh_seconds%s > %s unless on (site) dtms_site_in_downtime == 1", selector(s.Matcher), promFloat(limit)),
+			For:    "5m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.site }} has been stale for a long time",
+				"description": fmt.Sprintf("No transfer has arrived for {{ $value | humanizeDuration }}, over %s times the site's %s threshold.", promFloat(*alertRulesFactor), model.Duration(t*float64(time.Second))),
+			},
+		})
+	}
+	rules = append(rules, alertRule{
+		Alert:  "DTMSBacklogGrowing",
+		Expr:   "avg_over_time(dtms_data_fresh_delta_seconds_per_minute[15m]) > 45\n  and on (site) dtms_data_fresh_ok == 1\n",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary":     "{{ $labels.site }} is falling behind",
+			"description": "Its age has grown by {{ $value | printf \"%.0f\" }}s a minute for 15 minutes; little or nothing is arriving though it is still within its threshold.",
+		},
+	})
+	rules = append(rules, alertRule{
+		Alert:  "DTMSNoFreshnessData",
+		Expr:   "absent(dtms_data_fresh_seconds)",
+		For:    "10m",
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary":     "The freshness service reports no sites",
+			"description": "Either no source returns any site or the service is not being scraped.",
+		},
+	})
+	return rules
+}
+
+func sloRules(reg *sitesFile) []alertRule {
+	windows := map[string]string{}
+	for site, c := range reg.Sites {
+		if c.SLO != nil {
+			windows[site] = promFloat(c.SLO.window().Hours() / 24)
+		}
+	}
+	def := ""
+	if reg.Defaults.SLO != nil {
+		def = promFloat(reg.Defaults.SLO.window().Hours() / 24)
+	}
+	exported := map[time.Duration]bool{}
+	for _, w := range sloBurnWindows {
+		exported[w] = true
+	}
+
+	var rules []alertRule
+	for _, s := range siteSelectors(windows, def) {
+		days, _ := strconv.ParseFloat(s.Value, 64)
+		window := time.Duration(days * 24 * float64(time.Hour))
+		for _, b := range burnAlerts {
+			if !exported[b.Long] || !exported[b.Short] {
+				fmt.Fprintf(os.Stderr, "[alert-rules] skipping %s: SLO_BURN_WINDOWS lacks %s or %s\n", b.Name, b.Long, b.Short)
+				continue
+			}
+			rate := promFloat(b.Budget * window.Hours() / b.Long.Hours())
+			rules = append(rules, alertRule{
+				Alert: b.Name,
+				Expr: fmt.Sprintf("dtms_slo_burn_rate%s > %s\n  and on (site) dtms_slo_burn_rate%s > %s\n",
+					selector(fmt.Sprintf(`window=%q`, b.Long), s.Matcher), rate,
+					selector(fmt.Sprintf(`window=%q`, b.Short), s.Matcher), rate),
+				Labels: map[string]string{"severity": b.Severity},
+				Annotations: map[string]string{
+					"summary":     "{{ $labels.site }} is burning its freshness error budget",
+					"description": fmt.Sprintf("At this rate %s%% of the %s-day error budget is gone within %s.", promFloat(b.Budget*100), s.Value, model.Duration(b.Long)),
+				},
+			})
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return append(rules, alertRule{
+		Alert:  "DTMSFreshnessBudgetExhausted",
+		Expr:   "dtms_slo_error_budget_remaining_ratio <= 0",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary":     "{{ $labels.site }} has missed its freshness SLO",
+			"description": "The site has been stale more often than its objective allows over the SLO window.",
+		},
+	})
+}
+
+func exporterRules(jobs string) []alertRule {
+	return []alertRule{
+		{
+			Alert:  "DTMSExporterDown",
+			Expr:   fmt.Sprintf("up%s == 0", selector(jobs)),
+			For:    "5m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.job }} target {{ $labels.instance }} is down",
+				"description": "Prometheus has failed to scrape {{ $labels.instance }} for five minutes; its sites' freshness is not being measured.",
+			},
+		},
+		{
+			Alert:  "DTMSSourceFailing",
+			Expr:   fmt.Sprintf("time() - dtms_source_last_success_timestamp_seconds > %d", 10*interval),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Freshness source {{ $labels.source }} is failing",
+				"description": "The source has not collected successfully for {{ $value | humanizeDuration }}; its sites keep their last ages.",
+			},
+		},
+	}
+}
+
+func bufferRules() []alertRule {
+	return []alertRule{
+		{
+			Alert:  "DTMSBufferNearFull",
+			Expr:   "1 - dtms_buffer_free_bytes / dtms_buffer_size_bytes >= on (site, buffer) dtms_buffer_warn_ratio",
+			For:    "10m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Buffer {{ $labels.buffer }} at {{ $labels.site }} is nearly full",
+				"description": "{{ $value | humanizePercentage }} of the space is used; transfers into it stall once it fills.",
+			},
+		},
+		{
+			Alert:  "DTMSBufferInodesNearFull",
+			Expr:   "1 - dtms_buffer_inodes_free / dtms_buffer_inodes >= on (site, buffer) dtms_buffer_warn_ratio",
+			For:    "10m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Buffer {{ $labels.buffer }} at {{ $labels.site }} is running out of inodes",
+				"description": "{{ $value | humanizePercentage }} of the inodes are used; many small files can fill it with space to spare.",
+			},
+		},
+		{
+			Alert:  "DTMSBufferReportsMissing",
+			Expr:   "time() - dtms_buffer_report_timestamp_seconds > 900",
+			Labels: map[string]string{"severity": "info"},
+			Annotations: map[string]string{
+				"summary":     "No buffer report from {{ $labels.site }} for {{ $value | humanizeDuration }}",
+				"description": "The agent at {{ $labels.site }} has stopped reporting buffer {{ $labels.buffer }}.",
+			},
+		},
+	}
+}
+
+func expectedArrivalRules() []alertRule {
+	return []alertRule{
+		{
+			Alert:  "DTMSExpectedArrivalMissed",
+			Expr:   "dtms_expected_arrival_missed == 1",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Scheduled data for {{ $labels.site }} did not arrive",
+				"description": "Nothing of {{ with $labels.dataset }}dataset {{ . }}{{ else }}any data{{ end }} arrived within the grace of schedule {{ $labels.schedule }}.",
+			},
+		},
+	}
+}
+
+func cardinalityRules(jobs string) []alertRule {
+	return []alertRule{
+		{
+			Alert:  "DTMSHighCardinality",
+			Expr:   fmt.Sprintf("scrape_samples_scraped%s > %d", selector(jobs), *alertRulesSeries),
+			For:    "15m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.instance }} exposes {{ $value }} samples",
+				"description": "Check METRICS_TAG_LABELS and the number of sites and links; every label value is a series.",
+			},
+		},
+		{
+			Alert:  "DTMSSeriesChurn",
+			Expr:   fmt.Sprintf("sum_over_time(scrape_series_added%s[1h]) > %d", selector(jobs), *alertRulesSeries/10),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.instance }} added {{ $value }} new series in an hour",
+				"description": "A label with unbounded values, such as a request or file ID, is churning series.",
+			},
+		},
+	}
+}
+
+// writeAlertRules generates the rule file for -alert-rules.
+func writeAlertRules(path string) error {
+	var jobs []string
+	for _, j := range strings.Split(*alertRulesJobs, ",") {
+		if j = strings.TrimSpace(j); j != "" {
+			jobs = append(jobs, regexp.QuoteMeta(j))
+		}
+	}
+	jobMatcher := ""
+	if len(jobs) > 0 {
+		jobMatcher = fmt.Sprintf(`job=~"%s"`, strings.Join(jobs, "|"))
+	}
+	reg := siteRegistry()
+	groups := []alertRuleGroup{
+		{Name: "dtms-freshness", Rules: freshnessRules(reg)},
+		{Name: "dtms-slo", Rules: sloRules(reg)},
+		{Name: "dtms-exporters", Rules: exporterRules(jobMatcher)},
+		{Name: "dtms-buffers", Rules: bufferRules()},
+		{Name: "dtms-expected-arrivals", Rules: expectedArrivalRules()},
+		{Name: "dtms-cardinality", Rules: cardinalityRules(jobMatcher)},
+	}
+	out := struct {
+		Groups []alertRuleGroup `yaml:"groups"`
+	}{}
+	for _, g := range groups {
+		if len(g.Rules) > 0 {
+			out.Groups = append(out.Groups, g)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Generated by dtms-freshness -alert-rules from SITES_CONFIG %q; regenerate instead of editing.\n", sitesConfigPath)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	amqpURL            = envOr("AMQP_URL", "")
+	amqpExchange       = envOr("AMQP_EXCHANGE", "transfers")
+	amqpExchangeType   = envOr("AMQP_EXCHANGE_TYPE", "topic")
+	amqpQueue          = envOr("AMQP_QUEUE", "dtms-ingest")
+	amqpBindingKeys    = envOr("AMQP_BINDING_KEYS", "transfer.#")
+	amqpDeadLetterExch = envOr("AMQP_DEAD_LETTER_EXCHANGE", "dtms-ingest-dlx")
+	amqpMaxRedelivery  = envOrInt("AMQP_MAX_REDELIVERIES", 5)
+)
+
+// amqpConsumeLoop bridges the legacy RabbitMQ transfer feed into the
+// ingestion pipeline, reconnecting whenever the connection drops.
+func amqpConsumeLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := amqpConsume(ctx); err != nil {
+			fmt.Printf("[amqp] %v, reconnecting in 10s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func amqpConsume(ctx context.Context) error {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	if err := amqpDeclare(ch); err != nil {
+		return err
+	}
+	if err := ch.Qos(64, 0, false); err != nil {
+		return fmt.Errorf("qos: %w", err)
+	}
+	deliveries, err := ch.Consume(amqpQueue, "dtms-freshness", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+
+	fmt.Printf("[amqp] consuming %s bound to %s (%s)\n", amqpQueue, amqpExchange, amqpBindingKeys)
+	attempts := map[string]int{}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			return fmt.Errorf("connection closed: %v", err)
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			handleAMQPDelivery(d, attempts)
+		}
+	}
+}
+
+// amqpDeclare sets up the exchange, the queue with its dead-letter exchange,
+// and one binding per configured routing key.
+func amqpDeclare(ch *amqp.Channel) error {
+	if err := ch.ExchangeDeclare(amqpExchange, amqpExchangeType, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare exchange: %w", err)
+	}
+	if err := ch.ExchangeDeclare(amqpDeadLetterExch, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare dead-letter exchange: %w", err)
+	}
+	if _, err := ch.QueueDeclare(amqpQueue+".dead", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare dead-letter queue: %w", err)
+	}
+	if err := ch.QueueBind(amqpQueue+".dead", "", amqpDeadLetterExch, false, nil); err != nil {
+		return fmt.Errorf("bind dead-letter queue: %w", err)
+	}
+	args := amqp.Table{"x-dead-letter-exchange": amqpDeadLetterExch}
+	if _, err := ch.QueueDeclare(amqpQueue, true, false, false, false, args); err != nil {
+		return fmt.Errorf("declare queue: %w", err)
+	}
+	for _, key := range strings.Split(amqpBindingKeys, ",") {
+		if err := ch.QueueBind(amqpQueue, strings.TrimSpace(key), amqpExchange, false, nil); err != nil {
+			return fmt.Errorf("bind %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// handleAMQPDelivery acks persisted events and rejects invalid ones to the
+// dead-letter exchange. Messages that keep failing to persist are treated as
+// poison after AMQP_MAX_REDELIVERIES attempts instead of cycling forever.
+func handleAMQPDelivery(d amqp.Delivery, attempts map[string]int) {
+	err := ingest.Ingest("amqp", d.Body)
+	if err == nil {
+		delete(attempts, amqpMessageKey(d))
+		d.Ack(false)
+		return
+	}
+	if errors.Is(err, errInvalidEvent) {
+		fmt.Printf("[amqp] rejecting invalid message: %v\n", err)
+		d.Reject(false)
+		return
+	}
+
+	key := amqpMessageKey(d)
+	attempts[key]++
+	if attempts[key] >= amqpMaxRedelivery {
+		fmt.Printf("[amqp] giving up on message after %d attempts: %v\n", attempts[key], err)
+		deadLetters.Add("amqp", deadLetterPersist, d.Body, err)
+		delete(attempts, key)
+		d.Reject(false)
+		return
+	}
+	fmt.Printf("[amqp] persist error (attempt %d), requeueing: %v\n", attempts[key], err)
+	d.Nack(false, true)
+}
+
+func amqpMessageKey(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	sum := sha256.Sum256(d.Body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Annotations are operators' notes on a time range, optionally tied to a
+// site ("tape library maintenance", "network reroute"). They are returned
+// alongside history queries and, with format=grafana, in the shape
+// Grafana's JSON datasources take for annotation queries. They live in
+// ANNOTATIONS_FILE.
+var annotationsFile = envOr("ANNOTATIONS_FILE", filepath.Join(dataDir, "annotations.json"))
+
+type Annotation struct {
+	ID      string   `json:"id"`
+	Site    string   `json:"site,omitempty"`
+	Start   float64  `json:"start"`
+	End     float64  `json:"end,omitempty"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags,omitempty"`
+	Author  string   `json:"author,omitempty"`
+	Created float64  `json:"created"`
+}
+
+// overlaps reports whether the annotation touches [from, to] and applies
+// to site; annotations without a site apply everywhere.
+func (a Annotation) overlaps(site string, from, to float64) bool {
+	end := a.End
+	if end == 0 {
+		end = a.Start
+	}
+	return (site == "" || a.Site == "" || a.Site == site) && a.Start <= to && end >= from
+}
+
+type annotationStore struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]Annotation
+}
+
+var annotations = &annotationStore{path: annotationsFile, items: map[string]Annotation{}}
+
+func (s *annotationStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Annotation
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range list {
+		s.items[a.ID] = a
+	}
+	return nil
+}
+
+func (s *annotationStore) save() error {
+	list := make([]Annotation, 0, len(s.items))
+	for _, a := range s.items {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+func (s *annotationStore) Add(a Annotation) (Annotation, error) {
+	id := make([]byte, 6)
+	rand.Read(id)
+	a.ID = "an-" + hex.EncodeToString(id)
+	a.Created = float64(time.Now().Unix())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[a.ID] = a
+	return a, s.save()
+}
+
+func (s *annotationStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.items, id)
+	return s.save()
+}
+
+// Query returns the annotations overlapping [from, to] for site (all when
+// empty), oldest first.
+func (s *annotationStore) Query(site string, from, to float64) []Annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Annotation{}
+	for _, a := range s.items {
+		if a.overlaps(site, from, to) {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+// grafanaAnnotation is the row format Grafana's JSON and Infinity
+// datasources map onto annotations; times are in milliseconds.
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Title   string   `json:"title"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+// queryRange reads from and to as unix seconds, defaulting to the last day.
+func queryRange(r *http.Request) (from, to float64) {
+	now := time.Now().Unix()
+	to = float64(queryInt(r, "to", int(now)))
+	from = float64(queryInt(r, "from", int(now-86400)))
+	return from, to
+}
+
+// handleAnnotations serves GET /api/v1/annotations?site=&from=&to=[&format=grafana]
+// and POST /api/v1/annotations.
+func handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		from, to := queryRange(r)
+		list := annotations.Query(r.URL.Query().Get("site"), from, to)
+		if r.URL.Query().Get("format") != "grafana" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"annotations": list})
+			return
+		}
+		out := make([]grafanaAnnotation, 0, len(list))
+		for _, a := range list {
+			g := grafanaAnnotation{Time: int64(a.Start * 1000), TimeEnd: int64(a.End * 1000), Title: a.Site, Text: a.Text, Tags: a.Tags}
+			if a.Site != "" {
+				g.Tags = append([]string{"site:" + a.Site}, a.Tags...)
+			}
+			if g.Tags == nil {
+				g.Tags = []string{}
+			}
+			out = append(out, g)
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		caller := apiPrincipal(r)
+		if caller == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var a Annotation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !caller.canManageSite(a.Site) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if a.Author == "" {
+			a.Author = caller.Name
+		}
+		if a.Text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+		if a.Start == 0 {
+			a.Start = float64(time.Now().Unix())
+		}
+		if a.End != 0 && a.End < a.Start {
+			http.Error(w, "end is before start", http.StatusBadRequest)
+			return
+		}
+		a, err := annotations.Add(a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, a)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAnnotation serves DELETE /api/v1/annotations/{id}.
+func handleAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err := annotations.Delete(strings.TrimPrefix(r.URL.Path, "/api/v1/annotations/"))
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "unknown annotation", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleHistory serves GET /api/v1/history?site=&from=&to=, returning the
+// recorded samples together with the annotations over the same range.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	from, to := queryRange(r)
+	samples, err := history.Query(site, unixTime(from), unixTime(to))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if samples == nil {
+		samples = []HistorySample{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"samples":     samples,
+		"annotations": annotations.Query(site, from, to),
+	})
+}
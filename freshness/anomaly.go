@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Thresholds only fire once a site is already stale. The anomaly score
+// compares each site's current age with an exponentially weighted baseline
+// of its own past ages and reports how many standard deviations above it
+// the site is, so a site that normally refreshes every minute and is now
+// at ten stands out long before a one-hour threshold.
+//
+// With ANOMALY_SEASONALITY=daily or weekly the baseline is kept per hour of
+// the day or of the week (UTC), so sites with a regular schedule are
+// compared with the same time on previous days. Baselines are warmed from
+// the last ANOMALY_HISTORY_DAYS of history at startup.
+var (
+	anomalyHalfLife    = envOrInt("ANOMALY_HALF_LIFE_SAMPLES", 120)
+	anomalyWarmup      = envOrInt("ANOMALY_WARMUP_SAMPLES", 30)
+	anomalyMinStddev   = envOrInt("ANOMALY_MIN_STDDEV_SECONDS", 30)
+	anomalySeasonality = envOr("ANOMALY_SEASONALITY", "none")
+	anomalyHistoryDays = envOrInt("ANOMALY_HISTORY_DAYS", 7)
+)
+
+var gaugeFreshAnomaly = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "dtms_data_fresh_anomaly_score", Help: "Standard deviations the site's age is above its usual age (0 when at or below)"},
+	[]string{"site"},
+)
+
+func init() {
+	prometheus.MustRegister(gaugeFreshAnomaly)
+}
+
+// ewma is an exponentially weighted mean and variance.
+type ewma struct {
+	n          int
+	mean, vari float64
+}
+
+func (e *ewma) add(x, alpha float64) {
+	if e.n == 0 {
+		e.mean = x
+	} else {
+		d := x - e.mean
+		e.mean += alpha * d
+		e.vari = (1 - alpha) * (e.vari + alpha*d*d)
+	}
+	e.n++
+}
+
+type anomalyDetector struct {
+	mu        sync.Mutex
+	alpha     float64
+	baselines map[string]map[int]*ewma
+}
+
+var anomalies = newAnomalyDetector()
+
+func newAnomalyDetector() *anomalyDetector {
+	half := anomalyHalfLife
+	if half <= 0 {
+		half = 120
+	}
+	return &anomalyDetector{
+		alpha:     1 - math.Pow(0.5, 1/float64(half)),
+		baselines: map[string]map[int]*ewma{},
+	}
+}
+
+// season picks the baseline bucket a sample time falls in.
+func season(t time.Time) int {
+	t = t.UTC()
+	switch anomalySeasonality {
+	case "daily":
+		return t.Hour()
+	case "weekly":
+		return int(t.Weekday())*24 + t.Hour()
+	}
+	return 0
+}
+
+// Score returns the anomaly score of age for site at t, then folds age
+// into the baseline.
+func (a *anomalyDetector) Score(site string, age float64, t time.Time) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buckets := a.baselines[site]
+	if buckets == nil {
+		buckets = map[int]*ewma{}
+		a.baselines[site] = buckets
+	}
+	b := buckets[season(t)]
+	if b == nil {
+		b = &ewma{}
+		buckets[season(t)] = b
+	}
+	score := 0.0
+	if b.n >= anomalyWarmup {
+		sd := math.Max(math.Sqrt(b.vari), float64(anomalyMinStddev))
+		score = math.Max(0, (age-b.mean)/sd)
+	}
+	b.add(age, a.alpha)
+	return score
+}
+
+// Warm replays recent history into the baselines.
+func (a *anomalyDetector) Warm(now time.Time) error {
+	if anomalyHistoryDays <= 0 {
+		return nil
+	}
+	samples, err := history.Query("", now.AddDate(0, 0, -anomalyHistoryDays), now)
+	if err != nil {
+		return err
+	}
+	for _, s := range samples {
+		a.Score(s.Site, s.AgeSeconds, unixTime(s.Timestamp))
+	}
+	if len(samples) > 0 {
+		fmt.Printf("[anomaly] warmed baselines from %d history samples\n", len(samples))
+	}
+	return nil
+}
+
+// Observe scores a polled site and exports the result.
+func (a *anomalyDetector) Observe(s SiteFresh, now time.Time) {
+	gaugeFreshAnomaly.WithLabelValues(s.Site).Set(a.Score(s.Site, s.AgeSeconds, now))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// apiToken guards the /api/v1 endpoints that change state.
+var apiToken = envOr("API_TOKEN", "")
+
+// writeJSON is the response path shared by the /api/v1 handlers.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// queryInt reads a positive integer query parameter, falling back to def.
+func queryInt(r *http.Request, key string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// Roles a caller of the state-changing endpoints can hold. Admins may call
+// all of them; site admins may annotate, and add notes to incidents of,
+// the sites whose "tenant" metadata is one of their tenants.
+const (
+	roleAdmin     = "admin"
+	roleSiteAdmin = "site-admin"
+)
+
+// principal is an authenticated API caller. Name is empty for the shared
+// API token.
+type principal struct {
+	Name    string
+	Role    string
+	Tenants []string
+}
+
+// apiPrincipal authenticates r: the API_TOKEN bearer token is an admin,
+// and with LDAP_CONFIG set basic-auth users get the role their groups map
+// to. It returns nil for anonymous or unknown callers.
+func apiPrincipal(r *http.Request) *principal {
+	if got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if apiToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) == 1 {
+			return &principal{Role: roleAdmin}
+		}
+		return nil
+	}
+	if user, pass, ok := r.BasicAuth(); ok && ldapDir != nil {
+		p, err := ldapDir.authenticate(user, pass)
+		if err != nil {
+			fmt.Printf("[ldap] %s: %v\n", user, err)
+		}
+		return p
+	}
+	return nil
+}
+
+// apiAuthorized admits admins. Without a configured token or directory the
+// state-changing endpoints stay closed.
+func apiAuthorized(r *http.Request) bool {
+	p := apiPrincipal(r)
+	return p != nil && p.Role == roleAdmin
+}
+
+// canManageSite reports whether p may annotate site and its incidents:
+// admins anywhere, site admins at the sites of their tenants.
+func (p *principal) canManageSite(site string) bool {
+	if p.Role == roleAdmin {
+		return true
+	}
+	if p.Role != roleSiteAdmin || site == "" {
+		return false
+	}
+	tenant := siteRegistry().lookup(site).Metadata["tenant"]
+	for _, t := range p.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic replaces path via a temporary file and rename so readers
+// never see a partial document.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
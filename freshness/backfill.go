@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// POST /api/v1/backfill imports history from an older system: transfer
+// events, appended to transfers.csv, or freshness samples, written to the
+// history partitions. The body is the data, as CSV with a header row or
+// as JSON lines:
+//
+//	?kind=transfers|samples  &format=csv|jsonl  &dry_run=true  &skip_invalid=true  &first_line=N
+//
+// Transfer records take TransferEvent's fields (id, site, timestamp,
+// bytes, duration, status, ...); CSV may also use transfers.csv's own
+// columns, so an old transfers.csv imports as is. Samples take
+// timestamp, site, latest_timestamp and optionally age_seconds and ok,
+// computed from the site's threshold when missing.
+//
+// Every record is validated before anything is written; with invalid
+// records the request fails with their line numbers unless skip_invalid
+// is set, and dry_run only validates. Re-running an import is safe:
+// samples already in the history (same site and time) and transfers
+// already backfilled (by id, or a hash of the record when it has none,
+// kept in BACKFILL_LEDGER) are skipped. Backfilled transfers do not pass
+// through the live pipeline, so they raise no events or alerts.
+// dtmsctl backfill sends a file in chunks, reporting progress; first_line
+// numbers the chunk's records for the error report.
+var backfillLedgerPath = envOr("BACKFILL_LEDGER", filepath.Join(dataDir, "backfill-transfers.ids"))
+
+// backfillMaxErrors bounds the invalid records listed in a response.
+const backfillMaxErrors = 100
+
+type backfillError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type backfillResult struct {
+	Kind     string          `json:"kind"`
+	DryRun   bool            `json:"dry_run,omitempty"`
+	Read     int             `json:"read"`
+	Imported int             `json:"imported"`
+	Skipped  int             `json:"skipped"`
+	Invalid  int             `json:"invalid"`
+	Errors   []backfillError `json:"errors,omitempty"`
+}
+
+func (r *backfillResult) invalid(line int, err error) {
+	r.Invalid++
+	if len(r.Errors) < backfillMaxErrors {
+		r.Errors = append(r.Errors, backfillError{line, err.Error()})
+	}
+}
+
+var backfillRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_backfill_records_total", Help: "Records seen by the backfill API by kind and result"},
+	[]string{"kind", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(backfillRecords)
+}
+
+// backfillRecord is one input record, by field name, with its line.
+type backfillRecord struct {
+	line   int
+	fields map[string]string
+	raw    []byte
+}
+
+// readBackfill splits the body into records. CSV field names come from
+// the header row; JSON strings are decoded, other JSON values kept in
+// their JSON form, and nulls left out.
+func readBackfill(format string, body io.Reader, firstLine int) ([]backfillRecord, error) {
+	var out []backfillRecord
+	switch format {
+	case "csv":
+		r := csv.NewReader(body)
+		r.FieldsPerRecord = -1
+		header, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading the header: %w", err)
+		}
+		for i := range header {
+			header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		}
+		for {
+			rec, err := r.Read()
+			if err == io.EOF {
+				return out, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			line, _ := r.FieldPos(0)
+			f := map[string]string{}
+			for i, v := range rec {
+				if i < len(header) && v != "" {
+					f[header[i]] = v
+				}
+			}
+			out = append(out, backfillRecord{line: firstLine + line - 1, fields: f, raw: []byte(strings.Join(rec, ","))})
+		}
+	case "jsonl", "":
+		sc := bufio.NewScanner(body)
+		sc.Buffer(make([]byte, 64*1024), 4<<20)
+		for line := firstLine; sc.Scan(); line++ {
+			raw := bytes.TrimSpace(sc.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+			rec := backfillRecord{line: line, raw: append([]byte(nil), raw...)}
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &m); err == nil {
+				rec.fields = map[string]string{}
+				for k, v := range m {
+					s := string(v)
+					switch {
+					case s == "null":
+						continue
+					case strings.HasPrefix(s, `"`):
+						json.Unmarshal(v, &s)
+					}
+					rec.fields[strings.ToLower(k)] = s
+				}
+			}
+			out = append(out, rec)
+		}
+		return out, sc.Err()
+	}
+	return nil, fmt.Errorf("format must be csv or jsonl")
+}
+
+// float reads the first of keys present; missing is 0.
+func (r backfillRecord) float(keys ...string) (float64, error) {
+	for _, k := range keys {
+		if v, ok := r.fields[k]; ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", k, err)
+			}
+			return f, nil
+		}
+	}
+	return 0, nil
+}
+
+// timestamp reads unix seconds, or failing that an RFC 3339 time.
+func (r backfillRecord) timestamp() (float64, error) {
+	ts, err := r.float("timestamp", "timestamp_unix")
+	if err != nil || ts > 0 {
+		return ts, err
+	}
+	if v, ok := r.fields["timestamp_iso"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, fmt.Errorf("timestamp_iso: %w", err)
+		}
+		return float64(t.UnixNano()) / 1e9, nil
+	}
+	return 0, nil
+}
+
+func (r backfillRecord) transfer() (TransferEvent, error) {
+	if r.fields == nil {
+		return TransferEvent{}, fmt.Errorf("%w: not a JSON object", errInvalidEvent)
+	}
+	ev := TransferEvent{
+		ID: r.fields["id"], Site: r.fields["site"], Source: r.fields["source"], Tenant: r.fields["tenant"],
+		Status: r.fields["status"], Reason: r.fields["reason"], Dataset: r.fields["dataset"],
+		File: r.fields["file"], URL: r.fields["url"], Checksum: r.fields["checksum"],
+	}
+	var err error
+	if ev.Timestamp, err = r.timestamp(); err != nil {
+		return ev, fmt.Errorf("%w: %v", errInvalidEvent, err)
+	}
+	size, err := r.float("bytes")
+	if err != nil {
+		return ev, fmt.Errorf("%w: %v", errInvalidEvent, err)
+	}
+	ev.Bytes = int64(size)
+	if ev.Duration, err = r.float("duration"); err != nil {
+		return ev, fmt.Errorf("%w: %v", errInvalidEvent, err)
+	}
+	if ev.Status == "" {
+		ev.Status = "success"
+	}
+	if ev.ID == "" {
+		sum := sha256.Sum256(r.raw)
+		ev.ID = "backfill:" + hex.EncodeToString(sum[:12])
+	}
+	return ev, validateEvent(ev)
+}
+
+func (r backfillRecord) sample() (HistorySample, error) {
+	if r.fields == nil {
+		return HistorySample{}, fmt.Errorf("not a JSON object")
+	}
+	s := HistorySample{Site: r.fields["site"]}
+	var err error
+	if s.Timestamp, err = r.timestamp(); err != nil {
+		return s, err
+	}
+	if s.LatestTimestamp, err = r.float("latest_timestamp"); err != nil {
+		return s, err
+	}
+	switch {
+	case s.Site == "":
+		return s, fmt.Errorf("missing site")
+	case s.Timestamp <= 0:
+		return s, fmt.Errorf("missing timestamp")
+	case s.LatestTimestamp <= 0:
+		return s, fmt.Errorf("missing latest_timestamp")
+	}
+	if _, ok := r.fields["age_seconds"]; ok {
+		if s.AgeSeconds, err = r.float("age_seconds"); err != nil {
+			return s, err
+		}
+	} else {
+		s.AgeSeconds = s.Timestamp - s.LatestTimestamp
+	}
+	if v, ok := r.fields["ok"]; ok {
+		if s.Ok, err = strconv.ParseBool(v); err != nil {
+			return s, fmt.Errorf("ok: %w", err)
+		}
+	} else {
+		s.Ok = s.AgeSeconds <= siteRegistry().lookup(s.Site).Threshold
+	}
+	return s, nil
+}
+
+// backfillLedger is the set of transfer IDs imported so far, one per line
+// in BACKFILL_LEDGER, read on first use.
+type backfillLedger struct {
+	mu     sync.Mutex
+	path   string
+	ids    map[string]bool
+	loaded bool
+}
+
+var backfilled = &backfillLedger{path: backfillLedgerPath}
+
+func (l *backfillLedger) load() error {
+	if l.loaded {
+		return nil
+	}
+	l.ids = map[string]bool{}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		l.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l.ids[sc.Text()] = true
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	l.loaded = true
+	return nil
+}
+
+// importTransfers appends the events not imported before and records
+// their IDs.
+func (l *backfillLedger) importTransfers(events []TransferEvent, dryRun bool) (imported, skipped int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return 0, 0, err
+	}
+	var fresh []TransferEvent
+	seen := map[string]bool{}
+	for _, ev := range events {
+		if l.ids[ev.ID] || seen[ev.ID] {
+			skipped++
+			continue
+		}
+		seen[ev.ID] = true
+		fresh = append(fresh, ev)
+	}
+	if dryRun || len(fresh) == 0 {
+		return len(fresh), skipped, nil
+	}
+	ingest.mu.Lock()
+	err = appendTransferRows(fresh)
+	ingest.mu.Unlock()
+	if err != nil {
+		return 0, skipped, err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return 0, skipped, err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, skipped, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, ev := range fresh {
+		l.ids[ev.ID] = true
+		fmt.Fprintln(w, ev.ID)
+	}
+	return len(fresh), skipped, w.Flush()
+}
+
+func handleBackfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	res := backfillResult{Kind: q.Get("kind"), DryRun: q.Get("dry_run") == "true"}
+	if res.Kind != "transfers" && res.Kind != "samples" {
+		http.Error(w, "kind must be transfers or samples", http.StatusBadRequest)
+		return
+	}
+	records, err := readBackfill(q.Get("format"), http.MaxBytesReader(w, r.Body, 256<<20), queryInt(r, "first_line", 1))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large; send the file in chunks", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res.Read = len(records)
+
+	var (
+		transfers []TransferEvent
+		samples   []HistorySample
+	)
+	for _, rec := range records {
+		if res.Kind == "transfers" {
+			ev, err := rec.transfer()
+			if err != nil {
+				res.invalid(rec.line, err)
+				continue
+			}
+			transfers = append(transfers, ev)
+		} else {
+			s, err := rec.sample()
+			if err != nil {
+				res.invalid(rec.line, err)
+				continue
+			}
+			samples = append(samples, s)
+		}
+	}
+	backfillRecords.WithLabelValues(res.Kind, "invalid").Add(float64(res.Invalid))
+	if res.Invalid > 0 && q.Get("skip_invalid") != "true" {
+		writeJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	if res.Kind == "transfers" {
+		res.Imported, res.Skipped, err = backfilled.importTransfers(transfers, res.DryRun)
+	} else {
+		res.Imported, err = history.RecordNew(samples, res.DryRun)
+		res.Skipped = len(samples) - res.Imported
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !res.DryRun {
+		backfillRecords.WithLabelValues(res.Kind, "imported").Add(float64(res.Imported))
+		backfillRecords.WithLabelValues(res.Kind, "skipped").Add(float64(res.Skipped))
+		fmt.Printf("[backfill] %s: %d imported, %d already present, %d invalid\n", res.Kind, res.Imported, res.Skipped, res.Invalid)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
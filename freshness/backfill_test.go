@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBackfill(t *testing.T) {
+	type rec struct {
+		Line   int
+		Fields map[string]string
+	}
+	for _, tc := range []struct {
+		name      string
+		format    string
+		body      string
+		firstLine int
+		want      []rec
+		err       string
+	}{
+		{
+			name:   "csv header names are trimmed and lowercased",
+			format: "csv", firstLine: 1,
+			body: " Site ,Timestamp_Unix,BYTES\nSITE_A,1700000000,42\n",
+			want: []rec{{2, map[string]string{"site": "SITE_A", "timestamp_unix": "1700000000", "bytes": "42"}}},
+		},
+		{
+			name:   "transfers.csv as written",
+			format: "csv", firstLine: 1,
+			body: "timestamp_iso,timestamp_unix,bytes,duration,throughput_bytes_per_sec,status,site\n" +
+				"2023-11-14T22:13:20.000000Z,1700000000,100,2,50,success,SITE_A\n",
+			want: []rec{{2, map[string]string{
+				"timestamp_iso": "2023-11-14T22:13:20.000000Z", "timestamp_unix": "1700000000", "bytes": "100",
+				"duration": "2", "throughput_bytes_per_sec": "50", "status": "success", "site": "SITE_A",
+			}}},
+		},
+		{
+			name:   "csv empty cells and extra columns dropped",
+			format: "csv", firstLine: 1,
+			body: "site,bytes\nSITE_A,,extra\n",
+			want: []rec{{2, map[string]string{"site": "SITE_A"}}},
+		},
+		{
+			name:   "csv chunk numbered from first_line",
+			format: "csv", firstLine: 5000,
+			body: "site\nSITE_A\nSITE_B\n",
+			want: []rec{{5001, map[string]string{"site": "SITE_A"}}, {5002, map[string]string{"site": "SITE_B"}}},
+		},
+		{
+			name:   "csv quoted newline numbered by its first line",
+			format: "csv", firstLine: 1,
+			body: "site,reason\nSITE_A,\"two\nlines\"\nSITE_B,x\n",
+			want: []rec{
+				{2, map[string]string{"site": "SITE_A", "reason": "two\nlines"}},
+				{4, map[string]string{"site": "SITE_B", "reason": "x"}},
+			},
+		},
+		{name: "csv without a header", format: "csv", body: "", err: "reading the header"},
+		{
+			name:   "json strings decoded",
+			format: "jsonl", firstLine: 1,
+			body: `{"Site":"SITE_A","file":"\/data\/f.root","reason":"café \"quoted\"\ttab"}`,
+			want: []rec{{1, map[string]string{"site": "SITE_A", "file": "/data/f.root", "reason": "café \"quoted\"\ttab"}}},
+		},
+		{
+			name:   "json numbers and bools as written, nulls left out",
+			format: "jsonl", firstLine: 1,
+			body: `{"bytes":1e6,"duration":2.5,"ok":true,"reason":null}`,
+			want: []rec{{1, map[string]string{"bytes": "1e6", "duration": "2.5", "ok": "true"}}},
+		},
+		{
+			name:   "json blank lines counted, not read",
+			format: "jsonl", firstLine: 10,
+			body: "{\"site\":\"SITE_A\"}\n\n  \n{\"site\":\"SITE_B\"}\n",
+			want: []rec{{10, map[string]string{"site": "SITE_A"}}, {13, map[string]string{"site": "SITE_B"}}},
+		},
+		{
+			name:   "json line that is not an object",
+			format: "", firstLine: 1,
+			body: "[1,2]\n{broken\n",
+			want: []rec{{1, nil}, {2, nil}},
+		},
+		{name: "unknown format", format: "xml", body: "<a/>", err: "format must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := readBackfill(tc.format, strings.NewReader(tc.body), tc.firstLine)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []rec
+			for _, r := range records {
+				got = append(got, rec{r.line, r.fields})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackfillTransfer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields map[string]string
+		want   TransferEvent
+		err    string
+	}{
+		{
+			name:   "unix timestamp",
+			fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp": "1700000000.5", "bytes": "100", "duration": "2"},
+			want:   TransferEvent{ID: "t1", Site: "SITE_A", Timestamp: 1700000000.5, Bytes: 100, Duration: 2, Status: "success"},
+		},
+		{
+			name:   "timestamp_unix alias",
+			fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp_unix": "1700000000", "status": "failed", "reason": "timeout"},
+			want:   TransferEvent{ID: "t1", Site: "SITE_A", Timestamp: 1700000000, Status: "failed", Reason: "timeout"},
+		},
+		{
+			name:   "timestamp_iso when no unix time",
+			fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp_iso": "2023-11-14T22:13:20.500000Z"},
+			want:   TransferEvent{ID: "t1", Site: "SITE_A", Timestamp: 1700000000.5, Status: "success"},
+		},
+		{
+			name:   "unix time wins over timestamp_iso",
+			fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp_unix": "1700000000", "timestamp_iso": "not a time"},
+			want:   TransferEvent{ID: "t1", Site: "SITE_A", Timestamp: 1700000000, Status: "success"},
+		},
+		{
+			name:   "bytes in exponent form",
+			fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp": "1700000000", "bytes": "1e6"},
+			want:   TransferEvent{ID: "t1", Site: "SITE_A", Timestamp: 1700000000, Bytes: 1000000, Status: "success"},
+		},
+		{name: "bad timestamp_iso", fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp_iso": "14/11/2023"}, err: "timestamp_iso"},
+		{name: "bad bytes", fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp": "1", "bytes": "lots"}, err: "bytes"},
+		{name: "missing site", fields: map[string]string{"id": "t1", "timestamp": "1"}, err: "missing site"},
+		{name: "missing timestamp", fields: map[string]string{"id": "t1", "site": "SITE_A"}, err: "missing timestamp"},
+		{name: "negative duration", fields: map[string]string{"id": "t1", "site": "SITE_A", "timestamp": "1", "duration": "-1"}, err: "negative"},
+		{name: "not an object", err: "not a JSON object"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := backfillRecord{fields: tc.fields}.transfer()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("id from the record when missing", func(t *testing.T) {
+		fields := map[string]string{"site": "SITE_A", "timestamp": "1700000000"}
+		a, _ := backfillRecord{fields: fields, raw: []byte("SITE_A,1700000000")}.transfer()
+		b, _ := backfillRecord{fields: fields, raw: []byte("SITE_A,1700000000")}.transfer()
+		c, _ := backfillRecord{fields: fields, raw: []byte("SITE_A,1700000001")}.transfer()
+		if !strings.HasPrefix(a.ID, "backfill:") || a.ID != b.ID || a.ID == c.ID {
+			t.Fatalf("ids %q %q %q", a.ID, b.ID, c.ID)
+		}
+	})
+}
+
+// withBackfill points the ledger and transfers.csv at a temp directory.
+func withBackfill(t *testing.T) (csvPath string) {
+	t.Helper()
+	savedLedger, savedCSV, savedToken := backfilled, transfersCSV, apiToken
+	t.Cleanup(func() { backfilled, transfersCSV, apiToken = savedLedger, savedCSV, savedToken })
+	dir := t.TempDir()
+	backfilled = &backfillLedger{path: filepath.Join(dir, "backfill-transfers.ids")}
+	transfersCSV = filepath.Join(dir, "transfers.csv")
+	apiToken = "admin-token"
+	return transfersCSV
+}
+
+func backfillCall(t *testing.T, query, body string) (int, backfillResult) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/backfill?"+query, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	handleBackfill(w, r)
+	var res backfillResult
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestBackfillTransfers(t *testing.T) {
+	csvPath := withBackfill(t)
+	const good = "site,timestamp_unix,bytes,duration\n" +
+		"SITE_A,1700000000,100,2\n" +
+		"SITE_B,1700000060,200,4\n"
+	const mixed = "site,timestamp_unix,bytes\n" +
+		"SITE_A,1700000120,300\n" +
+		",1700000180,400\n" +
+		"SITE_C,soon,500\n"
+	for _, tc := range []struct {
+		name  string
+		query string
+		body  string
+		code  int
+		want  backfillResult
+		rows  int // lines in transfers.csv afterwards, header included
+	}{
+		{name: "dry run writes nothing", query: "kind=transfers&format=csv&dry_run=true", body: good,
+			code: 200, want: backfillResult{Kind: "transfers", DryRun: true, Read: 2, Imported: 2}, rows: 0},
+		{name: "import", query: "kind=transfers&format=csv", body: good,
+			code: 200, want: backfillResult{Kind: "transfers", Read: 2, Imported: 2}, rows: 3},
+		{name: "re-run skips the ledger's records", query: "kind=transfers&format=csv", body: good,
+			code: 200, want: backfillResult{Kind: "transfers", Read: 2, Skipped: 2}, rows: 3},
+		{name: "invalid lines numbered from first_line", query: "kind=transfers&format=csv&first_line=100", body: mixed,
+			code: 422, want: backfillResult{Kind: "transfers", Read: 3, Invalid: 2, Errors: []backfillError{
+				{102, "invalid transfer event: missing site"},
+				{103, `invalid transfer event: timestamp_unix: strconv.ParseFloat: parsing "soon": invalid syntax`},
+			}}, rows: 3},
+		{name: "skip_invalid imports the rest", query: "kind=transfers&format=csv&first_line=100&skip_invalid=true", body: mixed,
+			code: 200, want: backfillResult{Kind: "transfers", Read: 3, Imported: 1, Invalid: 2, Errors: []backfillError{
+				{102, "invalid transfer event: missing site"},
+				{103, `invalid transfer event: timestamp_unix: strconv.ParseFloat: parsing "soon": invalid syntax`},
+			}}, rows: 4},
+		{name: "duplicates within a request count once", query: "kind=transfers",
+			body: `{"id":"x1","site":"SITE_A","timestamp":1700000300}` + "\n" + `{"id":"x1","site":"SITE_A","timestamp":1700000300}`,
+			code: 200, want: backfillResult{Kind: "transfers", Read: 2, Imported: 1, Skipped: 1}, rows: 5},
+		{name: "json lines numbered from first_line", query: "kind=transfers&first_line=7",
+			body: `{"id":"x2","site":"SITE_A","timestamp_iso":"2023-11-14T22:13:20Z"}` + "\n" + `{"id":"x3","site":"SITE_A"}`,
+			code: 422, want: backfillResult{Kind: "transfers", Read: 2, Invalid: 1, Errors: []backfillError{
+				{8, "invalid transfer event: missing timestamp"},
+			}}, rows: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, got := backfillCall(t, tc.query, tc.body)
+			if code != tc.code || !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %d %+v, want %d %+v", code, got, tc.code, tc.want)
+			}
+			raw, _ := os.ReadFile(csvPath)
+			if rows := strings.Count(string(raw), "\n"); rows != tc.rows {
+				t.Fatalf("transfers.csv has %d lines, want %d", rows, tc.rows)
+			}
+		})
+	}
+
+	t.Run("ledger survives a restart", func(t *testing.T) {
+		backfilled = &backfillLedger{path: backfilled.path}
+		code, got := backfillCall(t, "kind=transfers&format=csv", good)
+		if code != 200 || got.Imported != 0 || got.Skipped != 2 {
+			t.Fatalf("got %d %+v, want both skipped", code, got)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// BANDWIDTH_CONFIG caps transfer bandwidth per site and per tenant and
+// weights tenants against each other:
+//
+//	sites:
+//	  SITE_A: {cap: 500MB}
+//	tenants:
+//	  bulk-recovery: {cap: 200MB, weight: 1}
+//	  replication:   {weight: 4}
+//
+// Caps are bytes per second (K/M/G suffixes are powers of 1000). When a
+// worker claims a request it is told the bandwidth it may use: each cap
+// touching the request (source site, destination site, tenant) is split
+// evenly across the requests running under it and the smallest share
+// wins. Whenever a request starts or stops running the limits of all
+// running requests are recomputed and handed back with their next progress
+// report. The worker's HTTP backend adjusts at once; rclone and rsync are
+// started with a fixed limit and take the new one on their next try, so
+// until then the caps are approximate. Across tenants the scheduler hands out the next request to the
+// tenant with the fewest running requests per unit of weight, so a bulk
+// recovery cannot starve latency-sensitive replication.
+var bandwidthConfigPath = envOr("BANDWIDTH_CONFIG", "")
+
+type bandwidthRule struct {
+	Cap    string  `yaml:"cap"`
+	Weight float64 `yaml:"weight"`
+
+	cap float64
+}
+
+type bandwidthConfig struct {
+	Sites   map[string]*bandwidthRule `yaml:"sites"`
+	Tenants map[string]*bandwidthRule `yaml:"tenants"`
+}
+
+var bandwidth = &bandwidthConfig{}
+
+var (
+	gaugeBandwidthUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_bandwidth_usage_bytes_per_second", Help: "Throughput reported by running transfer requests, by site or tenant"},
+		[]string{"scope", "name"},
+	)
+	gaugeBandwidthCap = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_bandwidth_cap_bytes_per_second", Help: "Configured bandwidth cap, by site or tenant"},
+		[]string{"scope", "name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeBandwidthUsage, gaugeBandwidthCap)
+}
+
+func loadBandwidthConfig() error {
+	if bandwidthConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(bandwidthConfigPath)
+	if err != nil {
+		return err
+	}
+	var c bandwidthConfig
+	if err := yamlenv.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("%s: %w", bandwidthConfigPath, err)
+	}
+	for scope, rules := range map[string]map[string]*bandwidthRule{"site": c.Sites, "tenant": c.Tenants} {
+		for name, r := range rules {
+			if r.Cap != "" {
+				if r.cap, err = parseBytes(r.Cap); err != nil {
+					return fmt.Errorf("%s: %s %s: %w", bandwidthConfigPath, scope, name, err)
+				}
+				gaugeBandwidthCap.WithLabelValues(scope, name).Set(r.cap)
+			}
+		}
+	}
+	bandwidth = &c
+	return nil
+}
+
+func (c *bandwidthConfig) weight(tenant string) float64 {
+	if r := c.Tenants[tenant]; r != nil && r.Weight > 0 {
+		return r.Weight
+	}
+	return 1
+}
+
+// pickFairShare returns the next request to run from the eligible queued
+// ones, given what is already running.
+func (c *bandwidthConfig) pickFairShare(queued, running []*TransferRequest) *TransferRequest {
+	active := map[string]int{}
+	for _, r := range running {
+		active[r.Tenant]++
+	}
+	var head *TransferRequest
+	headShare := math.Inf(1)
+	for _, r := range queued {
+		share := float64(active[r.Tenant]) / c.weight(r.Tenant)
+		if head == nil || share < headShare || (share == headShare && queueLess(*r, *head)) {
+			head, headShare = r, share
+		}
+	}
+	return head
+}
+
+// rebalance sets the limit of every running request.
+func (c *bandwidthConfig) rebalance(running []*TransferRequest) {
+	for _, r := range running {
+		r.Bandwidth = c.limitFor(r, running)
+	}
+}
+
+// limitFor returns the bandwidth r may use alongside running (which may
+// include r), 0 for unlimited.
+func (c *bandwidthConfig) limitFor(r *TransferRequest, running []*TransferRequest) int64 {
+	limit := math.Inf(1)
+	share := func(rule *bandwidthRule, sharing func(*TransferRequest) bool) {
+		if rule == nil || rule.cap == 0 {
+			return
+		}
+		n := 1
+		for _, o := range running {
+			if o != r && sharing(o) {
+				n++
+			}
+		}
+		limit = math.Min(limit, rule.cap/float64(n))
+	}
+	for _, site := range []string{r.Source, r.Destination} {
+		site := site
+		share(c.Sites[site], func(o *TransferRequest) bool { return o.Source == site || o.Destination == site })
+	}
+	share(c.Tenants[r.Tenant], func(o *TransferRequest) bool { return o.Tenant == r.Tenant })
+	if math.IsInf(limit, 1) {
+		return 0
+	}
+	return int64(limit)
+}
+
+// publishUsage sums the throughput last reported by running requests.
+func publishUsage(running []*TransferRequest) {
+	usage := map[[2]string]float64{}
+	for _, r := range running {
+		if r.Progress == nil {
+			continue
+		}
+		usage[[2]string{"site", r.Source}] += r.Progress.Rate
+		if r.Destination != r.Source {
+			usage[[2]string{"site", r.Destination}] += r.Progress.Rate
+		}
+		usage[[2]string{"tenant", r.Tenant}] += r.Progress.Rate
+	}
+	gaugeBandwidthUsage.Reset()
+	for k, v := range usage {
+		gaugeBandwidthUsage.WithLabelValues(k[0], k[1]).Set(v)
+	}
+}
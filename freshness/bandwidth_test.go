@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestPickFairShare(t *testing.T) {
+	c := &bandwidthConfig{Tenants: map[string]*bandwidthRule{"replication": {Weight: 4}, "bulk": {Weight: 1}}}
+	req := func(id, tenant string, priority int, created float64) *TransferRequest {
+		return &TransferRequest{ID: id, Tenant: tenant, Priority: priority, Created: created}
+	}
+	for _, tc := range []struct {
+		name            string
+		queued, running []*TransferRequest
+		want            string
+	}{
+		{"nothing queued", nil, nil, ""},
+		{"queue order without contention",
+			[]*TransferRequest{req("a", "bulk", 0, 2), req("b", "bulk", 0, 1)}, nil, "b"},
+		{"priority first within a tenant",
+			[]*TransferRequest{req("a", "bulk", 0, 1), req("b", "bulk", 5, 2)}, nil, "b"},
+		{"idle tenant goes first",
+			[]*TransferRequest{req("a", "bulk", 9, 1), req("b", "default", 0, 2)},
+			[]*TransferRequest{req("r1", "bulk", 0, 0)}, "b"},
+		{"weight lets a tenant run more",
+			[]*TransferRequest{req("a", "bulk", 0, 1), req("b", "replication", 0, 2)},
+			[]*TransferRequest{req("r1", "bulk", 0, 0), req("r2", "replication", 0, 0), req("r3", "replication", 0, 0)}, "b"},
+		{"until its weighted share is larger",
+			[]*TransferRequest{req("a", "bulk", 0, 1), req("b", "replication", 0, 2)},
+			[]*TransferRequest{req("r1", "bulk", 0, 0), req("r2", "replication", 0, 0), req("r3", "replication", 0, 0),
+				req("r4", "replication", 0, 0), req("r5", "replication", 0, 0), req("r6", "replication", 0, 0)}, "a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ""
+			if r := c.pickFairShare(tc.queued, tc.running); r != nil {
+				got = r.ID
+			}
+			if got != tc.want {
+				t.Errorf("picked %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	c := &bandwidthConfig{
+		Sites:   map[string]*bandwidthRule{"A": {cap: 900}, "B": {cap: 600}},
+		Tenants: map[string]*bandwidthRule{"bulk": {cap: 200}},
+	}
+	for _, tc := range []struct {
+		name    string
+		r       *TransferRequest
+		running []*TransferRequest
+		want    int64
+	}{
+		{"uncapped", &TransferRequest{Source: "X", Destination: "Y"}, nil, 0},
+		{"alone on a capped site", &TransferRequest{Source: "A", Destination: "Y"}, nil, 900},
+		{"smallest cap wins", &TransferRequest{Source: "A", Destination: "B"}, nil, 600},
+		{"site cap split", &TransferRequest{Source: "A", Destination: "Y"},
+			[]*TransferRequest{{Source: "Z", Destination: "A"}, {Source: "A", Destination: "W"}}, 300},
+		{"others elsewhere don't count", &TransferRequest{Source: "A", Destination: "Y"},
+			[]*TransferRequest{{Source: "Z", Destination: "W"}}, 900},
+		{"tenant cap", &TransferRequest{Source: "A", Destination: "Y", Tenant: "bulk"},
+			[]*TransferRequest{{Source: "Z", Destination: "W", Tenant: "bulk"}}, 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := c.limitFor(tc.r, tc.running); got != tc.want {
+				t.Errorf("limitFor = %d, want %d", got, tc.want)
+			}
+			// r itself among running must not count twice
+			if got := c.limitFor(tc.r, append(tc.running, tc.r)); got != tc.want {
+				t.Errorf("limitFor with r running = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// Limits granted at claim time shrink when another request starts under
+// the same cap and grow back once it ends.
+func TestRebalance(t *testing.T) {
+	c := &bandwidthConfig{Sites: map[string]*bandwidthRule{"A": {cap: 900}}}
+	a := &TransferRequest{Source: "A", Destination: "X"}
+	b := &TransferRequest{Source: "A", Destination: "Y"}
+	c.rebalance([]*TransferRequest{a})
+	if a.Bandwidth != 900 {
+		t.Fatalf("alone: %d", a.Bandwidth)
+	}
+	c.rebalance([]*TransferRequest{a, b})
+	if a.Bandwidth != 450 || b.Bandwidth != 450 {
+		t.Fatalf("shared: %d, %d", a.Bandwidth, b.Bandwidth)
+	}
+	c.rebalance([]*TransferRequest{b})
+	if b.Bandwidth != 900 {
+		t.Fatalf("after a ended: %d", b.Bandwidth)
+	}
+}
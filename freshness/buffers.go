@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Site agents report the free space and inodes of the staging and buffer
+// areas their transfers land in (cmd/dtms-agent/buffers.go) at POST
+// /api/v1/agent/buffers. They are exported per site and buffer together
+// with the buffer's warn ratio, which the generated alert rules compare
+// against, and a stale site's hints name any of its buffers past it.
+// GET /api/v1/buffers?site= lists the latest reports.
+
+// BufferUsage is one buffer area as last reported by its site's agent.
+type BufferUsage struct {
+	Site        string  `json:"site"`
+	Name        string  `json:"name"`
+	Path        string  `json:"path"`
+	SizeBytes   uint64  `json:"size_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	Inodes      uint64  `json:"inodes"`
+	InodesFree  uint64  `json:"inodes_free"`
+	WarnPercent float64 `json:"warn_percent"`
+	Error       string  `json:"error,omitempty"`
+	Reported    float64 `json:"reported"`
+}
+
+// usedPercent returns how full the buffer is by space and by inodes.
+func (b BufferUsage) usedPercent() (space, inodes float64) {
+	if b.SizeBytes > 0 {
+		space = 100 * (1 - float64(b.FreeBytes)/float64(b.SizeBytes))
+	}
+	if b.Inodes > 0 {
+		inodes = 100 * (1 - float64(b.InodesFree)/float64(b.Inodes))
+	}
+	return space, inodes
+}
+
+type bufferStore struct {
+	mu    sync.Mutex
+	items map[string]map[string]BufferUsage // by site, then buffer
+}
+
+var buffers = &bufferStore{items: map[string]map[string]BufferUsage{}}
+
+var (
+	bufferLabels       = []string{"site", "buffer"}
+	gaugeBufferSize    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_size_bytes", Help: "Size of the filesystem holding a site's buffer area"}, bufferLabels)
+	gaugeBufferFree    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_free_bytes", Help: "Bytes available in a site's buffer area"}, bufferLabels)
+	gaugeBufferInodes  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_inodes", Help: "Inodes of the filesystem holding a site's buffer area"}, bufferLabels)
+	gaugeBufferIFree   = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_inodes_free", Help: "Free inodes in a site's buffer area"}, bufferLabels)
+	gaugeBufferWarn    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_warn_ratio", Help: "Used fraction of space or inodes past which a buffer area counts as near full"}, bufferLabels)
+	gaugeBufferUpdated = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_buffer_report_timestamp_seconds", Help: "When a site's agent last reported a buffer area"}, bufferLabels)
+)
+
+var bufferValueGauges = []*prometheus.GaugeVec{gaugeBufferSize, gaugeBufferFree, gaugeBufferInodes, gaugeBufferIFree, gaugeBufferWarn}
+
+func init() {
+	prometheus.MustRegister(gaugeBufferSize, gaugeBufferFree, gaugeBufferInodes, gaugeBufferIFree, gaugeBufferWarn, gaugeBufferUpdated)
+}
+
+// Report replaces site's buffers with those its agent reported at now.
+func (s *bufferStore) Report(site string, list []BufferUsage, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := map[string]BufferUsage{}
+	for _, b := range list {
+		if b.Name == "" {
+			continue
+		}
+		b.Site, b.Reported = site, float64(now.Unix())
+		current[b.Name] = b
+		gaugeBufferUpdated.WithLabelValues(site, b.Name).Set(b.Reported)
+		if b.Error != "" {
+			// the agent could not measure it; keep no stale figures
+			for _, g := range bufferValueGauges {
+				g.DeleteLabelValues(site, b.Name)
+			}
+			continue
+		}
+		gaugeBufferSize.WithLabelValues(site, b.Name).Set(float64(b.SizeBytes))
+		gaugeBufferFree.WithLabelValues(site, b.Name).Set(float64(b.FreeBytes))
+		gaugeBufferInodes.WithLabelValues(site, b.Name).Set(float64(b.Inodes))
+		gaugeBufferIFree.WithLabelValues(site, b.Name).Set(float64(b.InodesFree))
+		gaugeBufferWarn.WithLabelValues(site, b.Name).Set(b.WarnPercent / 100)
+	}
+	for name := range s.items[site] {
+		if _, ok := current[name]; !ok {
+			for _, g := range bufferValueGauges {
+				g.DeleteLabelValues(site, name)
+			}
+			gaugeBufferUpdated.DeleteLabelValues(site, name)
+		}
+	}
+	s.items[site] = current
+}
+
+// List returns site's buffers, or every site's when it is empty.
+func (s *bufferStore) List(site string) []BufferUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []BufferUsage{}
+	for name, bs := range s.items {
+		if site != "" && name != site {
+			continue
+		}
+		for _, b := range bs {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Site != out[j].Site {
+			return out[i].Site < out[j].Site
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// nearFull describes site's buffers past their warn percentage.
+func (s *bufferStore) nearFull(site string) []string {
+	var out []string
+	for _, b := range s.List(site) {
+		space, inodes := b.usedPercent()
+		switch {
+		case b.Error != "":
+		case space >= b.WarnPercent:
+			out = append(out, fmt.Sprintf("buffer %s (%s) is %.0f%% full", b.Name, b.Path, space))
+		case inodes >= b.WarnPercent:
+			out = append(out, fmt.Sprintf("buffer %s (%s) has used %.0f%% of its inodes", b.Name, b.Path, inodes))
+		}
+	}
+	return out
+}
+
+// handleAgentBuffers serves POST /api/v1/agent/buffers for site agents.
+func handleAgentBuffers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site, err := parseAgentToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var list []BufferUsage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buffers.Report(site, list, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBuffers serves GET /api/v1/buffers?site=.
+func handleBuffers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"buffers": buffers.List(r.URL.Query().Get("site"))})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A site that only ingests during local business hours gets a schedule in
+// SITES_CONFIG:
+//
+//	schedule:
+//	  timezone: America/Chicago
+//	  hours: ["Mon-Fri 08:00-18:00", "Sat 09:00-12:00"]
+//	  off_hours_threshold: 50400   # optional
+//
+// Without off_hours_threshold the freshness clock pauses outside the
+// listed hours: the age judged against the threshold is the active time
+// since the last transfer, so a site that went quiet at Friday 18:00 is
+// not stale over the weekend, nor the moment it opens again on Monday.
+// With off_hours_threshold the wall-clock age is judged as usual, but
+// against that threshold while the site is closed. Windows may cross
+// midnight ("Mon-Fri 22:00-06:00" runs into the next morning), and day
+// lists take ranges, commas, or "daily". The published age is always the
+// wall-clock one; CEL ok rules see the judged age as age and the wall one
+// as wall_age, with in_active_hours.
+type siteSchedule struct {
+	Timezone          string   `yaml:"timezone"`
+	Hours             []string `yaml:"hours"`
+	OffHoursThreshold float64  `yaml:"off_hours_threshold"`
+
+	loc     *time.Location
+	windows []scheduleWindow
+}
+
+// scheduleWindow is active from minute `from` to minute `to` of each
+// listed local weekday; to <= from runs into the next day.
+type scheduleWindow struct {
+	days     [7]bool
+	from, to int
+}
+
+// maxScheduleDays bounds the active-time walk; older transfers are judged
+// by wall-clock age.
+const maxScheduleDays = 400
+
+var scheduleDayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (s *siteSchedule) compile() error {
+	s.loc = time.UTC
+	if s.Timezone != "" {
+		var err error
+		if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("schedule timezone: %w", err)
+		}
+	}
+	if len(s.Hours) == 0 {
+		return fmt.Errorf("schedule needs hours")
+	}
+	s.windows = nil
+	for _, h := range s.Hours {
+		w, err := parseScheduleWindow(h)
+		if err != nil {
+			return fmt.Errorf("schedule hours %q: %w", h, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	// activeSeconds merges spans in order of opening
+	sort.Slice(s.windows, func(i, j int) bool { return s.windows[i].from < s.windows[j].from })
+	return nil
+}
+
+func parseScheduleWindow(spec string) (scheduleWindow, error) {
+	var w scheduleWindow
+	days, span, ok := strings.Cut(strings.TrimSpace(spec), " ")
+	if !ok {
+		return w, fmt.Errorf("want DAYS HH:MM-HH:MM")
+	}
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		if part == "daily" || part == "*" {
+			w.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		a, ok1 := scheduleDayNames[first]
+		b, ok2 := scheduleDayNames[last]
+		if !isRange {
+			b, ok2 = a, ok1
+		}
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("unknown day in %q", part)
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	from, to, ok := strings.Cut(strings.TrimSpace(span), "-")
+	if !ok {
+		return w, fmt.Errorf("want HH:MM-HH:MM")
+	}
+	var err error
+	if w.from, err = parseClockMinutes(from); err != nil {
+		return w, err
+	}
+	if w.to, err = parseClockMinutes(to); err != nil {
+		return w, err
+	}
+	if w.from == w.to {
+		return w, fmt.Errorf("empty window")
+	}
+	return w, nil
+}
+
+func parseClockMinutes(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// eachWindow calls fn with the absolute spans of the windows opening on
+// the local days from the one before start to the one containing end.
+func (s *siteSchedule) eachWindow(start, end time.Time, fn func(from, to time.Time)) {
+	y, m, d := start.In(s.loc).Date()
+	day := time.Date(y, m, d-1, 0, 0, 0, 0, s.loc)
+	for i := 0; i <= maxScheduleDays+1 && !day.After(end); i++ {
+		for _, w := range s.windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			to := w.to
+			if to <= w.from {
+				to += 24 * 60
+			}
+			y, m, d := day.Date()
+			fn(time.Date(y, m, d, 0, w.from, 0, 0, s.loc), time.Date(y, m, d, 0, to, 0, 0, s.loc))
+		}
+		y, m, d := day.Date()
+		day = time.Date(y, m, d+1, 0, 0, 0, 0, s.loc)
+	}
+}
+
+// Active reports whether t falls in one of the windows.
+func (s *siteSchedule) Active(t time.Time) bool {
+	active := false
+	s.eachWindow(t, t, func(from, to time.Time) {
+		if !t.Before(from) && t.Before(to) {
+			active = true
+		}
+	})
+	return active
+}
+
+// activeSeconds is the time within the windows between since and now,
+// overlapping windows counted once.
+func (s *siteSchedule) activeSeconds(since, now time.Time) (float64, bool) {
+	if now.Sub(since) > maxScheduleDays*24*time.Hour {
+		return 0, false
+	}
+	var total time.Duration
+	covered := since
+	s.eachWindow(since, now, func(from, to time.Time) {
+		if from.Before(covered) {
+			from = covered
+		}
+		if to.After(now) {
+			to = now
+		}
+		if to.After(from) {
+			total += to.Sub(from)
+			covered = to
+		}
+	})
+	return total.Seconds(), true
+}
+
+// applySchedule returns the site as it is judged at now: with the active
+// age in place of the wall-clock one, or cfg with the off-hours threshold,
+// as the site's schedule asks. Without a schedule both pass through.
+func applySchedule(s SiteFresh, cfg siteConfig, now time.Time) (SiteFresh, siteConfig, bool) {
+	sch := cfg.Schedule
+	if sch == nil {
+		return s, cfg, true
+	}
+	active := sch.Active(now)
+	if sch.OffHoursThreshold > 0 {
+		if !active {
+			cfg.Threshold = sch.OffHoursThreshold
+		}
+		return s, cfg, active
+	}
+	since := now.Add(-time.Duration(s.AgeSeconds * float64(time.Second)))
+	if age, ok := sch.activeSeconds(since, now); ok {
+		s.AgeSeconds = age
+	}
+	return s, cfg, active
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseClockMinutes(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+		err  bool
+	}{
+		{in: "00:00", want: 0},
+		{in: "08:30", want: 510},
+		{in: " 8:05 ", want: 485},
+		{in: "23:59", want: 1439},
+		{in: "24:00", want: 1440},
+		{in: "24:01", err: true},
+		{in: "25:00", err: true},
+		{in: "12:60", err: true},
+		{in: "-1:00", err: true},
+		{in: "12", err: true},
+		{in: "12:", err: true},
+		{in: "noon", err: true},
+		{in: "08:00:00", err: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseClockMinutes(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("parseClockMinutes(%q) = %d, want an error", tc.in, got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("parseClockMinutes(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleWindow(t *testing.T) {
+	days := func(ds ...time.Weekday) [7]bool {
+		var out [7]bool
+		for _, d := range ds {
+			out[d] = true
+		}
+		return out
+	}
+	weekdays := days(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+	all := [7]bool{true, true, true, true, true, true, true}
+	for _, tc := range []struct {
+		spec string
+		want scheduleWindow
+		err  string
+	}{
+		{spec: "Mon-Fri 08:00-18:00", want: scheduleWindow{days: weekdays, from: 480, to: 1080}},
+		{spec: "  mon-fri   08:00-18:00 ", want: scheduleWindow{days: weekdays, from: 480, to: 1080}},
+		{spec: "Sat 09:00-12:00", want: scheduleWindow{days: days(time.Saturday), from: 540, to: 720}},
+		{spec: "Mon,Wed,Fri 09:00-10:00",
+			want: scheduleWindow{days: days(time.Monday, time.Wednesday, time.Friday), from: 540, to: 600}},
+		{spec: "Fri-Mon 10:00-11:00",
+			want: scheduleWindow{days: days(time.Friday, time.Saturday, time.Sunday, time.Monday), from: 600, to: 660}},
+		{spec: "Sat,Mon-Tue 10:00-11:00",
+			want: scheduleWindow{days: days(time.Saturday, time.Monday, time.Tuesday), from: 600, to: 660}},
+		{spec: "daily 00:00-24:00", want: scheduleWindow{days: all, from: 0, to: 1440}},
+		{spec: "* 06:00-07:00", want: scheduleWindow{days: all, from: 360, to: 420}},
+		{spec: "Mon-Fri 22:00-06:00", want: scheduleWindow{days: weekdays, from: 1320, to: 360}},
+
+		{spec: "", err: "want DAYS"},
+		{spec: "Mon-Fri", err: "want DAYS"},
+		{spec: "Mon 08:00", err: "want HH:MM-HH:MM"},
+		{spec: "Funday 08:00-09:00", err: "unknown day"},
+		{spec: "Mon- 08:00-09:00", err: "unknown day"},
+		{spec: "Mon,,Tue 08:00-09:00", err: "unknown day"},
+		{spec: "Mon 8am-9am", err: "bad time"},
+		{spec: "Mon 08:00-25:00", err: "bad time"},
+		{spec: "Mon 08:00-08:00", err: "empty window"},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := parseScheduleWindow(tc.spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScheduleCompile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    siteSchedule
+		err  string
+	}{
+		{name: "utc by default", s: siteSchedule{Hours: []string{"daily 08:00-18:00"}}},
+		{name: "zone", s: siteSchedule{Timezone: "America/Chicago", Hours: []string{"daily 08:00-18:00"}}},
+		{name: "unknown zone", s: siteSchedule{Timezone: "Mars/Olympus", Hours: []string{"daily 08:00-18:00"}},
+			err: "schedule timezone"},
+		{name: "no hours", s: siteSchedule{}, err: "needs hours"},
+		{name: "bad window named", s: siteSchedule{Hours: []string{"daily 08:00-18:00", "Mon 9-10"}},
+			err: `"Mon 9-10"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.s.compile()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func newTestSchedule(t *testing.T, zone string, hours ...string) *siteSchedule {
+	t.Helper()
+	s := &siteSchedule{Timezone: zone, Hours: hours}
+	if err := s.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleActive(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, chicago)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	office := newTestSchedule(t, "America/Chicago", "Mon-Fri 08:00-18:00", "Sat 09:00-12:00")
+	night := newTestSchedule(t, "America/Chicago", "Mon-Fri 22:00-06:00")
+	for _, tc := range []struct {
+		name string
+		s    *siteSchedule
+		at   time.Time
+		want bool
+	}{
+		// 2026-10-16 is a Friday
+		{"weekday opening minute", office, at("2026-10-16 08:00"), true},
+		{"weekday before opening", office, at("2026-10-16 07:59"), false},
+		{"weekday closing minute", office, at("2026-10-16 18:00"), false},
+		{"saturday morning", office, at("2026-10-17 10:00"), true},
+		{"saturday afternoon", office, at("2026-10-17 13:00"), false},
+		{"sunday", office, at("2026-10-18 10:00"), false},
+		{"same instant in utc", office, at("2026-10-16 08:00").UTC(), true},
+		{"overnight evening", night, at("2026-10-16 23:00"), true},
+		{"overnight runs into saturday", night, at("2026-10-17 05:59"), true},
+		{"overnight closes", night, at("2026-10-17 06:00"), false},
+		{"no window opens saturday night", night, at("2026-10-17 23:00"), false},
+		{"monday small hours belong to sunday", night, at("2026-10-19 02:00"), false},
+		{"tuesday small hours belong to monday", night, at("2026-10-20 02:00"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.s.Active(tc.at); got != tc.want {
+				t.Fatalf("Active(%s) = %v, want %v", tc.at, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScheduleActiveSeconds(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, chicago)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	office := newTestSchedule(t, "America/Chicago", "Mon-Fri 08:00-18:00")
+	for _, tc := range []struct {
+		name       string
+		s          *siteSchedule
+		since, now time.Time
+		want       time.Duration
+	}{
+		{"inside one window", office, at("2026-10-16 09:00"), at("2026-10-16 10:30"), 90 * time.Minute},
+		{"across closing", office, at("2026-10-16 17:30"), at("2026-10-16 19:00"), 30 * time.Minute},
+		{"across opening", office, at("2026-10-16 07:00"), at("2026-10-16 08:15"), 15 * time.Minute},
+		{"closed the whole time", office, at("2026-10-16 18:30"), at("2026-10-16 23:00"), 0},
+		{"over the weekend", office, at("2026-10-16 17:00"), at("2026-10-19 09:00"), 2 * time.Hour},
+		{"a full week", office, at("2026-10-12 00:00"), at("2026-10-19 00:00"), 50 * time.Hour},
+		{"overnight window", newTestSchedule(t, "America/Chicago", "Mon-Fri 22:00-06:00"),
+			at("2026-10-16 21:00"), at("2026-10-17 09:00"), 8 * time.Hour},
+		{"overlapping windows counted once",
+			newTestSchedule(t, "America/Chicago", "daily 08:00-18:00", "daily 12:00-20:00"),
+			at("2026-10-16 07:00"), at("2026-10-16 21:00"), 12 * time.Hour},
+		{"nested window counted once",
+			newTestSchedule(t, "America/Chicago", "daily 08:00-18:00", "daily 09:00-12:00"),
+			at("2026-10-16 07:00"), at("2026-10-16 21:00"), 10 * time.Hour},
+		{"overnight overlapping the next morning",
+			newTestSchedule(t, "America/Chicago", "daily 22:00-02:00", "daily 01:00-03:00"),
+			at("2026-10-16 21:00"), at("2026-10-17 04:00"), 5 * time.Hour},
+		// clocks go from 02:00 to 03:00 on 2026-03-08 and from 02:00 back
+		// to 01:00 on 2026-11-01, both Sundays in Chicago
+		{"spring forward inside the window", newTestSchedule(t, "America/Chicago", "daily 01:00-04:00"),
+			at("2026-03-08 00:00"), at("2026-03-08 12:00"), 2 * time.Hour},
+		{"fall back inside the window", newTestSchedule(t, "America/Chicago", "daily 01:00-04:00"),
+			at("2026-11-01 00:00"), at("2026-11-01 12:00"), 4 * time.Hour},
+		{"spring forward overnight", newTestSchedule(t, "America/Chicago", "Sat 22:00-06:00"),
+			at("2026-03-07 12:00"), at("2026-03-08 12:00"), 7 * time.Hour},
+		{"fall back overnight", newTestSchedule(t, "America/Chicago", "Sat 22:00-06:00"),
+			at("2026-10-31 12:00"), at("2026-11-01 12:00"), 9 * time.Hour},
+		{"spring forward office day unaffected", newTestSchedule(t, "America/Chicago", "daily 08:00-18:00"),
+			at("2026-03-08 00:00"), at("2026-03-09 00:00"), 10 * time.Hour},
+		{"now before the spring-forward window closes", newTestSchedule(t, "America/Chicago", "daily 01:00-04:00"),
+			at("2026-03-08 00:00"), at("2026-03-08 03:30"), 90 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := tc.s.activeSeconds(tc.since, tc.now)
+			if !ok {
+				t.Fatal("activeSeconds gave up")
+			}
+			if want := tc.want.Seconds(); got != want {
+				t.Fatalf("activeSeconds = %s, want %s", time.Duration(got*float64(time.Second)), tc.want)
+			}
+		})
+	}
+
+	t.Run("too long ago", func(t *testing.T) {
+		now := at("2026-10-16 12:00")
+		if _, ok := office.activeSeconds(now.Add(-(maxScheduleDays+1)*24*time.Hour), now); ok {
+			t.Fatal("activeSeconds walked past maxScheduleDays")
+		}
+	})
+}
+
+func TestApplySchedule(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Monday 09:00, an hour into the week; last transfer Friday 17:00
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, chicago)
+	wall := now.Sub(time.Date(2026, 10, 16, 17, 0, 0, 0, chicago)).Seconds()
+	for _, tc := range []struct {
+		name          string
+		schedule      *siteSchedule
+		now           time.Time
+		wantAge       float64
+		wantThreshold float64
+		wantActive    bool
+	}{
+		{name: "no schedule", now: now, wantAge: wall, wantThreshold: 3600, wantActive: true},
+		{name: "clock paused", schedule: newTestSchedule(t, "America/Chicago", "Mon-Fri 08:00-18:00"),
+			now: now, wantAge: 7200, wantThreshold: 3600, wantActive: true},
+		{name: "off-hours threshold while open",
+			schedule: &siteSchedule{Timezone: "America/Chicago", Hours: []string{"Mon-Fri 08:00-18:00"}, OffHoursThreshold: 50400},
+			now:      now, wantAge: wall, wantThreshold: 3600, wantActive: true},
+		{name: "off-hours threshold while closed",
+			schedule: &siteSchedule{Timezone: "America/Chicago", Hours: []string{"Mon-Fri 08:00-18:00"}, OffHoursThreshold: 50400},
+			now:      now.Add(-2 * time.Hour), wantAge: wall - 7200, wantThreshold: 50400},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.schedule != nil && tc.schedule.loc == nil {
+				if err := tc.schedule.compile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			age := tc.now.Sub(time.Date(2026, 10, 16, 17, 0, 0, 0, chicago)).Seconds()
+			s, cfg, active := applySchedule(SiteFresh{AgeSeconds: age}, siteConfig{Threshold: 3600, Schedule: tc.schedule}, tc.now)
+			if s.AgeSeconds != tc.wantAge || cfg.Threshold != tc.wantThreshold || active != tc.wantActive {
+				t.Fatalf("got age %v threshold %v active %v, want %v %v %v",
+					s.AgeSeconds, cfg.Threshold, active, tc.wantAge, tc.wantThreshold, tc.wantActive)
+			}
+		})
+	}
+}
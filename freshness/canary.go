@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// canarySource measures end-to-end freshness directly: every run it writes
+// a small timestamped object where the site's transfer path picks data up,
+// then watches the destination until the object shows up there. A site's
+// freshness is the write time of the newest canary that has arrived.
+type canarySource struct {
+	name       string
+	s3Settings `yaml:",inline"`
+	CAFile     string        `yaml:"ca_file"`
+	CertFile   string        `yaml:"cert_file"`
+	KeyFile    string        `yaml:"key_file"`
+	GiveUp     time.Duration `yaml:"give_up"`
+	Cleanup    bool          `yaml:"cleanup"`
+	Canaries   []canaryPath  `yaml:"canaries"`
+
+	http    *http.Client
+	pending map[string][]time.Time
+	arrived map[string]time.Time
+}
+
+// canaryPath's URLs are directories (or bucket prefixes) on storage spoken
+// to with the given protocol, s3 or webdav.
+type canaryPath struct {
+	Site     string `yaml:"site"`
+	Protocol string `yaml:"protocol"`
+	WriteURL string `yaml:"write_url"`
+	ReadURL  string `yaml:"read_url"`
+}
+
+var (
+	gaugeCanaryRoundtrip = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_canary_roundtrip_seconds", Help: "Time from writing the last arrived canary to seeing it at the destination"},
+		[]string{"site"},
+	)
+	canaryResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_canary_results_total", Help: "Canary objects by outcome (arrived, superseded, lost, write_error)"},
+		[]string{"site", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeCanaryRoundtrip, canaryResults)
+	registerSource("canary", func(name string, params *yaml.Node) (Source, error) {
+		s := &canarySource{
+			name:       name,
+			s3Settings: s3SettingsFromEnv(),
+			GiveUp:     time.Hour,
+			pending:    map[string][]time.Time{},
+			arrived:    map[string]time.Time{},
+		}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		for _, c := range s.Canaries {
+			if c.Protocol != "s3" && c.Protocol != "webdav" {
+				return nil, fmt.Errorf("canary %s: unknown protocol %q", c.Site, c.Protocol)
+			}
+		}
+		var err error
+		s.http, err = httpClientFor(s.CAFile, s.CertFile, s.KeyFile)
+		return s, err
+	})
+}
+
+func (s *canarySource) Name() string { return s.name }
+
+func (s *canarySource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	var out []SiteFresh
+	for _, c := range s.Canaries {
+		s.check(ctx, c, now)
+		if err := s.write(ctx, c, now); err != nil {
+			canaryResults.WithLabelValues(c.Site, "write_error").Inc()
+			fmt.Printf("[canary] %s write: %v\n", c.Site, err)
+		} else {
+			s.pending[c.Site] = append(s.pending[c.Site], now)
+		}
+		if t, ok := s.arrived[c.Site]; ok {
+			out = append(out, SiteFresh{
+				Site:            c.Site,
+				LatestTimestamp: float64(t.Unix()),
+				AgeSeconds:      now.Sub(t).Seconds(),
+			})
+		}
+	}
+	return out, nil
+}
+
+// check looks for the site's outstanding canaries at the destination,
+// newest first; once one has arrived every older one is settled too, as
+// superseded, without being looked for.
+func (s *canarySource) check(ctx context.Context, c canaryPath, now time.Time) {
+	pending := s.pending[c.Site]
+	var keep []time.Time
+	settled := 0
+	for i := len(pending) - 1; i >= 0; i-- {
+		written := pending[i]
+		status, err := s.do(ctx, c.Protocol, http.MethodHead, canaryURL(c.ReadURL, written), nil)
+		if err == nil && status == http.StatusOK {
+			canaryResults.WithLabelValues(c.Site, "arrived").Inc()
+			gaugeCanaryRoundtrip.WithLabelValues(c.Site).Set(now.Sub(written).Seconds())
+			if written.After(s.arrived[c.Site]) {
+				s.arrived[c.Site] = written
+			}
+			settled = i + 1
+			break
+		}
+		if now.Sub(written) > s.GiveUp {
+			canaryResults.WithLabelValues(c.Site, "lost").Inc()
+			continue
+		}
+		keep = append(keep, written)
+	}
+	for i, written := range pending[:settled] {
+		if i < settled-1 {
+			canaryResults.WithLabelValues(c.Site, "superseded").Inc()
+		}
+		if s.Cleanup {
+			s.do(ctx, c.Protocol, http.MethodDelete, canaryURL(c.WriteURL, written), nil)
+			s.do(ctx, c.Protocol, http.MethodDelete, canaryURL(c.ReadURL, written), nil)
+		}
+	}
+	slices.Reverse(keep)
+	s.pending[c.Site] = keep
+}
+
+func (s *canarySource) write(ctx context.Context, c canaryPath, now time.Time) error {
+	body := []byte(strconv.FormatInt(now.Unix(), 10) + "\n")
+	status, err := s.do(ctx, c.Protocol, http.MethodPut, canaryURL(c.WriteURL, now), body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated && status != http.StatusNoContent {
+		return fmt.Errorf("PUT: %d", status)
+	}
+	return nil
+}
+
+func (s *canarySource) do(ctx context.Context, protocol, method, u string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if protocol == "s3" && s.AccessKeyID != "" {
+		signV4(req, s.credentials(), s.Region, "s3", sha256Hex(body), time.Now())
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func canaryURL(dir string, written time.Time) string {
+	return strings.TrimRight(dir, "/") + "/dtms-canary-" + strconv.FormatInt(written.UnixNano(), 10)
+}
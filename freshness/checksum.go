@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Successful transfers carrying a URL and a checksum ("adler32:0a1b2c3d",
+// "md5:<hex>", "sha256:<hex>") are sampled at CHECKSUM_SAMPLE_RATE and
+// re-verified in the background. The storage is first asked for the digest
+// (RFC 3230 Want-Digest, served by dCache, XRootD and StoRM); otherwise the
+// file is read back in CHECKSUM_RANGE_BYTES range requests.
+var (
+	checksumSampleRate, _ = strconv.ParseFloat(envOr("CHECKSUM_SAMPLE_RATE", "0"), 64)
+	checksumWorkers       = envOrInt("CHECKSUM_WORKERS", 2)
+	checksumQueueSize     = envOrInt("CHECKSUM_QUEUE", 1000)
+	checksumWindow        = envOrInt("CHECKSUM_WINDOW", 100)
+	checksumRangeBytes    = int64(envOrInt("CHECKSUM_RANGE_BYTES", 8<<20))
+	checksumCAFile        = envOr("CHECKSUM_CA_FILE", "")
+	checksumCertFile      = envOr("CHECKSUM_CERT_FILE", "")
+	checksumKeyFile       = envOr("CHECKSUM_KEY_FILE", "")
+)
+
+var (
+	checksumVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_checksum_verifications_total", Help: "Sampled checksum re-verifications by result (match, mismatch, error, dropped)"},
+		[]string{"site", "result"},
+	)
+	gaugeCorruptionRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_checksum_corruption_ratio", Help: "Fraction of the site's recent verified files whose checksum did not match"},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(checksumVerifications, gaugeCorruptionRatio)
+}
+
+type checksumVerifier struct {
+	queue chan TransferEvent
+	http  *http.Client
+
+	mu     sync.Mutex
+	recent map[string][]bool // per site, true for a mismatch
+}
+
+var checksums = &checksumVerifier{
+	queue:  make(chan TransferEvent, checksumQueueSize),
+	recent: map[string][]bool{},
+}
+
+// sampleChecksum queues ev for verification if it is selected; a full
+// queue drops the sample rather than slowing ingestion down.
+func sampleChecksum(ev TransferEvent) {
+	if checksumSampleRate <= 0 || ev.Status != "success" || ev.URL == "" || ev.Checksum == "" {
+		return
+	}
+	if rand.Float64() >= checksumSampleRate {
+		return
+	}
+	select {
+	case checksums.queue <- ev:
+	default:
+		checksumVerifications.WithLabelValues(ev.Site, "dropped").Inc()
+	}
+}
+
+func (v *checksumVerifier) Run(ctx context.Context) {
+	var err error
+	v.http, err = httpClientFor(checksumCAFile, checksumCertFile, checksumKeyFile)
+	if err != nil {
+		fmt.Printf("[checksum] tls config error: %v\n", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < checksumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev := <-v.queue:
+					v.verify(ctx, ev)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (v *checksumVerifier) verify(ctx context.Context, ev TransferEvent) {
+	algo, want, ok := strings.Cut(strings.ToLower(ev.Checksum), ":")
+	if !ok || newChecksumHash(algo) == nil {
+		checksumVerifications.WithLabelValues(ev.Site, "error").Inc()
+		fmt.Printf("[checksum] %s: unsupported checksum %q\n", ev.URL, ev.Checksum)
+		return
+	}
+	got, err := v.storageDigest(ctx, ev.URL, algo)
+	if err == nil && got == "" {
+		got, err = v.readBack(ctx, ev.URL, algo)
+	}
+	if err != nil {
+		checksumVerifications.WithLabelValues(ev.Site, "error").Inc()
+		fmt.Printf("[checksum] %s: %v\n", ev.URL, err)
+		return
+	}
+	mismatch := normalizeChecksum(algo, got) != normalizeChecksum(algo, want)
+	if mismatch {
+		checksumVerifications.WithLabelValues(ev.Site, "mismatch").Inc()
+		fmt.Printf("[checksum] %s %s: mismatch, expected %s got %s\n", ev.Site, ev.URL, want, got)
+	} else {
+		checksumVerifications.WithLabelValues(ev.Site, "match").Inc()
+	}
+	v.record(ev.Site, mismatch)
+}
+
+func (v *checksumVerifier) record(site string, mismatch bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	r := append(v.recent[site], mismatch)
+	if len(r) > checksumWindow {
+		r = r[len(r)-checksumWindow:]
+	}
+	v.recent[site] = r
+	bad := 0
+	for _, m := range r {
+		if m {
+			bad++
+		}
+	}
+	gaugeCorruptionRatio.WithLabelValues(site).Set(float64(bad) / float64(len(r)))
+}
+
+// storageDigest asks the storage for its own checksum. It returns "" when
+// the endpoint does not offer the algorithm.
+func (v *checksumVerifier) storageDigest(ctx context.Context, u, algo string) (string, error) {
+	name := map[string]string{"adler32": "adler32", "md5": "md5", "sha256": "sha-256"}[algo]
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Want-Digest", name)
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD: %s", resp.Status)
+	}
+	for _, d := range strings.Split(resp.Header.Get("Digest"), ",") {
+		k, val, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(k, name) {
+			continue
+		}
+		if algo == "adler32" {
+			return val, nil
+		}
+		raw, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return "", fmt.Errorf("digest %s: %w", k, err)
+		}
+		return hex.EncodeToString(raw), nil
+	}
+	return "", nil
+}
+
+// readBack hashes the file through sequential range requests so a large
+// file never has to be held in one response.
+func (v *checksumVerifier) readBack(ctx context.Context, u, algo string) (string, error) {
+	h := newChecksumHash(algo)
+	for off := int64(0); ; off += checksumRangeBytes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+checksumRangeBytes-1))
+		resp, err := v.http.Do(req)
+		if err != nil {
+			return "", err
+		}
+		switch resp.StatusCode {
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			return hex.EncodeToString(h.Sum(nil)), nil
+		case http.StatusOK:
+			// The server ignored Range and sent the whole file.
+			_, err = io.Copy(h, resp.Body)
+			resp.Body.Close()
+			return hex.EncodeToString(h.Sum(nil)), err
+		case http.StatusPartialContent:
+		default:
+			resp.Body.Close()
+			return "", fmt.Errorf("GET: %s", resp.Status)
+		}
+		n, err := io.Copy(h, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if n < checksumRangeBytes {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+	}
+}
+
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case "adler32":
+		return adler32.New()
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// normalizeChecksum lowercases and, for adler32, restores the leading
+// zeros some tools drop.
+func normalizeChecksum(algo, sum string) string {
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	if algo == "adler32" && len(sum) < 8 {
+		sum = strings.Repeat("0", 8-len(sum)) + sum
+	}
+	return sum
+}
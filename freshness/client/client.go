@@ -0,0 +1,188 @@
+// Package client is a Go client for the DTMS HTTP APIs: dtms-api's
+// /freshness and /sites, and the freshness service's /api/v1 endpoints
+// (history, annotations, incidents). The two services listen on different
+// addresses, so point a Client at whichever one the calls go to:
+//
+//	api := client.New("http://dtms-api:8003")
+//	sites, err := api.Freshness(ctx)
+//
+//	svc := client.New("http://freshness:8004")
+//	svc.Token = os.Getenv("API_TOKEN")
+//	samples, _, err := svc.History(ctx, "SITE_A", from, to)
+//
+// Requests that fail on the network or with 429 or 5xx are retried with
+// exponential backoff, honouring Retry-After; requests that change state
+// are retried only when the server cannot have acted on them, that is on
+// dial errors and 429.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Client calls one DTMS service. Its fields may be changed until the first
+// request is made.
+type Client struct {
+	BaseURL string
+	// Token is sent as a bearer token; Username and Password, when set,
+	// are sent as basic auth instead (LDAP users of the freshness API).
+	Token    string
+	Username string
+	Password string
+	// HTTPClient defaults to one with a 30 second timeout.
+	HTTPClient *http.Client
+	// Retries is how many times a failed request is repeated, waiting
+	// Backoff, then twice that, and so on.
+	Retries int
+	Backoff time.Duration
+	// UserAgent identifies the calling program.
+	UserAgent string
+}
+
+// New returns a client for the service at baseURL with the default retry
+// policy of three retries starting at half a second.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Retries:    3,
+		Backoff:    500 * time.Millisecond,
+		UserAgent:  "dtms-client",
+	}
+}
+
+// Error is a response with a non-2xx status.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// IsNotFound reports whether err is a 404 from the service.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Do sends body as JSON to path and decodes a JSON response into out,
+// either of which may be nil; a []byte body is sent as it is. It is the
+// building block of the typed methods and covers endpoints they do not.
+func (c *Client) Do(ctx context.Context, method, path string, body, out interface{}) error {
+	var raw []byte
+	ctype := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		raw, ctype = b, "application/octet-stream"
+	default:
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	idempotent := method == http.MethodGet || method == http.MethodHead || method == http.MethodPut || method == http.MethodDelete
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, ctype, raw)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			// a failed dial never reached the server, so anything is safe
+			// to repeat; other network errors only for idempotent calls
+			if ctx.Err() != nil || (!idempotent && !isDialError(err)) {
+				return err
+			}
+		case resp.StatusCode < 300:
+			defer func() {
+				// drain what the decoder left so the connection is reused
+				io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+				resp.Body.Close()
+			}()
+			if out == nil || resp.StatusCode == http.StatusNoContent {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("%s %s: decoding response: %w", method, path, err)
+			}
+			return nil
+		default:
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(msg))}
+			if !retryable(resp.StatusCode) || (!idempotent && resp.StatusCode != http.StatusTooManyRequests) {
+				return err
+			}
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				wait = time.Duration(s) * time.Second
+			}
+		}
+		if attempt >= c.Retries {
+			return err
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isDialError reports whether err happened before a connection was made.
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func (c *Client) send(ctx context.Context, method, path, ctype string, body []byte) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", ctype)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	switch {
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return hc.Do(req)
+}
@@ -0,0 +1,508 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SiteFresh is one site's entry in dtms-api's /freshness.
+type SiteFresh struct {
+	Site            string  `json:"site"`
+	LatestTimestamp float64 `json:"latest_timestamp"`
+	AgeSeconds      float64 `json:"age_seconds"`
+}
+
+// HistorySample is one recorded evaluation of a site.
+type HistorySample struct {
+	Timestamp       float64 `json:"timestamp"`
+	Site            string  `json:"site"`
+	LatestTimestamp float64 `json:"latest_timestamp"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Ok              bool    `json:"ok"`
+}
+
+// Annotation is an operator note over a time range, for one site or, with
+// Site empty, for all of them.
+type Annotation struct {
+	ID      string   `json:"id,omitempty"`
+	Site    string   `json:"site,omitempty"`
+	Start   float64  `json:"start"`
+	End     float64  `json:"end,omitempty"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags,omitempty"`
+	Author  string   `json:"author,omitempty"`
+	Created float64  `json:"created,omitempty"`
+}
+
+// IncidentNote is a comment on an incident.
+type IncidentNote struct {
+	Timestamp float64 `json:"timestamp"`
+	Author    string  `json:"author,omitempty"`
+	Text      string  `json:"text"`
+}
+
+// Incident is a period in which a site was stale.
+type Incident struct {
+	ID            string         `json:"id"`
+	Site          string         `json:"site"`
+	Status        string         `json:"status"`
+	Start         float64        `json:"start"`
+	Opened        float64        `json:"opened"`
+	End           float64        `json:"end,omitempty"`
+	Duration      float64        `json:"duration_seconds"`
+	MaxAge        float64        `json:"max_age_seconds"`
+	Alerts        []string       `json:"alerts,omitempty"`
+	Hints         []string       `json:"hints,omitempty"`
+	Notes         []IncidentNote `json:"notes,omitempty"`
+	Resolution    string         `json:"resolution,omitempty"`
+	ProbableCause string         `json:"probable_cause,omitempty"`
+}
+
+// IncidentFilter narrows Incidents; zero fields do not filter.
+type IncidentFilter struct {
+	Site   string
+	Status string // open or resolved
+	Cause  string
+	From   time.Time
+	To     time.Time
+}
+
+func unix(t time.Time) string { return fmt.Sprint(t.Unix()) }
+
+// Freshness returns the latest transfer of every site (dtms-api).
+func (c *Client) Freshness(ctx context.Context) ([]SiteFresh, error) {
+	var out struct {
+		Sites []SiteFresh `json:"sites"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/freshness", nil, &out)
+	return out.Sites, err
+}
+
+// Sites lists the sites dtms-api knows of.
+func (c *Client) Sites(ctx context.Context) ([]string, error) {
+	var out struct {
+		Sites []string `json:"sites"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/sites", nil, &out)
+	return out.Sites, err
+}
+
+// History returns site's recorded samples between from and to together
+// with the annotations over the same range.
+func (c *Client) History(ctx context.Context, site string, from, to time.Time) ([]HistorySample, []Annotation, error) {
+	q := url.Values{"site": {site}, "from": {unix(from)}, "to": {unix(to)}}
+	var out struct {
+		Samples     []HistorySample `json:"samples"`
+		Annotations []Annotation    `json:"annotations"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/history?"+q.Encode(), nil, &out)
+	return out.Samples, out.Annotations, err
+}
+
+// Transition is a site turning stale or fresh again.
+type Transition struct {
+	Site             string  `json:"site"`
+	Timestamp        float64 `json:"timestamp"`
+	From             string  `json:"from"`
+	To               string  `json:"to"`
+	AgeSeconds       float64 `json:"age_seconds"`
+	Threshold        float64 `json:"threshold_seconds"`
+	PreviousDuration float64 `json:"previous_duration_seconds"`
+	PreviousPartial  bool    `json:"previous_partial,omitempty"`
+	Duration         float64 `json:"duration_seconds"`
+	Ongoing          bool    `json:"ongoing,omitempty"`
+}
+
+// Transitions lists every fresh↔stale transition of site, or of all sites
+// when it is empty, between from and to, oldest first.
+func (c *Client) Transitions(ctx context.Context, site string, from, to time.Time) ([]Transition, error) {
+	q := url.Values{"from": {unix(from)}, "to": {unix(to)}}
+	if site != "" {
+		q.Set("site", site)
+	}
+	var out struct {
+		Transitions []Transition `json:"transitions"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/transitions?"+q.Encode(), nil, &out)
+	return out.Transitions, err
+}
+
+// Annotations lists the annotations touching [from, to] that apply to
+// site, or all of them when site is empty.
+func (c *Client) Annotations(ctx context.Context, site string, from, to time.Time) ([]Annotation, error) {
+	q := url.Values{"from": {unix(from)}, "to": {unix(to)}}
+	if site != "" {
+		q.Set("site", site)
+	}
+	var out struct {
+		Annotations []Annotation `json:"annotations"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/annotations?"+q.Encode(), nil, &out)
+	return out.Annotations, err
+}
+
+// CreateAnnotation stores a and returns it as saved, with its ID.
+func (c *Client) CreateAnnotation(ctx context.Context, a Annotation) (Annotation, error) {
+	var created Annotation
+	err := c.Do(ctx, http.MethodPost, "/api/v1/annotations", a, &created)
+	return created, err
+}
+
+// DeleteAnnotation removes the annotation with the given ID.
+func (c *Client) DeleteAnnotation(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodDelete, "/api/v1/annotations/"+url.PathEscape(id), nil, nil)
+}
+
+// Incidents lists incidents matching f, oldest first.
+func (c *Client) Incidents(ctx context.Context, f IncidentFilter) ([]Incident, error) {
+	q := url.Values{}
+	for k, v := range map[string]string{"site": f.Site, "status": f.Status, "cause": f.Cause} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if !f.From.IsZero() {
+		q.Set("from", unix(f.From))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", unix(f.To))
+	}
+	var out struct {
+		Incidents []Incident `json:"incidents"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/incidents?"+q.Encode(), nil, &out)
+	return out.Incidents, err
+}
+
+// Incident returns one incident by ID.
+func (c *Client) Incident(ctx context.Context, id string) (Incident, error) {
+	var inc Incident
+	err := c.Do(ctx, http.MethodGet, "/api/v1/incidents/"+url.PathEscape(id), nil, &inc)
+	return inc, err
+}
+
+// AddIncidentNote comments on an incident; a non-empty resolution also
+// records how it was resolved.
+func (c *Client) AddIncidentNote(ctx context.Context, id, author, text, resolution string) (Incident, error) {
+	var inc Incident
+	body := map[string]string{"author": author, "text": text, "resolution": resolution}
+	err := c.Do(ctx, http.MethodPost, "/api/v1/incidents/"+url.PathEscape(id)+"/notes", body, &inc)
+	return inc, err
+}
+
+// TemplateRender asks the service to render a message or report template
+// against live data. Kind is message (the default), html or report;
+// messages take Site and Event, reports Tenant and Period.
+type TemplateRender struct {
+	Template string `json:"template"`
+	Kind     string `json:"kind,omitempty"`
+	Site     string `json:"site,omitempty"`
+	Event    string `json:"event,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Period   string `json:"period,omitempty"`
+}
+
+// RenderTemplate returns what the service would send for req.
+func (c *Client) RenderTemplate(ctx context.Context, req TemplateRender) (string, error) {
+	var out struct {
+		Output string `json:"output"`
+	}
+	err := c.Do(ctx, http.MethodPost, "/api/v1/templates/render", req, &out)
+	return out.Output, err
+}
+
+// DeadLetter is an event the service could not ingest, with the payload
+// as it arrived.
+type DeadLetter struct {
+	ID       string  `json:"id"`
+	Time     float64 `json:"time"`
+	Origin   string  `json:"origin"`
+	Reason   string  `json:"reason"`
+	Error    string  `json:"error"`
+	Payload  string  `json:"payload"`
+	Fixed    bool    `json:"fixed,omitempty"`
+	Replays  int     `json:"replays,omitempty"`
+	Replayed float64 `json:"last_replay,omitempty"`
+}
+
+// DeadLetters lists dead-lettered events from origin with reason
+// ("invalid" or "persist"), either empty for any, newest first.
+func (c *Client) DeadLetters(ctx context.Context, origin, reason string, limit int) ([]DeadLetter, error) {
+	q := url.Values{}
+	if origin != "" {
+		q.Set("origin", origin)
+	}
+	if reason != "" {
+		q.Set("reason", reason)
+	}
+	if limit > 0 {
+		q.Set("limit", fmt.Sprint(limit))
+	}
+	var out struct {
+		DeadLetters []DeadLetter `json:"dead_letters"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/dead-letters?"+q.Encode(), nil, &out)
+	return out.DeadLetters, err
+}
+
+// DeadLetter returns one dead-lettered event by ID.
+func (c *Client) DeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	var d DeadLetter
+	err := c.Do(ctx, http.MethodGet, "/api/v1/dead-letters/"+url.PathEscape(id), nil, &d)
+	return d, err
+}
+
+// FixDeadLetter replaces a dead-lettered event's payload, to be replayed.
+func (c *Client) FixDeadLetter(ctx context.Context, id string, payload json.RawMessage) (DeadLetter, error) {
+	var d DeadLetter
+	err := c.Do(ctx, http.MethodPut, "/api/v1/dead-letters/"+url.PathEscape(id), payload, &d)
+	return d, err
+}
+
+// ReplayDeadLetter ingests a dead-lettered event again; on success the
+// entry is gone from the queue.
+func (c *Client) ReplayDeadLetter(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodPost, "/api/v1/dead-letters/"+url.PathEscape(id)+"/replay", nil, nil)
+}
+
+// ReplayDeadLetters replays every entry matching origin and reason and
+// returns how many were ingested and the entries that failed again.
+func (c *Client) ReplayDeadLetters(ctx context.Context, origin, reason string) (int, []DeadLetter, error) {
+	q := url.Values{}
+	if origin != "" {
+		q.Set("origin", origin)
+	}
+	if reason != "" {
+		q.Set("reason", reason)
+	}
+	var out struct {
+		Ingested int          `json:"ingested"`
+		Failed   []DeadLetter `json:"failed"`
+	}
+	err := c.Do(ctx, http.MethodPost, "/api/v1/dead-letters/replay?"+q.Encode(), nil, &out)
+	return out.Ingested, out.Failed, err
+}
+
+// DiscardDeadLetter removes an entry without replaying it.
+func (c *Client) DiscardDeadLetter(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodDelete, "/api/v1/dead-letters/"+url.PathEscape(id), nil, nil)
+}
+
+// BackfillOptions describe one backfill request. Kind is transfers or
+// samples, Format csv or jsonl; FirstLine numbers the data's first line
+// in the error report, for files sent in chunks.
+type BackfillOptions struct {
+	Kind        string
+	Format      string
+	FirstLine   int
+	DryRun      bool
+	SkipInvalid bool
+}
+
+// BackfillResult is the outcome of a backfill request. Skipped records
+// were already imported.
+type BackfillResult struct {
+	Kind     string `json:"kind"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+	Read     int    `json:"read"`
+	Imported int    `json:"imported"`
+	Skipped  int    `json:"skipped"`
+	Invalid  int    `json:"invalid"`
+	Errors   []struct {
+		Line  int    `json:"line"`
+		Error string `json:"error"`
+	} `json:"errors,omitempty"`
+}
+
+// Backfill imports historical transfer events or freshness samples. When
+// records are invalid and SkipInvalid is not set nothing is imported, and
+// the result lists them along with an error.
+func (c *Client) Backfill(ctx context.Context, opts BackfillOptions, data []byte) (BackfillResult, error) {
+	q := url.Values{"kind": {opts.Kind}, "format": {opts.Format}}
+	if opts.FirstLine > 0 {
+		q.Set("first_line", fmt.Sprint(opts.FirstLine))
+	}
+	if opts.DryRun {
+		q.Set("dry_run", "true")
+	}
+	if opts.SkipInvalid {
+		q.Set("skip_invalid", "true")
+	}
+	var res BackfillResult
+	err := c.Do(ctx, http.MethodPost, "/api/v1/backfill?"+q.Encode(), data, &res)
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusUnprocessableEntity {
+		json.Unmarshal([]byte(e.Body), &res)
+	}
+	return res, err
+}
+
+// AgentRegistration is a site whose agent registered itself, and what an
+// admin decided about it.
+type AgentRegistration struct {
+	Site      string  `json:"site"`
+	Status    string  `json:"status"`
+	Requested float64 `json:"requested"`
+	LastSeen  float64 `json:"last_seen,omitempty"`
+	Decided   float64 `json:"decided,omitempty"`
+	DecidedBy string  `json:"decided_by,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Hostname  string  `json:"hostname,omitempty"`
+	Version   string  `json:"version,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	// KeySHA256 is the hash of the key the agent registered with.
+	KeySHA256 string          `json:"key_sha256,omitempty"`
+	Spec      json.RawMessage `json:"spec,omitempty"`
+}
+
+// AgentApproval sets up an approved site. It is kept with the
+// registration, not as a managed entry, so the operator does not prune
+// it; left empty, the site keeps its settings.
+type AgentApproval struct {
+	Tier      string            `json:"tier,omitempty"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Threshold float64           `json:"threshold,omitempty"`
+	Ok        string            `json:"ok,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// AgentRegistrations lists registrations with status ("pending",
+// "approved" or "rejected"; empty for all), pending first.
+func (c *Client) AgentRegistrations(ctx context.Context, status string) ([]AgentRegistration, error) {
+	q := url.Values{}
+	if status != "" {
+		q.Set("status", status)
+	}
+	var out struct {
+		Registrations []AgentRegistration `json:"registrations"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/agent/registrations?"+q.Encode(), nil, &out)
+	return out.Registrations, err
+}
+
+// ApproveAgent lets site's agent in, setting the site up as a.
+func (c *Client) ApproveAgent(ctx context.Context, site string, a AgentApproval) (AgentRegistration, error) {
+	var reg AgentRegistration
+	err := c.Do(ctx, http.MethodPost, "/api/v1/agent/registrations/"+url.PathEscape(site)+"/approve", a, &reg)
+	return reg, err
+}
+
+// RejectAgent refuses site's agent tokens until the registration is deleted.
+func (c *Client) RejectAgent(ctx context.Context, site, reason string) (AgentRegistration, error) {
+	var reg AgentRegistration
+	body := map[string]string{"reason": reason}
+	err := c.Do(ctx, http.MethodPost, "/api/v1/agent/registrations/"+url.PathEscape(site)+"/reject", body, &reg)
+	return reg, err
+}
+
+// DeleteAgentRegistration forgets site's registration; its agent is
+// filed as pending again when it next calls.
+func (c *Client) DeleteAgentRegistration(ctx context.Context, site string) error {
+	return c.Do(ctx, http.MethodDelete, "/api/v1/agent/registrations/"+url.PathEscape(site), nil, nil)
+}
+
+// GlobalSiteReport is one federated region's view of a site.
+type GlobalSiteReport struct {
+	Region          string  `json:"region"`
+	RegionUp        bool    `json:"region_up"`
+	LatestTimestamp float64 `json:"latest_timestamp,omitempty"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Ok              bool    `json:"ok"`
+	Evaluated       float64 `json:"evaluated,omitempty"`
+}
+
+// GlobalSite is a site's freshness across a federation, taken from the
+// region that saw its latest arrival.
+type GlobalSite struct {
+	Site            string             `json:"site"`
+	Tags            map[string]string  `json:"tags"`
+	LatestTimestamp float64            `json:"latest_timestamp,omitempty"`
+	AgeSeconds      float64            `json:"age_seconds"`
+	Ok              bool               `json:"ok"`
+	InDowntime      bool               `json:"in_downtime"`
+	Evaluated       float64            `json:"evaluated,omitempty"`
+	SourceRegion    string             `json:"source_region"`
+	SourceUp        bool               `json:"source_up"`
+	Conflict        bool               `json:"conflict,omitempty"`
+	Reports         []GlobalSiteReport `json:"reports"`
+}
+
+// GlobalRegion is a federated region's availability over the last day.
+type GlobalRegion struct {
+	Name         string  `json:"name"`
+	Up           bool    `json:"up"`
+	LastReport   float64 `json:"last_report,omitempty"`
+	Availability float64 `json:"availability"`
+	Sites        int     `json:"sites"`
+	Winning      int     `json:"winning_sites"`
+}
+
+// GlobalFreshness returns a central instance's regions and the sites
+// matching tags across them; tags may be empty.
+func (c *Client) GlobalFreshness(ctx context.Context, tags string) ([]GlobalRegion, []GlobalSite, error) {
+	q := url.Values{}
+	if tags != "" {
+		q.Set("tags", tags)
+	}
+	var out struct {
+		Regions []GlobalRegion `json:"regions"`
+		Sites   []GlobalSite   `json:"sites"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/global/freshness?"+q.Encode(), nil, &out)
+	return out.Regions, out.Sites, err
+}
+
+// ExpectedArrival is a cron schedule data is expected at a site on, and
+// optionally of one dataset, with where its checks stand.
+type ExpectedArrival struct {
+	ID           string  `json:"id,omitempty"`
+	Site         string  `json:"site"`
+	Dataset      string  `json:"dataset,omitempty"`
+	Cron         string  `json:"cron"`
+	Timezone     string  `json:"timezone,omitempty"`
+	GraceMinutes int     `json:"grace_minutes,omitempty"`
+	Author       string  `json:"author,omitempty"`
+	Created      float64 `json:"created,omitempty"`
+	Due          float64 `json:"due,omitempty"`
+	LastArrival  float64 `json:"last_arrival,omitempty"`
+	Missed       bool    `json:"missed,omitempty"`
+	MissedDue    float64 `json:"missed_due,omitempty"`
+	Met          int     `json:"met,omitempty"`
+	Misses       int     `json:"misses,omitempty"`
+}
+
+// ExpectedArrivals lists the expected arrivals at site, or at every site
+// when it is empty, and only the missed ones with missed set.
+func (c *Client) ExpectedArrivals(ctx context.Context, site string, missed bool) ([]ExpectedArrival, error) {
+	q := url.Values{}
+	if site != "" {
+		q.Set("site", site)
+	}
+	if missed {
+		q.Set("missed", "true")
+	}
+	var out struct {
+		ExpectedArrivals []ExpectedArrival `json:"expected_arrivals"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/api/v1/expected-arrivals?"+q.Encode(), nil, &out)
+	return out.ExpectedArrivals, err
+}
+
+// CreateExpectedArrival registers e and returns it as saved, with its ID
+// and first due time.
+func (c *Client) CreateExpectedArrival(ctx context.Context, e ExpectedArrival) (ExpectedArrival, error) {
+	var created ExpectedArrival
+	err := c.Do(ctx, http.MethodPost, "/api/v1/expected-arrivals", e, &created)
+	return created, err
+}
+
+// DeleteExpectedArrival removes the expected arrival with the given ID.
+func (c *Client) DeleteExpectedArrival(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodDelete, "/api/v1/expected-arrivals/"+url.PathEscape(id), nil, nil)
+}
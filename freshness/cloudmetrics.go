@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Cloud-native metrics outputs for METRICS_OUTPUTS_CONFIG. They bill per
+// series and per request, so they default to dtms_data_fresh_seconds only
+// (override with `metrics`), batch as many points per call as each API
+// allows, and should be given an interval no shorter than the resolution
+// the alarms need:
+//
+//	outputs:
+//	  - type: cloudwatch
+//	    namespace: DTMS
+//	    region: eu-west-1
+//	    storage_resolution: 60     # 1 for high-resolution (priced higher)
+//	    interval: 1m
+//	  - type: azure_monitor
+//	    region: westeurope
+//	    resource_id: /subscriptions/.../resourceGroups/dtms/providers/Microsoft.ContainerService/managedClusters/dtms
+//	    tenant_id: ...
+//	    client_id: ...
+//	    client_secret: ${AZURE_CLIENT_SECRET}
+//	    interval: 1m
+//	  - type: gcp_monitoring
+//	    project: my-project
+//	    credentials_file: /secrets/monitoring.json   # metadata server when unset
+//	    interval: 1m
+const (
+	cloudMetricsDefault = `^dtms_data_fresh_seconds$`
+
+	cloudWatchBatch = 1000
+	gcpBatch        = 200
+)
+
+// cloudOutput marks the cloud outputs, which default to
+// cloudMetricsDefault rather than the global metrics filter.
+type cloudOutput struct{}
+
+func (cloudOutput) defaultMetrics() string { return cloudMetricsDefault }
+
+// cloudWatchOutput calls PutMetricData with CLOUDWATCH_ACCESS_KEY_ID and
+// friends, falling back to the AWS_* environment, one dimension per label.
+type cloudWatchOutput struct {
+	cloudOutput
+
+	Namespace         string `yaml:"namespace"`
+	Region            string `yaml:"region"`
+	Endpoint          string `yaml:"endpoint"`
+	StorageResolution int    `yaml:"storage_resolution"`
+	creds             awsCredentials
+}
+
+func init() {
+	registerOutput("cloudwatch", func(params *yaml.Node) (metricsOutput, error) {
+		o := &cloudWatchOutput{Namespace: "DTMS", Region: envOr("AWS_REGION", "us-east-1"), StorageResolution: 60}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.StorageResolution != 1 && o.StorageResolution != 60 {
+			return nil, fmt.Errorf("storage_resolution must be 1 or 60")
+		}
+		if o.Endpoint == "" {
+			o.Endpoint = "https://monitoring." + o.Region + ".amazonaws.com"
+		}
+		o.creds = awsCredentials{
+			AccessKeyID:     envOr("CLOUDWATCH_ACCESS_KEY_ID", getenv("AWS_ACCESS_KEY_ID")),
+			SecretAccessKey: envOr("CLOUDWATCH_SECRET_ACCESS_KEY", getenv("AWS_SECRET_ACCESS_KEY")),
+			SessionToken:    envOr("CLOUDWATCH_SESSION_TOKEN", getenv("AWS_SESSION_TOKEN")),
+		}
+		return o, nil
+	})
+}
+
+func (o *cloudWatchOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	for start := 0; start < len(points); start += cloudWatchBatch {
+		end := start + cloudWatchBatch
+		if end > len(points) {
+			end = len(points)
+		}
+		form := url.Values{"Action": {"PutMetricData"}, "Version": {"2010-08-01"}, "Namespace": {o.Namespace}}
+		for i, p := range points[start:end] {
+			m := fmt.Sprintf("MetricData.member.%d.", i+1)
+			form.Set(m+"MetricName", p.name)
+			form.Set(m+"Value", strconv.FormatFloat(p.value, 'g', -1, 64))
+			form.Set(m+"Timestamp", now.UTC().Format(time.RFC3339))
+			form.Set(m+"StorageResolution", strconv.Itoa(o.StorageResolution))
+			for j, k := range p.sortedLabels() {
+				d := fmt.Sprintf("%sDimensions.member.%d.", m, j+1)
+				form.Set(d+"Name", k)
+				form.Set(d+"Value", p.labels[k])
+			}
+		}
+		body := []byte(form.Encode())
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Endpoint+"/", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		signV4(req, o.creds, o.Region, "monitoring", sha256Hex(body), now)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("PutMetricData: %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// azureMonitorOutput posts custom metrics to a resource, authenticating as
+// an Azure AD application. The API takes one metric per request, with the
+// sites as series.
+type azureMonitorOutput struct {
+	cloudOutput
+
+	Region       string `yaml:"region"`
+	ResourceID   string `yaml:"resource_id"`
+	Namespace    string `yaml:"namespace"`
+	TenantID     string `yaml:"tenant_id"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	tokens       *clientCredentials
+}
+
+func init() {
+	registerOutput("azure_monitor", func(params *yaml.Node) (metricsOutput, error) {
+		o := &azureMonitorOutput{Namespace: "DTMS"}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.Region == "" || o.ResourceID == "" || o.TenantID == "" || o.ClientID == "" {
+			return nil, fmt.Errorf("region, resource_id, tenant_id and client_id are required")
+		}
+		o.tokens = &clientCredentials{
+			TokenURL:     "https://login.microsoftonline.com/" + o.TenantID + "/oauth2/v2.0/token",
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			Scope:        "https://monitoring.azure.com/.default",
+		}
+		return o, nil
+	})
+}
+
+func (o *azureMonitorOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	type series struct {
+		DimValues []string `json:"dimValues"`
+		Min       float64  `json:"min"`
+		Max       float64  `json:"max"`
+		Sum       float64  `json:"sum"`
+		Count     int      `json:"count"`
+	}
+	type metric struct {
+		dimNames []string
+		series   []series
+	}
+	byName := map[string]*metric{}
+	var names []string
+	for _, p := range points {
+		m := byName[p.name]
+		if m == nil {
+			m = &metric{dimNames: p.sortedLabels()}
+			byName[p.name] = m
+			names = append(names, p.name)
+		}
+		values := make([]string, len(m.dimNames))
+		for i, k := range m.dimNames {
+			values[i] = p.labels[k]
+		}
+		m.series = append(m.series, series{values, p.value, p.value, p.value, 1})
+	}
+	tok, err := o.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	u := "https://" + o.Region + ".monitoring.azure.com" + o.ResourceID + "/metrics"
+	for _, name := range names {
+		m := byName[name]
+		body, _ := json.Marshal(map[string]interface{}{
+			"time": now.UTC().Format(time.RFC3339),
+			"data": map[string]interface{}{"baseData": map[string]interface{}{
+				"metric":    name,
+				"namespace": o.Namespace,
+				"dimNames":  m.dimNames,
+				"series":    m.series,
+			}},
+		})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", name, resp.Status)
+		}
+	}
+	return nil
+}
+
+// gcpMonitoringOutput writes custom.googleapis.com/dtms/<metric> gauges on
+// the global resource, with the same credentials as the BigQuery sink.
+type gcpMonitoringOutput struct {
+	cloudOutput
+
+	Project         string `yaml:"project"`
+	CredentialsFile string `yaml:"credentials_file"`
+	Endpoint        string `yaml:"endpoint"`
+	tokens          *googleTokenSource
+}
+
+func init() {
+	registerOutput("gcp_monitoring", func(params *yaml.Node) (metricsOutput, error) {
+		o := &gcpMonitoringOutput{Endpoint: "https://monitoring.googleapis.com"}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.Project == "" {
+			return nil, fmt.Errorf("project is required")
+		}
+		o.tokens = &googleTokenSource{scope: "https://www.googleapis.com/auth/monitoring.write"}
+		if o.CredentialsFile != "" {
+			if err := o.tokens.loadKey(o.CredentialsFile); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	})
+}
+
+func (o *gcpMonitoringOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	tok, err := o.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	end := now.UTC().Format(time.RFC3339)
+	u := strings.TrimRight(o.Endpoint, "/") + "/v3/projects/" + url.PathEscape(o.Project) + "/timeSeries"
+	for start := 0; start < len(points); start += gcpBatch {
+		stop := start + gcpBatch
+		if stop > len(points) {
+			stop = len(points)
+		}
+		var series []interface{}
+		for _, p := range points[start:stop] {
+			series = append(series, map[string]interface{}{
+				"metric":     map[string]interface{}{"type": "custom.googleapis.com/dtms/" + p.name, "labels": p.labels},
+				"resource":   map[string]interface{}{"type": "global", "labels": map[string]string{"project_id": o.Project}},
+				"metricKind": "GAUGE",
+				"valueType":  "DOUBLE",
+				"points": []interface{}{map[string]interface{}{
+					"interval": map[string]string{"endTime": end},
+					"value":    map[string]float64{"doubleValue": p.value},
+				}},
+			})
+		}
+		body, _ := json.Marshal(map[string]interface{}{"timeSeries": series})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("timeSeries.create: %s", resp.Status)
+		}
+	}
+	return nil
+}
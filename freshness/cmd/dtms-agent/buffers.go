@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The staging and buffer areas transfers land in are listed under
+// buffers: in AGENT_CONFIG. Every buffer_interval the agent reads their
+// free space and inodes, exports them on AGENT_METRICS_ADDR and, when it
+// has a site token (AGENT_BOOTSTRAP_TOKEN), reports them to the service,
+// which alerts and hints on buffers past their warn percentage: a full
+// buffer stalls transfers without any of them failing loudly.
+type bufferConfig struct {
+	Name        string  `yaml:"name"`
+	Path        string  `yaml:"path"`
+	WarnPercent float64 `yaml:"warn_percent"`
+}
+
+// bufferUsage mirrors the service's BufferUsage.
+type bufferUsage struct {
+	Name        string  `json:"name"`
+	Path        string  `json:"path"`
+	SizeBytes   uint64  `json:"size_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	Inodes      uint64  `json:"inodes"`
+	InodesFree  uint64  `json:"inodes_free"`
+	WarnPercent float64 `json:"warn_percent"`
+	Error       string  `json:"error,omitempty"`
+}
+
+var (
+	bufferLabels     = []string{"buffer"}
+	gaugeBufferSize  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_agent_buffer_size_bytes", Help: "Size of the filesystem holding a buffer area"}, bufferLabels)
+	gaugeBufferFree  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_agent_buffer_free_bytes", Help: "Bytes available to unprivileged writers in a buffer area"}, bufferLabels)
+	gaugeBufferInode = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_agent_buffer_inodes", Help: "Inodes of the filesystem holding a buffer area"}, bufferLabels)
+	gaugeBufferIFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_agent_buffer_inodes_free", Help: "Free inodes in a buffer area"}, bufferLabels)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeBufferSize, gaugeBufferFree, gaugeBufferInode, gaugeBufferIFree)
+}
+
+func (b bufferConfig) usage() bufferUsage {
+	u := bufferUsage{Name: b.Name, Path: b.Path, WarnPercent: b.WarnPercent}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(b.Path, &st); err != nil {
+		u.Error = err.Error()
+		return u
+	}
+	bs := uint64(st.Bsize)
+	u.SizeBytes, u.FreeBytes = st.Blocks*bs, st.Bavail*bs
+	u.Inodes, u.InodesFree = st.Files, st.Ffree
+	return u
+}
+
+// bufferLoop measures the buffers every interval until ctx is done.
+func bufferLoop(ctx context.Context, cfg agentConfig, p *httpPusher) {
+	t := time.NewTicker(cfg.BufferInterval)
+	defer t.Stop()
+	for {
+		usage := make([]bufferUsage, 0, len(cfg.Buffers))
+		for _, b := range cfg.Buffers {
+			u := b.usage()
+			if u.Error != "" {
+				fmt.Printf("[agent] buffer %s: %s\n", b.Name, u.Error)
+			} else {
+				gaugeBufferSize.WithLabelValues(b.Name).Set(float64(u.SizeBytes))
+				gaugeBufferFree.WithLabelValues(b.Name).Set(float64(u.FreeBytes))
+				gaugeBufferInode.WithLabelValues(b.Name).Set(float64(u.Inodes))
+				gaugeBufferIFree.WithLabelValues(b.Name).Set(float64(u.InodesFree))
+			}
+			usage = append(usage, u)
+		}
+		if bootstrapToken != "" {
+			if err := reportBuffers(ctx, p, usage); err != nil {
+				fmt.Printf("[agent] buffer report: %v\n", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func reportBuffers(ctx context.Context, p *httpPusher, usage []bufferUsage) error {
+	body, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	resp, err := apiRequest(ctx, p, http.MethodPost, "/api/v1/agent/buffers", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Besides json and regex, log watches understand the transfer logs of
+// common storage services, so sites need no shipper script of their own:
+//
+//	format: gridftp         the Globus GridFTP server's transfer log
+//	                        (-log-transfer): DATE, START, NBYTES, FILE,
+//	                        TYPE and CODE; the DN when the server logs a
+//	                        DN= field
+//	format: webdav          Apache or nginx access logs in the combined
+//	                        format followed by the request time, the client
+//	                        DN and the request size:
+//	                          Apache  ... "%{User-agent}i" %D "%{SSL_CLIENT_S_DN}x" %I
+//	                          nginx   ... "$http_user_agent" $request_time "$ssl_client_s_dn" $request_length
+//	format: dcache-billing  dCache's billing file in its default format:
+//	                        one event per door request line, with the DN
+//	                        of its owner and, when the pool's transfer line
+//	                        for the file came first, the bytes moved and
+//	                        the mover's time
+//
+// operations keeps only the listed operations: the GridFTP TYPE (RETR,
+// STOR, ESTO, ERET), the HTTP method, or read and write in dCache. webdav
+// defaults to GET, PUT and COPY so directory listings are not reported as
+// transfers. Failed requests become failed events with the server's code
+// as the reason.
+
+// gridftpTime is the layout of the DATE and START fields; any fraction of
+// a second is parsed without being in the layout.
+const gridftpTime = "20060102150405"
+
+// gridftpFields splits KEY=value pairs, values optionally double-quoted.
+var gridftpFields = regexp.MustCompile(`([A-Za-z_.]+)=("[^"]*"|\S*)`)
+
+func parseGridFTP(line string) (ev transferEvent, op string, ok bool, err error) {
+	f := map[string]string{}
+	for _, m := range gridftpFields.FindAllStringSubmatch(line, -1) {
+		f[m[1]] = strings.Trim(m[2], `"`)
+	}
+	if f["DATE"] == "" || f["NBYTES"] == "" {
+		return ev, "", false, nil
+	}
+	end, err := time.ParseInLocation(gridftpTime, f["DATE"], time.UTC)
+	if err != nil {
+		return ev, "", false, fmt.Errorf("DATE: %w", err)
+	}
+	ev.Timestamp = float64(end.UnixNano()) / 1e9
+	if start, err := time.ParseInLocation(gridftpTime, f["START"], time.UTC); err == nil && !start.After(end) {
+		ev.Duration = end.Sub(start).Seconds()
+	}
+	if ev.Bytes, err = strconv.ParseInt(f["NBYTES"], 10, 64); err != nil {
+		return ev, "", false, fmt.Errorf("NBYTES: %w", err)
+	}
+	ev.File = f["FILE"]
+	ev.ClientDN = f["DN"]
+	ev.Status = "success"
+	if code := f["CODE"]; code != "" && code != "226" {
+		ev.Status, ev.Reason = "failed", "gridftp code "+code
+	}
+	return ev, f["TYPE"], true, nil
+}
+
+// accessLogLine matches the combined format with the trailing request
+// time, client DN and request size, each of which may be missing.
+var accessLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) (\d+|-)(?: "[^"]*" "[^"]*")?(?: (\d+(?:\.\d+)?|-))?(?: "([^"]*)")?(?: (\d+|-))?`)
+
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// webdavOperations are the methods that move data.
+var webdavOperations = []string{"GET", "PUT", "COPY"}
+
+func parseAccessLog(line string) (ev transferEvent, op string, ok bool, err error) {
+	m := accessLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return ev, "", false, nil
+	}
+	t, err := time.Parse(accessLogTime, m[1])
+	if err != nil {
+		return ev, "", false, fmt.Errorf("time: %w", err)
+	}
+	ev.Timestamp = float64(t.UnixNano()) / 1e9
+	op = m[2]
+	path, _, _ := strings.Cut(m[3], "?")
+	if p, err := url.PathUnescape(path); err == nil {
+		path = p
+	}
+	ev.File = path
+	// the body of a PUT is the request; what is sent back is not the file
+	size := m[5]
+	if op == "PUT" {
+		size = m[8]
+	}
+	if size != "" && size != "-" {
+		ev.Bytes, _ = strconv.ParseInt(size, 10, 64)
+	}
+	// nginx logs seconds with a fraction, Apache's %D whole microseconds
+	switch d := m[6]; {
+	case d == "" || d == "-":
+	case strings.Contains(d, "."):
+		ev.Duration, _ = strconv.ParseFloat(d, 64)
+	default:
+		us, _ := strconv.ParseInt(d, 10, 64)
+		ev.Duration = float64(us) / 1e6
+	}
+	if dn := m[7]; dn != "-" {
+		ev.ClientDN = dn
+	}
+	ev.Status = "success"
+	if m[4][0] != '2' {
+		ev.Status, ev.Reason = "failed", "HTTP "+m[4]
+	}
+	return ev, op, true, nil
+}
+
+// dCache's default billing lines: a pool's mover-info and a door's
+// request-info. Dates carry no year.
+var (
+	billingMoverLine = regexp.MustCompile(`^(\d\d\.\d\d \d\d:\d\d:\d\d) \[pool:[^\]]*:transfer\] \[([0-9A-Fa-f]+),(-?\d+)\] \[[^\]]*\] \S+ (-?\d+) (-?\d+) (true|false) `)
+	billingDoorLine  = regexp.MustCompile(`^(\d\d\.\d\d \d\d:\d\d:\d\d) \[door:[^\]]*:request\] \["(.*)":-?\d+:-?\d+:[^\]]*\] \[([0-9A-Fa-f]+),(-?\d+)\] \[([^\]]*)\] \S+ (-?\d+) -?\d+ \{(-?\d+):"(.*)"\}`)
+)
+
+const (
+	billingTime = "01.02 15:04:05"
+	// billingMovers bounds the pool transfers kept for door lines to come.
+	billingMovers = 10000
+)
+
+// billingMover is what a pool's transfer line adds to its door's line.
+type billingMover struct {
+	bytes   int64
+	millis  int64
+	created bool
+}
+
+// billingJoin remembers recent pool transfers by pnfsid. It lives in
+// memory only: a door line read after a restart, or whose pool line is
+// not in the file, reports the file's size and the door's time instead.
+type billingJoin struct {
+	movers map[string]billingMover
+	order  []string
+}
+
+func newBillingJoin() *billingJoin {
+	return &billingJoin{movers: map[string]billingMover{}}
+}
+
+func (j *billingJoin) remember(id string, m billingMover) {
+	if _, ok := j.movers[id]; !ok {
+		j.order = append(j.order, id)
+	}
+	j.movers[id] = m
+	for len(j.order) > billingMovers {
+		delete(j.movers, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+// billingDate places a yearless billing date in the last year: the latest
+// year in which it exists and is not more than a day ahead of now, so a
+// 02.29 line falls in the last leap year.
+func billingDate(v string, now time.Time) (time.Time, error) {
+	t, err := time.ParseInLocation(billingTime, v, time.Local)
+	if err != nil {
+		return t, err
+	}
+	for y := now.Year(); ; y-- {
+		d := time.Date(y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+		if d.Day() == t.Day() && !d.After(now.Add(24*time.Hour)) {
+			return d, nil
+		}
+	}
+}
+
+func (j *billingJoin) parse(line string) (ev transferEvent, op string, ok bool, err error) {
+	if m := billingMoverLine.FindStringSubmatch(line); m != nil {
+		bytes, _ := strconv.ParseInt(m[4], 10, 64)
+		millis, _ := strconv.ParseInt(m[5], 10, 64)
+		j.remember(m[2], billingMover{bytes: bytes, millis: millis, created: m[6] == "true"})
+		return ev, "", false, nil
+	}
+	m := billingDoorLine.FindStringSubmatch(line)
+	if m == nil {
+		return ev, "", false, nil
+	}
+	t, err := billingDate(m[1], time.Now())
+	if err != nil {
+		return ev, "", false, fmt.Errorf("date: %w", err)
+	}
+	ev.Timestamp = float64(t.UnixNano()) / 1e9
+	if owner := m[2]; owner != "<unknown>" {
+		ev.ClientDN = owner
+	}
+	ev.File = m[5]
+	ev.Bytes, _ = strconv.ParseInt(m[4], 10, 64)
+	millis, _ := strconv.ParseInt(m[6], 10, 64)
+	if mv, found := j.movers[m[3]]; found {
+		ev.Bytes, millis = mv.bytes, mv.millis
+		op = "read"
+		if mv.created {
+			op = "write"
+		}
+	}
+	ev.Duration = float64(max(millis, 0)) / 1000
+	ev.Status = "success"
+	if rc := m[7]; rc != "0" {
+		ev.Status, ev.Reason = "failed", "dcache rc "+rc
+		if m[8] != "" {
+			ev.Reason += ": " + m[8]
+		}
+	}
+	return ev, op, true, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func unixSeconds(t time.Time) float64 { return float64(t.UnixNano()) / 1e9 }
+
+func TestParseGridFTP(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		line   string
+		want   transferEvent
+		wantOp string
+		skip   bool
+		err    bool
+	}{
+		{
+			name: "retrieve with fractional dates",
+			line: `DATE=20230615123456.789012 HOST=gridftp.example.org PROG=globus-gridftp-server NL.EVNT=FTP_INFO START=20230615123446.289012 USER=atlas001 FILE=/data/atlas/run1/file.root BUFFER=0 BLOCK=262144 NBYTES=1048576 VOLUME=/ STREAMS=4 STRIPES=1 DEST=[192.0.2.10] TYPE=RETR CODE=226`,
+			want: transferEvent{
+				Timestamp: unixSeconds(time.Date(2023, 6, 15, 12, 34, 56, 789012000, time.UTC)),
+				Duration:  10.5, Bytes: 1048576, File: "/data/atlas/run1/file.root", Status: "success",
+			},
+			wantOp: "RETR",
+		},
+		{
+			name: "store with a quoted DN",
+			line: `DATE=20230615130000 HOST=gridftp.example.org PROG=globus-gridftp-server NL.EVNT=FTP_INFO START=20230615125900 USER=cms DN="/DC=org/DC=example/CN=Alice Smith" FILE=/store/f.dat NBYTES=42 TYPE=STOR CODE=226`,
+			want: transferEvent{
+				Timestamp: unixSeconds(time.Date(2023, 6, 15, 13, 0, 0, 0, time.UTC)),
+				Duration:  60, Bytes: 42, File: "/store/f.dat", ClientDN: "/DC=org/DC=example/CN=Alice Smith", Status: "success",
+			},
+			wantOp: "STOR",
+		},
+		{
+			name: "failed transfer",
+			line: `DATE=20230615130000.5 HOST=gridftp.example.org PROG=globus-gridftp-server NL.EVNT=FTP_INFO START=20230615130000.1 USER=cms FILE=/store/f.dat NBYTES=0 TYPE=STOR CODE=426`,
+			want: transferEvent{
+				Timestamp: unixSeconds(time.Date(2023, 6, 15, 13, 0, 0, 500000000, time.UTC)),
+				Duration:  0.4, File: "/store/f.dat", Status: "failed", Reason: "gridftp code 426",
+			},
+			wantOp: "STOR",
+		},
+		{
+			name: "start after end leaves duration unset",
+			line: `DATE=20230615130000 START=20230615130005 FILE=/f NBYTES=1 TYPE=RETR CODE=226`,
+			want: transferEvent{
+				Timestamp: unixSeconds(time.Date(2023, 6, 15, 13, 0, 0, 0, time.UTC)),
+				Bytes:     1, File: "/f", Status: "success",
+			},
+			wantOp: "RETR",
+		},
+		{name: "not a transfer line", line: `[123] Fri Jun 16 09:00:00 2023 :: Server started in daemon mode`, skip: true},
+		{name: "bad date", line: `DATE=2023-06-15 NBYTES=1 TYPE=RETR CODE=226`, err: true},
+		{name: "bad size", line: `DATE=20230615130000 NBYTES=lots TYPE=RETR CODE=226`, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, op, ok, err := parseGridFTP(tc.line)
+			switch {
+			case tc.err:
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", ev)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			case ok == tc.skip:
+				t.Fatalf("ok = %v, want %v", ok, !tc.skip)
+			}
+			if tc.skip {
+				return
+			}
+			if !closeEvents(ev, tc.want) || op != tc.wantOp {
+				t.Fatalf("got %+v op %q, want %+v op %q", ev, op, tc.want, tc.wantOp)
+			}
+		})
+	}
+}
+
+func TestParseAccessLog(t *testing.T) {
+	when := unixSeconds(time.Date(2023, 6, 15, 10, 34, 56, 0, time.UTC))
+	for _, tc := range []struct {
+		name   string
+		line   string
+		want   transferEvent
+		wantOp string
+		skip   bool
+	}{
+		{
+			name: "apache %D in microseconds",
+			line: `192.0.2.7 - - [15/Jun/2023:12:34:56 +0200] "GET /atlas/data/file%201.root?authz=x HTTP/1.1" 200 1048576 "-" "curl/8.0.1" 2500000 "/DC=org/DC=example/CN=Alice" 312`,
+			want: transferEvent{Timestamp: when, Bytes: 1048576, Duration: 2.5,
+				File: "/atlas/data/file 1.root", ClientDN: "/DC=org/DC=example/CN=Alice", Status: "success"},
+			wantOp: "GET",
+		},
+		{
+			name: "nginx $request_time in seconds",
+			line: `192.0.2.7 - - [15/Jun/2023:10:34:56 +0000] "GET /cms/store/f.root HTTP/2.0" 206 65536 "-" "gfal2-util/1.8" 0.250 "/DC=org/DC=example/CN=Bob" 290`,
+			want: transferEvent{Timestamp: when, Bytes: 65536, Duration: 0.25,
+				File: "/cms/store/f.root", ClientDN: "/DC=org/DC=example/CN=Bob", Status: "success"},
+			wantOp: "GET",
+		},
+		{
+			name: "put counts the request size",
+			line: `192.0.2.8 - - [15/Jun/2023:10:34:56 +0000] "PUT /cms/store/new.root HTTP/1.1" 201 0 "-" "gfal2-util/1.8" 1.500 "-" 2097152`,
+			want: transferEvent{Timestamp: when, Bytes: 2097152, Duration: 1.5,
+				File: "/cms/store/new.root", Status: "success"},
+			wantOp: "PUT",
+		},
+		{
+			name:   "put without request size",
+			line:   `192.0.2.8 - - [15/Jun/2023:10:34:56 +0000] "PUT /cms/store/new.root HTTP/1.1" 201 17 "-" "curl/8.0.1"`,
+			want:   transferEvent{Timestamp: when, File: "/cms/store/new.root", Status: "success"},
+			wantOp: "PUT",
+		},
+		{
+			name:   "plain combined format",
+			line:   `192.0.2.9 - - [15/Jun/2023:10:34:56 +0000] "GET /f HTTP/1.1" 200 10 "https://example.org/" "Mozilla/5.0"`,
+			want:   transferEvent{Timestamp: when, Bytes: 10, File: "/f", Status: "success"},
+			wantOp: "GET",
+		},
+		{
+			name:   "failure",
+			line:   `192.0.2.9 - - [15/Jun/2023:10:34:56 +0000] "GET /missing HTTP/1.1" 404 - "-" "curl/8.0.1" 1200 "-" 150`,
+			want:   transferEvent{Timestamp: when, Duration: 0.0012, File: "/missing", Status: "failed", Reason: "HTTP 404"},
+			wantOp: "GET",
+		},
+		{
+			name:   "copy",
+			line:   `192.0.2.9 - - [15/Jun/2023:10:34:56 +0000] "COPY /a HTTP/1.1" 201 0 "-" "davix/0.8" 30000000 "-" 0`,
+			want:   transferEvent{Timestamp: when, Duration: 30, File: "/a", Status: "success"},
+			wantOp: "COPY",
+		},
+		{name: "error log line", line: `2023/06/15 10:34:56 [error] 12#12: *1 open() failed`, skip: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, op, ok, err := parseAccessLog(tc.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok == tc.skip {
+				t.Fatalf("ok = %v, want %v", ok, !tc.skip)
+			}
+			if tc.skip {
+				return
+			}
+			if !closeEvents(ev, tc.want) || op != tc.wantOp {
+				t.Fatalf("got %+v op %q, want %+v op %q", ev, op, tc.want, tc.wantOp)
+			}
+		})
+	}
+}
+
+// dCache billing lines: a pool's mover-info and the door's request-info
+// for the same pnfsid.
+const (
+	billingMoverWrite = `06.15 12:34:56 [pool:pool1@dcache-pool1Domain:transfer] [0000C0FFEE0123456789,1048576] [/pnfs/example.org/data/atlas/f.root] atlas:disk@osm 1048576 2500 true {GFtp-2.0 192.0.2.7:50000} [door:GFTP-door@gridftpDomain:1686832496000-42] {0:""}`
+	billingDoorWrite  = `06.15 12:34:57 [door:GFTP-door@gridftpDomain:request] ["/DC=org/DC=example/CN=Alice":1000:1000:192.0.2.7] [0000C0FFEE0123456789,1048576] [/pnfs/example.org/data/atlas/f.root] atlas:disk@osm 3000 0 {0:""}`
+	billingMoverRead  = `06.15 12:40:00 [pool:pool2@dcache-pool2Domain:transfer] [0000BEEF000000000001,524288] [Unknown] cms:tape@osm 524288 800 false {Http-1.1 192.0.2.8:0} [door:WebDAV-door@webdavDomain:1686832800000-7] {0:""}`
+	billingDoorRead   = `06.15 12:40:01 [door:WebDAV-door@webdavDomain:request] ["<unknown>":-1:-1:192.0.2.8] [0000BEEF000000000001,524288] [/pnfs/example.org/data/cms/g.root] cms:tape@osm 1200 0 {0:""}`
+	billingDoorAlone  = `06.15 12:45:00 [door:GFTP-door@gridftpDomain:request] ["/DC=org/DC=example/CN=Alice":1000:1000:192.0.2.7] [0000DEAD000000000002,2048] [/pnfs/example.org/data/atlas/h.root] atlas:disk@osm 4000 0 {0:""}`
+	billingDoorFailed = `06.15 12:50:00 [door:GFTP-door@gridftpDomain:request] ["/DC=org/DC=example/CN=Alice":1000:1000:192.0.2.7] [0000DEAD000000000003,0] [/pnfs/example.org/data/atlas/i.root] atlas:disk@osm 10 666 {666:"Permission denied"}`
+)
+
+func TestBillingJoin(t *testing.T) {
+	at := func(v string) float64 {
+		d, err := billingDate(v, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unixSeconds(d)
+	}
+	for _, tc := range []struct {
+		name   string
+		lines  []string
+		want   transferEvent
+		wantOp string
+	}{
+		{
+			name:  "door after its mover",
+			lines: []string{billingMoverWrite, billingDoorWrite},
+			want: transferEvent{Timestamp: at("06.15 12:34:57"), Bytes: 1048576, Duration: 2.5,
+				File: "/pnfs/example.org/data/atlas/f.root", ClientDN: "/DC=org/DC=example/CN=Alice", Status: "success"},
+			wantOp: "write",
+		},
+		{
+			name:  "read by an unknown owner",
+			lines: []string{billingMoverRead, billingDoorRead},
+			want: transferEvent{Timestamp: at("06.15 12:40:01"), Bytes: 524288, Duration: 0.8,
+				File: "/pnfs/example.org/data/cms/g.root", Status: "success"},
+			wantOp: "read",
+		},
+		{
+			name:  "movers of other files do not apply",
+			lines: []string{billingMoverWrite, billingMoverRead, billingDoorAlone},
+			want: transferEvent{Timestamp: at("06.15 12:45:00"), Bytes: 2048, Duration: 4,
+				File: "/pnfs/example.org/data/atlas/h.root", ClientDN: "/DC=org/DC=example/CN=Alice", Status: "success"},
+		},
+		{
+			name:  "door without a mover",
+			lines: []string{billingDoorWrite},
+			want: transferEvent{Timestamp: at("06.15 12:34:57"), Bytes: 1048576, Duration: 3,
+				File: "/pnfs/example.org/data/atlas/f.root", ClientDN: "/DC=org/DC=example/CN=Alice", Status: "success"},
+		},
+		{
+			name:  "failed request",
+			lines: []string{billingDoorFailed},
+			want: transferEvent{Timestamp: at("06.15 12:50:00"), Duration: 0.01,
+				File: "/pnfs/example.org/data/atlas/i.root", ClientDN: "/DC=org/DC=example/CN=Alice",
+				Status: "failed", Reason: "dcache rc 666: Permission denied"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			j := newBillingJoin()
+			var ev transferEvent
+			var op string
+			for i, line := range tc.lines {
+				var ok bool
+				var err error
+				ev, op, ok, err = j.parse(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if last := i == len(tc.lines)-1; ok != last {
+					t.Fatalf("line %d: ok = %v, want %v", i+1, ok, last)
+				}
+			}
+			if !closeEvents(ev, tc.want) || op != tc.wantOp {
+				t.Fatalf("got %+v op %q, want %+v op %q", ev, op, tc.want, tc.wantOp)
+			}
+		})
+	}
+
+	t.Run("movers are bounded", func(t *testing.T) {
+		j := newBillingJoin()
+		for i := 0; i < billingMovers+10; i++ {
+			j.remember(strconv.Itoa(i), billingMover{})
+		}
+		if len(j.movers) != billingMovers || len(j.order) != billingMovers {
+			t.Fatalf("%d movers, %d in order, want %d", len(j.movers), len(j.order), billingMovers)
+		}
+	})
+}
+
+func TestBillingDate(t *testing.T) {
+	local := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, time.Local) }
+	for _, tc := range []struct {
+		name string
+		v    string
+		now  time.Time
+		want time.Time
+	}{
+		{"earlier this year", "06.15 10:00:00", local(2026, 10, 15, 12), local(2026, 6, 15, 10)},
+		{"later today", "10.15 18:00:00", local(2026, 10, 15, 12), local(2026, 10, 15, 18)},
+		{"tomorrow, a clock ahead", "10.16 06:00:00", local(2026, 10, 15, 12), local(2026, 10, 16, 6)},
+		{"later in the year is last year", "12.31 23:00:00", local(2026, 1, 2, 0), local(2025, 12, 31, 23)},
+		{"leap day in a leap year", "02.29 10:00:00", local(2028, 3, 1, 0), local(2028, 2, 29, 10)},
+		{"leap day read in a common year", "02.29 10:00:00", local(2026, 10, 15, 12), local(2024, 2, 29, 10)},
+		{"leap day after a new year", "02.29 10:00:00", local(2029, 1, 10, 0), local(2028, 2, 29, 10)},
+		{"leap day ahead in a leap year", "02.29 10:00:00", local(2028, 1, 10, 0), local(2024, 2, 29, 10)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := billingDate(tc.v, tc.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tc.want) {
+				t.Fatalf("billingDate(%q) = %s, want %s", tc.v, got, tc.want)
+			}
+		})
+	}
+	if _, err := billingDate("02.30 10:00:00", time.Now()); err == nil {
+		t.Fatal("billingDate accepted 02.30")
+	}
+}
+
+// closeEvents compares parsed events, durations to the microsecond.
+func closeEvents(a, b transferEvent) bool {
+	d := a.Duration - b.Duration
+	a.Duration, b.Duration = 0, 0
+	return a == b && d < 1e-6 && d > -1e-6
+}
@@ -0,0 +1,293 @@
+// dtms-agent runs at a site and pushes its transfers to DTMS, for sites
+// DTMS cannot poll from outside. It watches the directories and transfer
+// logs listed in AGENT_CONFIG (see agent.example.yml), turns new files and
+// new log lines, GridFTP, WebDAV and dCache billing logs among them, into
+// transfer events and sends them to the freshness service's
+// /webhooks/dtms, or with AGENT_TARGET=kafka to KAFKA_TOPIC on
+// KAFKA_BROKERS, where the service's consumer picks them up.
+//
+// Events are written to a spool under AGENT_SPOOL_DIR before they are
+// sent and removed only once the service has taken them, so nothing is
+// lost while the site is cut off; the spool is capped at
+// AGENT_SPOOL_MAX_MB, dropping the oldest events first. Redelivered
+// events carry the same id and are dropped by the service's dedup.
+//
+// Over HTTP the agent authenticates with AGENT_BOOTSTRAP_TOKEN, exchanged
+// at /api/v1/agent/token for short-lived tokens scoped to its site, or
+// with a WEBHOOK_TOKEN. The bootstrap token may be the service's
+// AGENT_REGISTRATION_TOKEN, in which case a new site registers itself,
+// bound to a key the agent keeps in AGENT_SPOOL_DIR/agent.key, and the
+// agent spools until an admin approves it (dtmsctl agents approve).
+// With AGENT_HEARTBEAT_SECONDS set it also sends a heartbeat event that
+// often; like the MQTT heartbeats these count as arrivals, so leave them
+// off where only real transfers mean fresh data. AGENT_METRICS_ADDR
+// serves the agent's own metrics, AGENT_PROBES joins the service's
+// network probe mesh (see probe.go), and buffers: in the config reports
+// the free space of staging areas (see buffers.go).
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+var (
+	configPath     = envOr("AGENT_CONFIG", "/etc/dtms/agent.yml")
+	apiURL         = envOr("DTMS_API_URL", "http://freshness:8004")
+	bootstrapToken = envOr("AGENT_BOOTSTRAP_TOKEN", "")
+	webhookToken   = envOr("WEBHOOK_TOKEN", "")
+	target         = envOr("AGENT_TARGET", "http")
+	kafkaBrokers   = envOr("KAFKA_BROKERS", "")
+	kafkaTopic     = envOr("KAFKA_TOPIC", "dtms.transfers")
+	spoolDir       = envOr("AGENT_SPOOL_DIR", "/var/lib/dtms-agent")
+	spoolMaxBytes  = int64(envOrInt("AGENT_SPOOL_MAX_MB", 256)) << 20
+	batchSize      = envOrInt("AGENT_BATCH_SIZE", 500)
+	heartbeatEvery = time.Duration(envOrInt("AGENT_HEARTBEAT_SECONDS", 0)) * time.Second
+	metricsAddr    = envOr("AGENT_METRICS_ADDR", "")
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// transferEvent mirrors the fields of the service's TransferEvent.
+type transferEvent struct {
+	ID        string  `json:"id"`
+	Site      string  `json:"site"`
+	Source    string  `json:"source,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Status    string  `json:"status"`
+	Reason    string  `json:"reason,omitempty"`
+	Dataset   string  `json:"dataset,omitempty"`
+	VO        string  `json:"vo,omitempty"`
+	File      string  `json:"file,omitempty"`
+	Checksum  string  `json:"checksum,omitempty"`
+	ClientDN  string  `json:"client_dn,omitempty"`
+}
+
+type agentConfig struct {
+	Site         string        `yaml:"site"`
+	ScanInterval time.Duration `yaml:"scan_interval"`
+	Watch        []watchConfig `yaml:"watch"`
+	// BufferInterval is how often Buffers are measured (buffers.go).
+	BufferInterval time.Duration  `yaml:"buffer_interval"`
+	Buffers        []bufferConfig `yaml:"buffers"`
+}
+
+var (
+	eventsFound = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_agent_events_found_total", Help: "Transfer events found by watch"},
+		[]string{"watch"},
+	)
+	eventsSent = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "dtms_agent_events_sent_total", Help: "Events the service has taken"},
+	)
+	sendErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "dtms_agent_send_errors_total", Help: "Failed attempts to send a batch"},
+	)
+	eventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_agent_events_dropped_total", Help: "Events given up on, because the spool was full or the service rejected them"},
+		[]string{"reason"},
+	)
+	spoolBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "dtms_agent_spool_bytes", Help: "Events waiting in the spool"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventsFound, eventsSent, sendErrors, eventsDropped, spoolBytes)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func envOrInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func loadConfig() (agentConfig, error) {
+	cfg := agentConfig{ScanInterval: 30 * time.Second, BufferInterval: time.Minute}
+	raw, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yamlenv.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", configPath, err)
+	}
+	if cfg.Site == "" {
+		return cfg, fmt.Errorf("%s: site is required", configPath)
+	}
+	if cfg.ScanInterval <= 0 {
+		cfg.ScanInterval = 30 * time.Second
+	}
+	for i := range cfg.Watch {
+		if err := cfg.Watch[i].compile(); err != nil {
+			return cfg, fmt.Errorf("%s: %w", configPath, err)
+		}
+	}
+	if cfg.BufferInterval <= 0 {
+		cfg.BufferInterval = time.Minute
+	}
+	for i := range cfg.Buffers {
+		b := &cfg.Buffers[i]
+		if b.Path == "" {
+			return cfg, fmt.Errorf("%s: buffer %d: path is required", configPath, i)
+		}
+		if b.Name == "" {
+			b.Name = filepath.Base(b.Path)
+		}
+		if b.WarnPercent <= 0 {
+			b.WarnPercent = 90
+		}
+	}
+	return cfg, nil
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[agent] config error: %v\n", err)
+		os.Exit(1)
+	}
+	sp, err := openSpool(spoolDir, spoolMaxBytes)
+	if err != nil {
+		fmt.Printf("[agent] spool error: %v\n", err)
+		os.Exit(1)
+	}
+	st, err := loadWatchState(filepath.Join(spoolDir, "state.json"))
+	if err != nil {
+		fmt.Printf("[agent] state error: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := loadAgentKey(filepath.Join(spoolDir, "agent.key"))
+	if err != nil {
+		fmt.Printf("[agent] key error: %v\n", err)
+		os.Exit(1)
+	}
+	var p pusher
+	api := newHTTPPusher(cfg.Site, key)
+	switch target {
+	case "http":
+		p = api
+	case "kafka":
+		if kafkaBrokers == "" {
+			fmt.Println("[agent] AGENT_TARGET=kafka needs KAFKA_BROKERS")
+			os.Exit(1)
+		}
+		p = newKafkaPusher()
+	default:
+		fmt.Printf("[agent] unknown AGENT_TARGET %q\n", target)
+		os.Exit(1)
+	}
+	if probesEnabled && bootstrapToken == "" {
+		fmt.Println("[agent] AGENT_PROBES needs AGENT_BOOTSTRAP_TOKEN to identify the site")
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				fmt.Printf("[agent] metrics: %v\n", err)
+			}
+		}()
+	}
+	go sendLoop(ctx, sp, p)
+	if probeAddr != "" {
+		go func() {
+			if err := serveProbes(); err != nil {
+				fmt.Printf("[agent] probe server: %v\n", err)
+			}
+		}()
+	}
+	if iperf3Port > 0 {
+		go runIPerf3Server(ctx)
+	}
+	if probesEnabled {
+		go probeLoop(ctx, api)
+	}
+	if len(cfg.Buffers) > 0 {
+		go bufferLoop(ctx, cfg, api)
+	}
+
+	fmt.Printf("[agent] %s: %d watches, sending to %s\n", cfg.Site, len(cfg.Watch), target)
+	scan := time.NewTicker(cfg.ScanInterval)
+	defer scan.Stop()
+	var heartbeat <-chan time.Time
+	if heartbeatEvery > 0 {
+		t := time.NewTicker(heartbeatEvery)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+	scanAll(cfg, st, sp)
+	for {
+		select {
+		case <-ctx.Done():
+			sp.Close()
+			return
+		case <-scan.C:
+			scanAll(cfg, st, sp)
+		case now := <-heartbeat:
+			ts := float64(now.UnixNano()) / 1e9
+			ev := transferEvent{ID: fmt.Sprintf("agent:%s:heartbeat:%.3f", cfg.Site, ts), Site: cfg.Site, Timestamp: ts, Status: "heartbeat"}
+			if err := sp.Append([]transferEvent{ev}); err != nil {
+				fmt.Printf("[agent] spool: %v\n", err)
+			}
+		}
+	}
+}
+
+// scanAll runs every watch once, spooling what they find before their
+// positions are saved: after a crash events are found again rather than
+// lost.
+func scanAll(cfg agentConfig, st *watchState, sp *spool) {
+	for i := range cfg.Watch {
+		w := &cfg.Watch[i]
+		evs, commit, err := w.scan(cfg.Site, st)
+		if err != nil {
+			fmt.Printf("[agent] %s: %v\n", w.Name, err)
+		}
+		if len(evs) == 0 {
+			commit()
+			continue
+		}
+		if err := sp.Append(evs); err != nil {
+			fmt.Printf("[agent] spool: %v\n", err)
+			continue
+		}
+		eventsFound.WithLabelValues(w.Name).Add(float64(len(evs)))
+		commit()
+	}
+	if err := st.save(); err != nil {
+		fmt.Printf("[agent] state: %v\n", err)
+	}
+}
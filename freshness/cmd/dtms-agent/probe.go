@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With AGENT_PROBES=true the agent takes part in the service's network
+// probe mesh (NETWORK_PROBES): it asks for the probes due from its site
+// every AGENT_PROBE_POLL_SECONDS, runs them and reports the results. As a
+// destination it answers https probes on AGENT_PROBE_ADDR, over TLS with
+// AGENT_PROBE_TLS_CERT and AGENT_PROBE_TLS_KEY, and keeps an iperf3
+// server running on AGENT_IPERF3_PORT when that is set. iperf3 probes
+// need the iperf3 binary on the PATH at both ends, traceroutes the
+// traceroute binary at the source.
+var (
+	probesEnabled = envOr("AGENT_PROBES", "false") == "true"
+	probePoll     = time.Duration(envOrInt("AGENT_PROBE_POLL_SECONDS", 60)) * time.Second
+	probeAddr     = envOr("AGENT_PROBE_ADDR", "")
+	probeTLSCert  = envOr("AGENT_PROBE_TLS_CERT", "")
+	probeTLSKey   = envOr("AGENT_PROBE_TLS_KEY", "")
+	iperf3Port    = envOrInt("AGENT_IPERF3_PORT", 0)
+)
+
+const (
+	probePings        = 5
+	probeDownloadSize = 8 << 20
+)
+
+var probesRun = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_agent_probes_total", Help: "Network probes run by this agent, by kind and outcome"},
+	[]string{"kind", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(probesRun)
+}
+
+// probeTask and probeResult mirror the service's ProbeTask and ProbeResult.
+type probeTask struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Destination string `json:"destination"`
+	Target      string `json:"target"`
+	Seconds     int    `json:"seconds"`
+}
+
+type probeResult struct {
+	ID            string   `json:"id"`
+	Ok            bool     `json:"ok"`
+	Error         string   `json:"error,omitempty"`
+	RTT           float64  `json:"rtt_seconds,omitempty"`
+	BitsPerSecond float64  `json:"bits_per_second,omitempty"`
+	Retransmits   int      `json:"retransmits,omitempty"`
+	Hops          []string `json:"hops,omitempty"`
+}
+
+// serveProbes answers other agents' https probes: /probe/echo for round
+// trips and /probe/payload?bytes= for a download of that many bytes.
+func serveProbes() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	zeros := make([]byte, 64<<10)
+	mux.HandleFunc("/probe/payload", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		n = min(max(n, 0), 256<<20)
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		for n > 0 {
+			chunk := min(n, int64(len(zeros)))
+			if _, err := w.Write(zeros[:chunk]); err != nil {
+				return
+			}
+			n -= chunk
+		}
+	})
+	srv := &http.Server{Addr: probeAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if probeTLSCert != "" {
+		return srv.ListenAndServeTLS(probeTLSCert, probeTLSKey)
+	}
+	return srv.ListenAndServe()
+}
+
+// runIPerf3Server keeps an iperf3 server running until ctx is done.
+func runIPerf3Server(ctx context.Context) {
+	for ctx.Err() == nil {
+		cmd := exec.CommandContext(ctx, "iperf3", "-s", "-p", strconv.Itoa(iperf3Port))
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("[agent] iperf3 server exited: %v; restarting\n", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// probeLoop fetches and runs the site's due probes until ctx is done.
+func probeLoop(ctx context.Context, p *httpPusher) {
+	t := time.NewTicker(probePoll)
+	defer t.Stop()
+	for {
+		tasks, err := fetchProbes(ctx, p)
+		if err != nil {
+			fmt.Printf("[agent] probes: %v\n", err)
+		}
+		var results []probeResult
+		for _, task := range tasks {
+			res := runProbe(ctx, task)
+			outcome := "ok"
+			if !res.Ok {
+				outcome = "failed"
+			}
+			probesRun.WithLabelValues(task.Kind, outcome).Inc()
+			results = append(results, res)
+		}
+		if len(results) > 0 {
+			if err := reportProbes(ctx, p, results); err != nil {
+				fmt.Printf("[agent] probe results: %v\n", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// apiRequest calls the service's agent API at path with the site's token.
+func apiRequest(ctx context.Context, p *httpPusher, method, path string, body []byte) (*http.Response, error) {
+	tok, err := p.bearer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode == http.StatusUnauthorized {
+			p.mu.Lock()
+			p.token = ""
+			p.mu.Unlock()
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func fetchProbes(ctx context.Context, p *httpPusher) ([]probeTask, error) {
+	resp, err := apiRequest(ctx, p, http.MethodGet, "/api/v1/agent/probes", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Probes []probeTask `json:"probes"`
+	}
+	return out.Probes, json.NewDecoder(resp.Body).Decode(&out)
+}
+
+func reportProbes(ctx context.Context, p *httpPusher, results []probeResult) error {
+	body, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	resp, err := apiRequest(ctx, p, http.MethodPost, "/api/v1/agent/probes", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func runProbe(ctx context.Context, t probeTask) probeResult {
+	res := probeResult{ID: t.ID}
+	var err error
+	switch t.Kind {
+	case "https":
+		res.RTT, res.BitsPerSecond, err = probeHTTPS(ctx, t.Target)
+	case "iperf3":
+		res.RTT, res.BitsPerSecond, res.Retransmits, err = probeIPerf3(ctx, t.Target, t.Seconds)
+	case "traceroute":
+		res.Hops, err = traceroute(ctx, t.Target)
+	default:
+		err = fmt.Errorf("unknown probe kind %q", t.Kind)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Ok = true
+	return res
+}
+
+// probeHTTPS returns the median round trip of a few requests over one
+// warm connection and the throughput of a short download.
+func probeHTTPS(ctx context.Context, base string) (rtt, bps float64, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	// agents commonly serve probes with self-signed certificates; the
+	// probe measures the path, not the peer's identity
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext:     (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+	}}
+	defer c.CloseIdleConnections()
+	get := func(path string) (time.Duration, int64, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+path, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		start := time.Now()
+		resp, err := c.Do(req)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err == nil && resp.StatusCode >= 300 {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return time.Since(start), n, err
+	}
+	// the first request pays for the TCP and TLS handshakes
+	if _, _, err := get("/probe/echo"); err != nil {
+		return 0, 0, err
+	}
+	rtts := make([]time.Duration, 0, probePings)
+	for i := 0; i < probePings; i++ {
+		d, _, err := get("/probe/echo")
+		if err != nil {
+			return 0, 0, err
+		}
+		rtts = append(rtts, d)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	d, n, err := get("/probe/payload?bytes=" + strconv.Itoa(probeDownloadSize))
+	if err != nil {
+		return 0, 0, err
+	}
+	return rtts[len(rtts)/2].Seconds(), float64(n*8) / d.Seconds(), nil
+}
+
+// probeIPerf3 runs an iperf3 test against target (host:port) and returns
+// the mean round trip the sender saw, the received throughput and the
+// retransmits.
+func probeIPerf3(ctx context.Context, target string, seconds int) (rtt, bps float64, retransmits int, err error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	seconds = max(seconds, 1)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second+time.Minute)
+	defer cancel()
+	out, runErr := exec.CommandContext(ctx, "iperf3", "-c", host, "-p", port, "-t", strconv.Itoa(seconds), "-J").Output()
+	var report struct {
+		Error string `json:"error"`
+		End   struct {
+			Streams []struct {
+				Sender struct {
+					MeanRTT float64 `json:"mean_rtt"` // microseconds
+				} `json:"sender"`
+			} `json:"streams"`
+			SumSent struct {
+				Retransmits int `json:"retransmits"`
+			} `json:"sum_sent"`
+			SumReceived struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		if runErr != nil {
+			return 0, 0, 0, runErr
+		}
+		return 0, 0, 0, fmt.Errorf("iperf3 output: %w", err)
+	}
+	if report.Error != "" {
+		return 0, 0, 0, fmt.Errorf("iperf3: %s", report.Error)
+	}
+	if len(report.End.Streams) > 0 {
+		rtt = report.End.Streams[0].Sender.MeanRTT / 1e6
+	}
+	return rtt, report.End.SumReceived.BitsPerSecond, report.End.SumSent.Retransmits, nil
+}
+
+// traceroute returns the address of each hop to host, "*" for hops that
+// did not answer.
+func traceroute(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "traceroute", "-n", "-q", "1", "-w", "2", "-m", "30", host).Output()
+	if err != nil {
+		return nil, fmt.Errorf("traceroute: %w", err)
+	}
+	var hops []string
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		// " 3  192.0.2.1  4.123 ms" or " 4  *"; the header line does not
+		// start with a hop number
+		if len(f) < 2 {
+			continue
+		}
+		if _, err := strconv.Atoi(f[0]); err != nil {
+			continue
+		}
+		hops = append(hops, f[1])
+	}
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("traceroute to %s printed no hops", host)
+	}
+	return hops, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// errRejected marks a batch the service refused for good; retrying it
+// would block the spool forever.
+var errRejected = errors.New("rejected")
+
+// A pusher delivers a batch of spooled events.
+type pusher interface {
+	push(ctx context.Context, evs []json.RawMessage) error
+}
+
+// sendLoop sends the spool oldest first, retrying with backoff while the
+// service cannot be reached.
+func sendLoop(ctx context.Context, sp *spool, p pusher) {
+	backoff := time.Second
+	failing := false
+	wait := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+	for {
+		seq, evs, ok, err := sp.Oldest()
+		if err != nil {
+			fmt.Printf("[agent] spool: %v\n", err)
+			if !wait(backoff) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sp.wake:
+			}
+			continue
+		}
+		for off := 0; off < len(evs); {
+			batch := evs[off:min(off+batchSize, len(evs))]
+			err := p.push(ctx, batch)
+			switch {
+			case err == nil:
+				eventsSent.Add(float64(len(batch)))
+				if failing {
+					fmt.Println("[agent] connected again, sending the spool")
+					failing = false
+				}
+				backoff = time.Second
+				off += len(batch)
+			case errors.Is(err, errRejected):
+				eventsDropped.WithLabelValues("rejected").Add(float64(len(batch)))
+				fmt.Printf("[agent] dropping %d events: %v\n", len(batch), err)
+				off += len(batch)
+			default:
+				sendErrors.Inc()
+				if ctx.Err() != nil {
+					return
+				}
+				if !failing {
+					fmt.Printf("[agent] send failed, spooling until it recovers: %v\n", err)
+					failing = true
+				}
+				if !wait(backoff) {
+					return
+				}
+				backoff = min(2*backoff, 5*time.Minute)
+			}
+		}
+		sp.Remove(seq)
+	}
+}
+
+// loadAgentKey returns the key the agent registers its site with, making
+// one up the first time. It ties the site's registration to this agent,
+// so keep it with the spool; losing it means registering afresh.
+func loadAgentKey(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(raw)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(key + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+	return key, f.Close()
+}
+
+// httpPusher posts batches to /webhooks/dtms.
+type httpPusher struct {
+	site   string
+	key    string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	refresh time.Time
+}
+
+func newHTTPPusher(site, key string) *httpPusher {
+	return &httpPusher{site: site, key: key, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// bearer returns the token to send, exchanging the bootstrap token for a
+// fresh one when the last has used up two thirds of its lifetime. The
+// exchange names the agent's site and sends its key, which registers it
+// when the bootstrap token is the service's shared registration token.
+func (p *httpPusher) bearer(ctx context.Context) (string, error) {
+	if bootstrapToken == "" {
+		return webhookToken, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.refresh) {
+		return p.token, nil
+	}
+	hello, _ := json.Marshal(map[string]string{"site": p.site, "key": p.key, "hostname": hostname(), "version": version})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/api/v1/agent/token", bytes.NewReader(hello))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted:
+		return "", fmt.Errorf("site %s is registered and waiting for an admin to approve it", p.site)
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("token exchange: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Token     string `json:"token"`
+		Site      string `json:"site"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	if out.Site != p.site {
+		fmt.Printf("[agent] the bootstrap token is for site %s, not %s; the service will refuse its events\n", out.Site, p.site)
+	}
+	now := time.Now()
+	p.token = out.Token
+	p.refresh = now.Add(time.Unix(out.ExpiresAt, 0).Sub(now) * 2 / 3)
+	return p.token, nil
+}
+
+func (p *httpPusher) push(ctx context.Context, evs []json.RawMessage) error {
+	tok, err := p.bearer(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(evs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/webhooks/dtms", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	reason := strings.TrimSpace(string(msg))
+	switch code := resp.StatusCode; {
+	case code < 300:
+		return nil
+	case code == http.StatusRequestEntityTooLarge && len(evs) > 1:
+		half := len(evs) / 2
+		if err := p.push(ctx, evs[:half]); err != nil {
+			return err
+		}
+		return p.push(ctx, evs[half:])
+	case code == http.StatusUnauthorized:
+		// the token may have expired early, say after a service restart
+		p.mu.Lock()
+		p.token = ""
+		p.mu.Unlock()
+		return fmt.Errorf("%s: %s", resp.Status, reason)
+	case code == http.StatusBadRequest || code == http.StatusForbidden || code == http.StatusRequestEntityTooLarge:
+		// invalid events are dead-lettered by the service
+		return fmt.Errorf("%w: %s: %s", errRejected, resp.Status, reason)
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, reason)
+	}
+}
+
+// kafkaPusher writes batches to KAFKA_TOPIC keyed by site.
+type kafkaPusher struct{ w *kafka.Writer }
+
+func newKafkaPusher() *kafkaPusher {
+	return &kafkaPusher{w: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(kafkaBrokers, ",")...),
+		Topic:        kafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+func (p *kafkaPusher) push(ctx context.Context, evs []json.RawMessage) error {
+	msgs := make([]kafka.Message, len(evs))
+	for i, raw := range evs {
+		var ev struct {
+			Site string `json:"site"`
+		}
+		json.Unmarshal(raw, &ev)
+		msgs[i] = kafka.Message{Key: []byte(ev.Site), Value: raw}
+	}
+	return p.w.WriteMessages(ctx, msgs...)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spoolSegmentBytes is where the spool starts a new segment file.
+const spoolSegmentBytes = 4 << 20
+
+// spool is the agent's on-disk queue: events are appended as JSON lines to
+// numbered segment files and a segment is deleted once everything in it
+// has been sent. Past max bytes the oldest segments are dropped.
+type spool struct {
+	mu      sync.Mutex
+	dir     string
+	max     int64
+	segs    map[uint64]int64 // segment -> bytes
+	next    uint64
+	cur     *os.File
+	curSeq  uint64
+	curSize int64
+	wake    chan struct{}
+}
+
+func openSpool(dir string, limit int64) (*spool, error) {
+	dir = filepath.Join(dir, "spool")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{dir: dir, max: limit, segs: map[uint64]int64{}, next: 1, wake: make(chan struct{}, 1)}
+	for _, e := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".jsonl"), 10, 64)
+		if err != nil || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		sp.segs[seq] = info.Size()
+		sp.next = max(sp.next, seq+1)
+	}
+	if n := len(sp.segs); n > 0 {
+		fmt.Printf("[agent] %d spooled segments (%d bytes) from a previous run\n", n, sp.size())
+		sp.wake <- struct{}{}
+	}
+	spoolBytes.Set(float64(sp.size()))
+	return sp, nil
+}
+
+func (sp *spool) path(seq uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%020d.jsonl", seq))
+}
+
+func (sp *spool) size() int64 {
+	var n int64
+	for _, s := range sp.segs {
+		n += s
+	}
+	return n
+}
+
+// Append writes evs to the current segment, synced before it returns.
+func (sp *spool) Append(evs []transferEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range evs {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.cur != nil && sp.curSize >= spoolSegmentBytes {
+		sp.seal()
+	}
+	if sp.cur == nil {
+		f, err := os.OpenFile(sp.path(sp.next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		sp.cur, sp.curSeq, sp.curSize = f, sp.next, 0
+		sp.next++
+	}
+	if _, err := sp.cur.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := sp.cur.Sync(); err != nil {
+		return err
+	}
+	sp.curSize += int64(buf.Len())
+	sp.segs[sp.curSeq] = sp.curSize
+	sp.trim()
+	spoolBytes.Set(float64(sp.size()))
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// trim drops the oldest sealed segments while the spool is over its cap.
+func (sp *spool) trim() {
+	for sp.size() > sp.max {
+		seq, ok := sp.oldestSealed()
+		if !ok {
+			return
+		}
+		n, _ := countEvents(sp.path(seq))
+		os.Remove(sp.path(seq))
+		delete(sp.segs, seq)
+		eventsDropped.WithLabelValues("spool_full").Add(float64(n))
+		fmt.Printf("[agent] spool over %d bytes, dropped %d of the oldest events\n", sp.max, n)
+	}
+}
+
+func (sp *spool) oldestSealed() (uint64, bool) {
+	var seqs []uint64
+	for seq := range sp.segs {
+		if sp.cur == nil || seq != sp.curSeq {
+			seqs = append(seqs, seq)
+		}
+	}
+	if len(seqs) == 0 {
+		return 0, false
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs[0], true
+}
+
+func (sp *spool) seal() {
+	sp.cur.Close()
+	sp.cur = nil
+}
+
+// Oldest returns the oldest segment and its events, sealing the current
+// segment first when nothing else is waiting.
+func (sp *spool) Oldest() (uint64, []json.RawMessage, bool, error) {
+	sp.mu.Lock()
+	seq, ok := sp.oldestSealed()
+	if !ok && sp.cur != nil && sp.curSize > 0 {
+		seq, ok = sp.curSeq, true
+		sp.seal()
+	}
+	sp.mu.Unlock()
+	if !ok {
+		return 0, nil, false, nil
+	}
+	raw, err := os.ReadFile(sp.path(seq))
+	if os.IsNotExist(err) {
+		// dropped by trim meanwhile
+		return seq, nil, true, nil
+	}
+	if err != nil {
+		return seq, nil, true, err
+	}
+	var evs []json.RawMessage
+	for _, line := range bytes.Split(raw, []byte{'\n'}) {
+		// a line cut short by a crash is not valid JSON; skip it
+		if len(line) > 0 && json.Valid(line) {
+			evs = append(evs, json.RawMessage(line))
+		}
+	}
+	return seq, evs, true, nil
+}
+
+// Remove deletes a segment once it has been sent.
+func (sp *spool) Remove(seq uint64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if _, ok := sp.segs[seq]; !ok {
+		return
+	}
+	os.Remove(sp.path(seq))
+	delete(sp.segs, seq)
+	spoolBytes.Set(float64(sp.size()))
+}
+
+func (sp *spool) Close() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.cur != nil {
+		sp.seal()
+	}
+}
+
+func countEvents(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	for s.Scan() {
+		n++
+	}
+	return n, s.Err()
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A watch is where the agent looks for transfers:
+//
+//	type: dir    every file below path (matching pattern, a glob on the
+//	             base name) that has not changed for settle is one
+//	             successful transfer; a file that changes again is another
+//	type: log    every new line of the file at path is one transfer, read
+//	             as a JSON TransferEvent or with regex, whose named groups
+//	             (timestamp, bytes, duration, status, reason, file, source,
+//	             dataset, vo, checksum, client_dn, id) fill the event's fields,
+//	             or in one of the formats in logformats.go
+//
+// statuses maps a log's own status words to DTMS's ("DONE: success"); the
+// service only counts status success as fresh data. Timestamps in logs are
+// unix seconds unless time_layout is set. dataset and vo are given to
+// events that do not carry their own. A log that shrinks is taken to
+// have been rotated and is read from the start.
+type watchConfig struct {
+	Name       string            `yaml:"name"`
+	Type       string            `yaml:"type"`
+	Path       string            `yaml:"path"`
+	Pattern    string            `yaml:"pattern"`
+	Recursive  bool              `yaml:"recursive"`
+	Settle     time.Duration     `yaml:"settle"`
+	Dataset    string            `yaml:"dataset"`
+	VO         string            `yaml:"vo"`
+	Format     string            `yaml:"format"`
+	Regex      string            `yaml:"regex"`
+	TimeLayout string            `yaml:"time_layout"`
+	Statuses   map[string]string `yaml:"statuses"`
+	Operations []string          `yaml:"operations"`
+
+	re      *regexp.Regexp
+	billing *billingJoin
+}
+
+func (w *watchConfig) compile() error {
+	if w.Name == "" {
+		w.Name = w.Path
+	}
+	if w.Path == "" {
+		return fmt.Errorf("watch %q: path is required", w.Name)
+	}
+	switch w.Type {
+	case "dir":
+		if w.Pattern == "" {
+			w.Pattern = "*"
+		}
+		if _, err := filepath.Match(w.Pattern, ""); err != nil {
+			return fmt.Errorf("watch %q: pattern: %w", w.Name, err)
+		}
+		if w.Settle <= 0 {
+			w.Settle = time.Minute
+		}
+	case "log":
+		switch w.Format {
+		case "", "json":
+			w.Format = "json"
+		case "regex":
+			re, err := regexp.Compile(w.Regex)
+			if err != nil {
+				return fmt.Errorf("watch %q: regex: %w", w.Name, err)
+			}
+			w.re = re
+		case "gridftp":
+		case "webdav":
+			if len(w.Operations) == 0 {
+				w.Operations = webdavOperations
+			}
+		case "dcache-billing":
+			w.billing = newBillingJoin()
+		default:
+			return fmt.Errorf("watch %q: unknown format %q", w.Name, w.Format)
+		}
+	default:
+		return fmt.Errorf("watch %q: unknown type %q", w.Name, w.Type)
+	}
+	return nil
+}
+
+// fileMark is what the agent remembers of a file: its mtime and size for
+// dir watches, how far it has been read for logs.
+type fileMark struct {
+	ModTime int64 `json:"mtime"`
+	Size    int64 `json:"size"`
+	Offset  int64 `json:"offset,omitempty"`
+}
+
+// watchState is kept in the spool directory so a restarted agent carries
+// on where it stopped instead of reporting every file again.
+type watchState struct {
+	path  string
+	Files map[string]map[string]fileMark `json:"files"` // watch -> path -> mark
+}
+
+func loadWatchState(path string) (*watchState, error) {
+	st := &watchState{path: path, Files: map[string]map[string]fileMark{}}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, st); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]map[string]fileMark{}
+	}
+	return st, nil
+}
+
+func (st *watchState) save() error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// scan returns the events found since the last scan and a commit func that
+// records them as seen; the caller commits once they are safely spooled.
+func (w *watchConfig) scan(site string, st *watchState) ([]transferEvent, func(), error) {
+	if w.Type == "dir" {
+		return w.scanDir(site, st)
+	}
+	return w.scanLog(site, st)
+}
+
+func (w *watchConfig) scanDir(site string, st *watchState) ([]transferEvent, func(), error) {
+	seen := st.Files[w.Name]
+	next := map[string]fileMark{}
+	var evs []transferEvent
+	now := time.Now()
+	err := filepath.WalkDir(w.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == w.Path {
+				return err
+			}
+			return nil // vanished while walking
+		}
+		if d.IsDir() {
+			if path != w.Path && !w.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ok, _ := filepath.Match(w.Pattern, d.Name()); !ok || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		m := fileMark{ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+		if old, ok := seen[path]; ok && old == m {
+			next[path] = m
+			return nil
+		}
+		if now.Sub(info.ModTime()) < w.Settle {
+			// still being written; keep the old mark so it is reported once settled
+			if old, ok := seen[path]; ok {
+				next[path] = old
+			}
+			return nil
+		}
+		next[path] = m
+		rel, _ := filepath.Rel(w.Path, path)
+		evs = append(evs, transferEvent{
+			ID:        eventID(site, w.Name, path, strconv.FormatInt(m.ModTime, 10), strconv.FormatInt(m.Size, 10)),
+			Site:      site,
+			Timestamp: float64(m.ModTime) / 1e9,
+			Bytes:     m.Size,
+			Status:    "success",
+			Dataset:   w.Dataset,
+			VO:        w.VO,
+			File:      filepath.ToSlash(rel),
+		})
+		return nil
+	})
+	if err != nil {
+		// keep what was known rather than reporting everything again later
+		return nil, func() {}, err
+	}
+	return evs, func() { st.Files[w.Name] = next }, nil
+}
+
+func (w *watchConfig) scanLog(site string, st *watchState) ([]transferEvent, func(), error) {
+	mark := st.Files[w.Name][w.Path]
+	f, err := os.Open(w.Path)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if info.Size() < mark.Offset {
+		mark.Offset = 0
+	}
+	if _, err := f.Seek(mark.Offset, io.SeekStart); err != nil {
+		return nil, func() {}, err
+	}
+	var evs []transferEvent
+	offset := mark.Offset
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// a partial last line is read again once it is complete
+			break
+		}
+		start := offset
+		offset += int64(len(line))
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ev, ok, perr := w.parseLine(line)
+		if perr != nil {
+			fmt.Printf("[agent] %s: skipping line at offset %d: %v\n", w.Name, start, perr)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if ev.Site == "" {
+			ev.Site = site
+		}
+		if ev.Dataset == "" {
+			ev.Dataset = w.Dataset
+		}
+		if ev.VO == "" {
+			ev.VO = w.VO
+		}
+		if s, ok := w.Statuses[ev.Status]; ok {
+			ev.Status = s
+		}
+		if ev.Status == "" {
+			ev.Status = "success"
+		}
+		if ev.ID == "" {
+			ev.ID = eventID(site, w.Name, line)
+		}
+		evs = append(evs, ev)
+	}
+	m := fileMark{ModTime: info.ModTime().UnixNano(), Size: info.Size(), Offset: offset}
+	return evs, func() {
+		if st.Files[w.Name] == nil {
+			st.Files[w.Name] = map[string]fileMark{}
+		}
+		st.Files[w.Name][w.Path] = m
+	}, nil
+}
+
+// parseLine reads one log line; lines a regex or format does not match,
+// and operations the watch does not keep, are skipped.
+func (w *watchConfig) parseLine(line string) (transferEvent, bool, error) {
+	var ev transferEvent
+	var op string
+	ok, err := true, error(nil)
+	switch w.Format {
+	case "json":
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			return ev, false, err
+		}
+		return ev, true, nil
+	case "regex":
+		return w.parseRegex(line)
+	case "gridftp":
+		ev, op, ok, err = parseGridFTP(line)
+	case "webdav":
+		ev, op, ok, err = parseAccessLog(line)
+	case "dcache-billing":
+		ev, op, ok, err = w.billing.parse(line)
+	}
+	if !ok || err != nil {
+		return ev, false, err
+	}
+	return ev, w.keeps(op), nil
+}
+
+func (w *watchConfig) keeps(op string) bool {
+	if len(w.Operations) == 0 {
+		return true
+	}
+	for _, o := range w.Operations {
+		if strings.EqualFold(o, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *watchConfig) parseRegex(line string) (transferEvent, bool, error) {
+	var ev transferEvent
+	m := w.re.FindStringSubmatch(line)
+	if m == nil {
+		return ev, false, nil
+	}
+	var err error
+	for i, name := range w.re.SubexpNames() {
+		v := m[i]
+		if name == "" || v == "" {
+			continue
+		}
+		switch name {
+		case "id":
+			ev.ID = v
+		case "timestamp":
+			ev.Timestamp, err = w.parseTime(v)
+		case "bytes":
+			ev.Bytes, err = strconv.ParseInt(v, 10, 64)
+		case "duration":
+			ev.Duration, err = strconv.ParseFloat(v, 64)
+		case "status":
+			ev.Status = v
+		case "reason":
+			ev.Reason = v
+		case "file":
+			ev.File = v
+		case "source":
+			ev.Source = v
+		case "dataset":
+			ev.Dataset = v
+		case "vo":
+			ev.VO = v
+		case "checksum":
+			ev.Checksum = v
+		case "client_dn":
+			ev.ClientDN = v
+		}
+		if err != nil {
+			return ev, false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if ev.Timestamp == 0 {
+		return ev, false, fmt.Errorf("no timestamp")
+	}
+	return ev, true, nil
+}
+
+func (w *watchConfig) parseTime(v string) (float64, error) {
+	if w.TimeLayout == "" {
+		return strconv.ParseFloat(v, 64)
+	}
+	t, err := time.Parse(w.TimeLayout, v)
+	if err != nil {
+		return 0, err
+	}
+	return float64(t.UnixNano()) / 1e9, nil
+}
+
+// eventID derives a stable id from parts, so an event found twice, after
+// a crash or a replayed spool, is deduplicated by the service.
+func eventID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return "agent:" + hex.EncodeToString(sum[:12])
+}
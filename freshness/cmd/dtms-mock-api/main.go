@@ -0,0 +1,326 @@
+// dtms-mock-api stands in for dtms-api during local development. It serves
+// /health, /sites and /freshness for a set of synthetic sites and accepts
+// transfer events at POST /transfers, so the freshness service, exporters
+// and dashboards can be exercised without the full platform:
+//
+//	dtms-mock-api -sites 20 -error-rate 0.05 -latency 200ms
+//	dtms-mock-api -config mock-api.example.yml
+//
+// Every site behaves according to a scenario (see mock-api.example.yml):
+//
+//	healthy   a transfer lands every interval
+//	stale     no transfer since age before startup; age keeps growing
+//	flapping  healthy and stale for alternating periods
+//	missing   listed by /sites but absent from /freshness
+//
+// Events posted to /transfers reset their site's age. -error-rate answers
+// that share of requests with 500, and -latency (+/- -jitter) delays every
+// response. -seed makes the generated sites and errors repeatable.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+type siteScenario struct {
+	Site     string        `yaml:"site"`
+	Kind     string        `yaml:"kind"`
+	Interval time.Duration `yaml:"interval"`
+	Age      time.Duration `yaml:"age"`
+	Period   time.Duration `yaml:"period"`
+}
+
+type mockConfig struct {
+	Sites     int            `yaml:"sites"`
+	Interval  time.Duration  `yaml:"interval"`
+	ErrorRate float64        `yaml:"error_rate"`
+	Latency   time.Duration  `yaml:"latency"`
+	Jitter    time.Duration  `yaml:"jitter"`
+	Seed      int64          `yaml:"seed"`
+	Scenarios []siteScenario `yaml:"scenarios"`
+}
+
+type mockSite struct {
+	siteScenario
+	// offset staggers healthy sites so they do not all report together.
+	offset time.Duration
+	// ingested is the latest event posted for the site, if any.
+	ingested float64
+}
+
+type mockAPI struct {
+	cfg     mockConfig
+	started time.Time
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	sites []*mockSite
+}
+
+func main() {
+	var cfg mockConfig
+	addr := flag.String("addr", ":8003", "listen address")
+	config := flag.String("config", "", "YAML scenario file; flags override its settings")
+	flag.IntVar(&cfg.Sites, "sites", 10, "number of generated sites besides the scenario ones")
+	flag.DurationVar(&cfg.Interval, "interval", time.Minute, "transfer interval of healthy sites")
+	flag.Float64Var(&cfg.ErrorRate, "error-rate", 0, "share of requests answered with 500")
+	flag.DurationVar(&cfg.Latency, "latency", 0, "delay added to every response")
+	flag.DurationVar(&cfg.Jitter, "jitter", 0, "random variation of the delay")
+	flag.Int64Var(&cfg.Seed, "seed", 1, "random seed")
+	flag.Parse()
+
+	if *config != "" {
+		raw, err := os.ReadFile(*config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		var file mockConfig
+		if err := yamlenv.Unmarshal(raw, &file); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *config, err)
+			os.Exit(1)
+		}
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		overlay(&cfg, file, set)
+	}
+
+	m, err := newMockAPI(cfg, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", m.handleHealth)
+	mux.HandleFunc("/sites", m.handleSites)
+	mux.HandleFunc("/freshness", m.handleFreshness)
+	mux.HandleFunc("/transfers", m.handleTransfers)
+	fmt.Printf("[mock-api] serving %d sites on %s\n", len(m.sites), *addr)
+	if err := http.ListenAndServe(*addr, m.chaos(mux)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// overlay takes the file's settings for the flags not given explicitly.
+func overlay(cfg *mockConfig, file mockConfig, set map[string]bool) {
+	if !set["sites"] {
+		cfg.Sites = file.Sites
+	}
+	if !set["interval"] && file.Interval > 0 {
+		cfg.Interval = file.Interval
+	}
+	if !set["error-rate"] {
+		cfg.ErrorRate = file.ErrorRate
+	}
+	if !set["latency"] {
+		cfg.Latency = file.Latency
+	}
+	if !set["jitter"] {
+		cfg.Jitter = file.Jitter
+	}
+	if !set["seed"] && file.Seed != 0 {
+		cfg.Seed = file.Seed
+	}
+	cfg.Scenarios = file.Scenarios
+}
+
+func newMockAPI(cfg mockConfig, now time.Time) (*mockAPI, error) {
+	m := &mockAPI{cfg: cfg, started: now, rng: rand.New(rand.NewSource(cfg.Seed))}
+	named := map[string]bool{}
+	for _, sc := range cfg.Scenarios {
+		if sc.Site == "" {
+			return nil, fmt.Errorf("scenario without a site")
+		}
+		switch sc.Kind {
+		case "":
+			sc.Kind = "healthy"
+		case "healthy", "stale", "flapping", "missing":
+		default:
+			return nil, fmt.Errorf("site %s: unknown kind %q", sc.Site, sc.Kind)
+		}
+		if sc.Interval <= 0 {
+			sc.Interval = cfg.Interval
+		}
+		if sc.Period <= 0 {
+			sc.Period = 10 * time.Minute
+		}
+		named[sc.Site] = true
+		m.sites = append(m.sites, &mockSite{siteScenario: sc})
+	}
+	for i := 1; len(m.sites) < len(cfg.Scenarios)+cfg.Sites; i++ {
+		name := fmt.Sprintf("SITE_%03d", i)
+		if named[name] {
+			continue
+		}
+		m.sites = append(m.sites, &mockSite{siteScenario: siteScenario{Site: name, Kind: "healthy", Interval: cfg.Interval}})
+	}
+	for _, s := range m.sites {
+		s.offset = time.Duration(m.rng.Int63n(int64(s.Interval)))
+	}
+	sort.Slice(m.sites, func(i, j int) bool { return m.sites[i].Site < m.sites[j].Site })
+	return m, nil
+}
+
+// latest is the site's last transfer time at now by its scenario, and
+// false when the site reports nothing.
+func (m *mockAPI) latest(s *mockSite, now time.Time) (time.Time, bool) {
+	healthy := func() time.Time {
+		since := now.Sub(m.started) + s.offset
+		return now.Add(-(since % s.Interval))
+	}
+	var t time.Time
+	switch s.Kind {
+	case "missing":
+		return time.Time{}, false
+	case "stale":
+		t = m.started.Add(-s.Age)
+	case "flapping":
+		elapsed := now.Sub(m.started)
+		if (elapsed/s.Period)%2 == 0 {
+			t = healthy()
+		} else {
+			// stale since the current bad period began
+			t = m.started.Add(elapsed / s.Period * s.Period)
+		}
+	default:
+		t = healthy()
+	}
+	if ing := time.Unix(0, int64(s.ingested*1e9)); s.ingested > 0 && ing.After(t) {
+		t = ing
+	}
+	return t, true
+}
+
+// chaos adds the configured latency and injected errors in front of h.
+func (m *mockAPI) chaos(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		delay := m.cfg.Latency
+		if m.cfg.Jitter > 0 {
+			delay += time.Duration(m.rng.Int63n(int64(2*m.cfg.Jitter))) - m.cfg.Jitter
+		}
+		fail := m.rng.Float64() < m.cfg.ErrorRate
+		m.mu.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if fail && r.URL.Path != "/health" {
+			http.Error(w, `{"detail":"injected failure"}`, http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (m *mockAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok", "service": "dtms-mock-api"})
+}
+
+func (m *mockAPI) handleSites(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sites := make([]string, 0, len(m.sites))
+	for _, s := range m.sites {
+		sites = append(sites, s.Site)
+	}
+	writeJSON(w, map[string][]string{"sites": sites})
+}
+
+func (m *mockAPI) handleFreshness(w http.ResponseWriter, r *http.Request) {
+	type record struct {
+		Site            string  `json:"site"`
+		LatestTimestamp float64 `json:"latest_timestamp"`
+		AgeSeconds      float64 `json:"age_seconds"`
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []record{}
+	for _, s := range m.sites {
+		t, ok := m.latest(s, now)
+		if !ok {
+			continue
+		}
+		out = append(out, record{s.Site, float64(t.UnixNano()) / 1e9, now.Sub(t).Seconds()})
+	}
+	writeJSON(w, map[string][]record{"sites": out})
+}
+
+// handleTransfers accepts one transfer event or an array of them; each
+// successful event brings its site's latest timestamp forward.
+func (m *mockAPI) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type event struct {
+		Site      string  `json:"site"`
+		Timestamp float64 `json:"timestamp"`
+		Status    string  `json:"status"`
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var events []event
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var ev event
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, ev)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	accepted := 0
+	for _, ev := range events {
+		if ev.Site == "" || (ev.Status != "" && ev.Status != "success" && ev.Status != "succeeded") {
+			continue
+		}
+		if ev.Timestamp == 0 {
+			ev.Timestamp = float64(time.Now().UnixNano()) / 1e9
+		}
+		var site *mockSite
+		for _, s := range m.sites {
+			if s.Site == ev.Site {
+				site = s
+			}
+		}
+		if site == nil {
+			site = &mockSite{siteScenario: siteScenario{Site: ev.Site, Kind: "stale"}}
+			m.sites = append(m.sites, site)
+			sort.Slice(m.sites, func(i, j int) bool { return m.sites[i].Site < m.sites[j].Site })
+		}
+		if ev.Timestamp > site.ingested {
+			site.ingested = ev.Timestamp
+		}
+		accepted++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"accepted": accepted})
+}
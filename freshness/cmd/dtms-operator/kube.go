@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	crdGroup   = "dtms.iamakamen.io"
+	crdVersion = "v1alpha1"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kube is the small part of the Kubernetes API the operator needs: list,
+// watch and status patches on its own resources. In a pod it talks to
+// the API server with the service account; KUBE_API_URL points it
+// elsewhere, e.g. at `kubectl proxy` when run from a workstation.
+type kube struct {
+	base      string
+	tokenFile string
+	http      *http.Client
+}
+
+func newKube() (*kube, error) {
+	if kubeURL != "" {
+		// no client timeout: watches stay open; calls are bounded by ctx
+		return &kube{base: strings.TrimRight(kubeURL, "/"), http: &http.Client{}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster; set KUBE_API_URL")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	return &kube{
+		base:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		http: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// podNamespace is the namespace the operator runs in, "" outside a pod.
+func podNamespace() string {
+	raw, _ := os.ReadFile(serviceAccountDir + "/namespace")
+	return strings.TrimSpace(string(raw))
+}
+
+// object is a custom resource as the operator sees it; spec is kept raw
+// and forwarded to the service as it is.
+type object struct {
+	Metadata struct {
+		Name              string    `json:"name"`
+		Namespace         string    `json:"namespace"`
+		UID               string    `json:"uid"`
+		Generation        int64     `json:"generation"`
+		ResourceVersion   string    `json:"resourceVersion"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec   map[string]interface{} `json:"spec"`
+	Status resourceStatus         `json:"status"`
+}
+
+type resourceStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []condition `json:"conditions,omitempty"`
+}
+
+type condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+	ObservedGeneration int64     `json:"observedGeneration"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+func (k *kube) path(plural, namespace string) string {
+	p := "/apis/" + crdGroup + "/" + crdVersion
+	if namespace != "" {
+		p += "/namespaces/" + namespace
+	}
+	return p + "/" + plural
+}
+
+func (k *kube) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, method, k.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if k.tokenFile != "" {
+		// re-read each time: projected tokens are rotated on disk
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// List returns the resources of one kind in namespace, all namespaces
+// when it is "".
+func (k *kube) List(ctx context.Context, plural, namespace string) ([]object, error) {
+	resp, err := k.do(ctx, http.MethodGet, k.path(plural, namespace), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []object `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// PatchStatus merges status into the resource's status subresource.
+func (k *kube) PatchStatus(ctx context.Context, plural string, obj object, status resourceStatus) error {
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	path := k.path(plural, obj.Metadata.Namespace) + "/" + obj.Metadata.Name + "/status"
+	resp, err := k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Watch streams changes to one kind and calls fn for every event until
+// the server closes the stream or ctx ends.
+func (k *kube) Watch(ctx context.Context, plural, namespace string, fn func(event string, obj object)) error {
+	resp, err := k.do(ctx, http.MethodGet, k.path(plural, namespace)+"?watch=1&timeoutSeconds=300", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var ev struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return err
+		}
+		if ev.Type == "ERROR" {
+			// typically 410 Gone once the resource version is too old
+			return fmt.Errorf("watch %s: %s", plural, ev.Object)
+		}
+		var obj object
+		if err := json.Unmarshal(ev.Object, &obj); err != nil {
+			return err
+		}
+		fn(ev.Type, obj)
+	}
+	return sc.Err()
+}
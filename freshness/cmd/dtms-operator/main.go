@@ -0,0 +1,128 @@
+// dtms-operator reconciles DTMS custom resources into the freshness
+// service's managed configuration (GET/PUT/DELETE /api/v1/managed), so
+// sites, checks and alert routes can be kept in git and applied with the
+// rest of a cluster's manifests:
+//
+//	Site            site settings as under `sites:` in SITES_CONFIG;
+//	                spec.site names the site, metadata.name otherwise
+//	FreshnessCheck  a source as in SOURCES_CONFIG; spec.name or metadata.name
+//	AlertRoute      an incident webhook route; spec.name or metadata.name
+//
+// Every RESYNC_SECONDS, and soon after any resource's spec changes, it
+// lists the resources, PUTs the entries that differ, DELETEs managed
+// entries no resource asks for, and records the outcome in each
+// resource's Synced condition. The operator owns /api/v1/managed: entries
+// put there by hand are removed at the next resync. WATCH_NAMESPACE limits
+// it to one namespace; "*" watches all of them.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	apiURL         = envOr("DTMS_API_URL", "http://freshness:8004")
+	apiToken       = envOr("API_TOKEN", "")
+	kubeURL        = envOr("KUBE_API_URL", "")
+	watchNamespace = envOr("WATCH_NAMESPACE", podNamespace())
+	resync         = time.Duration(envOrInt("RESYNC_SECONDS", 60)) * time.Second
+)
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envOrInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func main() {
+	if watchNamespace == "*" {
+		watchNamespace = ""
+	}
+	k, err := newKube()
+	if err != nil {
+		fmt.Printf("[operator] kubernetes: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	scope := watchNamespace
+	if scope == "" {
+		scope = "all namespaces"
+	}
+	fmt.Printf("[operator] reconciling %s into %s every %s\n", scope, apiURL, resync)
+
+	changed := make(chan struct{}, 1)
+	for _, rk := range resourceKinds {
+		go watchKind(ctx, k, rk, changed)
+	}
+	for ctx.Err() == nil {
+		rctx, rcancel := context.WithTimeout(ctx, 2*time.Minute)
+		reconcile(rctx, k)
+		rcancel()
+		select {
+		case <-ctx.Done():
+		case <-time.After(resync):
+		case <-changed:
+			// let a burst of edits, say a whole directory applied at
+			// once, settle into one pass
+			select {
+			case <-ctx.Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}
+}
+
+// watchKind signals changed whenever a resource of the kind is added,
+// deleted or has its spec edited. Status-only updates, including the
+// operator's own, keep the generation and are ignored.
+func watchKind(ctx context.Context, k *kube, rk resourceKind, changed chan<- struct{}) {
+	seen := map[string]int64{}
+	for ctx.Err() == nil {
+		err := k.Watch(ctx, rk.plural, watchNamespace, func(event string, obj object) {
+			uid, gen := obj.Metadata.UID, obj.Metadata.Generation
+			switch event {
+			case "DELETED":
+				delete(seen, uid)
+			case "ADDED", "MODIFIED":
+				if seen[uid] == gen {
+					return
+				}
+				seen[uid] = gen
+			default:
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("[operator] watch %s: %v\n", rk.plural, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
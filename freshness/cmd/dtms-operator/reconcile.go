@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resourceKind ties a custom resource to the managed configuration kind
+// it is reconciled into. nameField is the spec field naming the entry in
+// the service; it defaults to the resource name and is not forwarded.
+type resourceKind struct {
+	kind      string // CRD kind, for logs
+	plural    string
+	managed   string
+	nameField string
+}
+
+var resourceKinds = []resourceKind{
+	{kind: "Site", plural: "sites", managed: "sites", nameField: "site"},
+	{kind: "FreshnessCheck", plural: "freshnesschecks", managed: "checks", nameField: "name"},
+	{kind: "AlertRoute", plural: "alertroutes", managed: "routes", nameField: "name"},
+}
+
+// desiredEntry is one managed entry and the resource it comes from.
+type desiredEntry struct {
+	obj  object
+	spec json.RawMessage
+}
+
+func entryName(rk resourceKind, obj object) string {
+	if n, ok := obj.Spec[rk.nameField].(string); ok && n != "" {
+		return n
+	}
+	return obj.Metadata.Name
+}
+
+// canonical re-encodes a spec with sorted keys, the form the service
+// keeps, so an unchanged resource is not PUT again.
+func canonical(v interface{}) (json.RawMessage, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
+
+// reconcile makes the service's managed configuration match the
+// resources in the cluster: it PUTs what is missing or different, DELETEs
+// what no resource asks for, and reports the outcome on each resource's
+// Synced condition. A kind whose list fails is left alone that round, so
+// an API server hiccup never prunes the service.
+func reconcile(ctx context.Context, k *kube) {
+	current, err := managedState(ctx)
+	if err != nil {
+		fmt.Printf("[operator] managed state: %v\n", err)
+		return
+	}
+	for _, rk := range resourceKinds {
+		objs, err := k.List(ctx, rk.plural, watchNamespace)
+		if err != nil {
+			fmt.Printf("[operator] list %s: %v\n", rk.plural, err)
+			continue
+		}
+		reconcileKind(ctx, k, rk, objs, current[rk.managed])
+	}
+}
+
+func reconcileKind(ctx context.Context, k *kube, rk resourceKind, objs []object, current map[string]json.RawMessage) {
+	// the oldest resource claims a name; later ones are reported as
+	// conflicting rather than fighting over the entry
+	sort.Slice(objs, func(i, j int) bool {
+		a, b := objs[i].Metadata, objs[j].Metadata
+		if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(b.CreationTimestamp)
+		}
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	})
+	desired := map[string]desiredEntry{}
+	for _, obj := range objs {
+		name := entryName(rk, obj)
+		if owner, taken := desired[name]; taken {
+			setSynced(ctx, k, rk, obj, false, "Conflict",
+				fmt.Sprintf("%s %q is already defined by %s/%s", rk.managed, name, owner.obj.Metadata.Namespace, owner.obj.Metadata.Name))
+			continue
+		}
+		spec := map[string]interface{}{}
+		for key, v := range obj.Spec {
+			if key != rk.nameField {
+				spec[key] = v
+			}
+		}
+		raw, err := canonical(spec)
+		if err != nil {
+			setSynced(ctx, k, rk, obj, false, "Invalid", err.Error())
+			continue
+		}
+		desired[name] = desiredEntry{obj: obj, spec: raw}
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := desired[name]
+		if have, ok := current[name]; ok && sameSpec(have, d.spec) {
+			setSynced(ctx, k, rk, d.obj, true, "Synced", fmt.Sprintf("%s/%s in sync", rk.managed, name))
+			continue
+		}
+		status, err := managedCall(ctx, http.MethodPut, rk.managed, name, d.spec)
+		switch {
+		case status == http.StatusUnprocessableEntity:
+			setSynced(ctx, k, rk, d.obj, false, "Invalid", err.Error())
+		case err != nil:
+			fmt.Printf("[operator] put %s/%s: %v\n", rk.managed, name, err)
+			setSynced(ctx, k, rk, d.obj, false, "Error", err.Error())
+		default:
+			fmt.Printf("[operator] %s/%s applied from %s/%s\n", rk.managed, name, d.obj.Metadata.Namespace, d.obj.Metadata.Name)
+			setSynced(ctx, k, rk, d.obj, true, "Synced", fmt.Sprintf("%s/%s in sync", rk.managed, name))
+		}
+	}
+
+	for name := range current {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		status, err := managedCall(ctx, http.MethodDelete, rk.managed, name, nil)
+		if err != nil && status != http.StatusNotFound {
+			fmt.Printf("[operator] delete %s/%s: %v\n", rk.managed, name, err)
+			continue
+		}
+		fmt.Printf("[operator] %s/%s removed\n", rk.managed, name)
+	}
+}
+
+func sameSpec(a, b json.RawMessage) bool {
+	ca, err1 := canonical(a)
+	cb, err2 := canonical(b)
+	return err1 == nil && err2 == nil && bytes.Equal(ca, cb)
+}
+
+// setSynced patches the Synced condition, only when it changes so the
+// operator's own writes do not keep the resources churning.
+func setSynced(ctx context.Context, k *kube, rk resourceKind, obj object, ok bool, reason, message string) {
+	status := "False"
+	if ok {
+		status = "True"
+	}
+	gen := obj.Metadata.Generation
+	cond := condition{
+		Type: "Synced", Status: status, Reason: reason, Message: message,
+		ObservedGeneration: gen, LastTransitionTime: time.Now().UTC().Truncate(time.Second),
+	}
+	var kept []condition
+	for _, c := range obj.Status.Conditions {
+		if c.Type != "Synced" {
+			kept = append(kept, c)
+			continue
+		}
+		if c.Status == cond.Status {
+			if c.Reason == cond.Reason && c.Message == cond.Message && c.ObservedGeneration == gen && obj.Status.ObservedGeneration == gen {
+				return
+			}
+			cond.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	next := resourceStatus{ObservedGeneration: gen, Conditions: append(kept, cond)}
+	if err := k.PatchStatus(ctx, rk.plural, obj, next); err != nil {
+		fmt.Printf("[operator] status %s %s/%s: %v\n", rk.kind, obj.Metadata.Namespace, obj.Metadata.Name, err)
+	}
+}
+
+// managedState fetches GET /api/v1/managed.
+func managedState(ctx context.Context) (map[string]map[string]json.RawMessage, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL+"/api/v1/managed", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+apiToken)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/api/v1/managed: %s", resp.Status)
+	}
+	var out map[string]map[string]json.RawMessage
+	return out, json.NewDecoder(resp.Body).Decode(&out)
+}
+
+// managedCall PUTs or DELETEs one managed entry and returns the response
+// status with an error carrying the service's message on failure.
+func managedCall(ctx context.Context, method, kind, name string, spec []byte) (int, error) {
+	path := "/api/v1/managed/" + kind + "/" + url.PathEscape(name)
+	r, err := http.NewRequestWithContext(ctx, method, apiURL+path, bytes.NewReader(spec))
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+apiToken)
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
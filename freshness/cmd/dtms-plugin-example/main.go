@@ -0,0 +1,93 @@
+// dtms-plugin-example is a minimal plugin for the freshness service,
+// written as a starting point for new ones. As a source it reports the
+// modification time of one file per site, from the entry's params:
+//
+//	sources:
+//	  - name: drops
+//	    type: plugin
+//	    plugin: example
+//	    params:
+//	      targets: {SITE_A: /mnt/drop/SITE_A/.last}
+//
+// As a notifier it appends every event it receives as a JSON line to the
+// file named by `log` in the plugin's config.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/youruser/dtms-fresh/plugin"
+)
+
+var (
+	mu      sync.Mutex
+	logPath string
+)
+
+func main() {
+	err := plugin.Serve(plugin.Handlers{
+		Configure: func(name string, config json.RawMessage) error {
+			var c struct {
+				Log string `json:"log"`
+			}
+			if len(config) > 0 && string(config) != "null" {
+				if err := json.Unmarshal(config, &c); err != nil {
+					return err
+				}
+			}
+			logPath = c.Log
+			return nil
+		},
+		Collect: collect,
+		Notify:  notify,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func collect(ctx context.Context, source string, params json.RawMessage) ([]plugin.Site, error) {
+	var p struct {
+		Targets map[string]string `json:"targets"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	var sites []plugin.Site
+	for site, path := range p.Targets {
+		fi, err := os.Stat(path)
+		if err != nil {
+			// stderr is logged by the service
+			fmt.Fprintf(os.Stderr, "%s: %v\n", site, err)
+			continue
+		}
+		sites = append(sites, plugin.Site{Site: site, LatestTimestamp: float64(fi.ModTime().UnixNano()) / 1e9})
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Site < sites[j].Site })
+	return sites, nil
+}
+
+func notify(ctx context.Context, ev plugin.Event) error {
+	if logPath == "" {
+		return nil
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(raw, '\n'))
+	return err
+}
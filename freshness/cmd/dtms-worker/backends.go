@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backend copies a request's dataset between sites, calling report with
+// cumulative progress as it goes, and removes datasets from a site. report
+// returns the request's current bandwidth limit, which a backend that can
+// change pace mid-copy follows. Delete returns the size of what it
+// removed, or would remove in dry-run mode, with sizeUnknown for both
+// counts when the backend cannot measure it.
+type backend interface {
+	Copy(ctx context.Context, req transferRequest, report func(progress) int64) error
+	Delete(ctx context.Context, site, dataset string, dryRun bool) (bytes, files int64, err error)
+}
+
+const sizeUnknown = -1
+
+// progressEvery throttles how often a backend reports to the API.
+const progressEvery = 10 * time.Second
+
+func newBackend(name string, sites map[string]siteRoots) (backend, error) {
+	switch name {
+	case "rclone":
+		return rcloneBackend{sites}, nil
+	case "rsync":
+		return rsyncBackend{sites}, nil
+	case "http":
+		return httpPutBackend{sites}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+func siteRoot(sites map[string]siteRoots, site string, pick func(siteRoots) string) (string, error) {
+	root := pick(sites[site])
+	if root == "" {
+		return "", fmt.Errorf("no root configured for site %s", site)
+	}
+	return strings.TrimRight(root, "/"), nil
+}
+
+// datasetPath is where a dataset to delete lives under the site's root. The
+// dataset must be a clean relative path, so nothing outside the dataset,
+// let alone the root itself, can be removed.
+func datasetPath(sites map[string]siteRoots, site, dataset string, pick func(siteRoots) string) (string, error) {
+	root, err := siteRoot(sites, site, pick)
+	if err != nil {
+		return "", err
+	}
+	refuse := func(why string) (string, error) {
+		return "", fmt.Errorf("refusing to delete dataset %q: %s", dataset, why)
+	}
+	switch {
+	case dataset == "":
+		return refuse("empty")
+	case strings.HasPrefix(dataset, "/"):
+		return refuse("absolute path")
+	case path.Clean(dataset) != dataset:
+		return refuse("not a clean path")
+	}
+	for _, c := range strings.Split(dataset, "/") {
+		if c == "" || c == "." || c == ".." {
+			return refuse(fmt.Sprintf("path component %q", c))
+		}
+	}
+	p := root + "/" + dataset
+	if root == "" || path.Clean(p) == path.Clean(root) {
+		return refuse("resolves to the site root")
+	}
+	return p, nil
+}
+
+func endpoints(sites map[string]siteRoots, req transferRequest, src, dst func(siteRoots) string) (string, string, error) {
+	from, err := siteRoot(sites, req.Source, src)
+	if err != nil {
+		return "", "", err
+	}
+	to, err := siteRoot(sites, req.Destination, dst)
+	if err != nil {
+		return "", "", err
+	}
+	return from + "/" + req.Dataset, to + "/" + req.Dataset, nil
+}
+
+// runStreaming runs cmd, handing every line of stderr+stdout (split on
+// newlines and carriage returns) to line.
+func runStreaming(cmd *exec.Cmd, line func(string)) error {
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	var tail bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc := bufio.NewScanner(pr)
+		sc.Split(scanLinesOrCR)
+		for sc.Scan() {
+			tail.Reset()
+			tail.WriteString(sc.Text())
+			line(sc.Text())
+		}
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", filepath.Base(cmd.Path), err, strings.TrimSpace(tail.String()))
+	}
+	return nil
+}
+
+func scanLinesOrCR(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// rcloneBackend runs `rclone copy` with JSON logging and forwards its
+// periodic stats.
+type rcloneBackend struct{ sites map[string]siteRoots }
+
+func (b rcloneBackend) Copy(ctx context.Context, req transferRequest, report func(progress) int64) error {
+	src, dst, err := endpoints(b.sites, req, func(r siteRoots) string { return r.Rclone }, func(r siteRoots) string { return r.Rclone })
+	if err != nil {
+		return err
+	}
+	args := []string{"copy", src, dst, "--use-json-log", "--stats", progressEvery.String(), "--stats-log-level", "NOTICE"}
+	if req.Bandwidth > 0 {
+		args = append(args, "--bwlimit", fmt.Sprintf("%dK", kibPerSecond(req.Bandwidth)))
+	}
+	cmd := exec.CommandContext(ctx, "rclone", args...)
+	return runStreaming(cmd, func(line string) {
+		var entry struct {
+			Stats *struct {
+				Bytes     int64 `json:"bytes"`
+				Transfers int64 `json:"transfers"`
+				Errors    int64 `json:"errors"`
+			} `json:"stats"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.Stats == nil {
+			return
+		}
+		p := progress{Bytes: entry.Stats.Bytes, Files: entry.Stats.Transfers}
+		if entry.Stats.Errors > 0 {
+			p.Message = fmt.Sprintf("%d errors so far", entry.Stats.Errors)
+		}
+		report(p)
+	})
+}
+
+func (b rcloneBackend) Delete(ctx context.Context, site, dataset string, dryRun bool) (int64, int64, error) {
+	path, err := datasetPath(b.sites, site, dataset, func(r siteRoots) string { return r.Rclone })
+	if err != nil {
+		return 0, 0, err
+	}
+	out, err := exec.CommandContext(ctx, "rclone", "size", "--json", path).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("rclone size: %w", err)
+	}
+	var size struct {
+		Count int64 `json:"count"`
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal(out, &size); err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		return size.Bytes, size.Count, nil
+	}
+	if out, err := exec.CommandContext(ctx, "rclone", "purge", path).CombinedOutput(); err != nil {
+		return 0, 0, fmt.Errorf("rclone purge: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return size.Bytes, size.Count, nil
+}
+
+// rsyncBackend runs rsync over ssh; --info=progress2 gives whole-transfer
+// totals such as "1,234,567  45%  1.23MB/s  0:00:12 (xfr#3, to-chk=7/11)".
+type rsyncBackend struct{ sites map[string]siteRoots }
+
+var rsyncProgress = regexp.MustCompile(`^\s*([\d,]+)\s+\d+%(?:.*xfr#(\d+))?`)
+
+func (b rsyncBackend) Copy(ctx context.Context, req transferRequest, report func(progress) int64) error {
+	src, dst, err := endpoints(b.sites, req, func(r siteRoots) string { return r.Rsync }, func(r siteRoots) string { return r.Rsync })
+	if err != nil {
+		return err
+	}
+	args := []string{"-a", "--partial", "--info=progress2", "--no-inc-recursive", "-e", "ssh -o BatchMode=yes"}
+	if req.Bandwidth > 0 {
+		args = append(args, fmt.Sprintf("--bwlimit=%d", kibPerSecond(req.Bandwidth)))
+	}
+	cmd := exec.CommandContext(ctx, "rsync", append(args, src+"/", dst+"/")...)
+	var last time.Time
+	return runStreaming(cmd, func(line string) {
+		m := rsyncProgress.FindStringSubmatch(line)
+		if m == nil || time.Since(last) < progressEvery {
+			return
+		}
+		last = time.Now()
+		n, _ := strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+		files, _ := strconv.ParseInt(m[2], 10, 64)
+		report(progress{Bytes: n, Files: files})
+	})
+}
+
+// Delete measures and removes the dataset over ssh on the rsync host.
+func (b rsyncBackend) Delete(ctx context.Context, site, dataset string, dryRun bool) (int64, int64, error) {
+	path, err := datasetPath(b.sites, site, dataset, func(r siteRoots) string { return r.Rsync })
+	if err != nil {
+		return 0, 0, err
+	}
+	host, dir, ok := strings.Cut(path, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("rsync root for %s is not host:path", site)
+	}
+	script := fmt.Sprintf("du -sb -- %[1]s | cut -f1; find %[1]s -type f | wc -l", shellQuote(dir))
+	if !dryRun {
+		script += "; rm -rf -- " + shellQuote(dir)
+	}
+	out, err := exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", host, script).CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ssh: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("unexpected output %q", out)
+	}
+	size, _ := strconv.ParseInt(fields[0], 10, 64)
+	files, _ := strconv.ParseInt(fields[1], 10, 64)
+	return size, files, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// httpPutBackend uploads the dataset from the source site's local mount
+// to the destination's HTTP(S)/WebDAV root, one PUT per file.
+type httpPutBackend struct{ sites map[string]siteRoots }
+
+func (b httpPutBackend) Copy(ctx context.Context, req transferRequest, report func(progress) int64) error {
+	src, dst, err := endpoints(b.sites, req, func(r siteRoots) string { return r.Local }, func(r siteRoots) string { return r.HTTP })
+	if err != nil {
+		return err
+	}
+	token := b.sites[req.Destination].HTTPToken
+	httpClient := &http.Client{}
+	var p progress
+	last := time.Now()
+	pace := newThrottle(req.Bandwidth)
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		n, err := putFile(ctx, httpClient, path, dst+"/"+filepath.ToSlash(rel), token, pace)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		p.Bytes += n
+		p.Files++
+		if time.Since(last) >= progressEvery {
+			last = time.Now()
+			pace.setRate(report(p))
+		}
+		return nil
+	})
+	if err == nil {
+		report(p)
+	}
+	return err
+}
+
+// Delete issues a WebDAV DELETE on the dataset's collection. Plain HTTP
+// has no sizes, so they are measured through the site's local mount when
+// one is configured and are otherwise unknown; in dry-run mode only
+// existence is checked.
+func (b httpPutBackend) Delete(ctx context.Context, site, dataset string, dryRun bool) (int64, int64, error) {
+	url, err := datasetPath(b.sites, site, dataset, func(r siteRoots) string { return r.HTTP })
+	if err != nil {
+		return 0, 0, err
+	}
+	size, files := int64(sizeUnknown), int64(sizeUnknown)
+	if local, err := datasetPath(b.sites, site, dataset, func(r siteRoots) string { return r.Local }); err == nil {
+		if s, f, err := localSize(local); err == nil {
+			size, files = s, f
+		}
+	}
+	method := http.MethodDelete
+	if dryRun {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url+"/", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if token := b.sites[site].HTTPToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, 0, fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return size, files, nil
+}
+
+// localSize sums the regular files under dir.
+func localSize(dir string) (size, files int64, err error) {
+	err = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		files++
+		return nil
+	})
+	return size, files, err
+}
+
+func putFile(ctx context.Context, c *http.Client, path, url, token string, t *throttle) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, t.reader(ctx, f))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = info.Size()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("PUT: %s", resp.Status)
+	}
+	return info.Size(), nil
+}
+
+// kibPerSecond converts a limit to the KiB/s rclone and rsync take.
+func kibPerSecond(bytesPerSecond int64) int64 {
+	if k := bytesPerSecond / 1024; k > 0 {
+		return k
+	}
+	return 1
+}
+
+// throttle paces reads to a byte rate shared by all files of a request.
+type throttle struct {
+	rate  float64
+	start time.Time
+	sent  int64
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{rate: float64(bytesPerSecond), start: time.Now()}
+}
+
+// setRate changes the rate for what is read from now on.
+func (t *throttle) setRate(bytesPerSecond int64) {
+	if float64(bytesPerSecond) != t.rate {
+		t.rate, t.start, t.sent = float64(bytesPerSecond), time.Now(), 0
+	}
+}
+
+func (t *throttle) reader(ctx context.Context, r io.Reader) io.Reader {
+	return throttledReader{ctx, r, t}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	if tr.t.rate <= 0 {
+		return tr.r.Read(p)
+	}
+	if max := int(tr.t.rate); len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.sent += int64(n)
+	ahead := time.Duration(float64(tr.t.sent)/tr.t.rate*float64(time.Second)) - time.Since(tr.t.start)
+	if ahead > 0 {
+		select {
+		case <-tr.ctx.Done():
+			return n, tr.ctx.Err()
+		case <-time.After(ahead):
+		}
+	}
+	return n, err
+}
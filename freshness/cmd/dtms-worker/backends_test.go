@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDatasetPath(t *testing.T) {
+	sites := map[string]siteRoots{
+		"A":    {Rsync: "host:/data/a/"},
+		"ROOT": {Rsync: "/"},
+	}
+	pick := func(r siteRoots) string { return r.Rsync }
+	for _, tc := range []struct {
+		site, dataset string
+		want, err     string
+	}{
+		{site: "A", dataset: "run1", want: "host:/data/a/run1"},
+		{site: "A", dataset: "raw/2024/run1", want: "host:/data/a/raw/2024/run1"},
+		{site: "A", dataset: "v1..2", want: "host:/data/a/v1..2"},
+		{site: "A", dataset: "", err: "empty"},
+		{site: "A", dataset: "/etc", err: "absolute path"},
+		{site: "A", dataset: "..", err: `path component ".."`},
+		{site: "A", dataset: "../b", err: `path component ".."`},
+		{site: "A", dataset: "a/../b", err: "not a clean path"},
+		{site: "A", dataset: "a/..", err: "not a clean path"},
+		{site: "A", dataset: ".", err: `path component "."`},
+		{site: "A", dataset: "./a", err: "not a clean path"},
+		{site: "A", dataset: "a/./b", err: "not a clean path"},
+		{site: "A", dataset: "a//b", err: "not a clean path"},
+		{site: "A", dataset: "a/", err: "not a clean path"},
+		{site: "ROOT", dataset: "run1", err: "resolves to the site root"},
+		{site: "B", dataset: "run1", err: "no root configured"},
+	} {
+		got, err := datasetPath(sites, tc.site, tc.dataset, pick)
+		switch {
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s %q: err = %v, want %q", tc.site, tc.dataset, err, tc.err)
+		case tc.err == "" && (err != nil || got != tc.want):
+			t.Errorf("%s %q = %q, %v, want %q", tc.site, tc.dataset, got, err, tc.want)
+		}
+	}
+}
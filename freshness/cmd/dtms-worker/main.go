@@ -0,0 +1,345 @@
+// dtms-worker executes transfer requests queued in DTMS. It claims the
+// head of the queue, runs the copy through one backend (rclone, rsync over
+// ssh, or HTTP PUT), reports progress while it runs and finishes the
+// request as done or failed once its retries are used up. With
+// WORKER_DELETIONS=true it also executes deletion campaign targets when
+// there is no transfer to run.
+//
+// With OTEL_EXPORTER_OTLP_ENDPOINT set the worker exports a span for each
+// request it executes and each copy it tries, below the attempt span the
+// service names in the claim, so a transfer's trace covers both sides.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+	"github.com/youruser/dtms-fresh/tracing"
+)
+
+var (
+	apiURL       = envOr("DTMS_API_URL", "http://freshness:8004")
+	apiToken     = envOr("API_TOKEN", "")
+	workerName   = envOr("WORKER_NAME", hostname())
+	backendName  = envOr("WORKER_BACKEND", "rclone")
+	sitesPath    = envOr("WORKER_SITES_CONFIG", "/etc/dtms/worker-sites.yml")
+	pollInterval = time.Duration(envOrInt("WORKER_POLL_SECONDS", 15)) * time.Second
+	retries      = envOrInt("WORKER_RETRIES", 2)
+	retryBackoff = time.Duration(envOrInt("WORKER_RETRY_BACKOFF_SECONDS", 30)) * time.Second
+	deletions    = envOr("WORKER_DELETIONS", "false") == "true"
+)
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+var tracer *tracing.Exporter
+
+// transferRequest mirrors the fields of the API's request the worker uses.
+type transferRequest struct {
+	ID          string `json:"id"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Dataset     string `json:"dataset"`
+	Attempts    int    `json:"attempts"`
+	Bandwidth   int64  `json:"bandwidth_limit"` // bytes per second, 0 for unlimited
+	Traceparent string `json:"traceparent"`
+}
+
+// siteRoots locates each site's storage for the backends. Datasets live
+// directly below the root.
+type siteRoots struct {
+	Rclone    string `yaml:"rclone"`
+	Rsync     string `yaml:"rsync"`
+	Local     string `yaml:"local"`
+	HTTP      string `yaml:"http"`
+	HTTPToken string `yaml:"http_token"`
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envOrInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func main() {
+	raw, err := os.ReadFile(sitesPath)
+	if err != nil {
+		fmt.Printf("[worker] sites config error: %v\n", err)
+		os.Exit(1)
+	}
+	var cfg struct {
+		Sites map[string]siteRoots `yaml:"sites"`
+	}
+	if err := yamlenv.Unmarshal(raw, &cfg); err != nil {
+		fmt.Printf("[worker] sites config error: %v\n", err)
+		os.Exit(1)
+	}
+	b, err := newBackend(backendName, cfg.Sites)
+	if err != nil {
+		fmt.Printf("[worker] %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	tracer = tracing.NewExporter(tracing.ConfigFromEnv("dtms-worker"), tracing.Hooks{
+		Failed: func(n int, err error) { fmt.Printf("[worker] trace export of %d spans failed: %v\n", n, err) },
+	})
+	traced := make(chan struct{})
+	go func() {
+		defer close(traced)
+		tracer.Run(ctx)
+	}()
+	defer func() { <-traced }()
+	fmt.Printf("[worker] %s claiming from %s with the %s backend\n", workerName, apiURL, backendName)
+	for ctx.Err() == nil {
+		req, ok, err := claim(ctx)
+		if err != nil {
+			fmt.Printf("[worker] claim: %v\n", err)
+		}
+		if !ok && deletions {
+			var d deletionClaim
+			if err := call(ctx, "/api/v1/deletion-campaigns/claim", map[string]string{"worker": workerName}, &d); err != nil {
+				fmt.Printf("[worker] deletion claim: %v\n", err)
+			} else if d.Campaign != "" {
+				executeDeletion(ctx, b, d)
+				continue
+			}
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		execute(ctx, b, req)
+	}
+}
+
+// execute runs one request with local retries. An interrupted worker
+// leaves the request alone; its lease expires and it is requeued. A
+// progress report the API rejects because the request is gone or no longer
+// held by this worker (cancelled, or requeued after the lease ran out)
+// stops the copy.
+func execute(ctx context.Context, b backend, req transferRequest) {
+	fmt.Printf("[worker] %s: %s %s->%s (attempt %d)\n", req.ID, req.Dataset, req.Source, req.Destination, req.Attempts)
+	parent := ctx
+	ctx, abandon := context.WithCancelCause(ctx)
+	defer abandon(nil)
+	var (
+		span *tracing.Span
+		err  error
+	)
+	if parent, ok := tracing.ParseTraceparent(req.Traceparent); ok && tracer.Enabled() {
+		span = parent.Child("worker.execute", time.Now())
+		span.Attr("dtms.request_id", req.ID).Attr("dtms.worker", workerName).Attr("dtms.backend", backendName)
+		defer func() { tracer.Export(span.Finish(time.Now(), err)) }()
+	}
+	for try := 0; try <= retries; try++ {
+		if try > 0 {
+			if limit, rerr := report(ctx, req.ID, progress{Message: fmt.Sprintf("retry %d after: %v", try, err)}); claimLost(rerr) {
+				abandon(rerr)
+			} else if rerr == nil {
+				req.Bandwidth = limit
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryBackoff * time.Duration(1<<(try-1))):
+			}
+		}
+		var cp *tracing.Span
+		if span != nil {
+			cp = span.Context().Child("worker.copy", time.Now())
+			cp.Attr("dtms.try", try)
+		}
+		err = b.Copy(ctx, req, func(p progress) int64 {
+			if cp != nil {
+				cp.Event("progress", time.Now(), map[string]interface{}{"dtms.bytes": p.Bytes, "dtms.files": p.Files})
+			}
+			limit, rerr := report(ctx, req.ID, p)
+			if claimLost(rerr) {
+				abandon(rerr)
+			} else if rerr == nil && limit != req.Bandwidth {
+				fmt.Printf("[worker] %s: bandwidth limit now %d B/s\n", req.ID, limit)
+				req.Bandwidth = limit
+			}
+			return req.Bandwidth
+		})
+		if cp != nil {
+			tracer.Export(cp.Finish(time.Now(), err))
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		if parent.Err() == nil {
+			fmt.Printf("[worker] %s: abandoned: %v\n", req.ID, context.Cause(ctx))
+		}
+		return
+	}
+	status, msg := "done", ""
+	if err != nil {
+		status, msg = "failed", err.Error()
+	}
+	if err := call(ctx, "/api/v1/transfer-requests/"+req.ID+"/finish", map[string]string{"worker": workerName, "status": status, "error": msg}, nil); err != nil {
+		fmt.Printf("[worker] %s: finish: %v\n", req.ID, err)
+	}
+	fmt.Printf("[worker] %s: %s %s\n", req.ID, status, msg)
+}
+
+type deletionClaim struct {
+	Campaign string `json:"campaign"`
+	Dataset  string `json:"dataset"`
+	Site     string `json:"site"`
+	DryRun   bool   `json:"dry_run"`
+}
+
+// executeDeletion removes (or, in dry-run, measures) one campaign target
+// and reports the result, renewing its lease with heartbeats meanwhile. As
+// with transfers, a heartbeat the API rejects stops the deletion.
+func executeDeletion(ctx context.Context, b backend, d deletionClaim) {
+	parent := ctx
+	ctx, abandon := context.WithCancelCause(ctx)
+	defer abandon(nil)
+	target := map[string]string{"worker": workerName, "dataset": d.Dataset, "site": d.Site}
+	go func() {
+		t := time.NewTicker(progressEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			err := call(ctx, "/api/v1/deletion-campaigns/"+d.Campaign+"/heartbeat", target, nil)
+			switch {
+			case claimLost(err):
+				abandon(err)
+			case err != nil && ctx.Err() == nil:
+				fmt.Printf("[worker] %s: heartbeat: %v\n", d.Campaign, err)
+			}
+		}
+	}()
+	bytes, files, err := b.Delete(ctx, d.Site, d.Dataset, d.DryRun)
+	if ctx.Err() != nil {
+		if parent.Err() == nil {
+			fmt.Printf("[worker] %s: abandoned %s@%s: %v\n", d.Campaign, d.Dataset, d.Site, context.Cause(ctx))
+		}
+		return
+	}
+	result := map[string]interface{}{"worker": workerName, "dataset": d.Dataset, "site": d.Site, "bytes": bytes, "files": files}
+	size := fmt.Sprintf("%d files, %d bytes", files, bytes)
+	if bytes == sizeUnknown {
+		result["bytes"], result["files"], result["bytes_unknown"] = 0, 0, true
+		size = "size unknown"
+	}
+	verb := "deleted"
+	if d.DryRun {
+		verb = "would delete"
+	}
+	if err != nil {
+		result["error"] = err.Error()
+		verb = "failed to delete"
+	}
+	fmt.Printf("[worker] %s: %s %s@%s (%s) %v\n", d.Campaign, verb, d.Dataset, d.Site, size, result["error"])
+	if err := call(ctx, "/api/v1/deletion-campaigns/"+d.Campaign+"/result", result, nil); err != nil {
+		fmt.Printf("[worker] %s: result: %v\n", d.Campaign, err)
+	}
+}
+
+type progress struct {
+	Worker  string `json:"worker"`
+	Bytes   int64  `json:"bytes"`
+	Files   int64  `json:"files"`
+	Message string `json:"message,omitempty"`
+}
+
+// report sends progress, which also renews the lease, and returns the
+// request's bandwidth limit from the answer, or the error, already logged,
+// if the API did not take it.
+func report(ctx context.Context, id string, p progress) (int64, error) {
+	p.Worker = workerName
+	var cur transferRequest
+	err := call(ctx, "/api/v1/transfer-requests/"+id+"/progress", p, &cur)
+	if err != nil && ctx.Err() == nil {
+		fmt.Printf("[worker] %s: progress: %v\n", id, err)
+	}
+	return cur.Bandwidth, err
+}
+
+// claimLost reports whether err says the request is gone or held by
+// someone else, rather than the API being unreachable.
+func claimLost(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusConflict)
+}
+
+func claim(ctx context.Context) (transferRequest, bool, error) {
+	var req transferRequest
+	err := call(ctx, "/api/v1/transfer-requests/claim", map[string]string{"worker": workerName}, &req)
+	return req, err == nil && req.ID != "", err
+}
+
+// statusError is a non-2xx answer from the API.
+type statusError struct {
+	Path   string
+	Code   int
+	Status string
+}
+
+func (e *statusError) Error() string { return e.Path + ": " + e.Status }
+
+// call POSTs body to the API and decodes the response into out, if any.
+func call(ctx context.Context, path string, body, out interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+apiToken)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return &statusError{Path: path, Code: resp.StatusCode, Status: resp.Status}
+	case out != nil:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/youruser/dtms-fresh/client"
+)
+
+// agents works through the sites whose agents registered themselves:
+//
+//	dtmsctl agents list [-status pending|approved|rejected]
+//	dtmsctl agents approve [-tier T] [-tenant T] [-threshold S] [-tag k=v]... SITE
+//	dtmsctl agents reject [-reason TEXT] SITE
+//	dtmsctl agents forget SITE
+func agents(args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+	ctx := context.Background()
+	c := newClient()
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		fs := flag.NewFlagSet("agents list", flag.ExitOnError)
+		status := fs.String("status", "", "only registrations in this state")
+		fs.Parse(args)
+		list, err := c.AgentRegistrations(ctx, *status)
+		if err != nil {
+			return err
+		}
+		for _, reg := range list {
+			at := time.Unix(int64(reg.Requested), 0).UTC().Format(time.RFC3339)
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", reg.Site, reg.Status, at, reg.Hostname, reg.Address, reg.Version)
+		}
+		return nil
+	case "approve":
+		fs := flag.NewFlagSet("agents approve", flag.ExitOnError)
+		var a client.AgentApproval
+		fs.StringVar(&a.Tier, "tier", "", "the site's tier tag")
+		fs.StringVar(&a.Tenant, "tenant", "", "the tenant owning the site's data")
+		fs.Float64Var(&a.Threshold, "threshold", 0, "freshness threshold in seconds")
+		var tags listFlag
+		fs.Var(&tags, "tag", "tag as key=value, repeatable")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		for _, t := range tags {
+			k, v, ok := strings.Cut(t, "=")
+			if !ok {
+				return fmt.Errorf("-tag %q: want key=value", t)
+			}
+			if a.Tags == nil {
+				a.Tags = map[string]string{}
+			}
+			a.Tags[k] = v
+		}
+		_, err := c.ApproveAgent(ctx, fs.Arg(0), a)
+		return err
+	case "reject":
+		fs := flag.NewFlagSet("agents reject", flag.ExitOnError)
+		reason := fs.String("reason", "", "told to the agent")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		_, err := c.RejectAgent(ctx, fs.Arg(0), *reason)
+		return err
+	case "forget":
+		if len(args) != 1 {
+			usage()
+		}
+		return c.DeleteAgentRegistration(ctx, args[0])
+	}
+	usage()
+	return nil
+}
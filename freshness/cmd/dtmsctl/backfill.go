@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/youruser/dtms-fresh/client"
+)
+
+// backfill imports history files through POST /api/v1/backfill:
+//
+//	dtmsctl backfill -kind transfers|samples [-format csv|jsonl] [-batch N] [-dry-run] [-skip-invalid] FILE...
+//
+// Files are sent -batch lines at a time, the CSV header repeated on each
+// chunk, with progress on stderr. Records cannot span lines, so CSV
+// fields must not contain newlines. An interrupted import can simply be
+// run again: what is already in is skipped.
+func backfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	var opts client.BackfillOptions
+	fs.StringVar(&opts.Kind, "kind", "transfers", "transfers or samples")
+	fs.StringVar(&opts.Format, "format", "", "csv or jsonl (default from the file name)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only validate")
+	fs.BoolVar(&opts.SkipInvalid, "skip-invalid", false, "import the valid records of files with invalid ones")
+	batch := fs.Int("batch", 5000, "lines per request")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no files given")
+	}
+	c := newClient()
+	var total client.BackfillResult
+	for _, path := range fs.Args() {
+		o := opts
+		if o.Format == "" {
+			o.Format = "jsonl"
+			if strings.EqualFold(filepath.Ext(path), ".csv") {
+				o.Format = "csv"
+			}
+		}
+		res, err := backfillFile(c, path, o, max(*batch, 1))
+		total.Read += res.Read
+		total.Imported += res.Imported
+		total.Skipped += res.Skipped
+		total.Invalid += res.Invalid
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if len(fs.Args()) > 1 {
+		fmt.Printf("total: %d read, %d imported, %d already present, %d invalid\n", total.Read, total.Imported, total.Skipped, total.Invalid)
+	}
+	return nil
+}
+
+func backfillFile(c *client.Client, path string, opts client.BackfillOptions, batch int) (client.BackfillResult, error) {
+	var sum client.BackfillResult
+	lines, err := countLines(path)
+	if err != nil {
+		return sum, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	var header []byte
+	line := 0
+	if opts.Format == "csv" {
+		if header, err = r.ReadBytes('\n'); err != nil && err != io.EOF {
+			return sum, err
+		}
+		line++
+	}
+	verb := "imported"
+	if opts.DryRun {
+		verb = "to import"
+	}
+	var failed error
+	for {
+		var chunk bytes.Buffer
+		chunk.Write(header)
+		start, n := line+1, 0
+		for n < batch {
+			b, err := r.ReadBytes('\n')
+			if len(b) > 0 {
+				chunk.Write(b)
+				n++
+				line++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return sum, err
+			}
+		}
+		if n == 0 {
+			break
+		}
+		opts.FirstLine = start
+		if opts.Format == "csv" {
+			// the server counts the header as the chunk's first line
+			opts.FirstLine = start - 1
+		}
+		res, err := c.Backfill(context.Background(), opts, chunk.Bytes())
+		sum.Read += res.Read
+		sum.Imported += res.Imported
+		sum.Skipped += res.Skipped
+		sum.Invalid += res.Invalid
+		for _, e := range res.Errors {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, e.Line, e.Error)
+		}
+		if err != nil {
+			var e *client.Error
+			if !errors.As(err, &e) || e.StatusCode != 422 {
+				return sum, err
+			}
+			failed = fmt.Errorf("invalid records; fix them or use -skip-invalid")
+			if !opts.DryRun {
+				return sum, failed
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d/%d lines, %d %s, %d already present, %d invalid\n", path, line, lines, sum.Imported, verb, sum.Skipped, sum.Invalid)
+	}
+	fmt.Printf("%s: %d read, %d %s, %d already present, %d invalid\n", path, sum.Read, sum.Imported, verb, sum.Skipped, sum.Invalid)
+	return sum, failed
+}
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	buf := make([]byte, 1<<20)
+	for {
+		k, err := f.Read(buf)
+		n += bytes.Count(buf[:k], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// dlq works the service's dead-letter queue:
+//
+//	dtmsctl dlq list [-origin O] [-reason invalid|persist] [-limit N]
+//	dtmsctl dlq show ID
+//	dtmsctl dlq fix ID [-f FILE]       new payload from FILE or stdin
+//	dtmsctl dlq replay ID... | -all [-origin O] [-reason R]
+//	dtmsctl dlq discard ID...
+func dlq(args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+	ctx := context.Background()
+	c := newClient()
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		fs := flag.NewFlagSet("dlq list", flag.ExitOnError)
+		origin := fs.String("origin", "", "only events from this origin (kafka, webhook:rclone, ...)")
+		reason := fs.String("reason", "", "only invalid or persist failures")
+		limit := fs.Int("limit", 100, "at most this many, newest first")
+		fs.Parse(args)
+		list, err := c.DeadLetters(ctx, *origin, *reason, *limit)
+		if err != nil {
+			return err
+		}
+		for _, d := range list {
+			at := time.Unix(int64(d.Time), 0).UTC().Format(time.RFC3339)
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", d.ID, at, d.Origin, d.Reason, d.Error)
+		}
+		return nil
+	case "show":
+		if len(args) != 1 {
+			usage()
+		}
+		d, err := c.DeadLetter(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case "fix":
+		fs := flag.NewFlagSet("dlq fix", flag.ExitOnError)
+		file := fs.String("f", "", "read the corrected payload from this file (default stdin)")
+		if len(args) == 0 {
+			usage()
+		}
+		id := args[0]
+		fs.Parse(args[1:])
+		var (
+			raw []byte
+			err error
+		)
+		if *file != "" {
+			raw, err = os.ReadFile(*file)
+		} else {
+			raw, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+		if !json.Valid(raw) {
+			return fmt.Errorf("the payload is not valid JSON")
+		}
+		_, err = c.FixDeadLetter(ctx, id, raw)
+		return err
+	case "replay":
+		fs := flag.NewFlagSet("dlq replay", flag.ExitOnError)
+		all := fs.Bool("all", false, "replay every entry matching -origin and -reason")
+		origin := fs.String("origin", "", "with -all, only events from this origin")
+		reason := fs.String("reason", "", "with -all, only invalid or persist failures")
+		fs.Parse(args)
+		if *all {
+			n, failed, err := c.ReplayDeadLetters(ctx, *origin, *reason)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d ingested, %d failed\n", n, len(failed))
+			for _, d := range failed {
+				fmt.Printf("%s\t%s\n", d.ID, d.Error)
+			}
+			return nil
+		}
+		if fs.NArg() == 0 {
+			usage()
+		}
+		var failed int
+		for _, id := range fs.Args() {
+			if err := c.ReplayDeadLetter(ctx, id); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d replays failed", failed, fs.NArg())
+		}
+		return nil
+	case "discard":
+		for _, id := range args {
+			if err := c.DiscardDeadLetter(ctx, id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		return nil
+	}
+	usage()
+	return nil
+}
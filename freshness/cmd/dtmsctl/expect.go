@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/youruser/dtms-fresh/client"
+)
+
+// expect manages the schedules data is expected to arrive on:
+//
+//	dtmsctl expect list [-site S] [-missed]
+//	dtmsctl expect add [-dataset D] [-tz ZONE] [-grace D] SITE CRON
+//	dtmsctl expect remove ID
+//
+// CRON is a five-field expression, quoted as one argument ("0 3 * * *"),
+// or @daily and the like.
+func expect(args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+	ctx := context.Background()
+	c := newClient()
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		fs := flag.NewFlagSet("expect list", flag.ExitOnError)
+		site := fs.String("site", "", "only this site's schedules")
+		missed := fs.Bool("missed", false, "only schedules whose last arrival was missed")
+		fs.Parse(args)
+		list, err := c.ExpectedArrivals(ctx, *site, *missed)
+		if err != nil {
+			return err
+		}
+		for _, e := range list {
+			state := "ok"
+			if e.Missed {
+				state = "missed " + time.Unix(int64(e.MissedDue), 0).UTC().Format(time.RFC3339)
+			}
+			due := time.Unix(int64(e.Due), 0).UTC().Format(time.RFC3339)
+			fmt.Printf("%s\t%s\t%s\t%s\tdue %s\t%s\t%d/%d met\n", e.ID, e.Site, e.Dataset, e.Cron, due, state, e.Met, e.Met+e.Misses)
+		}
+		return nil
+	case "add":
+		fs := flag.NewFlagSet("expect add", flag.ExitOnError)
+		e := client.ExpectedArrival{Author: user}
+		fs.StringVar(&e.Dataset, "dataset", "", "only arrivals of this dataset count (any data when empty)")
+		fs.StringVar(&e.Timezone, "tz", "", "time zone of the schedule (default UTC)")
+		grace := fs.Duration("grace", 0, "how late an arrival may be (default the service's)")
+		fs.Parse(args)
+		if fs.NArg() != 2 {
+			usage()
+		}
+		e.Site, e.Cron = fs.Arg(0), strings.TrimSpace(fs.Arg(1))
+		e.GraceMinutes = int(grace.Minutes())
+		created, err := c.CreateExpectedArrival(ctx, e)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\tdue %s\n", created.ID, time.Unix(int64(created.Due), 0).UTC().Format(time.RFC3339))
+		return nil
+	case "remove":
+		if len(args) != 1 {
+			usage()
+		}
+		return c.DeleteExpectedArrival(ctx, args[0])
+	}
+	usage()
+	return nil
+}
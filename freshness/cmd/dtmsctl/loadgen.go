@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/segmentio/kafka-go"
+)
+
+// transferEvent mirrors the fields of the service's TransferEvent.
+type transferEvent struct {
+	ID        string  `json:"id"`
+	Site      string  `json:"site"`
+	Source    string  `json:"source,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Status    string  `json:"status"`
+	Reason    string  `json:"reason,omitempty"`
+	Dataset   string  `json:"dataset,omitempty"`
+	File      string  `json:"file,omitempty"`
+}
+
+var failureReasons = []string{
+	"checksum mismatch",
+	"connection reset by peer",
+	"permission denied",
+	"no space left on device",
+	"transfer timed out",
+}
+
+// parseRate reads "5000/s", "300/m" or a bare number per second.
+func parseRate(s string) (float64, error) {
+	num, unit, _ := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	switch unit {
+	case "", "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("bad rate unit in %q", s)
+}
+
+// eventGen makes plausible transfers: sizes are log-normal around 200 MB
+// at ~100 MB/s, a few percent fail, and traffic favours the busier sites.
+type eventGen struct {
+	rng    *rand.Rand
+	sites  int
+	failed float64
+	run    string
+	n      int64
+}
+
+func (g *eventGen) next(now time.Time) transferEvent {
+	g.n++
+	// Zipf-like skew: low-numbered sites see most of the traffic.
+	site := int(math.Pow(g.rng.Float64(), 2)*float64(g.sites)) + 1
+	src := g.rng.Intn(g.sites) + 1
+	size := int64(math.Exp(g.rng.NormFloat64()*1.2 + math.Log(200e6)))
+	ev := transferEvent{
+		ID:        fmt.Sprintf("loadgen-%s-%d", g.run, g.n),
+		Site:      fmt.Sprintf("SITE_%04d", site),
+		Source:    fmt.Sprintf("SITE_%04d", src),
+		Timestamp: float64(now.UnixNano()) / 1e9,
+		Bytes:     size,
+		Duration:  math.Max(0.1, float64(size)/100e6*(0.5+g.rng.Float64())),
+		Status:    "success",
+		Dataset:   fmt.Sprintf("/loadgen/run%03d/ds%04d", g.n/100000, g.rng.Intn(5000)),
+	}
+	ev.File = fmt.Sprintf("%s/file%06d.root", ev.Dataset, g.rng.Intn(1000000))
+	if g.rng.Float64() < g.failed {
+		ev.Status = "failed"
+		ev.Reason = failureReasons[g.rng.Intn(len(failureReasons))]
+	}
+	return ev
+}
+
+// compress encodes body for a Content-Encoding header.
+func compress(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "":
+		return body, nil
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	case "snappy":
+		w = snappy.NewBufferedWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown -encoding %q", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+// latencies collects per-request latencies from the senders.
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.d = append(l.d, d)
+	l.mu.Unlock()
+}
+
+func (l *latencies) percentiles() (p50, p90, p99, max time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.d) == 0 {
+		return
+	}
+	sort.Slice(l.d, func(i, j int) bool { return l.d[i] < l.d[j] })
+	at := func(q float64) time.Duration { return l.d[int(q*float64(len(l.d)-1))] }
+	return at(0.50), at(0.90), at(0.99), l.d[len(l.d)-1]
+}
+
+// simulate dispatches the simulate subcommands.
+func simulate(args []string) error {
+	if len(args) == 0 || args[0] != "transfers" {
+		return fmt.Errorf("usage: dtmsctl simulate transfers [flags]")
+	}
+	return simulateTransfers(args[1:])
+}
+
+func simulateTransfers(args []string) error {
+	fs := flag.NewFlagSet("simulate transfers", flag.ExitOnError)
+	rateFlag := fs.String("rate", "100/s", "events per second (n/s, n/m or n/h)")
+	sites := fs.Int("sites", 100, "number of destination sites")
+	duration := fs.Duration("duration", time.Minute, "how long to generate load")
+	target := fs.String("target", "http", "http (the /webhooks/dtms endpoint) or kafka")
+	batch := fs.Int("batch", 1, "events per request or Kafka write")
+	concurrency := fs.Int("concurrency", 32, "requests in flight")
+	failed := fs.Float64("failure-rate", 0.03, "share of failed transfers")
+	brokers := fs.String("brokers", envOr("KAFKA_BROKERS", "localhost:9092"), "Kafka brokers for -target kafka")
+	topic := fs.String("topic", envOr("KAFKA_TOPIC", "dtms.transfers"), "Kafka topic for -target kafka")
+	encoding := fs.String("encoding", "", "compress HTTP bodies with zstd, snappy or gzip")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	rate, err := parseRate(*rateFlag)
+	if err != nil {
+		return err
+	}
+	if *sites <= 0 || *batch <= 0 || *concurrency <= 0 {
+		return fmt.Errorf("-sites, -batch and -concurrency must be positive")
+	}
+
+	var send func(ctx context.Context, events []transferEvent) error
+	switch *target {
+	case "http":
+		token := envOr("WEBHOOK_TOKEN", apiToken)
+		hc := &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		}
+		var wire, plain atomic.Int64
+		defer func() {
+			if *encoding != "" && wire.Load() > 0 {
+				fmt.Printf("compression     %s, %.1fx (%d bytes sent for %d)\n", *encoding, float64(plain.Load())/float64(wire.Load()), wire.Load(), plain.Load())
+			}
+		}()
+		send = func(ctx context.Context, events []transferEvent) error {
+			raw, _ := json.Marshal(events)
+			plain.Add(int64(len(raw)))
+			if raw, err = compress(*encoding, raw); err != nil {
+				return err
+			}
+			wire.Add(int64(len(raw)))
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/webhooks/dtms", bytes.NewReader(raw))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if *encoding != "" {
+				req.Header.Set("Content-Encoding", *encoding)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := hc.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("%s", resp.Status)
+			}
+			return nil
+		}
+	case "kafka":
+		w := &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(*brokers, ",")...),
+			Topic:        *topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    *batch,
+			BatchTimeout: 5 * time.Millisecond,
+			RequiredAcks: kafka.RequireOne,
+		}
+		defer w.Close()
+		send = func(ctx context.Context, events []transferEvent) error {
+			msgs := make([]kafka.Message, len(events))
+			for i, ev := range events {
+				raw, _ := json.Marshal(ev)
+				msgs[i] = kafka.Message{Key: []byte(ev.Site), Value: raw}
+			}
+			return w.WriteMessages(ctx, msgs...)
+		}
+	default:
+		return fmt.Errorf("unknown -target %q", *target)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	gen := &eventGen{rng: rand.New(rand.NewSource(*seed)), sites: *sites, failed: *failed, run: strconv.FormatInt(time.Now().Unix(), 36)}
+	batches := make(chan []transferEvent, *concurrency)
+	var sent, errs atomic.Int64
+	lat := &latencies{}
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				start := time.Now()
+				if err := send(context.Background(), b); err != nil {
+					if errs.Add(1) == 1 {
+						fmt.Fprintf(os.Stderr, "dtmsctl: first error: %v\n", err)
+					}
+					continue
+				}
+				lat.add(time.Since(start))
+				sent.Add(int64(len(b)))
+			}
+		}()
+	}
+
+	fmt.Printf("generating %.0f events/s for %d sites against %s for %s\n", rate, *sites, *target, *duration)
+	start := time.Now()
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+	generated := 0
+	backlogged := 0
+loop:
+	for {
+		// Emit whole batches as the schedule falls due, so the offered
+		// rate holds even when individual requests are slow.
+		due := int(time.Since(start).Seconds()*rate) - generated
+		for due >= *batch {
+			b := make([]transferEvent, *batch)
+			now := time.Now()
+			for i := range b {
+				b[i] = gen.next(now)
+			}
+			select {
+			case batches <- b:
+			default:
+				// every sender is busy; the backend is not keeping up
+				backlogged += len(b)
+			}
+			generated += len(b)
+			due -= len(b)
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-report.C:
+			el := time.Since(start).Seconds()
+			fmt.Printf("%6.0fs  sent %d (%.0f/s)  errors %d  dropped %d\n", el, sent.Load(), float64(sent.Load())/el, errs.Load(), backlogged)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	el := time.Since(start).Seconds()
+	p50, p90, p99, max := lat.percentiles()
+	fmt.Printf("\nevents sent     %d in %.1fs (%.0f/s, target %.0f/s)\n", sent.Load(), el, float64(sent.Load())/el, rate)
+	fmt.Printf("request errors  %d\n", errs.Load())
+	fmt.Printf("not sent        %d (senders saturated; raise -concurrency or -batch)\n", backlogged)
+	fmt.Printf("latency         p50 %s  p90 %s  p99 %s  max %s\n", p50.Round(time.Microsecond), p90.Round(time.Microsecond), p99.Round(time.Microsecond), max.Round(time.Microsecond))
+	return nil
+}
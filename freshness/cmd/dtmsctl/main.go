@@ -0,0 +1,213 @@
+// dtmsctl is the operator command line for the DTMS freshness service.
+//
+//	dtmsctl annotate [-site S] [-start T] [-end T | -for D] [-tag T]... text...
+//	dtmsctl annotations [-site S] [-since D]
+//	dtmsctl unannotate ID
+//	dtmsctl simulate transfers [-rate 5000/s] [-sites 2000] [-duration D] [-target http|kafka]
+//	dtmsctl template test [-kind message|html|report] [-site S] [-event E] [-tenant T] [-period P] [-f FILE | template]
+//	dtmsctl dlq list|show|fix|replay|discard [flags] [ID...]
+//	dtmsctl backfill -kind transfers|samples [-format csv|jsonl] [-dry-run] FILE...
+//	dtmsctl agents list|approve|reject|forget [flags] [SITE]
+//	dtmsctl expect list|add|remove [flags] [SITE CRON | ID]
+//
+// Times are RFC 3339 and default to now; durations use Go syntax (2h30m).
+// DTMS_API_URL and API_TOKEN select the service as for dtms-worker.
+// simulate transfers is a load generator for sizing ingestion: it posts
+// synthetic transfer events to /webhooks/dtms (WEBHOOK_TOKEN) or writes
+// them to the Kafka topic and reports throughput and latency percentiles.
+// template test prints what a notification or report template renders to
+// against the service's live data; the template comes from -f, the
+// arguments, or stdin. dlq inspects, fixes and replays the events the
+// service dead-lettered (see dlq.go), and backfill imports transfer
+// events or freshness samples from an older system (see backfill.go).
+// agents approves or rejects the sites whose agents registered
+// themselves (see agents.go), and expect registers the schedules data is
+// expected to arrive on (see expect.go).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/youruser/dtms-fresh/client"
+)
+
+var (
+	apiURL   = envOr("DTMS_API_URL", "http://freshness:8004")
+	apiToken = envOr("API_TOKEN", "")
+	user     = envOr("USER", "")
+)
+
+func newClient() *client.Client {
+	c := client.New(apiURL)
+	c.Token = apiToken
+	c.UserAgent = "dtmsctl"
+	return c
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// listFlag collects a repeatable string flag.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dtmsctl annotate|annotations|unannotate|simulate|template|dlq|backfill|agents|expect [flags] [args]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "annotate":
+		err = annotate(args)
+	case "annotations":
+		err = listAnnotations(args)
+	case "unannotate":
+		if len(args) != 1 {
+			usage()
+		}
+		err = newClient().DeleteAnnotation(context.Background(), args[0])
+	case "simulate":
+		err = simulate(args)
+	case "template":
+		if len(args) == 0 || args[0] != "test" {
+			usage()
+		}
+		err = templateTest(args[1:])
+	case "dlq":
+		err = dlq(args)
+	case "backfill":
+		err = backfill(args)
+	case "agents":
+		err = agents(args)
+	case "expect":
+		err = expect(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dtmsctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func parseTime(s string) (float64, error) {
+	if s == "" {
+		return float64(time.Now().Unix()), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return float64(t.Unix()), err
+}
+
+func annotate(args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	site := fs.String("site", "", "site the note applies to (all sites when empty)")
+	start := fs.String("start", "", "start of the range, RFC 3339 (default now)")
+	end := fs.String("end", "", "end of the range, RFC 3339")
+	dur := fs.Duration("for", 0, "length of the range, instead of -end")
+	var tags listFlag
+	fs.Var(&tags, "tag", "tag, repeatable")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("annotation text is required")
+	}
+
+	a := client.Annotation{Site: *site, Text: strings.Join(fs.Args(), " "), Tags: tags, Author: user}
+	var err error
+	if a.Start, err = parseTime(*start); err != nil {
+		return err
+	}
+	switch {
+	case *end != "":
+		if a.End, err = parseTime(*end); err != nil {
+			return err
+		}
+	case *dur > 0:
+		a.End = a.Start + dur.Seconds()
+	}
+	created, err := newClient().CreateAnnotation(context.Background(), a)
+	if err != nil {
+		return err
+	}
+	fmt.Println(created.ID)
+	return nil
+}
+
+func listAnnotations(args []string) error {
+	fs := flag.NewFlagSet("annotations", flag.ExitOnError)
+	site := fs.String("site", "", "only annotations for this site")
+	since := fs.Duration("since", 7*24*time.Hour, "how far back to list")
+	fs.Parse(args)
+
+	now := time.Now()
+	list, err := newClient().Annotations(context.Background(), *site, now.Add(-*since), now)
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		span := time.Unix(int64(a.Start), 0).UTC().Format(time.RFC3339)
+		if a.End != 0 {
+			span += " – " + time.Unix(int64(a.End), 0).UTC().Format(time.RFC3339)
+		}
+		site := a.Site
+		if site == "" {
+			site = "*"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", a.ID, site, span, a.Text)
+	}
+	return nil
+}
+
+func templateTest(args []string) error {
+	fs := flag.NewFlagSet("template test", flag.ExitOnError)
+	var req client.TemplateRender
+	fs.StringVar(&req.Kind, "kind", "message", "message, html or report")
+	fs.StringVar(&req.Site, "site", "", "site to render a message for")
+	fs.StringVar(&req.Event, "event", "incident.opened", "event type to render a message for")
+	fs.StringVar(&req.Tenant, "tenant", "", "REPORTS_CONFIG tenant to render a report for")
+	fs.StringVar(&req.Period, "period", "", "weekly or monthly (default the configured period)")
+	file := fs.String("f", "", "read the template from this file")
+	fs.Parse(args)
+
+	switch {
+	case *file != "":
+		raw, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		req.Template = string(raw)
+	case fs.NArg() > 0:
+		req.Template = strings.Join(fs.Args(), " ")
+	default:
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.Template = string(raw)
+	}
+	out, err := newClient().RenderTemplate(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	if !strings.HasSuffix(out, "\n") {
+		fmt.Println()
+	}
+	return nil
+}
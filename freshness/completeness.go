@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Freshness says something arrived; completeness says everything did. A
+// manifest registers the files a dataset is expected to contain and the
+// sites it is expected at; successful transfer events naming the dataset
+// and file then tick files off per site. Each dataset is kept as one JSON
+// document under COMPLETENESS_DIR.
+var completenessDir = envOr("COMPLETENESS_DIR", filepath.Join(dataDir, "completeness"))
+
+var (
+	gaugeDatasetComplete = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_dataset_complete_ratio", Help: "Fraction of a dataset's manifest present at a site"},
+		[]string{"dataset", "site"},
+	)
+	gaugeDatasetMissing = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_dataset_missing_files", Help: "Manifest files not yet delivered to a site"},
+		[]string{"dataset", "site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeDatasetComplete, gaugeDatasetMissing)
+}
+
+type Manifest struct {
+	Dataset string   `json:"dataset"`
+	Sites   []string `json:"sites"`
+	Files   []string `json:"files"`
+	Created float64  `json:"created"`
+}
+
+// datasetState is the persisted form: the manifest plus, per site, the
+// arrival time of each file seen so far.
+type datasetState struct {
+	Manifest Manifest                      `json:"manifest"`
+	Present  map[string]map[string]float64 `json:"present"`
+
+	expected map[string]bool
+	dirty    bool
+}
+
+type SiteCompleteness struct {
+	Dataset  string   `json:"dataset"`
+	Site     string   `json:"site"`
+	Expected int      `json:"expected"`
+	Present  int      `json:"present"`
+	Missing  int      `json:"missing"`
+	Percent  float64  `json:"percent"`
+	Files    []string `json:"missing_files,omitempty"`
+}
+
+type completenessStore struct {
+	mu       sync.Mutex
+	dir      string
+	datasets map[string]*datasetState
+}
+
+var completeness = &completenessStore{dir: completenessDir, datasets: map[string]*datasetState{}}
+
+func (c *completenessStore) file(dataset string) string {
+	f := fnv.New32a()
+	f.Write([]byte(dataset))
+	name := fmt.Sprintf("%s-%08x.json", unsafeFileChars.ReplaceAllString(dataset, "_"), f.Sum32())
+	return filepath.Join(c.dir, name)
+}
+
+func (s *datasetState) index() {
+	s.expected = make(map[string]bool, len(s.Manifest.Files))
+	for _, f := range s.Manifest.Files {
+		s.expected[f] = true
+	}
+	if s.Present == nil {
+		s.Present = map[string]map[string]float64{}
+	}
+}
+
+// Load reads every persisted dataset.
+func (c *completenessStore) Load() error {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var s datasetState
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		s.index()
+		c.datasets[s.Manifest.Dataset] = &s
+		c.publish(&s)
+	}
+	return nil
+}
+
+// Register creates or replaces a manifest. Arrivals already recorded for
+// files still in the manifest are kept.
+func (c *completenessStore) Register(m Manifest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &datasetState{Manifest: m}
+	if old, ok := c.datasets[m.Dataset]; ok {
+		s.Present = old.Present
+		for _, site := range old.Manifest.Sites {
+			gaugeDatasetComplete.DeleteLabelValues(m.Dataset, site)
+			gaugeDatasetMissing.DeleteLabelValues(m.Dataset, site)
+		}
+	}
+	s.index()
+	s.Manifest.Files = s.Manifest.Files[:0]
+	for f := range s.expected {
+		s.Manifest.Files = append(s.Manifest.Files, f)
+	}
+	sort.Strings(s.Manifest.Files)
+	for site, files := range s.Present {
+		for f := range files {
+			if !s.expected[f] {
+				delete(files, f)
+			}
+		}
+		if len(files) == 0 {
+			delete(s.Present, site)
+		}
+	}
+	c.datasets[m.Dataset] = s
+	c.publish(s)
+	return c.save(s)
+}
+
+func (c *completenessStore) Delete(dataset string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.datasets[dataset]
+	if !ok {
+		return os.ErrNotExist
+	}
+	for _, site := range s.Manifest.Sites {
+		gaugeDatasetComplete.DeleteLabelValues(dataset, site)
+		gaugeDatasetMissing.DeleteLabelValues(dataset, site)
+	}
+	delete(c.datasets, dataset)
+	return os.Remove(c.file(dataset))
+}
+
+// Created returns the creation time registered with dataset's manifest.
+func (c *completenessStore) Created(dataset string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.datasets[dataset]
+	if !ok {
+		return 0, false
+	}
+	return s.Manifest.Created, true
+}
+
+// Observe ticks off the event's file at its destination.
+func (c *completenessStore) Observe(ev TransferEvent) {
+	if ev.Status != "success" || ev.Dataset == "" || ev.File == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.datasets[ev.Dataset]
+	if !ok || !s.expected[ev.File] {
+		return
+	}
+	files := s.Present[ev.Site]
+	if files == nil {
+		files = map[string]float64{}
+		s.Present[ev.Site] = files
+	}
+	if _, seen := files[ev.File]; seen {
+		return
+	}
+	files[ev.File] = ev.Timestamp
+	s.dirty = true
+	c.publish(s)
+}
+
+// report summarises one dataset at one site, listing up to limit missing
+// files.
+func (s *datasetState) report(site string, limit int) SiteCompleteness {
+	present := s.Present[site]
+	r := SiteCompleteness{Dataset: s.Manifest.Dataset, Site: site, Expected: len(s.Manifest.Files), Present: len(present)}
+	r.Missing = r.Expected - r.Present
+	r.Percent = 100
+	if r.Expected > 0 {
+		r.Percent = 100 * float64(r.Present) / float64(r.Expected)
+	}
+	for _, f := range s.Manifest.Files {
+		if len(r.Files) >= limit {
+			break
+		}
+		if _, ok := present[f]; !ok {
+			r.Files = append(r.Files, f)
+		}
+	}
+	return r
+}
+
+func (c *completenessStore) publish(s *datasetState) {
+	for _, site := range s.Manifest.Sites {
+		r := s.report(site, 0)
+		gaugeDatasetComplete.WithLabelValues(r.Dataset, site).Set(r.Percent / 100)
+		gaugeDatasetMissing.WithLabelValues(r.Dataset, site).Set(float64(r.Missing))
+	}
+}
+
+// Report returns completeness for dataset (all when empty), optionally for
+// one site.
+func (c *completenessStore) Report(dataset, site string, limit int) []SiteCompleteness {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := []SiteCompleteness{}
+	for name, s := range c.datasets {
+		if dataset != "" && name != dataset {
+			continue
+		}
+		for _, st := range s.Manifest.Sites {
+			if site == "" || st == site {
+				out = append(out, s.report(st, limit))
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Dataset != out[j].Dataset {
+			return out[i].Dataset < out[j].Dataset
+		}
+		return out[i].Site < out[j].Site
+	})
+	return out
+}
+
+func (c *completenessStore) save(s *datasetState) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.file(s.Manifest.Dataset), raw); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// flushLoop persists arrivals in batches rather than on every event.
+func (c *completenessStore) flushLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		for _, s := range c.datasets {
+			if s.dirty {
+				if err := c.save(s); err != nil {
+					fmt.Printf("[completeness] save %s: %v\n", s.Manifest.Dataset, err)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handleManifests serves POST /api/v1/manifests (register or replace) and
+// DELETE /api/v1/manifests?dataset=.
+func handleManifests(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var m Manifest
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.Dataset == "" || len(m.Sites) == 0 || len(m.Files) == 0 {
+			http.Error(w, "dataset, sites and files are required", http.StatusBadRequest)
+			return
+		}
+		if m.Created == 0 {
+			m.Created = float64(time.Now().Unix())
+		}
+		if err := completeness.Register(m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, completeness.Report(m.Dataset, "", 0))
+	case http.MethodDelete:
+		err := completeness.Delete(r.URL.Query().Get("dataset"))
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "unknown dataset", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCompleteness serves GET /api/v1/completeness?dataset=&site=&missing=N,
+// where missing caps how many missing file names are listed.
+func handleCompleteness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"datasets": completeness.Report(q.Get("dataset"), q.Get("site"), queryInt(r, "missing", 0)),
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Webhook bodies may be sent with Content-Encoding zstd, snappy (the framed
+// stream format) or gzip, and export downloads are compressed with
+// whichever of those the Accept-Encoding header prefers. Remote agents on
+// slow links should use zstd, which shrinks batches of transfer events by
+// five to ten times. WEBHOOK_MAX_BYTES still limits what is sent on the
+// wire, and WEBHOOK_MAX_DECODED_BYTES what a compressed body may expand to.
+var webhookMaxDecodedBytes = int64(envOrInt("WEBHOOK_MAX_DECODED_BYTES", 32<<20))
+
+// contentEncodings in order of preference when a client accepts several
+// equally.
+var contentEncodings = []string{"zstd", "snappy", "gzip"}
+
+// errUnsupportedEncoding answers with 415.
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// decodeBody decompresses body as declared by the request's
+// Content-Encoding, reading at most limit decoded bytes; more than that is
+// an error.
+func decodeBody(r *http.Request, body []byte, limit int64) ([]byte, error) {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	var zr io.Reader
+	switch enc {
+	case "", "identity":
+		return body, nil
+	case "zstd":
+		d, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		zr = d
+	case "snappy", "x-snappy-framed":
+		zr = snappy.NewReader(bytes.NewReader(body))
+	case "gzip", "x-gzip":
+		g, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		zr = g
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, enc)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s body: %w", enc, err)
+	}
+	if int64(len(out)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	return out, nil
+}
+
+// negotiateEncoding picks the response encoding from Accept-Encoding, or
+// "" for none.
+func negotiateEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(name)] = q
+	}
+	for _, enc := range contentEncodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressResponse wraps w in the encoding the client prefers. The caller
+// must Close the returned writer to flush it.
+func compressResponse(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+	w.Header().Add("Vary", "Accept-Encoding")
+	enc := negotiateEncoding(r)
+	if enc == "" {
+		return nopWriteCloser{w}
+	}
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Del("Content-Length")
+	switch enc {
+	case "zstd":
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err == nil {
+			return zw
+		}
+		w.Header().Del("Content-Encoding")
+		return nopWriteCloser{w}
+	case "snappy":
+		return snappy.NewBufferedWriter(w)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
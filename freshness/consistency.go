@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// The catalog is every file DTMS believes is at a site: successful
+// transfer events naming a file add it, deletion events remove the file or,
+// without one, the whole dataset. Files are keyed by their path relative
+// to the site's storage root, which is what events should carry in file.
+//
+// CONSISTENCY_CONFIG lists how to enumerate each site's storage:
+//
+//	interval: 6h
+//	grace: 1h
+//	sites:
+//	  SITE_A: {type: local, root: /mnt/dtms}
+//	  SITE_B: {type: s3, bucket: dtms, prefix: site-b/}
+//	  SITE_C: {type: command, command: [rclone, lsf, -R, --files-only, site-c:dtms]}
+//
+// Each run reports dark data (on storage, not in the catalog) and lost
+// files (in the catalog, not on storage). Anything younger than grace is
+// ignored on both sides so transfers in flight don't show up as either.
+var (
+	consistencyConfigPath = envOr("CONSISTENCY_CONFIG", "")
+	catalogPath           = envOr("CATALOG_FILE", filepath.Join(dataDir, "catalog.json"))
+)
+
+var (
+	gaugeDarkFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_consistency_dark_files", Help: "Files on storage that the catalog does not know about"},
+		[]string{"site"},
+	)
+	gaugeDarkBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_consistency_dark_bytes", Help: "Bytes of dark data, where the lister reports sizes"},
+		[]string{"site"},
+	)
+	gaugeLostFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_consistency_lost_files", Help: "Catalogued files missing from storage"},
+		[]string{"site"},
+	)
+	gaugeConsistencyChecked = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_consistency_last_check_timestamp_seconds", Help: "When the site's storage was last compared with the catalog"},
+		[]string{"site"},
+	)
+	consistencyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_consistency_check_errors_total", Help: "Storage listings that failed"},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeDarkFiles, gaugeDarkBytes, gaugeLostFiles, gaugeConsistencyChecked, consistencyErrors)
+}
+
+type catalogEntry struct {
+	Dataset string  `json:"dataset"`
+	Bytes   int64   `json:"bytes"`
+	Arrived float64 `json:"arrived"`
+}
+
+type fileCatalog struct {
+	mu    sync.Mutex
+	sites map[string]map[string]catalogEntry
+	dirty bool
+}
+
+var catalog = &fileCatalog{sites: map[string]map[string]catalogEntry{}}
+
+func catalogKey(file string) string {
+	return strings.TrimPrefix(filepath.ToSlash(file), "/")
+}
+
+func (c *fileCatalog) Load() error {
+	raw, err := os.ReadFile(catalogPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.Unmarshal(raw, &c.sites); err != nil {
+		return fmt.Errorf("%s: %w", catalogPath, err)
+	}
+	return nil
+}
+
+// Observe records the event's file at its destination, or removes it.
+func (c *fileCatalog) Observe(ev TransferEvent) {
+	if ev.Site == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := c.sites[ev.Site]
+	switch {
+	case ev.Status == "success" && ev.File != "":
+		if files == nil {
+			files = map[string]catalogEntry{}
+			c.sites[ev.Site] = files
+		}
+		files[catalogKey(ev.File)] = catalogEntry{Dataset: ev.Dataset, Bytes: ev.Bytes, Arrived: ev.Timestamp}
+	case ev.Status == eventDeleted && ev.File != "":
+		delete(files, catalogKey(ev.File))
+	case ev.Status == eventDeleted && ev.Dataset != "":
+		for k, e := range files {
+			if e.Dataset == ev.Dataset {
+				delete(files, k)
+			}
+		}
+	default:
+		return
+	}
+	c.dirty = true
+}
+
+// snapshot copies one site's catalog so a long listing doesn't hold the
+// lock.
+func (c *fileCatalog) snapshot(site string) map[string]catalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]catalogEntry, len(c.sites[site]))
+	for k, e := range c.sites[site] {
+		out[k] = e
+	}
+	return out
+}
+
+func (c *fileCatalog) flushLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if c.dirty {
+			raw, err := json.Marshal(c.sites)
+			if err == nil {
+				err = writeFileAtomic(catalogPath, raw)
+			}
+			if err != nil {
+				fmt.Printf("[catalog] save: %v\n", err)
+			} else {
+				c.dirty = false
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// storageObject is one listed file; a zero Modified means the lister
+// doesn't know it.
+type storageObject struct {
+	Path     string
+	Bytes    int64
+	Modified time.Time
+}
+
+type storageLister struct {
+	Type       string   `yaml:"type"`
+	Root       string   `yaml:"root"`
+	Bucket     string   `yaml:"bucket"`
+	Prefix     string   `yaml:"prefix"`
+	Command    []string `yaml:"command"`
+	s3Settings `yaml:",inline"`
+}
+
+func (l *storageLister) list(ctx context.Context) ([]storageObject, error) {
+	switch l.Type {
+	case "local":
+		return l.listLocal(ctx)
+	case "s3":
+		return l.listS3(ctx)
+	case "command":
+		return l.listCommand(ctx)
+	}
+	return nil, fmt.Errorf("unknown lister type %q", l.Type)
+}
+
+func (l *storageLister) listLocal(ctx context.Context) ([]storageObject, error) {
+	var out []storageObject
+	err := filepath.WalkDir(l.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(l.Root, p)
+		out = append(out, storageObject{Path: catalogKey(rel), Bytes: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	return out, err
+}
+
+func (l *storageLister) listS3(ctx context.Context) ([]storageObject, error) {
+	var out []storageObject
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {l.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var page s3ListResult
+		if err := l.s3Settings.get(ctx, l.Bucket, q, &page); err != nil {
+			return out, err
+		}
+		for _, o := range page.Contents {
+			out = append(out, storageObject{Path: catalogKey(strings.TrimPrefix(o.Key, l.Prefix)), Bytes: o.Size, Modified: o.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// listCommand runs a command printing one relative path per line.
+func (l *storageLister) listCommand(ctx context.Context) ([]storageObject, error) {
+	if len(l.Command) == 0 {
+		return nil, fmt.Errorf("command lister without a command")
+	}
+	cmd := exec.CommandContext(ctx, l.Command[0], l.Command[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var out []storageObject
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if p := strings.TrimSpace(sc.Text()); p != "" && !strings.HasSuffix(p, "/") {
+			out = append(out, storageObject{Path: catalogKey(p)})
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return out, err
+	}
+	return out, sc.Err()
+}
+
+// ConsistencyReport is the outcome of one site's last check. Dark and Lost
+// list a sample of paths; the counts are complete.
+type ConsistencyReport struct {
+	Site         string   `json:"site"`
+	Checked      float64  `json:"checked"`
+	Duration     float64  `json:"duration_seconds"`
+	StorageFiles int      `json:"storage_files"`
+	CatalogFiles int      `json:"catalog_files"`
+	DarkFiles    int      `json:"dark_files"`
+	DarkBytes    int64    `json:"dark_bytes"`
+	LostFiles    int      `json:"lost_files"`
+	Dark         []string `json:"dark,omitempty"`
+	Lost         []string `json:"lost,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// consistencySample caps the paths kept per report.
+const consistencySample = 1000
+
+type consistencyChecker struct {
+	Interval time.Duration             `yaml:"interval"`
+	Grace    time.Duration             `yaml:"grace"`
+	Sites    map[string]*storageLister `yaml:"sites"`
+
+	mu      sync.Mutex
+	reports map[string]ConsistencyReport
+}
+
+var consistency = &consistencyChecker{reports: map[string]ConsistencyReport{}}
+
+func loadConsistency() error {
+	if consistencyConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(consistencyConfigPath)
+	if err != nil {
+		return err
+	}
+	consistency.Interval, consistency.Grace = 6*time.Hour, time.Hour
+	consistency.Sites = map[string]*storageLister{}
+	if err := yamlenv.Unmarshal(raw, consistency); err != nil {
+		return fmt.Errorf("%s: %w", consistencyConfigPath, err)
+	}
+	for site, l := range consistency.Sites {
+		if l.Endpoint == "" {
+			l.s3Settings = s3SettingsFromEnv()
+		}
+		if l.Type == "" {
+			return fmt.Errorf("%s: site %s needs a lister type", consistencyConfigPath, site)
+		}
+	}
+	return nil
+}
+
+func (c *consistencyChecker) check(ctx context.Context, site string, l *storageLister) ConsistencyReport {
+	start := time.Now()
+	r := ConsistencyReport{Site: site, Checked: float64(start.Unix())}
+	cutoff := start.Add(-c.Grace)
+	objects, err := l.list(ctx)
+	r.Duration = time.Since(start).Seconds()
+	if err != nil {
+		consistencyErrors.WithLabelValues(site).Inc()
+		r.Error = err.Error()
+		return r
+	}
+	known := catalog.snapshot(site)
+	r.StorageFiles, r.CatalogFiles = len(objects), len(known)
+	listed := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		listed[o.Path] = true
+		if _, ok := known[o.Path]; ok || o.Modified.After(cutoff) {
+			continue
+		}
+		r.DarkFiles++
+		r.DarkBytes += o.Bytes
+		if len(r.Dark) < consistencySample {
+			r.Dark = append(r.Dark, o.Path)
+		}
+	}
+	for p, e := range known {
+		if listed[p] || e.Arrived > float64(cutoff.Unix()) {
+			continue
+		}
+		r.LostFiles++
+		if len(r.Lost) < consistencySample {
+			r.Lost = append(r.Lost, p)
+		}
+	}
+	sort.Strings(r.Dark)
+	sort.Strings(r.Lost)
+	return r
+}
+
+func (c *consistencyChecker) runOnce(ctx context.Context) {
+	for site, l := range c.Sites {
+		r := c.check(ctx, site, l)
+		if r.Error != "" {
+			fmt.Printf("[consistency] site=%s: %s\n", site, r.Error)
+		} else {
+			gaugeDarkFiles.WithLabelValues(site).Set(float64(r.DarkFiles))
+			gaugeDarkBytes.WithLabelValues(site).Set(float64(r.DarkBytes))
+			gaugeLostFiles.WithLabelValues(site).Set(float64(r.LostFiles))
+			gaugeConsistencyChecked.WithLabelValues(site).Set(r.Checked)
+			fmt.Printf("[consistency] site=%s storage=%d catalog=%d dark=%d lost=%d\n",
+				site, r.StorageFiles, r.CatalogFiles, r.DarkFiles, r.LostFiles)
+		}
+		c.mu.Lock()
+		c.reports[site] = r
+		c.mu.Unlock()
+	}
+}
+
+func (c *consistencyChecker) loop(ctx context.Context) {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		c.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleConsistency serves GET /api/v1/consistency?site=&limit=N, where
+// limit caps how many dark and lost paths are listed per site.
+func handleConsistency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	limit := queryInt(r, "limit", 100)
+	consistency.mu.Lock()
+	out := []ConsistencyReport{}
+	for s, rep := range consistency.reports {
+		if site != "" && s != site {
+			continue
+		}
+		if len(rep.Dark) > limit {
+			rep.Dark = rep.Dark[:limit]
+		}
+		if len(rep.Lost) > limit {
+			rep.Lost = rep.Lost[:limit]
+		}
+		out = append(out, rep)
+	}
+	consistency.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sites": out})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Several replicas of the service can run against one DATA_DIR (a
+// ReadWriteMany volume) when COORDINATION_DSN names a Postgres database.
+// One replica at a time is the leader: it holds a session advisory lock,
+// loads the state, polls, evaluates and runs every background job, so
+// none of them runs twice. The others wait as standbys, forwarding API
+// requests to the leader and serving their own /metrics, and the first to
+// get the lock after the leader goes away loads the state from disk and
+// takes over. The leader publishes its COORDINATION_ADVERTISE_URL in the
+// dtms_coordination table for the standbys to find it.
+//
+// A leader that cannot confirm its lock for COORDINATION_RENEW_SECONDS
+// exits rather than risk running next to its successor; restarted, it
+// comes back as a standby. Without COORDINATION_DSN the service runs
+// alone, as before.
+//
+// A standby passes the client's address on in Dtms-Client-Addr, which the
+// leader's login limiter uses in place of the standby's own address. The
+// header counts only next to Dtms-Replica-Token, derived from
+// COORDINATION_DSN, which only the replicas know.
+var (
+	coordinationDSN     = envOr("COORDINATION_DSN", "")
+	coordinationLock    = envOr("COORDINATION_LOCK", "dtms-freshness")
+	coordinationReplica = envOr("COORDINATION_REPLICA", hostnameOr("replica"))
+	coordinationURL     = envOr("COORDINATION_ADVERTISE_URL", "http://"+hostnameOr("localhost")+":"+port)
+	coordinationRenew   = time.Duration(envOrInt("COORDINATION_RENEW_SECONDS", 5)) * time.Second
+)
+
+var (
+	replicaRole = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_replica_role", Help: "1 for this replica's current coordination role (leader or standby)"},
+		[]string{"replica", "role"},
+	)
+	replicaProxied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_replica_proxied_requests_total", Help: "API requests a standby forwarded to the leader, by result"},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicaRole, replicaProxied)
+}
+
+const coordinationSchema = `CREATE TABLE IF NOT EXISTS dtms_coordination (
+	lock_name text PRIMARY KEY,
+	holder    text NOT NULL,
+	address   text NOT NULL,
+	acquired  timestamptz NOT NULL,
+	renewed   timestamptz NOT NULL
+)`
+
+func hostnameOr(def string) string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return def
+}
+
+func setReplicaRole(role string) {
+	for _, r := range []string{"leader", "standby"} {
+		replicaRole.WithLabelValues(coordinationReplica, r).Set(boolFloat(r == role))
+	}
+}
+
+// coordinationKey maps the lock name onto Postgres' advisory key space.
+func coordinationKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(coordinationLock))
+	return int64(h.Sum64())
+}
+
+// awaitLeadership returns once this replica leads, serving as a standby
+// on the service port until then. It returns at once without
+// COORDINATION_DSN.
+func awaitLeadership() error {
+	if coordinationDSN == "" {
+		setReplicaRole("leader")
+		return nil
+	}
+	db, err := sql.Open("postgres", coordinationDSN)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, coordinationSchema); err != nil {
+		return fmt.Errorf("coordination schema: %w", err)
+	}
+	setReplicaRole("standby")
+	standby := &http.Server{Addr: ":" + port, Handler: standbyHandler(db)}
+	go func() {
+		if err := serve(standby); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("[coordination] standby server: %v\n", err)
+		}
+	}()
+
+	key := coordinationKey()
+	var conn *sql.Conn
+	for waited := false; ; waited = true {
+		if conn, err = tryLock(ctx, db, key); err != nil {
+			fmt.Printf("[coordination] %v\n", err)
+		}
+		if conn != nil {
+			break
+		}
+		if !waited {
+			fmt.Printf("[coordination] %s is standing by for lock %q\n", coordinationReplica, coordinationLock)
+		}
+		time.Sleep(coordinationRenew)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	standby.Shutdown(shutdownCtx)
+	cancel()
+	if err := publishLeader(ctx, conn, true); err != nil {
+		return err
+	}
+	setReplicaRole("leader")
+	fmt.Printf("[coordination] %s leads as %s\n", coordinationReplica, coordinationURL)
+	go holdLeadership(conn)
+	return nil
+}
+
+// tryLock takes the advisory lock on a connection of its own, which must
+// stay open for as long as the lock is to be held. It returns nil while
+// another replica holds it.
+func tryLock(ctx context.Context, db *sql.DB, key int64) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func publishLeader(ctx context.Context, conn *sql.Conn, acquired bool) error {
+	q := `UPDATE dtms_coordination SET renewed = now() WHERE lock_name = $1 AND holder = $2 AND address = $3`
+	if acquired {
+		q = `INSERT INTO dtms_coordination (lock_name, holder, address, acquired, renewed)
+			VALUES ($1, $2, $3, now(), now())
+			ON CONFLICT (lock_name) DO UPDATE SET holder = $2, address = $3, acquired = now(), renewed = now()`
+	}
+	_, err := conn.ExecContext(ctx, q, coordinationLock, coordinationReplica, coordinationURL)
+	return err
+}
+
+// holdLeadership renews the leader's row on the lock's own connection,
+// which also proves the session, and with it the lock, is still alive.
+func holdLeadership(conn *sql.Conn) {
+	for {
+		time.Sleep(coordinationRenew)
+		ctx, cancel := context.WithTimeout(context.Background(), coordinationRenew)
+		err := publishLeader(ctx, conn, false)
+		cancel()
+		if err != nil {
+			fmt.Printf("[coordination] lost lock %q: %v; exiting\n", coordinationLock, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// standbyHandler serves a standby's /metrics and forwards everything
+// else to the leader of the moment.
+func standbyHandler(db *sql.DB) http.Handler {
+	var (
+		mu      sync.Mutex
+		proxies = map[string]*httputil.ReverseProxy{}
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var addr string
+		err := db.QueryRowContext(r.Context(), `SELECT address FROM dtms_coordination WHERE lock_name = $1 AND renewed > now() - $2 * interval '1 second'`,
+			coordinationLock, 3*coordinationRenew.Seconds()).Scan(&addr)
+		if err != nil {
+			replicaProxied.WithLabelValues("no_leader").Inc()
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "no leader available", http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		p, ok := proxies[addr]
+		if !ok {
+			target, err := url.Parse(addr)
+			if err != nil {
+				mu.Unlock()
+				replicaProxied.WithLabelValues("error").Inc()
+				http.Error(w, "bad leader address", http.StatusBadGateway)
+				return
+			}
+			p = leaderProxy(target)
+			proxies[addr] = p
+		}
+		mu.Unlock()
+		replicaProxied.WithLabelValues("forwarded").Inc()
+		p.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+const (
+	clientAddrHeader   = "Dtms-Client-Addr"
+	replicaTokenHeader = "Dtms-Replica-Token"
+)
+
+// replicaToken proves to the leader that a request comes from a standby.
+func replicaToken() string {
+	sum := sha256.Sum256([]byte("dtms-replica\x00" + coordinationDSN))
+	return hex.EncodeToString(sum[:])
+}
+
+// leaderProxy forwards a standby's requests to the leader at target,
+// telling it who the client is.
+func leaderProxy(target *url.URL) *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(target)
+	p.Transport = sharedTransport
+	direct := p.Director
+	p.Director = func(r *http.Request) {
+		direct(r)
+		r.Header.Set(clientAddrHeader, clientAddr(r))
+		r.Header.Set(replicaTokenHeader, replicaToken())
+	}
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		replicaProxied.WithLabelValues("error").Inc()
+		http.Error(w, "leader unreachable: "+err.Error(), http.StatusBadGateway)
+	}
+	return p
+}
+
+// clientAddr is the host r came from: the one a standby names when the
+// request came through one, the peer's otherwise.
+func clientAddr(r *http.Request) string {
+	if coordinationDSN != "" && r.Header.Get(clientAddrHeader) != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(replicaTokenHeader)), []byte(replicaToken())) == 1 {
+		return r.Header.Get(clientAddrHeader)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The correlation job labels incidents with probable causes. It looks for
+// declared downtimes overlapping the incident and for perfSONAR anomalies
+// on links touching the site in the same span (starting
+// CORRELATION_LEAD_MINUTES early, since network trouble precedes the
+// staleness it causes): packet loss at or above CORRELATION_LOSS_RATIO, or
+// throughput below CORRELATION_THROUGHPUT_DROP of the link's usual level.
+// Each candidate gets a confidence in [0, 1]; the best one at or above
+// correlationMinConfidence becomes the incident's probable cause. Open
+// incidents are re-evaluated every run, resolved ones once more and then
+// left alone.
+var (
+	correlationLead          = time.Duration(envOrInt("CORRELATION_LEAD_MINUTES", 30)) * time.Minute
+	correlationLossRatio, _  = strconv.ParseFloat(envOr("CORRELATION_LOSS_RATIO", "0.01"), 64)
+	correlationThroughput, _ = strconv.ParseFloat(envOr("CORRELATION_THROUGHPUT_DROP", "0.5"), 64)
+	networkRetention         = time.Duration(envOrInt("CORRELATION_NETWORK_RETENTION_HOURS", 168)) * time.Hour
+)
+
+const (
+	causeDowntime            = "downtime"
+	causeNetwork             = "network"
+	causeUnknown             = "unknown"
+	correlationMinConfidence = 0.5
+)
+
+type incidentCause struct {
+	Category   string   `json:"category"`
+	Confidence float64  `json:"confidence"`
+	Evidence   []string `json:"evidence"`
+}
+
+type networkResult struct {
+	source, dest, kind string
+	value              float64
+	ts                 int64
+}
+
+// networkLog keeps recent perfSONAR results; the gauges only hold the
+// latest.
+type networkLog struct {
+	mu      sync.Mutex
+	results map[string][]networkResult
+}
+
+var networkResults = &networkLog{results: map[string][]networkResult{}}
+
+func (l *networkLog) record(source, dest, kind string, value float64, ts int64) {
+	k := source + "|" + dest + "|" + kind
+	cutoff := time.Now().Add(-networkRetention).Unix()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rs := l.results[k]
+	if n := len(rs); n > 0 && rs[n-1].ts == ts {
+		return
+	}
+	kept := rs[:0]
+	for _, r := range rs {
+		if r.ts >= cutoff {
+			kept = append(kept, r)
+		}
+	}
+	l.results[k] = append(kept, networkResult{source, dest, kind, value, ts})
+}
+
+// touching returns the results for links to or from site, per link.
+func (l *networkLog) touching(site string) map[string][]networkResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := map[string][]networkResult{}
+	for k, rs := range l.results {
+		if len(rs) > 0 && (rs[0].source == site || rs[0].dest == site) {
+			out[k] = append([]networkResult(nil), rs...)
+		}
+	}
+	return out
+}
+
+// span returns the incident's time range, up to now while it is open.
+func (inc Incident) span(now time.Time) (time.Time, time.Time) {
+	end := now
+	if inc.End > 0 {
+		end = unixTime(inc.End)
+	}
+	return unixTime(inc.Start), end
+}
+
+func downtimeCause(inc Incident, now time.Time) *incidentCause {
+	start, end := inc.span(now)
+	length := end.Sub(start)
+	var cause *incidentCause
+	for _, w := range downtimes.Overlapping(inc.Site, start.Add(-correlationLead), end) {
+		from, to := w.Start, w.End
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		coverage := 1.0
+		if length > 0 {
+			coverage = to.Sub(from).Seconds() / length.Seconds()
+		}
+		conf := 0.4 + 0.3*coverage
+		if strings.EqualFold(w.Severity, "OUTAGE") {
+			conf = 0.6 + 0.35*coverage
+		}
+		if cause == nil {
+			cause = &incidentCause{Category: causeDowntime}
+		}
+		if conf > cause.Confidence {
+			cause.Confidence = conf
+		}
+		cause.Evidence = append(cause.Evidence, fmt.Sprintf("%s downtime %s – %s covers %.0f%% of the incident: %s",
+			w.Severity, w.Start.UTC().Format(time.RFC3339), w.End.UTC().Format(time.RFC3339), 100*coverage, w.Description))
+	}
+	return cause
+}
+
+func networkCause(inc Incident, now time.Time) *incidentCause {
+	start, end := inc.span(now)
+	from := start.Add(-correlationLead).Unix()
+	var loss, drop, leads, inbound bool
+	var evidence []string
+	for _, rs := range networkResults.touching(inc.Site) {
+		var baseline float64
+		var n int
+		for _, r := range rs {
+			if r.ts < from {
+				baseline += r.value
+				n++
+			}
+		}
+		if n > 0 {
+			baseline /= float64(n)
+		}
+		for _, r := range rs {
+			if r.ts < from || r.ts > end.Unix() {
+				continue
+			}
+			var what string
+			switch {
+			case r.kind == "packet-loss-rate" && r.value >= correlationLossRatio:
+				loss = true
+				what = fmt.Sprintf("%.1f%% packet loss", 100*r.value)
+			case r.kind == "throughput" && n >= 3 && r.value < correlationThroughput*baseline:
+				drop = true
+				what = fmt.Sprintf("throughput %.0f Mbit/s against a usual %.0f Mbit/s", r.value/1e6, baseline/1e6)
+			default:
+				continue
+			}
+			if r.ts <= start.Unix() {
+				leads = true
+			}
+			if r.dest == inc.Site {
+				inbound = true
+			}
+			evidence = append(evidence, fmt.Sprintf("%s->%s at %s: %s", r.source, r.dest, time.Unix(r.ts, 0).UTC().Format(time.RFC3339), what))
+		}
+	}
+	if len(evidence) == 0 {
+		return nil
+	}
+	conf := 0.0
+	switch {
+	case loss && drop:
+		conf = 0.7
+	case loss, drop:
+		conf = 0.5
+	}
+	if leads {
+		conf += 0.15
+	}
+	if inbound {
+		conf += 0.1
+	}
+	if conf > 0.95 {
+		conf = 0.95
+	}
+	sort.Strings(evidence)
+	return &incidentCause{Category: causeNetwork, Confidence: conf, Evidence: evidence}
+}
+
+// correlate scores every candidate cause for inc, most likely first.
+func correlate(inc Incident, now time.Time) []incidentCause {
+	var out []incidentCause
+	for _, c := range []*incidentCause{downtimeCause(inc, now), networkCause(inc, now)} {
+		if c != nil {
+			c.Confidence = float64(int(c.Confidence*100)) / 100
+			out = append(out, *c)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Confidence > out[j].Confidence })
+	return out
+}
+
+func correlationLoop(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		for _, inc := range incidents.uncorrelated() {
+			causes := correlate(inc, now)
+			incidents.SetCauses(inc.ID, causes, inc.Status == incidentResolved)
+			if inc.Status == incidentResolved && len(causes) > 0 {
+				fmt.Printf("[correlation] %s site=%s: %s (%.2f)\n", inc.ID, inc.Site, causes[0].Category, causes[0].Confidence)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Fields take *, numbers, ranges (1-5), steps (*/15, 0-30/10) and lists of
+// those; months and weekdays also take names (JAN, MON), and 7 is Sunday
+// as 0 is. When both day fields are restricted a day matching either one
+// matches, as in cron. @hourly, @daily (@midnight), @weekly, @monthly and
+// @yearly (@annually) stand for their usual expressions. Times are wall
+// clock in the schedule's location: one skipped when the clocks go
+// forward does not occur that day, and one repeated when they go back
+// occurs only the first time.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths   = []string{"", "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+// cronHorizon bounds the search for an expression that never matches, such
+// as 30 February.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	s := strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[strings.ToLower(s)]; ok {
+		s = d
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", expr, len(fields))
+	}
+	c := &cronSchedule{loc: loc, domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for i, f := range []struct {
+		name     string
+		dst      *uint64
+		min, max int
+		names    []string
+	}{
+		{"minute", &c.minute, 0, 59, nil},
+		{"hour", &c.hour, 0, 23, nil},
+		{"day of month", &c.dom, 1, 31, nil},
+		{"month", &c.month, 1, 12, cronMonths},
+		{"day of week", &c.dow, 0, 7, cronWeekdays},
+	} {
+		if *f.dst, err = parseCronField(fields[i], f.min, f.max, f.names); err != nil {
+			return nil, fmt.Errorf("cron %q: %s: %w", expr, f.name, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(from, min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(to, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, n := range names {
+		if n != "" && strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("%d is outside %d-%d", v, min, max)
+	}
+	return v, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule matches, or the zero
+// time if it matches none within cronHorizon.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronHorizon)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = cronHourAfter(t, t.Year(), t.Month()+1, 1, 0)
+		case !c.dayMatches(t):
+			t = cronHourAfter(t, t.Year(), t.Month(), t.Day()+1, 0)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = cronHourAfter(t, t.Year(), t.Month(), t.Day(), t.Hour()+1)
+		case c.minute&(1<<uint(t.Minute())) == 0, repeatedWallClock(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronHourAfter returns the start of the wall-clock hour given, in t's
+// location. time.Date may resolve an hour the clocks repeat to its
+// second pass, so the first is taken, and one they skip to before t, so
+// that is moved on by the hour skipped.
+func cronHourAfter(t time.Time, y int, mo time.Month, d, h int) time.Time {
+	n := firstWallClock(time.Date(y, mo, d, h, 0, 0, 0, t.Location()))
+	if !n.After(t) {
+		n = n.Add(time.Hour)
+	}
+	return n
+}
+
+// firstWallClock returns the first time t's wall-clock time went by:
+// earlier than t when it comes round again after the clocks went back.
+func firstWallClock(t time.Time) time.Time {
+	_, off := t.Zone()
+	_, before := t.Add(-24 * time.Hour).Zone()
+	if before <= off {
+		return t
+	}
+	u := t.Add(-time.Duration(before-off) * time.Second)
+	if u.Day() == t.Day() && u.Hour() == t.Hour() && u.Minute() == t.Minute() {
+		return u
+	}
+	return t
+}
+
+// repeatedWallClock reports whether t's wall-clock time already went by
+// once today, before the clocks went back.
+func repeatedWallClock(t time.Time) bool {
+	return firstWallClock(t).Before(t)
+}
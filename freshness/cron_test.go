@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"1,x * * * *",
+		"* * * FOO *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		name, expr string
+		loc        *time.Location
+		from       time.Time
+		want       time.Time // zero for never
+	}{
+		{"daily", "0 3 * * *", time.UTC, utc("2024-01-01T02:59:30Z"), utc("2024-01-01T03:00:00Z")},
+		{"strictly after", "0 3 * * *", time.UTC, utc("2024-01-01T03:00:00Z"), utc("2024-01-02T03:00:00Z")},
+		{"step", "*/15 * * * *", time.UTC, utc("2024-01-01T10:07:00Z"), utc("2024-01-01T10:15:00Z")},
+		{"range step", "0-30/10 * * * *", time.UTC, utc("2024-01-01T10:31:00Z"), utc("2024-01-01T11:00:00Z")},
+		{"monthly", "@monthly", time.UTC, utc("2024-01-31T12:00:00Z"), utc("2024-02-01T00:00:00Z")},
+		{"weekdays by name", "0 9 * * MON-FRI", time.UTC, utc("2024-03-01T10:00:00Z"), utc("2024-03-04T09:00:00Z")},
+		{"Sunday as 7", "0 0 * * 7", time.UTC, utc("2024-03-04T00:00:00Z"), utc("2024-03-10T00:00:00Z")},
+		{"either day field", "0 0 13 * FRI", time.UTC, utc("2024-09-01T00:00:00Z"), utc("2024-09-06T00:00:00Z")},
+		{"leap day", "0 0 29 2 *", time.UTC, utc("2024-03-01T00:00:00Z"), utc("2028-02-29T00:00:00Z")},
+		{"30 February", "0 0 30 2 *", time.UTC, utc("2024-01-01T00:00:00Z"), time.Time{}},
+		{"31 April", "0 0 31 APR *", time.UTC, utc("2024-01-01T00:00:00Z"), time.Time{}},
+		{"in the schedule's zone", "0 3 * * *", zurich, utc("2024-01-01T00:00:00Z"), utc("2024-01-01T02:00:00Z")},
+		{"summer offset", "0 3 * * *", zurich, utc("2024-07-01T00:00:00Z"), utc("2024-07-01T01:00:00Z")},
+
+		// clocks go forward at 02:00 on 31 March 2024 in Zurich
+		{"skipped time does not occur", "30 2 * * *", zurich, utc("2024-03-30T02:00:00Z"), utc("2024-04-01T00:30:00Z")},
+		{"hourly across the gap", "0 * * * *", zurich, utc("2024-03-31T00:30:00Z"), utc("2024-03-31T01:00:00Z")}, // 03:00 CEST
+		{"after the gap", "0 3 * * *", zurich, utc("2024-03-30T23:00:00Z"), utc("2024-03-31T01:00:00Z")},
+		{"skipped in New York", "0 2 * * *", ny, utc("2024-03-10T05:00:00Z"), utc("2024-03-11T06:00:00Z")},
+
+		// and back at 03:00 CEST, to 02:00 CET, on 27 October 2024
+		{"repeated time occurs once", "30 2 * * *", zurich, utc("2024-10-26T12:00:00Z"), utc("2024-10-27T00:30:00Z")},
+		{"not again an hour later", "30 2 * * *", zurich, utc("2024-10-27T00:30:00Z"), utc("2024-10-28T01:30:00Z")},
+		{"hourly skips the repeat", "0 * * * *", zurich, utc("2024-10-27T00:00:00Z"), utc("2024-10-27T02:00:00Z")}, // 03:00 CET
+		{"every minute in the repeat", "* * * * *", zurich, utc("2024-10-27T00:59:00Z"), utc("2024-10-27T02:00:00Z")},
+		{"repeated in New York", "30 1 * * *", ny, utc("2024-11-03T05:30:00Z"), utc("2024-11-04T06:30:00Z")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseCron(tc.expr, tc.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.next(tc.from); !got.Equal(tc.want) {
+				t.Errorf("next(%s) = %s, want %s", tc.from.In(tc.loc), got, tc.want.In(tc.loc))
+			}
+		})
+	}
+}
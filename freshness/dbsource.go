@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// DB_TARGETS lists replicas separated by ';' as site=DSN. DSNs starting
+// with postgres:// or postgresql:// use lib/pq; "mysql:" followed by a
+// go-sql-driver DSN (user:pass@tcp(host:3306)/) uses MySQL.
+var dbTargets = envOr("DB_TARGETS", "")
+
+var (
+	dbPoolsMu sync.Mutex
+	dbPools   = map[string]*sql.DB{}
+)
+
+// postgresReplayQuery treats a replica that has replayed everything it
+// received as current; otherwise it is as old as the last replayed commit.
+const postgresReplayQuery = `SELECT EXTRACT(EPOCH FROM CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN now()
+	ELSE pg_last_xact_replay_timestamp() END)`
+
+// dbSource's targets map sites to DSNs in the DB_TARGETS format.
+type dbSource struct {
+	name    string
+	Targets map[string]string `yaml:"targets"`
+}
+
+func init() {
+	registerSource("db-replica", func(name string, params *yaml.Node) (Source, error) {
+		s := &dbSource{name: name}
+		return s, params.Decode(s)
+	})
+}
+
+func dbFromEnv() *dbSource {
+	s := &dbSource{name: "db-replica", Targets: map[string]string{}}
+	for _, entry := range strings.Split(dbTargets, ";") {
+		if site, dsn, ok := strings.Cut(strings.TrimSpace(entry), "="); ok {
+			s.Targets[site] = dsn
+		}
+	}
+	return s
+}
+
+func (s *dbSource) Name() string { return s.name }
+
+func (s *dbSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	var out []SiteFresh
+	for site, dsn := range s.Targets {
+		var age float64
+		var err error
+		if mysqlDSN, isMySQL := strings.CutPrefix(dsn, "mysql:"); isMySQL {
+			age, err = mysqlReplicaLag(ctx, mysqlDSN)
+		} else {
+			age, err = postgresReplicaLag(ctx, dsn, now)
+		}
+		if err != nil {
+			fmt.Printf("[%s] site=%s: %v\n", s.name, site, err)
+			continue
+		}
+		out = append(out, SiteFresh{
+			Site:            site,
+			LatestTimestamp: float64(now.Unix()) - age,
+			AgeSeconds:      age,
+		})
+	}
+	return out, nil
+}
+
+func dbPool(driver, dsn string) (*sql.DB, error) {
+	dbPoolsMu.Lock()
+	defer dbPoolsMu.Unlock()
+	if db, ok := dbPools[dsn]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	dbPools[dsn] = db
+	return db, nil
+}
+
+func postgresReplicaLag(ctx context.Context, dsn string, now time.Time) (float64, error) {
+	db, err := dbPool("postgres", dsn)
+	if err != nil {
+		return 0, err
+	}
+	var replayed sql.NullFloat64
+	if err := db.QueryRowContext(ctx, postgresReplayQuery).Scan(&replayed); err != nil {
+		return 0, err
+	}
+	if !replayed.Valid {
+		return 0, errors.New("not a replica or nothing replayed yet")
+	}
+	return float64(now.UnixNano())/1e9 - replayed.Float64, nil
+}
+
+// mysqlReplicaLag reads Seconds_Behind_Source (8.0.22+) or the older
+// Seconds_Behind_Master column from the replica status row.
+func mysqlReplicaLag(ctx context.Context, dsn string) (float64, error) {
+	db, err := dbPool("mysql", dsn)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, errors.New("not a replica")
+	}
+	vals := make([]sql.RawBytes, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return 0, err
+	}
+	for i, c := range cols {
+		if c != "Seconds_Behind_Source" && c != "Seconds_Behind_Master" {
+			continue
+		}
+		if vals[i] == nil {
+			return 0, errors.New("replication is not running")
+		}
+		return strconv.ParseFloat(string(vals[i]), 64)
+	}
+	return 0, errors.New("no seconds-behind column in replica status")
+}
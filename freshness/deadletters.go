@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Events the ingestion pipeline cannot take end up in the dead-letter
+// queue, DEAD_LETTERS_FILE, with the payload as received, the origin and
+// the error: every event that fails validation, whatever its transport,
+// and those a transport gives up persisting (AMQP after
+// AMQP_MAX_REDELIVERIES). The broker-side DLQs (KAFKA_DLQ_TOPIC,
+// NATS_DLQ_SUBJECT, the AMQP dead-letter exchange) are still written; this
+// one is what operators work from. It keeps the newest DEAD_LETTERS_MAX
+// entries.
+//
+//	GET    /api/v1/dead-letters?origin=&reason=&limit=  list, newest first
+//	GET    /api/v1/dead-letters/{id}                    one entry
+//	PUT    /api/v1/dead-letters/{id}                    replace the payload (the body) to fix it
+//	POST   /api/v1/dead-letters/{id}/replay             ingest the payload again
+//	POST   /api/v1/dead-letters/replay?origin=&reason=  replay every matching entry
+//	DELETE /api/v1/dead-letters/{id}                    discard
+//
+// Replays read the payload as native TransferEvent JSON, so webhook
+// payloads in another format need fixing first. A replayed entry that is
+// ingested (or turns out to be a duplicate) is removed; one that fails
+// again stays with the new error. dtmsctl dlq wraps the API.
+var (
+	deadLettersFile = envOr("DEAD_LETTERS_FILE", filepath.Join(dataDir, "dead-letters.json"))
+	deadLettersMax  = envOrInt("DEAD_LETTERS_MAX", 10000)
+)
+
+// Reasons an event is dead-lettered.
+const (
+	deadLetterInvalid = "invalid"
+	deadLetterPersist = "persist"
+)
+
+type DeadLetter struct {
+	ID       string  `json:"id"`
+	Time     float64 `json:"time"`
+	Origin   string  `json:"origin"`
+	Reason   string  `json:"reason"`
+	Error    string  `json:"error"`
+	Payload  string  `json:"payload"`
+	Fixed    bool    `json:"fixed,omitempty"`
+	Replays  int     `json:"replays,omitempty"`
+	Replayed float64 `json:"last_replay,omitempty"`
+}
+
+var (
+	deadLetterEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_dead_letters_total", Help: "Ingestion events dead-lettered by origin and reason"},
+		[]string{"origin", "reason"},
+	)
+	deadLetterReplays = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_dead_letter_replays_total", Help: "Dead-lettered events replayed by result"},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deadLetterEvents, deadLetterReplays)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "dtms_dead_letters", Help: "Events waiting in the dead-letter queue"},
+		func() float64 { return float64(deadLetters.Len()) },
+	))
+}
+
+type deadLetterStore struct {
+	mu    sync.Mutex
+	path  string
+	max   int
+	items map[string]*DeadLetter
+	dirty bool
+}
+
+var deadLetters = &deadLetterStore{path: deadLettersFile, max: deadLettersMax, items: map[string]*DeadLetter{}}
+
+func (s *deadLetterStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*DeadLetter
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range list {
+		s.items[d.ID] = d
+	}
+	return nil
+}
+
+func (s *deadLetterStore) save() error {
+	list := s.sorted()
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// sorted returns the entries newest first.
+func (s *deadLetterStore) sorted() []*DeadLetter {
+	list := make([]*DeadLetter, 0, len(s.items))
+	for _, d := range s.items {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Time != list[j].Time {
+			return list[i].Time > list[j].Time
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list
+}
+
+func (s *deadLetterStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// Add records a failed event. It is saved by flushLoop, so a burst of bad
+// events does not rewrite the file for each one.
+func (s *deadLetterStore) Add(origin, reason string, payload []byte, cause error) DeadLetter {
+	id := make([]byte, 6)
+	rand.Read(id)
+	d := &DeadLetter{
+		ID:      "dl-" + hex.EncodeToString(id),
+		Time:    float64(time.Now().UnixNano()) / 1e9,
+		Origin:  origin,
+		Reason:  reason,
+		Error:   cause.Error(),
+		Payload: string(payload),
+	}
+	deadLetterEvents.WithLabelValues(origin, reason).Inc()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[d.ID] = d
+	if len(s.items) > s.max {
+		list := s.sorted()
+		for _, old := range list[s.max:] {
+			delete(s.items, old.ID)
+		}
+	}
+	s.dirty = true
+	return *d
+}
+
+// addEvent records an event that arrived already decoded.
+func (s *deadLetterStore) addEvent(origin, reason string, ev TransferEvent, cause error) DeadLetter {
+	payload, _ := json.Marshal(ev)
+	return s.Add(origin, reason, payload, cause)
+}
+
+func (s *deadLetterStore) Get(id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.items[id]
+	if !ok {
+		return DeadLetter{}, os.ErrNotExist
+	}
+	return *d, nil
+}
+
+// List returns the entries matching origin and reason (any when empty),
+// newest first, at most limit when positive.
+func (s *deadLetterStore) List(origin, reason string, limit int) []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []DeadLetter{}
+	for _, d := range s.sorted() {
+		if (origin == "" || d.Origin == origin) && (reason == "" || d.Reason == reason) {
+			out = append(out, *d)
+			if limit > 0 && len(out) == limit {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Fix replaces an entry's payload with a corrected one.
+func (s *deadLetterStore) Fix(id string, payload []byte) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.items[id]
+	if !ok {
+		return DeadLetter{}, os.ErrNotExist
+	}
+	d.Payload, d.Fixed = string(payload), true
+	return *d, s.save()
+}
+
+func (s *deadLetterStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.items, id)
+	return s.save()
+}
+
+// Replay ingests an entry's payload again under its original origin. The
+// entry is removed once the event is in, and otherwise keeps the new
+// error.
+func (s *deadLetterStore) Replay(id string) (DeadLetter, error) {
+	d, err := s.Get(id)
+	if err != nil {
+		return d, err
+	}
+	err = ingest.replay(d.Origin, []byte(d.Payload))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.items[id]
+	if !ok {
+		// discarded while replaying
+		return d, err
+	}
+	if err == nil {
+		deadLetterReplays.WithLabelValues("ingested").Inc()
+		delete(s.items, id)
+		return *cur, s.save()
+	}
+	deadLetterReplays.WithLabelValues("failed").Inc()
+	cur.Replays++
+	cur.Replayed = float64(time.Now().Unix())
+	cur.Error = err.Error()
+	if errors.Is(err, errInvalidEvent) {
+		cur.Reason = deadLetterInvalid
+	} else {
+		cur.Reason = deadLetterPersist
+	}
+	if serr := s.save(); serr != nil {
+		return *cur, serr
+	}
+	return *cur, err
+}
+
+// flushLoop saves entries added since the last save.
+func (s *deadLetterStore) flushLoop(ctx context.Context) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		if s.dirty {
+			if err := s.save(); err != nil {
+				fmt.Printf("[dead-letters] save: %v\n", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleDeadLetters serves GET /api/v1/dead-letters and
+// POST /api/v1/dead-letters/replay.
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/dead-letters":
+		list := deadLetters.List(q.Get("origin"), q.Get("reason"), queryInt(r, "limit", 0))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"dead_letters": list})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/dead-letters/replay":
+		result := struct {
+			Ingested int          `json:"ingested"`
+			Failed   []DeadLetter `json:"failed"`
+		}{Failed: []DeadLetter{}}
+		for _, d := range deadLetters.List(q.Get("origin"), q.Get("reason"), 0) {
+			d, err := deadLetters.Replay(d.ID)
+			switch {
+			case err == nil:
+				result.Ingested++
+			case !errors.Is(err, os.ErrNotExist):
+				result.Failed = append(result.Failed, d)
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeadLetter serves the single-entry calls.
+func handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/dead-letters/"), "/")
+	if id == "replay" && action == "" {
+		handleDeadLetters(w, r)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var (
+		d   DeadLetter
+		err error
+	)
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		d, err = deadLetters.Get(id)
+	case r.Method == http.MethodPut && action == "":
+		payload, rerr := io.ReadAll(http.MaxBytesReader(w, r.Body, 4<<20))
+		if rerr != nil {
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		d, err = deadLetters.Fix(id, payload)
+	case r.Method == http.MethodDelete && action == "":
+		if err = deadLetters.Delete(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case r.Method == http.MethodPost && action == "replay":
+		d, err = deadLetters.Replay(id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// the entry, with the new error, is the answer
+			writeJSON(w, http.StatusUnprocessableEntity, d)
+			return
+		}
+	case action == "" || action == "replay":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "no such dead letter", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, d)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Redeliveries are recognised by event ID for at least
+// INGEST_DEDUP_TTL_SECONDS (0 turns this off).
+// The first check is a rotating Bloom filter sized for
+// INGEST_DEDUP_CAPACITY IDs per TTL at INGEST_DEDUP_FP_RATE, so almost
+// every new event is cleared without touching the exact ID set. Only a
+// probable hit is confirmed against the exact set. With INGEST_DEDUP_EXACT
+// set to false the exact set is not kept at all and a probable hit is
+// taken as a duplicate, which bounds memory at the cost of dropping that
+// share of genuinely new events.
+var (
+	ingestDedupCapacity = envOrInt("INGEST_DEDUP_CAPACITY", 1000000)
+	ingestDedupFPRate   = envOrFloat("INGEST_DEDUP_FP_RATE", 0.001)
+	ingestDedupExact    = envOr("INGEST_DEDUP_EXACT", "true") == "true"
+)
+
+// dedupGenerations is how many filters are kept. A new one starts every
+// TTL/(dedupGenerations-1), so an ID stays visible for at least the TTL.
+const dedupGenerations = 4
+
+var dedupBloomHits = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_ingest_dedup_bloom_hits_total", Help: "Event IDs the Bloom filter flagged as seen, by whether the exact set confirmed it (confirmed, false_positive, unchecked)"},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(dedupBloomHits)
+}
+
+func envOrFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(envOr(key, ""), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+type bloomFilter struct {
+	bits []uint64
+	k    int
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	return &bloomFilter{bits: make([]uint64, (int(m)+63)/64), k: max(k, 1)}
+}
+
+// positions derives the k bit positions by double hashing.
+func (b *bloomFilter) positions(h1, h2 uint64, fn func(word int, mask uint64) bool) bool {
+	m := uint64(len(b.bits)) * 64
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(h1, h2 uint64) {
+	b.positions(h1, h2, func(w int, mask uint64) bool { b.bits[w] |= mask; return true })
+}
+
+func (b *bloomFilter) has(h1, h2 uint64) bool {
+	return b.positions(h1, h2, func(w int, mask uint64) bool { return b.bits[w]&mask != 0 })
+}
+
+type dedupGeneration struct {
+	started time.Time
+	bloom   *bloomFilter
+	ids     map[string]struct{}
+}
+
+// eventDedup remembers recent event IDs. It is not safe for concurrent
+// use; the ingestor calls it under its own lock.
+type eventDedup struct {
+	ttl          time.Duration
+	perGen       int
+	fpRate       float64
+	exact        bool
+	seed1, seed2 maphash.Seed
+	gens         []*dedupGeneration // oldest first
+}
+
+func newEventDedup(ttl time.Duration, capacity int, fpRate float64, exact bool) *eventDedup {
+	return &eventDedup{
+		ttl:    ttl,
+		perGen: capacity / (dedupGenerations - 1),
+		// a lookup consults every generation, so split the target rate
+		fpRate: fpRate / dedupGenerations,
+		exact:  exact,
+		seed1:  maphash.MakeSeed(),
+		seed2:  maphash.MakeSeed(),
+	}
+}
+
+// rotate starts a new generation when the newest one is old enough and
+// forgets those past the TTL.
+func (d *eventDedup) rotate(now time.Time) {
+	span := d.ttl / (dedupGenerations - 1)
+	for len(d.gens) > 0 && now.Sub(d.gens[0].started) >= d.ttl+span {
+		d.gens = d.gens[1:]
+	}
+	if n := len(d.gens); n == 0 || now.Sub(d.gens[n-1].started) >= span {
+		g := &dedupGeneration{started: now, bloom: newBloomFilter(d.perGen, d.fpRate)}
+		if d.exact {
+			g.ids = map[string]struct{}{}
+		}
+		d.gens = append(d.gens, g)
+	}
+	for len(d.gens) > dedupGenerations {
+		d.gens = d.gens[1:]
+	}
+}
+
+// Seen reports whether id was added within the TTL.
+func (d *eventDedup) Seen(id string, now time.Time) bool {
+	if d.ttl <= 0 {
+		return false
+	}
+	d.rotate(now)
+	h1, h2 := maphash.String(d.seed1, id), maphash.String(d.seed2, id)|1
+	probable := false
+	for _, g := range d.gens {
+		if g.bloom.has(h1, h2) {
+			probable = true
+			break
+		}
+	}
+	if !probable {
+		return false
+	}
+	if !d.exact {
+		dedupBloomHits.WithLabelValues("unchecked").Inc()
+		return true
+	}
+	for _, g := range d.gens {
+		if _, ok := g.ids[id]; ok {
+			dedupBloomHits.WithLabelValues("confirmed").Inc()
+			return true
+		}
+	}
+	dedupBloomHits.WithLabelValues("false_positive").Inc()
+	return false
+}
+
+// Add records id in the current generation.
+func (d *eventDedup) Add(id string, now time.Time) {
+	if d.ttl <= 0 {
+		return
+	}
+	d.rotate(now)
+	g := d.gens[len(d.gens)-1]
+	g.bloom.add(maphash.String(d.seed1, id), maphash.String(d.seed2, id)|1)
+	if d.exact {
+		g.ids[id] = struct{}{}
+	}
+}
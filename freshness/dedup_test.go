@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventDedupRotation(t *testing.T) {
+	const ttl = 30 * time.Minute // a generation every 10 minutes
+	t0 := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		name  string
+		ttl   time.Duration
+		exact bool
+		adds  []time.Duration
+		at    time.Duration
+		want  bool
+	}{
+		{"just added", ttl, true, []time.Duration{0}, 0, true},
+		{"within the ttl", ttl, true, []time.Duration{0}, 29 * time.Minute, true},
+		{"at the ttl", ttl, true, []time.Duration{0}, ttl, true},
+		{"at most a generation past the ttl", ttl, true, []time.Duration{0}, 39 * time.Minute, true},
+		{"forgotten after ttl plus a generation", ttl, true, []time.Duration{0}, 40 * time.Minute, false},
+		{"long gone", ttl, true, []time.Duration{0}, 24 * time.Hour, false},
+		{"added again", ttl, true, []time.Duration{0, 35 * time.Minute}, 60 * time.Minute, true},
+		{"added mid-generation", ttl, true, []time.Duration{5 * time.Minute}, 35 * time.Minute, true},
+		{"bloom only", ttl, false, []time.Duration{0}, 29 * time.Minute, true},
+		{"bloom only forgets too", ttl, false, []time.Duration{0}, 40 * time.Minute, false},
+		{"off", 0, true, []time.Duration{0}, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newEventDedup(tc.ttl, 1000, 0.001, tc.exact)
+			for _, at := range tc.adds {
+				d.Add("evt-1", t0.Add(at))
+			}
+			// walk the clock forward a minute at a time, as steady
+			// traffic would, checking the generations stay bounded
+			for at := tc.adds[len(tc.adds)-1]; at < tc.at; at += time.Minute {
+				d.Add(fmt.Sprintf("other-%d", at), t0.Add(at))
+				if len(d.gens) > dedupGenerations {
+					t.Fatalf("%d generations at +%s", len(d.gens), at)
+				}
+			}
+			if got := d.Seen("evt-1", t0.Add(tc.at)); got != tc.want {
+				t.Errorf("Seen at +%s = %v, want %v", tc.at, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEventDedupNewIDs(t *testing.T) {
+	const n = 5000
+	t0 := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		exact   bool
+		maxSeen int // of n IDs never added
+	}{
+		{true, 0},
+		// 0.1% target; allow for chance
+		{false, n / 100},
+	} {
+		t.Run(fmt.Sprintf("exact=%v", tc.exact), func(t *testing.T) {
+			// capacity is per TTL, so spread the IDs across one
+			d := newEventDedup(time.Hour, n, 0.001, tc.exact)
+			for i := 0; i < n; i++ {
+				d.Add(fmt.Sprintf("seen-%d", i), t0.Add(time.Duration(i)*time.Hour/n))
+			}
+			now := t0.Add(time.Hour)
+			seen := 0
+			for i := 0; i < n; i++ {
+				if !d.Seen(fmt.Sprintf("seen-%d", i), now) {
+					t.Fatalf("seen-%d not recognised", i)
+				}
+				if d.Seen(fmt.Sprintf("new-%d", i), now) {
+					seen++
+				}
+			}
+			if seen > tc.maxSeen {
+				t.Errorf("%d of %d new IDs taken as duplicates, want at most %d", seen, n, tc.maxSeen)
+			}
+		})
+	}
+}
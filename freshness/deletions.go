@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A deletion campaign removes every dataset matching pattern from a set of
+// sites, no earlier than not_before. Its targets are resolved from the
+// dataset placements when the campaign is created, so what it will touch
+// is fixed and reviewable up front. Executor workers claim targets at no
+// more than rate_per_minute per campaign; in dry-run mode they only report
+// what they would remove. A claim is a lease the worker renews with
+// heartbeats while it deletes; a target whose lease runs out
+// (DELETION_LEASE_SECONDS) goes back to pending. Every step is appended to
+// DELETION_AUDIT_FILE.
+var (
+	deletionCampaignsFile = envOr("DELETION_CAMPAIGNS_FILE", filepath.Join(dataDir, "deletion-campaigns.json"))
+	deletionAuditFile     = envOr("DELETION_AUDIT_FILE", filepath.Join(dataDir, "deletion-audit.jsonl"))
+	deletionLease         = time.Duration(envOrInt("DELETION_LEASE_SECONDS", 300)) * time.Second
+)
+
+const (
+	targetPending  = "pending"
+	targetClaimed  = "claimed"
+	targetDeleted  = "deleted"
+	targetDryRun   = "would-delete"
+	targetFailed   = "failed"
+	campaignActive = "active"
+	campaignDone   = "done"
+	campaignCancel = "cancelled"
+)
+
+var errCampaignNotFound = errors.New("deletion campaign not found")
+
+type DeletionCampaign struct {
+	ID           string           `json:"id"`
+	Name         string           `json:"name"`
+	Pattern      string           `json:"pattern"`
+	Sites        []string         `json:"sites"`
+	NotBefore    float64          `json:"not_before"`
+	DryRun       bool             `json:"dry_run"`
+	RatePerMin   int              `json:"rate_per_minute"`
+	Status       string           `json:"status"`
+	Created      float64          `json:"created"`
+	Targets      []DeletionTarget `json:"targets"`
+	recentClaims []time.Time
+}
+
+// DeletionTarget is one dataset at one site. BytesUnknown is set when the
+// worker's backend cannot measure what it removed; quota usage is then left
+// as it was.
+type DeletionTarget struct {
+	Dataset      string  `json:"dataset"`
+	Site         string  `json:"site"`
+	Status       string  `json:"status"`
+	Worker       string  `json:"worker,omitempty"`
+	Bytes        int64   `json:"bytes,omitempty"`
+	BytesUnknown bool    `json:"bytes_unknown,omitempty"`
+	Files        int64   `json:"files,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	Updated      float64 `json:"updated"`
+	LeaseExpiry  float64 `json:"lease_expiry,omitempty"`
+}
+
+// DeletionClaim is what a worker receives for one target.
+type DeletionClaim struct {
+	Campaign string `json:"campaign"`
+	Dataset  string `json:"dataset"`
+	Site     string `json:"site"`
+	DryRun   bool   `json:"dry_run"`
+}
+
+type auditEntry struct {
+	Timestamp float64 `json:"timestamp"`
+	Campaign  string  `json:"campaign"`
+	Action    string  `json:"action"`
+	Actor     string  `json:"actor"`
+	Dataset   string  `json:"dataset,omitempty"`
+	Site      string  `json:"site,omitempty"`
+	DryRun    bool    `json:"dry_run"`
+	Bytes     int64   `json:"bytes,omitempty"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+var deletionTargets = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "dtms_deletion_targets", Help: "Deletion campaign targets by campaign and status"},
+	[]string{"campaign", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(deletionTargets)
+}
+
+type campaignStore struct {
+	mu        sync.Mutex
+	path      string
+	campaigns map[string]*DeletionCampaign
+}
+
+var deletionCampaigns = &campaignStore{path: deletionCampaignsFile, campaigns: map[string]*DeletionCampaign{}}
+
+func (s *campaignStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*DeletionCampaign
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range list {
+		s.campaigns[c.ID] = c
+		c.publish()
+	}
+	return nil
+}
+
+// save persists the store; callers hold mu.
+func (s *campaignStore) save() error {
+	list := make([]*DeletionCampaign, 0, len(s.campaigns))
+	for _, c := range s.campaigns {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+func (c *DeletionCampaign) publish() {
+	counts := map[string]int{targetPending: 0, targetClaimed: 0, targetDeleted: 0, targetDryRun: 0, targetFailed: 0}
+	for _, t := range c.Targets {
+		counts[t.Status]++
+	}
+	for status, n := range counts {
+		deletionTargets.WithLabelValues(c.ID, status).Set(float64(n))
+	}
+}
+
+func audit(e auditEntry) {
+	e.Timestamp = float64(time.Now().Unix())
+	raw, _ := json.Marshal(e)
+	if err := os.MkdirAll(filepath.Dir(deletionAuditFile), 0o755); err != nil {
+		fmt.Printf("[deletions] audit: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(deletionAuditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Printf("[deletions] audit: %v\n", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(raw, '\n'))
+}
+
+// Create resolves the campaign's targets and stores it.
+func (s *campaignStore) Create(c DeletionCampaign, actor string) (DeletionCampaign, error) {
+	re, err := regexp.Compile(c.Pattern)
+	if err != nil || c.Pattern == "" {
+		return c, fmt.Errorf("invalid pattern %q", c.Pattern)
+	}
+	if len(c.Sites) == 0 {
+		return c, errors.New("sites are required")
+	}
+	if c.RatePerMin <= 0 {
+		c.RatePerMin = 10
+	}
+	now := time.Now()
+	id := make([]byte, 6)
+	rand.Read(id)
+	c.ID = "dc-" + hex.EncodeToString(id)
+	c.Status, c.Created, c.Targets = campaignActive, float64(now.Unix()), nil
+	wanted := map[string]bool{}
+	for _, site := range c.Sites {
+		wanted[site] = true
+	}
+	for dataset, sites := range lineage.Placements() {
+		if !re.MatchString(dataset) {
+			continue
+		}
+		for site := range sites {
+			if wanted[site] {
+				c.Targets = append(c.Targets, DeletionTarget{Dataset: dataset, Site: site, Status: targetPending, Updated: c.Created})
+			}
+		}
+	}
+	sort.Slice(c.Targets, func(i, j int) bool {
+		if c.Targets[i].Dataset != c.Targets[j].Dataset {
+			return c.Targets[i].Dataset < c.Targets[j].Dataset
+		}
+		return c.Targets[i].Site < c.Targets[j].Site
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.campaigns[c.ID] = &c
+	c.publish()
+	audit(auditEntry{Campaign: c.ID, Action: "created", Actor: actor, DryRun: c.DryRun,
+		Detail: fmt.Sprintf("pattern %q at %s, %d targets", c.Pattern, strings.Join(c.Sites, ","), len(c.Targets))})
+	return c, s.save()
+}
+
+func (s *campaignStore) Get(id string) (DeletionCampaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.campaigns[id]
+	if !ok {
+		return DeletionCampaign{}, errCampaignNotFound
+	}
+	return *c, nil
+}
+
+func (s *campaignStore) List() []DeletionCampaign {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []DeletionCampaign{}
+	for _, c := range s.campaigns {
+		summary := *c
+		summary.Targets = nil
+		out = append(out, summary)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created < out[j].Created })
+	return out
+}
+
+func (s *campaignStore) Cancel(id, actor string) (DeletionCampaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.campaigns[id]
+	if !ok {
+		return DeletionCampaign{}, errCampaignNotFound
+	}
+	if c.Status != campaignActive {
+		return *c, fmt.Errorf("campaign is already %s", c.Status)
+	}
+	c.Status = campaignCancel
+	audit(auditEntry{Campaign: id, Action: "cancelled", Actor: actor, DryRun: c.DryRun})
+	return *c, s.save()
+}
+
+// Claim hands worker the next pending target of an active campaign that is
+// past its not-before date and under its rate limit.
+func (s *campaignStore) Claim(worker string) (DeletionClaim, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expireLeases(now)
+	for _, c := range s.sortedActive() {
+		if float64(now.Unix()) < c.NotBefore || !c.underRate(now) {
+			continue
+		}
+		for i := range c.Targets {
+			t := &c.Targets[i]
+			if t.Status != targetPending {
+				continue
+			}
+			t.Status, t.Worker, t.Updated = targetClaimed, worker, float64(now.Unix())
+			t.LeaseExpiry = float64(now.Add(deletionLease).Unix())
+			c.recentClaims = append(c.recentClaims, now)
+			c.publish()
+			audit(auditEntry{Campaign: c.ID, Action: "claimed", Actor: worker, Dataset: t.Dataset, Site: t.Site, DryRun: c.DryRun})
+			return DeletionClaim{Campaign: c.ID, Dataset: t.Dataset, Site: t.Site, DryRun: c.DryRun}, true, s.save()
+		}
+	}
+	return DeletionClaim{}, false, nil
+}
+
+func (s *campaignStore) sortedActive() []*DeletionCampaign {
+	var out []*DeletionCampaign
+	for _, c := range s.campaigns {
+		if c.Status == campaignActive {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created < out[j].Created })
+	return out
+}
+
+func (c *DeletionCampaign) underRate(now time.Time) bool {
+	keep := c.recentClaims[:0]
+	for _, t := range c.recentClaims {
+		if now.Sub(t) < time.Minute {
+			keep = append(keep, t)
+		}
+	}
+	c.recentClaims = keep
+	return len(keep) < c.RatePerMin
+}
+
+// claimed returns the target of campaign id held by worker; callers hold
+// mu.
+func (s *campaignStore) claimed(id, worker, dataset, site string) (*DeletionCampaign, *DeletionTarget, error) {
+	c, ok := s.campaigns[id]
+	if !ok {
+		return nil, nil, errCampaignNotFound
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.Dataset == dataset && t.Site == site && t.Status == targetClaimed && t.Worker == worker {
+			return c, t, nil
+		}
+	}
+	return c, nil, fmt.Errorf("target %s@%s is not claimed by %s", dataset, site, worker)
+}
+
+// Heartbeat renews worker's lease on a claimed target.
+func (s *campaignStore) Heartbeat(id, worker, dataset, site string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, t, err := s.claimed(id, worker, dataset, site)
+	if err != nil {
+		return err
+	}
+	t.LeaseExpiry = float64(time.Now().Add(deletionLease).Unix())
+	return s.save()
+}
+
+// expireLeases returns targets of silent workers to pending; callers hold
+// mu.
+func (s *campaignStore) expireLeases(now time.Time) {
+	for _, c := range s.campaigns {
+		for i := range c.Targets {
+			t := &c.Targets[i]
+			if t.Status == targetClaimed && float64(now.Unix()) > t.LeaseExpiry {
+				audit(auditEntry{Campaign: c.ID, Action: "lease-expired", Actor: t.Worker, Dataset: t.Dataset, Site: t.Site, DryRun: c.DryRun})
+				t.Status, t.Worker, t.LeaseExpiry = targetPending, "", 0
+			}
+		}
+	}
+}
+
+// Result records a worker's outcome for a claimed target. Real deletions
+// are fed back through ingestion so quota usage and placements follow.
+func (s *campaignStore) Result(id, worker string, res DeletionTarget) (DeletionCampaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, t, err := s.claimed(id, worker, res.Dataset, res.Site)
+	if c == nil {
+		return DeletionCampaign{}, err
+	}
+	if err != nil {
+		return *c, err
+	}
+	now := float64(time.Now().Unix())
+	t.Bytes, t.BytesUnknown, t.Files, t.Error, t.Updated, t.LeaseExpiry = res.Bytes, res.BytesUnknown, res.Files, res.Error, now, 0
+	switch {
+	case res.Error != "":
+		t.Status = targetFailed
+	case c.DryRun:
+		t.Status = targetDryRun
+	default:
+		t.Status = targetDeleted
+	}
+	detail := t.Error
+	if t.BytesUnknown && detail == "" {
+		detail = "size unknown, quota usage not reduced"
+	}
+	audit(auditEntry{Campaign: id, Action: t.Status, Actor: worker, Dataset: t.Dataset, Site: t.Site, DryRun: c.DryRun, Bytes: t.Bytes, Detail: detail})
+	if t.Status == targetDeleted {
+		// charged to the tenant the site's arrivals are charged to
+		ev := TransferEvent{
+			ID:        fmt.Sprintf("deletion:%s:%s:%s", id, t.Site, t.Dataset),
+			Site:      t.Site,
+			Dataset:   t.Dataset,
+			Tenant:    siteRegistry().lookup(t.Site).Metadata["tenant"],
+			Timestamp: now,
+			Bytes:     t.Bytes,
+			Status:    eventDeleted,
+		}
+		if err := ingest.IngestEvent("deletion", ev); err != nil {
+			fmt.Printf("[deletions] %s: %v\n", ev.ID, err)
+		}
+		lineage.Forget(DatasetRef{t.Dataset, t.Site})
+	}
+	done := true
+	for _, o := range c.Targets {
+		if o.Status == targetPending || o.Status == targetClaimed {
+			done = false
+		}
+	}
+	if done {
+		c.Status = campaignDone
+		audit(auditEntry{Campaign: id, Action: "completed", Actor: worker, DryRun: c.DryRun})
+	}
+	c.publish()
+	return *c, s.save()
+}
+
+// handleDeletionCampaigns serves GET (list) and POST (create) on
+// /api/v1/deletion-campaigns.
+func handleDeletionCampaigns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"campaigns": deletionCampaigns.List()})
+	case http.MethodPost:
+		if !apiAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var c DeletionCampaign
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := deletionCampaigns.Create(c, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeletionCampaign serves the per-campaign endpoints:
+//
+//	GET  /api/v1/deletion-campaigns/{id}
+//	POST /api/v1/deletion-campaigns/{id}/cancel
+//	POST /api/v1/deletion-campaigns/claim     {"worker"}
+//	POST /api/v1/deletion-campaigns/{id}/heartbeat {"worker","dataset","site"}
+//	POST /api/v1/deletion-campaigns/{id}/result
+//	     {"worker","dataset","site","bytes","bytes_unknown","files","error"}
+func handleDeletionCampaign(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/deletion-campaigns/"), "/")
+	if r.Method == http.MethodGet && action == "" {
+		c, err := deletionCampaigns.Get(id)
+		writeCampaignResult(w, c, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Worker string `json:"worker"`
+		DeletionTarget
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case id == "claim" && action == "":
+		if body.Worker == "" {
+			http.Error(w, "worker is required", http.StatusBadRequest)
+			return
+		}
+		claim, ok, err := deletionCampaigns.Claim(body.Worker)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case !ok:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusOK, claim)
+		}
+	case action == "cancel":
+		c, err := deletionCampaigns.Cancel(id, "api")
+		writeCampaignResult(w, c, err)
+	case action == "heartbeat":
+		if body.Worker == "" {
+			http.Error(w, "worker is required", http.StatusBadRequest)
+			return
+		}
+		if err := deletionCampaigns.Heartbeat(id, body.Worker, body.Dataset, body.Site); err != nil {
+			writeCampaignResult(w, DeletionCampaign{}, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "result":
+		if body.Worker == "" {
+			http.Error(w, "worker is required", http.StatusBadRequest)
+			return
+		}
+		c, err := deletionCampaigns.Result(id, body.Worker, body.DeletionTarget)
+		writeCampaignResult(w, c, err)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeCampaignResult(w http.ResponseWriter, c DeletionCampaign, err error) {
+	switch {
+	case errors.Is(err, errCampaignNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+// handleDeletionAudit serves GET /api/v1/deletion-audit?campaign=, the
+// audit trail in order.
+func handleDeletionAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	campaign := r.URL.Query().Get("campaign")
+	raw, err := os.ReadFile(deletionAuditFile)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := []auditEntry{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		var e auditEntry
+		if json.Unmarshal([]byte(line), &e) != nil {
+			continue
+		}
+		if campaign == "" || e.Campaign == campaign {
+			entries = append(entries, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// leaseLoop returns targets of silent workers to the queue even while
+// nobody is claiming.
+func (s *campaignStore) leaseLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.mu.Lock()
+			s.expireLeases(time.Now())
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Downtime feeds and the downtime calendar (downtimecalendar.go) populate
+// maintenance windows. While a site is inside one, dtms_site_in_downtime
+// is 1 and, unless DOWNTIME_SUPPRESSES_OK is false, the default ok rule
+// reports the site as ok so staleness alerts stay quiet for declared
+// outages. CEL ok rules see the same flag as in_downtime.
+var downtimeSuppressesOk = envOr("DOWNTIME_SUPPRESSES_OK", "true") == "true"
+
+type downtimeWindow struct {
+	Site        string    `json:"site"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Severity    string    `json:"severity"`
+	Description string    `json:"description"`
+	Origin      string    `json:"origin"`
+}
+
+type downtimeStore struct {
+	mu       sync.RWMutex
+	byOrigin map[string][]downtimeWindow
+}
+
+var downtimes = &downtimeStore{byOrigin: map[string][]downtimeWindow{}}
+
+// Replace swaps all windows previously reported by origin.
+func (d *downtimeStore) Replace(origin string, windows []downtimeWindow) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byOrigin[origin] = windows
+}
+
+// Active returns the windows covering site at t, scheduled ones included.
+func (d *downtimeStore) Active(site string, t time.Time) []downtimeWindow {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var out []downtimeWindow
+	for _, ws := range d.byOrigin {
+		for _, w := range ws {
+			if w.Site == site && !t.Before(w.Start) && t.Before(w.End) {
+				out = append(out, w)
+			}
+		}
+	}
+	return append(out, calendar.Windows(site, t, t.Add(time.Nanosecond))...)
+}
+
+// Overlapping returns the windows for site (every site when empty) that
+// intersect [from, to], scheduled ones included.
+func (d *downtimeStore) Overlapping(site string, from, to time.Time) []downtimeWindow {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var out []downtimeWindow
+	for _, ws := range d.byOrigin {
+		for _, w := range ws {
+			if (site == "" || w.Site == site) && w.Start.Before(to) && w.End.After(from) {
+				out = append(out, w)
+			}
+		}
+	}
+	return append(out, calendar.Windows(site, from, to)...)
+}
+
+// feedWindows returns every window the feeds reported for site (all when
+// empty).
+func (d *downtimeStore) feedWindows(site string) []downtimeWindow {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var out []downtimeWindow
+	for _, ws := range d.byOrigin {
+		for _, w := range ws {
+			if site == "" || w.Site == site {
+				out = append(out, w)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// downtimeFeed fetches GOCDB or OSG topology downtimes. Only windows whose
+// severity is listed (OUTAGE by default) are applied; `sites` renames feed
+// site/resource-group names to DTMS sites.
+type downtimeFeed struct {
+	name       string
+	kind       string
+	URL        string            `yaml:"url"`
+	Scope      string            `yaml:"scope"`
+	Severities []string          `yaml:"severities"`
+	Sites      map[string]string `yaml:"sites"`
+}
+
+func init() {
+	for kind, defURL := range map[string]string{
+		"gocdb-downtime": "https://goc.egi.eu/gocdbpi/public/",
+		"osg-downtime":   "https://topology.opensciencegrid.org/rgdowntime/xml",
+	} {
+		kind, defURL := kind, defURL
+		registerSource(kind, func(name string, params *yaml.Node) (Source, error) {
+			s := &downtimeFeed{name: name, kind: kind, URL: defURL, Severities: []string{"OUTAGE"}}
+			return s, params.Decode(s)
+		})
+	}
+}
+
+func (s *downtimeFeed) Name() string { return s.name }
+
+// Collect refreshes the feed's windows; it reports no sites itself.
+func (s *downtimeFeed) Collect(ctx context.Context) ([]SiteFresh, error) {
+	var windows []downtimeWindow
+	var err error
+	if s.kind == "gocdb-downtime" {
+		windows, err = s.fetchGOCDB(ctx)
+	} else {
+		windows, err = s.fetchOSG(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kept []downtimeWindow
+	for _, w := range windows {
+		if !s.wantSeverity(w.Severity) {
+			continue
+		}
+		if mapped, ok := s.Sites[w.Site]; ok {
+			w.Site = mapped
+		}
+		w.Origin = s.name
+		kept = append(kept, w)
+	}
+	downtimes.Replace(s.name, kept)
+	return nil, nil
+}
+
+func (s *downtimeFeed) wantSeverity(sev string) bool {
+	for _, want := range s.Severities {
+		if strings.EqualFold(want, sev) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *downtimeFeed) fetchGOCDB(ctx context.Context) ([]downtimeWindow, error) {
+	q := url.Values{
+		"method":      {"get_downtime"},
+		"windowstart": {time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")},
+	}
+	if s.Scope != "" {
+		q.Set("scope", s.Scope)
+	}
+	var doc struct {
+		Downtimes []struct {
+			Site        string `xml:"SITENAME"`
+			Severity    string `xml:"SEVERITY"`
+			Description string `xml:"DESCRIPTION"`
+			Start       int64  `xml:"START_DATE"`
+			End         int64  `xml:"END_DATE"`
+		} `xml:"DOWNTIME"`
+	}
+	if err := s.getXML(ctx, s.URL+"?"+q.Encode(), &doc); err != nil {
+		return nil, err
+	}
+	out := make([]downtimeWindow, 0, len(doc.Downtimes))
+	for _, d := range doc.Downtimes {
+		out = append(out, downtimeWindow{
+			Site:        d.Site,
+			Start:       time.Unix(d.Start, 0).UTC(),
+			End:         time.Unix(d.End, 0).UTC(),
+			Severity:    strings.ToUpper(d.Severity),
+			Description: d.Description,
+		})
+	}
+	return out, nil
+}
+
+type osgDowntime struct {
+	GroupName   string `xml:"ResourceGroup>GroupName"`
+	Start       string `xml:"StartTime"`
+	End         string `xml:"EndTime"`
+	Severity    string `xml:"Severity"`
+	Description string `xml:"Description"`
+}
+
+var osgTimeLayouts = []string{"Jan 2, 2006 15:04 -0700", "Jan 02, 2006 15:04 -0700", "Jan 2, 2006 15:04 MST", "Jan 02, 2006 03:04 PM MST"}
+
+func (s *downtimeFeed) fetchOSG(ctx context.Context) ([]downtimeWindow, error) {
+	var doc struct {
+		Current []osgDowntime `xml:"CurrentDowntimes>Downtime"`
+		Future  []osgDowntime `xml:"FutureDowntimes>Downtime"`
+	}
+	if err := s.getXML(ctx, s.URL, &doc); err != nil {
+		return nil, err
+	}
+	var out []downtimeWindow
+	for _, d := range append(doc.Current, doc.Future...) {
+		start, err1 := parseOSGTime(d.Start)
+		end, err2 := parseOSGTime(d.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		out = append(out, downtimeWindow{
+			Site:        d.GroupName,
+			Start:       start,
+			End:         end,
+			Severity:    strings.ToUpper(d.Severity),
+			Description: d.Description,
+		})
+	}
+	return out, nil
+}
+
+func parseOSGTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range osgTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised OSG time %q", s)
+}
+
+func (s *downtimeFeed) getXML(ctx context.Context, u string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", s.kind, resp.Status)
+	}
+	return xml.NewDecoder(resp.Body).Decode(into)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled downtimes are maintenance windows declared through the API
+// rather than pulled from a feed, kept in DOWNTIME_CALENDAR_FILE. Start and
+// end are wall-clock times in the entry's timezone (UTC by default), and
+// an optional RRULE repeats the window:
+//
+//	{"site": "SITE_A", "start": "2026-10-18T02:00", "end": "2026-10-18T06:00",
+//	 "timezone": "Europe/Zurich", "rrule": "FREQ=WEEKLY;BYDAY=SU",
+//	 "description": "tape library maintenance"}
+//
+// Occurrences join the feed windows in the downtime store, so they set
+// dtms_site_in_downtime, suppress staleness under DOWNTIME_SUPPRESSES_OK,
+// show up as hints and correlations, and are left out of SLA reports. The
+// API is /api/v1/downtimes (list, create), /api/v1/downtimes/{id} (get,
+// replace, delete), /api/v1/downtimes/occurrences (expanded windows from
+// every origin) and /api/v1/downtimes/calendar.ics.
+var downtimeCalendarFile = envOr("DOWNTIME_CALENDAR_FILE", filepath.Join(dataDir, "downtime-calendar.json"))
+
+// calendarOrigin is the Origin of windows from scheduled downtimes.
+const calendarOrigin = "calendar"
+
+var calendarTimeLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04"}
+
+type ScheduledDowntime struct {
+	ID          string  `json:"id"`
+	Site        string  `json:"site"`
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	Timezone    string  `json:"timezone,omitempty"`
+	RRule       string  `json:"rrule,omitempty"`
+	Severity    string  `json:"severity,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Author      string  `json:"author,omitempty"`
+	Created     float64 `json:"created"`
+	Updated     float64 `json:"updated,omitempty"`
+
+	start, end time.Time
+	rule       *recurrence
+}
+
+func parseCalendarTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range calendarTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("time %q is not YYYY-MM-DDTHH:MM", s)
+}
+
+func (d *ScheduledDowntime) compile() error {
+	if d.Site == "" {
+		return fmt.Errorf("site is required")
+	}
+	loc := time.UTC
+	if d.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(d.Timezone); err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+	}
+	var err error
+	if d.start, err = parseCalendarTime(d.Start, loc); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if d.end, err = parseCalendarTime(d.End, loc); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if !d.end.After(d.start) {
+		return fmt.Errorf("end is not after start")
+	}
+	d.rule = nil
+	if d.RRule != "" {
+		if d.rule, err = parseRecurrence(d.RRule, loc); err != nil {
+			return err
+		}
+	}
+	if d.Severity == "" {
+		d.Severity = "OUTAGE"
+	}
+	d.Severity = strings.ToUpper(d.Severity)
+	return nil
+}
+
+// occurrenceEnd ends the window starting at s at the same wall-clock time
+// and day offset as the first one.
+func (d *ScheduledDowntime) occurrenceEnd(s time.Time) time.Time {
+	sy, sm, sd := d.start.Date()
+	ey, em, ed := d.end.Date()
+	days := int(time.Date(ey, em, ed, 0, 0, 0, 0, time.UTC).Sub(time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	y, m, day := s.Date()
+	h, mi, sec := d.end.Clock()
+	return time.Date(y, m, day+days, h, mi, sec, 0, s.Location())
+}
+
+// windows returns the occurrences intersecting [from, to).
+func (d *ScheduledDowntime) windows(from, to time.Time) []downtimeWindow {
+	var out []downtimeWindow
+	add := func(s time.Time) bool {
+		if !s.Before(to) {
+			return false
+		}
+		if e := d.occurrenceEnd(s); e.After(from) {
+			out = append(out, downtimeWindow{Site: d.Site, Start: s.UTC(), End: e.UTC(), Severity: d.Severity, Description: d.Description, Origin: calendarOrigin})
+		}
+		return true
+	}
+	if d.rule == nil {
+		add(d.start)
+		return out
+	}
+	d.rule.each(d.start, add)
+	return out
+}
+
+type downtimeCalendar struct {
+	mu    sync.RWMutex
+	path  string
+	items map[string]*ScheduledDowntime
+}
+
+var calendar = &downtimeCalendar{path: downtimeCalendarFile, items: map[string]*ScheduledDowntime{}}
+
+func (c *downtimeCalendar) Load() error {
+	raw, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*ScheduledDowntime
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", c.path, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range list {
+		if err := d.compile(); err != nil {
+			return fmt.Errorf("%s: %s: %w", c.path, d.ID, err)
+		}
+		c.items[d.ID] = d
+	}
+	return nil
+}
+
+func (c *downtimeCalendar) save() error {
+	raw, err := json.Marshal(c.sorted(""))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, raw)
+}
+
+// sorted lists the entries for site (all when empty) by start.
+func (c *downtimeCalendar) sorted(site string) []*ScheduledDowntime {
+	out := []*ScheduledDowntime{}
+	for _, d := range c.items {
+		if site == "" || d.Site == site {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].start.Equal(out[j].start) {
+			return out[i].start.Before(out[j].start)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Put stores d, which must be compiled, assigning an ID to a new entry.
+func (c *downtimeCalendar) Put(d *ScheduledDowntime) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := float64(time.Now().Unix())
+	if d.ID == "" {
+		id := make([]byte, 6)
+		rand.Read(id)
+		d.ID = "dt-" + hex.EncodeToString(id)
+		d.Created = now
+	} else {
+		d.Updated = now
+	}
+	c.items[d.ID] = d
+	return c.save()
+}
+
+func (c *downtimeCalendar) Get(id string) (*ScheduledDowntime, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	d, ok := c.items[id]
+	return d, ok
+}
+
+func (c *downtimeCalendar) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[id]; !ok {
+		return os.ErrNotExist
+	}
+	delete(c.items, id)
+	return c.save()
+}
+
+func (c *downtimeCalendar) List(site string) []*ScheduledDowntime {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sorted(site)
+}
+
+// Windows returns the occurrences for site (all when empty) intersecting
+// [from, to).
+func (c *downtimeCalendar) Windows(site string, from, to time.Time) []downtimeWindow {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []downtimeWindow
+	for _, d := range c.items {
+		if site == "" || d.Site == site {
+			out = append(out, d.windows(from, to)...)
+		}
+	}
+	return out
+}
+
+// handleDowntimes serves GET /api/v1/downtimes?site=&tags= and
+// POST /api/v1/downtimes.
+func handleDowntimes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sel, err := queryTags(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := []*ScheduledDowntime{}
+		for _, d := range calendar.List(r.URL.Query().Get("site")) {
+			if sel.selects(d.Site) {
+				out = append(out, d)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"downtimes": out})
+	case http.MethodPost:
+		caller := apiPrincipal(r)
+		if caller == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var d ScheduledDowntime
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !caller.canManageSite(d.Site) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := d.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d.Author == "" {
+			d.Author = caller.Name
+		}
+		d.ID = ""
+		if err := calendar.Put(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, d)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDowntime serves GET, PUT and DELETE /api/v1/downtimes/{id}, plus
+// the occurrences and calendar.ics views.
+func handleDowntime(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/downtimes/")
+	switch {
+	case id == "occurrences" && r.Method == http.MethodGet:
+		handleDowntimeOccurrences(w, r)
+		return
+	case id == "calendar.ics" && r.Method == http.MethodGet:
+		handleDowntimeICS(w, r)
+		return
+	}
+	existing, ok := calendar.Get(id)
+	if !ok {
+		http.Error(w, "unknown downtime", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, existing)
+		return
+	}
+	caller := apiPrincipal(r)
+	if caller == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !caller.canManageSite(existing.Site) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var d ScheduledDowntime
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !caller.canManageSite(d.Site) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := d.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.ID, d.Created = existing.ID, existing.Created
+		if d.Author == "" {
+			d.Author = existing.Author
+		}
+		if err := calendar.Put(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	case http.MethodDelete:
+		if err := calendar.Delete(id); err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDowntimeOccurrences serves GET /api/v1/downtimes/occurrences?site=&from=&to=,
+// the windows from feeds and the calendar over [from, to), unix seconds
+// defaulting to the coming week.
+func handleDowntimeOccurrences(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Unix()
+	from := unixTime(float64(queryInt(r, "from", int(now))))
+	to := unixTime(float64(queryInt(r, "to", int(now+7*86400))))
+	if to.Sub(from) > 366*24*time.Hour {
+		http.Error(w, "range is limited to a year", http.StatusBadRequest)
+		return
+	}
+	out := downtimes.Overlapping(r.URL.Query().Get("site"), from, to)
+	if out == nil {
+		out = []downtimeWindow{}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.Before(out[j].Start)
+		}
+		return out[i].Site < out[j].Site
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"windows": out})
+}
+
+// handleDowntimeICS serves GET /api/v1/downtimes/calendar.ics?site=&tags=:
+// scheduled downtimes as recurring events in their own timezone, and the
+// feed windows currently known as one-off events.
+func handleDowntimeICS(w http.ResponseWriter, r *http.Request) {
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	var b strings.Builder
+	line := func(s string) {
+		// fold at 75 octets as RFC 5545 requires
+		for len(s) > 75 {
+			cut := 75
+			for cut > 0 && s[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			b.WriteString(s[:cut] + "\r\n")
+			s = " " + s[cut:]
+		}
+		b.WriteString(s + "\r\n")
+	}
+	icsTime := func(name string, t time.Time, tz string) {
+		if tz == "" || tz == "UTC" {
+			line(name + ":" + t.UTC().Format("20060102T150405Z"))
+			return
+		}
+		line(name + ";TZID=" + tz + ":" + t.Format("20060102T150405"))
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//DTMS//Downtime calendar//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:DTMS downtimes")
+	for _, d := range calendar.List(site) {
+		if !sel.selects(d.Site) {
+			continue
+		}
+		line("BEGIN:VEVENT")
+		line("UID:" + d.ID + "@dtms")
+		line("DTSTAMP:" + stamp)
+		icsTime("DTSTART", d.start, d.Timezone)
+		icsTime("DTEND", d.end, d.Timezone)
+		if d.RRule != "" {
+			line("RRULE:" + strings.TrimPrefix(d.RRule, "RRULE:"))
+		}
+		line("SUMMARY:" + icsText(d.Site+" downtime ("+d.Severity+")"))
+		if d.Description != "" {
+			line("DESCRIPTION:" + icsText(d.Description))
+		}
+		line("CATEGORIES:" + icsText(d.Severity))
+		line("END:VEVENT")
+	}
+	for _, fw := range downtimes.feedWindows(site) {
+		if !sel.selects(fw.Site) {
+			continue
+		}
+		line("BEGIN:VEVENT")
+		line(fmt.Sprintf("UID:%s-%s-%d@dtms", fw.Origin, fw.Site, fw.Start.Unix()))
+		line("DTSTAMP:" + stamp)
+		icsTime("DTSTART", fw.Start, "")
+		icsTime("DTEND", fw.End, "")
+		line("SUMMARY:" + icsText(fw.Site+" downtime ("+fw.Severity+", "+fw.Origin+")"))
+		if fw.Description != "" {
+			line("DESCRIPTION:" + icsText(fw.Description))
+		}
+		line("CATEGORIES:" + icsText(fw.Severity))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="dtms-downtimes.ics"`)
+	w.Write([]byte(b.String()))
+}
+
+// icsText escapes an iCalendar TEXT value.
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A successful transfer of a file the same destination already received
+// within DUPLICATE_WINDOW_SECONDS is counted as a duplicate. Files are
+// identified by File, falling back to URL; events carrying neither are
+// skipped.
+var duplicateWindow = time.Duration(envOrInt("DUPLICATE_WINDOW_SECONDS", 86400)) * time.Second
+
+var (
+	duplicateTransfers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_transfer_duplicates_total", Help: "Transfers repeating a delivery to the same destination within the duplicate window"},
+		[]string{"site"},
+	)
+	duplicateBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_transfer_duplicate_bytes_total", Help: "Bytes moved by duplicate transfers"},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(duplicateTransfers, duplicateBytes)
+}
+
+// DuplicateOffender aggregates the duplicates of one file, or of a whole
+// dataset when events name one, at one destination.
+type DuplicateOffender struct {
+	Site     string  `json:"site"`
+	Dataset  string  `json:"dataset,omitempty"`
+	File     string  `json:"file,omitempty"`
+	Count    int     `json:"count"`
+	Bytes    int64   `json:"bytes"`
+	LastSeen float64 `json:"last_seen"`
+}
+
+type duplicateKey struct{ site, item string }
+
+type duplicateTracker struct {
+	mu        sync.Mutex
+	delivered map[duplicateKey]time.Time
+	offenders map[duplicateKey]*DuplicateOffender
+}
+
+var duplicates = &duplicateTracker{
+	delivered: map[duplicateKey]time.Time{},
+	offenders: map[duplicateKey]*DuplicateOffender{},
+}
+
+func (d *duplicateTracker) Observe(ev TransferEvent) {
+	file := ev.File
+	if file == "" {
+		file = ev.URL
+	}
+	if ev.Status != "success" || file == "" {
+		return
+	}
+	at := unixTime(ev.Timestamp)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(time.Now())
+	k := duplicateKey{ev.Site, file}
+	prev, seen := d.delivered[k]
+	if !seen || at.After(prev) {
+		d.delivered[k] = at
+	}
+	if !seen || absDuration(at.Sub(prev)) > duplicateWindow {
+		return
+	}
+
+	duplicateTransfers.WithLabelValues(ev.Site).Inc()
+	duplicateBytes.WithLabelValues(ev.Site).Add(float64(ev.Bytes))
+	ok := duplicateKey{ev.Site, "file:" + file}
+	if ev.Dataset != "" {
+		ok = duplicateKey{ev.Site, "dataset:" + ev.Dataset}
+	}
+	o := d.offenders[ok]
+	if o == nil {
+		o = &DuplicateOffender{Site: ev.Site, Dataset: ev.Dataset}
+		if ev.Dataset == "" {
+			o.File = file
+		}
+		d.offenders[ok] = o
+	}
+	o.Count++
+	o.Bytes += ev.Bytes
+	if ev.Timestamp > o.LastSeen {
+		o.LastSeen = ev.Timestamp
+	}
+}
+
+// expire forgets deliveries and offenders that fell out of the window.
+func (d *duplicateTracker) expire(now time.Time) {
+	for k, t := range d.delivered {
+		if now.Sub(t) > duplicateWindow {
+			delete(d.delivered, k)
+		}
+	}
+	for k, o := range d.offenders {
+		if now.Sub(unixTime(o.LastSeen)) > duplicateWindow {
+			delete(d.offenders, k)
+		}
+	}
+}
+
+// Top returns the offenders with the most duplicate bytes, optionally for
+// one destination site.
+func (d *duplicateTracker) Top(site string, limit int) []DuplicateOffender {
+	d.mu.Lock()
+	d.expire(time.Now())
+	out := []DuplicateOffender{}
+	for _, o := range d.offenders {
+		if site == "" || o.Site == site {
+			out = append(out, *o)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// handleDuplicates serves GET /api/v1/duplicates?site=&limit=.
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window_seconds": duplicateWindow.Seconds(),
+		"offenders":      duplicates.Top(r.URL.Query().Get("site"), queryInt(r, "limit", 20)),
+	})
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
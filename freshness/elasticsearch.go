@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// esSink is a warehouse sink indexing rows into Elasticsearch or
+// OpenSearch with the bulk API:
+//
+//	sinks:
+//	  - name: search
+//	    type: elasticsearch
+//	    urls: [https://es-1:9200, https://es-2:9200]
+//	    api_key: ${ES_API_KEY}          # or username/password
+//	    index_prefix: dtms
+//	    index_naming: data_stream       # daily (default), monthly or data_stream
+//	    ilm_policy: dtms-90d
+//	    templates: {transfer_events: /etc/dtms/es-transfers.json}
+//
+// Each table is indexed as <prefix>-<table>, with underscores turned into
+// dashes and a date suffix for daily and monthly naming, so ILM policies
+// and Kibana data views can match on <prefix>-<table>*. Documents carry
+// @timestamp and use the row's insert ID as _id, making redelivery
+// idempotent. Before the first write to a table its index template is
+// installed: the file from `templates` as-is, else a default that maps
+// strings as keywords and attaches ilm_policy.
+type esSink struct {
+	name      string
+	URLs      []string          `yaml:"urls"`
+	Username  string            `yaml:"username"`
+	Password  string            `yaml:"password"`
+	APIKey    string            `yaml:"api_key"`
+	Prefix    string            `yaml:"index_prefix"`
+	Naming    string            `yaml:"index_naming"`
+	ILMPolicy string            `yaml:"ilm_policy"`
+	Templates map[string]string `yaml:"templates"`
+
+	mu        sync.Mutex
+	installed map[string]bool
+	next      int
+}
+
+func init() {
+	registerSink("elasticsearch", newESSink)
+	registerSink("opensearch", newESSink)
+}
+
+func newESSink(name string, params *yaml.Node) (warehouseSink, error) {
+	s := &esSink{name: name, Prefix: "dtms", Naming: "daily", installed: map[string]bool{}}
+	if err := params.Decode(s); err != nil {
+		return nil, err
+	}
+	if len(s.URLs) == 0 {
+		return nil, fmt.Errorf("urls is required")
+	}
+	switch s.Naming {
+	case "daily", "monthly", "data_stream":
+	default:
+		return nil, fmt.Errorf("index_naming must be daily, monthly or data_stream")
+	}
+	for table, path := range s.Templates {
+		if _, err := os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("template for %s: %w", table, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *esSink) Name() string { return s.name }
+
+func (s *esSink) base(table string) string {
+	return strings.ToLower(s.Prefix + "-" + strings.ReplaceAll(table, "_", "-"))
+}
+
+func (s *esSink) index(table string, r warehouseRow) string {
+	switch s.Naming {
+	case "daily":
+		return s.base(table) + "-" + r.at.UTC().Format("2006.01.02")
+	case "monthly":
+		return s.base(table) + "-" + r.at.UTC().Format("2006.01")
+	}
+	return s.base(table)
+}
+
+// do sends a request to the first node that answers, starting after the
+// last one that did.
+func (s *esSink) do(ctx context.Context, method, path, ctype string, body []byte) (*http.Response, error) {
+	var err error
+	for i := 0; i < len(s.URLs); i++ {
+		n := (s.next + i) % len(s.URLs)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, strings.TrimRight(s.URLs[n], "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", ctype)
+		switch {
+		case s.APIKey != "":
+			req.Header.Set("Authorization", "ApiKey "+s.APIKey)
+		case s.Username != "":
+			req.SetBasicAuth(s.Username, s.Password)
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			s.next = n
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// ensureTemplate installs the table's index template once.
+func (s *esSink) ensureTemplate(ctx context.Context, table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.installed[table] {
+		return nil
+	}
+	var body []byte
+	if path, ok := s.Templates[table]; ok {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		body = raw
+	} else {
+		settings := map[string]interface{}{}
+		if s.ILMPolicy != "" {
+			settings["index.lifecycle.name"] = s.ILMPolicy
+		}
+		tmpl := map[string]interface{}{
+			"index_patterns": []string{s.base(table) + "*"},
+			"priority":       200,
+			"template": map[string]interface{}{
+				"settings": settings,
+				"mappings": map[string]interface{}{
+					"dynamic_templates": []interface{}{
+						map[string]interface{}{"strings": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping":            map[string]string{"type": "keyword"},
+						}},
+					},
+					"properties": map[string]interface{}{
+						"@timestamp": map[string]string{"type": "date"},
+						"timestamp":  map[string]string{"type": "date"},
+						"reason":     map[string]string{"type": "text"},
+						"summary":    map[string]string{"type": "text"},
+					},
+				},
+			},
+		}
+		if s.Naming == "data_stream" {
+			tmpl["data_stream"] = map[string]interface{}{}
+		}
+		body, _ = json.Marshal(tmpl)
+	}
+	resp, err := s.do(ctx, http.MethodPut, "/_index_template/"+s.base(table), "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("index template %s: %s", s.base(table), resp.Status)
+	}
+	s.installed[table] = true
+	return nil
+}
+
+func (s *esSink) Insert(ctx context.Context, table string, rows []warehouseRow) error {
+	if err := s.ensureTemplate(ctx, table); err != nil {
+		return err
+	}
+	// Data streams only accept create; elsewhere index overwrites by _id.
+	op := "index"
+	if s.Naming == "data_stream" {
+		op = "create"
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range rows {
+		enc.Encode(map[string]interface{}{op: map[string]string{"_index": s.index(table, r), "_id": r.insertID}})
+		doc := make(map[string]interface{}, len(r.values)+1)
+		for k, v := range r.values {
+			doc[k] = v
+		}
+		doc["@timestamp"] = r.at.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+		enc.Encode(doc)
+	}
+	resp, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bulk: %s", resp.Status)
+	}
+	var out struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return err
+	}
+	if !out.Errors {
+		return nil
+	}
+	// 409 is a document already created by an earlier delivery. Throttled
+	// items fail the batch so it is retried; other rejections would only
+	// repeat and are dropped.
+	for i, item := range out.Items {
+		for _, res := range item {
+			switch {
+			case res.Status < 300 || res.Status == http.StatusConflict:
+			case res.Status == http.StatusTooManyRequests:
+				return fmt.Errorf("bulk: %s", res.Error.Reason)
+			default:
+				warehouseRows.WithLabelValues(s.name, table, "rejected").Inc()
+				fmt.Printf("[warehouse] %s: %s rejected: %s: %s\n", s.name, rows[i].insertID, res.Error.Type, res.Error.Reason)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/youruser/dtms-fresh/events"
+)
+
+// The service publishes what happens on an internal bus (package events)
+// and its notifiers subscribe to it:
+//
+//	freshness.transition  a site turned stale or fresh; data {ok, age_seconds, threshold}
+//	incident.opened       an incident was opened; data is the incident
+//	incident.resolved     an incident was resolved; data is the incident
+//	ingest.transfer       a transfer event was accepted; data is the event
+//	arrival.missed        a scheduled arrival did not come; data is the
+//	                      expected arrival (expectedarrivals.go)
+//	arrival.late          data came after a missed arrival; likewise
+//
+// Alert routes, the GET /api/v1/events stream and EVENTS_LOG, a JSON-lines
+// file of every event, are subscribers. EVENTS_KAFKA_TOPIC (on
+// KAFKA_BROKERS) and EVENTS_NATS_SUBJECT (a prefix on NATS_URL, the type
+// appended) forward the events to other systems; EVENTS_FORWARD limits
+// which types are forwarded, comma-separated patterns such as incident.*.
+var (
+	eventsLogPath     = envOr("EVENTS_LOG", "")
+	eventsKafkaTopic  = envOr("EVENTS_KAFKA_TOPIC", "")
+	eventsNATSSubject = envOr("EVENTS_NATS_SUBJECT", "")
+	eventsForward     = envOr("EVENTS_FORWARD", "*")
+)
+
+const (
+	eventFreshnessTransition = "freshness.transition"
+	eventIncidentOpened      = "incident.opened"
+	eventIncidentResolved    = "incident.resolved"
+	eventTransferIngested    = "ingest.transfer"
+)
+
+var (
+	eventsPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_events_published_total", Help: "Events published on the internal bus by type"},
+		[]string{"type"},
+	)
+	eventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_events_dropped_total", Help: "Events a subscriber lost because it fell behind"},
+		[]string{"subscriber"},
+	)
+	eventsBackendErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_events_backend_errors_total", Help: "Events an external backend failed to take"},
+		[]string{"backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventsPublished, eventsDropped, eventsBackendErrors)
+}
+
+var bus = events.New(events.Hooks{
+	Published: func(ev events.Event) { eventsPublished.WithLabelValues(ev.Type).Inc() },
+	Dropped:   func(sub string, ev events.Event) { eventsDropped.WithLabelValues(sub).Inc() },
+	BackendError: func(backend string, ev events.Event, err error) {
+		eventsBackendErrors.WithLabelValues(backend).Inc()
+		fmt.Printf("[events] %s: %s: %v\n", backend, ev.Type, err)
+	},
+})
+
+func splitPatterns(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// freshnessStates remembers each site's last verdict to publish
+// transitions; the first verdict after start is not one.
+var freshnessStates = struct {
+	sync.Mutex
+	ok map[string]bool
+}{ok: map[string]bool{}}
+
+func publishFreshness(site string, ok bool, age, threshold float64) {
+	freshnessStates.Lock()
+	prev, seen := freshnessStates.ok[site]
+	freshnessStates.ok[site] = ok
+	freshnessStates.Unlock()
+	if !seen || prev == ok {
+		return
+	}
+	bus.Publish(events.Event{Type: eventFreshnessTransition, Site: site, Data: map[string]interface{}{
+		"ok": ok, "age_seconds": age, "threshold": threshold,
+	}})
+}
+
+// startEventSinks subscribes the event log and connects the external
+// backends; call it before anything publishes.
+func startEventSinks(ctx context.Context) error {
+	forward := splitPatterns(eventsForward)
+	if eventsKafkaTopic != "" {
+		if kafkaBrokers == "" {
+			return fmt.Errorf("EVENTS_KAFKA_TOPIC needs KAFKA_BROKERS")
+		}
+		w := &kafka.Writer{
+			Addr:     kafka.TCP(strings.Split(kafkaBrokers, ",")...),
+			Topic:    eventsKafkaTopic,
+			Balancer: &kafka.Hash{},
+		}
+		bus.AddBackend(ctx, kafkaEventBackend{w}, 1024, forward...)
+	}
+	if eventsNATSSubject != "" {
+		if natsURL == "" {
+			return fmt.Errorf("EVENTS_NATS_SUBJECT needs NATS_URL")
+		}
+		nc, err := nats.Connect(natsURL, nats.Name("dtms-freshness-events"), nats.MaxReconnects(-1))
+		if err != nil {
+			return err
+		}
+		bus.AddBackend(ctx, natsEventBackend{nc}, 1024, forward...)
+	}
+	if eventsLogPath != "" {
+		f, err := os.OpenFile(eventsLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		sub := bus.Subscribe("log", 1024)
+		go func() {
+			defer f.Close()
+			enc := json.NewEncoder(f)
+			for {
+				select {
+				case <-ctx.Done():
+					sub.Close()
+					return
+				case ev := <-sub.C:
+					if err := enc.Encode(ev); err != nil {
+						fmt.Printf("[events] log: %v\n", err)
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// kafkaEventBackend writes events keyed by site, so a site's events stay
+// in order on one partition.
+type kafkaEventBackend struct{ w *kafka.Writer }
+
+func (kafkaEventBackend) Name() string { return "kafka" }
+
+func (b kafkaEventBackend) Publish(ctx context.Context, ev events.Event) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.w.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(ev.Site),
+		Value:   raw,
+		Headers: []kafka.Header{{Key: "Dtms-Event-Type", Value: []byte(ev.Type)}},
+	})
+}
+
+// natsEventBackend publishes each event on EVENTS_NATS_SUBJECT.<type>.
+type natsEventBackend struct{ nc *nats.Conn }
+
+func (natsEventBackend) Name() string { return "nats" }
+
+func (b natsEventBackend) Publish(ctx context.Context, ev events.Event) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.nc.Publish(eventsNATSSubject+"."+ev.Type, raw)
+}
+
+// handleEventStream serves GET /api/v1/events as server-sent events.
+// ?types= takes comma-separated patterns (incident.*), ?tags= a site tag
+// selector, and ?vo= also drops other VOs' transfers at the sites it
+// shares with them; a comment every 15s keeps idle connections open.
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vo := r.URL.Query().Get("vo")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sub := bus.Subscribe("stream", 256, splitPatterns(r.URL.Query().Get("types"))...)
+	defer sub.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-sub.C:
+			if ev.Site != "" && !sel.selects(ev.Site) {
+				continue
+			}
+			if t, ok := ev.Data.(TransferEvent); ok && vo != "" && t.VO != vo {
+				continue
+			}
+			raw, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, raw)
+		}
+		flusher.Flush()
+	}
+}
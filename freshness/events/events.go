@@ -0,0 +1,163 @@
+// Package events is the freshness service's internal publish/subscribe
+// bus. Producers such as the poll loop, the incident tracker and the
+// ingestion pipeline publish what happened; notifiers, streams and logs
+// subscribe to the types they care about instead of being called from the
+// producers:
+//
+//	bus := events.New(events.Hooks{})
+//	sub := bus.Subscribe("notifier", 256, "incident.*")
+//	defer sub.Close()
+//	for ev := range sub.C { ... }
+//
+//	bus.Publish(events.Event{Type: "incident.opened", Site: "SITE_A", Data: inc})
+//
+// Delivery in process never blocks a publisher: a subscriber whose buffer
+// is full loses the event, and the Dropped hook is told. Backends forward
+// every event to an external system, Kafka or NATS say, each from its own
+// queue so a slow broker holds up nobody else.
+package events
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one thing that happened. Types are dotted, the first part
+// naming the area ("freshness.transition", "incident.opened"); Data is
+// the type's payload and must marshal to JSON for backends and streams.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Site string      `json:"site,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Backend forwards events to an external system.
+type Backend interface {
+	Name() string
+	Publish(ctx context.Context, ev Event) error
+}
+
+// Hooks report what the bus cannot deliver; either may be nil.
+type Hooks struct {
+	Published    func(ev Event)
+	Dropped      func(subscriber string, ev Event)
+	BackendError func(backend string, ev Event, err error)
+}
+
+// Bus fans published events out to subscribers and backends. The zero
+// value is not usable; call New.
+type Bus struct {
+	hooks Hooks
+
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func New(hooks Hooks) *Bus {
+	return &Bus{hooks: hooks, subs: map[*Subscription]struct{}{}}
+}
+
+// Subscription receives the events matching its patterns on C until it
+// is closed.
+type Subscription struct {
+	C <-chan Event
+
+	name     string
+	patterns []string
+	c        chan Event
+	bus      *Bus
+	once     sync.Once
+}
+
+// Match reports whether pattern selects type typ: "*" selects all,
+// "incident.*" every type under incident, anything else itself.
+func Match(pattern, typ string) bool {
+	if pattern == "*" || pattern == typ {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasPrefix(typ, prefix)
+}
+
+func (s *Subscription) wants(typ string) bool {
+	if len(s.patterns) == 0 {
+		return true
+	}
+	for _, p := range s.patterns {
+		if Match(p, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe starts delivering the events matching any of patterns, all
+// of them when none are given, into a buffer of the given size. name
+// identifies the subscriber to the Dropped hook.
+func (b *Bus) Subscribe(name string, buffer int, patterns ...string) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, name: name, patterns: patterns, c: c, bus: b}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Close stops delivery and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		close(s.c)
+		s.bus.mu.Unlock()
+	})
+}
+
+// Publish delivers ev to every matching subscriber without waiting; a
+// zero Time is set to now.
+func (b *Bus) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if b.hooks.Published != nil {
+		b.hooks.Published(ev)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.wants(ev.Type) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			if b.hooks.Dropped != nil {
+				b.hooks.Dropped(s.name, ev)
+			}
+		}
+	}
+}
+
+// AddBackend forwards every event matching patterns to backend until ctx
+// ends, through a queue of the given size. Failed events are reported to
+// the BackendError hook and not retried; backends that need stronger
+// guarantees retry inside Publish.
+func (b *Bus) AddBackend(ctx context.Context, backend Backend, buffer int, patterns ...string) {
+	sub := b.Subscribe("backend:"+backend.Name(), buffer, patterns...)
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-sub.C:
+				if err := backend.Publish(ctx, ev); err != nil && b.hooks.BackendError != nil {
+					b.hooks.BackendError(backend.Name(), ev, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// execSource runs an operator-supplied program each interval and reads
+// freshness from its stdout, either {"sites": [...]} as served by dtms-api
+// or a bare array of the same records. Records that only carry
+// latest_timestamp get their age computed here. See sources.example.yml.
+type execSource struct {
+	name    string
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env"`
+	Dir     string            `yaml:"dir"`
+}
+
+func init() {
+	registerSource("exec", func(name string, params *yaml.Node) (Source, error) {
+		s := &execSource{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if len(s.Command) == 0 {
+			return nil, fmt.Errorf("command is required")
+		}
+		return s, nil
+	})
+}
+
+func (s *execSource) Name() string { return s.name }
+
+func (s *execSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Dir = s.Dir
+	cmd.Env = os.Environ()
+	for k, v := range s.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", s.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return parseSiteFreshJSON(out, time.Now())
+}
+
+func parseSiteFreshJSON(data []byte, now time.Time) ([]SiteFresh, error) {
+	data = bytes.TrimSpace(data)
+	var sites []SiteFresh
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &sites); err != nil {
+			return nil, err
+		}
+	} else {
+		var resp FreshnessResp
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, err
+		}
+		sites = resp.Sites
+	}
+
+	out := sites[:0]
+	for _, sf := range sites {
+		if sf.Site == "" {
+			continue
+		}
+		if sf.AgeSeconds == 0 && sf.LatestTimestamp > 0 {
+			sf.AgeSeconds = now.Sub(unixTime(sf.LatestTimestamp)).Seconds()
+		}
+		out = append(out, sf)
+	}
+	return out, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/youruser/dtms-fresh/tracing"
+)
+
+// With tracing on (transfertrace.go), every poll is a trace as well:
+//
+//	freshness.poll          one round of the poll loop
+//	  source.collect        each source that was due, with its site count
+//	  freshness.evaluate    judging the sites and recording the verdicts
+//
+// METRICS_EXEMPLARS=true attaches the collect span's trace_id and span_id
+// as an exemplar to each dtms_source_collect_duration_seconds observation
+// and serves /metrics as OpenMetrics when the scraper asks for it, the
+// only format that carries exemplars. Prometheus must run with
+// --enable-feature=exemplar-storage for Grafana to link a latency spike to
+// its trace.
+var metricsExemplars = envOr("METRICS_EXEMPLARS", "false") == "true"
+
+type pollSpanKey struct{}
+
+// startPoll opens the span of one poll, or returns nil without tracing.
+func startPoll(ctx context.Context, now time.Time) (context.Context, *tracing.Span) {
+	if !tracer.Enabled() {
+		return ctx, nil
+	}
+	s := &tracing.Span{TraceID: tracing.NewTraceID(), SpanID: tracing.NewSpanID(), Name: "freshness.poll", Start: now}
+	return context.WithValue(ctx, pollSpanKey{}, s.Context()), s
+}
+
+// childOfPoll opens a span below the poll ctx belongs to, if it is traced.
+func childOfPoll(ctx context.Context, name string, start time.Time) *tracing.Span {
+	parent, ok := ctx.Value(pollSpanKey{}).(tracing.SpanContext)
+	if !ok {
+		return nil
+	}
+	return parent.Child(name, start)
+}
+
+// observeCollect records a collection's duration, with span as its
+// exemplar when exemplars are on.
+func observeCollect(source string, d time.Duration, span *tracing.Span) {
+	obs := histSourceDuration.WithLabelValues(source)
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && metricsExemplars && span != nil {
+		eo.ObserveWithExemplar(d.Seconds(), prometheus.Labels{"trace_id": span.TraceID, "span_id": span.SpanID})
+		return
+	}
+	obs.Observe(d.Seconds())
+}
+
+// metricsHandler serves the default registry, as OpenMetrics to scrapers
+// that accept it when exemplars are on.
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: metricsExemplars}))
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/events"
+)
+
+// Some data arrives on a known schedule, a dataset produced daily at
+// 03:00, and is late long before its site's age threshold would notice.
+// An expected arrival registers that schedule as a cron expression
+// (cron.go) for a site, and optionally one dataset:
+//
+//	{"site": "SITE_A", "dataset": "daily-calib", "cron": "0 3 * * *",
+//	 "timezone": "Europe/Zurich", "grace_minutes": 90}
+//
+// Every scheduled time must be followed by an arrival within its grace
+// (EXPECTED_ARRIVAL_GRACE_MINUTES by default): a successful transfer
+// event of the dataset, or with no dataset any new data the site's
+// freshness source reports. Arrivals count toward the first scheduled
+// time whose deadline is still ahead of them, so one delivery cannot
+// satisfy two days. A scheduled time without an arrival is missed,
+// whatever the site's age, unless the site is in downtime at the
+// deadline. The expectation stays missed until data turns up: before the
+// next scheduled time it is the missed delivery, late, and after it it
+// counts toward that time as usual. Missed and late arrivals are
+// published as arrival.missed and arrival.late, which alert routes
+// deliver as "arrival_missed" and "arrival_late", and
+// dtms_expected_arrival_missed backs the DTMSExpectedArrivalMissed rule.
+// Expectations are registered through /api/v1/expected-arrivals and kept
+// in EXPECTED_ARRIVALS_FILE.
+var (
+	expectedArrivalsPath  = envOr("EXPECTED_ARRIVALS_FILE", filepath.Join(dataDir, "expected-arrivals.json"))
+	expectedArrivalGrace  = envOrInt("EXPECTED_ARRIVAL_GRACE_MINUTES", 60)
+	expectedArrivalsCheck = 30 * time.Second
+)
+
+const (
+	eventArrivalMissed = "arrival.missed"
+	eventArrivalLate   = "arrival.late"
+)
+
+// ExpectedArrival is a registered schedule and where its checks stand.
+type ExpectedArrival struct {
+	ID           string  `json:"id"`
+	Site         string  `json:"site"`
+	Dataset      string  `json:"dataset,omitempty"`
+	Cron         string  `json:"cron"`
+	Timezone     string  `json:"timezone,omitempty"`
+	GraceMinutes int     `json:"grace_minutes,omitempty"`
+	Author       string  `json:"author,omitempty"`
+	Created      float64 `json:"created"`
+
+	// Due is the next scheduled arrival; arrivals after WindowStart and
+	// up to its deadline count toward it, and Arrived is the first.
+	Due         float64 `json:"due"`
+	WindowStart float64 `json:"window_start"`
+	Arrived     float64 `json:"arrived,omitempty"`
+	LastArrival float64 `json:"last_arrival,omitempty"`
+	// Missed is set from the deadline of the scheduled time MissedDue
+	// until an arrival after MissedWindowStart.
+	Missed            bool    `json:"missed"`
+	MissedDue         float64 `json:"missed_due,omitempty"`
+	MissedWindowStart float64 `json:"missed_window_start,omitempty"`
+	Met               int     `json:"met"`
+	Misses            int     `json:"misses"`
+
+	sched *cronSchedule
+}
+
+func (e *ExpectedArrival) grace() time.Duration {
+	return time.Duration(e.GraceMinutes) * time.Minute
+}
+
+// compile checks the schedule and fills in the defaults.
+func (e *ExpectedArrival) compile() error {
+	if e.Site == "" {
+		return fmt.Errorf("site is required")
+	}
+	loc := time.UTC
+	if e.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(e.Timezone); err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+	}
+	sched, err := parseCron(e.Cron, loc)
+	if err != nil {
+		return err
+	}
+	if e.GraceMinutes == 0 {
+		e.GraceMinutes = expectedArrivalGrace
+	}
+	if e.GraceMinutes < 0 {
+		return fmt.Errorf("grace_minutes must be positive")
+	}
+	e.sched = sched
+	return nil
+}
+
+// labels keys e's series by its ID, so expectations sharing a site,
+// dataset and schedule keep apart; the rest only describe it.
+func (e *ExpectedArrival) labels() []string {
+	return []string{e.ID, e.Site, e.Dataset, e.Cron}
+}
+
+var (
+	expectedArrivalLabels = []string{"id", "site", "dataset", "schedule"}
+	gaugeArrivalMissed    = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_expected_arrival_missed", Help: "1 while a scheduled arrival is missed and no data has come since"},
+		expectedArrivalLabels,
+	)
+	gaugeArrivalDue = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_expected_arrival_due_timestamp_seconds", Help: "When the next scheduled arrival is expected"},
+		expectedArrivalLabels,
+	)
+	expectedArrivalChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_expected_arrival_checks_total", Help: "Scheduled arrivals checked, by result (met, missed, downtime)"},
+		append(expectedArrivalLabels, "result"),
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeArrivalMissed, gaugeArrivalDue, expectedArrivalChecks)
+}
+
+type expectedArrivalStore struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]*ExpectedArrival
+	dirty bool
+}
+
+var expectedArrivals = &expectedArrivalStore{path: expectedArrivalsPath, items: map[string]*ExpectedArrival{}}
+
+func (s *expectedArrivalStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*ExpectedArrival
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range list {
+		if err := e.compile(); err != nil {
+			return fmt.Errorf("%s: %s: %w", s.path, e.ID, err)
+		}
+		s.items[e.ID] = e
+		s.publish(e)
+	}
+	return nil
+}
+
+func (s *expectedArrivalStore) save() error {
+	list := make([]*ExpectedArrival, 0, len(s.items))
+	for _, e := range s.items {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+// publish sets e's gauges; s.mu is held.
+func (s *expectedArrivalStore) publish(e *ExpectedArrival) {
+	missed := 0.0
+	if e.Missed {
+		missed = 1
+	}
+	gaugeArrivalMissed.WithLabelValues(e.labels()...).Set(missed)
+	gaugeArrivalDue.WithLabelValues(e.labels()...).Set(e.Due)
+}
+
+func (s *expectedArrivalStore) Add(e ExpectedArrival, now time.Time) (ExpectedArrival, error) {
+	if err := e.compile(); err != nil {
+		return e, err
+	}
+	next := e.sched.next(now)
+	if next.IsZero() {
+		return e, fmt.Errorf("cron %q never matches", e.Cron)
+	}
+	id := make([]byte, 6)
+	rand.Read(id)
+	e.ID = "ea-" + hex.EncodeToString(id)
+	e.Created = float64(now.Unix())
+	e.Due, e.WindowStart = float64(next.Unix()), e.Created
+	e.Arrived, e.LastArrival, e.Missed, e.MissedDue, e.MissedWindowStart, e.Met, e.Misses = 0, 0, false, 0, 0, 0, 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[e.ID] = &e
+	s.publish(&e)
+	return e, s.save()
+}
+
+func (s *expectedArrivalStore) Get(id string) (ExpectedArrival, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[id]
+	if !ok {
+		return ExpectedArrival{}, false
+	}
+	return *e, true
+}
+
+func (s *expectedArrivalStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(s.items, id)
+	gaugeArrivalMissed.DeleteLabelValues(e.labels()...)
+	gaugeArrivalDue.DeleteLabelValues(e.labels()...)
+	expectedArrivalChecks.DeletePartialMatch(prometheus.Labels{"id": id})
+	return s.save()
+}
+
+// List returns the expectations for sites sel selects, optionally one
+// site's, or only those missed, by site, dataset and ID.
+func (s *expectedArrivalStore) List(site string, sel tagSelector, missed bool) []ExpectedArrival {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []ExpectedArrival{}
+	for _, e := range s.items {
+		if (site == "" || e.Site == site) && (!missed || e.Missed) && sel.selects(e.Site) {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Site != out[j].Site {
+			return out[i].Site < out[j].Site
+		}
+		if out[i].Dataset != out[j].Dataset {
+			return out[i].Dataset < out[j].Dataset
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Observe records a successful transfer toward its site's expectations
+// for the dataset and for any data.
+func (s *expectedArrivalStore) Observe(ev TransferEvent) {
+	if ev.Status != "success" {
+		return
+	}
+	s.arrived(ev.Site, ev.Dataset, ev.Timestamp, true)
+}
+
+// ObserveSite records the latest data a freshness source reports for
+// site toward the site's expectations for any data.
+func (s *expectedArrivalStore) ObserveSite(site string, latest float64) {
+	if latest > 0 {
+		s.arrived(site, "", latest, false)
+	}
+}
+
+func (s *expectedArrivalStore) arrived(site, dataset string, ts float64, byDataset bool) {
+	var late []ExpectedArrival
+	s.mu.Lock()
+	for _, e := range s.items {
+		if e.Site != site || (e.Dataset != "" && (!byDataset || e.Dataset != dataset)) {
+			continue
+		}
+		if ts > e.LastArrival {
+			e.LastArrival = ts
+			s.dirty = true
+		}
+		if e.Missed && ts > e.MissedWindowStart {
+			e.Missed = false
+			s.dirty = true
+			s.publish(e)
+			late = append(late, *e)
+			if ts < e.Due {
+				// the missed delivery, not the next one
+				e.WindowStart = max(e.WindowStart, ts)
+				if e.Arrived <= e.WindowStart {
+					e.Arrived = 0
+				}
+				continue
+			}
+		}
+		if ts > e.WindowStart && (e.Arrived == 0 || ts < e.Arrived) {
+			e.Arrived = ts
+			s.dirty = true
+		}
+	}
+	s.mu.Unlock()
+	for _, e := range late {
+		fmt.Printf("[expected-arrivals] site=%s dataset=%s cron=%q: arrived late\n", e.Site, e.Dataset, e.Cron)
+		bus.Publish(events.Event{Type: eventArrivalLate, Site: e.Site, Data: e})
+	}
+}
+
+// check judges every scheduled time whose deadline has passed at now.
+// Times that went by while the service was down are judged together as
+// the latest of them.
+func (s *expectedArrivalStore) check(now time.Time) {
+	var missed []ExpectedArrival
+	s.mu.Lock()
+	for _, e := range s.items {
+		due := unixTime(e.Due)
+		if e.Due == 0 || now.Before(due.Add(e.grace())) {
+			continue
+		}
+		for {
+			n := e.sched.next(due)
+			if n.IsZero() || now.Before(n.Add(e.grace())) {
+				break
+			}
+			due = n
+		}
+		deadline := due.Add(e.grace())
+		end := float64(deadline.Unix())
+		result := "met"
+		switch {
+		case e.Arrived != 0 && e.Arrived <= end:
+			e.Met++
+		case len(downtimes.Active(e.Site, deadline)) > 0:
+			result = "downtime"
+		default:
+			result = "missed"
+			e.Misses++
+			e.Missed, e.MissedDue, e.MissedWindowStart = true, float64(due.Unix()), e.WindowStart
+			missed = append(missed, *e)
+		}
+		expectedArrivalChecks.WithLabelValues(append(e.labels(), result)...).Inc()
+		e.WindowStart = end
+		switch {
+		case e.Arrived > end:
+		case e.LastArrival > end:
+			// only the latest of the arrivals since is known
+			e.Arrived = e.LastArrival
+		default:
+			e.Arrived = 0
+		}
+		e.Due = 0
+		if n := e.sched.next(due); !n.IsZero() {
+			e.Due = float64(n.Unix())
+		}
+		s.publish(e)
+		s.dirty = true
+	}
+	s.mu.Unlock()
+	for _, e := range missed {
+		fmt.Printf("[expected-arrivals] site=%s dataset=%s cron=%q: nothing arrived for %s\n",
+			e.Site, e.Dataset, e.Cron, unixTime(e.MissedDue).UTC().Format(time.RFC3339))
+		bus.Publish(events.Event{Type: eventArrivalMissed, Site: e.Site, Data: e})
+	}
+}
+
+func (s *expectedArrivalStore) loop(ctx context.Context) {
+	t := time.NewTicker(expectedArrivalsCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.check(now)
+		}
+		s.mu.Lock()
+		if s.dirty {
+			if err := s.save(); err != nil {
+				fmt.Printf("[expected-arrivals] save: %v\n", err)
+			} else {
+				s.dirty = false
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleExpectedArrivals serves GET /api/v1/expected-arrivals?site=&tags=&missed=true
+// and POST /api/v1/expected-arrivals.
+func handleExpectedArrivals(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sel, err := queryTags(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		list := expectedArrivals.List(q.Get("site"), sel, q.Get("missed") == "true")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"expected_arrivals": list})
+	case http.MethodPost:
+		caller := apiPrincipal(r)
+		if caller == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var e ExpectedArrival
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !caller.canManageSite(e.Site) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if e.Author == "" {
+			e.Author = caller.Name
+		}
+		e, err := expectedArrivals.Add(e, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, e)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExpectedArrival serves DELETE /api/v1/expected-arrivals/{id}.
+func handleExpectedArrival(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := apiPrincipal(r)
+	if caller == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/expected-arrivals/")
+	existing, ok := expectedArrivals.Get(id)
+	if !ok {
+		http.Error(w, "unknown expected arrival", http.StatusNotFound)
+		return
+	}
+	if !caller.canManageSite(existing.Site) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	err := expectedArrivals.Delete(id)
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "unknown expected arrival", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
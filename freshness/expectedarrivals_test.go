@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dueSeries returns the dtms_expected_arrival_due_timestamp_seconds values
+// by expectation ID.
+func dueSeries(t *testing.T) map[string]float64 {
+	ch := make(chan prometheus.Metric, 16)
+	gaugeArrivalDue.Collect(ch)
+	close(ch)
+	out := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range pb.Label {
+			if l.GetName() == "id" {
+				out[l.GetValue()] = pb.GetGauge().GetValue()
+			}
+		}
+	}
+	return out
+}
+
+func TestExpectedArrivalSeriesByID(t *testing.T) {
+	s := &expectedArrivalStore{path: filepath.Join(t.TempDir(), "expected-arrivals.json"), items: map[string]*ExpectedArrival{}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	spec := ExpectedArrival{Site: "SITE_A", Dataset: "daily-calib", Cron: "0 3 * * *"}
+	a, err := s.Add(spec, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.GraceMinutes = 180
+	b, err := s.Add(spec, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Delete(a.ID); s.Delete(b.ID) })
+	if got := dueSeries(t); len(got) != 2 {
+		t.Fatalf("due series %v for two expectations, want one each", got)
+	}
+	if err := s.Delete(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := dueSeries(t); len(got) != 1 || got[b.ID] != b.Due {
+		t.Errorf("due series %v after deleting %s, want only %s at %v", got, a.ID, b.ID, b.Due)
+	}
+}
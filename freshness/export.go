@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// Exports dump freshness history or ingested transfer events as CSV or
+// Parquet for offline analysis. GET /api/v1/export streams one;
+// POST /api/v1/export writes one to a destination, either s3://bucket/key
+// (S3_* settings) or a path under EXPORT_DIR. EXPORT_CONFIG schedules the
+// same as recurring jobs:
+//
+//	jobs:
+//	  - name: daily-history
+//	    dataset: history
+//	    format: parquet
+//	    every: 24h                  # exports the preceding 24h each run
+//	    columns: [timestamp, site, age_seconds, ok]
+//	    destination: s3://dtms-exports/history/{date}.parquet
+//
+// "{date}" in a destination expands to the start of the exported range.
+// Parquet columns come out in name order; CSV keeps the requested order.
+var (
+	exportDir        = envOr("EXPORT_DIR", filepath.Join(dataDir, "exports"))
+	exportConfigPath = envOr("EXPORT_CONFIG", "")
+)
+
+const (
+	colString = "string"
+	colDouble = "double"
+	colInt    = "int64"
+	colBool   = "bool"
+)
+
+type exportColumn struct {
+	Name string
+	Type string
+}
+
+// exportDataset reads rows in [from, to] for site (all when empty), values
+// in column order.
+type exportDataset struct {
+	columns []exportColumn
+	read    func(site string, from, to time.Time) ([][]interface{}, error)
+}
+
+var exportDatasets = map[string]exportDataset{
+	"history": {
+		columns: []exportColumn{
+			{"timestamp", colDouble}, {"site", colString}, {"latest_timestamp", colDouble},
+			{"age_seconds", colDouble}, {"ok", colBool},
+		},
+		read: func(site string, from, to time.Time) ([][]interface{}, error) {
+			samples, err := history.Query(site, from, to)
+			out := make([][]interface{}, 0, len(samples))
+			for _, s := range samples {
+				out = append(out, []interface{}{s.Timestamp, s.Site, s.LatestTimestamp, s.AgeSeconds, s.Ok})
+			}
+			return out, err
+		},
+	},
+	"transfers": {
+		columns: []exportColumn{
+			{"timestamp", colDouble}, {"site", colString}, {"bytes", colInt},
+			{"duration", colDouble}, {"throughput_bytes_per_sec", colDouble}, {"status", colString},
+		},
+		read: readTransferRows,
+	},
+}
+
+// readTransferRows scans transfers.csv. Columns are found by header name
+// since the exporters writing the same file may add their own.
+func readTransferRows(site string, from, to time.Time) ([][]interface{}, error) {
+	f, err := os.Open(transfersCSV)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := map[string]int{}
+	for i, h := range header {
+		idx[h] = i
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := idx[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	lo, hi := float64(from.Unix()), float64(to.Unix())
+	var out [][]interface{}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		ts, _ := strconv.ParseFloat(field(rec, "timestamp_unix"), 64)
+		s := field(rec, "site")
+		if ts < lo || ts > hi || (site != "" && s != site) {
+			continue
+		}
+		bytes, _ := strconv.ParseInt(field(rec, "bytes"), 10, 64)
+		dur, _ := strconv.ParseFloat(field(rec, "duration"), 64)
+		tput, _ := strconv.ParseFloat(field(rec, "throughput_bytes_per_sec"), 64)
+		out = append(out, []interface{}{ts, s, bytes, dur, tput, field(rec, "status")})
+	}
+	return out, nil
+}
+
+// exportSpec describes one export; From and To are unix seconds.
+type exportSpec struct {
+	Dataset     string   `json:"dataset" yaml:"dataset"`
+	Format      string   `json:"format" yaml:"format"`
+	Site        string   `json:"site,omitempty" yaml:"site"`
+	From        float64  `json:"from,omitempty" yaml:"-"`
+	To          float64  `json:"to,omitempty" yaml:"-"`
+	Columns     []string `json:"columns,omitempty" yaml:"columns"`
+	Destination string   `json:"destination,omitempty" yaml:"destination"`
+}
+
+// plan resolves the dataset and the selected columns, by index.
+func (s exportSpec) plan() (exportDataset, []int, error) {
+	ds, ok := exportDatasets[s.Dataset]
+	if !ok {
+		return ds, nil, fmt.Errorf("unknown dataset %q (history or transfers)", s.Dataset)
+	}
+	if s.Format != "csv" && s.Format != "parquet" {
+		return ds, nil, fmt.Errorf("unknown format %q (csv or parquet)", s.Format)
+	}
+	if len(s.Columns) == 0 {
+		cols := make([]int, len(ds.columns))
+		for i := range cols {
+			cols[i] = i
+		}
+		return ds, cols, nil
+	}
+	var cols []int
+	for _, name := range s.Columns {
+		i := -1
+		for j, c := range ds.columns {
+			if c.Name == name {
+				i = j
+			}
+		}
+		if i < 0 {
+			return ds, nil, fmt.Errorf("dataset %s has no column %q", s.Dataset, name)
+		}
+		cols = append(cols, i)
+	}
+	return ds, cols, nil
+}
+
+func (s exportSpec) contentType() string {
+	if s.Format == "parquet" {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// write runs the export into w and returns the number of rows.
+func (s exportSpec) write(w io.Writer) (int, error) {
+	ds, cols, err := s.plan()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := ds.read(s.Site, unixTime(s.From), unixTime(s.To))
+	if err != nil {
+		return 0, err
+	}
+	if s.Format == "parquet" {
+		return len(rows), writeParquet(w, s.Dataset, ds.columns, cols, rows)
+	}
+	cw := csv.NewWriter(w)
+	rec := make([]string, len(cols))
+	for i, c := range cols {
+		rec[i] = ds.columns[c].Name
+	}
+	cw.Write(rec)
+	for _, row := range rows {
+		for i, c := range cols {
+			switch v := row[c].(type) {
+			case float64:
+				rec[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				rec[i] = fmt.Sprint(v)
+			}
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return len(rows), cw.Error()
+}
+
+func writeParquet(w io.Writer, name string, columns []exportColumn, cols []int, rows [][]interface{}) error {
+	group := parquet.Group{}
+	for _, c := range cols {
+		switch columns[c].Type {
+		case colString:
+			group[columns[c].Name] = parquet.String()
+		case colDouble:
+			group[columns[c].Name] = parquet.Leaf(parquet.DoubleType)
+		case colInt:
+			group[columns[c].Name] = parquet.Int(64)
+		case colBool:
+			group[columns[c].Name] = parquet.Leaf(parquet.BooleanType)
+		}
+	}
+	// Group fields, and so column indexes, are in name order.
+	order := append([]int(nil), cols...)
+	sort.Slice(order, func(i, j int) bool { return columns[order[i]].Name < columns[order[j]].Name })
+
+	pw := parquet.NewWriter(w, parquet.NewSchema(name, group), parquet.Compression(&parquet.Zstd))
+	batch := make([]parquet.Row, 0, 1024)
+	for n, row := range rows {
+		pr := make(parquet.Row, len(order))
+		for i, c := range order {
+			pr[i] = parquet.ValueOf(row[c]).Level(0, 0, i)
+		}
+		batch = append(batch, pr)
+		if len(batch) == cap(batch) || n == len(rows)-1 {
+			if _, err := pw.WriteRows(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return pw.Close()
+}
+
+// deliver runs the export and stores it at its destination.
+func (s exportSpec) deliver(ctx context.Context) (int, error) {
+	var buf bytes.Buffer
+	n, err := s.write(&buf)
+	if err != nil {
+		return 0, err
+	}
+	dest := strings.ReplaceAll(s.Destination, "{date}", unixTime(s.From).Format("2006-01-02"))
+	if bucketKey, ok := strings.CutPrefix(dest, "s3://"); ok {
+		bucket, key, _ := strings.Cut(bucketKey, "/")
+		if bucket == "" || key == "" {
+			return 0, fmt.Errorf("destination %q needs a bucket and key", dest)
+		}
+		return n, s3SettingsFromEnv().put(ctx, bucket, key, s.contentType(), buf.Bytes())
+	}
+	path := filepath.Join(exportDir, filepath.Clean("/"+dest))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	return n, writeFileAtomic(path, buf.Bytes())
+}
+
+type exportJob struct {
+	Name       string        `yaml:"name"`
+	Every      time.Duration `yaml:"every"`
+	exportSpec `yaml:",inline"`
+}
+
+var exportJobs []exportJob
+
+func loadExportJobs() error {
+	if exportConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(exportConfigPath)
+	if err != nil {
+		return err
+	}
+	var c struct {
+		Jobs []exportJob `yaml:"jobs"`
+	}
+	if err := yamlenv.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("%s: %w", exportConfigPath, err)
+	}
+	for i := range c.Jobs {
+		j := &c.Jobs[i]
+		if j.Format == "" {
+			j.Format = "csv"
+		}
+		if _, _, err := j.plan(); err != nil {
+			return fmt.Errorf("%s: job %s: %w", exportConfigPath, j.Name, err)
+		}
+		if j.Every <= 0 || j.Destination == "" {
+			return fmt.Errorf("%s: job %s needs every and destination", exportConfigPath, j.Name)
+		}
+	}
+	exportJobs = c.Jobs
+	return nil
+}
+
+// exportLoop runs each job at the end of every period aligned to its
+// interval, exporting that period.
+func exportLoop(ctx context.Context) {
+	next := make([]time.Time, len(exportJobs))
+	for i, j := range exportJobs {
+		next[i] = time.Now().Truncate(j.Every).Add(j.Every)
+	}
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		for i, j := range exportJobs {
+			if now.Before(next[i]) {
+				continue
+			}
+			spec := j.exportSpec
+			spec.From = float64(next[i].Add(-j.Every).Unix())
+			spec.To = float64(next[i].Unix()) - 0.001
+			next[i] = next[i].Add(j.Every)
+			n, err := spec.deliver(ctx)
+			if err != nil {
+				fmt.Printf("[export] job %s: %v\n", j.Name, err)
+				continue
+			}
+			fmt.Printf("[export] job %s: %d rows to %s\n", j.Name, n, spec.Destination)
+		}
+	}
+}
+
+// handleExport serves GET /api/v1/export?dataset=&format=&site=&from=&to=&columns=a,b,
+// streaming the file, and POST /api/v1/export with an exportSpec body,
+// writing it to the spec's destination. Ranges default to the last day.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		spec := exportSpec{Dataset: q.Get("dataset"), Format: q.Get("format"), Site: q.Get("site")}
+		spec.From, spec.To = queryRange(r)
+		if spec.Format == "" {
+			spec.Format = "csv"
+		}
+		if c := q.Get("columns"); c != "" {
+			spec.Columns = strings.Split(c, ",")
+		}
+		if _, _, err := spec.plan(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", spec.contentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", spec.Dataset+"."+spec.Format))
+		zw := compressResponse(w, r)
+		if _, err := spec.write(zw); err != nil {
+			fmt.Printf("[export] %s: %v\n", spec.Dataset, err)
+		}
+		zw.Close()
+	case http.MethodPost:
+		if !apiAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var spec exportSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if spec.Format == "" {
+			spec.Format = "csv"
+		}
+		if spec.To == 0 {
+			spec.To = float64(time.Now().Unix())
+		}
+		if spec.From == 0 {
+			spec.From = spec.To - 86400
+		}
+		if _, _, err := spec.plan(); err != nil || spec.Destination == "" {
+			if err == nil {
+				err = fmt.Errorf("destination is required")
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := spec.deliver(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"destination": spec.Destination, "rows": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
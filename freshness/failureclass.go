@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// FAILURE_CLASSES_CONFIG replaces the built-in failure ruleset. Rules are
+// tried in order and the first pattern matching the event's reason wins:
+//
+//	rules:
+//	  - class: tape-recall
+//	    pattern: (?i)staging (timed out|failed)
+//	  - class: network
+//	    pattern: (?i)connection reset
+var failureClassesPath = envOr("FAILURE_CLASSES_CONFIG", "")
+
+type failureRule struct {
+	Class   string `yaml:"class"`
+	Pattern string `yaml:"pattern"`
+
+	re *regexp.Regexp
+}
+
+var defaultFailureRules = []failureRule{
+	{Class: "checksum", Pattern: `(?i)checksum|adler32|md5 mismatch|integrity`},
+	{Class: "quota", Pattern: `(?i)quota`},
+	{Class: "destination-full", Pattern: `(?i)no space left|disk full|insufficient (space|storage)|enospc|pool.* full`},
+	{Class: "auth", Pattern: `(?i)permission denied|unauthori[sz]ed|forbidden|authenticat|credential|(token|proxy).* expired|\b40[13]\b`},
+	{Class: "network", Pattern: `(?i)timed? ?out|connection (refused|reset|closed)|network|socket|unreachable|no route|broken pipe|\beof\b`},
+}
+
+var failureRules = mustCompileFailureRules(defaultFailureRules)
+
+var transferFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_transfer_failures_total", Help: "Failed transfers by site and failure class"},
+	[]string{"site", "class"},
+)
+
+func init() {
+	prometheus.MustRegister(transferFailures)
+}
+
+func compileFailureRules(rules []failureRule) ([]failureRule, error) {
+	for i := range rules {
+		if rules[i].Class == "" {
+			return nil, fmt.Errorf("rule %d: class is required", i)
+		}
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rules[i].Class, err)
+		}
+		rules[i].re = re
+	}
+	return rules, nil
+}
+
+func mustCompileFailureRules(rules []failureRule) []failureRule {
+	out, err := compileFailureRules(rules)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func loadFailureRules() error {
+	if failureClassesPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(failureClassesPath)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Rules []failureRule `yaml:"rules"`
+	}
+	if err := yamlenv.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("%s: %w", failureClassesPath, err)
+	}
+	rules, err := compileFailureRules(f.Rules)
+	if err != nil {
+		return fmt.Errorf("%s: %w", failureClassesPath, err)
+	}
+	failureRules = rules
+	return nil
+}
+
+// classifyFailure maps a failure reason to its class; reasons no rule
+// recognises are "other", and failures reported without one "unknown".
+func classifyFailure(reason string) string {
+	if reason == "" {
+		return "unknown"
+	}
+	for _, r := range failureRules {
+		if r.re.MatchString(reason) {
+			return r.Class
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// FEDERATION_CONFIG makes this instance the central one of a federation of
+// regional DTMS instances:
+//
+//	interval: 30s       # how often pulled regions are asked
+//	stale_after: 5m     # a region not heard from for this long is down
+//	regions:
+//	  - name: eu
+//	    url: https://dtms-eu.example.org
+//	    token: ${DTMS_EU_TOKEN}
+//	    ca_file: /etc/dtms/ca.pem
+//	  - name: us
+//	    token: ${DTMS_US_TOKEN}   # no url: the region pushes
+//
+// Regions with a url are pulled: their /api/v1/sites and open incidents
+// are fetched every interval, with token as the bearer token. The others
+// push the same report to /api/v1/federation/push?region=NAME,
+// authenticated by their token before the report is read (without
+// ?region= the token alone has to pick out the region). A regional instance pushes when FEDERATION_PUSH_URL names the
+// central instance, as FEDERATION_REGION with FEDERATION_PUSH_TOKEN, every
+// FEDERATION_PUSH_SECONDS.
+//
+// GET /api/v1/federation?region=&tags= is the global view: each region's
+// state, and every site and open incident labelled with its region. A
+// site reported by several regions is shown once, from the first region
+// in the config that is up, or the first at all when none is. The last
+// report of each region is kept, in FEDERATION_STATE across restarts, so
+// a region that goes away stays visible, marked down, with what it last
+// said. /api/v1/global/freshness resolves shared sites by their latest
+// arrival instead (globalfreshness.go).
+var (
+	federationConfigPath = envOr("FEDERATION_CONFIG", "")
+	federationStatePath  = envOr("FEDERATION_STATE", filepath.Join(dataDir, "federation.json"))
+	federationPushURL    = envOr("FEDERATION_PUSH_URL", "")
+	federationRegion     = envOr("FEDERATION_REGION", "")
+	federationPushToken  = envOr("FEDERATION_PUSH_TOKEN", "")
+	federationPushEvery  = time.Duration(envOrInt("FEDERATION_PUSH_SECONDS", 30)) * time.Second
+)
+
+type federationRegionConfig struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	http *http.Client
+}
+
+type federationConfig struct {
+	Interval   time.Duration            `yaml:"interval"`
+	StaleAfter time.Duration            `yaml:"stale_after"`
+	Regions    []federationRegionConfig `yaml:"regions"`
+}
+
+// RegionReport is what a regional instance tells the central one.
+type RegionReport struct {
+	Region    string     `json:"region"`
+	Generated float64    `json:"generated"`
+	Sites     []SiteTags `json:"sites"`
+	Incidents []Incident `json:"incidents"`
+}
+
+// FederatedRegion is a region's state as the central instance sees it.
+type FederatedRegion struct {
+	Name          string  `json:"name"`
+	Mode          string  `json:"mode"`
+	Up            bool    `json:"up"`
+	LastReport    float64 `json:"last_report,omitempty"`
+	LastAttempt   float64 `json:"last_attempt,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	Sites         int     `json:"sites"`
+	OpenIncidents int     `json:"open_incidents"`
+}
+
+// FederatedSite is a site in the global view. AlsoIn lists the other
+// regions reporting it.
+type FederatedSite struct {
+	SiteTags
+	Region   string   `json:"region"`
+	RegionUp bool     `json:"region_up"`
+	AlsoIn   []string `json:"also_in,omitempty"`
+}
+
+// FederatedIncident is an open incident of the region a site is shown from.
+type FederatedIncident struct {
+	Incident
+	Region string `json:"region"`
+}
+
+// regionState is kept per region; report is nil until it first reports.
+type regionState struct {
+	Report      *RegionReport `json:"report,omitempty"`
+	Received    float64       `json:"received,omitempty"`
+	LastAttempt float64       `json:"last_attempt,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	// Availability counts the checks that found the region up, by hour
+	// (globalfreshness.go).
+	Availability []availabilityBucket `json:"availability,omitempty"`
+}
+
+type federationStore struct {
+	mu      sync.Mutex
+	path    string
+	cfg     federationConfig
+	regions map[string]*regionState
+}
+
+var federation = &federationStore{path: federationStatePath, regions: map[string]*regionState{}}
+
+var (
+	federationReports = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_federation_reports_total", Help: "Region reports pulled or pushed, by region and result"},
+		[]string{"region", "result"},
+	)
+	gaugeFederationReport = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_federation_region_report_timestamp_seconds", Help: "When a region's last report was received"},
+		[]string{"region"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(federationReports, gaugeFederationReport)
+}
+
+func loadFederation() error {
+	if federationPushURL != "" && (federationRegion == "" || federationPushToken == "") {
+		return fmt.Errorf("FEDERATION_PUSH_URL needs FEDERATION_REGION and FEDERATION_PUSH_TOKEN")
+	}
+	if federationConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(federationConfigPath)
+	if err != nil {
+		return err
+	}
+	cfg := federationConfig{Interval: 30 * time.Second, StaleAfter: 5 * time.Minute}
+	if err := yamlenv.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", federationConfigPath, err)
+	}
+	if cfg.Interval <= 0 || cfg.StaleAfter <= 0 {
+		return fmt.Errorf("%s: interval and stale_after must be positive", federationConfigPath)
+	}
+	seen := map[string]bool{}
+	for i := range cfg.Regions {
+		r := &cfg.Regions[i]
+		switch {
+		case r.Name == "":
+			return fmt.Errorf("%s: region %d: name is required", federationConfigPath, i)
+		case seen[r.Name]:
+			return fmt.Errorf("%s: region %s listed twice", federationConfigPath, r.Name)
+		case r.URL == "" && r.Token == "":
+			return fmt.Errorf("%s: region %s: a pushing region needs a token", federationConfigPath, r.Name)
+		}
+		seen[r.Name] = true
+		if r.URL != "" {
+			if r.http, err = httpClientFor(r.CAFile, r.CertFile, r.KeyFile); err != nil {
+				return fmt.Errorf("%s: region %s: %w", federationConfigPath, r.Name, err)
+			}
+		}
+	}
+	federation.mu.Lock()
+	defer federation.mu.Unlock()
+	federation.cfg = cfg
+	raw, err = os.ReadFile(federation.path)
+	if err == nil {
+		if err := json.Unmarshal(raw, &federation.regions); err != nil {
+			return fmt.Errorf("%s: %w", federation.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for name := range federation.regions {
+		if !seen[name] {
+			delete(federation.regions, name)
+		}
+	}
+	for _, r := range cfg.Regions {
+		if federation.regions[r.Name] == nil {
+			federation.regions[r.Name] = &regionState{}
+		}
+	}
+	return nil
+}
+
+func (f *federationStore) enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.cfg.Regions) > 0
+}
+
+func (f *federationStore) region(name string) *federationRegionConfig {
+	for i := range f.cfg.Regions {
+		if f.cfg.Regions[i].Name == name {
+			return &f.cfg.Regions[i]
+		}
+	}
+	return nil
+}
+
+// pushRegion returns the pushing region tok authenticates: the one named,
+// or when none is, the only one with that token. f.mu is held.
+func (f *federationStore) pushRegion(name, tok string) string {
+	found := ""
+	for _, rc := range f.cfg.Regions {
+		if rc.URL != "" || name != "" && rc.Name != name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(rc.Token)) == 1 {
+			if found != "" {
+				return ""
+			}
+			found = rc.Name
+		}
+	}
+	return found
+}
+
+func (f *federationStore) save() error {
+	raw, err := json.Marshal(f.regions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, raw)
+}
+
+// record stores the outcome of asking region for a report at now; a
+// failed attempt keeps the last report.
+func (f *federationStore) record(region string, rep *RegionReport, err error, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.regions[region]
+	if st == nil {
+		return
+	}
+	st.LastAttempt = float64(now.Unix())
+	if err != nil {
+		if st.Error == "" {
+			fmt.Printf("[federation] region %s: %v\n", region, err)
+		}
+		st.Error = err.Error()
+		federationReports.WithLabelValues(region, "error").Inc()
+		return
+	}
+	if st.Error != "" {
+		fmt.Printf("[federation] region %s reporting again\n", region)
+	}
+	rep.Region = region
+	st.Report, st.Received, st.Error = rep, float64(now.Unix()), ""
+	federationReports.WithLabelValues(region, "ok").Inc()
+	gaugeFederationReport.WithLabelValues(region).Set(st.Received)
+	if err := f.save(); err != nil {
+		fmt.Printf("[federation] save error: %v\n", err)
+	}
+}
+
+// up reports whether a region's last word is recent and was not a failure.
+func (f *federationStore) up(st *regionState, now time.Time) bool {
+	return st.Report != nil && st.Error == "" && now.Sub(unixTime(st.Received)) <= f.cfg.StaleAfter
+}
+
+// loop pulls the regions that have a url every interval until ctx is done.
+func (f *federationStore) loop(ctx context.Context) {
+	t := time.NewTicker(f.cfg.Interval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for i := range f.cfg.Regions {
+			r := &f.cfg.Regions[i]
+			if r.URL == "" {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rep, err := r.pull(ctx)
+				f.record(r.Name, rep, err, time.Now())
+			}()
+		}
+		wg.Wait()
+		f.observeAvailability(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (r *federationRegionConfig) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(r.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// pull fetches a region's sites and open incidents.
+func (r *federationRegionConfig) pull(ctx context.Context) (*RegionReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var sites struct {
+		Sites []SiteTags `json:"sites"`
+	}
+	if err := r.get(ctx, "/api/v1/sites", &sites); err != nil {
+		return nil, err
+	}
+	var open struct {
+		Incidents []Incident `json:"incidents"`
+	}
+	if err := r.get(ctx, "/api/v1/incidents?status="+incidentOpen, &open); err != nil {
+		return nil, err
+	}
+	return &RegionReport{Generated: float64(time.Now().Unix()), Sites: sites.Sites, Incidents: open.Incidents}, nil
+}
+
+// localReport is this instance's own report as a region.
+func localReport(now time.Time) RegionReport {
+	return RegionReport{
+		Region:    federationRegion,
+		Generated: float64(now.Unix()),
+		Sites:     listSites(nil),
+		Incidents: incidents.List("", incidentOpen, 0, float64(now.Unix())),
+	}
+}
+
+// federationPushLoop sends this region's report to the central instance
+// every FEDERATION_PUSH_SECONDS until ctx is done.
+func federationPushLoop(ctx context.Context) {
+	t := time.NewTicker(federationPushEvery)
+	defer t.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := pushRegionReport(ctx, localReport(time.Now()))
+		switch {
+		case err != nil && !failing:
+			fmt.Printf("[federation] push to %s: %v\n", federationPushURL, err)
+		case err == nil && failing:
+			fmt.Printf("[federation] push to %s recovered\n", federationPushURL)
+		}
+		failing = err != nil
+	}
+}
+
+func pushRegionReport(ctx context.Context, rep RegionReport) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(federationPushURL, "/")+"/api/v1/federation/push?region="+url.QueryEscape(rep.Region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+federationPushToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// view builds the global view of the regions named, all when empty, and
+// the sites sel matches.
+func (f *federationStore) view(only string, sel tagSelector, now time.Time) ([]FederatedRegion, []FederatedSite, []FederatedIncident) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	regions := []FederatedRegion{}
+	sites := map[string]*FederatedSite{}
+	var order []string
+	// up regions claim their sites first, then the rest in config order
+	for _, pass := range []bool{true, false} {
+		for _, rc := range f.cfg.Regions {
+			st := f.regions[rc.Name]
+			up := f.up(st, now)
+			if up != pass || (only != "" && rc.Name != only) {
+				continue
+			}
+			if st.Report == nil {
+				continue
+			}
+			for _, s := range st.Report.Sites {
+				if !sel.matches(s.Tags) {
+					continue
+				}
+				if fs := sites[s.Site]; fs != nil {
+					fs.AlsoIn = append(fs.AlsoIn, rc.Name)
+					continue
+				}
+				sites[s.Site] = &FederatedSite{SiteTags: s, Region: rc.Name, RegionUp: up}
+				order = append(order, s.Site)
+			}
+		}
+	}
+	var open []FederatedIncident
+	for _, rc := range f.cfg.Regions {
+		if only != "" && rc.Name != only {
+			continue
+		}
+		st := f.regions[rc.Name]
+		r := FederatedRegion{Name: rc.Name, Mode: "push", Up: f.up(st, now), LastReport: st.Received, LastAttempt: st.LastAttempt, Error: st.Error}
+		if rc.URL != "" {
+			r.Mode = "pull"
+		}
+		if st.Report != nil {
+			r.Sites, r.OpenIncidents = len(st.Report.Sites), len(st.Report.Incidents)
+			for _, inc := range st.Report.Incidents {
+				if fs := sites[inc.Site]; fs != nil && fs.Region == rc.Name {
+					open = append(open, FederatedIncident{Incident: inc, Region: rc.Name})
+				}
+			}
+		}
+		regions = append(regions, r)
+	}
+	out := make([]FederatedSite, 0, len(order))
+	for _, name := range order {
+		out = append(out, *sites[name])
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	sort.Slice(open, func(i, j int) bool { return open[i].Start < open[j].Start })
+	return regions, out, open
+}
+
+// handleFederation serves GET /api/v1/federation?region=&tags=.
+func handleFederation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !federation.enabled() {
+		http.Error(w, "federation is not configured", http.StatusNotFound)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regions, sites, open := federation.view(r.URL.Query().Get("region"), sel, time.Now())
+	if open == nil {
+		open = []FederatedIncident{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"regions": regions, "sites": sites, "incidents": open})
+}
+
+// handleFederationPush serves POST /api/v1/federation/push for regions
+// that push their reports.
+func handleFederationPush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	federation.mu.Lock()
+	name := federation.pushRegion(r.URL.Query().Get("region"), tok)
+	federation.mu.Unlock()
+	if name == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var rep RegionReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 32<<20)).Decode(&rep); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rep.Region != name {
+		http.Error(w, fmt.Sprintf("report is for region %q, not %q", rep.Region, name), http.StatusBadRequest)
+		return
+	}
+	federation.record(rep.Region, &rep, nil, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readTracker notes whether the handler read the body at all.
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestFederationPushAuthenticatesFirst(t *testing.T) {
+	prev := federation
+	t.Cleanup(func() { federation = prev })
+	federation = &federationStore{
+		path: filepath.Join(t.TempDir(), "federation.json"),
+		cfg: federationConfig{Regions: []federationRegionConfig{
+			{Name: "eu", URL: "https://dtms-eu.example.org", Token: "tok-eu"},
+			{Name: "us", Token: "tok-us"},
+			{Name: "ap", Token: "tok-ap"},
+		}},
+		regions: map[string]*regionState{"eu": {}, "us": {}, "ap": {}},
+	}
+	for _, tc := range []struct {
+		name, query, token, body string
+		want                     int
+		wantRead                 bool
+	}{
+		{"no token", "?region=us", "", `{"region":"us"}`, http.StatusUnauthorized, false},
+		{"wrong token", "?region=us", "tok-ap", `{"region":"us"}`, http.StatusUnauthorized, false},
+		{"unknown region", "?region=xx", "tok-us", `{"region":"xx"}`, http.StatusUnauthorized, false},
+		{"pulled region", "?region=eu", "tok-eu", `{"region":"eu"}`, http.StatusUnauthorized, false},
+		{"garbage from a stranger", "", "nope", strings.Repeat("x", 1<<20), http.StatusUnauthorized, false},
+		{"named region", "?region=us", "tok-us", `{"region":"us"}`, http.StatusNoContent, true},
+		{"region from the token", "", "tok-ap", `{"region":"ap"}`, http.StatusNoContent, true},
+		{"report for another region", "?region=us", "tok-us", `{"region":"ap"}`, http.StatusBadRequest, true},
+		{"bad body", "?region=us", "tok-us", `{`, http.StatusBadRequest, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := &readTracker{Reader: strings.NewReader(tc.body)}
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/federation/push"+tc.query, body)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			handleFederationPush(w, r)
+			if w.Code != tc.want || body.read != tc.wantRead {
+				t.Errorf("status %d, body read %v; want %d, %v", w.Code, body.read, tc.want, tc.wantRead)
+			}
+		})
+	}
+	if federation.regions["us"].Report == nil || federation.regions["ap"].Report == nil {
+		t.Error("accepted reports were not recorded")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FILE_TARGETS maps sites to glob patterns. Sites are separated by ';' and
+// a site's patterns by the path list separator (':' on Unix), e.g.
+// "LEGACY_NFS=/mnt/nfs/drop/*.dat:/mnt/nfs/drop/*/*.dat;SCRATCH=/scratch/**".
+// Patterns containing either separator need the list form in sources.yml. A
+// pattern ending in "/**" walks that directory recursively.
+var fileTargets = envOr("FILE_TARGETS", "")
+
+// fileSource's targets map sites to glob patterns.
+type fileSource struct {
+	name    string
+	Targets map[string][]string `yaml:"targets"`
+}
+
+func init() {
+	registerSource("files", func(name string, params *yaml.Node) (Source, error) {
+		s := &fileSource{name: name}
+		return s, params.Decode(s)
+	})
+}
+
+func fileFromEnv() *fileSource {
+	s := &fileSource{name: "files", Targets: map[string][]string{}}
+	for _, entry := range strings.Split(fileTargets, ";") {
+		site, patterns, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && site != "" {
+			s.Targets[site] = filepath.SplitList(patterns)
+		}
+	}
+	return s
+}
+
+func (s *fileSource) Name() string { return s.name }
+
+// Collect reports each target's age as the time since its newest matching
+// file was modified.
+func (s *fileSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	var out []SiteFresh
+	for site, patterns := range s.Targets {
+		var newest time.Time
+		for _, pattern := range patterns {
+			if ctx.Err() != nil {
+				return out, ctx.Err()
+			}
+			t, err := newestMtime(strings.TrimSpace(pattern))
+			if err != nil {
+				return out, fmt.Errorf("%s: %w", site, err)
+			}
+			if t.After(newest) {
+				newest = t
+			}
+		}
+		if newest.IsZero() {
+			fmt.Printf("[%s] site=%s: no files match %v\n", s.name, site, patterns)
+			continue
+		}
+		out = append(out, SiteFresh{
+			Site:            site,
+			LatestTimestamp: float64(newest.Unix()),
+			AgeSeconds:      now.Sub(newest).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+func newestMtime(pattern string) (time.Time, error) {
+	var newest time.Time
+	consider := func(info fs.FileInfo) {
+		if info.Mode().IsRegular() && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// unreadable subtrees on flaky mounts should not hide the rest
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				consider(info)
+			}
+			return nil
+		})
+		return newest, err
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return newest, err
+	}
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil {
+			consider(info)
+		}
+	}
+	return newest, nil
+}
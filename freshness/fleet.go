@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fleet-level views of freshness that don't need a per-site dashboard: the
+// age quantiles across all sites at the last poll, and a histogram that
+// gets every site's age each poll so histogram_quantile() can look back
+// over any range.
+var fleetQuantiles = []float64{0.5, 0.9, 0.99}
+
+var (
+	histFreshAge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dtms_data_fresh_age_distribution_seconds",
+		Help:    "Site ages, observed once per site per poll",
+		Buckets: []float64{30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 14400, 43200, 86400, 172800, 604800},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(histFreshAge)
+}
+
+// quantile returns the nearest-rank q-quantile of sorted.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// publishFleet summarises one poll's samples into m.
+func publishFleet(samples []HistorySample, m *metricSnapshot) {
+	ages := make([]float64, 0, len(samples))
+	ok := 0
+	for _, s := range samples {
+		ages = append(ages, s.AgeSeconds)
+		histFreshAge.Observe(s.AgeSeconds)
+		if s.Ok {
+			ok++
+		}
+	}
+	sort.Float64s(ages)
+	for _, q := range fleetQuantiles {
+		m.fleetAge[q] = quantile(ages, q)
+	}
+	m.fleetOk, m.fleetSick = ok, len(samples)-ok
+	m.hasFleet = true
+}
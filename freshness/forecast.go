@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A site's age grows by one second per second while nothing arrives and
+// drops whenever data does. Fitting a line through the last
+// FORECAST_WINDOW_SAMPLES polls gives the rate the age is actually
+// growing at, and from it the time left until the site's threshold is
+// crossed. The gauge is only set while a breach is predicted: a site whose
+// age is flat or falling has no series.
+var forecastWindow = envOrInt("FORECAST_WINDOW_SAMPLES", 10)
+
+var gaugePredictedBreach = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "dtms_data_fresh_predicted_breach_seconds", Help: "Predicted seconds until the site's age crosses its threshold (0 once crossed)"},
+	[]string{"site"},
+)
+
+func init() {
+	prometheus.MustRegister(gaugePredictedBreach)
+}
+
+type agePoint struct {
+	t   float64
+	age float64
+}
+
+type breachForecaster struct {
+	mu     sync.Mutex
+	points map[string][]agePoint
+}
+
+var forecaster = &breachForecaster{points: map[string][]agePoint{}}
+
+// slope is the least-squares rate of age growth over pts, in seconds per
+// second.
+func slope(pts []agePoint) float64 {
+	n := float64(len(pts))
+	var st, sa, stt, sta float64
+	for _, p := range pts {
+		st += p.t
+		sa += p.age
+		stt += p.t * p.t
+		sta += p.t * p.age
+	}
+	den := n*stt - st*st
+	if den == 0 {
+		return 0
+	}
+	return (n*sta - st*sa) / den
+}
+
+// Predict returns the seconds until site crosses threshold, and false when
+// no breach is in sight.
+func (f *breachForecaster) Predict(site string, age, threshold float64, now time.Time) (float64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	window := forecastWindow
+	if window < 2 {
+		window = 2
+	}
+	pts := append(f.points[site], agePoint{t: float64(now.Unix()), age: age})
+	if len(pts) > window {
+		pts = pts[len(pts)-window:]
+	}
+	f.points[site] = pts
+	if age >= threshold {
+		return 0, true
+	}
+	if len(pts) < 2 {
+		return 0, false
+	}
+	// Fit on times relative to the first point so the sums stay small.
+	rel := make([]agePoint, len(pts))
+	for i, p := range pts {
+		rel[i] = agePoint{t: p.t - pts[0].t, age: p.age}
+	}
+	rate := slope(rel)
+	if rate <= 0 {
+		return 0, false
+	}
+	return (threshold - age) / rate, true
+}
+
+// Observe updates the site's forecast gauge.
+func (f *breachForecaster) Observe(s SiteFresh, now time.Time) {
+	if eta, ok := f.Predict(s.Site, s.AgeSeconds, siteRegistry().lookup(s.Site).Threshold, now); ok {
+		gaugePredictedBreach.WithLabelValues(s.Site).Set(eta)
+	} else {
+		gaugePredictedBreach.DeleteLabelValues(s.Site)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// diffLookback is how far back a rebuilt snapshot looks for a site's
+// last sample.
+func diffLookback() time.Duration {
+	return time.Duration(max(3*interval, 300)) * time.Second
+}
+
+type snapshotRef struct {
+	Requested float64 `json:"requested"`
+	Evaluated float64 `json:"evaluated"`
+	Sites     int     `json:"sites"`
+	Stale     int     `json:"stale"`
+}
+
+type siteChange struct {
+	Site      string  `json:"site"`
+	FromOk    bool    `json:"from_ok"`
+	ToOk      bool    `json:"to_ok"`
+	FromAge   float64 `json:"from_age_seconds"`
+	ToAge     float64 `json:"to_age_seconds"`
+	Delta     float64 `json:"delta_seconds"`
+	Threshold float64 `json:"threshold_seconds"`
+}
+
+type FreshnessDiff struct {
+	Source      string          `json:"source"`
+	From        snapshotRef     `json:"from"`
+	To          snapshotRef     `json:"to"`
+	BecameStale []siteChange    `json:"became_stale"`
+	Recovered   []siteChange    `json:"recovered"`
+	Appeared    []evaluatedSite `json:"appeared"`
+	Disappeared []evaluatedSite `json:"disappeared"`
+	Largest     []siteChange    `json:"largest_deltas"`
+}
+
+// snapshotAt returns the snapshot in force at t and where it came from.
+func snapshotAt(ctx context.Context, t time.Time) (*FreshnessSnapshot, string, error) {
+	if snapshots.enabled() {
+		snap, err := snapshots.at(ctx, t)
+		return snap, "archive", err
+	}
+	samples, err := history.Query("", t.Add(-diffLookback()), t)
+	if err != nil {
+		return nil, "history", err
+	}
+	if len(samples) == 0 {
+		return nil, "history", os.ErrNotExist
+	}
+	last := map[string]HistorySample{}
+	for _, s := range samples {
+		last[s.Site] = s
+	}
+	snap := &FreshnessSnapshot{}
+	for _, s := range last {
+		snap.Evaluated = math.Max(snap.Evaluated, s.Timestamp)
+		snap.Sites = append(snap.Sites, evaluatedSite{
+			Site:            s.Site,
+			LatestTimestamp: s.LatestTimestamp,
+			AgeSeconds:      s.AgeSeconds,
+			Threshold:       siteRegistry().lookup(s.Site).Threshold,
+			Ok:              s.Ok,
+			InDowntime:      len(downtimes.Active(s.Site, unixTime(s.Timestamp))) > 0,
+		})
+	}
+	return snap, "history", nil
+}
+
+// diffSnapshots compares two snapshots, keeping the sites sel selects.
+func diffSnapshots(from, to *FreshnessSnapshot, sel tagSelector, limit int) FreshnessDiff {
+	d := FreshnessDiff{
+		From:        snapshotRef{Evaluated: from.Evaluated},
+		To:          snapshotRef{Evaluated: to.Evaluated},
+		BecameStale: []siteChange{}, Recovered: []siteChange{},
+		Appeared: []evaluatedSite{}, Disappeared: []evaluatedSite{},
+		Largest: []siteChange{},
+	}
+	index := func(snap *FreshnessSnapshot, ref *snapshotRef) map[string]evaluatedSite {
+		m := map[string]evaluatedSite{}
+		for _, s := range snap.Sites {
+			if !sel.selects(s.Site) {
+				continue
+			}
+			m[s.Site] = s
+			ref.Sites++
+			if !s.Ok {
+				ref.Stale++
+			}
+		}
+		return m
+	}
+	before, after := index(from, &d.From), index(to, &d.To)
+	var common []siteChange
+	for site, b := range before {
+		a, ok := after[site]
+		if !ok {
+			d.Disappeared = append(d.Disappeared, b)
+			continue
+		}
+		c := siteChange{Site: site, FromOk: b.Ok, ToOk: a.Ok, FromAge: b.AgeSeconds, ToAge: a.AgeSeconds, Delta: a.AgeSeconds - b.AgeSeconds, Threshold: a.Threshold}
+		switch {
+		case b.Ok && !a.Ok:
+			d.BecameStale = append(d.BecameStale, c)
+		case !b.Ok && a.Ok:
+			d.Recovered = append(d.Recovered, c)
+		}
+		common = append(common, c)
+	}
+	for site, a := range after {
+		if _, ok := before[site]; !ok {
+			d.Appeared = append(d.Appeared, a)
+		}
+	}
+	byDelta := func(l []siteChange) {
+		sort.Slice(l, func(i, j int) bool {
+			if di, dj := math.Abs(l[i].Delta), math.Abs(l[j].Delta); di != dj {
+				return di > dj
+			}
+			return l[i].Site < l[j].Site
+		})
+	}
+	bySite := func(l []evaluatedSite) { sort.Slice(l, func(i, j int) bool { return l[i].Site < l[j].Site }) }
+	byDelta(d.BecameStale)
+	byDelta(d.Recovered)
+	byDelta(common)
+	bySite(d.Appeared)
+	bySite(d.Disappeared)
+	if len(common) > limit {
+		common = common[:limit]
+	}
+	d.Largest = append(d.Largest, common...)
+	return d
+}
+
+// handleFreshnessDiff serves GET /api/v1/freshness/diff?from=&to=, which
+// compares the freshness snapshots in force at two times (unix seconds;
+// to defaults to now, from to a day before): the sites that turned stale
+// or recovered, those that appeared or disappeared, and the largest
+// changes in age (?limit=, 10 by default). ?tags= narrows it to a
+// selection of sites. Snapshots come from SNAPSHOT_ARCHIVE when it is
+// configured and are otherwise rebuilt from each site's last history
+// sample in the few poll intervals before the time asked for. It is what
+// a "what changed overnight" morning report reads.
+func handleFreshnessDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().Unix()
+	to := int64(queryInt(r, "to", int(now)))
+	from := int64(queryInt(r, "from", int(to-86400)))
+	if from >= to {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	var snaps [2]*FreshnessSnapshot
+	var source string
+	for i, t := range []int64{from, to} {
+		snap, src, err := snapshotAt(r.Context(), time.Unix(t, 0))
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "no snapshot at or before "+time.Unix(t, 0).UTC().Format(time.RFC3339), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		snaps[i], source = snap, src
+	}
+	d := diffSnapshots(snaps[0], snaps[1], sel, queryInt(r, "limit", 10))
+	d.Source = source
+	d.From.Requested, d.To.Requested = float64(from), float64(to)
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// ftsSource polls an FTS3 server. Per-link queue, activity, success rate
+// and throughput come from the ftsmon overview; link freshness is the most
+// recent finished job per source/destination pair from the REST API, and
+// each link is reported as the site "fts:<source_se>-><dest_se>".
+type ftsSource struct {
+	name       string
+	URL        string `yaml:"url"`         // REST API, e.g. https://fts3.example.org:8446
+	MonURL     string `yaml:"monitor_url"` // ftsmon, e.g. https://fts3.example.org:8449/fts3/ftsmon
+	VO         string `yaml:"vo"`
+	TimeWindow int    `yaml:"time_window_hours"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+
+	http *http.Client
+}
+
+var (
+	ftsLinkLabels       = []string{"source_se", "dest_se"}
+	gaugeFTSLinkActive  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_fts_link_active", Help: "Active FTS transfers on a link"}, ftsLinkLabels)
+	gaugeFTSLinkQueued  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_fts_link_queued", Help: "Submitted (queued) FTS transfers on a link"}, ftsLinkLabels)
+	gaugeFTSLinkSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_fts_link_success_ratio", Help: "FTS transfer success ratio on a link over the time window"}, ftsLinkLabels)
+	gaugeFTSLinkRate    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_fts_link_throughput_bytes_per_second", Help: "Current FTS throughput on a link"}, ftsLinkLabels)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeFTSLinkActive, gaugeFTSLinkQueued, gaugeFTSLinkSuccess, gaugeFTSLinkRate)
+	registerSource("fts", func(name string, params *yaml.Node) (Source, error) {
+		s := &ftsSource{name: name, TimeWindow: 1}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		var err error
+		s.http, err = httpClientFor(s.CAFile, s.CertFile, s.KeyFile)
+		return s, err
+	})
+}
+
+func (s *ftsSource) Name() string { return s.name }
+
+type ftsOverviewItem struct {
+	SourceSE  string   `json:"source_se"`
+	DestSE    string   `json:"dest_se"`
+	Active    float64  `json:"active"`
+	Submitted float64  `json:"submitted"`
+	Finished  float64  `json:"finished"`
+	Failed    float64  `json:"failed"`
+	Rate      *float64 `json:"rate"`    // percent
+	Current   *float64 `json:"current"` // MB/s
+}
+
+type ftsJob struct {
+	SourceSE    string `json:"source_se"`
+	DestSE      string `json:"dest_se"`
+	JobState    string `json:"job_state"`
+	JobFinished string `json:"job_finished"`
+}
+
+func (s *ftsSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	if s.MonURL != "" {
+		if err := s.collectOverview(ctx); err != nil {
+			fmt.Printf("[%s] overview: %v\n", s.name, err)
+		}
+	}
+
+	q := url.Values{
+		"state_in":    {"FINISHED,FINISHEDDIRTY"},
+		"time_window": {fmt.Sprint(s.TimeWindow)},
+		"limit":       {"10000"},
+	}
+	if s.VO != "" {
+		q.Set("vo_name", s.VO)
+	}
+	var jobs []ftsJob
+	if err := s.getJSON(ctx, strings.TrimRight(s.URL, "/")+"/jobs?"+q.Encode(), &jobs); err != nil {
+		return nil, fmt.Errorf("jobs: %w", err)
+	}
+
+	now := time.Now()
+	latest := map[[2]string]time.Time{}
+	for _, j := range jobs {
+		t, err := parseTimestamp(j.JobFinished)
+		if err != nil {
+			continue
+		}
+		link := [2]string{j.SourceSE, j.DestSE}
+		if t.After(latest[link]) {
+			latest[link] = t
+		}
+	}
+	out := make([]SiteFresh, 0, len(latest))
+	for link, t := range latest {
+		out = append(out, SiteFresh{
+			Site:            "fts:" + link[0] + "->" + link[1],
+			LatestTimestamp: float64(t.Unix()),
+			AgeSeconds:      now.Sub(t).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+func (s *ftsSource) collectOverview(ctx context.Context) error {
+	q := url.Values{"page": {"all"}, "time_window": {fmt.Sprint(s.TimeWindow)}}
+	if s.VO != "" {
+		q.Set("vo", s.VO)
+	}
+	var resp struct {
+		Overview struct {
+			Items []ftsOverviewItem `json:"items"`
+		} `json:"overview"`
+	}
+	if err := s.getJSON(ctx, strings.TrimRight(s.MonURL, "/")+"/overview?"+q.Encode(), &resp); err != nil {
+		return err
+	}
+	for _, it := range resp.Overview.Items {
+		l := prometheus.Labels{"source_se": it.SourceSE, "dest_se": it.DestSE}
+		gaugeFTSLinkActive.With(l).Set(it.Active)
+		gaugeFTSLinkQueued.With(l).Set(it.Submitted)
+		if it.Rate != nil {
+			gaugeFTSLinkSuccess.With(l).Set(*it.Rate / 100)
+		} else if done := it.Finished + it.Failed; done > 0 {
+			gaugeFTSLinkSuccess.With(l).Set(it.Finished / done)
+		}
+		if it.Current != nil {
+			gaugeFTSLinkRate.With(l).Set(*it.Current * 1e6)
+		}
+	}
+	return nil
+}
+
+func (s *ftsSource) getJSON(ctx context.Context, u string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GET /api/v1/global/freshness?region=&tags= is the federated freshness
+// the global dashboard reads. Unlike the federation view, which shows a
+// site from one region by config order, each site here takes the figures
+// of whichever region saw its latest arrival: a region that has seen newer
+// data is right about it. Arrivals less than arrivalTolerance apart are
+// the same one, shown from a region that is up if any is. source_region
+// names the winner, reports lists what every region said, and conflict
+// marks sites the regions disagree on.
+//
+// Every federation interval each region is checked for being up; the
+// checks are kept by hour for availabilityWindow and exported as
+// dtms_federation_region_up and dtms_federation_region_availability_ratio.
+const availabilityWindow = 24 * time.Hour
+
+// availabilityBucket counts one hour's checks of a region.
+type availabilityBucket struct {
+	Hour   int64 `json:"hour"`
+	Up     int   `json:"up"`
+	Checks int   `json:"checks"`
+}
+
+// GlobalSiteReport is one region's view of a site.
+type GlobalSiteReport struct {
+	Region          string  `json:"region"`
+	RegionUp        bool    `json:"region_up"`
+	LatestTimestamp float64 `json:"latest_timestamp,omitempty"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Ok              bool    `json:"ok"`
+	Evaluated       float64 `json:"evaluated,omitempty"`
+}
+
+// GlobalSite is a site's freshness across the federation.
+type GlobalSite struct {
+	Site            string             `json:"site"`
+	Tags            map[string]string  `json:"tags"`
+	LatestTimestamp float64            `json:"latest_timestamp,omitempty"`
+	AgeSeconds      float64            `json:"age_seconds"`
+	Ok              bool               `json:"ok"`
+	InDowntime      bool               `json:"in_downtime"`
+	Evaluated       float64            `json:"evaluated,omitempty"`
+	SourceRegion    string             `json:"source_region"`
+	SourceUp        bool               `json:"source_up"`
+	Conflict        bool               `json:"conflict,omitempty"`
+	Reports         []GlobalSiteReport `json:"reports"`
+}
+
+// GlobalRegion is a region's availability.
+type GlobalRegion struct {
+	Name         string  `json:"name"`
+	Up           bool    `json:"up"`
+	LastReport   float64 `json:"last_report,omitempty"`
+	Availability float64 `json:"availability"`
+	Sites        int     `json:"sites"`
+	Winning      int     `json:"winning_sites"`
+}
+
+var (
+	gaugeRegionUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_federation_region_up", Help: "Whether a federated region's last report is recent and its last check succeeded"},
+		[]string{"region"},
+	)
+	gaugeRegionAvailability = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_federation_region_availability_ratio", Help: "Share of the last day's checks that found a federated region up"},
+		[]string{"region"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeRegionUp, gaugeRegionAvailability)
+}
+
+// observeAvailability checks every region at now.
+func (f *federationStore) observeAvailability(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hour := now.Truncate(time.Hour).Unix()
+	oldest := now.Add(-availabilityWindow).Truncate(time.Hour).Unix()
+	for _, rc := range f.cfg.Regions {
+		st := f.regions[rc.Name]
+		up := f.up(st, now)
+		buckets := st.Availability[:0]
+		for _, b := range st.Availability {
+			if b.Hour > oldest {
+				buckets = append(buckets, b)
+			}
+		}
+		if n := len(buckets); n == 0 || buckets[n-1].Hour != hour {
+			buckets = append(buckets, availabilityBucket{Hour: hour})
+		}
+		last := &buckets[len(buckets)-1]
+		last.Checks++
+		v := 0.0
+		if up {
+			last.Up++
+			v = 1
+		}
+		st.Availability = buckets
+		gaugeRegionUp.WithLabelValues(rc.Name).Set(v)
+		gaugeRegionAvailability.WithLabelValues(rc.Name).Set(availability(buckets))
+	}
+}
+
+// availability is the share of checks in buckets that found the region up,
+// 0 before any check.
+func availability(buckets []availabilityBucket) float64 {
+	up, checks := 0, 0
+	for _, b := range buckets {
+		up, checks = up+b.Up, checks+b.Checks
+	}
+	if checks == 0 {
+		return 0
+	}
+	return float64(up) / float64(checks)
+}
+
+// arrivalTolerance is how far apart two regions' ages of one arrival can
+// put it: each measured the age at its own poll.
+const arrivalTolerance = 1.0
+
+// loses reports whether the report g shows gives way to rep: a later
+// arrival wins, and for the same arrival an up region, then the later
+// evaluation.
+func (g *GlobalSite) loses(rep GlobalSiteReport) bool {
+	switch d := rep.LatestTimestamp - g.LatestTimestamp; {
+	case d > arrivalTolerance:
+		return true
+	case d < -arrivalTolerance:
+		return false
+	case rep.RegionUp != g.SourceUp:
+		return rep.RegionUp
+	}
+	return rep.Evaluated > g.Evaluated
+}
+
+// latestArrival is when a region's report says the site last got data.
+func latestArrival(s SiteTags) float64 {
+	if s.AgeSeconds == nil || s.Evaluated == 0 {
+		return 0
+	}
+	return s.Evaluated - *s.AgeSeconds
+}
+
+// globalFreshness resolves every region's report of each site sel matches,
+// of the region named or all of them.
+func (f *federationStore) globalFreshness(only string, sel tagSelector, now time.Time) ([]GlobalRegion, []GlobalSite) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sites := map[string]*GlobalSite{}
+	var regions []GlobalRegion
+	for _, rc := range f.cfg.Regions {
+		if only != "" && rc.Name != only {
+			continue
+		}
+		st := f.regions[rc.Name]
+		up := f.up(st, now)
+		regions = append(regions, GlobalRegion{Name: rc.Name, Up: up, LastReport: st.Received, Availability: availability(st.Availability)})
+		if st.Report == nil {
+			continue
+		}
+		regions[len(regions)-1].Sites = len(st.Report.Sites)
+		for _, s := range st.Report.Sites {
+			if s.AgeSeconds == nil || !sel.matches(s.Tags) {
+				continue
+			}
+			rep := GlobalSiteReport{Region: rc.Name, RegionUp: up, LatestTimestamp: latestArrival(s), AgeSeconds: *s.AgeSeconds, Ok: s.Ok != nil && *s.Ok, Evaluated: s.Evaluated}
+			g := sites[s.Site]
+			if g == nil {
+				g = &GlobalSite{Site: s.Site}
+				sites[s.Site] = g
+			}
+			g.Reports = append(g.Reports, rep)
+			if len(g.Reports) == 1 || g.loses(rep) {
+				g.Tags, g.LatestTimestamp, g.AgeSeconds, g.Ok = s.Tags, rep.LatestTimestamp, rep.AgeSeconds, rep.Ok
+				g.InDowntime, g.Evaluated, g.SourceRegion, g.SourceUp = s.InDowntime, rep.Evaluated, rc.Name, up
+			}
+		}
+	}
+	out := make([]GlobalSite, 0, len(sites))
+	winning := map[string]int{}
+	for _, g := range sites {
+		for _, r := range g.Reports {
+			if r.Ok != g.Ok {
+				g.Conflict = true
+			}
+		}
+		winning[g.SourceRegion]++
+		out = append(out, *g)
+	}
+	for i := range regions {
+		regions[i].Winning = winning[regions[i].Name]
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	if regions == nil {
+		regions = []GlobalRegion{}
+	}
+	return regions, out
+}
+
+// handleGlobalFreshness serves GET /api/v1/global/freshness?region=&tags=.
+func handleGlobalFreshness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !federation.enabled() {
+		http.Error(w, "federation is not configured", http.StatusNotFound)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	regions, sites := federation.globalFreshness(r.URL.Query().Get("region"), sel, now)
+	stale := 0
+	for _, s := range sites {
+		if !s.Ok {
+			stale++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"generated": now.Unix(),
+		"regions":   regions,
+		"sites":     sites,
+		"stale":     stale,
+	})
+}
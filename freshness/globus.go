@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	globusTokenURL    = "https://auth.globus.org/v2/oauth2/token"
+	globusTransferURL = "https://transfer.api.globus.org/v0.10"
+	globusScope       = "urn:globus:auth:scope:transfer.api.globus.org:all"
+)
+
+// globusSource tracks Globus tasks visible to a confidential client. Each
+// endpoint pair becomes the site "globus:<src>-><dst>", aged by its most
+// recent successful task; endpoints listed under `endpoints` are named by
+// their DTMS site instead of their display name. A pair with no task left in
+// the lookback window is still reported, aged from the last task seen, so
+// it goes stale instead of vanishing.
+type globusSource struct {
+	name         string
+	ClientID     string            `yaml:"client_id"`
+	ClientSecret string            `yaml:"client_secret"`
+	Endpoints    map[string]string `yaml:"endpoints"` // endpoint UUID -> site
+	Lookback     time.Duration     `yaml:"lookback"`
+
+	auth *clientCredentials
+
+	mu       sync.Mutex
+	lastSeen map[[2]string]time.Time
+}
+
+var (
+	globusPairLabels         = []string{"source", "destination"}
+	gaugeGlobusPairBytes     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_globus_pair_bytes_transferred", Help: "Bytes moved by successful Globus tasks between an endpoint pair within the lookback window"}, globusPairLabels)
+	gaugeGlobusPairRate      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_globus_pair_bytes_per_second", Help: "Effective throughput of the most recent successful Globus task between an endpoint pair"}, globusPairLabels)
+	gaugeGlobusPairCompleted = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_globus_pair_tasks_completed", Help: "Successful Globus tasks between an endpoint pair within the lookback window"}, globusPairLabels)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeGlobusPairBytes, gaugeGlobusPairRate, gaugeGlobusPairCompleted)
+	registerSource("globus", func(name string, params *yaml.Node) (Source, error) {
+		s := &globusSource{name: name, Lookback: 24 * time.Hour, lastSeen: map[[2]string]time.Time{}}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.ClientID == "" || s.ClientSecret == "" {
+			return nil, fmt.Errorf("client_id and client_secret are required")
+		}
+		s.auth = &clientCredentials{TokenURL: globusTokenURL, ClientID: s.ClientID, ClientSecret: s.ClientSecret, Scope: globusScope}
+		return s, nil
+	})
+}
+
+func (s *globusSource) Name() string { return s.name }
+
+type globusTask struct {
+	TaskID            string  `json:"task_id"`
+	SourceID          string  `json:"source_endpoint_id"`
+	SourceName        string  `json:"source_endpoint_display_name"`
+	DestinationID     string  `json:"destination_endpoint_id"`
+	DestinationName   string  `json:"destination_endpoint_display_name"`
+	CompletionTime    string  `json:"completion_time"`
+	BytesTransferred  float64 `json:"bytes_transferred"`
+	EffectiveBytesSec float64 `json:"effective_bytes_per_second"`
+}
+
+func (s *globusSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	token, err := s.auth.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	since := now.Add(-s.Lookback).UTC().Format("2006-01-02T15:04:05")
+	filter := "type:TRANSFER/status:SUCCEEDED/completion_time:" + since + ","
+
+	type pairStats struct {
+		latest    time.Time
+		rate      float64
+		bytes     float64
+		completed int
+	}
+	pairs := map[[2]string]*pairStats{}
+	for offset := 0; ; offset += 1000 {
+		q := url.Values{"filter": {filter}, "limit": {"1000"}, "offset": {fmt.Sprint(offset)}}
+		var page struct {
+			Data  []globusTask `json:"DATA"`
+			Total int          `json:"total"`
+		}
+		if err := s.get(ctx, token, "/task_list?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, t := range page.Data {
+			done, err := parseTimestamp(t.CompletionTime)
+			if err != nil {
+				continue
+			}
+			key := [2]string{s.endpointName(t.SourceID, t.SourceName), s.endpointName(t.DestinationID, t.DestinationName)}
+			p := pairs[key]
+			if p == nil {
+				p = &pairStats{}
+				pairs[key] = p
+			}
+			p.bytes += t.BytesTransferred
+			p.completed++
+			if done.After(p.latest) {
+				p.latest, p.rate = done, t.EffectiveBytesSec
+			}
+		}
+		if len(page.Data) == 0 || offset+len(page.Data) >= page.Total {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]SiteFresh, 0, len(s.lastSeen))
+	for key, p := range pairs {
+		l := prometheus.Labels{"source": key[0], "destination": key[1]}
+		gaugeGlobusPairBytes.With(l).Set(p.bytes)
+		gaugeGlobusPairRate.With(l).Set(p.rate)
+		gaugeGlobusPairCompleted.With(l).Set(float64(p.completed))
+		if p.latest.After(s.lastSeen[key]) {
+			s.lastSeen[key] = p.latest
+		}
+	}
+	for key, latest := range s.lastSeen {
+		if pairs[key] == nil {
+			l := prometheus.Labels{"source": key[0], "destination": key[1]}
+			gaugeGlobusPairBytes.With(l).Set(0)
+			gaugeGlobusPairCompleted.With(l).Set(0)
+		}
+		out = append(out, SiteFresh{
+			Site:            "globus:" + key[0] + "->" + key[1],
+			LatestTimestamp: float64(latest.Unix()),
+			AgeSeconds:      now.Sub(latest).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+func (s *globusSource) endpointName(id, display string) string {
+	if site, ok := s.Endpoints[id]; ok {
+		return site
+	}
+	if display != "" {
+		return display
+	}
+	return id
+}
+
+func (s *globusSource) get(ctx context.Context, token, path string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, globusTransferURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", strings.SplitN(path, "?", 2)[0], resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Site groups roll per-site freshness up for management views. Each
+// hierarchy in SITES_CONFIG lists metadata keys from the outermost level
+// in:
+//
+//	groups:
+//	  - name: geography
+//	    levels: [region, country]
+//	  - name: tier
+//	    levels: [tier]
+//
+// A site with metadata {region: eu-west, country: DE} then counts towards
+// geography groups "eu-west" (level region) and "eu-west/DE" (level
+// country). A site missing a level's key is left out of that level and
+// the ones below it. Groups are recomputed every poll from the same
+// snapshot as the per-site gauges and served as metrics and at
+// GET /api/v1/groups?hierarchy=&level=.
+type groupHierarchy struct {
+	Name   string   `yaml:"name"`
+	Levels []string `yaml:"levels"`
+}
+
+// SiteGroup is one group's freshness at the last poll.
+type SiteGroup struct {
+	Hierarchy string  `json:"hierarchy"`
+	Level     string  `json:"level"`
+	Group     string  `json:"group"`
+	Parent    string  `json:"parent,omitempty"`
+	Sites     int     `json:"sites"`
+	Ok        int     `json:"ok"`
+	WorstAge  float64 `json:"worst_age_seconds"`
+	WorstSite string  `json:"worst_site"`
+	AvgAge    float64 `json:"avg_age_seconds"`
+}
+
+var (
+	descGroupWorst = prometheus.NewDesc("dtms_group_fresh_worst_seconds", "Age of the stalest site in the group", []string{"hierarchy", "level", "group"}, nil)
+	descGroupAvg   = prometheus.NewDesc("dtms_group_fresh_avg_seconds", "Mean age of the group's sites", []string{"hierarchy", "level", "group"}, nil)
+	descGroupSites = prometheus.NewDesc("dtms_group_sites", "Sites in the group, by whether they were ok", []string{"hierarchy", "level", "group", "ok"}, nil)
+)
+
+func validateGroups(hs []groupHierarchy) error {
+	seen := map[string]bool{}
+	for _, h := range hs {
+		if h.Name == "" || len(h.Levels) == 0 {
+			return fmt.Errorf("groups: every hierarchy needs a name and levels")
+		}
+		if seen[h.Name] {
+			return fmt.Errorf("groups: duplicate hierarchy %q", h.Name)
+		}
+		seen[h.Name] = true
+	}
+	return nil
+}
+
+// computeGroups aggregates sites over every configured hierarchy.
+func computeGroups(sites map[string]siteMetrics) []SiteGroup {
+	type key struct{ hierarchy, group string }
+	byKey := map[key]*SiteGroup{}
+	reg := siteRegistry()
+	for _, h := range reg.Groups {
+		for site, m := range sites {
+			md := reg.lookup(site).Metadata
+			var path []string
+			for _, level := range h.Levels {
+				v := md[level]
+				if v == "" {
+					break
+				}
+				parent := strings.Join(path, "/")
+				path = append(path, v)
+				k := key{h.Name, strings.Join(path, "/")}
+				g := byKey[k]
+				if g == nil {
+					g = &SiteGroup{Hierarchy: h.Name, Level: level, Group: k.group, Parent: parent}
+					byKey[k] = g
+				}
+				g.Sites++
+				if m.Ok {
+					g.Ok++
+				}
+				g.AvgAge += m.Age
+				if m.Age > g.WorstAge || g.WorstSite == "" {
+					g.WorstAge, g.WorstSite = m.Age, site
+				}
+			}
+		}
+	}
+	out := make([]SiteGroup, 0, len(byKey))
+	for _, g := range byKey {
+		g.AvgAge /= float64(g.Sites)
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hierarchy != out[j].Hierarchy {
+			return out[i].Hierarchy < out[j].Hierarchy
+		}
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+func collectGroupMetrics(ch chan<- prometheus.Metric, groups []SiteGroup) {
+	for _, g := range groups {
+		ch <- prometheus.MustNewConstMetric(descGroupWorst, prometheus.GaugeValue, g.WorstAge, g.Hierarchy, g.Level, g.Group)
+		ch <- prometheus.MustNewConstMetric(descGroupAvg, prometheus.GaugeValue, g.AvgAge, g.Hierarchy, g.Level, g.Group)
+		ch <- prometheus.MustNewConstMetric(descGroupSites, prometheus.GaugeValue, float64(g.Ok), g.Hierarchy, g.Level, g.Group, "true")
+		ch <- prometheus.MustNewConstMetric(descGroupSites, prometheus.GaugeValue, float64(g.Sites-g.Ok), g.Hierarchy, g.Level, g.Group, "false")
+	}
+}
+
+// handleGroups serves GET /api/v1/groups?hierarchy=&level=.
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	out := []SiteGroup{}
+	if m := currentMetrics.Load(); m != nil {
+		for _, g := range m.groups {
+			if (q.Get("hierarchy") == "" || g.Hierarchy == q.Get("hierarchy")) && (q.Get("level") == "" || g.Level == q.Get("level")) {
+				out = append(out, g)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": out})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// When a site goes stale the usual first questions are: did transfers to
+// it start failing, is its storage up or its buffer full, is it in a
+// declared downtime, and did someone just change the configuration. Stale sites get those answers
+// collected each poll, served by GET /api/v1/hints and exported as
+// dtms_stale_hint so alert annotations can quote them; hints carry
+// absolute times so their series stay put while the site is stale.
+// Configuration files count as recently changed when modified within
+// HINTS_CONFIG_CHANGE_WINDOW_HOURS.
+var hintsConfigChangeWindow = time.Duration(envOrInt("HINTS_CONFIG_CHANGE_WINDOW_HOURS", 24)) * time.Hour
+
+// hintsFailureWindow bounds the per-class failure counts, and
+// hintsMaxFailures how many failures a site keeps for them.
+const (
+	hintsFailureWindow = time.Hour
+	hintsMaxFailures   = 1000
+)
+
+var gaugeStaleHint = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "dtms_stale_hint", Help: "Context gathered for a stale site, one series per hint (always 1)"},
+	[]string{"site", "kind", "hint"},
+)
+
+func init() {
+	prometheus.MustRegister(gaugeStaleHint)
+}
+
+type transferFailure struct {
+	Timestamp float64 `json:"timestamp"`
+	Source    string  `json:"source,omitempty"`
+	Class     string  `json:"class"`
+	Reason    string  `json:"reason"`
+}
+
+type configChange struct {
+	Path     string  `json:"path"`
+	Modified float64 `json:"modified"`
+}
+
+// StaleHints is the context gathered for one stale site.
+type StaleHints struct {
+	Site           string               `json:"site"`
+	StaleSince     float64              `json:"stale_since"`
+	AgeSeconds     float64              `json:"age_seconds"`
+	LastError      *transferFailure     `json:"last_transfer_error,omitempty"`
+	RecentFailures map[string]int       `json:"recent_failures,omitempty"`
+	Storage        []storageProbeResult `json:"storage,omitempty"`
+	Downtimes      []downtimeWindow     `json:"downtimes,omitempty"`
+	ConfigChanges  []configChange       `json:"config_changes,omitempty"`
+	Hints          []string             `json:"hints"`
+
+	labels [][2]string
+}
+
+type hintCollector struct {
+	mu       sync.Mutex
+	failures map[string][]transferFailure
+	last     map[string]transferFailure
+	stale    map[string]*StaleHints
+}
+
+var hints = &hintCollector{
+	failures: map[string][]transferFailure{},
+	last:     map[string]transferFailure{},
+	stale:    map[string]*StaleHints{},
+}
+
+// Observe remembers failed transfers into each site.
+func (h *hintCollector) Observe(ev TransferEvent) {
+	if ev.Status == "success" || ev.Status == eventDeleted {
+		return
+	}
+	f := transferFailure{Timestamp: ev.Timestamp, Source: ev.Source, Class: classifyFailure(ev.Reason), Reason: ev.Reason}
+	cutoff := float64(time.Now().Add(-hintsFailureWindow).Unix())
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last[ev.Site] = f
+	kept := h.failures[ev.Site][:0]
+	for _, old := range h.failures[ev.Site] {
+		if old.Timestamp >= cutoff {
+			kept = append(kept, old)
+		}
+	}
+	if len(kept) >= hintsMaxFailures {
+		kept = kept[len(kept)-hintsMaxFailures+1:]
+	}
+	h.failures[ev.Site] = append(kept, f)
+}
+
+// configFiles are the configuration files the service was started with.
+func configFiles() []string {
+	var out []string
+	for _, p := range []string{
+		sitesConfigPath, sourcesConfig, failureClassesPath, lineageConfigPath, bandwidthConfigPath,
+		retryPoliciesPath, quotasConfigPath, subscriptionsPath, consistencyConfigPath,
+	} {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (h *hintCollector) gather(site string, age float64, now time.Time) *StaleHints {
+	s := &StaleHints{Site: site, AgeSeconds: age, RecentFailures: map[string]int{}}
+	add := func(kind, hint string) {
+		s.Hints = append(s.Hints, hint)
+		s.labels = append(s.labels, [2]string{kind, hint})
+	}
+
+	cutoff := float64(now.Add(-hintsFailureWindow).Unix())
+	for _, f := range h.failures[site] {
+		if f.Timestamp >= cutoff {
+			s.RecentFailures[f.Class]++
+		}
+	}
+	if last, ok := h.last[site]; ok {
+		s.LastError = &last
+		reason := []rune(last.Reason)
+		if len(reason) > 120 {
+			reason = append(reason[:120], '…')
+		}
+		add("transfer_error", fmt.Sprintf("last transfer failed at %s (%s): %s",
+			unixTime(last.Timestamp).Format(time.RFC3339), last.Class, string(reason)))
+	}
+
+	s.Storage = storageProbesFor(site)
+	for _, p := range s.Storage {
+		if !p.Up {
+			add("storage", fmt.Sprintf("%s endpoint %s is down: %s", p.Protocol, p.Endpoint, p.Error))
+		}
+	}
+
+	for _, b := range buffers.nearFull(site) {
+		add("buffer", b)
+	}
+
+	s.Downtimes = downtimes.Active(site, now)
+	for _, d := range s.Downtimes {
+		add("downtime", fmt.Sprintf("%s downtime until %s: %s", d.Severity, d.End.UTC().Format(time.RFC3339), d.Description))
+	}
+
+	for _, p := range configFiles() {
+		info, err := os.Stat(p)
+		if err != nil || now.Sub(info.ModTime()) > hintsConfigChangeWindow {
+			continue
+		}
+		s.ConfigChanges = append(s.ConfigChanges, configChange{Path: p, Modified: float64(info.ModTime().Unix())})
+		add("config", fmt.Sprintf("%s changed at %s", filepath.Base(p), info.ModTime().UTC().Format(time.RFC3339)))
+	}
+
+	if len(s.Hints) == 0 {
+		s.Hints = []string{}
+	}
+	return s
+}
+
+// Update refreshes site's hints after a poll: gathered while it is stale,
+// dropped once it is ok again.
+func (h *hintCollector) Update(site string, age float64, ok bool, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.stale[site]
+	var s *StaleHints
+	current := map[[2]string]bool{}
+	if !ok {
+		s = h.gather(site, age, now)
+		s.StaleSince = float64(now.Unix())
+		if prev != nil {
+			s.StaleSince = prev.StaleSince
+		}
+		for _, l := range s.labels {
+			current[l] = true
+			gaugeStaleHint.WithLabelValues(site, l[0], l[1]).Set(1)
+		}
+	}
+	if prev != nil {
+		for _, l := range prev.labels {
+			if !current[l] {
+				gaugeStaleHint.DeleteLabelValues(site, l[0], l[1])
+			}
+		}
+	}
+	if ok {
+		delete(h.stale, site)
+		return
+	}
+	h.stale[site] = s
+}
+
+// hintsFor returns site's current hints, or nil while it is ok.
+func hintsFor(site string) *StaleHints {
+	hints.mu.Lock()
+	defer hints.mu.Unlock()
+	return hints.stale[site]
+}
+
+// handleHints serves GET /api/v1/hints?site=, listing every stale site's
+// hints.
+func handleHints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	hints.mu.Lock()
+	out := []*StaleHints{}
+	for name, s := range hints.stale {
+		if site == "" || name == site {
+			out = append(out, s)
+		}
+	}
+	hints.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sites": out})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History is stored as CSV partitions under HISTORY_DIR:
+//
+//	<YYYY-MM>/<site>.csv        when HISTORY_SITE_BUCKETS is 0
+//	<YYYY-MM>/bucket-<NNN>.csv  when sites are hashed into N buckets
+//
+// Queries only open the months in range and the one file a site maps to,
+// and retention drops whole month directories instead of rewriting rows.
+var (
+	dataDir              = envOr("DATA_DIR", "/app/data")
+	historyDir           = envOr("HISTORY_DIR", filepath.Join(dataDir, "history"))
+	historyBuckets       = envOrInt("HISTORY_SITE_BUCKETS", 0)
+	historyRetentionMons = envOrInt("HISTORY_RETENTION_MONTHS", 6)
+)
+
+const historyMonthLayout = "2006-01"
+
+var historyHeader = []string{"timestamp_unix", "site", "latest_timestamp", "age_seconds", "ok"}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+type HistorySample struct {
+	Timestamp       float64 `json:"timestamp"`
+	Site            string  `json:"site"`
+	LatestTimestamp float64 `json:"latest_timestamp"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Ok              bool    `json:"ok"`
+}
+
+type historyStore struct {
+	mu      sync.Mutex
+	dir     string
+	buckets int
+}
+
+var history = &historyStore{dir: historyDir, buckets: historyBuckets}
+
+// partitionFile returns the file a site's samples for the given month live in.
+func (h *historyStore) partitionFile(month time.Time, site string) string {
+	name := unsafeFileChars.ReplaceAllString(site, "_") + ".csv"
+	if h.buckets > 0 {
+		f := fnv.New32a()
+		f.Write([]byte(site))
+		name = fmt.Sprintf("bucket-%03d.csv", f.Sum32()%uint32(h.buckets))
+	}
+	return filepath.Join(h.dir, month.UTC().Format(historyMonthLayout), name)
+}
+
+// Record appends one sample per site to the partition for the sample time.
+func (h *historyStore) Record(samples []HistorySample) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byFile := map[string][]HistorySample{}
+	for _, s := range samples {
+		p := h.partitionFile(unixTime(s.Timestamp), s.Site)
+		byFile[p] = append(byFile[p], s)
+	}
+	for path, rows := range byFile {
+		if err := appendHistoryRows(path, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordNew is Record for samples that may already be stored: those with
+// the same site and time as a stored one are left out. It returns how
+// many were written.
+func (h *historyStore) RecordNew(samples []HistorySample, dryRun bool) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := func(s HistorySample) string { return s.Site + "|" + formatFloat(s.Timestamp) }
+	byFile := map[string][]HistorySample{}
+	for _, s := range samples {
+		p := h.partitionFile(unixTime(s.Timestamp), s.Site)
+		byFile[p] = append(byFile[p], s)
+	}
+	written := 0
+	for path, rows := range byFile {
+		have := map[string]bool{}
+		stored, err := readHistoryFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return written, err
+		}
+		for _, s := range stored {
+			have[key(s)] = true
+		}
+		var fresh []HistorySample
+		for _, s := range rows {
+			if !have[key(s)] {
+				have[key(s)] = true
+				fresh = append(fresh, s)
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if !dryRun {
+			if err := appendHistoryRows(path, fresh); err != nil {
+				return written, err
+			}
+		}
+		written += len(fresh)
+	}
+	return written, nil
+}
+
+func appendHistoryRows(path string, rows []HistorySample) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	_, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if os.IsNotExist(statErr) {
+		w.Write(historyHeader)
+	}
+	for _, s := range rows {
+		w.Write([]string{
+			formatFloat(s.Timestamp),
+			s.Site,
+			formatFloat(s.LatestTimestamp),
+			formatFloat(s.AgeSeconds),
+			strconv.FormatBool(s.Ok),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Query returns samples for site (all sites when empty) in [from, to],
+// ordered by timestamp.
+func (h *historyStore) Query(site string, from, to time.Time) ([]HistorySample, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []HistorySample
+	for m := monthStart(from); !m.After(to); m = m.AddDate(0, 1, 0) {
+		var files []string
+		if site != "" {
+			files = []string{h.partitionFile(m, site)}
+		} else {
+			files, _ = filepath.Glob(filepath.Join(h.dir, m.Format(historyMonthLayout), "*.csv"))
+		}
+		for _, path := range files {
+			rows, err := readHistoryFile(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, s := range rows {
+				ts := unixTime(s.Timestamp)
+				if (site == "" || s.Site == site) && !ts.Before(from) && !ts.After(to) {
+					out = append(out, s)
+				}
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp < out[j].Timestamp })
+	return out, nil
+}
+
+func readHistoryFile(path string) ([]HistorySample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	var out []HistorySample
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			break
+		}
+		if len(rec) < len(historyHeader) || rec[0] == historyHeader[0] {
+			continue
+		}
+		ts, _ := strconv.ParseFloat(rec[0], 64)
+		latest, _ := strconv.ParseFloat(rec[2], 64)
+		age, _ := strconv.ParseFloat(rec[3], 64)
+		ok, _ := strconv.ParseBool(rec[4])
+		out = append(out, HistorySample{Timestamp: ts, Site: rec[1], LatestTimestamp: latest, AgeSeconds: age, Ok: ok})
+	}
+	return out, nil
+}
+
+// Prune drops month partitions older than the retention window.
+func (h *historyStore) Prune(now time.Time) ([]string, error) {
+	if historyRetentionMons <= 0 {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cutoff := monthStart(now).AddDate(0, -historyRetentionMons+1, 0)
+	var dropped []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		m, err := time.Parse(historyMonthLayout, e.Name())
+		if err != nil || !m.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(h.dir, e.Name())); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, e.Name())
+	}
+	return dropped, nil
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func unixTime(ts float64) time.Time {
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*1e9)).UTC()
+}
+
+func formatFloat(v float64) string {
+	return strings.TrimSuffix(strconv.FormatFloat(v, 'f', 3, 64), ".000")
+}
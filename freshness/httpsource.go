@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HTTP_TARGETS lists probes separated by ';' as site=URL[|extractor]:
+//
+//	last-modified    the Last-Modified response header (default)
+//	json:$.a.b[0].c  a timestamp at a JSONPath-style location in the body
+//	regex:<re>       the first capture group of re matched against the body
+//
+// Extracted timestamps may be unix seconds/milliseconds or RFC 3339/1123.
+var httpTargets = envOr("HTTP_TARGETS", "")
+
+type httpProbe struct {
+	Site      string `yaml:"site"`
+	URL       string `yaml:"url"`
+	Extractor string `yaml:"extractor"`
+}
+
+type httpSource struct {
+	name   string
+	Probes []httpProbe `yaml:"probes"`
+}
+
+func init() {
+	registerSource("http", func(name string, params *yaml.Node) (Source, error) {
+		s := &httpSource{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		for i := range s.Probes {
+			if s.Probes[i].Extractor == "" {
+				s.Probes[i].Extractor = "last-modified"
+			}
+		}
+		return s, nil
+	})
+}
+
+func httpFromEnv() *httpSource {
+	probes, err := parseHTTPTargets(httpTargets)
+	if err != nil {
+		fmt.Printf("[http] %v\n", err)
+	}
+	return &httpSource{name: "http", Probes: probes}
+}
+
+func (s *httpSource) Name() string { return s.name }
+
+func parseHTTPTargets(s string) ([]httpProbe, error) {
+	var out []httpProbe
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		site, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad HTTP_TARGETS entry %q", entry)
+		}
+		u, ext, _ := strings.Cut(rest, "|")
+		if ext == "" {
+			ext = "last-modified"
+		}
+		out = append(out, httpProbe{Site: site, URL: u, Extractor: ext})
+	}
+	return out, nil
+}
+
+func (s *httpSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	var out []SiteFresh
+	for _, p := range s.Probes {
+		ts, err := p.fetch(ctx)
+		if err != nil {
+			fmt.Printf("[%s] site=%s: %v\n", s.name, p.Site, err)
+			continue
+		}
+		out = append(out, SiteFresh{
+			Site:            p.Site,
+			LatestTimestamp: float64(ts.Unix()),
+			AgeSeconds:      now.Sub(ts).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+func (p httpProbe) fetch(ctx context.Context) (time.Time, error) {
+	method := http.MethodGet
+	if p.Extractor == "last-modified" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.URL, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return time.Time{}, fmt.Errorf("%s: %s", p.URL, resp.Status)
+	}
+
+	if p.Extractor == "last-modified" {
+		lm := resp.Header.Get("Last-Modified")
+		if lm == "" {
+			return time.Time{}, fmt.Errorf("%s: no Last-Modified header", p.URL)
+		}
+		return http.ParseTime(lm)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return time.Time{}, err
+	}
+	kind, arg, _ := strings.Cut(p.Extractor, ":")
+	switch kind {
+	case "json":
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return time.Time{}, err
+		}
+		v, err := jsonPathLookup(doc, arg)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return parseTimestamp(fmt.Sprint(v))
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return time.Time{}, err
+		}
+		m := re.FindSubmatch(body)
+		if len(m) < 2 {
+			return time.Time{}, fmt.Errorf("regex %q did not match", arg)
+		}
+		return parseTimestamp(string(m[1]))
+	}
+	return time.Time{}, fmt.Errorf("unknown extractor %q", p.Extractor)
+}
+
+// jsonPathLookup resolves the dotted subset of JSONPath: $.a.b[0].c
+func jsonPathLookup(doc interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	cur := doc
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+		name, idx, hasIdx := strings.Cut(part, "[")
+		if name != "" {
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: not an object", name)
+			}
+			if cur, ok = obj[name]; !ok {
+				return nil, fmt.Errorf("%s: not found", name)
+			}
+		}
+		for hasIdx {
+			var n string
+			n, idx, _ = strings.Cut(idx, "]")
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				return nil, fmt.Errorf("bad index in %q", part)
+			}
+			arr, ok := cur.([]interface{})
+			if !ok || i < 0 || i >= len(arr) {
+				return nil, fmt.Errorf("index %d out of range in %q", i, part)
+			}
+			cur = arr[i]
+			idx, hasIdx = strings.CutPrefix(idx, "[")
+		}
+	}
+	return cur, nil
+}
+
+var timestampLayouts = []string{time.RFC3339Nano, time.RFC1123, time.RFC1123Z, "2006-01-02 15:04:05", "2006-01-02T15:04:05"}
+
+// parseTimestamp accepts unix seconds or milliseconds and common layouts.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f > 1e12 {
+			f /= 1000
+		}
+		return unixTime(f), nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/events"
+)
+
+// An incident is opened once a site has been stale for
+// INCIDENT_OPEN_AFTER_MINUTES and resolved when it is ok again. It keeps
+// the hints gathered when it opened, the names of alerts Alertmanager
+// reported firing for the site meanwhile, and free-form notes. Incidents
+// older than INCIDENT_RETENTION_DAYS are dropped from INCIDENTS_FILE.
+var (
+	incidentsFile      = envOr("INCIDENTS_FILE", filepath.Join(dataDir, "incidents.json"))
+	incidentOpenAfter  = time.Duration(envOrInt("INCIDENT_OPEN_AFTER_MINUTES", 10)) * time.Minute
+	incidentRetention  = envOrInt("INCIDENT_RETENTION_DAYS", 365)
+	errIncidentMissing = errors.New("incident not found")
+)
+
+const (
+	incidentOpen     = "open"
+	incidentResolved = "resolved"
+)
+
+type Incident struct {
+	ID         string         `json:"id"`
+	Site       string         `json:"site"`
+	Status     string         `json:"status"`
+	Start      float64        `json:"start"`
+	Opened     float64        `json:"opened"`
+	End        float64        `json:"end,omitempty"`
+	Duration   float64        `json:"duration_seconds"`
+	MaxAge     float64        `json:"max_age_seconds"`
+	Alerts     []string       `json:"alerts,omitempty"`
+	Hints      []string       `json:"hints,omitempty"`
+	Notes      []incidentNote `json:"notes,omitempty"`
+	Resolution string         `json:"resolution,omitempty"`
+
+	// Causes are filled in by the correlation job, most likely first.
+	Causes        []incidentCause `json:"causes,omitempty"`
+	ProbableCause string          `json:"probable_cause,omitempty"`
+	Correlated    bool            `json:"correlated,omitempty"`
+}
+
+type incidentNote struct {
+	Timestamp float64 `json:"timestamp"`
+	Author    string  `json:"author,omitempty"`
+	Text      string  `json:"text"`
+}
+
+var (
+	gaugeIncidentsOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_incidents_open", Help: "1 while the site has an open incident"},
+		[]string{"site"},
+	)
+	incidentsOpened = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_incidents_total", Help: "Incidents opened"},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeIncidentsOpen, incidentsOpened)
+}
+
+type incidentStore struct {
+	mu         sync.Mutex
+	path       string
+	incidents  map[string]*Incident
+	open       map[string]*Incident
+	staleSince map[string]time.Time
+}
+
+var incidents = &incidentStore{
+	path:       incidentsFile,
+	incidents:  map[string]*Incident{},
+	open:       map[string]*Incident{},
+	staleSince: map[string]time.Time{},
+}
+
+func (s *incidentStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Incident
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, inc := range list {
+		s.incidents[inc.ID] = inc
+		if inc.Status == incidentOpen {
+			s.open[inc.Site] = inc
+			s.staleSince[inc.Site] = unixTime(inc.Start)
+			gaugeIncidentsOpen.WithLabelValues(inc.Site).Set(1)
+		}
+	}
+	return nil
+}
+
+func (s *incidentStore) save() error {
+	cutoff := float64(time.Now().AddDate(0, 0, -incidentRetention).Unix())
+	list := make([]*Incident, 0, len(s.incidents))
+	for id, inc := range s.incidents {
+		if inc.Status == incidentResolved && inc.End < cutoff {
+			delete(s.incidents, id)
+			continue
+		}
+		list = append(list, inc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+// Observe follows site through one poll, opening an incident once it has
+// been stale long enough and resolving it when it recovers.
+func (s *incidentStore) Observe(site string, age float64, ok bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inc := s.open[site]
+	if ok {
+		delete(s.staleSince, site)
+		if inc == nil {
+			return
+		}
+		inc.Status, inc.End = incidentResolved, float64(now.Unix())
+		inc.Duration = inc.End - inc.Start
+		delete(s.open, site)
+		gaugeIncidentsOpen.WithLabelValues(site).Set(0)
+		fmt.Printf("[incidents] %s resolved for site=%s after %s\n", inc.ID, site, time.Duration(inc.Duration)*time.Second)
+		bus.Publish(events.Event{Type: eventIncidentResolved, Site: site, Data: *inc})
+		if err := s.save(); err != nil {
+			fmt.Printf("[incidents] save: %v\n", err)
+		}
+		return
+	}
+	since, seen := s.staleSince[site]
+	if !seen {
+		// A site past its threshold went stale when its age crossed it,
+		// which is usually before the first poll that saw it.
+		since = now
+		if over := age - siteRegistry().lookup(site).Threshold; over > 0 {
+			since = now.Add(-time.Duration(over * float64(time.Second)))
+		}
+		s.staleSince[site] = since
+	}
+	if inc != nil {
+		inc.Duration = float64(now.Unix()) - inc.Start
+		if age > inc.MaxAge {
+			inc.MaxAge = age
+		}
+		return
+	}
+	if now.Sub(since) < incidentOpenAfter {
+		return
+	}
+	id := make([]byte, 6)
+	rand.Read(id)
+	inc = &Incident{
+		ID:       "inc-" + hex.EncodeToString(id),
+		Site:     site,
+		Status:   incidentOpen,
+		Start:    float64(since.Unix()),
+		Opened:   float64(now.Unix()),
+		Duration: now.Sub(since).Seconds(),
+		MaxAge:   age,
+	}
+	if h := hintsFor(site); h != nil {
+		inc.Hints = h.Hints
+	}
+	s.incidents[inc.ID] = inc
+	s.open[site] = inc
+	gaugeIncidentsOpen.WithLabelValues(site).Set(1)
+	incidentsOpened.WithLabelValues(site).Inc()
+	fmt.Printf("[incidents] %s opened for site=%s\n", inc.ID, site)
+	bus.Publish(events.Event{Type: eventIncidentOpened, Site: site, Data: *inc})
+	if err := s.save(); err != nil {
+		fmt.Printf("[incidents] save: %v\n", err)
+	}
+}
+
+// uncorrelated returns copies of the incidents the correlation job still
+// has to look at: open ones, and resolved ones it hasn't finalised.
+func (s *incidentStore) uncorrelated() []Incident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Incident
+	for _, inc := range s.incidents {
+		if !inc.Correlated {
+			out = append(out, *inc)
+		}
+	}
+	return out
+}
+
+// SetCauses records the correlation job's verdict; final marks resolved
+// incidents as done.
+func (s *incidentStore) SetCauses(id string, causes []incidentCause, final bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inc := s.incidents[id]
+	if inc == nil {
+		return
+	}
+	probable := causeUnknown
+	if len(causes) > 0 && causes[0].Confidence >= correlationMinConfidence {
+		probable = causes[0].Category
+	}
+	if !final && probable == inc.ProbableCause && reflect.DeepEqual(causes, inc.Causes) {
+		return
+	}
+	inc.Causes, inc.ProbableCause, inc.Correlated = causes, probable, final
+	if err := s.save(); err != nil {
+		fmt.Printf("[incidents] save: %v\n", err)
+	}
+}
+
+// AttachAlert records a firing alert against site's open incident.
+func (s *incidentStore) AttachAlert(site, alert string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inc := s.open[site]
+	if inc == nil {
+		return false
+	}
+	for _, a := range inc.Alerts {
+		if a == alert {
+			return true
+		}
+	}
+	inc.Alerts = append(inc.Alerts, alert)
+	if err := s.save(); err != nil {
+		fmt.Printf("[incidents] save: %v\n", err)
+	}
+	return true
+}
+
+// AddNote appends a note and, when resolution is set, records it.
+func (s *incidentStore) AddNote(id string, note incidentNote, resolution string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inc := s.incidents[id]
+	if inc == nil {
+		return Incident{}, errIncidentMissing
+	}
+	if note.Text != "" {
+		inc.Notes = append(inc.Notes, note)
+	}
+	if resolution != "" {
+		inc.Resolution = resolution
+	}
+	return *inc, s.save()
+}
+
+func (s *incidentStore) Get(id string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inc := s.incidents[id]; inc != nil {
+		return *inc, nil
+	}
+	return Incident{}, errIncidentMissing
+}
+
+// List returns incidents for site (all when empty) with the given status
+// that overlap [from, to], oldest first.
+func (s *incidentStore) List(site, status string, from, to float64) []Incident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Incident{}
+	for _, inc := range s.incidents {
+		if (site != "" && inc.Site != site) || (status != "" && inc.Status != status) {
+			continue
+		}
+		if inc.Start > to || (inc.Status == incidentResolved && inc.End < from) {
+			continue
+		}
+		out = append(out, *inc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+// handleIncidents serves GET /api/v1/incidents?site=&status=&cause=&tags=&from=&to=,
+// with from and to as unix seconds.
+func handleIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := float64(queryInt(r, "to", int(time.Now().Unix())))
+	from := float64(queryInt(r, "from", 0))
+	list := incidents.List(q.Get("site"), q.Get("status"), from, to)
+	cause := q.Get("cause")
+	filtered := list[:0]
+	for _, inc := range list {
+		if (cause == "" || inc.ProbableCause == cause) && sel.selects(inc.Site) {
+			filtered = append(filtered, inc)
+		}
+	}
+	list = filtered
+	writeJSON(w, http.StatusOK, map[string]interface{}{"incidents": list})
+}
+
+// handleIncident serves GET /api/v1/incidents/{id} and
+// POST /api/v1/incidents/{id}/notes with {"author", "text", "resolution"}.
+func handleIncident(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/incidents/"), "/")
+	var inc Incident
+	var err error
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		inc, err = incidents.Get(id)
+	case r.Method == http.MethodPost && action == "notes":
+		caller := apiPrincipal(r)
+		if caller == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if inc, err = incidents.Get(id); err != nil {
+			break
+		}
+		if !caller.canManageSite(inc.Site) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var body struct {
+			incidentNote
+			Resolution string `json:"resolution"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Text == "" && body.Resolution == "" {
+			http.Error(w, "text or resolution is required", http.StatusBadRequest)
+			return
+		}
+		body.Timestamp = float64(time.Now().Unix())
+		if body.Author == "" {
+			body.Author = caller.Name
+		}
+		inc, err = incidents.AddNote(id, body.incidentNote, body.Resolution)
+	case action == "" || action == "notes":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case errors.Is(err, errIncidentMissing):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, inc)
+	}
+}
+
+// handleIncidentAlerts serves POST /api/v1/incidents/alerts, an
+// Alertmanager webhook receiver: firing alerts with a site label are
+// attached to that site's open incident.
+func handleIncidentAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Alerts []alertEvent `json:"alerts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attached := 0
+	for _, a := range body.Alerts {
+		warehouse.ObserveAlert(a)
+		loki.Alert(a)
+		if a.Status == "firing" && a.Labels["site"] != "" && incidents.AttachAlert(a.Labels["site"], a.Labels["alertname"]) {
+			attached++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"attached": attached})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/events"
+)
+
+// TransferEvent is a transfer-complete notification published by a site
+// agent. Ingested events are appended to transfers.csv on the shared volume,
+// the same file the exporters write and dtms-api computes freshness from.
+// Site is the destination; Source, when known, is the site data came from,
+// and Tenant the owner of the data, by default the tenant in the site's
+// metadata. Status "deleted" reports removed data. Failed transfers should
+// carry the error text in Reason. File (a logical name), URL and Checksum
+// identify the delivered file, and Dataset the collection it belongs to.
+type TransferEvent struct {
+	ID        string  `json:"id"`
+	Site      string  `json:"site"`
+	Source    string  `json:"source,omitempty"`
+	Tenant    string  `json:"tenant,omitempty"`
+	VO        string  `json:"vo,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Status    string  `json:"status"`
+	Reason    string  `json:"reason,omitempty"`
+	Dataset   string  `json:"dataset,omitempty"`
+	File      string  `json:"file,omitempty"`
+	URL       string  `json:"url,omitempty"`
+	Checksum  string  `json:"checksum,omitempty"`
+	ClientDN  string  `json:"client_dn,omitempty"`
+}
+
+var (
+	transfersCSV   = envOr("TRANSFERS_CSV", filepath.Join(dataDir, "transfers.csv"))
+	ingestDedupTTL = envOrInt("INGEST_DEDUP_TTL_SECONDS", 3600)
+)
+
+// errInvalidEvent marks events that can never be ingested and should be
+// dead-lettered instead of retried.
+var errInvalidEvent = errors.New("invalid transfer event")
+
+var ingestEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dtms_ingest_events_total",
+		Help: "Transfer events seen by the ingestion pipeline by origin and result",
+	},
+	[]string{"origin", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(ingestEvents)
+}
+
+func decodeEvent(data []byte) (TransferEvent, error) {
+	var ev TransferEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return ev, fmt.Errorf("%w: %v", errInvalidEvent, err)
+	}
+	return ev, validateEvent(ev)
+}
+
+func validateEvent(ev TransferEvent) error {
+	switch {
+	case ev.ID == "":
+		return fmt.Errorf("%w: missing id", errInvalidEvent)
+	case ev.Site == "":
+		return fmt.Errorf("%w: missing site", errInvalidEvent)
+	case ev.Timestamp <= 0:
+		return fmt.Errorf("%w: missing timestamp", errInvalidEvent)
+	case ev.Bytes < 0 || ev.Duration < 0:
+		return fmt.Errorf("%w: negative bytes or duration", errInvalidEvent)
+	}
+	return nil
+}
+
+// The ingestor is the code path shared by every ingestion transport, a
+// staged pipeline joined by bounded channels:
+//
+//	decode/validate (INGEST_WORKERS) -> enrich -> persist (batches of INGEST_BATCH_SIZE)
+//
+// Persist drops redeliveries (see dedup.go), appends everything that is waiting to
+// transfers.csv in one write and only then reports each event done. When
+// INGEST_QUEUE_SIZE events are waiting to be decoded, Submit blocks, which
+// pauses the broker consumers, and TrySubmit refuses, which webhooks turn
+// into 429.
+var (
+	ingestQueueSize = envOrInt("INGEST_QUEUE_SIZE", 10000)
+	ingestBatchSize = envOrInt("INGEST_BATCH_SIZE", 500)
+	ingestWorkers   = envOrInt("INGEST_WORKERS", 4)
+)
+
+// errIngestBusy is returned by TrySubmit when the pipeline is full.
+var errIngestBusy = errors.New("ingestion queue full")
+
+var histIngestBatch = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "dtms_ingest_batch_size",
+	Help:    "Events persisted per transfers.csv write",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 7),
+})
+
+// ingestJob is one event moving through the pipeline. raw is set until
+// the event has been decoded. Invalid events are dead-lettered
+// (deadletters.go) unless they are being replayed from there.
+type ingestJob struct {
+	origin string
+	raw    []byte
+	ev     TransferEvent
+	replay bool
+	done   chan error
+}
+
+// ingestTicket reports the outcome of a submitted event.
+type ingestTicket struct{ done chan error }
+
+// Wait blocks until the event is persisted, dropped as a duplicate (nil)
+// or rejected; errInvalidEvent means it should be dead-lettered.
+func (t ingestTicket) Wait() error { return <-t.done }
+
+type ingestor struct {
+	start    sync.Once
+	incoming chan *ingestJob
+	enrichCh chan *ingestJob
+	persistC chan *ingestJob
+
+	mu   sync.Mutex
+	seen *eventDedup
+}
+
+var ingest = &ingestor{
+	seen: newEventDedup(time.Duration(ingestDedupTTL)*time.Second, ingestDedupCapacity, ingestDedupFPRate, ingestDedupExact),
+}
+
+func init() {
+	prometheus.MustRegister(histIngestBatch)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "dtms_ingest_queue_events", Help: "Events waiting in the ingestion pipeline"},
+		func() float64 {
+			return float64(len(ingest.incoming) + len(ingest.enrichCh) + len(ingest.persistC))
+		},
+	))
+}
+
+// run starts the stages on first use; they live as long as the process.
+func (in *ingestor) run() {
+	in.start.Do(func() {
+		in.incoming = make(chan *ingestJob, ingestQueueSize)
+		in.enrichCh = make(chan *ingestJob, ingestBatchSize)
+		in.persistC = make(chan *ingestJob, ingestBatchSize)
+		for i := 0; i < max(ingestWorkers, 1); i++ {
+			go in.decodeStage()
+		}
+		go in.enrichStage()
+		go in.persistStage()
+	})
+}
+
+func newIngestJob(origin string, raw []byte, ev TransferEvent) *ingestJob {
+	return &ingestJob{origin: origin, raw: raw, ev: ev, done: make(chan error, 1)}
+}
+
+// Submit queues a raw event, waiting while the pipeline is full.
+func (in *ingestor) Submit(origin string, data []byte) ingestTicket {
+	in.run()
+	j := newIngestJob(origin, data, TransferEvent{})
+	in.incoming <- j
+	return ingestTicket{j.done}
+}
+
+// TrySubmit queues a decoded event unless the pipeline is full.
+func (in *ingestor) TrySubmit(origin string, ev TransferEvent) (ingestTicket, error) {
+	in.run()
+	j := newIngestJob(origin, nil, ev)
+	select {
+	case in.incoming <- j:
+		return ingestTicket{j.done}, nil
+	default:
+		ingestEvents.WithLabelValues(origin, "backpressure").Inc()
+		return ingestTicket{}, errIngestBusy
+	}
+}
+
+// Ingest decodes and persists one raw event. A nil error means the message
+// can be acknowledged; errInvalidEvent means it should be dead-lettered.
+func (in *ingestor) Ingest(origin string, data []byte) error {
+	return in.Submit(origin, data).Wait()
+}
+
+// replay ingests a dead-lettered payload again, waiting for the outcome.
+func (in *ingestor) replay(origin string, data []byte) error {
+	in.run()
+	j := newIngestJob(origin, data, TransferEvent{})
+	j.replay = true
+	in.incoming <- j
+	return ingestTicket{j.done}.Wait()
+}
+
+// IngestEvent persists an already decoded event, waiting for the outcome.
+func (in *ingestor) IngestEvent(origin string, ev TransferEvent) error {
+	in.run()
+	j := newIngestJob(origin, nil, ev)
+	in.incoming <- j
+	return ingestTicket{j.done}.Wait()
+}
+
+func (in *ingestor) decodeStage() {
+	for j := range in.incoming {
+		var err error
+		raw := j.raw
+		if raw != nil {
+			j.ev, err = decodeEvent(raw)
+			j.raw = nil
+		} else {
+			err = validateEvent(j.ev)
+		}
+		if err != nil {
+			ingestEvents.WithLabelValues(j.origin, "invalid").Inc()
+			switch {
+			case j.replay:
+			case raw != nil:
+				deadLetters.Add(j.origin, deadLetterInvalid, raw, err)
+			default:
+				deadLetters.addEvent(j.origin, deadLetterInvalid, j.ev, err)
+			}
+			j.done <- err
+			continue
+		}
+		in.enrichCh <- j
+	}
+}
+
+// enrichStage fills in what the sender may leave out: the status, and the
+// tenant and VO from the site's metadata.
+func (in *ingestor) enrichStage() {
+	for j := range in.enrichCh {
+		if j.ev.Status == "" {
+			j.ev.Status = "success"
+		}
+		if j.ev.Tenant == "" {
+			j.ev.Tenant = siteRegistry().lookup(j.ev.Site).Metadata["tenant"]
+		}
+		if j.ev.VO == "" {
+			j.ev.VO = siteVO(j.ev.Site)
+		}
+		in.persistC <- j
+	}
+}
+
+// persistStage takes whatever is waiting, up to a batch, and persists it
+// together, so batches grow with the load and stay small when idle.
+func (in *ingestor) persistStage() {
+	batch := make([]*ingestJob, 0, ingestBatchSize)
+	for j := range in.persistC {
+		batch = append(batch[:0], j)
+	drain:
+		for len(batch) < ingestBatchSize {
+			select {
+			case j := <-in.persistC:
+				batch = append(batch, j)
+			default:
+				break drain
+			}
+		}
+		in.persist(batch)
+	}
+}
+
+func (in *ingestor) persist(batch []*ingestJob) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	now := time.Now()
+	var fresh []*ingestJob
+	var rows []TransferEvent
+	batchIDs := map[string]bool{}
+	for _, j := range batch {
+		if batchIDs[j.ev.ID] || in.seen.Seen(j.ev.ID, now) {
+			ingestEvents.WithLabelValues(j.origin, "duplicate").Inc()
+			j.done <- nil
+			continue
+		}
+		batchIDs[j.ev.ID] = true
+		fresh = append(fresh, j)
+		// Deletions feed quota accounting but are not arrivals, so they
+		// stay out of transfers.csv and the freshness computed from it.
+		if j.ev.Status != eventDeleted {
+			rows = append(rows, j.ev)
+		}
+	}
+	if len(rows) > 0 {
+		histIngestBatch.Observe(float64(len(rows)))
+		if err := appendTransferRows(rows); err != nil {
+			for _, j := range fresh {
+				ingestEvents.WithLabelValues(j.origin, "error").Inc()
+				j.done <- err
+			}
+			return
+		}
+	}
+	for _, j := range fresh {
+		ev := j.ev
+		in.seen.Add(ev.ID, now)
+		observeTransfer(ev)
+		sampleChecksum(ev)
+		duplicates.Observe(ev)
+		completeness.Observe(ev)
+		lineage.Observe(ev)
+		quotas.Observe(ev)
+		catalog.Observe(ev)
+		accounting.Observe(ev)
+		voFlows.Observe(ev)
+		expectedArrivals.Observe(ev)
+		hints.Observe(ev)
+		warehouse.Observe(ev)
+		bus.Publish(events.Event{Type: eventTransferIngested, Site: ev.Site, Data: ev})
+		ingestEvents.WithLabelValues(j.origin, "accepted").Inc()
+		j.done <- nil
+	}
+}
+
+// appendTransferRows writes events using the exporter's transfers.csv
+// columns.
+func appendTransferRows(events []TransferEvent) error {
+	if err := os.MkdirAll(filepath.Dir(transfersCSV), 0o755); err != nil {
+		return err
+	}
+	_, statErr := os.Stat(transfersCSV)
+	f, err := os.OpenFile(transfersCSV, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if os.IsNotExist(statErr) {
+		w.Write([]string{"timestamp_iso", "timestamp_unix", "bytes", "duration", "throughput_bytes_per_sec", "status", "site"})
+	}
+	for _, ev := range events {
+		throughput := 0.0
+		if ev.Duration > 0 {
+			throughput = float64(ev.Bytes) / ev.Duration
+		}
+		w.Write([]string{
+			unixTime(ev.Timestamp).Format("2006-01-02T15:04:05.000000Z"),
+			strconv.FormatFloat(ev.Timestamp, 'f', -1, 64),
+			strconv.FormatInt(ev.Bytes, 10),
+			strconv.FormatFloat(ev.Duration, 'f', -1, 64),
+			strconv.FormatFloat(throughput, 'f', -1, 64),
+			ev.Status,
+			ev.Site,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,86 @@
+package yamlenv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	t.Setenv("DTMS_TEST_HOST", "db.example.org")
+	t.Setenv("DTMS_TEST_PORT", "5432")
+	t.Setenv("DTMS_TEST_EMPTY", "")
+	type conf struct {
+		URL   string            `yaml:"url"`
+		Port  int               `yaml:"port"`
+		Match string            `yaml:"match"`
+		Quote string            `yaml:"quote"`
+		Empty string            `yaml:"empty"`
+		Keys  map[string]string `yaml:"keys"`
+		List  []string          `yaml:"list"`
+	}
+	for _, tc := range []struct {
+		name, in string
+		want     conf
+		err      string
+	}{
+		{name: "string value", in: "url: postgres://${DTMS_TEST_HOST}/dtms",
+			want: conf{URL: "postgres://db.example.org/dtms"}},
+		{name: "plain value resolves to int", in: "port: ${DTMS_TEST_PORT}",
+			want: conf{Port: 5432}},
+		{name: "quoted value stays a string", in: `quote: "${DTMS_TEST_PORT}"`,
+			want: conf{Quote: "5432"}},
+		{name: "set but empty", in: "empty: x${DTMS_TEST_EMPTY}y",
+			want: conf{Empty: "xy"}},
+		{name: "bare dollar left alone", in: `match: '^(?P<site>\w+)$'`,
+			want: conf{Match: `^(?P<site>\w+)$`}},
+		{name: "$VAR without braces left alone", in: "match: $DTMS_TEST_HOST",
+			want: conf{Match: "$DTMS_TEST_HOST"}},
+		{name: "keys not expanded", in: "keys:\n  ${DTMS_TEST_HOST}: ${DTMS_TEST_PORT}",
+			want: conf{Keys: map[string]string{"${DTMS_TEST_HOST}": "5432"}}},
+		{name: "comments ignored", in: "# ${DTMS_TEST_UNSET}\nurl: a",
+			want: conf{URL: "a"}},
+		{name: "sequence items", in: "list:\n  - ${DTMS_TEST_HOST}\n  - b",
+			want: conf{List: []string{"db.example.org", "b"}}},
+		{name: "unset variable", in: "url: x\nmatch: ${DTMS_TEST_UNSET}",
+			err: "line 2: ${DTMS_TEST_UNSET} not set"},
+		{name: "empty document", in: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got conf
+			err := Unmarshal([]byte(tc.in), &got)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLookup(t *testing.T) {
+	t.Setenv("DTMS_TEST_SECRET", "hunter2")
+	allowed := func(name string) (string, bool) {
+		if name != "DTMS_TEST_ALLOWED" {
+			return "", false
+		}
+		return "ok", true
+	}
+	var got struct {
+		A string `yaml:"a"`
+	}
+	if err := UnmarshalLookup([]byte("a: ${DTMS_TEST_ALLOWED}"), &got, allowed); err != nil || got.A != "ok" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	err := UnmarshalLookup([]byte("a: ${DTMS_TEST_SECRET}"), &got, allowed)
+	if err == nil || !strings.Contains(err.Error(), "${DTMS_TEST_SECRET} not set") {
+		t.Fatalf("err = %v, want the environment ignored", err)
+	}
+}
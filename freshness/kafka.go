@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	kafkaBrokers  = envOr("KAFKA_BROKERS", "")
+	kafkaTopic    = envOr("KAFKA_TOPIC", "dtms.transfers")
+	kafkaGroupID  = envOr("KAFKA_GROUP_ID", "dtms-ingest")
+	kafkaDLQTopic = envOr("KAFKA_DLQ_TOPIC", "dtms.transfers.dlq")
+	// kafkaMaxInFlight bounds the messages fetched but not yet committed;
+	// fetching pauses while that many are waiting on the pipeline.
+	kafkaMaxInFlight = envOrInt("KAFKA_MAX_IN_FLIGHT", 1000)
+)
+
+// kafkaInFlight is a fetched message and its place in the pipeline.
+type kafkaInFlight struct {
+	msg    kafka.Message
+	ticket ingestTicket
+}
+
+// kafkaConsumeLoop ingests transfer events from KAFKA_TOPIC as part of a
+// consumer group. Offsets are committed only once an event has been
+// persisted or dead-lettered, so delivery is at-least-once and redeliveries
+// are absorbed by the ingestor's dedup.
+func kafkaConsumeLoop(ctx context.Context) {
+	brokers := strings.Split(kafkaBrokers, ",")
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		Topic:   kafkaTopic,
+		GroupID: kafkaGroupID,
+	})
+	defer r.Close()
+	dlq := &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    kafkaDLQTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer dlq.Close()
+
+	fmt.Printf("[kafka] consuming %s as group %s from %s\n", kafkaTopic, kafkaGroupID, kafkaBrokers)
+	inFlight := make(chan kafkaInFlight, kafkaMaxInFlight)
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		kafkaCommitLoop(ctx, r, dlq, inFlight)
+	}()
+	defer func() {
+		close(inFlight)
+		<-committed
+	}()
+	backoff := time.Second
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("[kafka] fetch error, retrying in %s: %v\n", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		select {
+		case inFlight <- kafkaInFlight{m, ingest.Submit("kafka", m.Value)}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// kafkaCommitLoop settles fetched messages in offset order, committing each
+// once it has been persisted or dead-lettered.
+func kafkaCommitLoop(ctx context.Context, r *kafka.Reader, dlq *kafka.Writer, inFlight <-chan kafkaInFlight) {
+	for f := range inFlight {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := handleKafkaMessage(ctx, dlq, f.msg, f.ticket.Wait()); err != nil {
+			// only reached on shutdown; leave the offset uncommitted
+			continue
+		}
+		if err := r.CommitMessages(ctx, f.msg); err != nil && ctx.Err() == nil {
+			fmt.Printf("[kafka] commit error: %v\n", err)
+		}
+	}
+}
+
+// handleKafkaMessage dead-letters an invalid message and retries one that
+// failed to persist; err is the outcome of its first attempt.
+func handleKafkaMessage(ctx context.Context, dlq *kafka.Writer, m kafka.Message, err error) error {
+	backoff := time.Second
+	for {
+		if errors.Is(err, errInvalidEvent) {
+			fmt.Printf("[kafka] dead-lettering offset %d/%d: %v\n", m.Partition, m.Offset, err)
+			err = dlq.WriteMessages(ctx, kafka.Message{
+				Key:   m.Key,
+				Value: m.Value,
+				Headers: append(m.Headers,
+					kafka.Header{Key: "dtms-error", Value: []byte(err.Error())},
+					kafka.Header{Key: "dtms-source-topic", Value: []byte(m.Topic)},
+				),
+			})
+		}
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("[kafka] offset %d/%d failed, retrying in %s: %v\n", m.Partition, m.Offset, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+		err = ingest.Ingest("kafka", m.Value)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"gopkg.in/yaml.v3"
+)
+
+// KAFKA_LAG_TARGETS lists group:topic pairs whose consumer lag is reported
+// as freshness of the site "kafka/<topic>/<group>".
+var (
+	kafkaLagBrokers = envOr("KAFKA_LAG_BROKERS", kafkaBrokers)
+	kafkaLagTargets = envOr("KAFKA_LAG_TARGETS", "")
+)
+
+var gaugeKafkaLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "dtms_kafka_consumer_lag_messages",
+		Help: "Messages between the committed offset and the end of the topic, summed over partitions",
+	},
+	[]string{"group", "topic"},
+)
+
+func init() {
+	prometheus.MustRegister(gaugeKafkaLag)
+}
+
+type kafkaLagTarget struct {
+	Group string `yaml:"group"`
+	Topic string `yaml:"topic"`
+}
+
+type kafkaLagSource struct {
+	name    string
+	Brokers []string         `yaml:"brokers"`
+	Targets []kafkaLagTarget `yaml:"targets"`
+}
+
+func init() {
+	registerSource("kafka-lag", func(name string, params *yaml.Node) (Source, error) {
+		s := &kafkaLagSource{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if len(s.Brokers) == 0 {
+			return nil, fmt.Errorf("brokers is required")
+		}
+		return s, nil
+	})
+}
+
+func kafkaLagFromEnv() *kafkaLagSource {
+	s := &kafkaLagSource{name: "kafka-lag", Brokers: strings.Split(kafkaLagBrokers, ",")}
+	for _, target := range strings.Split(kafkaLagTargets, ",") {
+		group, topic, _ := strings.Cut(strings.TrimSpace(target), ":")
+		s.Targets = append(s.Targets, kafkaLagTarget{Group: group, Topic: topic})
+	}
+	return s
+}
+
+func (s *kafkaLagSource) Name() string { return s.name }
+
+// Collect reports, per target, the age of the oldest message the group has
+// not consumed yet. A group that is caught up is fresh (age 0) regardless
+// of how long ago the topic last received data. A target that cannot be
+// read is left out and its error returned with the others' results.
+func (s *kafkaLagSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	client := &kafka.Client{
+		Addr:    kafka.TCP(s.Brokers...),
+		Timeout: 10 * time.Second,
+	}
+	now := time.Now()
+	var out []SiteFresh
+	var errs []error
+	for _, t := range s.Targets {
+		group, topic := t.Group, t.Topic
+		if group == "" || topic == "" {
+			errs = append(errs, fmt.Errorf("target needs group and topic, got %+v", t))
+			continue
+		}
+		oldest, lag, err := kafkaOldestUnconsumed(ctx, client, group, topic)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", topic, group, err))
+			continue
+		}
+		gaugeKafkaLag.WithLabelValues(group, topic).Set(float64(lag))
+		if lag == 0 || oldest.IsZero() {
+			oldest = now
+		}
+		out = append(out, SiteFresh{
+			Site:            "kafka/" + topic + "/" + group,
+			LatestTimestamp: float64(oldest.Unix()),
+			AgeSeconds:      now.Sub(oldest).Seconds(),
+		})
+	}
+	return out, errors.Join(errs...)
+}
+
+func kafkaOldestUnconsumed(ctx context.Context, client *kafka.Client, group, topic string) (time.Time, int64, error) {
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return time.Time{}, 0, fmt.Errorf("topic metadata unavailable")
+	}
+	var ids []int
+	var reqs []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		ids = append(ids, p.ID)
+		reqs = append(reqs, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: group,
+		Topics:  map[string][]int{topic: ids},
+	})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	ends, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: reqs},
+	})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	bounds := map[int]kafka.PartitionOffsets{}
+	for _, p := range ends.Topics[topic] {
+		bounds[p.Partition] = p
+	}
+
+	var oldest time.Time
+	var lag int64
+	for _, p := range committed.Topics[topic] {
+		b := bounds[p.Partition]
+		offset := p.CommittedOffset
+		if offset < b.FirstOffset {
+			// nothing committed yet, or committed data was deleted
+			offset = b.FirstOffset
+		}
+		if offset >= b.LastOffset {
+			continue
+		}
+		lag += b.LastOffset - offset
+		ts, err := kafkaRecordTime(ctx, client, topic, p.Partition, offset)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if oldest.IsZero() || ts.Before(oldest) {
+			oldest = ts
+		}
+	}
+	return oldest, lag, nil
+}
+
+func kafkaRecordTime(ctx context.Context, client *kafka.Client, topic string, partition int, offset int64) (time.Time, error) {
+	resp, err := client.Fetch(ctx, &kafka.FetchRequest{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		MaxBytes:  64 << 10,
+		MaxWait:   time.Second,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.Error != nil {
+		return time.Time{}, resp.Error
+	}
+	rec, err := resp.Records.ReadRecord()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return rec.Time, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// LDAP_CONFIG lets people call the state-changing API with their directory
+// credentials (HTTP basic auth) instead of the shared API_TOKEN. The user
+// is found and bound as, then the groups it belongs to are mapped to a
+// role and tenants; see ldap.example.yml. Logins are cached for cache_ttl,
+// and the groups of cached users are looked up again every refresh so
+// removing someone from a group takes effect without waiting for them to
+// log in again.
+var ldapConfigPath = envOr("LDAP_CONFIG", "")
+
+type ldapGroupMapping struct {
+	Group   string   `yaml:"group"` // DN or CN
+	Role    string   `yaml:"role"`
+	Tenants []string `yaml:"tenants"`
+}
+
+type ldapConfig struct {
+	URL          string             `yaml:"url"`
+	StartTLS     bool               `yaml:"start_tls"`
+	CAFile       string             `yaml:"ca_file"`
+	BindDN       string             `yaml:"bind_dn"`
+	BindPassword string             `yaml:"bind_password"`
+	UserBase     string             `yaml:"user_base"`
+	UserFilter   string             `yaml:"user_filter"`
+	GroupBase    string             `yaml:"group_base"`
+	GroupFilter  string             `yaml:"group_filter"`
+	CacheTTL     time.Duration      `yaml:"cache_ttl"`
+	Refresh      time.Duration      `yaml:"refresh"`
+	Groups       []ldapGroupMapping `yaml:"groups"`
+	tls          *tls.Config
+	cacheMu      sync.Mutex
+	cache        map[string]*ldapLogin
+}
+
+type ldapLogin struct {
+	dn       string
+	pwHash   [32]byte
+	who      *principal
+	loggedIn time.Time
+}
+
+// ldapDir is nil unless LDAP_CONFIG is set.
+var ldapDir *ldapConfig
+
+func loadLDAP() error {
+	if ldapConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(ldapConfigPath)
+	if err != nil {
+		return err
+	}
+	c := &ldapConfig{
+		UserFilter:  "(uid={username})",
+		GroupFilter: "(member={dn})",
+		CacheTTL:    10 * time.Minute,
+		Refresh:     5 * time.Minute,
+		cache:       map[string]*ldapLogin{},
+	}
+	if err := yamlenv.Unmarshal(raw, c); err != nil {
+		return fmt.Errorf("%s: %w", ldapConfigPath, err)
+	}
+	if c.URL == "" || c.UserBase == "" {
+		return fmt.Errorf("%s: url and user_base are required", ldapConfigPath)
+	}
+	if c.GroupBase == "" {
+		c.GroupBase = c.UserBase
+	}
+	for _, g := range c.Groups {
+		if g.Role != roleAdmin && g.Role != roleSiteAdmin {
+			return fmt.Errorf("%s: group %s: role must be %s or %s", ldapConfigPath, g.Group, roleAdmin, roleSiteAdmin)
+		}
+	}
+	if c.tls, err = loadTLSConfig(c.CAFile, "", ""); err != nil {
+		return err
+	}
+	ldapDir = c
+	return nil
+}
+
+func (c *ldapConfig) dial() (*ldap.Conn, error) {
+	var opts []ldap.DialOpt
+	if c.tls != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(c.tls))
+	}
+	conn, err := ldap.DialURL(c.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if c.StartTLS {
+		cfg := c.tls
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if err := conn.StartTLS(cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// serviceBind binds as bind_dn, or stays anonymous without one.
+func (c *ldapConfig) serviceBind(conn *ldap.Conn) error {
+	if c.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(c.BindDN, c.BindPassword)
+}
+
+// authenticate checks user's password by binding as them and returns the
+// principal their groups map to, or nil when they have no mapped group.
+func (c *ldapConfig) authenticate(user, password string) (*principal, error) {
+	if user == "" || password == "" {
+		return nil, nil
+	}
+	pwHash := sha256.Sum256([]byte(user + "\x00" + password))
+	c.cacheMu.Lock()
+	if l := c.cache[user]; l != nil && time.Since(l.loggedIn) < c.CacheTTL && subtle.ConstantTimeCompare(l.pwHash[:], pwHash[:]) == 1 {
+		c.cacheMu.Unlock()
+		return l.who, nil
+	}
+	c.cacheMu.Unlock()
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := c.serviceBind(conn); err != nil {
+		return nil, fmt.Errorf("service bind: %w", err)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		c.UserBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		strings.ReplaceAll(c.UserFilter, "{username}", ldap.EscapeFilter(user)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, nil
+	}
+	dn := res.Entries[0].DN
+	if err := conn.Bind(dn, password); err != nil {
+		return nil, nil
+	}
+	if err := c.serviceBind(conn); err != nil {
+		return nil, fmt.Errorf("service bind: %w", err)
+	}
+	who, err := c.lookupGroups(conn, user, dn)
+	if err != nil {
+		return nil, err
+	}
+	c.cacheMu.Lock()
+	c.cache[user] = &ldapLogin{dn: dn, pwHash: pwHash, who: who, loggedIn: time.Now()}
+	c.cacheMu.Unlock()
+	return who, nil
+}
+
+// lookupGroups maps dn's groups to a principal.
+func (c *ldapConfig) lookupGroups(conn *ldap.Conn, user, dn string) (*principal, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		c.GroupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+		strings.ReplaceAll(c.GroupFilter, "{dn}", ldap.EscapeFilter(dn)),
+		[]string{"cn"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	return c.mapGroups(user, res.Entries), nil
+}
+
+// mapGroups turns group entries into user's principal, nil when none is
+// mapped: admin wins over site-admin and tenants accumulate across groups.
+func (c *ldapConfig) mapGroups(user string, groups []*ldap.Entry) *principal {
+	var who *principal
+	for _, e := range groups {
+		cn := e.GetAttributeValue("cn")
+		for _, m := range c.Groups {
+			if !strings.EqualFold(m.Group, e.DN) && !strings.EqualFold(m.Group, cn) {
+				continue
+			}
+			if who == nil {
+				who = &principal{Name: user, Role: m.Role}
+			}
+			if m.Role == roleAdmin {
+				who.Role = roleAdmin
+			}
+			who.Tenants = append(who.Tenants, m.Tenants...)
+		}
+	}
+	return who
+}
+
+// refresh re-reads the groups of cached users and forgets expired logins.
+func (c *ldapConfig) refresh() error {
+	c.cacheMu.Lock()
+	logins := map[string]*ldapLogin{}
+	for user, l := range c.cache {
+		if time.Since(l.loggedIn) >= c.CacheTTL {
+			delete(c.cache, user)
+			continue
+		}
+		logins[user] = l
+	}
+	c.cacheMu.Unlock()
+	if len(logins) == 0 {
+		return nil
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := c.serviceBind(conn); err != nil {
+		return err
+	}
+	for user, l := range logins {
+		who, err := c.lookupGroups(conn, user, l.dn)
+		if err != nil {
+			return err
+		}
+		c.cacheMu.Lock()
+		if cur := c.cache[user]; cur == l {
+			cur.who = who
+		}
+		c.cacheMu.Unlock()
+	}
+	return nil
+}
+
+func (c *ldapConfig) loop(ctx context.Context) {
+	t := time.NewTicker(c.Refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := c.refresh(); err != nil {
+			fmt.Printf("[ldap] refresh: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLDAPMapGroups(t *testing.T) {
+	c := &ldapConfig{Groups: []ldapGroupMapping{
+		{Group: "cn=dtms-admins,ou=groups,dc=example,dc=org", Role: roleAdmin},
+		{Group: "site-a-ops", Role: roleSiteAdmin, Tenants: []string{"site-a"}},
+		{Group: "site-b-ops", Role: roleSiteAdmin, Tenants: []string{"site-b", "shared"}},
+	}}
+	group := func(cn string) *ldap.Entry {
+		return ldap.NewEntry("cn="+cn+",ou=groups,dc=example,dc=org", map[string][]string{"cn": {cn}})
+	}
+	for _, tc := range []struct {
+		name   string
+		groups []*ldap.Entry
+		want   *principal
+	}{
+		{"no groups", nil, nil},
+		{"unmapped groups only", []*ldap.Entry{group("staff")}, nil},
+		{"matched by CN", []*ldap.Entry{group("site-a-ops")},
+			&principal{Name: "alice", Role: roleSiteAdmin, Tenants: []string{"site-a"}}},
+		{"matched by DN, case-insensitively", []*ldap.Entry{ldap.NewEntry("CN=DTMS-Admins,OU=Groups,DC=example,DC=org", nil)},
+			&principal{Name: "alice", Role: roleAdmin}},
+		{"tenants accumulate", []*ldap.Entry{group("site-a-ops"), group("staff"), group("site-b-ops")},
+			&principal{Name: "alice", Role: roleSiteAdmin, Tenants: []string{"site-a", "site-b", "shared"}}},
+		{"admin wins whatever the order", []*ldap.Entry{group("site-a-ops"), group("dtms-admins")},
+			&principal{Name: "alice", Role: roleAdmin, Tenants: []string{"site-a"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := c.mapGroups("alice", tc.groups); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadLDAPRoles(t *testing.T) {
+	saved, savedDir := ldapConfigPath, ldapDir
+	t.Cleanup(func() { ldapConfigPath, ldapDir = saved, savedDir })
+	for _, tc := range []struct {
+		name, role, err string
+	}{
+		{"admin", roleAdmin, ""},
+		{"site-admin", roleSiteAdmin, ""},
+		{"unknown role", "owner", "role must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ldapConfigPath = filepath.Join(t.TempDir(), "ldap.yml")
+			conf := "url: ldap://ldap.example.org\nuser_base: ou=people,dc=example,dc=org\ngroups:\n  - group: ops\n    role: " + tc.role + "\n"
+			if err := os.WriteFile(ldapConfigPath, []byte(conf), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			err := loadLDAP()
+			if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("err = %v, want %q", err, tc.err)
+			}
+			if err == nil && ldapDir.GroupBase != ldapDir.UserBase {
+				t.Errorf("group_base defaults to %q", ldapDir.GroupBase)
+			}
+		})
+	}
+}
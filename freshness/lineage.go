@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// LINEAGE_CONFIG declares datasets derived from others:
+//
+//	derived:
+//	  - dataset: reco-2026
+//	    site: SITE_B
+//	    inputs:
+//	      - {dataset: raw-2026, site: SITE_A}
+//
+// A derived dataset can be no fresher than its inputs, so its derived
+// freshness is the oldest of its own latest arrival and its inputs'
+// derived freshness. Per-dataset arrivals come from ingested events that
+// name a dataset and are kept in LINEAGE_STATE; they double as the index
+// of which datasets exist where.
+var (
+	lineageConfigPath = envOr("LINEAGE_CONFIG", "")
+	lineageStatePath  = envOr("LINEAGE_STATE", filepath.Join(dataDir, "dataset-latest.json"))
+)
+
+var (
+	gaugeDatasetFresh = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_dataset_fresh_seconds", Help: "Seconds since the dataset last received data at the site"},
+		[]string{"dataset", "site"},
+	)
+	gaugeDatasetDerivedFresh = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_dataset_derived_fresh_seconds", Help: "Dataset freshness bounded by the freshness of its lineage inputs"},
+		[]string{"dataset", "site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeDatasetFresh, gaugeDatasetDerivedFresh)
+}
+
+// DatasetRef names a dataset at a site; it is the node type of the graph.
+type DatasetRef struct {
+	Dataset string `json:"dataset" yaml:"dataset"`
+	Site    string `json:"site" yaml:"site"`
+}
+
+func (r DatasetRef) String() string { return r.Dataset + "@" + r.Site }
+
+// datasetArrivals is the persisted record of a dataset's data at a site.
+type datasetArrivals struct {
+	DatasetRef
+	First  float64 `json:"first_timestamp"`
+	Latest float64 `json:"latest_timestamp"`
+}
+
+type lineageEdge struct {
+	DatasetRef `yaml:",inline"`
+	Inputs     []DatasetRef `yaml:"inputs"`
+}
+
+// LineageNode is one dataset in an API response. Latest timestamps are 0
+// when nothing has arrived.
+type LineageNode struct {
+	DatasetRef
+	Inputs        []DatasetRef `json:"inputs,omitempty"`
+	Outputs       []DatasetRef `json:"outputs,omitempty"`
+	Latest        float64      `json:"latest_timestamp"`
+	DerivedLatest float64      `json:"derived_latest_timestamp"`
+	LimitedBy     *DatasetRef  `json:"limited_by,omitempty"`
+}
+
+type lineageGraph struct {
+	mu      sync.Mutex
+	inputs  map[DatasetRef][]DatasetRef
+	outputs map[DatasetRef][]DatasetRef
+	latest  map[DatasetRef]float64
+	first   map[DatasetRef]float64
+	dirty   bool
+}
+
+var lineage = &lineageGraph{
+	inputs:  map[DatasetRef][]DatasetRef{},
+	outputs: map[DatasetRef][]DatasetRef{},
+	latest:  map[DatasetRef]float64{},
+	first:   map[DatasetRef]float64{},
+}
+
+func loadLineage() error {
+	if raw, err := os.ReadFile(lineageStatePath); err == nil {
+		var rows []datasetArrivals
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return fmt.Errorf("%s: %w", lineageStatePath, err)
+		}
+		for _, r := range rows {
+			lineage.latest[r.DatasetRef] = r.Latest
+			lineage.first[r.DatasetRef] = r.First
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if lineageConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(lineageConfigPath)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Derived []lineageEdge `yaml:"derived"`
+	}
+	if err := yamlenv.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("%s: %w", lineageConfigPath, err)
+	}
+	for _, e := range f.Derived {
+		if e.Dataset == "" || e.Site == "" || len(e.Inputs) == 0 {
+			return fmt.Errorf("%s: derived entries need dataset, site and inputs", lineageConfigPath)
+		}
+		lineage.inputs[e.DatasetRef] = append(lineage.inputs[e.DatasetRef], e.Inputs...)
+		for _, in := range e.Inputs {
+			lineage.outputs[in] = append(lineage.outputs[in], e.DatasetRef)
+		}
+	}
+	for n := range lineage.inputs {
+		if err := lineage.checkCycle(n, map[DatasetRef]bool{}); err != nil {
+			return fmt.Errorf("%s: %w", lineageConfigPath, err)
+		}
+	}
+	return nil
+}
+
+func (g *lineageGraph) checkCycle(n DatasetRef, path map[DatasetRef]bool) error {
+	if path[n] {
+		return fmt.Errorf("lineage cycle through %s", n)
+	}
+	path[n] = true
+	defer delete(path, n)
+	for _, in := range g.inputs[n] {
+		if err := g.checkCycle(in, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *lineageGraph) Observe(ev TransferEvent) {
+	if ev.Status != "success" || ev.Dataset == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ref := DatasetRef{ev.Dataset, ev.Site}
+	if ev.Timestamp > g.latest[ref] {
+		g.latest[ref] = ev.Timestamp
+		g.dirty = true
+	}
+	if first, ok := g.first[ref]; !ok || ev.Timestamp < first {
+		g.first[ref] = ev.Timestamp
+		g.dirty = true
+	}
+}
+
+// Forget drops a dataset's arrivals at a site once it has been deleted
+// there.
+func (g *lineageGraph) Forget(ref DatasetRef) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.latest, ref)
+	delete(g.first, ref)
+	g.dirty = true
+}
+
+// derived returns n's derived latest timestamp and the upstream dataset
+// that bounds it (n itself when its own data is the oldest).
+func (g *lineageGraph) derived(n DatasetRef, memo map[DatasetRef]LineageNode) (float64, DatasetRef) {
+	if m, ok := memo[n]; ok {
+		return m.DerivedLatest, *m.LimitedBy
+	}
+	latest, by := g.latest[n], n
+	for _, in := range g.inputs[n] {
+		if t, b := g.derived(in, memo); t < latest {
+			latest, by = t, b
+		}
+	}
+	memo[n] = LineageNode{DerivedLatest: latest, LimitedBy: &by}
+	return latest, by
+}
+
+func (g *lineageGraph) node(n DatasetRef, memo map[DatasetRef]LineageNode) LineageNode {
+	t, by := g.derived(n, memo)
+	out := LineageNode{
+		DatasetRef:    n,
+		Inputs:        g.inputs[n],
+		Outputs:       g.outputs[n],
+		Latest:        g.latest[n],
+		DerivedLatest: t,
+	}
+	if by != n {
+		out.LimitedBy = &by
+	}
+	return out
+}
+
+// Nodes returns every dataset known from lineage or arrivals.
+func (g *lineageGraph) Nodes() []LineageNode {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seen := map[DatasetRef]bool{}
+	for n := range g.latest {
+		seen[n] = true
+	}
+	for n, ins := range g.inputs {
+		seen[n] = true
+		for _, in := range ins {
+			seen[in] = true
+		}
+	}
+	memo := map[DatasetRef]LineageNode{}
+	out := make([]LineageNode, 0, len(seen))
+	for n := range seen {
+		out = append(out, g.node(n, memo))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out
+}
+
+// Impact returns everything transitively derived from n, nearest first.
+func (g *lineageGraph) Impact(n DatasetRef) []LineageNode {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	memo := map[DatasetRef]LineageNode{}
+	seen := map[DatasetRef]bool{n: true}
+	out := []LineageNode{}
+	for queue := g.outputs[n]; len(queue) > 0; queue = queue[1:] {
+		d := queue[0]
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		out = append(out, g.node(d, memo))
+		queue = append(queue, g.outputs[d]...)
+	}
+	return out
+}
+
+// refreshLoop republishes the dataset gauges and persists arrivals.
+func (g *lineageGraph) refreshLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := float64(time.Now().Unix())
+		for _, n := range g.Nodes() {
+			if n.Latest > 0 {
+				gaugeDatasetFresh.WithLabelValues(n.Dataset, n.Site).Set(now - n.Latest)
+			}
+			derived := math.Inf(1)
+			if n.DerivedLatest > 0 {
+				derived = now - n.DerivedLatest
+			}
+			gaugeDatasetDerivedFresh.WithLabelValues(n.Dataset, n.Site).Set(derived)
+		}
+		if err := g.save(); err != nil {
+			fmt.Printf("[lineage] save: %v\n", err)
+		}
+	}
+}
+
+func (g *lineageGraph) save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.dirty {
+		return nil
+	}
+	rows := make([]datasetArrivals, 0, len(g.latest))
+	for n, t := range g.latest {
+		rows = append(rows, datasetArrivals{n, g.first[n], t})
+	}
+	raw, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(lineageStatePath, raw); err != nil {
+		return err
+	}
+	g.dirty = false
+	return nil
+}
+
+// handleLineage serves GET /api/v1/lineage, the whole graph, and
+// GET /api/v1/lineage?dataset=&site=&impact=true, the datasets downstream
+// of one node.
+func handleLineage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("impact") != "true" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"datasets": lineage.Nodes()})
+		return
+	}
+	ref := DatasetRef{q.Get("dataset"), q.Get("site")}
+	if ref.Dataset == "" || ref.Site == "" {
+		http.Error(w, "dataset and site are required for impact", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"source": ref, "impacted": lineage.Impact(ref)})
+}
+
+// Placements returns the arrivals of every known dataset by site.
+func (g *lineageGraph) Placements() map[string]map[string]datasetArrivals {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := map[string]map[string]datasetArrivals{}
+	for n, t := range g.latest {
+		if out[n.Dataset] == nil {
+			out[n.Dataset] = map[string]datasetArrivals{}
+		}
+		out[n.Dataset][n.Site] = datasetArrivals{n, g.first[n], t}
+	}
+	return out
+}
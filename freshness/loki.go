@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With LOKI_URL set, freshness evaluations and alert notifications are
+// shipped to Loki's push API as JSON log lines, one stream per label set:
+// job="dtms", event (evaluation or alert), site, tenant (the site's
+// "tenant" metadata) and severity (info or warning for evaluations, the
+// alert's severity label for alerts). LOKI_LABELS adds static labels
+// ("env=prod,cluster=a"), LOKI_TENANT sets X-Scope-OrgID and
+// LOKI_USERNAME/LOKI_PASSWORD basic auth. LOKI_EVALUATIONS=changes ships
+// only evaluations whose ok state changed instead of every poll. Entries
+// are pushed every LOKI_PUSH_SECONDS; up to LOKI_BUFFER_ENTRIES are kept
+// while Loki is unreachable.
+var (
+	lokiURL         = envOr("LOKI_URL", "")
+	lokiTenant      = envOr("LOKI_TENANT", "")
+	lokiUsername    = envOr("LOKI_USERNAME", "")
+	lokiPassword    = envOr("LOKI_PASSWORD", "")
+	lokiLabels      = parseLabelList(envOr("LOKI_LABELS", ""))
+	lokiEvaluations = envOr("LOKI_EVALUATIONS", "all")
+	lokiPush        = time.Duration(envOrInt("LOKI_PUSH_SECONDS", 5)) * time.Second
+	lokiBuffer      = envOrInt("LOKI_BUFFER_ENTRIES", 50000)
+)
+
+var lokiEntries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_loki_entries_total", Help: "Log entries for Loki by result (pushed, failed, dropped)"},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(lokiEntries)
+}
+
+// parseLabelList reads "k=v,k2=v2".
+func parseLabelList(s string) map[string]string {
+	out := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok && k != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type lokiEntry struct {
+	labels map[string]string
+	at     time.Time
+	line   []byte
+}
+
+type lokiShipper struct {
+	mu      sync.Mutex
+	entries []lokiEntry
+	lastOk  map[string]bool
+}
+
+var loki = &lokiShipper{lastOk: map[string]bool{}}
+
+func (l *lokiShipper) add(labels map[string]string, at time.Time, fields map[string]interface{}) {
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	for k, v := range lokiLabels {
+		labels[k] = v
+	}
+	labels["job"] = "dtms"
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, lokiEntry{labels, at, line})
+	if over := len(l.entries) - lokiBuffer; over > 0 {
+		lokiEntries.WithLabelValues("dropped").Add(float64(over))
+		l.entries = append([]lokiEntry(nil), l.entries[over:]...)
+	}
+}
+
+// Evaluation records one site's freshness evaluation from the poll loop.
+func (l *lokiShipper) Evaluation(s SiteFresh, ok bool, now time.Time) {
+	if lokiURL == "" {
+		return
+	}
+	l.mu.Lock()
+	prev, seen := l.lastOk[s.Site]
+	l.lastOk[s.Site] = ok
+	l.mu.Unlock()
+	if lokiEvaluations == "changes" && seen && prev == ok {
+		return
+	}
+	severity := "info"
+	if !ok {
+		severity = "warning"
+	}
+	l.add(map[string]string{
+		"event":    "evaluation",
+		"site":     s.Site,
+		"tenant":   siteRegistry().lookup(s.Site).Metadata["tenant"],
+		"severity": severity,
+	}, now, map[string]interface{}{
+		"msg":              "freshness evaluated",
+		"age_seconds":      s.AgeSeconds,
+		"latest_timestamp": s.LatestTimestamp,
+		"ok":               ok,
+		"changed":          seen && prev != ok,
+	})
+}
+
+// Alert records one Alertmanager notification.
+func (l *lokiShipper) Alert(a alertEvent) {
+	if lokiURL == "" {
+		return
+	}
+	at := a.StartsAt
+	if a.Status == "resolved" {
+		at = a.EndsAt
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	site := a.Labels["site"]
+	l.add(map[string]string{
+		"event":    "alert",
+		"site":     site,
+		"tenant":   siteRegistry().lookup(site).Metadata["tenant"],
+		"severity": a.Labels["severity"],
+	}, at, map[string]interface{}{
+		"msg":         a.Annotations["summary"],
+		"alertname":   a.Labels["alertname"],
+		"status":      a.Status,
+		"fingerprint": a.Fingerprint,
+	})
+}
+
+// push sends the buffered entries, keeping them when Loki refuses.
+func (l *lokiShipper) push(ctx context.Context) error {
+	l.mu.Lock()
+	batch := l.entries
+	l.entries = nil
+	l.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	var keys []string
+	for _, e := range batch {
+		for k, v := range e.labels {
+			if v == "" {
+				delete(e.labels, k)
+			}
+		}
+		k := labelKey(e.labels)
+		st, ok := streams[k]
+		if !ok {
+			st = &stream{Stream: e.labels}
+			streams[k] = st
+			keys = append(keys, k)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(e.at.UnixNano(), 10), string(e.line)})
+	}
+	body := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, k := range keys {
+		// Loki wants each stream in time order; alerts can arrive late.
+		st := streams[k]
+		sort.SliceStable(st.Values, func(i, j int) bool {
+			a, _ := strconv.ParseInt(st.Values[i][0], 10, 64)
+			b, _ := strconv.ParseInt(st.Values[j][0], 10, 64)
+			return a < b
+		})
+		body.Streams = append(body.Streams, st)
+	}
+	raw, _ := json.Marshal(body)
+
+	retry, err := l.send(ctx, raw)
+	switch {
+	case err == nil:
+		lokiEntries.WithLabelValues("pushed").Add(float64(len(batch)))
+	case retry:
+		lokiEntries.WithLabelValues("failed").Add(float64(len(batch)))
+		l.mu.Lock()
+		l.entries = append(batch, l.entries...)
+		l.mu.Unlock()
+	default:
+		lokiEntries.WithLabelValues("dropped").Add(float64(len(batch)))
+	}
+	return err
+}
+
+// send posts one push request; retry is false when Loki rejected the
+// batch outright (a 4xx other than throttling) and resending cannot help.
+func (l *lokiShipper) send(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(lokiURL, "/")+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if lokiTenant != "" {
+		req.Header.Set("X-Scope-OrgID", lokiTenant)
+	}
+	if lokiUsername != "" {
+		req.SetBasicAuth(lokiUsername, lokiPassword)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("push: %s", resp.Status)
+	}
+	return false, nil
+}
+
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + labels[k] + ",")
+	}
+	return b.String()
+}
+
+func (l *lokiShipper) loop(ctx context.Context) {
+	t := time.NewTicker(lokiPush)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := l.push(ctx); err != nil {
+			fmt.Printf("[loki] %v\n", err)
+		}
+	}
+}
@@ -2,16 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dtmsclient "github.com/youruser/dtms-fresh/client"
+	"gopkg.in/yaml.v3"
 )
 
 type SiteFresh struct {
@@ -31,35 +29,20 @@ var (
 	threshold  = envOrInt("FRESHNESS_THRESHOLD_SECONDS", 300)
 )
 
-var (
-	gaugeFreshSeconds = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "dtms_data_fresh_seconds",
-			Help: "Age in seconds since last transfer for a site",
-		},
-		[]string{"site"},
-	)
-	gaugeFreshOk = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "dtms_data_fresh_ok",
-			Help: "1 if freshness is below threshold, 0 otherwise",
-		},
-		[]string{"site"},
-	)
-	client = &http.Client{
-		Timeout: 10 * time.Second,
-	}
-)
+var client = &http.Client{
+	Transport: sharedTransport,
+	Timeout:   httpClientTimeout,
+}
 
 func envOr(key, def string) string {
-	if v := os.Getenv(key); v != "" {
+	if v := getenv(key); v != "" {
 		return v
 	}
 	return def
 }
 
 func envOrInt(key string, def int) int {
-	if v := os.Getenv(key); v != "" {
+	if v := getenv(key); v != "" {
 		var t int
 		_, err := fmt.Sscanf(v, "%d", &t)
 		if err == nil {
@@ -69,52 +52,141 @@ func envOrInt(key string, def int) int {
 	return def
 }
 
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// apiSource polls dtms-api's /freshness endpoint.
+type apiSource struct {
+	name    string
+	BaseURL string `yaml:"url"`
+}
+
 func init() {
-	prometheus.MustRegister(gaugeFreshSeconds)
-	prometheus.MustRegister(gaugeFreshOk)
+	registerSource("dtms-api", func(name string, params *yaml.Node) (Source, error) {
+		s := &apiSource{name: name, BaseURL: apiBaseURL}
+		return s, params.Decode(s)
+	})
 }
 
-func fetchFreshness(ctx context.Context) (*FreshnessResp, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", apiBaseURL+"/freshness", nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := client.Do(req)
+func (s *apiSource) Name() string { return s.name }
+
+func (s *apiSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	api := dtmsclient.New(s.BaseURL)
+	api.HTTPClient = client
+	api.UserAgent = "dtms-freshness"
+	fresh, err := api.Freshness(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	var f FreshnessResp
-	if err := json.Unmarshal(body, &f); err != nil {
-		return nil, fmt.Errorf("json unmarshal: %w / body: %s", err, string(body))
+	sites := make([]SiteFresh, len(fresh))
+	for i, f := range fresh {
+		sites[i] = SiteFresh(f)
 	}
-	return &f, nil
+	return sites, nil
 }
 
-func pollLoop(ctx context.Context) {
+// collectSites gathers freshness from every configured source, running
+// them concurrently. A failing, hung or panicking source is logged and
+// skipped so it cannot blank the others.
+func collectSites(ctx context.Context, sources []*scheduledSource) []SiteFresh {
+	return collectAll(ctx, sources, time.Now())
+}
+
+func pollLoop(ctx context.Context, sources []*scheduledSource) {
 	t := time.NewTicker(time.Duration(interval) * time.Second)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-t.C:
-			f, err := fetchFreshness(ctx)
-			if err != nil {
-				fmt.Printf("[freshness] fetch error: %v\n", err)
-				continue
-			}
-			now := time.Now()
-			for _, s := range f.Sites {
-				gaugeFreshSeconds.WithLabelValues(s.Site).Set(s.AgeSeconds)
-				ok := 0.0
-				if s.AgeSeconds <= float64(threshold) {
-					ok = 1.0
+			all := append(sources[:len(sources):len(sources)], managed.Sources()...)
+			pctx, poll := startPoll(ctx, time.Now())
+			sites := collectSites(pctx, all)
+			eval := childOfPoll(pctx, "freshness.evaluate", time.Now())
+			evaluated := evaluatePoll(sites, time.Now())
+			if poll != nil {
+				stale := 0
+				for _, e := range evaluated {
+					if !e.Ok {
+						stale++
+					}
 				}
-				gaugeFreshOk.WithLabelValues(s.Site).Set(ok)
-				fmt.Printf("[freshness] site=%s age=%.2fs ok=%v\n", s.Site, s.AgeSeconds, ok == 1.0)
+				now := time.Now()
+				eval.Attr("dtms.sites", len(evaluated)).Attr("dtms.stale", stale).Finish(now, nil)
+				poll.Attr("dtms.sources", len(all)).Finish(now, nil)
+				tracer.Export(eval, poll)
 			}
-			_ = now
+		}
+	}
+}
+
+// evaluatePoll judges one poll's sites at now and feeds the verdicts to
+// the metrics, trackers and history.
+func evaluatePoll(sites []SiteFresh, now time.Time) []evaluatedSite {
+	samples := make([]HistorySample, 0, len(sites))
+	evaluated := make([]evaluatedSite, 0, len(sites))
+	metrics := nextMetricSnapshot()
+	for _, s := range sites {
+		inDowntime := len(downtimes.Active(s.Site, now)) > 0
+		cfg := siteRegistry().lookup(s.Site)
+		ok := 0.0
+		if evaluateOk(s, cfg, inDowntime, now) {
+			ok = 1.0
+		}
+		metrics.observeSite(s.Site, s.AgeSeconds, ok == 1.0, inDowntime, now)
+		anomalies.Observe(s, now)
+		forecaster.Observe(s, now)
+		slos.Observe(s.Site, ok == 1.0, now)
+		hints.Update(s.Site, s.AgeSeconds, ok == 1.0, now)
+		incidents.Observe(s.Site, s.AgeSeconds, ok == 1.0, now)
+		expectedArrivals.ObserveSite(s.Site, s.LatestTimestamp)
+		loki.Evaluation(s, ok == 1.0, now)
+		publishFreshness(s.Site, ok == 1.0, s.AgeSeconds, cfg.Threshold)
+		fmt.Printf("[freshness] site=%s age=%.2fs ok=%v\n", s.Site, s.AgeSeconds, ok == 1.0)
+		samples = append(samples, HistorySample{
+			Timestamp:       float64(now.Unix()),
+			Site:            s.Site,
+			LatestTimestamp: s.LatestTimestamp,
+			AgeSeconds:      s.AgeSeconds,
+			Ok:              ok == 1.0,
+		})
+		evaluated = append(evaluated, evaluatedSite{
+			Site:            s.Site,
+			LatestTimestamp: s.LatestTimestamp,
+			AgeSeconds:      s.AgeSeconds,
+			Threshold:       cfg.Threshold,
+			Ok:              ok == 1.0,
+			InDowntime:      inDowntime,
+		})
+	}
+	publishFleet(samples, metrics)
+	metrics.publish()
+	snapshots.Offer(now, evaluated)
+	if err := history.Record(samples); err != nil {
+		fmt.Printf("[history] record error: %v\n", err)
+	}
+	return evaluated
+}
+
+func pruneLoop(ctx context.Context) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		dropped, err := history.Prune(time.Now())
+		if err != nil {
+			fmt.Printf("[history] prune error: %v\n", err)
+		}
+		for _, m := range dropped {
+			fmt.Printf("[history] dropped partition %s\n", m)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
 		}
 	}
 }
@@ -122,18 +194,318 @@ func pollLoop(ctx context.Context) {
 func main() {
 	// allow override via flags
 	flag.Parse()
+	if err := setupRecordReplay(); err != nil {
+		fmt.Printf("[freshness] %v\n", err)
+		os.Exit(1)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", metricsHandler())
+	http.HandleFunc("/webhooks/", handleWebhook)
+	http.HandleFunc("/api/v1/duplicates", handleDuplicates)
+	http.HandleFunc("/api/v1/manifests", handleManifests)
+	http.HandleFunc("/api/v1/completeness", handleCompleteness)
+	http.HandleFunc("/api/v1/lineage", handleLineage)
+	http.HandleFunc("/api/v1/subscriptions/violations", handleSubscriptionViolations)
+	http.HandleFunc("/api/v1/transfer-requests", handleTransferRequests)
+	http.HandleFunc("/api/v1/transfer-requests/", handleTransferRequest)
+	http.HandleFunc("/api/v1/quotas", handleQuotas)
+	http.HandleFunc("/api/v1/deletion-campaigns", handleDeletionCampaigns)
+	http.HandleFunc("/api/v1/deletion-campaigns/", handleDeletionCampaign)
+	http.HandleFunc("/api/v1/deletion-audit", handleDeletionAudit)
+	http.HandleFunc("/api/v1/consistency", handleConsistency)
+	http.HandleFunc("/api/v1/accounting", handleAccounting)
+	http.HandleFunc("/api/v1/vos", handleVOs)
+	http.HandleFunc("/api/v1/slo", handleSLO)
+	http.HandleFunc("/api/v1/groups", handleGroups)
+	http.HandleFunc("/api/v1/sites", handleSites)
+	http.HandleFunc("/api/v1/hints", handleHints)
+	http.HandleFunc("/api/v1/incidents", handleIncidents)
+	http.HandleFunc("/api/v1/incidents/alerts", handleIncidentAlerts)
+	http.HandleFunc("/api/v1/incidents/", handleIncident)
+	http.HandleFunc("/api/v1/downtimes", handleDowntimes)
+	http.HandleFunc("/api/v1/downtimes/", handleDowntime)
+	http.HandleFunc("/api/v1/annotations", handleAnnotations)
+	http.HandleFunc("/api/v1/annotations/", handleAnnotation)
+	http.HandleFunc("/api/v1/expected-arrivals", handleExpectedArrivals)
+	http.HandleFunc("/api/v1/expected-arrivals/", handleExpectedArrival)
+	http.HandleFunc("/api/v1/history", handleHistory)
+	http.HandleFunc("/api/v1/reports/sla", handleSLAReport)
+	http.HandleFunc("/api/v1/export", handleExport)
+	http.HandleFunc("/api/v1/snapshots", handleSnapshots)
+	http.HandleFunc("/api/v1/freshness/diff", handleFreshnessDiff)
+	http.HandleFunc("/api/v1/transitions", handleTransitions)
+	http.HandleFunc("/api/v1/events", handleEventStream)
+	http.HandleFunc("/api/v1/dead-letters", handleDeadLetters)
+	http.HandleFunc("/api/v1/dead-letters/", handleDeadLetter)
+	http.HandleFunc("/api/v1/backfill", handleBackfill)
+	http.HandleFunc("/api/v1/templates/render", handleTemplateRender)
+	http.HandleFunc("/api/v1/managed", handleManaged)
+	http.HandleFunc("/api/v1/managed/", handleManagedEntry)
+	http.HandleFunc("/api/v1/agent/token", handleAgentToken)
+	http.HandleFunc("/api/v1/agent/registrations", handleAgentRegistrations)
+	http.HandleFunc("/api/v1/agent/registrations/", handleAgentRegistration)
+	http.HandleFunc("/api/v1/agent/probes", handleAgentProbes)
+	http.HandleFunc("/api/v1/network-probes", handleNetworkProbes)
+	http.HandleFunc("/api/v1/agent/buffers", handleAgentBuffers)
+	http.HandleFunc("/api/v1/buffers", handleBuffers)
+	http.HandleFunc("/api/v1/federation", handleFederation)
+	http.HandleFunc("/api/v1/federation/push", handleFederationPush)
+	http.HandleFunc("/api/v1/global/freshness", handleGlobalFreshness)
 	srv := &http.Server{
 		Addr: ":" + port,
 	}
 
+	if err := vaultLoaded(); err != nil {
+		fmt.Printf("[freshness] vault error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadLDAP(); err != nil {
+		fmt.Printf("[freshness] ldap config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadRateLimits(); err != nil {
+		fmt.Printf("[freshness] rate limits config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadSitesConfig(); err != nil {
+		fmt.Printf("[freshness] sites config error: %v\n", err)
+		os.Exit(1)
+	}
+	if *simulatePath != "" {
+		os.Exit(runSimulation(*simulatePath))
+	}
+	if *alertRulesPath != "" {
+		if err := writeAlertRules(*alertRulesPath); err != nil {
+			fmt.Fprintf(os.Stderr, "[alert-rules] %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// state is loaded only once this replica leads
+	if err := awaitLeadership(); err != nil {
+		fmt.Printf("[freshness] coordination error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadFailureRules(); err != nil {
+		fmt.Printf("[freshness] failure classes config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := completeness.Load(); err != nil {
+		fmt.Printf("[freshness] completeness state error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadLineage(); err != nil {
+		fmt.Printf("[freshness] lineage config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadBandwidthConfig(); err != nil {
+		fmt.Printf("[freshness] bandwidth config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadRetryPolicies(); err != nil {
+		fmt.Printf("[freshness] retry policies config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadQuotas(); err != nil {
+		fmt.Printf("[freshness] quotas error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := transferRequests.Load(); err != nil {
+		fmt.Printf("[freshness] transfer requests error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := deletionCampaigns.Load(); err != nil {
+		fmt.Printf("[freshness] deletion campaigns error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := accounting.Load(); err != nil {
+		fmt.Printf("[freshness] accounting error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := voFlows.Load(); err != nil {
+		fmt.Printf("[freshness] vo flows error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := agentRegistrations.Load(); err != nil {
+		fmt.Printf("[freshness] agent registrations error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadNetworkProbes(); err != nil {
+		fmt.Printf("[freshness] network probes config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := netPaths.Load(); err != nil {
+		fmt.Printf("[freshness] network paths error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadFederation(); err != nil {
+		fmt.Printf("[freshness] federation config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := deadLetters.Load(); err != nil {
+		fmt.Printf("[freshness] dead letters error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := annotations.Load(); err != nil {
+		fmt.Printf("[freshness] annotations error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := expectedArrivals.Load(); err != nil {
+		fmt.Printf("[freshness] expected arrivals error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := incidents.Load(); err != nil {
+		fmt.Printf("[freshness] incidents error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := calendar.Load(); err != nil {
+		fmt.Printf("[freshness] downtime calendar error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := catalog.Load(); err != nil {
+		fmt.Printf("[freshness] catalog error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadConsistency(); err != nil {
+		fmt.Printf("[freshness] consistency config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadSubscriptions(); err != nil {
+		fmt.Printf("[freshness] subscriptions config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadReports(); err != nil {
+		fmt.Printf("[freshness] reports config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadExportJobs(); err != nil {
+		fmt.Printf("[freshness] export config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadWarehouse(); err != nil {
+		fmt.Printf("[freshness] warehouse config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadMetricsOutputs(); err != nil {
+		fmt.Printf("[freshness] metrics outputs config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadSnapshotArchive(); err != nil {
+		fmt.Printf("[freshness] snapshot archive config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadPlugins(); err != nil {
+		fmt.Printf("[freshness] plugins config error: %v\n", err)
+		os.Exit(1)
+	}
+	sources, err := loadSources()
+	if err != nil {
+		fmt.Printf("[freshness] sources config error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := managed.Load(); err != nil {
+		fmt.Printf("[freshness] managed config error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := anomalies.Warm(time.Now()); err != nil {
+		fmt.Printf("[anomaly] warm-up from history failed: %v\n", err)
+	}
+	if err := slos.Warm(time.Now()); err != nil {
+		fmt.Printf("[slo] warm-up from history failed: %v\n", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go pollLoop(ctx)
+	if tracer = newTracer(); tracer.Enabled() {
+		go tracer.Run(ctx)
+	} else if metricsExemplars {
+		fmt.Println("[freshness] METRICS_EXEMPLARS is set but tracing is off; no exemplars will be attached")
+	}
+	for _, src := range sources {
+		if bg, ok := src.Source.(backgroundSource); ok {
+			go bg.Start(ctx)
+		}
+	}
+	if vaultAddr != "" {
+		go vault.loop(ctx)
+	}
+	if ldapDir != nil {
+		go ldapDir.loop(ctx)
+	}
+	if err := startEventSinks(ctx); err != nil {
+		fmt.Printf("[freshness] events config error: %v\n", err)
+		os.Exit(1)
+	}
+	alertRoutes.Start(ctx)
+	startPluginNotifiers(ctx)
+	managed.Start(ctx, sources)
+	go pollLoop(ctx, sources)
+	go pruneLoop(ctx)
+	go transferRatesLoop(ctx)
+	go completeness.flushLoop(ctx)
+	go lineage.refreshLoop(ctx)
+	go transferRequests.leaseLoop(ctx)
+	go quotas.flushLoop(ctx)
+	go deletionCampaigns.leaseLoop(ctx)
+	go catalog.flushLoop(ctx)
+	go accounting.flushLoop(ctx)
+	go voFlows.flushLoop(ctx)
+	go expectedArrivals.loop(ctx)
+	go deadLetters.flushLoop(ctx)
+	go correlationLoop(ctx)
+	if len(consistency.Sites) > 0 {
+		go consistency.loop(ctx)
+	}
+	if len(subscriptions.rules) > 0 {
+		go subscriptions.loop(ctx)
+	}
+	if len(reports.Tenants) > 0 {
+		go reports.loop(ctx)
+	}
+	if len(exportJobs) > 0 {
+		go exportLoop(ctx)
+	}
+	if len(warehouse.sinks) > 0 {
+		go warehouse.loop(ctx)
+	}
+	if lokiURL != "" {
+		go loki.loop(ctx)
+	}
+	if snapshots.enabled() {
+		go snapshots.loop(ctx)
+	}
+	if federation.enabled() {
+		go federation.loop(ctx)
+	}
+	if federationPushURL != "" {
+		go federationPushLoop(ctx)
+	}
+	for _, o := range metricsOutputs {
+		go o.loop(ctx)
+	}
+	if checksumSampleRate > 0 {
+		go checksums.Run(ctx)
+	}
+	if kafkaBrokers != "" {
+		go kafkaConsumeLoop(ctx)
+	}
+	if natsURL != "" {
+		go natsConsumeLoop(ctx)
+	}
+	if mqttBroker != "" {
+		go mqttSubscribe(ctx)
+	}
+	if amqpURL != "" {
+		go amqpConsumeLoop(ctx)
+	}
+
+	if rateLimits != nil {
+		srv.Handler = rateLimits.Wrap(http.DefaultServeMux)
+	}
 
-	fmt.Printf("[freshness] starting on :%s polling %s every %ds\n", port, apiBaseURL, interval)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	fmt.Printf("[freshness] starting on :%s polling %d sources every %ds\n", port, len(sources), interval)
+	if err := serve(srv); err != nil && err != http.ErrServerClosed {
 		fmt.Printf("server error: %v\n", err)
 	}
 }
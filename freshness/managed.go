@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// The managed configuration is the part of the service's settings owned
+// by a controller, normally dtms-operator reconciling Kubernetes
+// resources, rather than by mounted files:
+//
+//	sites   site settings as under `sites:` in SITES_CONFIG; a managed
+//	        site replaces a file entry of the same name
+//	checks  sources as entries of SOURCES_CONFIG, polled with the others
+//	routes  incident notification routes (alertroutes.go)
+//
+// GET /api/v1/managed returns all of it, and PUT and DELETE
+// /api/v1/managed/{sites,checks,routes}/{name} change one entry as an
+// admin. Entries are validated before they are stored and survive
+// restarts in MANAGED_STATE. Checks may only use the source types in
+// MANAGED_SOURCE_TYPES, by default every type but exec, since an API
+// token should not be enough to run commands on the host. For the same
+// reason ${VAR} in an entry, expanded as in the config files, may only
+// name a variable listed in MANAGED_ENV; by default none is.
+var (
+	managedStatePath   = envOr("MANAGED_STATE", filepath.Join(dataDir, "managed.json"))
+	managedSourceTypes = envOr("MANAGED_SOURCE_TYPES", "")
+	managedEnv         = envOr("MANAGED_ENV", "")
+)
+
+var managedKinds = []string{"sites", "checks", "routes"}
+
+type managedCheck struct {
+	sched  *scheduledSource
+	cancel context.CancelFunc
+}
+
+type managedStore struct {
+	mu    sync.Mutex
+	path  string
+	specs map[string]map[string]json.RawMessage // kind, name
+
+	sites  map[string]siteConfig
+	checks map[string]*managedCheck
+	// ctx runs background checks; static holds the SOURCES_CONFIG names
+	ctx    context.Context
+	static map[string]bool
+}
+
+var managed = &managedStore{
+	path:   managedStatePath,
+	specs:  map[string]map[string]json.RawMessage{"sites": {}, "checks": {}, "routes": {}},
+	sites:  map[string]siteConfig{},
+	checks: map[string]*managedCheck{},
+}
+
+// canonicalJSON re-encodes v with sorted keys so equal specs compare equal.
+func canonicalJSON(raw []byte) (json.RawMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("spec must be an object")
+	}
+	return json.Marshal(v)
+}
+
+func managedSourceTypeAllowed(typ string) bool {
+	if managedSourceTypes == "" {
+		return typ != "exec"
+	}
+	for _, t := range strings.Split(managedSourceTypes, ",") {
+		if strings.TrimSpace(t) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// managedLookupEnv resolves ${VAR} in managed entries, which come from the
+// API and so may not read just any of the service's environment.
+func managedLookupEnv(name string) (string, bool) {
+	for _, n := range strings.Split(managedEnv, ",") {
+		if strings.TrimSpace(n) == name {
+			return os.LookupEnv(name)
+		}
+	}
+	return "", false
+}
+
+func (s *managedStore) compileCheck(name string, raw []byte) (*scheduledSource, error) {
+	if s.static[name] {
+		return nil, fmt.Errorf("a source named %q is configured in SOURCES_CONFIG", name)
+	}
+	var c sourceConfig
+	if err := yamlenv.UnmarshalLookup(raw, &c, managedLookupEnv); err != nil {
+		return nil, err
+	}
+	if !managedSourceTypeAllowed(c.Type) {
+		return nil, fmt.Errorf("source type %q is not allowed for managed checks", c.Type)
+	}
+	factory, ok := sourceFactories[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+	src, err := factory(name, &c.params)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduled(src, c.Interval, c.Timeout), nil
+}
+
+// apply compiles one entry and puts it in effect; s.mu is held.
+func (s *managedStore) apply(kind, name string, raw []byte) error {
+	switch kind {
+	case "sites":
+		c, err := compileSiteSpec(raw)
+		if err != nil {
+			return err
+		}
+		s.sites[name] = c
+		rebuildSiteRegistryLocked(s.sites)
+	case "checks":
+		sched, err := s.compileCheck(name, raw)
+		if err != nil {
+			return err
+		}
+		s.stopCheck(name)
+		c := &managedCheck{sched: sched}
+		s.startCheck(c)
+		s.checks[name] = c
+	case "routes":
+		r, err := compileAlertRoute(name, raw)
+		if err != nil {
+			return err
+		}
+		alertRoutes.Set(r)
+	}
+	return nil
+}
+
+func (s *managedStore) remove(kind, name string) {
+	switch kind {
+	case "sites":
+		delete(s.sites, name)
+		rebuildSiteRegistryLocked(s.sites)
+	case "checks":
+		s.stopCheck(name)
+		delete(s.checks, name)
+	case "routes":
+		alertRoutes.Delete(name)
+	}
+}
+
+func (s *managedStore) startCheck(c *managedCheck) {
+	bg, ok := c.sched.Source.(backgroundSource)
+	if !ok || s.ctx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	c.cancel = cancel
+	go bg.Start(ctx)
+}
+
+func (s *managedStore) stopCheck(name string) {
+	if c := s.checks[name]; c != nil && c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// Load reads MANAGED_STATE. Entries that no longer validate, say after an
+// upgrade, are logged and left out rather than stopping the service.
+func (s *managedStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var specs map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &specs); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kind := range managedKinds {
+		for name, spec := range specs[kind] {
+			if err := s.apply(kind, name, spec); err != nil {
+				fmt.Printf("[managed] %s/%s: %v\n", kind, name, err)
+				continue
+			}
+			s.specs[kind][name] = spec
+		}
+	}
+	return nil
+}
+
+// Start begins running background checks under ctx. static names the
+// SOURCES_CONFIG sources, which managed checks may not shadow.
+func (s *managedStore) Start(ctx context.Context, static []*scheduledSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	s.static = map[string]bool{}
+	for _, src := range static {
+		s.static[src.Name()] = true
+	}
+	for name, c := range s.checks {
+		if s.static[name] {
+			fmt.Printf("[managed] checks/%s: shadowed by a source in SOURCES_CONFIG, dropped\n", name)
+			delete(s.checks, name)
+			delete(s.specs["checks"], name)
+			continue
+		}
+		s.startCheck(c)
+	}
+}
+
+// Sources returns the managed checks in name order.
+func (s *managedStore) Sources() []*scheduledSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*scheduledSource, 0, len(names))
+	for _, name := range names {
+		out = append(out, s.checks[name].sched)
+	}
+	return out
+}
+
+func (s *managedStore) save() error {
+	raw, err := json.Marshal(s.specs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+func (s *managedStore) Put(kind, name string, spec []byte) error {
+	spec, err := canonicalJSON(spec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.apply(kind, name, spec); err != nil {
+		return err
+	}
+	s.specs[kind][name] = spec
+	return s.save()
+}
+
+func (s *managedStore) Delete(kind, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.specs[kind][name]; !ok {
+		return os.ErrNotExist
+	}
+	s.remove(kind, name)
+	delete(s.specs[kind], name)
+	return s.save()
+}
+
+func (s *managedStore) Snapshot() map[string]map[string]json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]map[string]json.RawMessage{}
+	for kind, specs := range s.specs {
+		out[kind] = map[string]json.RawMessage{}
+		for name, spec := range specs {
+			out[kind][name] = spec
+		}
+	}
+	return out
+}
+
+// compileSiteSpec reads a site's settings given as JSON (or YAML) in the
+// form of an entry under `sites:` in SITES_CONFIG.
+func compileSiteSpec(raw []byte) (siteConfig, error) {
+	var c siteConfig
+	if err := yamlenv.UnmarshalLookup(raw, &c, managedLookupEnv); err != nil {
+		return c, err
+	}
+	return c, c.compile()
+}
+
+// rebuildSiteRegistry layers the sites approved for registered agents
+// (agentregistry.go) over SITES_CONFIG, and the managed sites over both.
+func rebuildSiteRegistry() {
+	managed.mu.Lock()
+	defer managed.mu.Unlock()
+	rebuildSiteRegistryLocked(managed.sites)
+}
+
+func rebuildSiteRegistryLocked(sites map[string]siteConfig) {
+	base := sitesFromFile
+	merged := &sitesFile{Defaults: base.Defaults, Groups: base.Groups, Sites: map[string]siteConfig{}}
+	for name, c := range base.Sites {
+		merged.Sites[name] = c
+	}
+	for name, c := range agentRegistrations.approvedSites() {
+		merged.Sites[name] = c
+	}
+	for name, c := range sites {
+		merged.Sites[name] = c
+	}
+	var gone []string
+	for name := range sitesCurrent.Load().Sites {
+		if _, ok := merged.Sites[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	sitesCurrent.Store(merged)
+	publishSiteVOs(merged)
+	forgetSiteMetrics(gone)
+}
+
+// handleManaged serves GET /api/v1/managed.
+func handleManaged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, managed.Snapshot())
+}
+
+// handleManagedEntry serves PUT and DELETE /api/v1/managed/{kind}/{name}.
+func handleManagedEntry(w http.ResponseWriter, r *http.Request) {
+	kind, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/managed/"), "/")
+	known := false
+	for _, k := range managedKinds {
+		known = known || k == kind
+	}
+	if !known || name == "" || strings.Contains(name, "/") {
+		http.Error(w, "want /api/v1/managed/{sites,checks,routes}/{name}", http.StatusNotFound)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		spec, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := managed.Put(kind, name, spec); err != nil {
+			http.Error(w, fmt.Sprintf("%s/%s: %v", kind, name, err), http.StatusUnprocessableEntity)
+			return
+		}
+		fmt.Printf("[managed] %s/%s updated\n", kind, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := managed.Delete(kind, name)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "not managed", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			fmt.Printf("[managed] %s/%s deleted\n", kind, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The per-site and fleet gauges are served from an immutable snapshot that
+// each poll builds in full and then swaps in, so a scrape that lands in the
+// middle of a poll sees either the previous poll or the new one, never a
+// mix. Sites missing from a poll keep their last values, as they did when
+// these were plain GaugeVecs, until they leave the site registry: then
+// forgetSiteMetrics drops their series.
+var (
+	descFreshSeconds = prometheus.NewDesc("dtms_data_fresh_seconds", "Age in seconds since last transfer for a site", []string{"site"}, nil)
+	descFreshOk      = prometheus.NewDesc("dtms_data_fresh_ok", "1 if freshness is below threshold, 0 otherwise", []string{"site"}, nil)
+	descFreshDelta   = prometheus.NewDesc("dtms_data_fresh_delta_seconds_per_minute", "Change in a site's age per minute between its last two polls; near 60 while nothing arrives, negative once new data lands", []string{"site"}, nil)
+	descInDowntime   = prometheus.NewDesc("dtms_site_in_downtime", "1 while a site is inside a declared maintenance window", []string{"site"}, nil)
+	descFleetAge     = prometheus.NewDesc("dtms_data_fresh_fleet_age_seconds", "Age quantiles across all sites at the last poll", []string{"quantile"}, nil)
+	descFleetSites   = prometheus.NewDesc("dtms_data_fresh_fleet_sites", "Sites reported at the last poll, by whether they were ok", []string{"ok"}, nil)
+)
+
+type siteMetrics struct {
+	Age        float64
+	Ok         bool
+	InDowntime bool
+	Evaluated  time.Time
+	// Delta is the age's change per minute since the previous poll that
+	// reported the site; HasDelta is false until there was one.
+	Delta    float64
+	HasDelta bool
+}
+
+// observeSite records site's evaluation at now in the snapshot, deriving
+// its staleness velocity from the previous one.
+func (m *metricSnapshot) observeSite(site string, age float64, ok, inDowntime bool, now time.Time) {
+	s := siteMetrics{Age: age, Ok: ok, InDowntime: inDowntime, Evaluated: now}
+	if prev, seen := m.sites[site]; seen && now.After(prev.Evaluated) {
+		s.Delta, s.HasDelta = (age-prev.Age)/now.Sub(prev.Evaluated).Minutes(), true
+	}
+	m.sites[site] = s
+}
+
+// metricSnapshot must not be changed once published.
+type metricSnapshot struct {
+	sites     map[string]siteMetrics
+	fleetAge  map[float64]float64 // by quantile
+	fleetOk   int
+	fleetSick int
+	hasFleet  bool
+	groups    []SiteGroup
+}
+
+var currentMetrics atomic.Pointer[metricSnapshot]
+
+// nextMetricSnapshot starts a snapshot from the published one.
+func nextMetricSnapshot() *metricSnapshot {
+	next := &metricSnapshot{sites: map[string]siteMetrics{}, fleetAge: map[float64]float64{}}
+	if prev := currentMetrics.Load(); prev != nil {
+		for site, m := range prev.sites {
+			next.sites[site] = m
+		}
+	}
+	return next
+}
+
+// forgottenSites holds when each site left the registry. A poll that was
+// already under way carries the site over from the snapshot it started
+// from; publish drops it unless the poll saw it again since.
+var forgottenSites sync.Map // site -> time.Time
+
+// publish completes the snapshot with the group aggregates and makes it
+// current.
+func (m *metricSnapshot) publish() {
+	m.dropForgotten()
+	m.groups = computeGroups(m.sites)
+	currentMetrics.Store(m)
+}
+
+func (m *metricSnapshot) dropForgotten() {
+	forgottenSites.Range(func(k, v any) bool {
+		site := k.(string)
+		if s, ok := m.sites[site]; ok {
+			if s.Evaluated.After(v.(time.Time)) {
+				forgottenSites.Delete(site)
+			} else {
+				delete(m.sites, site)
+			}
+		}
+		return true
+	})
+}
+
+// forgetSiteMetrics stops exporting sites that left the registry, rather
+// than leaving their last values to look current forever.
+func forgetSiteMetrics(sites []string) {
+	if len(sites) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, site := range sites {
+		forgottenSites.Store(site, now)
+	}
+	for {
+		prev := currentMetrics.Load()
+		if prev == nil {
+			return
+		}
+		next := *prev
+		next.sites = make(map[string]siteMetrics, len(prev.sites))
+		for site, m := range prev.sites {
+			next.sites[site] = m
+		}
+		next.dropForgotten()
+		next.groups = computeGroups(next.sites)
+		if currentMetrics.CompareAndSwap(prev, &next) {
+			return
+		}
+	}
+}
+
+type snapshotCollector struct{}
+
+func (snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descFreshSeconds, descFreshOk, descFreshDelta, descInDowntime, descFleetAge, descFleetSites, descGroupWorst, descGroupAvg, descGroupSites} {
+		ch <- d
+	}
+}
+
+func (snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	m := currentMetrics.Load()
+	if m == nil {
+		return
+	}
+	collectGroupMetrics(ch, m.groups)
+	collectSiteTags(ch, m.sites)
+	for site, s := range m.sites {
+		if !metricsSiteSelector.selects(site) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(descFreshSeconds, prometheus.GaugeValue, s.Age, site)
+		ch <- prometheus.MustNewConstMetric(descFreshOk, prometheus.GaugeValue, boolFloat(s.Ok), site)
+		if s.HasDelta {
+			ch <- prometheus.MustNewConstMetric(descFreshDelta, prometheus.GaugeValue, s.Delta, site)
+		}
+		ch <- prometheus.MustNewConstMetric(descInDowntime, prometheus.GaugeValue, boolFloat(s.InDowntime), site)
+	}
+	if !m.hasFleet {
+		return
+	}
+	for q, v := range m.fleetAge {
+		ch <- prometheus.MustNewConstMetric(descFleetAge, prometheus.GaugeValue, v, strconv.FormatFloat(q, 'f', -1, 64))
+	}
+	ch <- prometheus.MustNewConstMetric(descFleetSites, prometheus.GaugeValue, float64(m.fleetOk), "true")
+	ch <- prometheus.MustNewConstMetric(descFleetSites, prometheus.GaugeValue, float64(m.fleetSick), "false")
+}
+
+func init() {
+	prometheus.MustRegister(snapshotCollector{})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForgetSiteMetrics(t *testing.T) {
+	prevMetrics, prevFile, prevSites := currentMetrics.Load(), sitesFromFile, sitesCurrent.Load()
+	t.Cleanup(func() {
+		currentMetrics.Store(prevMetrics)
+		sitesFromFile = prevFile
+		sitesCurrent.Store(prevSites)
+		forgottenSites.Range(func(k, _ any) bool { forgottenSites.Delete(k); return true })
+	})
+	currentMetrics.Store(nil)
+	forgottenSites.Range(func(k, _ any) bool { forgottenSites.Delete(k); return true })
+	sitesFromFile = &sitesFile{Sites: map[string]siteConfig{"SITE_A": {}}}
+	rebuildSiteRegistryLocked(map[string]siteConfig{"SITE_B": {}})
+
+	poll := func(at time.Time, sites ...string) {
+		m := nextMetricSnapshot()
+		for _, s := range sites {
+			m.observeSite(s, 10, true, false, at)
+		}
+		m.publish()
+	}
+	exported := func() map[string]bool {
+		out := map[string]bool{}
+		for site := range currentMetrics.Load().sites {
+			out[site] = true
+		}
+		return out
+	}
+
+	t0 := time.Now().Add(-time.Minute)
+	poll(t0, "SITE_A", "SITE_B")
+	inFlight := nextMetricSnapshot()
+
+	rebuildSiteRegistryLocked(map[string]siteConfig{})
+	if got := exported(); !got["SITE_A"] || got["SITE_B"] {
+		t.Fatalf("after removing SITE_B exported %v", got)
+	}
+	inFlight.publish()
+	if got := exported(); got["SITE_B"] {
+		t.Fatalf("a poll started before the removal brought SITE_B back: %v", got)
+	}
+	poll(time.Now().Add(time.Second), "SITE_B")
+	if got := exported(); !got["SITE_B"] {
+		t.Fatalf("SITE_B reported again after removal is not exported: %v", got)
+	}
+}
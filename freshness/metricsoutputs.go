@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+	"gopkg.in/yaml.v3"
+)
+
+// METRICS_OUTPUTS_CONFIG pushes the same metrics /metrics serves to
+// systems that do not scrape Prometheus:
+//
+//	metrics: ^dtms_data_fresh       # regexp over metric names (default)
+//	outputs:
+//	  - type: influxdb
+//	    url: http://influx:8086/api/v2/write?org=ops&bucket=dtms&precision=s
+//	    token: ${INFLUX_TOKEN}
+//	    interval: 30s
+//	  - type: graphite
+//	    address: graphite:2003
+//	    prefix: dtms
+//	    tagged: true                # name;label=value instead of dotted paths
+//	  - type: statsd
+//	    address: statsd:8125
+//	    prefix: dtms
+//	    tags: dogstatsd             # append |#label:value
+//
+// Gauges and counters are written as they are, histograms and summaries as
+// their _sum and _count. StatsD receives gauges, and counters as the
+// increase since the previous flush. Intervals default to POLL_INTERVAL.
+// An output's own `metrics` regexp replaces the global one, and `labels`
+// keeps only the listed labels; series that collapse into one keep the
+// largest value. Both matter for the pay-per-series cloud outputs.
+var metricsOutputsPath = envOr("METRICS_OUTPUTS_CONFIG", "")
+
+// metricPoint is one sample of a gathered metric.
+type metricPoint struct {
+	name    string
+	labels  map[string]string
+	value   float64
+	counter bool
+}
+
+// sortedLabels returns the label names in order, for stable output.
+func (p metricPoint) sortedLabels() []string {
+	keys := make([]string, 0, len(p.labels))
+	for k := range p.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsOutput writes one flush worth of points.
+type metricsOutput interface {
+	Write(ctx context.Context, points []metricPoint, now time.Time) error
+}
+
+type outputFactory func(params *yaml.Node) (metricsOutput, error)
+
+var outputFactories = map[string]outputFactory{}
+
+func registerOutput(typ string, f outputFactory) {
+	if _, dup := outputFactories[typ]; dup {
+		panic("duplicate output type " + typ)
+	}
+	outputFactories[typ] = f
+}
+
+var metricsOutputErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_metrics_output_errors_total", Help: "Failed pushes to non-Prometheus metrics outputs"},
+	[]string{"output"},
+)
+
+func init() {
+	prometheus.MustRegister(metricsOutputErrors)
+}
+
+type scheduledOutput struct {
+	metricsOutput
+	typ      string
+	interval time.Duration
+	filter   *regexp.Regexp
+	labels   []string
+}
+
+var (
+	metricsOutputs      []scheduledOutput
+	metricsOutputFilter = regexp.MustCompile(`^dtms_data_fresh`)
+)
+
+func loadMetricsOutputs() error {
+	if metricsOutputsPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(metricsOutputsPath)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Metrics string      `yaml:"metrics"`
+		Outputs []yaml.Node `yaml:"outputs"`
+	}
+	if err := yamlenv.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("%s: %w", metricsOutputsPath, err)
+	}
+	if doc.Metrics != "" {
+		if metricsOutputFilter, err = regexp.Compile(doc.Metrics); err != nil {
+			return fmt.Errorf("%s: metrics: %w", metricsOutputsPath, err)
+		}
+	}
+	for i := range doc.Outputs {
+		var common struct {
+			Type     string        `yaml:"type"`
+			Interval time.Duration `yaml:"interval"`
+			Metrics  string        `yaml:"metrics"`
+			Labels   []string      `yaml:"labels"`
+		}
+		if err := doc.Outputs[i].Decode(&common); err != nil {
+			return fmt.Errorf("%s: %w", metricsOutputsPath, err)
+		}
+		factory, ok := outputFactories[common.Type]
+		if !ok {
+			return fmt.Errorf("%s: unknown output type %q", metricsOutputsPath, common.Type)
+		}
+		out, err := factory(&doc.Outputs[i])
+		if err != nil {
+			return fmt.Errorf("%s: %s output: %w", metricsOutputsPath, common.Type, err)
+		}
+		o := scheduledOutput{out, common.Type, common.Interval, metricsOutputFilter, common.Labels}
+		if o.interval <= 0 {
+			o.interval = time.Duration(interval) * time.Second
+		}
+		if d, ok := out.(interface{ defaultMetrics() string }); ok && common.Metrics == "" {
+			common.Metrics = d.defaultMetrics()
+		}
+		if common.Metrics != "" {
+			if o.filter, err = regexp.Compile(common.Metrics); err != nil {
+				return fmt.Errorf("%s: %s output: metrics: %w", metricsOutputsPath, common.Type, err)
+			}
+		}
+		metricsOutputs = append(metricsOutputs, o)
+	}
+	return nil
+}
+
+// gatherPoints flattens the default registry's metrics matching filter.
+func gatherPoints(filter *regexp.Regexp) ([]metricPoint, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	var out []metricPoint
+	for _, mf := range families {
+		if !filter.MatchString(mf.GetName()) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			name := mf.GetName()
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				out = append(out, metricPoint{name, labels, m.GetGauge().GetValue(), false})
+			case dto.MetricType_COUNTER:
+				out = append(out, metricPoint{name, labels, m.GetCounter().GetValue(), true})
+			case dto.MetricType_UNTYPED:
+				out = append(out, metricPoint{name, labels, m.GetUntyped().GetValue(), false})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				out = append(out,
+					metricPoint{name + "_sum", labels, h.GetSampleSum(), true},
+					metricPoint{name + "_count", labels, float64(h.GetSampleCount()), true})
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				out = append(out,
+					metricPoint{name + "_sum", labels, s.GetSampleSum(), true},
+					metricPoint{name + "_count", labels, float64(s.GetSampleCount()), true})
+			}
+		}
+	}
+	// None of the outputs can carry NaN or infinities.
+	kept := out[:0]
+	for _, p := range out {
+		if !math.IsNaN(p.value) && !math.IsInf(p.value, 0) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, err
+}
+
+// projectLabels drops labels not in keep, merging the series that become
+// identical into the largest value.
+func projectLabels(points []metricPoint, keep []string) []metricPoint {
+	index := map[string]int{}
+	var out []metricPoint
+	for _, p := range points {
+		labels := map[string]string{}
+		for _, k := range keep {
+			if v, ok := p.labels[k]; ok {
+				labels[k] = v
+			}
+		}
+		p.labels = labels
+		key := p.name + "{" + labelKey(labels) + "}"
+		if i, ok := index[key]; ok {
+			if p.value > out[i].value {
+				out[i].value = p.value
+			}
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, p)
+	}
+	return out
+}
+
+func (o scheduledOutput) loop(ctx context.Context) {
+	t := time.NewTicker(o.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		points, err := gatherPoints(o.filter)
+		if err != nil {
+			fmt.Printf("[outputs] gather: %v\n", err)
+		}
+		if o.labels != nil {
+			points = projectLabels(points, o.labels)
+		}
+		wctx, cancel := context.WithTimeout(ctx, o.interval)
+		err = o.Write(wctx, points, time.Now())
+		cancel()
+		if err != nil {
+			metricsOutputErrors.WithLabelValues(o.typ).Inc()
+			fmt.Printf("[outputs] %s: %v\n", o.typ, err)
+		}
+	}
+}
+
+// influxOutput posts line protocol to a v1 (/write?db=) or v2
+// (/api/v2/write?org=&bucket=) write URL. Timestamps are in seconds, so
+// the URL needs precision=s.
+type influxOutput struct {
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func init() {
+	registerOutput("influxdb", func(params *yaml.Node) (metricsOutput, error) {
+		o := &influxOutput{}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return o, nil
+	})
+}
+
+func (o *influxOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(influxEscaper.Replace(p.name))
+		for _, k := range p.sortedLabels() {
+			if v := p.labels[k]; v != "" {
+				fmt.Fprintf(&buf, ",%s=%s", influxEscaper.Replace(k), influxEscaper.Replace(v))
+			}
+		}
+		fmt.Fprintf(&buf, " value=%s %d\n", strconv.FormatFloat(p.value, 'g', -1, 64), now.Unix())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case o.Token != "":
+		req.Header.Set("Authorization", "Token "+o.Token)
+	case o.Username != "":
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("write: %s", resp.Status)
+	}
+	return nil
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// graphiteOutput writes the plaintext protocol over TCP.
+type graphiteOutput struct {
+	Address string `yaml:"address"`
+	Prefix  string `yaml:"prefix"`
+	Tagged  bool   `yaml:"tagged"`
+}
+
+func init() {
+	registerOutput("graphite", func(params *yaml.Node) (metricsOutput, error) {
+		o := &graphiteOutput{}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.Address == "" {
+			return nil, fmt.Errorf("address is required")
+		}
+		return o, nil
+	})
+}
+
+// path names a point: prefix.name.value1.value2 in label order, or with
+// tagged, prefix.name;label=value.
+func (o *graphiteOutput) path(p metricPoint, tagSep, kvSep string, tagged bool) string {
+	var b strings.Builder
+	if o.Prefix != "" {
+		b.WriteString(o.Prefix + ".")
+	}
+	b.WriteString(p.name)
+	for _, k := range p.sortedLabels() {
+		v := p.labels[k]
+		if v == "" {
+			continue
+		}
+		if tagged {
+			b.WriteString(tagSep + k + kvSep + strings.NewReplacer(";", "_", " ", "_").Replace(v))
+		} else {
+			b.WriteString("." + graphiteUnsafe.ReplaceAllString(v, "_"))
+		}
+	}
+	return b.String()
+}
+
+func (o *graphiteOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", o.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	var buf bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&buf, "%s %s %d\n", o.path(p, ";", "=", o.Tagged), strconv.FormatFloat(p.value, 'g', -1, 64), now.Unix())
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// statsdOutput sends gauges, and counter increases, over UDP
+// in packets of at most statsdMaxPacket bytes.
+type statsdOutput struct {
+	graphiteOutput `yaml:",inline"`
+	Tags           string `yaml:"tags"`
+
+	last map[string]float64
+}
+
+const statsdMaxPacket = 1432
+
+func init() {
+	registerOutput("statsd", func(params *yaml.Node) (metricsOutput, error) {
+		o := &statsdOutput{last: map[string]float64{}}
+		if err := params.Decode(o); err != nil {
+			return nil, err
+		}
+		if o.Address == "" {
+			return nil, fmt.Errorf("address is required")
+		}
+		if o.Tags != "" && o.Tags != "dogstatsd" {
+			return nil, fmt.Errorf("tags must be empty or dogstatsd")
+		}
+		return o, nil
+	})
+}
+
+func (o *statsdOutput) Write(ctx context.Context, points []metricPoint, now time.Time) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", o.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		buf.Reset()
+		return err
+	}
+	for _, p := range points {
+		var line string
+		tagged := o.Tags == "dogstatsd"
+		name := o.path(p, "", "", false)
+		if tagged {
+			name = o.path(metricPoint{name: p.name}, "", "", false)
+		}
+		if p.counter {
+			key := o.path(p, ";", "=", true)
+			prev, seen := o.last[key]
+			o.last[key] = p.value
+			if !seen || p.value < prev {
+				continue
+			}
+			line = fmt.Sprintf("%s:%s|c", name, strconv.FormatFloat(p.value-prev, 'g', -1, 64))
+		} else {
+			line = fmt.Sprintf("%s:%s|g", name, strconv.FormatFloat(p.value, 'g', -1, 64))
+		}
+		if tagged && len(p.labels) > 0 {
+			var tags []string
+			for _, k := range p.sortedLabels() {
+				tags = append(tags, k+":"+p.labels[k])
+			}
+			line += "|#" + strings.Join(tags, ",")
+		}
+		if buf.Len()+len(line)+1 > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(line + "\n")
+	}
+	return flush()
+}
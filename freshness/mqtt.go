@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	mqttBroker   = envOr("MQTT_BROKER", "")
+	mqttTopic    = envOr("MQTT_TOPIC", "dtms/heartbeat/+")
+	mqttClientID = envOr("MQTT_CLIENT_ID", "dtms-freshness")
+	mqttUsername = envOr("MQTT_USERNAME", "")
+	mqttPassword = envOr("MQTT_PASSWORD", "")
+	mqttCAFile   = envOr("MQTT_CA_FILE", "")
+	mqttCertFile = envOr("MQTT_CERT_FILE", "")
+	mqttKeyFile  = envOr("MQTT_KEY_FILE", "")
+)
+
+// mqttSubscribe accepts heartbeats from edge sites that can only make
+// outbound connections. Subscriptions use QoS 1 on a persistent session and
+// messages are acked after they are persisted, so heartbeats published while
+// we are down are delivered on reconnect.
+func mqttSubscribe(ctx context.Context) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttBroker).
+		SetClientID(mqttClientID).
+		SetUsername(mqttUsername).
+		SetPassword(mqttPassword).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(true).
+		SetOrderMatters(false)
+	tlsCfg, err := loadTLSConfig(mqttCAFile, mqttCertFile, mqttKeyFile)
+	if err != nil {
+		fmt.Printf("[mqtt] tls config error: %v\n", err)
+		return
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	// (re)subscribe on every connect; the broker keeps the session but a
+	// fresh session after broker restart would otherwise lose the filter.
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		t := c.Subscribe(mqttTopic, 1, handleMQTTMessage)
+		t.Wait()
+		if err := t.Error(); err != nil {
+			fmt.Printf("[mqtt] subscribe error: %v\n", err)
+			return
+		}
+		fmt.Printf("[mqtt] subscribed to %s on %s\n", mqttTopic, mqttBroker)
+	})
+
+	c := mqtt.NewClient(opts)
+	for {
+		t := c.Connect()
+		t.Wait()
+		if t.Error() == nil {
+			break
+		}
+		fmt.Printf("[mqtt] connect error: %v\n", t.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+	<-ctx.Done()
+	c.Disconnect(250)
+}
+
+// handleMQTTMessage turns a heartbeat into a transfer event. The site
+// defaults to the last topic level and the timestamp to the receive time,
+// so the minimal heartbeat is an empty payload on dtms/heartbeat/<site>.
+func handleMQTTMessage(_ mqtt.Client, m mqtt.Message) {
+	var ev TransferEvent
+	if len(m.Payload()) > 0 {
+		if err := json.Unmarshal(m.Payload(), &ev); err != nil {
+			ingestEvents.WithLabelValues("mqtt", "invalid").Inc()
+			fmt.Printf("[mqtt] dropping malformed heartbeat on %s: %v\n", m.Topic(), err)
+			m.Ack()
+			return
+		}
+	}
+	if ev.Site == "" {
+		ev.Site = m.Topic()[strings.LastIndex(m.Topic(), "/")+1:]
+	}
+	if ev.Timestamp == 0 {
+		ev.Timestamp = float64(time.Now().Unix())
+	}
+	if ev.Status == "" {
+		ev.Status = "heartbeat"
+	}
+	if ev.ID == "" {
+		ev.ID = fmt.Sprintf("mqtt:%s:%.3f", ev.Site, ev.Timestamp)
+	}
+
+	err := ingest.IngestEvent("mqtt", ev)
+	if err != nil && !errors.Is(err, errInvalidEvent) {
+		// leave unacked so the broker redelivers it
+		fmt.Printf("[mqtt] persist error: %v\n", err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("[mqtt] dead-lettering invalid heartbeat on %s: %v\n", m.Topic(), err)
+	}
+	m.Ack()
+}
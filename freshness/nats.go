@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	natsURL        = envOr("NATS_URL", "")
+	natsSubject    = envOr("NATS_SUBJECT", "dtms.transfers")
+	natsDurable    = envOr("NATS_DURABLE", "dtms-ingest")
+	natsDLQSubject = envOr("NATS_DLQ_SUBJECT", "dtms.transfers.dlq")
+)
+
+// natsConsumeLoop is the JetStream counterpart of kafkaConsumeLoop: a durable
+// pull consumer whose messages are acked once persisted, terminated and
+// copied to NATS_DLQ_SUBJECT when invalid, and redelivered otherwise. Like
+// amqpConsumeLoop it keeps retrying setup, so a server or stream that is not
+// up yet when the process starts only delays consumption.
+func natsConsumeLoop(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := natsConsume(ctx)
+		if err == nil {
+			return
+		}
+		fmt.Printf("[nats] %v, retrying in %s\n", err, backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// natsConsume runs one consumer session. It returns nil once ctx is done and
+// an error when the connection or subscription could not be set up.
+func natsConsume(ctx context.Context) error {
+	nc, err := nats.Connect(natsURL, nats.Name("dtms-freshness"),
+		nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer nc.Drain()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("jetstream: %w", err)
+	}
+	// With RetryOnFailedConnect the connection may still be dialling, in
+	// which case the consumer lookup fails and the whole session is retried.
+	sub, err := js.PullSubscribe(natsSubject, natsDurable, nats.ManualAck())
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+
+	fmt.Printf("[nats] consuming %s as durable %s from %s\n", natsSubject, natsDurable, natsURL)
+	backoff := time.Second
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(64, nats.MaxWait(5*time.Second))
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("[nats] fetch error, retrying in %s: %v\n", backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		for _, m := range msgs {
+			handleNATSMessage(nc, m)
+		}
+	}
+	return nil
+}
+
+func handleNATSMessage(nc *nats.Conn, m *nats.Msg) {
+	err := ingest.Ingest("nats", m.Data)
+	switch {
+	case err == nil:
+		m.Ack()
+	case errors.Is(err, errInvalidEvent):
+		fmt.Printf("[nats] dead-lettering message: %v\n", err)
+		dead := nats.NewMsg(natsDLQSubject)
+		dead.Data = m.Data
+		dead.Header.Set("Dtms-Error", err.Error())
+		dead.Header.Set("Dtms-Source-Subject", m.Subject)
+		if err := nc.PublishMsg(dead); err != nil {
+			fmt.Printf("[nats] dlq publish error: %v\n", err)
+			m.Nak()
+			return
+		}
+		m.Term()
+	default:
+		fmt.Printf("[nats] persist error, redelivering: %v\n", err)
+		m.NakWithDelay(5 * time.Second)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The route from each agent to each traceroute destination (netprobes.go)
+// is kept as a hash of its hops. Hops that did not answer are left out of
+// the hash, so a router that only sometimes replies does not count as a
+// change, and an all-silent trace is ignored. A new hash is a path change:
+// it is counted, timestamped, and annotated on the source site so it sits
+// next to the staleness it may explain. Paths live in NETWORK_PATHS_FILE.
+var networkPathsFile = envOr("NETWORK_PATHS_FILE", filepath.Join(dataDir, "network-paths.json"))
+
+// NetworkPath is the current route from a site to a destination.
+type NetworkPath struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Hash        string   `json:"hash"`
+	Hops        []string `json:"hops"`
+	Since       float64  `json:"since"`
+	Changes     int      `json:"changes"`
+	LastChange  float64  `json:"last_change,omitempty"`
+	Traced      float64  `json:"traced"`
+}
+
+type pathStore struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]*NetworkPath // by source->destination
+}
+
+var netPaths = &pathStore{path: networkPathsFile, items: map[string]*NetworkPath{}}
+
+var (
+	pathLabels      = []string{"source_site", "destination"}
+	pathChanges     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dtms_network_path_changes_total", Help: "Route changes seen by traceroute from a site to a destination"}, pathLabels)
+	gaugePathChange = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_path_last_change_timestamp_seconds", Help: "When the route from a site to a destination last changed"}, pathLabels)
+	gaugePathHops   = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_path_hops", Help: "Hops on the current route from a site to a destination"}, pathLabels)
+)
+
+func init() {
+	prometheus.MustRegister(pathChanges, gaugePathChange, gaugePathHops)
+}
+
+func (s *pathStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*NetworkPath
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range list {
+		s.items[p.Source+"->"+p.Destination] = p
+		gaugePathHops.WithLabelValues(p.Source, p.Destination).Set(float64(len(p.Hops)))
+		if p.LastChange > 0 {
+			gaugePathChange.WithLabelValues(p.Source, p.Destination).Set(p.LastChange)
+		}
+	}
+	return nil
+}
+
+func (s *pathStore) save() error {
+	raw, err := json.Marshal(s.sorted(""))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+func (s *pathStore) sorted(site string) []NetworkPath {
+	out := []NetworkPath{}
+	for _, p := range s.items {
+		if site == "" || p.Source == site || p.Destination == site {
+			out = append(out, *p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].Destination < out[j].Destination
+	})
+	return out
+}
+
+// List returns the paths from or to site, all of them when it is empty.
+func (s *pathStore) List(site string) []NetworkPath {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(site)
+}
+
+// pathHash hashes the hops that answered.
+func pathHash(hops []string) string {
+	var answered []string
+	for _, h := range hops {
+		if h != "*" && h != "" {
+			answered = append(answered, h)
+		}
+	}
+	if len(answered) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(answered, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Observe records a trace from source to destination at now.
+func (s *pathStore) Observe(source, destination string, hops []string, now time.Time) {
+	hash := pathHash(hops)
+	if hash == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := source + "->" + destination
+	ts := float64(now.Unix())
+	p := s.items[key]
+	switch {
+	case p == nil:
+		p = &NetworkPath{Source: source, Destination: destination, Hash: hash, Since: ts}
+		s.items[key] = p
+	case p.Hash != hash:
+		old := p.Hops
+		p.Hash, p.Since, p.LastChange = hash, ts, ts
+		p.Changes++
+		pathChanges.WithLabelValues(source, destination).Inc()
+		gaugePathChange.WithLabelValues(source, destination).Set(ts)
+		fmt.Printf("[paths] route %s changed: %s -> %s\n", key, strings.Join(old, " "), strings.Join(hops, " "))
+		// annotations has its own lock and file
+		go func() {
+			a := Annotation{Site: source, Start: ts, Text: fmt.Sprintf("route to %s changed (%d hops, was %d)", destination, len(hops), len(old)), Tags: []string{"path-change", "destination:" + destination}, Author: "dtms-freshness"}
+			if _, err := annotations.Add(a); err != nil {
+				fmt.Printf("[paths] annotation error: %v\n", err)
+			}
+		}()
+	}
+	p.Hops, p.Traced = hops, ts
+	gaugePathHops.WithLabelValues(source, destination).Set(float64(len(hops)))
+	if err := s.save(); err != nil {
+		fmt.Printf("[paths] save error: %v\n", err)
+	}
+}
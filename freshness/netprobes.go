@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// NETWORK_PROBES has the site agents (cmd/dtms-agent) measure the network
+// between each other, so a transfer slowdown can be put down to the link
+// or ruled out:
+//
+//	interval: 1h
+//	kinds: [https, iperf3]
+//	iperf3_seconds: 10
+//	agents:
+//	  SITE_A: {https: "https://agent-a.example.org:7443", iperf3: "agent-a.example.org:5201"}
+//	  SITE_B: {https: "https://agent-b.example.org:7443"}
+//	traceroute:
+//	  interval: 15m
+//	  destinations: {SITE_B: agent-b.example.org, cern-eos: eospublic.cern.ch}
+//	exclude:
+//	  - {source: SITE_A, destination: SITE_B, kind: iperf3}
+//
+// Every ordered pair of agents is a link, probed once per interval with
+// each kind its destination serves: https times small requests to the
+// destination agent's AGENT_PROBE_ADDR and a short download from it,
+// iperf3 runs a test against the destination's iperf3 server. Links are
+// spread over the interval by a hash of their name, and a site takes part
+// in one iperf3 test at a time so tests do not measure each other.
+// Every agent also traces the route to each traceroute destination, its
+// own site aside, for path-change detection (netpaths.go).
+//
+// Agents with AGENT_PROBES=true fetch the probes due from them at GET
+// /api/v1/agent/probes and post the results back, authenticating with
+// their site-scoped token (agenttokens.go). Results are exported per link
+// and listed at GET /api/v1/network-probes.
+var networkProbesPath = envOr("NETWORK_PROBES", "")
+
+type probeAgent struct {
+	HTTPS  string `yaml:"https"`
+	IPerf3 string `yaml:"iperf3"`
+}
+
+type probeLink struct {
+	Source      string `json:"source" yaml:"source"`
+	Destination string `json:"destination" yaml:"destination"`
+	Kind        string `json:"kind" yaml:"kind"`
+}
+
+type networkProbesConfig struct {
+	Interval      time.Duration         `yaml:"interval"`
+	Kinds         []string              `yaml:"kinds"`
+	IPerf3Seconds int                   `yaml:"iperf3_seconds"`
+	Agents        map[string]probeAgent `yaml:"agents"`
+	Traceroute    struct {
+		Interval     time.Duration     `yaml:"interval"`
+		Destinations map[string]string `yaml:"destinations"`
+	} `yaml:"traceroute"`
+	Exclude []probeLink `yaml:"exclude"`
+}
+
+// ProbeTask is a probe handed to the source agent.
+type ProbeTask struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Destination string `json:"destination"`
+	Target      string `json:"target"`
+	Seconds     int    `json:"seconds,omitempty"`
+}
+
+// ProbeResult is what an agent reports for a task, and the latest result
+// of a link as listed.
+type ProbeResult struct {
+	ID            string  `json:"id,omitempty"`
+	Source        string  `json:"source"`
+	Destination   string  `json:"destination"`
+	Kind          string  `json:"kind"`
+	Timestamp     float64 `json:"timestamp"`
+	Ok            bool    `json:"ok"`
+	Error         string  `json:"error,omitempty"`
+	RTT           float64 `json:"rtt_seconds,omitempty"`
+	BitsPerSecond float64 `json:"bits_per_second,omitempty"`
+	Retransmits   int     `json:"retransmits,omitempty"`
+	// Hops are a traceroute's hop addresses, "*" where none answered.
+	Hops []string `json:"hops,omitempty"`
+}
+
+type probeLease struct {
+	link  probeLink
+	until time.Time
+}
+
+type probeScheduler struct {
+	mu      sync.Mutex
+	cfg     networkProbesConfig
+	links   []probeLink
+	last    map[probeLink]time.Time // when each link was last handed out
+	leases  map[string]probeLease   // by task ID
+	results map[probeLink]ProbeResult
+}
+
+var netProbes = &probeScheduler{last: map[probeLink]time.Time{}, leases: map[string]probeLease{}, results: map[probeLink]ProbeResult{}}
+
+var (
+	networkProbeLabels = []string{"source_site", "destination_site", "kind"}
+	gaugeProbeRTT      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_probe_rtt_seconds", Help: "Round-trip time measured by the latest successful probe of a link"}, networkProbeLabels)
+	gaugeProbeBits     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_probe_throughput_bits_per_second", Help: "Throughput measured by the latest successful probe of a link"}, networkProbeLabels)
+	gaugeProbeRetrans  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_probe_retransmits", Help: "TCP retransmits during the latest successful iperf3 test of a link"}, networkProbeLabels)
+	gaugeProbeTs       = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_network_probe_result_timestamp_seconds", Help: "Time of the latest probe result of a link, successful or not"}, networkProbeLabels)
+	probeRuns          = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dtms_network_probe_runs_total", Help: "Network probes by kind and outcome (ok, failed, expired)"}, []string{"kind", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeProbeRTT, gaugeProbeBits, gaugeProbeRetrans, gaugeProbeTs, probeRuns)
+}
+
+func loadNetworkProbes() error {
+	if networkProbesPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(networkProbesPath)
+	if err != nil {
+		return err
+	}
+	cfg := networkProbesConfig{Interval: time.Hour, Kinds: []string{"https"}, IPerf3Seconds: 10}
+	cfg.Traceroute.Interval = 15 * time.Minute
+	if err := yamlenv.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", networkProbesPath, err)
+	}
+	if cfg.Interval < time.Minute || cfg.Traceroute.Interval < time.Minute {
+		return fmt.Errorf("%s: intervals must be at least a minute", networkProbesPath)
+	}
+	excluded := map[probeLink]bool{}
+	for _, l := range cfg.Exclude {
+		excluded[l] = true
+	}
+	var links []probeLink
+	for _, kind := range cfg.Kinds {
+		if kind != "https" && kind != "iperf3" {
+			return fmt.Errorf("%s: unknown probe kind %q", networkProbesPath, kind)
+		}
+		for src := range cfg.Agents {
+			for dst, a := range cfg.Agents {
+				l := probeLink{Source: src, Destination: dst, Kind: kind}
+				if src == dst || a.target(kind) == "" || excluded[l] || excluded[probeLink{Source: src, Destination: dst}] {
+					continue
+				}
+				links = append(links, l)
+			}
+		}
+	}
+	for src := range cfg.Agents {
+		for dst := range cfg.Traceroute.Destinations {
+			l := probeLink{Source: src, Destination: dst, Kind: "traceroute"}
+			if src != dst && !excluded[l] && !excluded[probeLink{Source: src, Destination: dst}] {
+				links = append(links, l)
+			}
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].String() < links[j].String() })
+	netProbes.mu.Lock()
+	netProbes.cfg, netProbes.links = cfg, links
+	netProbes.mu.Unlock()
+	fmt.Printf("[probes] %d links between %d agents every %s\n", len(links), len(cfg.Agents), cfg.Interval)
+	return nil
+}
+
+// target returns what the source of l probes.
+func (c *networkProbesConfig) target(l probeLink) string {
+	if l.Kind == "traceroute" {
+		return c.Traceroute.Destinations[l.Destination]
+	}
+	return c.Agents[l.Destination].target(l.Kind)
+}
+
+func (c *networkProbesConfig) interval(kind string) time.Duration {
+	if kind == "traceroute" {
+		return c.Traceroute.Interval
+	}
+	return c.Interval
+}
+
+func (a probeAgent) target(kind string) string {
+	if kind == "iperf3" {
+		return a.IPerf3
+	}
+	return a.HTTPS
+}
+
+func (l probeLink) String() string {
+	return l.Source + "->" + l.Destination + "/" + l.Kind
+}
+
+// slot returns when l is due in the interval that contains now: each link
+// has its own offset into the interval.
+func (s *probeScheduler) slot(l probeLink, now time.Time) time.Time {
+	h := fnv.New64a()
+	h.Write([]byte(l.String()))
+	interval := s.cfg.interval(l.Kind)
+	offset := time.Duration(h.Sum64() % uint64(interval))
+	slot := now.Truncate(interval).Add(offset)
+	if slot.After(now) {
+		slot = slot.Add(-interval)
+	}
+	return slot
+}
+
+// leaseTime is how long an agent has to report a task's result.
+func (s *probeScheduler) leaseTime(kind string) time.Duration {
+	if kind == "iperf3" {
+		return time.Duration(s.cfg.IPerf3Seconds)*time.Second + 2*time.Minute
+	}
+	return 2 * time.Minute
+}
+
+// expire forgets leases whose results never came.
+func (s *probeScheduler) expire(now time.Time) {
+	for id, l := range s.leases {
+		if now.After(l.until) {
+			delete(s.leases, id)
+			probeRuns.WithLabelValues(l.link.Kind, "expired").Inc()
+		}
+	}
+}
+
+// Due hands site the probes it should run now.
+func (s *probeScheduler) Due(site string, now time.Time) []ProbeTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	inIPerf3 := map[string]bool{}
+	for _, l := range s.leases {
+		if l.link.Kind == "iperf3" {
+			inIPerf3[l.link.Source], inIPerf3[l.link.Destination] = true, true
+		}
+	}
+	tasks := []ProbeTask{}
+	for _, l := range s.links {
+		if l.Source != site || !s.last[l].Before(s.slot(l, now)) {
+			continue
+		}
+		if l.Kind == "iperf3" {
+			if inIPerf3[l.Source] || inIPerf3[l.Destination] {
+				continue
+			}
+			inIPerf3[l.Source], inIPerf3[l.Destination] = true, true
+		}
+		id := make([]byte, 8)
+		rand.Read(id)
+		t := ProbeTask{ID: hex.EncodeToString(id), Kind: l.Kind, Destination: l.Destination, Target: s.cfg.target(l)}
+		if l.Kind == "iperf3" {
+			t.Seconds = s.cfg.IPerf3Seconds
+		}
+		s.last[l] = now
+		s.leases[t.ID] = probeLease{link: l, until: now.Add(s.leaseTime(l.Kind))}
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+// Report records results site posted for tasks it was handed; it returns
+// how many matched a task.
+func (s *probeScheduler) Report(site string, results []ProbeResult, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range results {
+		lease, ok := s.leases[r.ID]
+		if !ok || lease.link.Source != site {
+			continue
+		}
+		delete(s.leases, r.ID)
+		l := lease.link
+		r.Source, r.Destination, r.Kind = l.Source, l.Destination, l.Kind
+		r.Timestamp = float64(now.Unix())
+		s.results[l] = r
+		gaugeProbeTs.WithLabelValues(l.Source, l.Destination, l.Kind).Set(r.Timestamp)
+		if !r.Ok {
+			probeRuns.WithLabelValues(l.Kind, "failed").Inc()
+			fmt.Printf("[probes] %s failed: %s\n", l, r.Error)
+			n++
+			continue
+		}
+		probeRuns.WithLabelValues(l.Kind, "ok").Inc()
+		if l.Kind == "traceroute" {
+			netPaths.Observe(l.Source, l.Destination, r.Hops, now)
+		}
+		if r.RTT > 0 {
+			gaugeProbeRTT.WithLabelValues(l.Source, l.Destination, l.Kind).Set(r.RTT)
+		}
+		if r.BitsPerSecond > 0 {
+			gaugeProbeBits.WithLabelValues(l.Source, l.Destination, l.Kind).Set(r.BitsPerSecond)
+		}
+		if l.Kind == "iperf3" {
+			gaugeProbeRetrans.WithLabelValues(l.Source, l.Destination, l.Kind).Set(float64(r.Retransmits))
+		}
+		n++
+	}
+	return n
+}
+
+// Latest returns the latest result of every link that has one.
+func (s *probeScheduler) Latest() []ProbeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ProbeResult, 0, len(s.results))
+	for _, r := range s.results {
+		r.ID = ""
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return probeLink{out[i].Source, out[i].Destination, out[i].Kind}.String() < probeLink{out[j].Source, out[j].Destination, out[j].Kind}.String()
+	})
+	return out
+}
+
+// handleAgentProbes serves GET /api/v1/agent/probes, the probes due from
+// the calling agent's site, and POST, their results.
+func handleAgentProbes(w http.ResponseWriter, r *http.Request) {
+	site, err := parseAgentToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"probes": netProbes.Due(site, time.Now())})
+	case http.MethodPost:
+		var results []ProbeResult
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&results); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := netProbes.Report(site, results, time.Now())
+		writeJSON(w, http.StatusOK, map[string]interface{}{"accepted": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleNetworkProbes serves GET /api/v1/network-probes?site=, the latest
+// result of every link and the current route of every traced path, or of
+// those from or to site.
+func handleNetworkProbes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	list := netProbes.Latest()
+	kept := list[:0]
+	for _, p := range list {
+		if site == "" || p.Source == site || p.Destination == site {
+			kept = append(kept, p)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"links": kept, "paths": netPaths.List(site)})
+}
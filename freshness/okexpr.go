@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// okExpression is a compiled CEL rule deciding whether a site is fresh.
+// In scope: site, age, wall_age, threshold (seconds), latest and now
+// (timestamps), in_downtime, in_active_hours, and the site's metadata map.
+// age is wall_age unless the site's schedule pauses the clock off hours
+// (businesshours.go). hour(t) and weekday(t) return the UTC hour and day
+// of week (0 = Sunday); hour(t, tz) and weekday(t, tz) those in an IANA
+// timezone such as "Europe/Berlin".
+type okExpression struct {
+	prg cel.Program
+}
+
+var okEnv = mustOkEnv()
+
+func mustOkEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("site", cel.StringType),
+		cel.Variable("age", cel.DoubleType),
+		cel.Variable("threshold", cel.DoubleType),
+		cel.Variable("latest", cel.TimestampType),
+		cel.Variable("now", cel.TimestampType),
+		cel.Variable("wall_age", cel.DoubleType),
+		cel.Variable("in_downtime", cel.BoolType),
+		cel.Variable("in_active_hours", cel.BoolType),
+		cel.Variable("metadata", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Function("hour",
+			cel.Overload("hour_timestamp", []*cel.Type{cel.TimestampType}, cel.IntType,
+				cel.UnaryBinding(func(v ref.Val) ref.Val {
+					return types.Int(v.(types.Timestamp).UTC().Hour())
+				})),
+			cel.Overload("hour_timestamp_string", []*cel.Type{cel.TimestampType, cel.StringType}, cel.IntType,
+				cel.BinaryBinding(func(t, tz ref.Val) ref.Val {
+					loc, err := celLocation(string(tz.(types.String)))
+					if err != nil {
+						return types.NewErr("%v", err)
+					}
+					return types.Int(t.(types.Timestamp).In(loc).Hour())
+				}))),
+		cel.Function("weekday",
+			cel.Overload("weekday_timestamp", []*cel.Type{cel.TimestampType}, cel.IntType,
+				cel.UnaryBinding(func(v ref.Val) ref.Val {
+					return types.Int(v.(types.Timestamp).UTC().Weekday())
+				})),
+			cel.Overload("weekday_timestamp_string", []*cel.Type{cel.TimestampType, cel.StringType}, cel.IntType,
+				cel.BinaryBinding(func(t, tz ref.Val) ref.Val {
+					loc, err := celLocation(string(tz.(types.String)))
+					if err != nil {
+						return types.NewErr("%v", err)
+					}
+					return types.Int(t.(types.Timestamp).In(loc).Weekday())
+				}))),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// celLocations caches the zones ok rules name, as loading one reads the
+// zone database.
+var celLocations sync.Map
+
+func celLocation(name string) (*time.Location, error) {
+	if loc, ok := celLocations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	celLocations.Store(name, loc)
+	return loc, nil
+}
+
+func compileOkExpression(src string) (*okExpression, error) {
+	ast, iss := okEnv.Compile(src)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("ok expression must be bool, got %s", ast.OutputType())
+	}
+	prg, err := okEnv.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &okExpression{prg: prg}, nil
+}
+
+// evaluateOk applies the site's ok rule, defaulting to age <= threshold
+// (or inside a downtime, see DOWNTIME_SUPPRESSES_OK), after the site's
+// schedule has adjusted age or threshold. A rule that fails at runtime
+// falls back to the default and is logged.
+func evaluateOk(s SiteFresh, cfg siteConfig, inDowntime bool, now time.Time) bool {
+	judged, cfg, active := applySchedule(s, cfg, now)
+	def := judged.AgeSeconds <= cfg.Threshold || (inDowntime && downtimeSuppressesOk)
+	if cfg.okExpr == nil {
+		return def
+	}
+	metadata := cfg.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	out, _, err := cfg.okExpr.prg.Eval(map[string]interface{}{
+		"site":            s.Site,
+		"age":             judged.AgeSeconds,
+		"wall_age":        s.AgeSeconds,
+		"threshold":       cfg.Threshold,
+		"latest":          unixTime(s.LatestTimestamp),
+		"now":             now,
+		"in_downtime":     inDowntime,
+		"in_active_hours": active,
+		"metadata":        metadata,
+	})
+	if err != nil {
+		fmt.Printf("[freshness] site=%s ok expression %q failed: %v\n", s.Site, cfg.Ok, err)
+		return def
+	}
+	ok, _ := out.Value().(bool)
+	return ok
+}
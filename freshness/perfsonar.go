@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// perfsonarSource pulls the latest throughput, packet loss and one-way
+// delay results for configured site pairs from an esmond archive. It
+// contributes no sites of its own; the link metrics sit next to freshness
+// so staleness can be read against network conditions.
+type perfsonarSource struct {
+	name   string
+	URL    string          `yaml:"url"`
+	Window time.Duration   `yaml:"window"`
+	Pairs  []perfsonarPair `yaml:"pairs"`
+}
+
+type perfsonarPair struct {
+	Source      string `yaml:"source"`      // measurement host/address
+	Destination string `yaml:"destination"` // measurement host/address
+	SourceSite  string `yaml:"source_site"`
+	DestSite    string `yaml:"destination_site"`
+}
+
+var (
+	perfsonarLabels         = []string{"source_site", "destination_site"}
+	gaugePerfsonarBandwidth = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_perfsonar_throughput_bits_per_second", Help: "Latest perfSONAR throughput result between two sites"}, perfsonarLabels)
+	gaugePerfsonarLoss      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_perfsonar_packet_loss_ratio", Help: "Latest perfSONAR packet loss rate between two sites"}, perfsonarLabels)
+	gaugePerfsonarDelay     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_perfsonar_owdelay_seconds", Help: "Latest perfSONAR mean one-way delay between two sites"}, perfsonarLabels)
+	gaugePerfsonarResultTs  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_perfsonar_result_timestamp_seconds", Help: "Time of the latest perfSONAR result by event type"}, append(perfsonarLabels, "event_type"))
+)
+
+func init() {
+	prometheus.MustRegister(gaugePerfsonarBandwidth, gaugePerfsonarLoss, gaugePerfsonarDelay, gaugePerfsonarResultTs)
+	registerSource("perfsonar", func(name string, params *yaml.Node) (Source, error) {
+		s := &perfsonarSource{name: name, Window: 24 * time.Hour}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		for i := range s.Pairs {
+			p := &s.Pairs[i]
+			if p.SourceSite == "" {
+				p.SourceSite = p.Source
+			}
+			if p.DestSite == "" {
+				p.DestSite = p.Destination
+			}
+		}
+		return s, nil
+	})
+}
+
+func (s *perfsonarSource) Name() string { return s.name }
+
+type esmondMetadata struct {
+	EventTypes []struct {
+		EventType string `json:"event-type"`
+		BaseURI   string `json:"base-uri"`
+		Summaries []struct {
+			Type   string `json:"summary-type"`
+			Window string `json:"summary-window"`
+			URI    string `json:"uri"`
+		} `json:"summaries"`
+	} `json:"event-types"`
+}
+
+type esmondPoint struct {
+	TS  int64           `json:"ts"`
+	Val json.RawMessage `json:"val"`
+}
+
+func (s *perfsonarSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	for _, p := range s.Pairs {
+		if err := s.collectPair(ctx, p); err != nil {
+			fmt.Printf("[%s] %s->%s: %v\n", s.name, p.SourceSite, p.DestSite, err)
+		}
+	}
+	return nil, nil
+}
+
+func (s *perfsonarSource) collectPair(ctx context.Context, p perfsonarPair) error {
+	q := url.Values{
+		"source":      {p.Source},
+		"destination": {p.Destination},
+		"time-range":  {fmt.Sprint(int(s.Window.Seconds()))},
+	}
+	var metas []esmondMetadata
+	if err := s.get(ctx, "/esmond/perfsonar/archive/?"+q.Encode(), &metas); err != nil {
+		return err
+	}
+	labels := prometheus.Labels{"source_site": p.SourceSite, "destination_site": p.DestSite}
+	for _, m := range metas {
+		for _, et := range m.EventTypes {
+			uri := et.BaseURI
+			switch et.EventType {
+			case "throughput", "packet-loss-rate":
+			case "histogram-owdelay":
+				uri = ""
+				for _, sum := range et.Summaries {
+					if sum.Type == "statistics" && sum.Window == "0" {
+						uri = sum.URI
+					}
+				}
+			default:
+				continue
+			}
+			if uri == "" {
+				continue
+			}
+			pt, err := s.latest(ctx, uri)
+			if err != nil {
+				return err
+			}
+			if pt == nil {
+				continue
+			}
+			switch et.EventType {
+			case "throughput":
+				var v float64
+				if json.Unmarshal(pt.Val, &v) == nil {
+					gaugePerfsonarBandwidth.With(labels).Set(v)
+					networkResults.record(p.SourceSite, p.DestSite, et.EventType, v, pt.TS)
+				}
+			case "packet-loss-rate":
+				var v float64
+				if json.Unmarshal(pt.Val, &v) == nil {
+					gaugePerfsonarLoss.With(labels).Set(v)
+					networkResults.record(p.SourceSite, p.DestSite, et.EventType, v, pt.TS)
+				}
+			case "histogram-owdelay":
+				var st struct {
+					Mean float64 `json:"mean"`
+				}
+				if json.Unmarshal(pt.Val, &st) == nil {
+					gaugePerfsonarDelay.With(labels).Set(st.Mean / 1000)
+				}
+			}
+			gaugePerfsonarResultTs.WithLabelValues(p.SourceSite, p.DestSite, et.EventType).Set(float64(pt.TS))
+		}
+	}
+	return nil
+}
+
+func (s *perfsonarSource) latest(ctx context.Context, uri string) (*esmondPoint, error) {
+	q := url.Values{"time-range": {fmt.Sprint(int(s.Window.Seconds()))}}
+	var pts []esmondPoint
+	if err := s.get(ctx, uri+"?"+q.Encode(), &pts); err != nil {
+		return nil, err
+	}
+	var last *esmondPoint
+	for i := range pts {
+		if last == nil || pts[i].TS > last.TS {
+			last = &pts[i]
+		}
+	}
+	return last, nil
+}
+
+func (s *perfsonarSource) get(ctx context.Context, path string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
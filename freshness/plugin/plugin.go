@@ -0,0 +1,198 @@
+// Package plugin is the protocol between the freshness service and the
+// plugin programs named in its PLUGINS_CONFIG, and a small server for
+// writing plugins in Go. A plugin is any executable; the service starts
+// it once, keeps it running and restarts it if it exits. They talk in
+// JSON lines: the service writes requests to the plugin's stdin and reads
+// responses, matched by id, from its stdout. Whatever the plugin writes to
+// stderr ends up in the service's log.
+//
+//	-> {"id":1,"method":"configure","params":{"protocol":1,"name":"pd","config":{...}}}
+//	<- {"id":1,"result":{"protocol":1,"capabilities":["notifier"]}}
+//	-> {"id":2,"method":"notify","params":{"type":"incident.opened","site":"SITE_A",...}}
+//	<- {"id":2,"result":{}}
+//	-> {"id":3,"method":"collect","params":{"source":"lab","params":{...}}}
+//	<- {"id":3,"error":"upstream unavailable"}
+//
+// configure is always the first request; a plugin answering with another
+// protocol version is not used. Plugins with the "source" capability
+// answer collect with {"sites": [...]}, records as served by dtms-api's
+// /freshness; "notifier" plugins receive notify with an event of the
+// service's bus. Requests may arrive before earlier ones are answered.
+// The service sets DTMS_PLUGIN=1 in the plugin's environment, so a plugin
+// run by hand can tell it is not talking to the service. Closing stdin
+// asks the plugin to exit.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Protocol is the protocol version this package speaks.
+const Protocol = 1
+
+// MagicEnv is set to "1" in a plugin's environment by the service.
+const MagicEnv = "DTMS_PLUGIN"
+
+// Capabilities a plugin can announce.
+const (
+	CapabilitySource   = "source"
+	CapabilityNotifier = "notifier"
+)
+
+type Request struct {
+	ID     int64           `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type ConfigureParams struct {
+	Protocol int             `json:"protocol"`
+	Name     string          `json:"name"`
+	Config   json.RawMessage `json:"config,omitempty"`
+}
+
+type ConfigureResult struct {
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type CollectParams struct {
+	Source string          `json:"source"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Site is one freshness record, as in dtms-api's /freshness. A record
+// with only LatestTimestamp has its age computed by the service.
+type Site struct {
+	Site            string  `json:"site"`
+	LatestTimestamp float64 `json:"latest_timestamp"`
+	AgeSeconds      float64 `json:"age_seconds,omitempty"`
+}
+
+type CollectResult struct {
+	Sites []Site `json:"sites"`
+}
+
+// Event is a bus event as delivered to notifiers. Message is the text
+// rendered from the plugin's template, when it has one.
+type Event struct {
+	Type    string          `json:"type"`
+	Time    string          `json:"time"`
+	Site    string          `json:"site,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// Handlers implement a plugin. Leaving one nil leaves its capability
+// out.
+type Handlers struct {
+	Configure func(name string, config json.RawMessage) error
+	Collect   func(ctx context.Context, source string, params json.RawMessage) ([]Site, error)
+	Notify    func(ctx context.Context, ev Event) error
+}
+
+// Serve answers requests on stdin and stdout until stdin is closed.
+func Serve(h Handlers) error {
+	if os.Getenv(MagicEnv) != "1" {
+		return fmt.Errorf("this is a DTMS plugin; list it in the freshness service's PLUGINS_CONFIG instead of running it")
+	}
+	return ServeConn(context.Background(), os.Stdin, os.Stdout, h)
+}
+
+// ServeConn is Serve over any pair of streams. Requests are handled
+// concurrently; ctx is cancelled once in is exhausted.
+func ServeConn(ctx context.Context, in io.Reader, out io.Writer, h Handlers) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	enc := json.NewEncoder(out)
+	reply := func(resp Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(resp)
+	}
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var req Request
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			return fmt.Errorf("plugin: bad request: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := h.handle(ctx, req)
+			resp := Response{ID: req.ID}
+			if err != nil {
+				resp.Error = err.Error()
+			} else if resp.Result, err = json.Marshal(result); err != nil {
+				resp.Result, resp.Error = nil, err.Error()
+			}
+			reply(resp)
+		}()
+	}
+	cancel()
+	wg.Wait()
+	return sc.Err()
+}
+
+func (h Handlers) handle(ctx context.Context, req Request) (interface{}, error) {
+	switch req.Method {
+	case "configure":
+		var p ConfigureParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if h.Configure != nil {
+			if err := h.Configure(p.Name, p.Config); err != nil {
+				return nil, err
+			}
+		}
+		res := ConfigureResult{Protocol: Protocol, Capabilities: []string{}}
+		if h.Collect != nil {
+			res.Capabilities = append(res.Capabilities, CapabilitySource)
+		}
+		if h.Notify != nil {
+			res.Capabilities = append(res.Capabilities, CapabilityNotifier)
+		}
+		return res, nil
+	case "collect":
+		if h.Collect == nil {
+			break
+		}
+		var p CollectParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		sites, err := h.Collect(ctx, p.Source, p.Params)
+		if err != nil {
+			return nil, err
+		}
+		return CollectResult{Sites: sites}, nil
+	case "notify":
+		if h.Notify == nil {
+			break
+		}
+		var ev Event
+		if err := json.Unmarshal(req.Params, &ev); err != nil {
+			return nil, err
+		}
+		return struct{}{}, h.Notify(ctx, ev)
+	}
+	return nil, fmt.Errorf("method %q not supported", req.Method)
+}
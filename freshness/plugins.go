@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/events"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+	"github.com/youruser/dtms-fresh/plugin"
+	"gopkg.in/yaml.v3"
+)
+
+// PLUGINS_CONFIG names long-running plugin programs that add sources and
+// notification channels without rebuilding the service; the protocol is
+// described in package plugin. A plugin announcing the source capability
+// is used by sources of type plugin in SOURCES_CONFIG, and a notifier
+// receives the bus events matching its `events` patterns (incident.* by
+// default), retried twice, with the event's text rendered from the
+// plugin's `template` (templates.go) as its message. See
+// plugins.example.yml.
+var pluginsConfig = envOr("PLUGINS_CONFIG", "")
+
+type pluginConfig struct {
+	Name     string            `yaml:"name"`
+	Command  []string          `yaml:"command"`
+	Env      map[string]string `yaml:"env"`
+	Dir      string            `yaml:"dir"`
+	Config   interface{}       `yaml:"config"`
+	Events   []string          `yaml:"events"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Template string            `yaml:"template"`
+}
+
+var (
+	pluginCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_plugin_calls_total", Help: "Calls into plugins by plugin, method and result"},
+		[]string{"plugin", "method", "result"},
+	)
+	pluginStarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_plugin_starts_total", Help: "Plugin processes started, including restarts"},
+		[]string{"plugin"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pluginCalls, pluginStarts)
+	registerSource("plugin", func(name string, params *yaml.Node) (Source, error) {
+		var c struct {
+			Plugin string      `yaml:"plugin"`
+			Params interface{} `yaml:"params"`
+		}
+		if err := params.Decode(&c); err != nil {
+			return nil, err
+		}
+		p := plugins[c.Plugin]
+		if p == nil {
+			return nil, fmt.Errorf("no plugin %q in PLUGINS_CONFIG", c.Plugin)
+		}
+		if !p.has(plugin.CapabilitySource) {
+			return nil, fmt.Errorf("plugin %q is not a source", c.Plugin)
+		}
+		raw, err := json.Marshal(c.Params)
+		if err != nil {
+			return nil, err
+		}
+		return &pluginSource{name: name, plugin: p, params: raw}, nil
+	})
+}
+
+var plugins = map[string]*pluginProcess{}
+
+// pluginProcess is one configured plugin: its process while it runs and
+// the calls waiting on it.
+type pluginProcess struct {
+	cfg          pluginConfig
+	config       json.RawMessage
+	capabilities []string
+	tmpl         *texttemplate.Template
+
+	// startMu serializes starts, so configure is always the first call
+	startMu sync.Mutex
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	cmd     *exec.Cmd
+	nextID  int64
+	pending map[int64]chan plugin.Response
+	started time.Time
+}
+
+// pluginRestartDelay keeps a crashing plugin from being restarted in a
+// tight loop.
+const pluginRestartDelay = 5 * time.Second
+
+func loadPlugins() error {
+	if pluginsConfig == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(pluginsConfig)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Plugins []pluginConfig `yaml:"plugins"`
+	}
+	if err := yamlenv.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("%s: %w", pluginsConfig, err)
+	}
+	for _, c := range doc.Plugins {
+		if c.Name == "" || len(c.Command) == 0 {
+			return fmt.Errorf("plugins need a name and a command")
+		}
+		if plugins[c.Name] != nil {
+			return fmt.Errorf("duplicate plugin %q", c.Name)
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 30 * time.Second
+		}
+		if len(c.Events) == 0 {
+			c.Events = []string{"incident.*"}
+		}
+		p := &pluginProcess{cfg: c, pending: map[int64]chan plugin.Response{}}
+		if p.config, err = json.Marshal(c.Config); err != nil {
+			return fmt.Errorf("plugin %s: %w", c.Name, err)
+		}
+		if c.Template != "" {
+			if p.tmpl, err = parseMessageTemplate(c.Name, c.Template); err != nil {
+				return fmt.Errorf("plugin %s: %w", c.Name, err)
+			}
+		}
+		// start now: the capabilities decide how the plugin is used
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		err := p.ensure(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", c.Name, err)
+		}
+		fmt.Printf("[plugins] %s started with %v\n", c.Name, p.capabilities)
+		plugins[c.Name] = p
+	}
+	return nil
+}
+
+func (p *pluginProcess) has(capability string) bool {
+	for _, c := range p.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure starts the process and configures it unless it is running.
+func (p *pluginProcess) ensure(ctx context.Context) error {
+	p.startMu.Lock()
+	defer p.startMu.Unlock()
+	p.mu.Lock()
+	if p.cmd != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	if wait := pluginRestartDelay - time.Since(p.started); wait > 0 && !p.started.IsZero() {
+		p.mu.Unlock()
+		return fmt.Errorf("restarting in %s", wait.Round(time.Second))
+	}
+	p.started = time.Now()
+	cmd := exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	cmd.Dir = p.cfg.Dir
+	cmd.Env = append(os.Environ(), plugin.MagicEnv+"=1")
+	for k, v := range p.cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	pluginStarts.WithLabelValues(p.cfg.Name).Inc()
+	p.cmd, p.stdin = cmd, stdin
+	p.mu.Unlock()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		p.logStderr(stderr)
+		close(stderrDone)
+	}()
+	go p.readResponses(cmd, stdout, stderrDone)
+
+	var res plugin.ConfigureResult
+	err = p.call(ctx, "configure", plugin.ConfigureParams{Protocol: plugin.Protocol, Name: p.cfg.Name, Config: p.config}, &res)
+	if err == nil && res.Protocol != plugin.Protocol {
+		err = fmt.Errorf("speaks protocol %d, want %d", res.Protocol, plugin.Protocol)
+	}
+	if err != nil {
+		p.stop(cmd)
+		return err
+	}
+	p.mu.Lock()
+	p.capabilities = res.Capabilities
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *pluginProcess) logStderr(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fmt.Printf("[plugins] %s: %s\n", p.cfg.Name, sc.Text())
+	}
+}
+
+// readResponses hands each response to its caller and, once the plugin
+// exits, fails the calls still waiting.
+func (p *pluginProcess) readResponses(cmd *exec.Cmd, stdout io.Reader, stderrDone <-chan struct{}) {
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var resp plugin.Response
+		if err := json.Unmarshal(sc.Bytes(), &resp); err != nil {
+			fmt.Printf("[plugins] %s: bad response: %v\n", p.cfg.Name, err)
+			continue
+		}
+		p.mu.Lock()
+		ch := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+	<-stderrDone
+	err := cmd.Wait()
+	fmt.Printf("[plugins] %s exited: %v\n", p.cfg.Name, err)
+	p.mu.Lock()
+	if p.cmd == cmd {
+		p.cmd, p.stdin = nil, nil
+	}
+	for id, ch := range p.pending {
+		ch <- plugin.Response{ID: id, Error: "plugin exited"}
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+}
+
+func (p *pluginProcess) stop(cmd *exec.Cmd) {
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin != nil {
+		stdin.Close()
+	}
+	time.AfterFunc(5*time.Second, func() { cmd.Process.Kill() })
+}
+
+// call sends one request and decodes the result into out.
+func (p *pluginProcess) call(ctx context.Context, method string, params, out interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.stdin == nil {
+		p.mu.Unlock()
+		return fmt.Errorf("plugin not running")
+	}
+	p.nextID++
+	id := p.nextID
+	ch := make(chan plugin.Response, 1)
+	p.pending[id] = ch
+	line, _ := json.Marshal(plugin.Request{ID: id, Method: method, Params: raw})
+	_, err = p.stdin.Write(append(line, '\n'))
+	p.mu.Unlock()
+
+	result := "ok"
+	defer func() { pluginCalls.WithLabelValues(p.cfg.Name, method, result).Inc() }()
+	if err != nil {
+		result = "error"
+		p.forget(id)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		result = "timeout"
+		p.forget(id)
+		return ctx.Err()
+	case resp := <-ch:
+		if resp.Error != "" {
+			result = "error"
+			return fmt.Errorf("%s", resp.Error)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, out)
+	}
+}
+
+func (p *pluginProcess) forget(id int64) {
+	p.mu.Lock()
+	delete(p.pending, id)
+	p.mu.Unlock()
+}
+
+// Call restarts the plugin if it has exited and makes one call.
+func (p *pluginProcess) Call(ctx context.Context, method string, params, out interface{}) error {
+	if err := p.ensure(ctx); err != nil {
+		return fmt.Errorf("plugin %s: %w", p.cfg.Name, err)
+	}
+	if err := p.call(ctx, method, params, out); err != nil {
+		return fmt.Errorf("plugin %s: %s: %w", p.cfg.Name, method, err)
+	}
+	return nil
+}
+
+// pluginSource collects through a source plugin, passing the entry's
+// params along.
+type pluginSource struct {
+	name   string
+	plugin *pluginProcess
+	params json.RawMessage
+}
+
+func (s *pluginSource) Name() string { return s.name }
+
+func (s *pluginSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	var res plugin.CollectResult
+	if err := s.plugin.Call(ctx, "collect", plugin.CollectParams{Source: s.name, Params: s.params}, &res); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := make([]SiteFresh, 0, len(res.Sites))
+	for _, r := range res.Sites {
+		if r.Site == "" {
+			continue
+		}
+		sf := SiteFresh{Site: r.Site, LatestTimestamp: r.LatestTimestamp, AgeSeconds: r.AgeSeconds}
+		if sf.AgeSeconds == 0 && sf.LatestTimestamp > 0 {
+			sf.AgeSeconds = now.Sub(unixTime(sf.LatestTimestamp)).Seconds()
+		}
+		out = append(out, sf)
+	}
+	return out, nil
+}
+
+// startPluginNotifiers subscribes each notifier plugin to its events.
+func startPluginNotifiers(ctx context.Context) {
+	for _, p := range plugins {
+		if !p.has(plugin.CapabilityNotifier) {
+			continue
+		}
+		p := p
+		sub := bus.Subscribe("plugin:"+p.cfg.Name, 256, p.cfg.Events...)
+		go func() {
+			defer sub.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev := <-sub.C:
+					p.notify(ctx, ev)
+				}
+			}
+		}()
+	}
+}
+
+func (p *pluginProcess) notify(ctx context.Context, ev events.Event) {
+	pev := plugin.Event{Type: ev.Type, Time: ev.Time.Format(time.RFC3339Nano), Site: ev.Site}
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		fmt.Printf("[plugins] %s: %s: %v\n", p.cfg.Name, ev.Type, err)
+		return
+	}
+	pev.Data = data
+	if p.tmpl != nil {
+		if pev.Message, err = renderTemplate(p.tmpl, eventMessage(ev)); err != nil {
+			fmt.Printf("[plugins] %s: %s: template: %v\n", p.cfg.Name, ev.Type, err)
+			return
+		}
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+		cctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+		err = p.Call(cctx, "notify", pev, nil)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	fmt.Printf("[plugins] %s: %s for site=%s: %v\n", p.cfg.Name, ev.Type, ev.Site, err)
+}
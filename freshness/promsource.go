@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// promSource computes freshness from per-site timestamps a team already
+// keeps in Prometheus, Thanos or Mimir. It runs an instant query through
+// the HTTP query API (/api/v1/query, which every remote-read backend also
+// serves) and maps each series of the resulting vector to a site by
+// site_label:
+//
+//	type: prometheus
+//	url: https://thanos-query.example.org
+//	query: max by (site) (transfer_last_success_timestamp_seconds)
+//	site_label: site        # default
+//	value: timestamp        # or age, when the query already yields seconds
+//	sites:                  # optional label value -> DTMS site renames
+//	  t1-cern: CERN
+//
+// bearer_token or username/password authenticate; headers are sent as is,
+// e.g. X-Scope-OrgID for a multi-tenant Mimir.
+type promSource struct {
+	name        string
+	URL         string            `yaml:"url"`
+	Query       string            `yaml:"query"`
+	SiteLabel   string            `yaml:"site_label"`
+	Value       string            `yaml:"value"`
+	Sites       map[string]string `yaml:"sites"`
+	BearerToken string            `yaml:"bearer_token"`
+	Username    string            `yaml:"username"`
+	Password    string            `yaml:"password"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+func init() {
+	registerSource("prometheus", func(name string, params *yaml.Node) (Source, error) {
+		s := &promSource{name: name, SiteLabel: "site", Value: "timestamp"}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.URL == "" || s.Query == "" {
+			return nil, fmt.Errorf("url and query are required")
+		}
+		if s.Value != "timestamp" && s.Value != "age" {
+			return nil, fmt.Errorf("value must be timestamp or age")
+		}
+		return s, nil
+	})
+}
+
+func (s *promSource) Name() string { return s.name }
+
+func (s *promSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	form := url.Values{"query": {s.Query}, "time": {strconv.FormatInt(now.Unix(), 10)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(s.URL, "/")+"/api/v1/query", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case s.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+	case s.Username != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  [2]interface{}    `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("query: %s", resp.Status)
+	}
+	if res.Status != "success" {
+		return nil, fmt.Errorf("query: %s", res.Error)
+	}
+	if res.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("query returned a %s, want a vector", res.Data.ResultType)
+	}
+
+	var out []SiteFresh
+	for _, r := range res.Data.Result {
+		site := r.Metric[s.SiteLabel]
+		if site == "" {
+			continue
+		}
+		if renamed, ok := s.Sites[site]; ok {
+			site = renamed
+		}
+		raw, _ := r.Value[1].(string)
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			fmt.Printf("[%s] site=%s: bad sample %q\n", s.name, site, raw)
+			continue
+		}
+		f := SiteFresh{Site: site}
+		if s.Value == "age" {
+			f.AgeSeconds = v
+			f.LatestTimestamp = float64(now.Unix()) - v
+		} else {
+			f.LatestTimestamp = v
+			f.AgeSeconds = float64(now.Unix()) - v
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
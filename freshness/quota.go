@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// Stored bytes are tracked per site and tenant from ingested events:
+// successful transfers add their bytes at the destination, events with
+// status "deleted" remove them. QUOTAS_CONFIG sets limits on that usage;
+// a quota without a tenant covers the whole site:
+//
+//	quotas:
+//	  - site: SITE_A
+//	    soft: 80TB
+//	    hard: 100TB
+//	  - site: SITE_A
+//	    tenant: bulk-recovery
+//	    hard: 20TB
+//
+// New transfer requests that would push their destination past a hard
+// quota are rejected; past a soft quota they are accepted with a warning.
+var (
+	quotasConfigPath = envOr("QUOTAS_CONFIG", "")
+	quotaUsagePath   = envOr("QUOTA_USAGE_FILE", filepath.Join(dataDir, "quota-usage.json"))
+)
+
+// eventDeleted is the status of events reporting data removed from a site.
+const eventDeleted = "deleted"
+
+// quotaAllTenants labels site-wide usage and quotas.
+const quotaAllTenants = "all"
+
+type quotaRule struct {
+	Site   string `yaml:"site"`
+	Tenant string `yaml:"tenant"`
+	Soft   string `yaml:"soft"`
+	Hard   string `yaml:"hard"`
+
+	soft, hard float64
+}
+
+// QuotaStatus is one quota's usage as reported by the API.
+type QuotaStatus struct {
+	Site   string  `json:"site"`
+	Tenant string  `json:"tenant"`
+	Used   int64   `json:"used_bytes"`
+	Soft   int64   `json:"soft_bytes,omitempty"`
+	Hard   int64   `json:"hard_bytes,omitempty"`
+	Ratio  float64 `json:"used_ratio,omitempty"`
+	State  string  `json:"state"`
+}
+
+var (
+	gaugeQuotaUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_quota_used_bytes", Help: "Bytes stored per site and tenant (tenant=\"all\" for the site total)"},
+		[]string{"site", "tenant"},
+	)
+	gaugeQuotaLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_quota_limit_bytes", Help: "Configured soft and hard quotas"},
+		[]string{"site", "tenant", "kind"},
+	)
+	quotaRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_quota_rejections_total", Help: "Transfer requests rejected by a hard quota"},
+		[]string{"site", "tenant"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeQuotaUsed, gaugeQuotaLimit, quotaRejections)
+}
+
+type quotaKey struct {
+	Site   string `json:"site"`
+	Tenant string `json:"tenant"`
+}
+
+type quotaTracker struct {
+	mu    sync.Mutex
+	rules []quotaRule
+	used  map[quotaKey]int64
+	dirty bool
+}
+
+var quotas = &quotaTracker{used: map[quotaKey]int64{}}
+
+func loadQuotas() error {
+	if raw, err := os.ReadFile(quotaUsagePath); err == nil {
+		var rows []struct {
+			quotaKey
+			Used int64 `json:"used_bytes"`
+		}
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return fmt.Errorf("%s: %w", quotaUsagePath, err)
+		}
+		for _, r := range rows {
+			quotas.used[r.quotaKey] = r.Used
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if quotasConfigPath != "" {
+		raw, err := os.ReadFile(quotasConfigPath)
+		if err != nil {
+			return err
+		}
+		var f struct {
+			Quotas []quotaRule `yaml:"quotas"`
+		}
+		if err := yamlenv.Unmarshal(raw, &f); err != nil {
+			return fmt.Errorf("%s: %w", quotasConfigPath, err)
+		}
+		for i := range f.Quotas {
+			q := &f.Quotas[i]
+			if q.Tenant == "" {
+				q.Tenant = quotaAllTenants
+			}
+			for _, l := range []struct {
+				s    string
+				into *float64
+			}{{q.Soft, &q.soft}, {q.Hard, &q.hard}} {
+				if l.s == "" {
+					continue
+				}
+				if *l.into, err = parseBytes(l.s); err != nil {
+					return fmt.Errorf("%s: quota %s/%s: %w", quotasConfigPath, q.Site, q.Tenant, err)
+				}
+			}
+			if q.soft > 0 {
+				gaugeQuotaLimit.WithLabelValues(q.Site, q.Tenant, "soft").Set(q.soft)
+			}
+			if q.hard > 0 {
+				gaugeQuotaLimit.WithLabelValues(q.Site, q.Tenant, "hard").Set(q.hard)
+			}
+		}
+		quotas.rules = f.Quotas
+	}
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	for k, v := range quotas.used {
+		gaugeQuotaUsed.WithLabelValues(k.Site, k.Tenant).Set(float64(v))
+	}
+	return nil
+}
+
+func eventTenant(ev TransferEvent) string {
+	if ev.Tenant == "" {
+		return "default"
+	}
+	return ev.Tenant
+}
+
+// Observe applies a transfer or deletion event to the usage counts.
+func (q *quotaTracker) Observe(ev TransferEvent) {
+	var delta int64
+	switch ev.Status {
+	case "success":
+		delta = ev.Bytes
+	case eventDeleted:
+		delta = -ev.Bytes
+	default:
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, k := range []quotaKey{{ev.Site, eventTenant(ev)}, {ev.Site, quotaAllTenants}} {
+		v := q.used[k] + delta
+		if v < 0 {
+			v = 0
+		}
+		q.used[k] = v
+		gaugeQuotaUsed.WithLabelValues(k.Site, k.Tenant).Set(float64(v))
+	}
+	q.dirty = true
+}
+
+// Check reports whether adding bytes for tenant at site stays within the
+// hard quotas, and a warning when it crosses a soft one.
+func (q *quotaTracker) Check(site, tenant string, bytes int64) (ok bool, warning string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ok = true
+	for _, r := range q.rules {
+		if r.Site != site || (r.Tenant != quotaAllTenants && r.Tenant != tenant) {
+			continue
+		}
+		after := float64(q.used[quotaKey{site, r.Tenant}] + bytes)
+		switch {
+		case r.hard > 0 && after > r.hard:
+			quotaRejections.WithLabelValues(site, r.Tenant).Inc()
+			return false, fmt.Sprintf("hard quota for %s/%s exceeded", site, r.Tenant)
+		case r.soft > 0 && after > r.soft:
+			warning = fmt.Sprintf("soft quota for %s/%s exceeded", site, r.Tenant)
+		}
+	}
+	return ok, warning
+}
+
+// Status returns every configured quota and every tracked usage.
+func (q *quotaTracker) Status(site string) []QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []QuotaStatus{}
+	covered := map[quotaKey]bool{}
+	for _, r := range q.rules {
+		k := quotaKey{r.Site, r.Tenant}
+		covered[k] = true
+		s := QuotaStatus{Site: r.Site, Tenant: r.Tenant, Used: q.used[k], Soft: int64(r.soft), Hard: int64(r.hard), State: "ok"}
+		limit := r.hard
+		if limit == 0 {
+			limit = r.soft
+		}
+		if limit > 0 {
+			s.Ratio = float64(s.Used) / limit
+		}
+		switch {
+		case r.hard > 0 && float64(s.Used) >= r.hard:
+			s.State = "hard"
+		case r.soft > 0 && float64(s.Used) >= r.soft:
+			s.State = "soft"
+		}
+		out = append(out, s)
+	}
+	for k, v := range q.used {
+		if !covered[k] {
+			out = append(out, QuotaStatus{Site: k.Site, Tenant: k.Tenant, Used: v, State: "unlimited"})
+		}
+	}
+	filtered := out[:0]
+	for _, s := range out {
+		if site == "" || s.Site == site {
+			filtered = append(filtered, s)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		if filtered[i].Site != filtered[j].Site {
+			return filtered[i].Site < filtered[j].Site
+		}
+		return filtered[i].Tenant < filtered[j].Tenant
+	})
+	return filtered
+}
+
+func (q *quotaTracker) flushLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := q.save(); err != nil {
+			fmt.Printf("[quota] save: %v\n", err)
+		}
+	}
+}
+
+func (q *quotaTracker) save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty {
+		return nil
+	}
+	type row struct {
+		quotaKey
+		Used int64 `json:"used_bytes"`
+	}
+	rows := make([]row, 0, len(q.used))
+	for k, v := range q.used {
+		rows = append(rows, row{k, v})
+	}
+	raw, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(quotaUsagePath, raw); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// handleQuotas serves GET /api/v1/quotas?site=.
+func handleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"quotas": quotas.Status(r.URL.Query().Get("site"))})
+}
+
+// parseBytes parses sizes such as "100TB", "1.5G" or plain bytes; suffixes
+// are powers of 1000.
+func parseBytes(s string) (float64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := 1.0
+	if n := len(t); n > 0 {
+		if m, ok := map[byte]float64{'K': 1e3, 'M': 1e6, 'G': 1e9, 'T': 1e12, 'P': 1e15}[t[n-1]]; ok {
+			mult, t = m, t[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(t, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * mult, nil
+}
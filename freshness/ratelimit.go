@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// RATE_LIMITS_CONFIG limits each tenant's use of the HTTP API; see
+// ratelimits.example.yml. A request belongs to the tenant of its agent
+// token's site, of its LDAP user, or of its webhook source; anything else
+// counts against "default". Requests beyond the tenant's rate get 429 with
+// Retry-After, webhook bodies over max_body_bytes get 413, and once a
+// tenant has sent ingest_bytes_per_day (UTC) further webhooks get 429
+// until midnight. Daily volumes are kept in memory only; the counters
+// below are the record for capacity planning and chargeback.
+//
+// Telling an LDAP user's tenant takes a bind, so basic-auth requests are
+// first limited per client address under `logins` (the default limits when
+// absent) and only then authenticated; this also throttles password
+// guessing.
+var rateLimitsConfigPath = envOr("RATE_LIMITS_CONFIG", "")
+
+const defaultTenant = "default"
+
+type tenantLimits struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	MaxBodyBytes      int64   `yaml:"max_body_bytes"`
+	IngestBytesPerDay int64   `yaml:"ingest_bytes_per_day"`
+}
+
+type rateLimitsConfig struct {
+	Default tenantLimits            `yaml:"default"`
+	Tenants map[string]tenantLimits `yaml:"tenants"`
+	// Logins limits basic-auth requests per client address; only the
+	// request rate and burst apply.
+	Logins *tenantLimits `yaml:"logins"`
+	// Sources assigns webhook sources to tenants.
+	Sources map[string]string `yaml:"sources"`
+}
+
+var (
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_api_requests_total", Help: "HTTP API requests by tenant and result (allowed, rate_limited, too_large, over_quota)"},
+		[]string{"tenant", "result"},
+	)
+	apiIngestBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_api_ingest_bytes_total", Help: "Webhook payload bytes received by tenant"},
+		[]string{"tenant"},
+	)
+	apiIngestQuotaUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_api_ingest_quota_used_ratio", Help: "Share of the tenant's daily ingestion quota used today"},
+		[]string{"tenant"},
+	)
+	apiLoginsLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "dtms_api_logins_rate_limited_total", Help: "Basic-auth requests refused before authentication by the per-client login limit"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiIngestBytes, apiIngestQuotaUsed, apiLoginsLimited)
+}
+
+type tenantBucket struct {
+	tokens  float64
+	updated time.Time
+	day     string
+	ingest  int64
+}
+
+type rateLimiter struct {
+	cfg rateLimitsConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tenantBucket
+	logins  map[string]*tenantBucket // by client address
+	pruned  time.Time
+}
+
+// rateLimits is nil unless RATE_LIMITS_CONFIG is set.
+var rateLimits *rateLimiter
+
+func loadRateLimits() error {
+	if rateLimitsConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(rateLimitsConfigPath)
+	if err != nil {
+		return err
+	}
+	var c rateLimitsConfig
+	if err := yamlenv.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("%s: %w", rateLimitsConfigPath, err)
+	}
+	rateLimits = &rateLimiter{cfg: c, buckets: map[string]*tenantBucket{}, logins: map[string]*tenantBucket{}}
+	return nil
+}
+
+func (l *rateLimiter) limits(tenant string) tenantLimits {
+	if t, ok := l.cfg.Tenants[tenant]; ok {
+		return t
+	}
+	return l.cfg.Default
+}
+
+// requestTenant attributes r to a tenant without consuming it.
+func (l *rateLimiter) requestTenant(r *http.Request) string {
+	tenant := ""
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(bearer, agentTokenPrefix) {
+		if site, err := parseAgentToken(bearer, time.Now()); err == nil {
+			tenant = siteRegistry().lookup(site).Metadata["tenant"]
+		}
+	} else if _, _, ok := r.BasicAuth(); ok {
+		if p := apiPrincipal(r); p != nil && len(p.Tenants) > 0 {
+			tenant = p.Tenants[0]
+		}
+	} else if source, ok := strings.CutPrefix(r.URL.Path, "/webhooks/"); ok {
+		tenant = l.cfg.Sources[strings.Trim(source, "/")]
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	return tenant
+}
+
+// admit takes a request token from tenant's bucket, returning how long to
+// wait when there is none. It also rolls the daily ingestion volume over.
+func (l *rateLimiter) admit(tenant string, lim tenantLimits, now time.Time) (time.Duration, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[tenant]
+	if b == nil {
+		b = newBucket(lim, now)
+		l.buckets[tenant] = b
+	}
+	if day := now.UTC().Format("2006-01-02"); day != b.day {
+		b.day, b.ingest = day, 0
+	}
+	return b.take(lim, now), b.ingest
+}
+
+// admitLogin takes a token from the login bucket of the client at addr.
+// Buckets that have refilled are dropped, so idle clients cost nothing.
+func (l *rateLimiter) admitLogin(addr string, now time.Time) time.Duration {
+	lim := l.cfg.Default
+	if l.cfg.Logins != nil {
+		lim = *l.cfg.Logins
+	}
+	if lim.RequestsPerSecond <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if full := time.Duration(math.Max(float64(lim.Burst), 1) / lim.RequestsPerSecond * float64(time.Second)); now.Sub(l.pruned) > full {
+		for a, b := range l.logins {
+			if now.Sub(b.updated) > full {
+				delete(l.logins, a)
+			}
+		}
+		l.pruned = now
+	}
+	b := l.logins[addr]
+	if b == nil {
+		b = newBucket(lim, now)
+		l.logins[addr] = b
+	}
+	return b.take(lim, now)
+}
+
+// newBucket starts full, with at least the one token every request needs.
+func newBucket(lim tenantLimits, now time.Time) *tenantBucket {
+	return &tenantBucket{tokens: math.Max(float64(lim.Burst), 1), updated: now}
+}
+
+// take refills b for the time since its last use and takes one token,
+// returning how long to wait when there is none.
+func (b *tenantBucket) take(lim tenantLimits, now time.Time) time.Duration {
+	if lim.RequestsPerSecond <= 0 {
+		return 0
+	}
+	burst := math.Max(float64(lim.Burst), 1)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*lim.RequestsPerSecond)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / lim.RequestsPerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (l *rateLimiter) addIngest(tenant string, n int64, lim tenantLimits) {
+	l.mu.Lock()
+	b := l.buckets[tenant]
+	b.ingest += n
+	used := b.ingest
+	l.mu.Unlock()
+	apiIngestBytes.WithLabelValues(tenant).Add(float64(n))
+	if lim.IngestBytesPerDay > 0 {
+		apiIngestQuotaUsed.WithLabelValues(tenant).Set(float64(used) / float64(lim.IngestBytesPerDay))
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Wrap applies the limits in front of h; /metrics is never limited.
+func (l *rateLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			addr := clientAddr(r)
+			if wait := l.admitLogin(addr, time.Now()); wait > 0 {
+				apiLoginsLimited.Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many logins from "+addr, http.StatusTooManyRequests)
+				return
+			}
+		}
+		tenant := l.requestTenant(r)
+		lim := l.limits(tenant)
+		wait, ingested := l.admit(tenant, lim, time.Now())
+		if wait > 0 {
+			apiRequests.WithLabelValues(tenant, "rate_limited").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded for tenant "+tenant, http.StatusTooManyRequests)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/webhooks/") {
+			if lim.MaxBodyBytes > 0 && r.ContentLength > lim.MaxBodyBytes {
+				apiRequests.WithLabelValues(tenant, "too_large").Inc()
+				http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if lim.IngestBytesPerDay > 0 && ingested >= lim.IngestBytesPerDay {
+				apiRequests.WithLabelValues(tenant, "over_quota").Inc()
+				midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(midnight).Seconds())+1))
+				http.Error(w, "daily ingestion quota exhausted for tenant "+tenant, http.StatusTooManyRequests)
+				return
+			}
+			body := r.Body
+			if lim.MaxBodyBytes > 0 {
+				body = http.MaxBytesReader(w, body, lim.MaxBodyBytes)
+			}
+			counted := &countingReader{ReadCloser: body}
+			r.Body = counted
+			defer func() { l.addIngest(tenant, counted.n, lim) }()
+		}
+		apiRequests.WithLabelValues(tenant, "allowed").Inc()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAdmit(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		name string
+		lim  tenantLimits
+		at   []time.Duration // request times from now
+		want []bool          // admitted
+	}{
+		{"unlimited", tenantLimits{}, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+		{"burst then rate", tenantLimits{RequestsPerSecond: 1, Burst: 3},
+			[]time.Duration{0, 0, 0, 0, time.Second, time.Second}, []bool{true, true, true, false, true, false}},
+		{"no burst still lets the first through", tenantLimits{RequestsPerSecond: 0.5},
+			[]time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, true}},
+		{"refill caps at burst", tenantLimits{RequestsPerSecond: 10, Burst: 2},
+			[]time.Duration{time.Hour, time.Hour, time.Hour}, []bool{true, true, false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &rateLimiter{buckets: map[string]*tenantBucket{}}
+			for i, at := range tc.at {
+				wait, _ := l.admit("t", tc.lim, now.Add(at))
+				if (wait == 0) != tc.want[i] {
+					t.Fatalf("request %d at +%s: wait %s, want admitted=%v", i+1, at, wait, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Basic-auth requests are limited per client address before they get as
+// far as an LDAP bind.
+func TestRateLimiterLoginsBeforeAuth(t *testing.T) {
+	l := &rateLimiter{
+		cfg:     rateLimitsConfig{Default: tenantLimits{RequestsPerSecond: 100, Burst: 100}, Logins: &tenantLimits{RequestsPerSecond: 0.1, Burst: 2}},
+		buckets: map[string]*tenantBucket{},
+		logins:  map[string]*tenantBucket{},
+	}
+	served := 0
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }))
+	for _, tc := range []struct {
+		addr  string
+		basic bool
+		want  int
+	}{
+		{"10.0.0.1:5000", true, http.StatusOK},
+		{"10.0.0.1:5001", true, http.StatusOK},
+		{"10.0.0.1:5002", true, http.StatusTooManyRequests},
+		{"10.0.0.2:5000", true, http.StatusOK},
+		{"10.0.0.1:5003", false, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/sites", nil)
+		r.RemoteAddr = tc.addr
+		if tc.basic {
+			r.SetBasicAuth("alice", "guess")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s basic=%v: %d, want %d", tc.addr, tc.basic, w.Code, tc.want)
+		}
+	}
+	if served != 4 {
+		t.Errorf("served %d requests, want 4", served)
+	}
+}
+
+// Behind a standby every client arrives from the standby's address; the
+// leader limits by the address the standby names, and only trusts it from
+// a replica.
+func TestRateLimiterLoginsThroughStandby(t *testing.T) {
+	saved := coordinationDSN
+	t.Cleanup(func() { coordinationDSN = saved })
+	coordinationDSN = "postgres://dtms:secret@db/dtms"
+
+	l := &rateLimiter{
+		cfg:     rateLimitsConfig{Default: tenantLimits{RequestsPerSecond: 100, Burst: 100}, Logins: &tenantLimits{RequestsPerSecond: 0.1, Burst: 1}},
+		buckets: map[string]*tenantBucket{},
+		logins:  map[string]*tenantBucket{},
+	}
+	leader := httptest.NewServer(l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer leader.Close()
+	target, _ := url.Parse(leader.URL)
+	standby := leaderProxy(target)
+
+	for _, tc := range []struct {
+		name    string
+		via     string // standby or direct
+		client  string
+		headers map[string]string
+		want    int
+	}{
+		{"first client through the standby", "standby", "10.0.0.1:5000", nil, http.StatusOK},
+		{"second client is not the first's bucket", "standby", "10.0.0.2:5000", nil, http.StatusOK},
+		{"first client again is limited", "standby", "10.0.0.1:5001", nil, http.StatusTooManyRequests},
+		{"client cannot pick its address through the standby", "standby", "10.0.0.1:5002",
+			map[string]string{clientAddrHeader: "10.0.0.9"}, http.StatusTooManyRequests},
+		{"header without the token is ignored", "direct", "",
+			map[string]string{clientAddrHeader: "10.0.0.3"}, http.StatusOK},
+		{"so the direct caller's own bucket is used", "direct", "",
+			map[string]string{clientAddrHeader: "10.0.0.4"}, http.StatusTooManyRequests},
+		{"wrong token is ignored", "direct", "",
+			map[string]string{clientAddrHeader: "10.0.0.5", replicaTokenHeader: "guess"}, http.StatusTooManyRequests},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var code int
+			if tc.via == "standby" {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/sites", nil)
+				r.RemoteAddr = tc.client
+				r.SetBasicAuth("alice", "guess")
+				for k, v := range tc.headers {
+					r.Header.Set(k, v)
+				}
+				w := httptest.NewRecorder()
+				standby.ServeHTTP(w, r)
+				code = w.Code
+			} else {
+				r, _ := http.NewRequest(http.MethodGet, leader.URL+"/api/v1/sites", nil)
+				r.SetBasicAuth("alice", "guess")
+				for k, v := range tc.headers {
+					r.Header.Set(k, v)
+				}
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				code = resp.StatusCode
+			}
+			if code != tc.want {
+				t.Fatalf("%d, want %d", code, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// rcloneSource follows rclone sync jobs for one or both of:
+//
+//   - an rc server: finished jobs are mapped to sites through their job
+//     group, so jobs should be started with _group=<remote> (e.g. "site-a:")
+//   - JSON logs (--use-json-log), one file per site, tailed between polls
+//
+// A site's freshness is the end of its latest successful job or the time
+// of the latest file copied according to its log.
+type rcloneSource struct {
+	name   string
+	RCURL  string            `yaml:"rc_url"`
+	RCUser string            `yaml:"rc_user"`
+	RCPass string            `yaml:"rc_pass"`
+	Groups map[string]string `yaml:"groups"` // job group (remote) -> site
+	Logs   map[string]string `yaml:"logs"`   // site -> JSON log path
+
+	mu       sync.Mutex
+	seenJobs map[int64]bool
+	latest   map[string]time.Time
+	offsets  map[string]int64
+	logBytes map[string]float64
+}
+
+var (
+	rcloneBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_rclone_bytes_transferred_total", Help: "Bytes transferred by rclone jobs per site"},
+		[]string{"site"},
+	)
+	rcloneErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_rclone_errors_total", Help: "Errors reported by rclone jobs per site"},
+		[]string{"site"},
+	)
+	rcloneJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_rclone_jobs_total", Help: "Finished rclone jobs per site and outcome"},
+		[]string{"site", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rcloneBytes, rcloneErrors, rcloneJobs)
+	registerSource("rclone", func(name string, params *yaml.Node) (Source, error) {
+		s := &rcloneSource{name: name, seenJobs: map[int64]bool{}, latest: map[string]time.Time{}, offsets: map[string]int64{}, logBytes: map[string]float64{}}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.RCURL == "" && len(s.Logs) == 0 {
+			return nil, fmt.Errorf("rc_url or logs is required")
+		}
+		return s, nil
+	})
+}
+
+func (s *rcloneSource) Name() string { return s.name }
+
+func (s *rcloneSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	if s.RCURL != "" {
+		if err := s.collectJobs(ctx); err != nil {
+			firstErr = fmt.Errorf("rc: %w", err)
+		}
+	}
+	for site, path := range s.Logs {
+		if err := s.tailLog(site, path); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("log %s: %w", path, err)
+		}
+	}
+
+	now := time.Now()
+	out := make([]SiteFresh, 0, len(s.latest))
+	for site, t := range s.latest {
+		out = append(out, SiteFresh{Site: site, LatestTimestamp: float64(t.Unix()), AgeSeconds: now.Sub(t).Seconds()})
+	}
+	return out, firstErr
+}
+
+type rcloneJobStatus struct {
+	ID       int64  `json:"id"`
+	Group    string `json:"group"`
+	EndTime  string `json:"endTime"`
+	Finished bool   `json:"finished"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error"`
+}
+
+func (s *rcloneSource) collectJobs(ctx context.Context) error {
+	var list struct {
+		JobIDs []int64 `json:"jobids"`
+	}
+	if err := s.rc(ctx, "job/list", nil, &list); err != nil {
+		return err
+	}
+	for _, id := range list.JobIDs {
+		if s.seenJobs[id] {
+			continue
+		}
+		var st rcloneJobStatus
+		if err := s.rc(ctx, "job/status", map[string]interface{}{"jobid": id}, &st); err != nil {
+			return err
+		}
+		if !st.Finished {
+			continue
+		}
+		s.seenJobs[id] = true
+		site, ok := s.Groups[st.Group]
+		if !ok {
+			continue
+		}
+		var stats struct {
+			Bytes  float64 `json:"bytes"`
+			Errors float64 `json:"errors"`
+		}
+		if err := s.rc(ctx, "core/stats", map[string]interface{}{"group": st.Group}, &stats); err == nil {
+			rcloneBytes.WithLabelValues(site).Add(stats.Bytes)
+			rcloneErrors.WithLabelValues(site).Add(stats.Errors)
+		}
+		if !st.Success {
+			rcloneJobs.WithLabelValues(site, "failed").Inc()
+			continue
+		}
+		rcloneJobs.WithLabelValues(site, "success").Inc()
+		if end, err := parseTimestamp(st.EndTime); err == nil && end.After(s.latest[site]) {
+			s.latest[site] = end
+		}
+	}
+	return nil
+}
+
+func (s *rcloneSource) rc(ctx context.Context, method string, params, into interface{}) error {
+	body, _ := json.Marshal(params)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(s.RCURL, "/")+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.RCUser != "" {
+		req.SetBasicAuth(s.RCUser, s.RCPass)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+type rcloneLogLine struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	Time  string `json:"time"`
+	Stats *struct {
+		Bytes float64 `json:"bytes"`
+	} `json:"stats"`
+}
+
+// tailLog reads whatever was appended to path since the last poll. Stats
+// lines are cumulative per rclone run, so only their growth is counted; a
+// drop means a new run started.
+func (s *rcloneSource) tailLog(site, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	off := s.offsets[path]
+	if info.Size() < off {
+		// rotated or truncated
+		off = 0
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// keep a partial last line for the next poll
+			break
+		}
+		off += int64(len(line))
+		var l rcloneLogLine
+		if json.Unmarshal(line, &l) != nil {
+			continue
+		}
+		t, terr := parseTimestamp(l.Time)
+		switch {
+		case l.Level == "error":
+			rcloneErrors.WithLabelValues(site).Inc()
+		case strings.HasPrefix(l.Msg, "Copied") || strings.HasPrefix(l.Msg, "Moved"):
+			if terr == nil && t.After(s.latest[site]) {
+				s.latest[site] = t
+			}
+		}
+		if l.Stats != nil {
+			prev := s.logBytes[path]
+			if l.Stats.Bytes < prev {
+				prev = 0
+			}
+			rcloneBytes.WithLabelValues(site).Add(l.Stats.Bytes - prev)
+			s.logBytes[path] = l.Stats.Bytes
+		}
+	}
+	s.offsets[path] = off
+	return nil
+}
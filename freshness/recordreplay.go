@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -record DIR saves every upstream HTTP exchange the sources make (dtms-api,
+// the http, prometheus, rucio and other HTTP-based collectors) as numbered
+// JSON files in DIR. -replay DIR answers the same requests from those
+// files without touching the network: each method and URL gets its
+// recorded responses back in order, the last one repeating once they run
+// out, and requests never recorded fail. Together they reproduce a
+// production incident locally and turn it into fixtures. Non-HTTP sources
+// (Kafka, databases, exec) are not covered. Request headers are not kept
+// and Vault traffic is passed through unrecorded, but response bodies are
+// saved as received, so treat a recording like the data it came from.
+var (
+	recordDir = flag.String("record", "", "save upstream HTTP responses to this directory")
+	replayDir = flag.String("replay", "", "serve upstream HTTP responses recorded with -record from this directory")
+)
+
+type recordedExchange struct {
+	Seq      int         `json:"seq"`
+	At       time.Time   `json:"at"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	Error    string      `json:"error,omitempty"`
+	Duration float64     `json:"duration_seconds"`
+}
+
+func exchangeKey(method, url string) string { return method + " " + url }
+
+// recordSeq numbers exchanges across all recording transports.
+var recordSeq struct {
+	sync.Mutex
+	n int
+}
+
+// recordingTransport saves each exchange that passes through it.
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if vaultAddr != "" && strings.HasPrefix(req.URL.String(), strings.TrimRight(vaultAddr, "/")+"/") {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	ex := recordedExchange{At: start, Method: req.Method, URL: req.URL.String(), Duration: time.Since(start).Seconds()}
+	if err != nil {
+		ex.Error = err.Error()
+	} else {
+		body, rerr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		ex.Status, ex.Header, ex.Body = resp.StatusCode, resp.Header, body
+	}
+	recordSeq.Lock()
+	recordSeq.n++
+	ex.Seq = recordSeq.n
+	recordSeq.Unlock()
+	sum := sha256.Sum256([]byte(exchangeKey(ex.Method, ex.URL)))
+	raw, _ := json.MarshalIndent(ex, "", "  ")
+	name := fmt.Sprintf("%06d-%s.json", ex.Seq, hex.EncodeToString(sum[:4]))
+	if werr := writeFileAtomic(filepath.Join(t.dir, name), raw); werr != nil {
+		fmt.Printf("[record] %v\n", werr)
+	}
+	return resp, err
+}
+
+// replayTransport answers requests from a recording.
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]recordedExchange
+	next      map[string]int
+}
+
+func loadReplay(dir string) (*replayTransport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	t := &replayTransport{exchanges: map[string][]recordedExchange{}, next: map[string]int{}}
+	var all []recordedExchange
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var ex recordedExchange
+		if err := json.Unmarshal(raw, &ex); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		all = append(all, ex)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("no recorded exchanges in %s", dir)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Seq < all[j].Seq })
+	for _, ex := range all {
+		k := exchangeKey(ex.Method, ex.URL)
+		t.exchanges[k] = append(t.exchanges[k], ex)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	k := exchangeKey(req.Method, req.URL.String())
+	t.mu.Lock()
+	list := t.exchanges[k]
+	i := t.next[k]
+	if i < len(list)-1 {
+		t.next[k] = i + 1
+	}
+	t.mu.Unlock()
+	if len(list) == 0 {
+		return nil, fmt.Errorf("replay: no recording for %s", k)
+	}
+	ex := list[i]
+	if ex.Error != "" {
+		return nil, fmt.Errorf("replay: %s", ex.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.Header,
+		Body:          io.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: int64(len(ex.Body)),
+		Request:       req,
+	}, nil
+}
+
+// upstreamTransport is what outbound clients should use: next, or the
+// recorder or replayer around it when one is enabled.
+var upstreamTransport = func(next http.RoundTripper) http.RoundTripper { return next }
+
+// setupRecordReplay installs -record or -replay on the shared client.
+func setupRecordReplay() error {
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		return fmt.Errorf("-record and -replay are exclusive")
+	case *recordDir != "":
+		if err := os.MkdirAll(*recordDir, 0o755); err != nil {
+			return err
+		}
+		// continue numbering after an earlier recording in the same place
+		existing, _ := filepath.Glob(filepath.Join(*recordDir, "*.json"))
+		recordSeq.n = len(existing)
+		upstreamTransport = func(next http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: next, dir: *recordDir}
+		}
+		fmt.Printf("[record] saving upstream responses to %s\n", *recordDir)
+	case *replayDir != "":
+		rt, err := loadReplay(*replayDir)
+		if err != nil {
+			return err
+		}
+		upstreamTransport = func(http.RoundTripper) http.RoundTripper { return rt }
+		fmt.Printf("[replay] serving upstream responses for %d requests from %s\n", len(rt.exchanges), *replayDir)
+	default:
+		return nil
+	}
+	client.Transport = upstreamTransport(sharedTransport)
+	return nil
+}
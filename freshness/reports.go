@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// REPORTS_CONFIG schedules per-tenant SLA reports:
+//
+//	period: weekly          # or monthly
+//	hour: 6                 # UTC hour after the period closes to send
+//	upload: {endpoint: https://s3.example.org, bucket: dtms-reports, prefix: sla/}
+//	tenants:
+//	  - name: cms
+//	    tags: tenant=cms,!decommissioned
+//	    group_by: region
+//	    email: [cms-ops@example.org]
+//	    formats: [html, pdf]
+//	    upload: true
+//
+// A tenant covers its listed sites, or those its tag selector (or the
+// older site_metadata map) picks out; vo: NAME narrows any of these to the
+// sites serving that VO (vos.go). group_by adds a table rolling the
+// sites up by one tag. `subject` (the mail subject) and `intro` (HTML
+// put above the tables) are templates over the report (templates.go),
+// set at the top for every tenant or per tenant.
+// Weekly periods run Monday to Monday, monthly ones calendar month to
+// month, both UTC. Mail goes through SMTP_ADDR as SMTP_FROM, with
+// SMTP_USERNAME/SMTP_PASSWORD when set. The same reports render on demand
+// from GET /api/v1/reports/sla.
+var (
+	reportsConfigPath = envOr("REPORTS_CONFIG", "")
+	reportsStatePath  = envOr("REPORTS_STATE", filepath.Join(dataDir, "reports-state.json"))
+	smtpAddr          = envOr("SMTP_ADDR", "")
+	smtpFrom          = envOr("SMTP_FROM", "dtms@localhost")
+	smtpUsername      = envOr("SMTP_USERNAME", "")
+	smtpPassword      = envOr("SMTP_PASSWORD", "")
+)
+
+// reportTopN bounds the worst-incident and top-stale tables.
+const reportTopN = 5
+
+type reportTenant struct {
+	Name         string            `yaml:"name"`
+	Sites        []string          `yaml:"sites"`
+	SiteMetadata map[string]string `yaml:"site_metadata"`
+	Tags         string            `yaml:"tags"`
+	VO           string            `yaml:"vo"`
+	GroupBy      string            `yaml:"group_by"`
+	Email        []string          `yaml:"email"`
+	Formats      []string          `yaml:"formats"`
+	Upload       bool              `yaml:"upload"`
+	Subject      string            `yaml:"subject"`
+	Intro        string            `yaml:"intro"`
+
+	sel     tagSelector
+	subject *texttemplate.Template
+	intro   *template.Template
+}
+
+// annotate renders the tenant's subject and intro into r.
+func (t reportTenant) annotate(r *SLAReport) error {
+	data := reportMessage(*r)
+	if t.subject != nil {
+		s, err := renderTemplate(t.subject, data)
+		if err != nil {
+			return fmt.Errorf("subject: %w", err)
+		}
+		r.Subject = strings.TrimSpace(s)
+	}
+	if t.intro != nil {
+		s, err := renderTemplate(t.intro, data)
+		if err != nil {
+			return fmt.Errorf("intro: %w", err)
+		}
+		r.Intro = template.HTML(s)
+	}
+	return nil
+}
+
+func (t reportTenant) sites() []string {
+	var sites []string
+	switch {
+	case len(t.sel) > 0:
+		return siteRegistry().sitesSelected(t.sel)
+	case len(t.SiteMetadata) > 0:
+		sites = siteRegistry().sitesMatching(t.SiteMetadata)
+	default:
+		sites = t.Sites
+	}
+	if t.VO == "" {
+		return sites
+	}
+	out := []string{}
+	for _, s := range sites {
+		if hasVO(siteRegistry().lookup(s).Metadata[voTagKey], t.VO) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+type reportUpload struct {
+	s3Settings `yaml:",inline"`
+	Bucket     string `yaml:"bucket"`
+	Prefix     string `yaml:"prefix"`
+}
+
+type reportsConfig struct {
+	Period  string         `yaml:"period"`
+	Hour    int            `yaml:"hour"`
+	Upload  *reportUpload  `yaml:"upload"`
+	Subject string         `yaml:"subject"`
+	Intro   string         `yaml:"intro"`
+	Tenants []reportTenant `yaml:"tenants"`
+}
+
+var reports = &reportsConfig{Period: "weekly"}
+
+func loadReports() error {
+	if reportsConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(reportsConfigPath)
+	if err != nil {
+		return err
+	}
+	c := reportsConfig{Period: "weekly", Hour: 6}
+	if err := yamlenv.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("%s: %w", reportsConfigPath, err)
+	}
+	if c.Period != "weekly" && c.Period != "monthly" {
+		return fmt.Errorf("%s: period must be weekly or monthly", reportsConfigPath)
+	}
+	if c.Upload != nil && c.Upload.Endpoint == "" {
+		bucket, prefix := c.Upload.Bucket, c.Upload.Prefix
+		c.Upload.s3Settings = s3SettingsFromEnv()
+		c.Upload.Bucket, c.Upload.Prefix = bucket, prefix
+	}
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if t.Name == "" {
+			return fmt.Errorf("%s: tenant without a name", reportsConfigPath)
+		}
+		if len(t.Formats) == 0 {
+			t.Formats = []string{"html"}
+		}
+		if t.sel, err = parseTagSelector(t.Tags); err != nil {
+			return fmt.Errorf("%s: tenant %s: %w", reportsConfigPath, t.Name, err)
+		}
+		if t.VO != "" && len(t.sel) > 0 {
+			t.sel = append(t.sel, tagTerm{key: voTagKey, value: t.VO})
+		}
+		if t.Subject == "" {
+			t.Subject = c.Subject
+		}
+		if t.Intro == "" {
+			t.Intro = c.Intro
+		}
+		if t.Subject != "" {
+			if t.subject, err = parseMessageTemplate(t.Name+" subject", t.Subject); err != nil {
+				return fmt.Errorf("%s: tenant %s: %w", reportsConfigPath, t.Name, err)
+			}
+		}
+		if t.Intro != "" {
+			if t.intro, err = parseHTMLTemplate(t.Name+" intro", t.Intro); err != nil {
+				return fmt.Errorf("%s: tenant %s: %w", reportsConfigPath, t.Name, err)
+			}
+		}
+	}
+	reports = &c
+	return nil
+}
+
+func (c *reportsConfig) tenant(name string) (reportTenant, bool) {
+	for _, t := range c.Tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return reportTenant{}, false
+}
+
+// periodBounds returns the last complete period ending at or before t.
+func periodBounds(period string, t time.Time) (from, to time.Time) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if period == "monthly" {
+		to = monthStart(t)
+		return to.AddDate(0, -1, 0), to
+	}
+	to = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	return to.AddDate(0, 0, -7), to
+}
+
+type siteAvailability struct {
+	Site         string  `json:"site"`
+	Availability float64 `json:"availability"`
+	Previous     float64 `json:"previous_availability,omitempty"`
+	Trend        float64 `json:"trend"`
+	Objective    float64 `json:"objective,omitempty"`
+	Met          bool    `json:"met"`
+	StaleSeconds float64 `json:"stale_seconds"`
+	MaxAge       float64 `json:"max_age_seconds"`
+	Incidents    int     `json:"incidents"`
+	Maintenance  float64 `json:"maintenance_seconds"`
+}
+
+// groupAvailability rolls a report's sites up by the value of one tag.
+type groupAvailability struct {
+	Group        string  `json:"group"`
+	Sites        int     `json:"sites"`
+	Availability float64 `json:"availability"`
+	Missed       int     `json:"missed_objective"`
+	StaleSeconds float64 `json:"stale_seconds"`
+	Incidents    int     `json:"incidents"`
+}
+
+// SLAReport is one tenant's report for one period.
+type SLAReport struct {
+	Tenant         string              `json:"tenant"`
+	Period         string              `json:"period"`
+	From           time.Time           `json:"from"`
+	To             time.Time           `json:"to"`
+	Generated      time.Time           `json:"generated"`
+	Availability   float64             `json:"availability"`
+	Sites          []siteAvailability  `json:"sites"`
+	GroupBy        string              `json:"group_by,omitempty"`
+	Groups         []groupAvailability `json:"groups,omitempty"`
+	WorstIncidents []Incident          `json:"worst_incidents"`
+	TopStale       []siteAvailability  `json:"top_stale"`
+
+	// from the tenant's templates
+	Subject string        `json:"-"`
+	Intro   template.HTML `json:"-"`
+}
+
+type siteSamples struct {
+	ok, total   int
+	first, last float64
+	maxAge      float64
+}
+
+// availability is the fraction of ok samples.
+func (s siteSamples) availability() float64 { return float64(s.ok) / float64(s.total) }
+
+// staleSeconds spreads the not-ok fraction over the span the samples
+// cover, so a site added mid-period is not charged for before it existed.
+func (s siteSamples) staleSeconds() float64 {
+	return (1 - s.availability()) * (s.last - s.first)
+}
+
+// reportMaintenance caches each site's downtime windows over a span.
+// Samples inside one are left out of the SLA: a declared maintenance does
+// not count against the site.
+type reportMaintenance struct {
+	from, to time.Time
+	bySite   map[string][]downtimeWindow
+}
+
+func newReportMaintenance(from, to time.Time) *reportMaintenance {
+	return &reportMaintenance{from: from, to: to, bySite: map[string][]downtimeWindow{}}
+}
+
+func (m *reportMaintenance) windows(site string) []downtimeWindow {
+	ws, ok := m.bySite[site]
+	if !ok {
+		ws = downtimes.Overlapping(site, m.from, m.to)
+		sort.Slice(ws, func(i, j int) bool { return ws[i].Start.Before(ws[j].Start) })
+		m.bySite[site] = ws
+	}
+	return ws
+}
+
+func (m *reportMaintenance) covers(site string, ts float64) bool {
+	t := unixTime(ts)
+	for _, w := range m.windows(site) {
+		if !t.Before(w.Start) && t.Before(w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// seconds is the time site spent in downtime within the span, overlapping
+// windows counted once.
+func (m *reportMaintenance) seconds(site string) float64 {
+	var total time.Duration
+	var covered time.Time
+	for _, w := range m.windows(site) {
+		start, end := w.Start, w.End
+		if start.Before(m.from) {
+			start = m.from
+		}
+		if end.After(m.to) {
+			end = m.to
+		}
+		if start.Before(covered) {
+			start = covered
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+			covered = end
+		}
+	}
+	return total.Seconds()
+}
+
+func summarizeSamples(samples []HistorySample, maint *reportMaintenance) map[string]*siteSamples {
+	out := map[string]*siteSamples{}
+	for _, h := range samples {
+		if maint.covers(h.Site, h.Timestamp) {
+			continue
+		}
+		s := out[h.Site]
+		if s == nil {
+			s = &siteSamples{first: h.Timestamp}
+			out[h.Site] = s
+		}
+		s.total++
+		if h.Ok {
+			s.ok++
+		}
+		s.last = h.Timestamp
+		if h.AgeSeconds > s.maxAge {
+			s.maxAge = h.AgeSeconds
+		}
+	}
+	return out
+}
+
+func buildSLAReport(tenant reportTenant, period string, from, to time.Time) (SLAReport, error) {
+	r := SLAReport{Tenant: tenant.Name, Period: period, From: from, To: to, Generated: time.Now().UTC()}
+	samples, err := history.Query("", from, to.Add(-time.Second))
+	if err != nil {
+		return r, err
+	}
+	prevFrom := from.Add(-to.Sub(from))
+	if period == "monthly" {
+		prevFrom = from.AddDate(0, -1, 0)
+	}
+	prevSamples, err := history.Query("", prevFrom, from.Add(-time.Second))
+	if err != nil {
+		return r, err
+	}
+	maint := newReportMaintenance(from, to)
+	cur := summarizeSamples(samples, maint)
+	prev := summarizeSamples(prevSamples, newReportMaintenance(prevFrom, from))
+
+	sites := tenant.sites()
+	if len(sites) == 0 {
+		for site := range cur {
+			sites = append(sites, site)
+		}
+	}
+	sort.Strings(sites)
+	var sum float64
+	for _, site := range sites {
+		c, seen := cur[site]
+		if !seen {
+			continue
+		}
+		a := c.availability()
+		sa := siteAvailability{Site: site, Availability: a, MaxAge: c.maxAge, StaleSeconds: c.staleSeconds(), Maintenance: maint.seconds(site), Met: true}
+		if p, ok := prev[site]; ok {
+			sa.Previous = p.availability()
+			sa.Trend = a - sa.Previous
+		}
+		if slo := siteRegistry().lookup(site).SLO; slo != nil {
+			sa.Objective, sa.Met = slo.Objective, a >= slo.Objective
+		}
+		for _, inc := range incidents.List(site, "", float64(from.Unix()), float64(to.Unix())) {
+			sa.Incidents++
+			r.WorstIncidents = append(r.WorstIncidents, inc)
+		}
+		r.Sites = append(r.Sites, sa)
+		sum += a
+	}
+	if len(r.Sites) > 0 {
+		r.Availability = sum / float64(len(r.Sites))
+	}
+	if tenant.GroupBy != "" {
+		r.GroupBy, r.Groups = tenant.GroupBy, groupSiteAvailability(r.Sites, tenant.GroupBy)
+	}
+	sort.Slice(r.WorstIncidents, func(i, j int) bool { return r.WorstIncidents[i].Duration > r.WorstIncidents[j].Duration })
+	if len(r.WorstIncidents) > reportTopN {
+		r.WorstIncidents = r.WorstIncidents[:reportTopN]
+	}
+	r.TopStale = append([]siteAvailability(nil), r.Sites...)
+	sort.SliceStable(r.TopStale, func(i, j int) bool { return r.TopStale[i].StaleSeconds > r.TopStale[j].StaleSeconds })
+	for len(r.TopStale) > 0 && r.TopStale[len(r.TopStale)-1].StaleSeconds == 0 {
+		r.TopStale = r.TopStale[:len(r.TopStale)-1]
+	}
+	if len(r.TopStale) > reportTopN {
+		r.TopStale = r.TopStale[:reportTopN]
+	}
+	return r, nil
+}
+
+// groupSiteAvailability averages sites by their value of tag; sites
+// without it are grouped under "(none)".
+func groupSiteAvailability(sites []siteAvailability, tag string) []groupAvailability {
+	byGroup := map[string]*groupAvailability{}
+	var order []string
+	for _, s := range sites {
+		name := siteRegistry().lookup(s.Site).Metadata[tag]
+		if name == "" {
+			name = "(none)"
+		}
+		g := byGroup[name]
+		if g == nil {
+			g = &groupAvailability{Group: name}
+			byGroup[name] = g
+			order = append(order, name)
+		}
+		g.Sites++
+		g.Availability += s.Availability
+		g.StaleSeconds += s.StaleSeconds
+		g.Incidents += s.Incidents
+		if !s.Met {
+			g.Missed++
+		}
+	}
+	sort.Strings(order)
+	out := make([]groupAvailability, 0, len(order))
+	for _, name := range order {
+		g := byGroup[name]
+		g.Availability /= float64(g.Sites)
+		out = append(out, *g)
+	}
+	return out
+}
+
+func pct(v float64) string { return fmt.Sprintf("%.2f%%", 100*v) }
+
+func signedPct(v float64) string { return fmt.Sprintf("%+.2f pp", 100*v) }
+
+func humanSeconds(v float64) string { return (time.Duration(v) * time.Second).String() }
+
+func reportDate(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
+func reportTime(ts float64) string { return unixTime(ts).Format("2006-01-02 15:04") }
+
+var reportFuncs = template.FuncMap{"pct": pct, "signedPct": signedPct, "duration": humanSeconds, "date": reportDate, "time": reportTime}
+
+var slaReportHTML = template.Must(template.New("sla").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>DTMS SLA report – {{.Tenant}}</title>
+<style>
+body{font-family:sans-serif;margin:2em;color:#222}
+table{border-collapse:collapse;margin-bottom:2em}
+th,td{border:1px solid #ccc;padding:4px 8px;text-align:right}
+th:first-child,td:first-child{text-align:left}
+.miss{color:#b00}
+</style></head><body>
+<h1>Data freshness SLA – {{.Tenant}}</h1>
+{{with .Intro}}<div class="intro">{{.}}</div>
+{{end}}<p>{{.Period}} report for {{date .From}} to {{date .To}}. Overall availability {{pct .Availability}}.</p>
+<h2>Availability</h2>
+<table><tr><th>Site</th><th>Availability</th><th>Objective</th><th>Trend</th><th>Stale for</th><th>Max age</th><th>Incidents</th><th>Maintenance</th></tr>
+{{range .Sites}}<tr{{if not .Met}} class="miss"{{end}}><td>{{.Site}}</td><td>{{pct .Availability}}</td><td>{{if .Objective}}{{pct .Objective}}{{else}}–{{end}}</td><td>{{signedPct .Trend}}</td><td>{{duration .StaleSeconds}}</td><td>{{duration .MaxAge}}</td><td>{{.Incidents}}</td><td>{{duration .Maintenance}}</td></tr>
+{{end}}</table>
+{{if .Groups}}<h2>By {{.GroupBy}}</h2>
+<table><tr><th>{{.GroupBy}}</th><th>Sites</th><th>Availability</th><th>Missed objective</th><th>Stale for</th><th>Incidents</th></tr>
+{{range .Groups}}<tr><td>{{.Group}}</td><td>{{.Sites}}</td><td>{{pct .Availability}}</td><td>{{.Missed}}</td><td>{{duration .StaleSeconds}}</td><td>{{.Incidents}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Worst incidents</h2>
+{{if .WorstIncidents}}<table><tr><th>Site</th><th>Start</th><th>Duration</th><th>Max age</th><th>Cause</th><th>Resolution</th></tr>
+{{range .WorstIncidents}}<tr><td>{{.Site}}</td><td>{{time .Start}}</td><td>{{duration .Duration}}</td><td>{{duration .MaxAge}}</td><td>{{.ProbableCause}}</td><td>{{.Resolution}}</td></tr>
+{{end}}</table>{{else}}<p>No incidents.</p>{{end}}
+<h2>Top stale sites</h2>
+{{if .TopStale}}<table><tr><th>Site</th><th>Stale for</th><th>Availability</th></tr>
+{{range .TopStale}}<tr><td>{{.Site}}</td><td>{{duration .StaleSeconds}}</td><td>{{pct .Availability}}</td></tr>
+{{end}}</table>{{else}}<p>No site was stale.</p>{{end}}
+<p><small>Generated {{.Generated.Format "2006-01-02 15:04 MST"}}</small></p>
+</body></html>
+`))
+
+func (r SLAReport) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	err := slaReportHTML.Execute(&buf, r)
+	return buf.Bytes(), err
+}
+
+func (r SLAReport) PDF() ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, tr("Data freshness SLA - "+r.Tenant))
+	pdf.Ln(10)
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.Cell(0, 6, tr(fmt.Sprintf("%s report for %s to %s. Overall availability %s.", r.Period, reportDate(r.From), reportDate(r.To), pct(r.Availability))))
+	pdf.Ln(10)
+
+	table := func(title string, header []string, widths []float64, rows [][]string) {
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.Cell(0, 8, title)
+		pdf.Ln(8)
+		if len(rows) == 0 {
+			pdf.SetFont("Helvetica", "", 10)
+			pdf.Cell(0, 6, "None.")
+			pdf.Ln(10)
+			return
+		}
+		pdf.SetFont("Helvetica", "B", 9)
+		for i, h := range header {
+			pdf.CellFormat(widths[i], 6, h, "1", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+		for _, row := range rows {
+			for i, c := range row {
+				pdf.CellFormat(widths[i], 6, tr(c), "1", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+		pdf.Ln(6)
+	}
+
+	var rows [][]string
+	for _, s := range r.Sites {
+		obj := "-"
+		if s.Objective > 0 {
+			obj = pct(s.Objective)
+		}
+		rows = append(rows, []string{s.Site, pct(s.Availability), obj, signedPct(s.Trend), humanSeconds(s.StaleSeconds), humanSeconds(s.MaxAge), fmt.Sprint(s.Incidents), humanSeconds(s.Maintenance)})
+	}
+	table("Availability", []string{"Site", "Availability", "Objective", "Trend", "Stale for", "Max age", "Incidents", "Maintenance"},
+		[]float64{34, 24, 20, 20, 25, 25, 16, 26}, rows)
+
+	if len(r.Groups) > 0 {
+		rows = nil
+		for _, g := range r.Groups {
+			rows = append(rows, []string{g.Group, fmt.Sprint(g.Sites), pct(g.Availability), fmt.Sprint(g.Missed), humanSeconds(g.StaleSeconds), fmt.Sprint(g.Incidents)})
+		}
+		table("By "+r.GroupBy, []string{r.GroupBy, "Sites", "Availability", "Missed objective", "Stale for", "Incidents"},
+			[]float64{40, 18, 25, 30, 30, 20}, rows)
+	}
+
+	rows = nil
+	for _, inc := range r.WorstIncidents {
+		rows = append(rows, []string{inc.Site, reportTime(inc.Start), humanSeconds(inc.Duration), humanSeconds(inc.MaxAge), inc.ProbableCause, inc.Resolution})
+	}
+	table("Worst incidents", []string{"Site", "Start", "Duration", "Max age", "Cause", "Resolution"},
+		[]float64{35, 32, 28, 28, 22, 45}, rows)
+
+	rows = nil
+	for _, s := range r.TopStale {
+		rows = append(rows, []string{s.Site, humanSeconds(s.StaleSeconds), pct(s.Availability)})
+	}
+	table("Top stale sites", []string{"Site", "Stale for", "Availability"}, []float64{60, 40, 30}, rows)
+
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	return buf.Bytes(), err
+}
+
+// render returns the report in format with its content type.
+func (r SLAReport) render(format string) ([]byte, string, error) {
+	switch format {
+	case "pdf":
+		b, err := r.PDF()
+		return b, "application/pdf", err
+	case "json":
+		b, err := json.Marshal(r)
+		return b, "application/json", err
+	}
+	b, err := r.HTML()
+	return b, "text/html; charset=utf-8", err
+}
+
+func (r SLAReport) fileName(format string) string {
+	return fmt.Sprintf("dtms-sla-%s-%s-%s.%s", unsafeFileChars.ReplaceAllString(r.Tenant, "_"), r.Period, reportDate(r.From), format)
+}
+
+// sendReport mails the rendered report: the HTML as the body when there is
+// one, every format as an attachment.
+func sendReport(to []string, r SLAReport, files map[string][]byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	subject := r.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("DTMS %s SLA report for %s, %s", r.Period, r.Tenant, reportDate(r.From))
+	}
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		smtpFrom, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", subject), mw.Boundary())
+	text := fmt.Sprintf("Overall availability %s for %s to %s.\r\n", pct(r.Availability), reportDate(r.From), reportDate(r.To))
+	ctype := "text/plain; charset=utf-8"
+	if html, ok := files["html"]; ok {
+		text, ctype = string(html), "text/html; charset=utf-8"
+	}
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {ctype}})
+	part.Write([]byte(text))
+	for format, b := range files {
+		_, ct, _ := SLAReport{}.render(format)
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {ct},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", r.fileName(format))},
+		})
+		enc := base64.NewEncoder(base64.StdEncoding, part)
+		enc.Write(b)
+		enc.Close()
+	}
+	mw.Close()
+
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host := smtpAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, to, body.Bytes())
+}
+
+// deliver renders and ships one tenant's report.
+func (c *reportsConfig) deliver(ctx context.Context, t reportTenant, from, to time.Time) error {
+	r, err := buildSLAReport(t, c.Period, from, to)
+	if err != nil {
+		return err
+	}
+	if err := t.annotate(&r); err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	for _, format := range t.Formats {
+		b, _, err := r.render(format)
+		if err != nil {
+			return fmt.Errorf("render %s: %w", format, err)
+		}
+		files[format] = b
+	}
+	if t.Upload && c.Upload != nil {
+		for format, b := range files {
+			_, ct, _ := r.render(format)
+			key := c.Upload.Prefix + r.fileName(format)
+			if err := c.Upload.put(ctx, c.Upload.Bucket, key, ct, b); err != nil {
+				return err
+			}
+		}
+	}
+	if len(t.Email) > 0 {
+		if smtpAddr == "" {
+			return fmt.Errorf("email requested but SMTP_ADDR is not set")
+		}
+		if err := sendReport(t.Email, r, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportsState remembers the last period delivered per tenant.
+type reportsState struct {
+	mu   sync.Mutex
+	Sent map[string]time.Time `json:"sent"`
+}
+
+// loop delivers each tenant's report once its period has closed and the
+// configured hour has passed.
+func (c *reportsConfig) loop(ctx context.Context) {
+	state := &reportsState{Sent: map[string]time.Time{}}
+	if raw, err := os.ReadFile(reportsStatePath); err == nil {
+		json.Unmarshal(raw, state)
+	}
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+	for {
+		now := time.Now().UTC()
+		from, to := periodBounds(c.Period, now)
+		if now.Sub(to) >= time.Duration(c.Hour)*time.Hour {
+			for _, tenant := range c.Tenants {
+				if !state.Sent[tenant.Name].Before(to) {
+					continue
+				}
+				if err := c.deliver(ctx, tenant, from, to); err != nil {
+					fmt.Printf("[reports] tenant=%s: %v\n", tenant.Name, err)
+					continue
+				}
+				fmt.Printf("[reports] delivered %s report for tenant=%s %s\n", c.Period, tenant.Name, reportDate(from))
+				state.mu.Lock()
+				state.Sent[tenant.Name] = to
+				raw, _ := json.Marshal(state)
+				state.mu.Unlock()
+				if err := writeFileAtomic(reportsStatePath, raw); err != nil {
+					fmt.Printf("[reports] save state: %v\n", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleSLAReport serves GET /api/v1/reports/sla?tenant=&period=&end=&format=,
+// rendering the period that ended at or before end (unix seconds, default
+// now) as html, pdf or json. A tenant not in REPORTS_CONFIG covers the
+// configured sites ?tags= selects, or with no selector every site with
+// history. ?group_by= overrides the tenant's grouping tag.
+func handleSLAReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = reports.Period
+	}
+	if period != "weekly" && period != "monthly" {
+		http.Error(w, "period must be weekly or monthly", http.StatusBadRequest)
+		return
+	}
+	tenant, ok := reports.tenant(q.Get("tenant"))
+	if !ok {
+		tenant = reportTenant{Name: q.Get("tenant")}
+		if tenant.Name == "" {
+			tenant.Name = "all"
+		}
+		sel, err := queryTags(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tenant.sel = sel
+	}
+	if g := q.Get("group_by"); g != "" {
+		tenant.GroupBy = g
+	}
+	from, to := periodBounds(period, time.Unix(int64(queryInt(r, "end", int(time.Now().Unix()))), 0))
+	report, err := buildSLAReport(tenant, period, from, to)
+	if err == nil {
+		err = tenant.annotate(&report)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	format := q.Get("format")
+	b, ct, err := report.render(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	if format == "pdf" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", report.fileName("pdf")))
+	}
+	w.Write(b)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// RETRY_POLICIES_CONFIG lists the policies applied when a worker reports a
+// transfer request as failed. The first policy whose match patterns all
+// match the request's fields governs it; without a match the request fails
+// for good:
+//
+//	policies:
+//	  - name: raw-data
+//	    match: {dataset: ^raw-, destination: ^SITE_}
+//	    max_attempts: 5
+//	    backoff: 5m
+//	    backoff_factor: 2
+//	    max_backoff: 2h
+//	    alternate_sources: true
+//	    give_up_on: [auth, quota]
+//	    give_up_after: 24h
+//
+// give_up_on names failure classes (see FAILURE_CLASSES_CONFIG) that no
+// retry can fix. With alternate_sources the retry is sourced from another
+// site holding the dataset, freshest first, before sources are reused.
+var retryPoliciesPath = envOr("RETRY_POLICIES_CONFIG", "")
+
+type retryPolicy struct {
+	Name             string            `yaml:"name"`
+	Match            map[string]string `yaml:"match"`
+	MaxAttempts      int               `yaml:"max_attempts"`
+	Backoff          time.Duration     `yaml:"backoff"`
+	BackoffFactor    float64           `yaml:"backoff_factor"`
+	MaxBackoff       time.Duration     `yaml:"max_backoff"`
+	AlternateSources bool              `yaml:"alternate_sources"`
+	GiveUpOn         []string          `yaml:"give_up_on"`
+	GiveUpAfter      time.Duration     `yaml:"give_up_after"`
+
+	match map[string]*regexp.Regexp
+}
+
+var retryPolicies []retryPolicy
+
+var retryOutcomes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_retry_policy_outcomes_total", Help: "Failed transfer request handling by retry policy and outcome (retried, gave_up, exhausted, recovered)"},
+	[]string{"policy", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(retryOutcomes)
+}
+
+func loadRetryPolicies() error {
+	if retryPoliciesPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(retryPoliciesPath)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Policies []retryPolicy `yaml:"policies"`
+	}
+	if err := yamlenv.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("%s: %w", retryPoliciesPath, err)
+	}
+	for i := range f.Policies {
+		p := &f.Policies[i]
+		if p.Name == "" || p.MaxAttempts < 1 {
+			return fmt.Errorf("%s: policies need a name and max_attempts", retryPoliciesPath)
+		}
+		if p.BackoffFactor < 1 {
+			p.BackoffFactor = 1
+		}
+		p.match = map[string]*regexp.Regexp{}
+		for field, pattern := range p.Match {
+			switch field {
+			case "dataset", "source", "destination":
+			default:
+				return fmt.Errorf("%s: policy %s: cannot match on %q", retryPoliciesPath, p.Name, field)
+			}
+			if p.match[field], err = regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%s: policy %s: %w", retryPoliciesPath, p.Name, err)
+			}
+		}
+	}
+	retryPolicies = f.Policies
+	return nil
+}
+
+func policyFor(r *TransferRequest) *retryPolicy {
+	fields := map[string]string{"dataset": r.Dataset, "source": r.Source, "destination": r.Destination}
+	for i := range retryPolicies {
+		p := &retryPolicies[i]
+		matched := true
+		for field, re := range p.match {
+			if !re.MatchString(fields[field]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return p
+		}
+	}
+	return nil
+}
+
+// retryDecision is what the policy decided for one failed attempt.
+type retryDecision struct {
+	policy  string
+	outcome string
+	retry   bool
+	delay   time.Duration
+	source  string
+	message string
+}
+
+// decideRetry applies r's policy to its failed attempt with error msg.
+func decideRetry(r *TransferRequest, msg string, now time.Time) retryDecision {
+	p := policyFor(r)
+	if p == nil {
+		return retryDecision{policy: "none", outcome: "gave_up", message: "no retry policy"}
+	}
+	d := retryDecision{policy: p.Name, outcome: "gave_up"}
+	class := classifyFailure(msg)
+	for _, c := range p.GiveUpOn {
+		if c == class {
+			d.message = fmt.Sprintf("gave up: %s failures are not retried", class)
+			return d
+		}
+	}
+	if r.Attempts >= p.MaxAttempts {
+		d.outcome = "exhausted"
+		d.message = fmt.Sprintf("gave up after %d attempts", r.Attempts)
+		return d
+	}
+	delay := p.Backoff
+	for i := 1; i < r.Attempts; i++ {
+		delay = time.Duration(float64(delay) * p.BackoffFactor)
+		if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+			break
+		}
+	}
+	if p.GiveUpAfter > 0 && now.Add(delay).Sub(unixTime(r.Created)) > p.GiveUpAfter {
+		d.message = fmt.Sprintf("gave up: would retry past %s", p.GiveUpAfter)
+		return d
+	}
+	d.outcome, d.retry, d.delay, d.source = "retried", true, delay, r.Source
+	if p.AlternateSources {
+		d.source = alternateSource(r)
+	}
+	d.message = fmt.Sprintf("retry %d/%d from %s in %s (policy %s)", r.Attempts+1, p.MaxAttempts, d.source, delay, p.Name)
+	return d
+}
+
+// alternateSource picks the freshest site holding r's dataset that has not
+// been tried yet, or the least recently tried one once all have been.
+func alternateSource(r *TransferRequest) string {
+	tried := map[string]int{}
+	for i, s := range r.TriedSources {
+		tried[s] = i + 1
+	}
+	best, bestTried, bestLatest := r.Source, math.MaxInt, 0.0
+	for site, a := range lineage.Placements()[r.Dataset] {
+		if site == r.Destination {
+			continue
+		}
+		t := tried[site]
+		if t < bestTried || (t == bestTried && a.Latest > bestLatest) {
+			best, bestTried, bestLatest = site, t, a.Latest
+		}
+	}
+	return best
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withPlacements replaces the lineage graph with arrivals of dataset at the
+// given sites, newest last.
+func withPlacements(t *testing.T, dataset string, sites ...string) {
+	t.Helper()
+	saved := lineage
+	t.Cleanup(func() { lineage = saved })
+	lineage = &lineageGraph{
+		inputs:  map[DatasetRef][]DatasetRef{},
+		outputs: map[DatasetRef][]DatasetRef{},
+		latest:  map[DatasetRef]float64{},
+		first:   map[DatasetRef]float64{},
+	}
+	for i, site := range sites {
+		lineage.Observe(TransferEvent{Site: site, Dataset: dataset, Status: "success", Timestamp: float64(1000 + i)})
+	}
+}
+
+func TestAlternateSource(t *testing.T) {
+	withPlacements(t, "ds", "OLD", "MID", "NEW", "DST")
+	for _, tc := range []struct {
+		name    string
+		dataset string
+		source  string
+		tried   []string
+		want    string
+	}{
+		{"freshest untried", "ds", "NEW", []string{"NEW"}, "MID"},
+		{"skips every tried source", "ds", "MID", []string{"NEW", "MID"}, "OLD"},
+		{"least recently tried once all were", "ds", "OLD", []string{"MID", "NEW", "OLD"}, "MID"},
+		{"never the destination", "ds", "OLD", []string{"OLD", "MID", "NEW"}, "OLD"},
+		{"nothing else holds it", "other", "NEW", []string{"NEW"}, "NEW"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &TransferRequest{Dataset: tc.dataset, Source: tc.source, Destination: "DST", TriedSources: tc.tried}
+			if got := alternateSource(r); got != tc.want {
+				t.Errorf("alternateSource = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecideRetry(t *testing.T) {
+	saved := retryPolicies
+	t.Cleanup(func() { retryPolicies = saved })
+	retryPolicies = []retryPolicy{{
+		Name: "p", MaxAttempts: 3, Backoff: time.Minute, BackoffFactor: 2, MaxBackoff: 3 * time.Minute,
+		GiveUpAfter: time.Hour,
+	}}
+	created := time.Unix(1_000_000, 0)
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		now      time.Time
+		retry    bool
+		outcome  string
+		delay    time.Duration
+	}{
+		{"first failure", 1, created, true, "retried", time.Minute},
+		{"backoff grows", 2, created, true, "retried", 2 * time.Minute},
+		{"exhausted", 3, created, false, "exhausted", 0},
+		{"past give_up_after", 1, created.Add(time.Hour), false, "gave_up", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &TransferRequest{Dataset: "ds", Source: "A", Attempts: tc.attempts, Created: float64(created.Unix())}
+			d := decideRetry(r, "connection reset", tc.now)
+			if d.retry != tc.retry || d.outcome != tc.outcome || d.delay != tc.delay {
+				t.Errorf("got retry=%v outcome=%s delay=%s, want %v %s %s", d.retry, d.outcome, d.delay, tc.retry, tc.outcome, tc.delay)
+			}
+		})
+	}
+}
+
+// A failed attempt must not be retried from the source that just failed
+// while another site holds the dataset.
+func TestFinishRetriesFromAnotherSource(t *testing.T) {
+	withPlacements(t, "ds", "OLD", "NEW")
+	saved := retryPolicies
+	t.Cleanup(func() { retryPolicies = saved })
+	retryPolicies = []retryPolicy{{Name: "p", MaxAttempts: 5, BackoffFactor: 1, AlternateSources: true}}
+
+	s := &requestStore{path: filepath.Join(t.TempDir(), "requests.json"), requests: map[string]*TransferRequest{}}
+	s.requests["r1"] = &TransferRequest{ID: "r1", Dataset: "ds", Source: "NEW", Destination: "DST",
+		Status: requestRunning, Worker: "w", Attempts: 1}
+	r, err := s.Finish("r1", "w", requestFailed, "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != requestQueued || r.Source != "OLD" {
+		t.Fatalf("got %s from %s, want queued from OLD", r.Status, r.Source)
+	}
+	if len(r.TriedSources) != 1 || r.TriedSources[0] != "NEW" {
+		t.Errorf("tried sources = %v", r.TriedSources)
+	}
+}
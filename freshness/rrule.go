@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrence is the subset of RFC 5545 RRULE the downtime calendar
+// understands: FREQ=DAILY|WEEKLY|MONTHLY|YEARLY with INTERVAL, COUNT or
+// UNTIL, BYDAY (except under YEARLY; with ordinals such as 1SU or -1FR
+// under MONTHLY), BYMONTHDAY (under MONTHLY) and WKST. Other combinations
+// are refused rather than expanded differently from RFC 5545. Occurrences keep the first one's wall-clock time in
+// its location, so a 02:00 window stays at 02:00 across DST changes.
+type recurrence struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []recurrenceDay
+	byMonthDay []int
+	weekStart  time.Weekday
+}
+
+type recurrenceDay struct {
+	weekday time.Weekday
+	nth     int // 0 for every such weekday in the period
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// maxRecurrencePeriods bounds expansion of a rule that never matches.
+const maxRecurrencePeriods = 100000
+
+func parseRecurrence(s string, loc *time.Location) (*recurrence, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	r := &recurrence{interval: 1, weekStart: time.Monday}
+	for _, part := range strings.Split(s, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rrule: malformed part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(val)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(val)
+			if err == nil && r.count < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "UNTIL":
+			r.until, err = parseICalTime(val, loc)
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				d = strings.ToUpper(d)
+				if len(d) < 2 {
+					return nil, fmt.Errorf("rrule: BYDAY %q", d)
+				}
+				wd, ok := rruleWeekdays[d[len(d)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("rrule: BYDAY %q", d)
+				}
+				day := recurrenceDay{weekday: wd}
+				if n := d[:len(d)-2]; n != "" {
+					if day.nth, err = strconv.Atoi(n); err != nil || day.nth == 0 || day.nth < -5 || day.nth > 5 {
+						return nil, fmt.Errorf("rrule: BYDAY %q", d)
+					}
+				}
+				r.byDay = append(r.byDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("rrule: BYMONTHDAY %q", d)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "WKST":
+			wd, ok := rruleWeekdays[strings.ToUpper(val)]
+			if !ok {
+				return nil, fmt.Errorf("rrule: WKST %q", val)
+			}
+			r.weekStart = wd
+		default:
+			return nil, fmt.Errorf("rrule: %s is not supported", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rrule: %s: %w", key, err)
+		}
+	}
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	case "":
+		return nil, fmt.Errorf("rrule: FREQ is required")
+	default:
+		return nil, fmt.Errorf("rrule: FREQ=%s is not supported", r.freq)
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return nil, fmt.Errorf("rrule: COUNT and UNTIL are exclusive")
+	}
+	for _, d := range r.byDay {
+		if d.nth != 0 && r.freq != "MONTHLY" {
+			return nil, fmt.Errorf("rrule: ordinal BYDAY needs FREQ=MONTHLY")
+		}
+	}
+	if len(r.byDay) > 0 && r.freq == "YEARLY" {
+		return nil, fmt.Errorf("rrule: BYDAY is not supported with FREQ=YEARLY")
+	}
+	if len(r.byMonthDay) > 0 && r.freq != "MONTHLY" {
+		return nil, fmt.Errorf("rrule: BYMONTHDAY needs FREQ=MONTHLY")
+	}
+	return r, nil
+}
+
+// parseICalTime reads an iCalendar DATE or DATE-TIME, UTC when it ends in
+// Z and in loc otherwise.
+func parseICalTime(s string, loc *time.Location) (time.Time, error) {
+	if strings.HasSuffix(s, "Z") {
+		return time.Parse("20060102T150405Z", s)
+	}
+	if len(s) == 8 {
+		t, err := time.ParseInLocation("20060102", s, loc)
+		// a bare date includes the whole day
+		return t.AddDate(0, 0, 1).Add(-time.Second), err
+	}
+	return time.ParseInLocation("20060102T150405", s, loc)
+}
+
+// each calls fn with every occurrence start from dtstart on, in order,
+// until fn returns false or the rule ends.
+func (r *recurrence) each(dtstart time.Time, fn func(time.Time) bool) {
+	loc := dtstart.Location()
+	h, m, s := dtstart.Clock()
+	at := func(y int, mo time.Month, d int) time.Time { return time.Date(y, mo, d, h, m, s, 0, loc) }
+	n := 0
+	emit := func(t time.Time) bool {
+		if t.Before(dtstart) {
+			return true
+		}
+		if !r.until.IsZero() && t.After(r.until) {
+			return false
+		}
+		n++
+		if !fn(t) {
+			return false
+		}
+		return r.count == 0 || n < r.count
+	}
+	y, mo, d := dtstart.Date()
+	for p := 0; p < maxRecurrencePeriods; p++ {
+		var days []time.Time
+		switch r.freq {
+		case "DAILY":
+			t := at(y, mo, d+p*r.interval)
+			if r.matchesWeekday(t.Weekday()) {
+				days = append(days, t)
+			}
+		case "WEEKLY":
+			offset := (int(dtstart.Weekday()) - int(r.weekStart) + 7) % 7
+			for i := 0; i < 7; i++ {
+				t := at(y, mo, d-offset+7*p*r.interval+i)
+				if len(r.byDay) == 0 && t.Weekday() == dtstart.Weekday() || len(r.byDay) > 0 && r.matchesWeekday(t.Weekday()) {
+					days = append(days, t)
+				}
+			}
+		case "MONTHLY":
+			days = r.monthDays(at, y, mo+time.Month(p*r.interval), d)
+		case "YEARLY":
+			if t := at(y+p*r.interval, mo, d); t.Day() == d {
+				days = append(days, t)
+			}
+		}
+		for _, t := range days {
+			if !emit(t) {
+				return
+			}
+		}
+	}
+}
+
+func (r *recurrence) matchesWeekday(wd time.Weekday) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, d := range r.byDay {
+		if d.weekday == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays lists the occurrence days of one month in order.
+func (r *recurrence) monthDays(at func(int, time.Month, int) time.Time, y int, mo time.Month, dtDay int) []time.Time {
+	first := at(y, mo, 1)
+	y, mo = first.Year(), first.Month()
+	last := at(y, mo+1, 0).Day()
+	byMonthDay := map[int]bool{}
+	for _, md := range r.byMonthDay {
+		if md < 0 {
+			md = last + 1 + md
+		}
+		byMonthDay[md] = true
+	}
+	byDay := map[int]bool{}
+	for _, bd := range r.byDay {
+		var matches []int
+		for day := 1; day <= last; day++ {
+			if at(y, mo, day).Weekday() == bd.weekday {
+				matches = append(matches, day)
+			}
+		}
+		switch {
+		case bd.nth == 0:
+			for _, day := range matches {
+				byDay[day] = true
+			}
+		case bd.nth > 0 && bd.nth <= len(matches):
+			byDay[matches[bd.nth-1]] = true
+		case bd.nth < 0 && -bd.nth <= len(matches):
+			byDay[matches[len(matches)+bd.nth]] = true
+		}
+	}
+	// with both given a day must satisfy both, as in RFC 5545
+	picked := func(day int) bool {
+		switch {
+		case len(r.byMonthDay) > 0 && len(r.byDay) > 0:
+			return byMonthDay[day] && byDay[day]
+		case len(r.byMonthDay) > 0:
+			return byMonthDay[day]
+		case len(r.byDay) > 0:
+			return byDay[day]
+		}
+		return day == dtDay
+	}
+	var out []time.Time
+	for day := 1; day <= last; day++ {
+		if picked(day) {
+			out = append(out, at(y, mo, day))
+		}
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// expand lists up to max occurrences of rule from dtstart, as local
+// DATE-TIMEs.
+func expand(t *testing.T, rule, dtstart string, loc *time.Location, max int) []string {
+	t.Helper()
+	r, err := parseRecurrence(rule, loc)
+	if err != nil {
+		t.Fatalf("%s: %v", rule, err)
+	}
+	start, err := time.ParseInLocation("20060102T150405", dtstart, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	r.each(start, func(o time.Time) bool {
+		out = append(out, o.Format("20060102T150405"))
+		return len(out) < max
+	})
+	return out
+}
+
+// Examples from RFC 5545 section 3.8.5.3, all DTSTART;TZID=America/New_York.
+func TestRecurrenceRFC5545(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, rule, dtstart string
+		want                []string
+		open                bool // no COUNT or UNTIL; check only the start
+	}{
+		{"daily for 10 occurrences", "FREQ=DAILY;COUNT=10", "19970902T090000",
+			[]string{"19970902T090000", "19970903T090000", "19970904T090000", "19970905T090000", "19970906T090000",
+				"19970907T090000", "19970908T090000", "19970909T090000", "19970910T090000", "19970911T090000"}, false},
+		{"every 10 days, 5 occurrences", "FREQ=DAILY;INTERVAL=10;COUNT=5", "19970902T090000",
+			[]string{"19970902T090000", "19970912T090000", "19970922T090000", "19971002T090000", "19971012T090000"}, false},
+		{"every other week on Tuesday and Thursday, 8 occurrences", "RRULE:FREQ=WEEKLY;INTERVAL=2;WKST=SU;BYDAY=TU,TH;COUNT=8", "19970902T090000",
+			[]string{"19970902T090000", "19970904T090000", "19970916T090000", "19970918T090000",
+				"19970930T090000", "19971002T090000", "19971014T090000", "19971016T090000"}, false},
+		{"weekly on Tuesday and Thursday for five weeks", "FREQ=WEEKLY;UNTIL=19971007T000000Z;WKST=SU;BYDAY=TU,TH", "19970902T090000",
+			[]string{"19970902T090000", "19970904T090000", "19970909T090000", "19970911T090000", "19970916T090000",
+				"19970918T090000", "19970923T090000", "19970925T090000", "19970930T090000", "19971002T090000"}, false},
+		{"monthly on the first Friday for 10 occurrences", "FREQ=MONTHLY;COUNT=10;BYDAY=1FR", "19970905T090000",
+			[]string{"19970905T090000", "19971003T090000", "19971107T090000", "19971205T090000", "19980102T090000",
+				"19980206T090000", "19980306T090000", "19980403T090000", "19980501T090000", "19980605T090000"}, false},
+		{"every other month on the first and last Sunday", "FREQ=MONTHLY;INTERVAL=2;COUNT=10;BYDAY=1SU,-1SU", "19970907T090000",
+			[]string{"19970907T090000", "19970928T090000", "19971102T090000", "19971130T090000", "19980104T090000",
+				"19980125T090000", "19980301T090000", "19980329T090000", "19980503T090000", "19980531T090000"}, false},
+		{"monthly on the third-to-the-last day", "FREQ=MONTHLY;BYMONTHDAY=-3", "19970928T090000",
+			[]string{"19970928T090000", "19971029T090000", "19971128T090000", "19971229T090000", "19980129T090000", "19980226T090000"}, true},
+		{"monthly on the 2nd and 15th for 10 occurrences", "FREQ=MONTHLY;COUNT=10;BYMONTHDAY=2,15", "19970902T090000",
+			[]string{"19970902T090000", "19970915T090000", "19971002T090000", "19971015T090000", "19971102T090000",
+				"19971115T090000", "19971202T090000", "19971215T090000", "19980102T090000", "19980115T090000"}, false},
+		{"every 18 months on the 10th through 15th", "FREQ=MONTHLY;INTERVAL=18;COUNT=10;BYMONTHDAY=10,11,12,13,14,15", "19970910T090000",
+			[]string{"19970910T090000", "19970911T090000", "19970912T090000", "19970913T090000", "19970914T090000",
+				"19970915T090000", "19990310T090000", "19990311T090000", "19990312T090000", "19990313T090000"}, false},
+		{"every Friday the 13th", "FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13", "19970902T090000",
+			[]string{"19980213T090000", "19980313T090000", "19981113T090000", "19990813T090000", "20001013T090000"}, true},
+		{"yearly skips years without the date", "FREQ=YEARLY;COUNT=3", "20000229T090000",
+			[]string{"20000229T090000", "20040229T090000", "20080229T090000"}, false},
+		{"monthly skips months without the date", "FREQ=MONTHLY;COUNT=4", "20240131T090000",
+			[]string{"20240131T090000", "20240331T090000", "20240531T090000", "20240731T090000"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			max := len(tc.want) + 1
+			if tc.open {
+				max = len(tc.want)
+			}
+			if got := expand(t, tc.rule, tc.dtstart, ny, max); !slices.Equal(got, tc.want) {
+				t.Errorf("got  %v\nwant %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecurrenceDST(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the wall-clock time holds across both changes (31 March and 27
+	// October 2024), so occurrences are 23h or 25h apart there
+	// 02:00 does not exist on 31 March and moves forward an hour
+	got := expand(t, "FREQ=DAILY;COUNT=4", "20240330T020000", zurich, 10)
+	if want := []string{"20240330T020000", "20240331T030000", "20240401T020000", "20240402T020000"}; !slices.Equal(got, want) {
+		t.Errorf("spring forward: got %v, want %v", got, want)
+	}
+	r, _ := parseRecurrence("FREQ=WEEKLY;BYDAY=SU;COUNT=3", zurich)
+	start := time.Date(2024, 10, 20, 1, 30, 0, 0, zurich)
+	var gaps []time.Duration
+	prev := start
+	r.each(start, func(o time.Time) bool {
+		if h, m, _ := o.Clock(); h != 1 || m != 30 {
+			t.Errorf("fall back: occurrence at %s, want 01:30", o)
+		}
+		if o != start {
+			gaps = append(gaps, o.Sub(prev))
+		}
+		prev = o
+		return true
+	})
+	// clocks go back at 03:00 on the 27th, after that day's 01:30
+	if want := []time.Duration{7 * 24 * time.Hour, 7*24*time.Hour + time.Hour}; !slices.Equal(gaps, want) {
+		t.Errorf("fall back: gaps %v, want %v", gaps, want)
+	}
+}
+
+func TestParseRecurrenceErrors(t *testing.T) {
+	for _, tc := range []struct{ rule, want string }{
+		{"COUNT=3", "FREQ is required"},
+		{"FREQ=HOURLY", "not supported"},
+		{"FREQ=DAILY;BYHOUR=3", "not supported"},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20250101T000000Z", "exclusive"},
+		{"FREQ=DAILY;INTERVAL=0", "INTERVAL"},
+		{"FREQ=WEEKLY;BYDAY=XX", "BYDAY"},
+		{"FREQ=MONTHLY;BYDAY=6MO", "BYDAY"},
+		{"FREQ=WEEKLY;BYDAY=1MO", "ordinal BYDAY needs FREQ=MONTHLY"},
+		{"FREQ=YEARLY;BYDAY=MO", "BYDAY is not supported with FREQ=YEARLY"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", "BYMONTHDAY"},
+		{"FREQ=DAILY;BYMONTHDAY=1", "BYMONTHDAY needs FREQ=MONTHLY"},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", "BYMONTHDAY needs FREQ=MONTHLY"},
+		{"FREQ=YEARLY;BYMONTHDAY=1", "BYMONTHDAY needs FREQ=MONTHLY"},
+		{"FREQ=WEEKLY;WKST=XX", "WKST"},
+		{"FREQ", "malformed"},
+	} {
+		_, err := parseRecurrence(tc.rule, time.UTC)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v, want one mentioning %q", tc.rule, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// rucioSource maps Rucio onto DTMS: every RSE holding one of the configured
+// datasets becomes a site whose freshness is the newest update of an
+// available replica there. Rule states for the account are exported
+// alongside so stuck replication shows up next to the staleness it causes.
+//
+// Authentication uses userpass (/auth/userpass) unless a static token is
+// configured.
+type rucioSource struct {
+	name     string
+	URL      string   `yaml:"url"`
+	AuthURL  string   `yaml:"auth_url"`
+	Account  string   `yaml:"account"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Token    string   `yaml:"token"`
+	Datasets []string `yaml:"datasets"` // scope:name
+
+	mu          sync.Mutex
+	authToken   string
+	authExpires time.Time
+}
+
+var (
+	gaugeRucioRules = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dtms_rucio_rules",
+			Help: "Replication rules owned by the account, by state",
+		},
+		[]string{"account", "state"},
+	)
+	gaugeRucioDatasetComplete = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dtms_rucio_dataset_available_ratio",
+			Help: "Fraction of a dataset's files available at an RSE",
+		},
+		[]string{"site", "dataset"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeRucioRules, gaugeRucioDatasetComplete)
+	registerSource("rucio", func(name string, params *yaml.Node) (Source, error) {
+		s := &rucioSource{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.URL == "" || s.Account == "" {
+			return nil, fmt.Errorf("url and account are required")
+		}
+		if s.AuthURL == "" {
+			s.AuthURL = s.URL
+		}
+		return s, nil
+	})
+}
+
+func (s *rucioSource) Name() string { return s.name }
+
+type rucioRule struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+type rucioDatasetReplica struct {
+	RSE             string `json:"rse"`
+	State           string `json:"state"`
+	Length          int64  `json:"length"`
+	AvailableLength int64  `json:"available_length"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+func (s *rucioSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	var rules []rucioRule
+	if err := s.stream(ctx, "/rules/?"+url.Values{"account": {s.Account}}.Encode(), func(b []byte) error {
+		var r rucioRule
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		rules = append(rules, r)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("list rules: %w", err)
+	}
+	states := map[string]int{}
+	for _, r := range rules {
+		states[r.State]++
+	}
+	gaugeRucioRules.DeletePartialMatch(prometheus.Labels{"account": s.Account})
+	for state, n := range states {
+		gaugeRucioRules.WithLabelValues(s.Account, state).Set(float64(n))
+	}
+
+	now := time.Now()
+	latest := map[string]time.Time{}
+	for _, did := range s.Datasets {
+		scope, name, ok := strings.Cut(did, ":")
+		if !ok {
+			return nil, fmt.Errorf("dataset %q must be scope:name", did)
+		}
+		path := "/replicas/" + url.PathEscape(scope) + "/" + url.PathEscape(name) + "/datasets"
+		err := s.stream(ctx, path, func(b []byte) error {
+			var rep rucioDatasetReplica
+			if err := json.Unmarshal(b, &rep); err != nil {
+				return err
+			}
+			if rep.Length > 0 {
+				gaugeRucioDatasetComplete.WithLabelValues(rep.RSE, did).Set(float64(rep.AvailableLength) / float64(rep.Length))
+			}
+			if rep.State != "AVAILABLE" {
+				return nil
+			}
+			t, err := parseTimestamp(rep.UpdatedAt)
+			if err != nil {
+				return err
+			}
+			if t.After(latest[rep.RSE]) {
+				latest[rep.RSE] = t
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("replicas of %s: %w", did, err)
+		}
+	}
+
+	out := make([]SiteFresh, 0, len(latest))
+	for rse, t := range latest {
+		out = append(out, SiteFresh{
+			Site:            rse,
+			LatestTimestamp: float64(t.Unix()),
+			AgeSeconds:      now.Sub(t).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+// stream calls fn for every line of a Rucio x-json-stream response. A 401
+// with a userpass token, e.g. one revoked before its stated expiry, gets one
+// retry with a fresh token.
+func (s *rucioSource) stream(ctx context.Context, path string, fn func([]byte) error) error {
+	resp, err := s.get(ctx, path)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && s.Token == "" {
+		resp.Body.Close()
+		s.mu.Lock()
+		s.authToken = ""
+		s.mu.Unlock()
+		resp, err = s.get(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (s *rucioSource) get(ctx context.Context, path string) (*http.Response, error) {
+	token, err := s.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.URL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Rucio-Auth-Token", token)
+	req.Header.Set("Accept", "application/x-json-stream")
+	return client.Do(req)
+}
+
+func (s *rucioSource) token(ctx context.Context) (string, error) {
+	if s.Token != "" {
+		return s.Token, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.authToken != "" && time.Now().Before(s.authExpires.Add(-time.Minute)) {
+		return s.authToken, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.AuthURL, "/")+"/auth/userpass", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Rucio-Account", s.Account)
+	req.Header.Set("X-Rucio-Username", s.Username)
+	req.Header.Set("X-Rucio-Password", s.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("rucio auth: %s", resp.Status)
+	}
+	s.authToken = resp.Header.Get("X-Rucio-Auth-Token")
+	s.authExpires = time.Now().Add(time.Hour)
+	if exp, err := parseTimestamp(resp.Header.Get("X-Rucio-Auth-Token-Expires")); err == nil {
+		s.authExpires = exp
+	}
+	return s.authToken, nil
+}
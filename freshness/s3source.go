@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// S3_TARGETS maps sites to bucket prefixes, e.g.
+// "PARTNER_X=incoming/partner-x/,LAB=lab-drop". Requests are path-style
+// against the endpoint so MinIO and GCS interoperability endpoints work too.
+var s3Targets = envOr("S3_TARGETS", "")
+
+// s3Settings addresses an S3-compatible endpoint; it is shared by everything
+// that talks to object storage.
+type s3Settings struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+}
+
+func s3SettingsFromEnv() s3Settings {
+	return s3Settings{
+		Endpoint:        envOr("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		Region:          envOr("S3_REGION", "us-east-1"),
+		AccessKeyID:     envOr("S3_ACCESS_KEY_ID", getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: envOr("S3_SECRET_ACCESS_KEY", getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    envOr("S3_SESSION_TOKEN", getenv("AWS_SESSION_TOKEN")),
+	}
+}
+
+func (c s3Settings) credentials() awsCredentials {
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}
+}
+
+// s3Source's targets map sites to "bucket/prefix".
+type s3Source struct {
+	name       string
+	s3Settings `yaml:",inline"`
+	Targets    map[string]string `yaml:"targets"`
+}
+
+func init() {
+	registerSource("s3", func(name string, params *yaml.Node) (Source, error) {
+		s := &s3Source{name: name, s3Settings: s3SettingsFromEnv()}
+		return s, params.Decode(s)
+	})
+}
+
+func s3FromEnv() *s3Source {
+	return &s3Source{name: "s3", s3Settings: s3SettingsFromEnv(), Targets: parseKeyValues(s3Targets)}
+}
+
+func (s *s3Source) Name() string { return s.name }
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Collect reports each target's age as the time since its newest object
+// was written. Keep prefixes narrow: every poll lists them in full.
+func (s *s3Source) Collect(ctx context.Context) ([]SiteFresh, error) {
+	now := time.Now()
+	var out []SiteFresh
+	for site, loc := range s.Targets {
+		bucket, prefix, _ := strings.Cut(loc, "/")
+		newest, err := s.newestObject(ctx, bucket, prefix)
+		if err != nil {
+			return out, fmt.Errorf("%s: %w", site, err)
+		}
+		if newest.IsZero() {
+			fmt.Printf("[s3] site=%s: no objects under %s\n", site, loc)
+			continue
+		}
+		out = append(out, SiteFresh{
+			Site:            site,
+			LatestTimestamp: float64(newest.Unix()),
+			AgeSeconds:      now.Sub(newest).Seconds(),
+		})
+	}
+	return out, nil
+}
+
+func (s *s3Source) newestObject(ctx context.Context, bucket, prefix string) (time.Time, error) {
+	var newest time.Time
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var page s3ListResult
+		if err := s.s3Settings.get(ctx, bucket, q, &page); err != nil {
+			return newest, err
+		}
+		for _, o := range page.Contents {
+			if o.LastModified.After(newest) {
+				newest = o.LastModified
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return newest, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (c s3Settings) get(ctx context.Context, bucket string, q url.Values, into interface{}) error {
+	u := strings.TrimRight(c.Endpoint, "/") + "/" + bucket + "?" + canonicalQuery(q)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	signV4(req, c.credentials(), c.Region, "s3", emptyPayloadHash, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("list %s: %s", bucket, resp.Status)
+	}
+	return xml.NewDecoder(resp.Body).Decode(into)
+}
+
+// put uploads body as bucket/key.
+func (c s3Settings) put(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	u := strings.TrimRight(c.Endpoint, "/") + "/" + bucket + "/" + strings.TrimLeft(key, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	signV4(req, c.credentials(), c.Region, "s3", sha256Hex(body), time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put %s/%s: %s", bucket, key, resp.Status)
+	}
+	return nil
+}
+
+// object downloads bucket/key.
+func (c s3Settings) object(ctx context.Context, bucket, key string) ([]byte, error) {
+	u := strings.TrimRight(c.Endpoint, "/") + "/" + bucket + "/" + strings.TrimLeft(key, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, c.credentials(), c.Region, "s3", emptyPayloadHash, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s/%s: %s", bucket, key, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// remove deletes bucket/key.
+func (c s3Settings) remove(ctx context.Context, bucket, key string) error {
+	u := strings.TrimRight(c.Endpoint, "/") + "/" + bucket + "/" + strings.TrimLeft(key, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	signV4(req, c.credentials(), c.Region, "s3", emptyPayloadHash, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete %s/%s: %s", bucket, key, resp.Status)
+	}
+	return nil
+}
+
+// keys lists every key under prefix, starting after startAfter.
+func (c s3Settings) keys(ctx context.Context, bucket, prefix, startAfter string) ([]string, error) {
+	var out []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if startAfter != "" {
+			q.Set("start-after", startAfter)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var page s3ListResult
+		if err := c.get(ctx, bucket, q, &page); err != nil {
+			return out, err
+		}
+		for _, o := range page.Contents {
+			out = append(out, o.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks plain HTTP unless TLS_CERT_FILE/TLS_KEY_FILE are set,
+// in which case the pair is reloaded whenever it changes on disk (as
+// cert-manager rotates the mounted secret). Edge deployments without a
+// certificate can set ACME_DOMAINS (comma separated) to obtain and renew
+// one automatically over TLS-ALPN-01 on PORT, which must then be reachable
+// as 443; ACME_HTTP_PORT additionally answers HTTP-01 challenges.
+// ACME_DIRECTORY defaults to Let's Encrypt, and certificates and the
+// account key are kept in ACME_CACHE_DIR.
+var (
+	tlsCertFile   = envOr("TLS_CERT_FILE", "")
+	tlsKeyFile    = envOr("TLS_KEY_FILE", "")
+	acmeDomains   = envOr("ACME_DOMAINS", "")
+	acmeEmail     = envOr("ACME_EMAIL", "")
+	acmeDirectory = envOr("ACME_DIRECTORY", acme.LetsEncryptURL)
+	acmeCacheDir  = envOr("ACME_CACHE_DIR", filepath.Join(dataDir, "acme"))
+	acmeHTTPPort  = envOr("ACME_HTTP_PORT", "")
+)
+
+// serve runs srv with whichever TLS setup is configured, asking for (but
+// not requiring) client certificates when WEBHOOK_CLIENT_CA_FILE is set.
+func serve(srv *http.Server) error {
+	clientCAs, err := webhookClientCAs()
+	if err != nil {
+		return err
+	}
+	requestClientCerts := func(cfg *tls.Config) {
+		if clientCAs != nil {
+			cfg.ClientCAs = clientCAs
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	switch {
+	case acmeDomains != "":
+		var hosts []string
+		for _, h := range strings.Split(acmeDomains, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(acmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      acmeEmail,
+			Client:     &acme.Client{DirectoryURL: acmeDirectory},
+		}
+		if acmeHTTPPort != "" {
+			go func() {
+				err := http.ListenAndServe(":"+acmeHTTPPort, m.HTTPHandler(nil))
+				fmt.Printf("[tls] acme http-01 listener: %v\n", err)
+			}()
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		requestClientCerts(srv.TLSConfig)
+		fmt.Printf("[tls] serving certificates from %s for %s\n", acmeDirectory, strings.Join(hosts, ", "))
+		return srv.ListenAndServeTLS("", "")
+	case tlsCertFile != "":
+		r, err := newCertReloader(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: r.GetCertificate}
+		requestClientCerts(srv.TLSConfig)
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
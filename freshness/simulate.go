@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// -simulate scenario.yml runs the evaluation pipeline against a scripted
+// scenario on a virtual clock instead of serving: each step the scripted
+// site ages are judged exactly as a live poll would (SITES_CONFIG
+// thresholds and ok rules, downtimes, incidents), and the outcome is
+// written as JSON lines to stdout, or to -simulate-out. Nothing depends on
+// the wall clock, so the same scenario and config always give the same
+// output, which makes it suitable as a golden file in regression tests.
+// Service logs go to stderr while simulating. See simulation.example.yml.
+var (
+	simulatePath = flag.String("simulate", "", "run the scenario file on a virtual clock and exit")
+	simulateOut  = flag.String("simulate-out", "", "write simulation output here instead of stdout")
+)
+
+type simSpan struct {
+	From  time.Duration `yaml:"from"`
+	To    time.Duration `yaml:"to"`
+	Every time.Duration `yaml:"every"`
+}
+
+type simSite struct {
+	Site string `yaml:"site"`
+	// InitialAge is the age at the start, before any scripted transfer;
+	// without it the site reports nothing until its first transfer.
+	InitialAge time.Duration `yaml:"initial_age"`
+	Transfers  []simSpan     `yaml:"transfers"`
+}
+
+type simScenario struct {
+	Start    time.Time     `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+	Step     time.Duration `yaml:"step"`
+	// Report is "changes" (evaluations whose ok state changed) or "all".
+	Report      string    `yaml:"report"`
+	Sites       []simSite `yaml:"sites"`
+	APIFailures []simSpan `yaml:"api_failures"`
+	Downtimes   []struct {
+		Site string        `yaml:"site"`
+		From time.Duration `yaml:"from"`
+		To   time.Duration `yaml:"to"`
+	} `yaml:"downtimes"`
+}
+
+// simEvent is one line of simulation output.
+type simEvent struct {
+	Time     string   `json:"t"`
+	Type     string   `json:"type"`
+	Site     string   `json:"site,omitempty"`
+	Age      *float64 `json:"age_seconds,omitempty"`
+	Ok       *bool    `json:"ok,omitempty"`
+	Duration *float64 `json:"duration_seconds,omitempty"`
+	Count    *int     `json:"count,omitempty"`
+}
+
+func loadScenario(path string) (*simScenario, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &simScenario{Step: time.Minute, Report: "changes"}
+	if err := yamlenv.Unmarshal(raw, sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if sc.Start.IsZero() || sc.Duration <= 0 {
+		return nil, fmt.Errorf("%s: start and duration are required", path)
+	}
+	if sc.Report != "changes" && sc.Report != "all" {
+		return nil, fmt.Errorf("%s: report must be changes or all", path)
+	}
+	sort.Slice(sc.Sites, func(i, j int) bool { return sc.Sites[i].Site < sc.Sites[j].Site })
+	return sc, nil
+}
+
+// latestAt is the site's last transfer at offset into the scenario.
+func (s simSite) latestAt(offset time.Duration) (time.Duration, bool) {
+	latest, ok := -s.InitialAge, s.InitialAge > 0
+	for _, sp := range s.Transfers {
+		if offset < sp.From {
+			continue
+		}
+		last := sp.From
+		if sp.Every > 0 {
+			end := offset
+			if sp.To > 0 && sp.To < end {
+				end = sp.To
+			}
+			last = sp.From + (end-sp.From)/sp.Every*sp.Every
+		}
+		if !ok || last > latest {
+			latest, ok = last, true
+		}
+	}
+	return latest, ok
+}
+
+func inSpans(spans []simSpan, offset time.Duration) bool {
+	for _, sp := range spans {
+		if offset >= sp.From && offset < sp.To {
+			return true
+		}
+	}
+	return false
+}
+
+// runSimulation plays the scenario and returns the process exit code.
+func runSimulation(path string) int {
+	sc, err := loadScenario(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[simulate] %v\n", err)
+		return 1
+	}
+	var out io.Writer = os.Stdout
+	if *simulateOut != "" {
+		f, err := os.Create(*simulateOut)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[simulate] %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	// Keep the results alone on stdout, and the state the pipeline
+	// persists away from the real data directory.
+	os.Stdout = os.Stderr
+	tmp, err := os.MkdirTemp("", "dtms-simulate-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[simulate] %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+	history.dir = filepath.Join(tmp, "history")
+	incidents.path = filepath.Join(tmp, "incidents.json")
+
+	var windows []downtimeWindow
+	for _, d := range sc.Downtimes {
+		windows = append(windows, downtimeWindow{
+			Site:   d.Site,
+			Start:  sc.Start.Add(d.From),
+			End:    sc.Start.Add(d.To),
+			Origin: "simulation",
+		})
+	}
+	downtimes.Replace("simulation", windows)
+
+	enc := json.NewEncoder(out)
+	emit := func(now time.Time, ev simEvent) {
+		ev.Time = now.UTC().Format(time.RFC3339)
+		enc.Encode(ev)
+	}
+	lastOk := map[string]bool{}
+	wasOpen := map[string]float64{}
+	opened := map[string]int{}
+	for offset := time.Duration(0); offset <= sc.Duration; offset += sc.Step {
+		now := sc.Start.Add(offset)
+		if inSpans(sc.APIFailures, offset) {
+			emit(now, simEvent{Type: "api_failure"})
+			continue
+		}
+		var sites []SiteFresh
+		for _, s := range sc.Sites {
+			latest, ok := s.latestAt(offset)
+			if !ok {
+				continue
+			}
+			at := sc.Start.Add(latest)
+			sites = append(sites, SiteFresh{
+				Site:            s.Site,
+				LatestTimestamp: float64(at.Unix()),
+				AgeSeconds:      now.Sub(at).Seconds(),
+			})
+		}
+		for _, e := range evaluatePoll(sites, now) {
+			prev, seen := lastOk[e.Site]
+			lastOk[e.Site] = e.Ok
+			if sc.Report == "all" || !seen || prev != e.Ok {
+				age, ok := e.AgeSeconds, e.Ok
+				emit(now, simEvent{Type: "evaluation", Site: e.Site, Age: &age, Ok: &ok})
+			}
+		}
+
+		incidents.mu.Lock()
+		open := map[string]float64{}
+		for site, inc := range incidents.open {
+			open[site] = inc.Start
+		}
+		incidents.mu.Unlock()
+		for _, s := range sc.Sites {
+			start, isOpen := open[s.Site]
+			_, was := wasOpen[s.Site]
+			switch {
+			case isOpen && !was:
+				opened[s.Site]++
+				emit(now, simEvent{Type: "incident_opened", Site: s.Site})
+			case !isOpen && was:
+				d := float64(now.Unix()) - wasOpen[s.Site]
+				emit(now, simEvent{Type: "incident_resolved", Site: s.Site, Duration: &d})
+			}
+			if isOpen {
+				wasOpen[s.Site] = start
+			} else {
+				delete(wasOpen, s.Site)
+			}
+		}
+	}
+	end := sc.Start.Add(sc.Duration)
+	for _, s := range sc.Sites {
+		n := opened[s.Site]
+		emit(end, simEvent{Type: "incidents", Site: s.Site, Count: &n})
+	}
+	return 0
+}
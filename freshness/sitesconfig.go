@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+var sitesConfigPath = envOr("SITES_CONFIG", "")
+
+// siteConfig holds per-site settings from SITES_CONFIG. Entries under
+// `sites:` override `defaults:` field by field:
+//
+//	defaults:
+//	  threshold: 300
+//	sites:
+//	  SITE_A:
+//	    threshold: 900
+//	    ok: age < threshold || hour(now) < 6
+//	    tags: {tier: "1", region: eu-west}
+//	    vos: [atlas, cms]
+//	    cost: {per_gb: 0.09}
+//
+// Tags are merged into Metadata when the file is loaded; see tags.go. The
+// VOs a site serves become its "vo" tag (vos.go).
+// Schedules for sites active only in business hours are in
+// businesshours.go.
+type siteConfig struct {
+	Threshold float64           `yaml:"threshold"`
+	Ok        string            `yaml:"ok"`
+	Metadata  map[string]string `yaml:"metadata"`
+	Tags      map[string]string `yaml:"tags"`
+	VOs       []string          `yaml:"vos"`
+	Cost      *costModel        `yaml:"cost"`
+	SLO       *sloConfig        `yaml:"slo"`
+	Schedule  *siteSchedule     `yaml:"schedule"`
+
+	okExpr *okExpression
+}
+
+type sitesFile struct {
+	Defaults siteConfig            `yaml:"defaults"`
+	Sites    map[string]siteConfig `yaml:"sites"`
+	Groups   []groupHierarchy      `yaml:"groups"`
+}
+
+// sitesFromFile is SITES_CONFIG as loaded; the registry in use layers the
+// sites approved for registered agents (agentregistry.go) and those
+// managed through the API (managed.go) over it.
+var (
+	sitesFromFile = &sitesFile{}
+	sitesCurrent  atomic.Pointer[sitesFile]
+)
+
+func init() {
+	sitesCurrent.Store(sitesFromFile)
+}
+
+// siteRegistry returns the site settings in effect. The result must not
+// be modified; it is replaced whole when managed sites change.
+func siteRegistry() *sitesFile {
+	return sitesCurrent.Load()
+}
+
+func loadSitesConfig() error {
+	if err := validateTagSettings(); err != nil {
+		return err
+	}
+	if sitesConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(sitesConfigPath)
+	if err != nil {
+		return err
+	}
+	var f sitesFile
+	if err := yamlenv.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("%s: %w", sitesConfigPath, err)
+	}
+	if err := f.Defaults.compile(); err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	if err := validateGroups(f.Groups); err != nil {
+		return err
+	}
+	for name, c := range f.Sites {
+		if err := c.compile(); err != nil {
+			return fmt.Errorf("site %s: %w", name, err)
+		}
+		f.Sites[name] = c
+	}
+	sitesFromFile = &f
+	rebuildSiteRegistry()
+	return nil
+}
+
+func (c *siteConfig) compile() error {
+	if len(c.Tags) > 0 && c.Metadata == nil {
+		c.Metadata = map[string]string{}
+	}
+	for k, v := range c.Tags {
+		c.Metadata[k] = v
+	}
+	if len(c.VOs) > 0 {
+		for _, vo := range c.VOs {
+			if vo == "" || strings.Contains(vo, ",") {
+				return fmt.Errorf("vos: %q is not a VO name", vo)
+			}
+		}
+		if c.Metadata == nil {
+			c.Metadata = map[string]string{}
+		}
+		vos := append([]string(nil), c.VOs...)
+		sort.Strings(vos)
+		c.Metadata[voTagKey] = strings.Join(vos, ",")
+	}
+	if c.Cost != nil {
+		if err := c.Cost.compile(); err != nil {
+			return fmt.Errorf("cost: %w", err)
+		}
+	}
+	if c.Schedule != nil {
+		if err := c.Schedule.compile(); err != nil {
+			return err
+		}
+	}
+	if c.SLO != nil && (c.SLO.Objective <= 0 || c.SLO.Objective >= 1) {
+		return fmt.Errorf("slo objective must be between 0 and 1")
+	}
+	if c.Ok == "" {
+		return nil
+	}
+	expr, err := compileOkExpression(c.Ok)
+	if err != nil {
+		return err
+	}
+	c.okExpr = expr
+	return nil
+}
+
+// lookup returns the effective settings for site: its own entry layered
+// over the defaults, with FRESHNESS_THRESHOLD_SECONDS as the final fallback.
+func (r *sitesFile) lookup(site string) siteConfig {
+	c := r.Defaults
+	if s, ok := r.Sites[site]; ok {
+		if s.Threshold > 0 {
+			c.Threshold = s.Threshold
+		}
+		if s.okExpr != nil {
+			c.Ok, c.okExpr = s.Ok, s.okExpr
+		}
+		if s.Cost != nil {
+			c.Cost = s.Cost
+		}
+		if s.SLO != nil {
+			c.SLO = s.SLO
+		}
+		if s.Schedule != nil {
+			c.Schedule = s.Schedule
+		}
+		if len(s.Metadata) > 0 {
+			merged := map[string]string{}
+			for k, v := range c.Metadata {
+				merged[k] = v
+			}
+			for k, v := range s.Metadata {
+				merged[k] = v
+			}
+			c.Metadata = merged
+		}
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = float64(threshold)
+	}
+	return c
+}
+
+// sitesMatching returns the configured sites whose effective metadata
+// contains every key/value in selector, sorted by name.
+func (r *sitesFile) sitesMatching(selector map[string]string) []string {
+	var out []string
+	for site := range r.Sites {
+		md := r.lookup(site).Metadata
+		match := true
+		for k, v := range selector {
+			if md[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, site)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A freshness SLO is the fraction of polls a site must be ok over a
+// rolling window, set in SITES_CONFIG next to the threshold:
+//
+//	defaults:
+//	  slo: {objective: 0.99, window_days: 30}
+//
+// The error budget is the 1-objective of polls allowed to fail; the burn
+// rate over a window is how many times faster than that the budget is
+// being spent, so 1 exhausts it exactly at the end of the SLO window.
+// Burn rates are exported for each of SLO_BURN_WINDOWS for multi-window
+// alerts. Polls are counted in five-minute buckets, warmed from history
+// at startup.
+var sloBurnWindows = parseRateWindows(envOr("SLO_BURN_WINDOWS", "5m,30m,1h,6h,24h,72h"))
+
+const sloBucket = 5 * time.Minute
+
+type sloConfig struct {
+	Objective  float64 `yaml:"objective"`
+	WindowDays int     `yaml:"window_days"`
+}
+
+func (c *sloConfig) window() time.Duration {
+	days := c.WindowDays
+	if days <= 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+var (
+	gaugeSLOObjective = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_slo_objective", Help: "Target fraction of polls the site is fresh over the SLO window"},
+		[]string{"site"},
+	)
+	gaugeSLOCompliance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_slo_compliance_ratio", Help: "Fraction of polls the site was fresh over the SLO window"},
+		[]string{"site"},
+	)
+	gaugeSLOBudget = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_slo_error_budget_remaining_ratio", Help: "Fraction of the SLO window's error budget not yet spent (negative once overspent)"},
+		[]string{"site"},
+	)
+	gaugeSLOBurnRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_slo_burn_rate", Help: "Error budget consumption rate over a window; 1 spends exactly the budget"},
+		[]string{"site", "window"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeSLOObjective, gaugeSLOCompliance, gaugeSLOBudget, gaugeSLOBurnRate)
+}
+
+type sloCounts struct{ good, total int }
+
+// SLOStatus is one site's SLO as reported by the API.
+type SLOStatus struct {
+	Site       string             `json:"site"`
+	Objective  float64            `json:"objective"`
+	WindowDays float64            `json:"window_days"`
+	Compliance float64            `json:"compliance"`
+	Budget     float64            `json:"error_budget_remaining"`
+	BurnRates  map[string]float64 `json:"burn_rates"`
+}
+
+type sloTracker struct {
+	mu      sync.Mutex
+	buckets map[string]map[int64]*sloCounts
+}
+
+var slos = &sloTracker{buckets: map[string]map[int64]*sloCounts{}}
+
+func (s *sloTracker) record(site string, ok bool, t time.Time) {
+	b := s.buckets[site]
+	if b == nil {
+		b = map[int64]*sloCounts{}
+		s.buckets[site] = b
+	}
+	k := t.Unix() / int64(sloBucket.Seconds())
+	c := b[k]
+	if c == nil {
+		c = &sloCounts{}
+		b[k] = c
+	}
+	c.total++
+	if ok {
+		c.good++
+	}
+}
+
+// sum counts polls within d of now, dropping buckets older than keep.
+func (s *sloTracker) sum(site string, now time.Time, d, keep time.Duration) sloCounts {
+	var out sloCounts
+	from := now.Add(-d).Unix() / int64(sloBucket.Seconds())
+	drop := now.Add(-keep).Unix() / int64(sloBucket.Seconds())
+	for k, c := range s.buckets[site] {
+		if k < drop {
+			delete(s.buckets[site], k)
+			continue
+		}
+		if k > from {
+			out.good += c.good
+			out.total += c.total
+		}
+	}
+	return out
+}
+
+func (s *sloTracker) status(site string, cfg *sloConfig, now time.Time) SLOStatus {
+	window := cfg.window()
+	st := SLOStatus{Site: site, Objective: cfg.Objective, WindowDays: window.Hours() / 24, Compliance: 1, Budget: 1, BurnRates: map[string]float64{}}
+	allowed := 1 - cfg.Objective
+	if c := s.sum(site, now, window, window); c.total > 0 {
+		st.Compliance = float64(c.good) / float64(c.total)
+		if allowed > 0 {
+			st.Budget = 1 - (1-st.Compliance)/allowed
+		}
+	}
+	for _, w := range sloBurnWindows {
+		rate := 0.0
+		if c := s.sum(site, now, w, window); c.total > 0 && allowed > 0 {
+			rate = (1 - float64(c.good)/float64(c.total)) / allowed
+		}
+		st.BurnRates[w.String()] = rate
+	}
+	return st
+}
+
+// Observe counts one poll for site and republishes its SLO gauges.
+func (s *sloTracker) Observe(site string, ok bool, now time.Time) {
+	cfg := siteRegistry().lookup(site).SLO
+	if cfg == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(site, ok, now)
+	st := s.status(site, cfg, now)
+	gaugeSLOObjective.WithLabelValues(site).Set(st.Objective)
+	gaugeSLOCompliance.WithLabelValues(site).Set(st.Compliance)
+	gaugeSLOBudget.WithLabelValues(site).Set(st.Budget)
+	for w, rate := range st.BurnRates {
+		gaugeSLOBurnRate.WithLabelValues(site, w).Set(rate)
+	}
+}
+
+// Warm counts the polls in history that fall inside each site's window.
+func (s *sloTracker) Warm(now time.Time) error {
+	longest := time.Duration(0)
+	for _, site := range append(siteRegistry().sitesMatching(nil), "") {
+		if cfg := siteRegistry().lookup(site).SLO; cfg != nil && cfg.window() > longest {
+			longest = cfg.window()
+		}
+	}
+	if longest == 0 {
+		return nil
+	}
+	samples, err := history.Query("", now.Add(-longest), now)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range samples {
+		if siteRegistry().lookup(h.Site).SLO != nil {
+			s.record(h.Site, h.Ok, unixTime(h.Timestamp))
+		}
+	}
+	return nil
+}
+
+// handleSLO serves GET /api/v1/slo?site=&tags=.
+func handleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.URL.Query().Get("site")
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	slos.mu.Lock()
+	out := []SLOStatus{}
+	for name := range slos.buckets {
+		if (site != "" && name != site) || !sel.selects(name) {
+			continue
+		}
+		if cfg := siteRegistry().lookup(name).SLO; cfg != nil {
+			out = append(out, slos.status(name, cfg, now))
+		}
+	}
+	slos.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"slos": out})
+}
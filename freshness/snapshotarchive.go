@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SNAPSHOT_ARCHIVE (s3://bucket/prefix/) turns on archival of the evaluated
+// freshness snapshot: every SNAPSHOT_ARCHIVE_INTERVAL_SECONDS the latest
+// poll's per-site verdicts, with hashes of the config files that produced
+// them, are written gzipped to
+//
+//	<prefix>YYYY/MM/DD/snapshot-YYYYMMDDTHHMMSSZ.json.gz
+//
+// using the S3_* settings. Objects older than
+// SNAPSHOT_ARCHIVE_RETENTION_DAYS are deleted once a day.
+// GET /api/v1/snapshots?at=<unix> returns the snapshot in force at that
+// time, so auditors can see what DTMS believed then.
+var (
+	snapshotArchiveURL       = envOr("SNAPSHOT_ARCHIVE", "")
+	snapshotArchiveInterval  = time.Duration(envOrInt("SNAPSHOT_ARCHIVE_INTERVAL_SECONDS", 300)) * time.Second
+	snapshotArchiveRetention = envOrInt("SNAPSHOT_ARCHIVE_RETENTION_DAYS", 400)
+)
+
+const snapshotKeyLayout = "2006/01/02/snapshot-20060102T150405Z.json.gz"
+
+// evaluatedSite is one site's verdict in a poll.
+type evaluatedSite struct {
+	Site            string  `json:"site"`
+	LatestTimestamp float64 `json:"latest_timestamp"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Threshold       float64 `json:"threshold_seconds"`
+	Ok              bool    `json:"ok"`
+	InDowntime      bool    `json:"in_downtime"`
+}
+
+type FreshnessSnapshot struct {
+	Evaluated float64           `json:"evaluated"`
+	Sites     []evaluatedSite   `json:"sites"`
+	Config    map[string]string `json:"config_sha256"`
+}
+
+var (
+	snapshotArchiveWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_snapshot_archive_writes_total", Help: "Freshness snapshots written to the archive by result"},
+		[]string{"result"},
+	)
+	snapshotArchiveLast = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "dtms_snapshot_archive_last_success_timestamp_seconds", Help: "When a snapshot was last archived"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(snapshotArchiveWrites, snapshotArchiveLast)
+}
+
+type snapshotArchive struct {
+	s3Settings
+	bucket, prefix string
+
+	mu     sync.Mutex
+	latest *FreshnessSnapshot
+}
+
+var snapshots = &snapshotArchive{}
+
+func loadSnapshotArchive() error {
+	if snapshotArchiveURL == "" {
+		return nil
+	}
+	rest, ok := strings.CutPrefix(snapshotArchiveURL, "s3://")
+	if !ok {
+		return fmt.Errorf("SNAPSHOT_ARCHIVE must be s3://bucket/prefix/")
+	}
+	snapshots.bucket, snapshots.prefix, _ = strings.Cut(rest, "/")
+	if snapshots.bucket == "" {
+		return fmt.Errorf("SNAPSHOT_ARCHIVE needs a bucket")
+	}
+	if snapshots.prefix != "" && !strings.HasSuffix(snapshots.prefix, "/") {
+		snapshots.prefix += "/"
+	}
+	snapshots.s3Settings = s3SettingsFromEnv()
+	return nil
+}
+
+func (a *snapshotArchive) enabled() bool { return a.bucket != "" }
+
+// Offer keeps the latest poll's verdicts for the next archive write.
+func (a *snapshotArchive) Offer(now time.Time, sites []evaluatedSite) {
+	if !a.enabled() {
+		return
+	}
+	a.mu.Lock()
+	a.latest = &FreshnessSnapshot{Evaluated: float64(now.Unix()), Sites: sites}
+	a.mu.Unlock()
+}
+
+// configHashes fingerprints the config files in effect.
+func configHashes() map[string]string {
+	out := map[string]string{}
+	for _, p := range configFiles() {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		out[p] = hex.EncodeToString(sum[:])
+	}
+	return out
+}
+
+func (a *snapshotArchive) write(ctx context.Context) error {
+	a.mu.Lock()
+	snap := a.latest
+	a.latest = nil
+	a.mu.Unlock()
+	if snap == nil {
+		return nil
+	}
+	snap.Config = configHashes()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	key := a.prefix + unixTime(snap.Evaluated).Format(snapshotKeyLayout)
+	return a.put(ctx, a.bucket, key, "application/gzip", buf.Bytes())
+}
+
+// expire deletes snapshots past retention. Keys sort by time, so the
+// listing stops at the first one to keep.
+func (a *snapshotArchive) expire(ctx context.Context, now time.Time) (int, error) {
+	if snapshotArchiveRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := a.prefix + now.UTC().AddDate(0, 0, -snapshotArchiveRetention).Format(snapshotKeyLayout)
+	keys, err := a.keys(ctx, a.bucket, a.prefix, "")
+	removed := 0
+	for _, k := range keys {
+		if k >= cutoff {
+			break
+		}
+		if err := a.remove(ctx, a.bucket, k); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, err
+}
+
+func (a *snapshotArchive) loop(ctx context.Context) {
+	t := time.NewTicker(snapshotArchiveInterval)
+	defer t.Stop()
+	var lastExpire time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := a.write(ctx); err != nil {
+			snapshotArchiveWrites.WithLabelValues("error").Inc()
+			fmt.Printf("[archive] write: %v\n", err)
+		} else {
+			snapshotArchiveWrites.WithLabelValues("ok").Inc()
+			snapshotArchiveLast.SetToCurrentTime()
+		}
+		if now := time.Now(); now.Sub(lastExpire) >= 24*time.Hour {
+			lastExpire = now
+			n, err := a.expire(ctx, now)
+			if err != nil {
+				fmt.Printf("[archive] expire: %v\n", err)
+			}
+			if n > 0 {
+				fmt.Printf("[archive] deleted %d snapshots past retention\n", n)
+			}
+		}
+	}
+}
+
+// at fetches the newest snapshot written at or before t, looking back
+// over the previous day's listing as well.
+func (a *snapshotArchive) at(ctx context.Context, t time.Time) (*FreshnessSnapshot, error) {
+	want := a.prefix + t.UTC().Format(snapshotKeyLayout)
+	var best string
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		keys, err := a.keys(ctx, a.bucket, a.prefix+day.UTC().Format("2006/01/02/"), "")
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k <= want {
+				best = k
+			}
+		}
+		if best != "" {
+			break
+		}
+	}
+	if best == "" {
+		return nil, os.ErrNotExist
+	}
+	raw, err := a.object(ctx, a.bucket, best)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var snap FreshnessSnapshot
+	return &snap, json.Unmarshal(body, &snap)
+}
+
+// handleSnapshots serves GET /api/v1/snapshots?at=<unix>, defaulting to now.
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !snapshots.enabled() {
+		http.Error(w, "snapshot archive not configured", http.StatusNotFound)
+		return
+	}
+	at := time.Unix(int64(queryInt(r, "at", int(time.Now().Unix()))), 0)
+	snap, err := snapshots.at(r.Context(), at)
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "no snapshot archived at or before that time", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(w, http.StatusOK, snap)
+	}
+}
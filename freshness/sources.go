@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Source is one origin of per-site freshness. Implementations register a
+// factory under a type name so they can be configured from SOURCES_CONFIG
+// without touching the poll loop.
+type Source interface {
+	Name() string
+	Collect(ctx context.Context) ([]SiteFresh, error)
+}
+
+// backgroundSource is implemented by sources that receive data between
+// polls, e.g. UDP listeners. Start runs until ctx is cancelled.
+type backgroundSource interface {
+	Start(ctx context.Context)
+}
+
+// sourceFactory builds a source from its YAML entry. params is the whole
+// entry, so type-specific keys sit next to name/type/interval.
+type sourceFactory func(name string, params *yaml.Node) (Source, error)
+
+var sourceFactories = map[string]sourceFactory{}
+
+func registerSource(typ string, f sourceFactory) {
+	if _, dup := sourceFactories[typ]; dup {
+		panic("duplicate source type " + typ)
+	}
+	sourceFactories[typ] = f
+}
+
+var sourcesConfig = envOr("SOURCES_CONFIG", "")
+
+// sourceConcurrency bounds how many sources collect at the same time.
+var sourceConcurrency = envOrInt("SOURCE_CONCURRENCY", 8)
+
+var (
+	histSourceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dtms_source_collect_duration_seconds",
+		Help:    "Time taken by each collection of a source",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"source"})
+	counterSourceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtms_source_collect_errors_total",
+		Help: "Failed collections by source and reason (error, timeout, panic, busy)",
+	}, []string{"source", "reason"})
+	gaugeSourceLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtms_source_last_success_timestamp_seconds",
+		Help: "Unix time of the source's last successful collection",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(histSourceDuration, counterSourceErrors, gaugeSourceLastSuccess)
+}
+
+// sourceConfig is one entry of the `sources:` list, e.g.
+//
+//	sources:
+//	  - name: lab-drop
+//	    type: files
+//	    interval: 2m
+//	    timeout: 20s
+//	    targets:
+//	      LEGACY_NFS: ["/mnt/nfs/drop/*.dat"]
+//
+// ${VAR} references are expanded from the environment before parsing.
+type sourceConfig struct {
+	Name     string        `yaml:"name"`
+	Type     string        `yaml:"type"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	params   yaml.Node
+}
+
+func (c *sourceConfig) UnmarshalYAML(n *yaml.Node) error {
+	type plain sourceConfig
+	if err := n.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.params = *n
+	return nil
+}
+
+// scheduledSource remembers a source's last result so sources with a
+// longer interval than the poll loop still contribute to every snapshot;
+// cached ages keep growing between collections.
+type scheduledSource struct {
+	Source
+	interval time.Duration
+	timeout  time.Duration
+	lastRun  time.Time
+	last     []SiteFresh
+	// running is set while a Collect is in flight, including one that
+	// outlived its timeout and was abandoned; the source is skipped until
+	// it returns so a hung source cannot pile up goroutines.
+	running sync.Mutex
+}
+
+func (s *scheduledSource) due(now time.Time) bool {
+	return s.lastRun.IsZero() || now.Sub(s.lastRun) >= s.interval
+}
+
+func (s *scheduledSource) collect(ctx context.Context, now time.Time) []SiteFresh {
+	if !s.due(now) {
+		elapsed := now.Sub(s.lastRun).Seconds()
+		out := make([]SiteFresh, len(s.last))
+		for i, sf := range s.last {
+			sf.AgeSeconds += elapsed
+			out[i] = sf
+		}
+		return out
+	}
+	s.lastRun = now
+	if !s.running.TryLock() {
+		counterSourceErrors.WithLabelValues(s.Name(), "busy").Inc()
+		fmt.Printf("[%s] previous collection still running, skipped\n", s.Name())
+		s.last = nil
+		return nil
+	}
+	cctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	type result struct {
+		sites    []SiteFresh
+		err      error
+		panicked bool
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	span := childOfPoll(ctx, "source.collect", start)
+	go func() {
+		defer s.running.Unlock()
+		defer func() {
+			if p := recover(); p != nil {
+				counterSourceErrors.WithLabelValues(s.Name(), "panic").Inc()
+				fmt.Printf("[%s] collect panic: %v\n%s", s.Name(), p, debug.Stack())
+				done <- result{err: fmt.Errorf("panic: %v", p), panicked: true}
+			}
+		}()
+		sites, err := s.Collect(cctx)
+		done <- result{sites: sites, err: err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+		observeCollect(s.Name(), time.Since(start), span)
+		switch {
+		case r.err == nil:
+			gaugeSourceLastSuccess.WithLabelValues(s.Name()).Set(float64(time.Now().Unix()))
+		case r.panicked:
+			// counted and logged with its stack by the recover above
+		case cctx.Err() == context.DeadlineExceeded:
+			counterSourceErrors.WithLabelValues(s.Name(), "timeout").Inc()
+			fmt.Printf("[%s] collect error: %v\n", s.Name(), r.err)
+		default:
+			counterSourceErrors.WithLabelValues(s.Name(), "error").Inc()
+			fmt.Printf("[%s] collect error: %v\n", s.Name(), r.err)
+		}
+	case <-cctx.Done():
+		// the source ignored its context; stop waiting for it
+		observeCollect(s.Name(), time.Since(start), span)
+		r.err = cctx.Err()
+		counterSourceErrors.WithLabelValues(s.Name(), "timeout").Inc()
+		fmt.Printf("[%s] collect timed out after %s\n", s.Name(), s.timeout)
+	}
+	if span != nil {
+		span.Attr("dtms.source", s.Name()).Attr("dtms.sites", len(r.sites))
+		tracer.Export(span.Finish(time.Now(), r.err))
+	}
+	s.last = r.sites
+	return r.sites
+}
+
+// collectAll runs the due sources on a pool of sourceConcurrency workers
+// and returns their sites in source order.
+func collectAll(ctx context.Context, sources []*scheduledSource, now time.Time) []SiteFresh {
+	results := make([][]SiteFresh, len(sources))
+	work := make(chan int)
+	workers := sourceConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(sources) {
+		workers = len(sources)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				results[j] = sources[j].collect(ctx, now)
+			}
+		}()
+	}
+	for j := range sources {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	var sites []SiteFresh
+	for _, r := range results {
+		sites = append(sites, r...)
+	}
+	return sites
+}
+
+func loadSources() ([]*scheduledSource, error) {
+	if sourcesConfig == "" {
+		return scheduleAll(envSources()), nil
+	}
+	raw, err := os.ReadFile(sourcesConfig)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Sources []sourceConfig `yaml:"sources"`
+	}
+	if err := yamlenv.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", sourcesConfig, err)
+	}
+
+	var out []*scheduledSource
+	seen := map[string]bool{}
+	for _, c := range doc.Sources {
+		factory, ok := sourceFactories[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("source %q: unknown type %q", c.Name, c.Type)
+		}
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate source name %q", c.Name)
+		}
+		seen[c.Name] = true
+		src, err := factory(c.Name, &c.params)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", c.Name, err)
+		}
+		out = append(out, newScheduled(src, c.Interval, c.Timeout))
+	}
+	return out, nil
+}
+
+// envSources keeps deployments without SOURCES_CONFIG working: dtms-api is
+// always polled and every collector whose *_TARGETS variable is set is added.
+func envSources() []Source {
+	srcs := []Source{&apiSource{name: "dtms-api", BaseURL: apiBaseURL}}
+	if kafkaLagTargets != "" {
+		srcs = append(srcs, kafkaLagFromEnv())
+	}
+	if s3Targets != "" {
+		srcs = append(srcs, s3FromEnv())
+	}
+	if fileTargets != "" {
+		srcs = append(srcs, fileFromEnv())
+	}
+	if httpTargets != "" {
+		srcs = append(srcs, httpFromEnv())
+	}
+	if dbTargets != "" {
+		srcs = append(srcs, dbFromEnv())
+	}
+	return srcs
+}
+
+func scheduleAll(srcs []Source) []*scheduledSource {
+	out := make([]*scheduledSource, 0, len(srcs))
+	for _, s := range srcs {
+		out = append(out, newScheduled(s, 0, 0))
+	}
+	return out
+}
+
+func newScheduled(s Source, every, timeout time.Duration) *scheduledSource {
+	if every <= 0 {
+		every = time.Duration(interval) * time.Second
+	}
+	if timeout <= 0 {
+		timeout = every
+	}
+	return &scheduledSource{Source: s, interval: every, timeout: timeout}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// storageProbeSource performs a cheap liveness check against each storage
+// endpoint so staleness can be told apart from dead storage:
+//
+//	s3       signed HEAD on the bucket URL
+//	webdav   PROPFIND with Depth: 0
+//	xrootd   stat via stat_command (gfal-stat by default)
+//	gridftp  MLST via stat_command
+type storageProbeSource struct {
+	name        string
+	s3Settings  `yaml:",inline"`
+	CAFile      string            `yaml:"ca_file"`
+	CertFile    string            `yaml:"cert_file"`
+	KeyFile     string            `yaml:"key_file"`
+	StatCommand []string          `yaml:"stat_command"`
+	Endpoints   []storageEndpoint `yaml:"endpoints"`
+
+	http *http.Client
+}
+
+type storageEndpoint struct {
+	Site     string `yaml:"site"`
+	Protocol string `yaml:"protocol"`
+	URL      string `yaml:"url"`
+}
+
+var (
+	gaugeStorageUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_storage_up", Help: "1 if the storage endpoint answered its probe"},
+		[]string{"site", "protocol", "endpoint"},
+	)
+	gaugeStorageLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_storage_probe_latency_seconds", Help: "Response time of the last storage endpoint probe"},
+		[]string{"site", "protocol", "endpoint"},
+	)
+)
+
+// storageProbeResult is an endpoint's last probe, kept for stale-site hints.
+type storageProbeResult struct {
+	Site     string  `json:"site"`
+	Protocol string  `json:"protocol"`
+	Endpoint string  `json:"endpoint"`
+	Up       bool    `json:"up"`
+	Error    string  `json:"error,omitempty"`
+	Checked  float64 `json:"checked"`
+}
+
+var storageProbes = struct {
+	sync.Mutex
+	last map[string]storageProbeResult
+}{last: map[string]storageProbeResult{}}
+
+// storageProbesFor returns the last probe of each of site's endpoints.
+func storageProbesFor(site string) []storageProbeResult {
+	storageProbes.Lock()
+	defer storageProbes.Unlock()
+	var out []storageProbeResult
+	for _, r := range storageProbes.last {
+		if r.Site == site {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func init() {
+	prometheus.MustRegister(gaugeStorageUp, gaugeStorageLatency)
+	registerSource("storage-probe", func(name string, params *yaml.Node) (Source, error) {
+		s := &storageProbeSource{name: name, s3Settings: s3SettingsFromEnv(), StatCommand: []string{"gfal-stat"}}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		for _, e := range s.Endpoints {
+			switch e.Protocol {
+			case "s3", "webdav", "xrootd", "gridftp":
+			default:
+				return nil, fmt.Errorf("endpoint %s: unknown protocol %q", e.URL, e.Protocol)
+			}
+		}
+		var err error
+		s.http, err = httpClientFor(s.CAFile, s.CertFile, s.KeyFile)
+		return s, err
+	})
+}
+
+func (s *storageProbeSource) Name() string { return s.name }
+
+func (s *storageProbeSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	var wg sync.WaitGroup
+	for _, e := range s.Endpoints {
+		wg.Add(1)
+		go func(e storageEndpoint) {
+			defer wg.Done()
+			start := time.Now()
+			err := s.probe(ctx, e)
+			gaugeStorageLatency.WithLabelValues(e.Site, e.Protocol, e.URL).Set(time.Since(start).Seconds())
+			gaugeStorageUp.WithLabelValues(e.Site, e.Protocol, e.URL).Set(boolFloat(err == nil))
+			r := storageProbeResult{Site: e.Site, Protocol: e.Protocol, Endpoint: e.URL, Up: err == nil, Checked: float64(time.Now().Unix())}
+			if err != nil {
+				r.Error = err.Error()
+				fmt.Printf("[storage-probe] %s %s: %v\n", e.Site, e.URL, err)
+			}
+			storageProbes.Lock()
+			storageProbes.last[e.Site+" "+e.URL] = r
+			storageProbes.Unlock()
+		}(e)
+	}
+	wg.Wait()
+	return nil, nil
+}
+
+func (s *storageProbeSource) probe(ctx context.Context, e storageEndpoint) error {
+	switch e.Protocol {
+	case "s3":
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, e.URL, nil)
+		if err != nil {
+			return err
+		}
+		if s.AccessKeyID != "" {
+			signV4(req, s.credentials(), s.Region, "s3", emptyPayloadHash, time.Now())
+		}
+		return s.expect(req, http.StatusOK)
+	case "webdav":
+		req, err := http.NewRequestWithContext(ctx, "PROPFIND", e.URL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Depth", "0")
+		return s.expect(req, http.StatusMultiStatus)
+	default:
+		args := append(append([]string{}, s.StatCommand[1:]...), e.URL)
+		out, err := exec.CommandContext(ctx, s.StatCommand[0], args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+func (s *storageProbeSource) expect(req *http.Request, status int) error {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s: %s", req.Method, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+)
+
+// SUBSCRIPTIONS_CONFIG holds replication rules: every dataset matching
+// pattern must have arrived at each target site within `within` of its
+// creation. Targets are listed or selected by site tags from SITES_CONFIG
+// (a tag selector, or the older site_metadata map):
+//
+//	subscriptions:
+//	  - name: raw-to-tier1
+//	    pattern: ^raw-
+//	    tags: tier=1,!decommissioned
+//	    within: 6h
+//	    trigger_url: https://orchestrator.example.org/replicate
+//
+// A dataset's creation is its manifest's, else its first arrival anywhere.
+// With trigger_url set, each new violation is POSTed there once, as JSON
+// or as rendered by trigger_template (templates.go, with the violation as
+// .Data); with
+// request_transfer set, a transfer request is queued from the site holding
+// the freshest copy.
+var subscriptionsPath = envOr("SUBSCRIPTIONS_CONFIG", "")
+
+type subscription struct {
+	Name         string            `yaml:"name"`
+	Pattern      string            `yaml:"pattern"`
+	Sites        []string          `yaml:"sites"`
+	SiteMetadata map[string]string `yaml:"site_metadata"`
+	Tags         string            `yaml:"tags"`
+	Within       time.Duration     `yaml:"within"`
+	TriggerURL   string            `yaml:"trigger_url"`
+	TriggerTmpl  string            `yaml:"trigger_template"`
+	Request      bool              `yaml:"request_transfer"`
+	Priority     int               `yaml:"priority"`
+	Tenant       string            `yaml:"tenant"`
+
+	re      *regexp.Regexp
+	sel     tagSelector
+	trigger *texttemplate.Template
+}
+
+// SubscriptionViolation is a dataset missing at a target site past its
+// deadline.
+type SubscriptionViolation struct {
+	Subscription string  `json:"subscription"`
+	Dataset      string  `json:"dataset"`
+	Site         string  `json:"site"`
+	Created      float64 `json:"created"`
+	Deadline     float64 `json:"deadline"`
+	Overdue      float64 `json:"overdue_seconds"`
+}
+
+var (
+	gaugeSubscriptionViolations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_subscription_violations", Help: "Datasets missing at a subscribed site past the rule's deadline"},
+		[]string{"subscription"},
+	)
+	gaugeSubscriptionPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_subscription_pending", Help: "Datasets not yet at a subscribed site but still within the deadline"},
+		[]string{"subscription"},
+	)
+	subscriptionTriggers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_subscription_triggers_total", Help: "Violation notifications sent to trigger URLs by result"},
+		[]string{"subscription", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeSubscriptionViolations, gaugeSubscriptionPending, subscriptionTriggers)
+}
+
+type subscriptionEngine struct {
+	mu         sync.Mutex
+	rules      []subscription
+	violations []SubscriptionViolation
+	triggered  map[string]bool
+}
+
+var subscriptions = &subscriptionEngine{triggered: map[string]bool{}}
+
+func loadSubscriptions() error {
+	if subscriptionsPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(subscriptionsPath)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Subscriptions []subscription `yaml:"subscriptions"`
+	}
+	if err := yamlenv.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("%s: %w", subscriptionsPath, err)
+	}
+	for i := range f.Subscriptions {
+		s := &f.Subscriptions[i]
+		if s.Name == "" || s.Within <= 0 {
+			return fmt.Errorf("%s: subscriptions need a name and within", subscriptionsPath)
+		}
+		if s.re, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("%s: subscription %s: %w", subscriptionsPath, s.Name, err)
+		}
+		if s.sel, err = parseTagSelector(s.Tags); err != nil {
+			return fmt.Errorf("%s: subscription %s: %w", subscriptionsPath, s.Name, err)
+		}
+		if s.TriggerTmpl != "" {
+			if s.trigger, err = parseMessageTemplate(s.Name, s.TriggerTmpl); err != nil {
+				return fmt.Errorf("%s: subscription %s: %w", subscriptionsPath, s.Name, err)
+			}
+		}
+	}
+	subscriptions.rules = f.Subscriptions
+	return nil
+}
+
+func (s subscription) targets() []string {
+	if len(s.Sites) > 0 {
+		return s.Sites
+	}
+	if len(s.sel) > 0 {
+		return siteRegistry().sitesSelected(s.sel)
+	}
+	return siteRegistry().sitesMatching(s.SiteMetadata)
+}
+
+// Evaluate checks every rule against the datasets seen so far.
+func (e *subscriptionEngine) Evaluate(ctx context.Context, now time.Time) {
+	placements := lineage.Placements()
+	type trigger struct {
+		url  string
+		tmpl *texttemplate.Template
+		v    SubscriptionViolation
+	}
+	var all []SubscriptionViolation
+	var fresh []trigger
+	e.mu.Lock()
+	active := map[string]bool{}
+	for _, rule := range e.rules {
+		violations, pending := 0, 0
+		for dataset, sites := range placements {
+			if !rule.re.MatchString(dataset) {
+				continue
+			}
+			created, ok := completeness.Created(dataset)
+			if !ok {
+				for _, a := range sites {
+					if created == 0 || a.First < created {
+						created = a.First
+					}
+				}
+			}
+			deadline := created + rule.Within.Seconds()
+			for _, site := range rule.targets() {
+				if _, arrived := sites[site]; arrived {
+					continue
+				}
+				if float64(now.Unix()) <= deadline {
+					pending++
+					continue
+				}
+				violations++
+				v := SubscriptionViolation{rule.Name, dataset, site, created, deadline, float64(now.Unix()) - deadline}
+				all = append(all, v)
+				key := rule.Name + "|" + dataset + "|" + site
+				active[key] = true
+				if e.triggered[key] {
+					continue
+				}
+				if rule.Request {
+					requestReplication(rule, v, sites)
+				}
+				if rule.TriggerURL != "" {
+					fresh = append(fresh, trigger{rule.TriggerURL, rule.trigger, v})
+				} else {
+					e.triggered[key] = true
+				}
+			}
+		}
+		gaugeSubscriptionViolations.WithLabelValues(rule.Name).Set(float64(violations))
+		gaugeSubscriptionPending.WithLabelValues(rule.Name).Set(float64(pending))
+	}
+	for key := range e.triggered {
+		if !active[key] {
+			delete(e.triggered, key)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Overdue > all[j].Overdue })
+	e.violations = all
+	e.mu.Unlock()
+
+	for _, t := range fresh {
+		v := t.v
+		if err := postTrigger(ctx, t.url, t.tmpl, v); err != nil {
+			subscriptionTriggers.WithLabelValues(v.Subscription, "error").Inc()
+			fmt.Printf("[subscriptions] trigger %s %s@%s: %v\n", v.Subscription, v.Dataset, v.Site, err)
+			continue
+		}
+		subscriptionTriggers.WithLabelValues(v.Subscription, "sent").Inc()
+		e.mu.Lock()
+		e.triggered[v.Subscription+"|"+v.Dataset+"|"+v.Site] = true
+		e.mu.Unlock()
+	}
+}
+
+// requestReplication queues a transfer for v unless one is already open.
+func requestReplication(rule subscription, v SubscriptionViolation, sites map[string]datasetArrivals) {
+	for _, r := range transferRequests.List("", v.Dataset) {
+		if r.Destination == v.Site && !r.finished() {
+			return
+		}
+	}
+	source, latest := "", 0.0
+	for site, a := range sites {
+		if a.Latest > latest {
+			source, latest = site, a.Latest
+		}
+	}
+	if source == "" {
+		return
+	}
+	r, err := transferRequests.Create(TransferRequest{Source: source, Destination: v.Site, Dataset: v.Dataset, Priority: rule.Priority, Tenant: rule.Tenant}, "")
+	if err != nil {
+		fmt.Printf("[subscriptions] request %s@%s: %v\n", v.Dataset, v.Site, err)
+		return
+	}
+	fmt.Printf("[subscriptions] %s: queued %s %s %s->%s\n", rule.Name, r.ID, v.Dataset, source, v.Site)
+}
+
+func postTrigger(ctx context.Context, url string, tmpl *texttemplate.Template, v SubscriptionViolation) error {
+	body, _ := json.Marshal(v)
+	ctype := "application/json"
+	if tmpl != nil {
+		data := siteMessage(v.Site, time.Now())
+		data.Event, data.Data = "subscription.violation", v
+		text, err := renderTemplate(tmpl, data)
+		if err != nil {
+			return err
+		}
+		body, ctype = []byte(text), triggerContentType(text)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ctype)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST: %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *subscriptionEngine) Violations(name string) []SubscriptionViolation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := []SubscriptionViolation{}
+	for _, v := range e.violations {
+		if name == "" || v.Subscription == name {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (e *subscriptionEngine) loop(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		e.Evaluate(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleSubscriptionViolations serves GET
+// /api/v1/subscriptions/violations?subscription=.
+func handleSubscriptionViolations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"violations": subscriptions.Violations(r.URL.Query().Get("subscription")),
+	})
+}
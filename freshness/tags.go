@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sites carry free-form key/value tags, set under `tags:` in SITES_CONFIG
+// (`metadata:` is the older spelling and is still read; the two are
+// merged). Anything that picks out a set of sites takes a tag selector: a
+// comma-separated list of terms that must all hold.
+//
+//	tier=1           tag tier is 1
+//	region!=us-east  tag region is missing or anything but us-east
+//	gpu              tag gpu is set
+//	!decommissioned  tag decommissioned is not set
+//	vo=atlas         the site serves VO atlas, one of those in its vo tag
+//
+// Selectors are accepted as ?tags= by /api/v1/sites, /api/v1/incidents,
+// /api/v1/slo and /api/v1/reports/sla, and as `tags:` by report tenants and
+// subscriptions, and grouped by with a report tenant's `group_by:`. Where
+// ?tags= is accepted, ?vo=NAME adds the term vo=NAME.
+//
+// METRICS_SITE_TAGS limits the per-site freshness gauges to the sites it
+// selects; groups and fleet figures still count every site.
+// METRICS_TAG_LABELS lists tags exported as labels of dtms_site_tags, so
+// alert rules can join them in and Alertmanager route on them:
+//
+//	(dtms_data_fresh_ok == 0) * on (site) group_left (tier, region) dtms_site_tags
+var (
+	metricsSiteTags     = envOr("METRICS_SITE_TAGS", "")
+	metricsTagLabelList = envOr("METRICS_TAG_LABELS", "")
+)
+
+// Parsed from the settings above by validateTagSettings.
+var (
+	metricsSiteSelector tagSelector
+	metricsTagLabels    []string
+)
+
+var promLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type tagTerm struct {
+	key    string
+	value  string
+	exists bool // key alone: set or, negated, not set
+	negate bool
+}
+
+// tagSelector is a parsed selector; the empty selector selects every site.
+type tagSelector []tagTerm
+
+func parseTagSelector(s string) (tagSelector, error) {
+	var sel tagSelector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var t tagTerm
+		switch {
+		case strings.Contains(part, "!="):
+			t.key, t.value, _ = strings.Cut(part, "!=")
+			t.negate = true
+		case strings.Contains(part, "="):
+			t.key, t.value, _ = strings.Cut(part, "=")
+		case strings.HasPrefix(part, "!"):
+			t.key, t.exists, t.negate = part[1:], true, true
+		default:
+			t.key, t.exists = part, true
+		}
+		t.key, t.value = strings.TrimSpace(t.key), strings.TrimSpace(t.value)
+		if t.key == "" {
+			return nil, fmt.Errorf("tag selector %q: term %q has no tag name", s, part)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+func (sel tagSelector) matches(tags map[string]string) bool {
+	for _, t := range sel {
+		v, set := tags[t.key]
+		ok := set
+		if !t.exists {
+			ok = set && (v == t.value || t.key == voTagKey && hasVO(v, t.value))
+		}
+		if ok == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether site's effective tags match.
+func (sel tagSelector) selects(site string) bool {
+	return len(sel) == 0 || sel.matches(siteRegistry().lookup(site).Metadata)
+}
+
+// sitesSelected returns the configured sites sel matches, sorted by name.
+func (r *sitesFile) sitesSelected(sel tagSelector) []string {
+	var out []string
+	for site := range r.Sites {
+		if sel.matches(r.lookup(site).Metadata) {
+			out = append(out, site)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// queryTags parses the request's ?tags= selector, narrowed to ?vo= when
+// that is set.
+func queryTags(r *http.Request) (tagSelector, error) {
+	sel, err := parseTagSelector(r.URL.Query().Get("tags"))
+	if vo := r.URL.Query().Get("vo"); vo != "" && err == nil {
+		sel = append(sel, tagTerm{key: voTagKey, value: vo})
+	}
+	return sel, err
+}
+
+func validateTagSettings() error {
+	sel, err := parseTagSelector(metricsSiteTags)
+	if err != nil {
+		return fmt.Errorf("METRICS_SITE_TAGS: %w", err)
+	}
+	metricsSiteSelector = sel
+	for _, l := range strings.Split(metricsTagLabelList, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		metricsTagLabels = append(metricsTagLabels, l)
+		if !promLabelName.MatchString(l) || l == "site" {
+			return fmt.Errorf("METRICS_TAG_LABELS: %q cannot be a label name", l)
+		}
+	}
+	return nil
+}
+
+func collectSiteTags(ch chan<- prometheus.Metric, sites map[string]siteMetrics) {
+	if len(metricsTagLabels) == 0 {
+		return
+	}
+	desc := prometheus.NewDesc("dtms_site_tags", "Always 1; carries the site's tags named in METRICS_TAG_LABELS as labels", append([]string{"site"}, metricsTagLabels...), nil)
+	for site := range sites {
+		if !metricsSiteSelector.selects(site) {
+			continue
+		}
+		tags := siteRegistry().lookup(site).Metadata
+		values := []string{site}
+		for _, l := range metricsTagLabels {
+			values = append(values, tags[l])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
+
+// SiteTags is one site's tags and freshness at the last poll.
+type SiteTags struct {
+	Site       string            `json:"site"`
+	Tags       map[string]string `json:"tags"`
+	AgeSeconds *float64          `json:"age_seconds,omitempty"`
+	Ok         *bool             `json:"ok,omitempty"`
+	InDowntime bool              `json:"in_downtime"`
+	// Evaluated is when the age was measured, unset until a poll has.
+	Evaluated float64 `json:"evaluated,omitempty"`
+}
+
+// handleSites serves GET /api/v1/sites?tags=, every configured or polled
+// site the selector matches.
+func handleSites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sites": listSites(sel)})
+}
+
+// listSites returns every configured or polled site sel matches, with its
+// state at the last poll.
+func listSites(sel tagSelector) []SiteTags {
+	polled := map[string]siteMetrics{}
+	if m := currentMetrics.Load(); m != nil {
+		polled = m.sites
+	}
+	reg := siteRegistry()
+	names := map[string]bool{}
+	for site := range reg.Sites {
+		names[site] = true
+	}
+	for site := range polled {
+		names[site] = true
+	}
+	out := []SiteTags{}
+	for site := range names {
+		tags := reg.lookup(site).Metadata
+		if !sel.matches(tags) {
+			continue
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		s := SiteTags{Site: site, Tags: tags}
+		if m, ok := polled[site]; ok {
+			s.AgeSeconds, s.Ok, s.InDowntime = &m.Age, &m.Ok, m.InDowntime
+			s.Evaluated = float64(m.Evaluated.UnixNano()) / 1e9
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	return out
+}
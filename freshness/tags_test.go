@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseTagSelector(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    tagSelector
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"tier=1", tagSelector{{key: "tier", value: "1"}}, false},
+		{" tier = 1 , region!=us-east", tagSelector{{key: "tier", value: "1"}, {key: "region", value: "us-east", negate: true}}, false},
+		{"gpu,!decommissioned", tagSelector{{key: "gpu", exists: true}, {key: "decommissioned", exists: true, negate: true}}, false},
+		{"owner=", tagSelector{{key: "owner"}}, false},
+		{"=1", nil, true},
+		{"!=1", nil, true},
+		{"!", nil, true},
+		{"tier=1,=2", nil, true},
+	} {
+		got, err := parseTagSelector(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseTagSelector(%q): err %v, want error %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("parseTagSelector(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestTagSelectorMatches(t *testing.T) {
+	tags := map[string]string{"tier": "1", "region": "eu-west", "gpu": "", "vo": "atlas,cms", "owner": ""}
+	for _, tc := range []struct {
+		sel  string
+		want bool
+	}{
+		{"", true},
+		{"tier=1", true},
+		{"tier=2", false},
+		{"tier!=2", true},
+		{"tier!=1", false},
+		{"zone!=a", true}, // missing counts as not equal
+		{"zone=", false},  // but not as empty
+		{"owner=", true},
+		{"gpu", true},
+		{"!gpu", false},
+		{"decommissioned", false},
+		{"!decommissioned", true},
+		{"tier=1,region=eu-west,gpu", true},
+		{"tier=1,region=us-east", false},
+		{"vo=atlas", true},
+		{"vo=cms", true},
+		{"vo=lhcb", false},
+		{"vo=atl", false},
+		{"vo!=lhcb", true},
+		{"vo!=cms", false},
+		{"vo=atlas,cms", false}, // two terms; "cms" is not a tag
+		{"vo", true},
+	} {
+		sel, err := parseTagSelector(tc.sel)
+		if err != nil {
+			t.Fatalf("parseTagSelector(%q): %v", tc.sel, err)
+		}
+		if got := sel.matches(tags); got != tc.want {
+			t.Errorf("%q matches = %v, want %v", tc.sel, got, tc.want)
+		}
+	}
+	// only the vo tag is a list
+	if sel, _ := parseTagSelector("region=eu"); sel.matches(map[string]string{"region": "eu,us"}) {
+		t.Error("region=eu matched region eu,us")
+	}
+}
+
+func TestSitesSelected(t *testing.T) {
+	var f sitesFile
+	if err := yaml.Unmarshal([]byte(`
+defaults:
+  tags: {tier: "2"}
+sites:
+  SITE_A:
+    tags: {tier: "1", region: eu-west}
+    vos: [cms, atlas]
+  SITE_B:
+    metadata: {region: us-east}
+    vos: [lhcb]
+  SITE_C:
+    tags: {decommissioned: "yes"}
+`), &f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Defaults.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range f.Sites {
+		if err := c.compile(); err != nil {
+			t.Fatal(err)
+		}
+		f.Sites[name] = c
+	}
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"SITE_A", "SITE_B", "SITE_C"}},
+		{"tags=tier%3D2", []string{"SITE_B", "SITE_C"}},
+		{"tags=region!%3Dus-east", []string{"SITE_A", "SITE_C"}},
+		{"tags=!decommissioned", []string{"SITE_A", "SITE_B"}},
+		{"vo=atlas", []string{"SITE_A"}},
+		{"tags=tier%3D2&vo=lhcb", []string{"SITE_B"}},
+		{"tags=tier%3D1&vo=lhcb", nil},
+	} {
+		sel, err := queryTags(httptest.NewRequest("GET", "/api/v1/sites?"+tc.query, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if got := f.sitesSelected(sel); !slices.Equal(got, tc.want) {
+			t.Errorf("?%s selected %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
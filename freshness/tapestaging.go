@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// tapeStagingSource exports a tape-backed site's staging (recall) queue so
+// freshness violations there can be explained by a backed-up queue:
+//
+//	backend: dcache  frontend REST /api/v1/restores
+//	backend: cta     `cta-admin --json showqueues`, RETRIEVE queues
+//	backend: exec    any command printing
+//	                 [{"queued": 12, "oldest_age_seconds": 3600}]
+//
+// HPSS has no public API and is covered by the exec backend.
+type tapeStagingSource struct {
+	name     string
+	Site     string   `yaml:"site"`
+	Backend  string   `yaml:"backend"`
+	URL      string   `yaml:"url"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Command  []string `yaml:"command"`
+	VO       string   `yaml:"vo"`
+}
+
+var (
+	gaugeStagingQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_tape_staging_queued_requests", Help: "Outstanding tape staging (recall) requests"},
+		[]string{"site"},
+	)
+	gaugeStagingOldest = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_tape_staging_oldest_request_age_seconds", Help: "Age of the oldest outstanding tape staging request"},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeStagingQueued, gaugeStagingOldest)
+	registerSource("tape-staging", func(name string, params *yaml.Node) (Source, error) {
+		s := &tapeStagingSource{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.Site == "" {
+			return nil, fmt.Errorf("site is required")
+		}
+		switch s.Backend {
+		case "dcache":
+			if s.URL == "" {
+				return nil, fmt.Errorf("url is required for dcache")
+			}
+		case "cta":
+			if len(s.Command) == 0 {
+				s.Command = []string{"cta-admin", "--json", "showqueues"}
+			}
+		case "exec":
+			if len(s.Command) == 0 {
+				return nil, fmt.Errorf("command is required for exec")
+			}
+		default:
+			return nil, fmt.Errorf("unknown backend %q", s.Backend)
+		}
+		return s, nil
+	})
+}
+
+func (s *tapeStagingSource) Name() string { return s.name }
+
+func (s *tapeStagingSource) Collect(ctx context.Context) ([]SiteFresh, error) {
+	var queued int
+	var oldest float64
+	var err error
+	switch s.Backend {
+	case "dcache":
+		queued, oldest, err = s.dcacheRestores(ctx)
+	case "cta":
+		queued, oldest, err = s.ctaQueues(ctx)
+	default:
+		queued, oldest, err = s.execQueues(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gaugeStagingQueued.WithLabelValues(s.Site).Set(float64(queued))
+	gaugeStagingOldest.WithLabelValues(s.Site).Set(oldest)
+	return nil, nil
+}
+
+func (s *tapeStagingSource) dcacheRestores(ctx context.Context) (int, float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.URL, "/")+"/api/v1/restores", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("restores: %s", resp.Status)
+	}
+	var restores []struct {
+		Started int64 `json:"started"` // epoch milliseconds
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&restores); err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	oldest := 0.0
+	for _, r := range restores {
+		if age := now.Sub(time.UnixMilli(r.Started)).Seconds(); r.Started > 0 && age > oldest {
+			oldest = age
+		}
+	}
+	return len(restores), oldest, nil
+}
+
+func (s *tapeStagingSource) ctaQueues(ctx context.Context) (int, float64, error) {
+	out, err := s.run(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	var queues []struct {
+		MountType   string      `json:"mountType"`
+		VO          string      `json:"vo"`
+		QueuedFiles json.Number `json:"queuedFiles"`
+		OldestAge   json.Number `json:"oldestAge"`
+	}
+	if err := json.Unmarshal(out, &queues); err != nil {
+		return 0, 0, err
+	}
+	queued, oldest := 0, 0.0
+	for _, q := range queues {
+		if !strings.Contains(q.MountType, "RETRIEVE") || (s.VO != "" && q.VO != s.VO) {
+			continue
+		}
+		n, _ := q.QueuedFiles.Int64()
+		age, _ := q.OldestAge.Float64()
+		queued += int(n)
+		if age > oldest {
+			oldest = age
+		}
+	}
+	return queued, oldest, nil
+}
+
+func (s *tapeStagingSource) execQueues(ctx context.Context) (int, float64, error) {
+	out, err := s.run(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows []struct {
+		Queued    int     `json:"queued"`
+		OldestAge float64 `json:"oldest_age_seconds"`
+	}
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return 0, 0, err
+	}
+	queued, oldest := 0, 0.0
+	for _, r := range rows {
+		queued += r.Queued
+		if r.OldestAge > oldest {
+			oldest = r.OldestAge
+		}
+	}
+	return queued, oldest, nil
+}
+
+func (s *tapeStagingSource) run(ctx context.Context) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", s.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/youruser/dtms-fresh/events"
+)
+
+// Notification texts and report sections can be written as Go templates:
+// alert routes' `template`, plugins' `template`, subscriptions'
+// `trigger_template`, and reports' `subject` and `intro`. Message
+// templates see a messageData: .Event, .Time, .Site, .Metadata (the
+// site's metadata and tags), .Threshold, .Incident, .Data (the event's
+// payload), .Links and .Stats (24h and 7d figures from the history).
+// Report templates see .Report, the SLAReport, and .Links. Both have the
+// functions in templateFuncs: a subset of sprig's (upper, trimPrefix,
+// default, ternary, join, dict, toJson, date, ago, addf, round, ...) with
+// sprig's names and argument order but implemented here, plus pct,
+// humanDuration and `site NAME`, which gives any site's messageData.
+//
+// Links point into PUBLIC_URL, the address the service is reached at,
+// and DASHBOARD_URL, with {site} replaced, when set. POST
+// /api/v1/templates/render previews a template against live data, which
+// is what `dtmsctl template test` uses.
+var (
+	publicURL    = strings.TrimRight(envOr("PUBLIC_URL", "http://freshness:"+port), "/")
+	dashboardURL = envOr("DASHBOARD_URL", "")
+)
+
+type messageLinks struct {
+	History   string
+	Incident  string
+	Dashboard string
+}
+
+type messageStats struct {
+	Availability24h float64
+	Availability7d  float64
+	MeanAge24h      float64
+	MaxAge24h       float64
+	Samples24h      int
+}
+
+type messageData struct {
+	Event     string
+	Time      time.Time
+	Site      string
+	Metadata  map[string]string
+	Threshold float64
+	Incident  *Incident
+	Data      interface{}
+	Links     messageLinks
+
+	stats *messageStats
+}
+
+// siteMessage describes site at now, without an event.
+func siteMessage(site string, now time.Time) *messageData {
+	cfg := siteRegistry().lookup(site)
+	d := &messageData{Time: now, Site: site, Metadata: cfg.Metadata, Threshold: cfg.Threshold}
+	if d.Metadata == nil {
+		d.Metadata = map[string]string{}
+	}
+	d.Links.History = publicURL + "/api/v1/history?site=" + url.QueryEscape(site)
+	if dashboardURL != "" {
+		d.Links.Dashboard = strings.ReplaceAll(dashboardURL, "{site}", url.QueryEscape(site))
+	}
+	return d
+}
+
+// eventMessage describes a bus event.
+func eventMessage(ev events.Event) *messageData {
+	d := siteMessage(ev.Site, ev.Time)
+	d.Event, d.Data = ev.Type, ev.Data
+	if inc, ok := ev.Data.(Incident); ok {
+		d.Incident = &inc
+		d.Links.Incident = publicURL + "/api/v1/incidents/" + inc.ID
+	}
+	return d
+}
+
+// Stats reads the site's history the first time a template asks.
+func (d *messageData) Stats() messageStats {
+	if d.stats != nil {
+		return *d.stats
+	}
+	d.stats = &messageStats{}
+	samples, err := history.Query(d.Site, d.Time.Add(-7*24*time.Hour), d.Time)
+	if err != nil {
+		return *d.stats
+	}
+	dayAgo := float64(d.Time.Add(-24 * time.Hour).Unix())
+	var ok7, ok24, sumAge float64
+	for _, s := range samples {
+		if s.Ok {
+			ok7++
+		}
+		if s.Timestamp < dayAgo {
+			continue
+		}
+		d.stats.Samples24h++
+		sumAge += s.AgeSeconds
+		d.stats.MaxAge24h = math.Max(d.stats.MaxAge24h, s.AgeSeconds)
+		if s.Ok {
+			ok24++
+		}
+	}
+	if len(samples) > 0 {
+		d.stats.Availability7d = ok7 / float64(len(samples))
+	}
+	if n := float64(d.stats.Samples24h); n > 0 {
+		d.stats.Availability24h = ok24 / n
+		d.stats.MeanAge24h = sumAge / n
+	}
+	return *d.stats
+}
+
+// reportMessageData is what report templates see.
+type reportMessageData struct {
+	Report SLAReport
+	Links  struct{ Report string }
+}
+
+func reportMessage(r SLAReport) reportMessageData {
+	d := reportMessageData{Report: r}
+	d.Links.Report = fmt.Sprintf("%s/api/v1/reports/sla?tenant=%s&period=%s&end=%d",
+		publicURL, url.QueryEscape(r.Tenant), r.Period, r.To.Unix())
+	return d
+}
+
+func parseMessageTemplate(name, text string) (*texttemplate.Template, error) {
+	return texttemplate.New(name).Funcs(texttemplate.FuncMap(templateFuncs)).Option("missingkey=zero").Parse(text)
+}
+
+func parseHTMLTemplate(name, text string) (*htmltemplate.Template, error) {
+	return htmltemplate.New(name).Funcs(htmltemplate.FuncMap(templateFuncs)).Option("missingkey=zero").Parse(text)
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// triggerContentType is the type of a rendered body: JSON when it parses
+// as JSON, plain text otherwise.
+func triggerContentType(body string) string {
+	if json.Valid([]byte(body)) {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+func renderTemplate(t executor, data interface{}) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templateFuncs are the template functions. Those named after sprig's take
+// the same arguments but are not the library, and differ where sprig is
+// surprising: add, sub, mul, div, mod, max and min stay integers only when
+// every operand is one and otherwise work in float64 rather than
+// truncating; trunc and abbrev count runes, not bytes; get, hasKey and
+// keys take any map keyed by strings, .Metadata included.
+var templateFuncs = map[string]interface{}{
+	// dtms
+	"pct":           pct,
+	"humanDuration": humanSeconds,
+	"site":          func(name string) *messageData { return siteMessage(name, time.Now()) },
+
+	// strings
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cut, s string) string { return strings.Trim(s, cut) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(sub, s string) bool { return strings.Contains(s, sub) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"repeat":     func(n int, s string) string { return strings.Repeat(s, max(n, 0)) },
+	"quote":      func(s interface{}) string { return strconv.Quote(fmt.Sprint(s)) },
+	"squote":     func(s interface{}) string { return "'" + fmt.Sprint(s) + "'" },
+	"indent":     func(n int, s string) string { return indentLines(n, s) },
+	"nindent":    func(n int, s string) string { return "\n" + indentLines(n, s) },
+	"trunc": func(n int, s string) string {
+		r := []rune(s)
+		switch {
+		case n >= 0 && len(r) > n:
+			return string(r[:n])
+		case n < 0 && len(r) > -n:
+			return string(r[len(r)+n:])
+		}
+		return s
+	},
+	"abbrev": func(n int, s string) string {
+		if r := []rune(s); n > 3 && len(r) > n {
+			return string(r[:n-3]) + "..."
+		}
+		return s
+	},
+	"join":      func(sep string, v interface{}) string { return strings.Join(toStrings(v), sep) },
+	"splitList": func(sep, s string) []string { return strings.Split(s, sep) },
+
+	// lists and dicts
+	"list": func(v ...interface{}) []interface{} { return v },
+	"first": func(v interface{}) interface{} {
+		l := toList(v)
+		if len(l) == 0 {
+			return nil
+		}
+		return l[0]
+	},
+	"last": func(v interface{}) interface{} {
+		l := toList(v)
+		if len(l) == 0 {
+			return nil
+		}
+		return l[len(l)-1]
+	},
+	"has": func(needle, v interface{}) bool {
+		for _, x := range toList(v) {
+			if reflect.DeepEqual(x, needle) {
+				return true
+			}
+		}
+		return false
+	},
+	"sortAlpha": func(v interface{}) []string {
+		s := toStrings(v)
+		sort.Strings(s)
+		return s
+	},
+	"dict": func(kv ...interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[fmt.Sprint(kv[i])] = kv[i+1]
+		}
+		return m
+	},
+	"get": func(m interface{}, key string) interface{} {
+		if v, ok := mapIndex(m, key); ok {
+			return v.Interface()
+		}
+		return ""
+	},
+	"hasKey": func(m interface{}, key string) bool {
+		_, ok := mapIndex(m, key)
+		return ok
+	},
+	"keys": func(m interface{}) []string {
+		v := reflect.ValueOf(m)
+		var out []string
+		if v.Kind() == reflect.Map {
+			for _, k := range v.MapKeys() {
+				out = append(out, fmt.Sprint(k.Interface()))
+			}
+		}
+		sort.Strings(out)
+		return out
+	},
+
+	// defaults and conversions
+	"default": func(def interface{}, v ...interface{}) interface{} {
+		if len(v) == 0 || isEmpty(v[0]) {
+			return def
+		}
+		return v[0]
+	},
+	"empty": isEmpty,
+	"coalesce": func(v ...interface{}) interface{} {
+		for _, x := range v {
+			if !isEmpty(x) {
+				return x
+			}
+		}
+		return nil
+	},
+	"ternary": func(a, b interface{}, cond bool) interface{} {
+		if cond {
+			return a
+		}
+		return b
+	},
+	"toString": func(v interface{}) string { return fmt.Sprint(v) },
+	"toJson": func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	},
+	"toPrettyJson": func(v interface{}) string {
+		b, _ := json.MarshalIndent(v, "", "  ")
+		return string(b)
+	},
+
+	// math
+	"add": func(a, b interface{}) interface{} {
+		return arith(a, b, func(x, y int64) int64 { return x + y }, func(x, y float64) float64 { return x + y })
+	},
+	"add1": func(a interface{}) interface{} {
+		return arith(a, 1, func(x, y int64) int64 { return x + y }, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b interface{}) interface{} {
+		return arith(a, b, func(x, y int64) int64 { return x - y }, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b interface{}) interface{} {
+		return arith(a, b, func(x, y int64) int64 { return x * y }, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b interface{}) interface{} { return arith(a, b, safeDiv, safeDivf) },
+	"mod": func(a, b interface{}) interface{} { return arith(a, b, safeMod, safeModf) },
+	"max": func(a, b interface{}) interface{} {
+		return arith(a, b, func(x, y int64) int64 { return max(x, y) }, math.Max)
+	},
+	"min": func(a, b interface{}) interface{} {
+		return arith(a, b, func(x, y int64) int64 { return min(x, y) }, math.Min)
+	},
+	"addf":  func(a, b interface{}) float64 { return toFloat64(a) + toFloat64(b) },
+	"subf":  func(a, b interface{}) float64 { return toFloat64(a) - toFloat64(b) },
+	"mulf":  func(a, b interface{}) float64 { return toFloat64(a) * toFloat64(b) },
+	"divf":  func(a, b interface{}) float64 { return toFloat64(a) / toFloat64(b) },
+	"floor": func(a interface{}) float64 { return math.Floor(toFloat64(a)) },
+	"ceil":  func(a interface{}) float64 { return math.Ceil(toFloat64(a)) },
+	"round": func(a interface{}, places int) float64 {
+		p := math.Pow(10, float64(places))
+		return math.Round(toFloat64(a)*p) / p
+	},
+
+	// dates
+	"now":  time.Now,
+	"date": func(layout string, t interface{}) string { return toTime(t).Format(layout) },
+	"dateInZone": func(layout string, t interface{}, zone string) string {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			loc = time.UTC
+		}
+		return toTime(t).In(loc).Format(layout)
+	},
+	"unixEpoch": func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"ago":       func(t interface{}) string { return time.Since(toTime(t)).Round(time.Second).String() },
+	"duration": func(sec interface{}) string {
+		return (time.Duration(toFloat64(sec) * float64(time.Second))).Round(time.Second).String()
+	},
+}
+
+func indentLines(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func toList(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil
+	}
+	out := make([]interface{}, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
+
+// toStrings is the items of a list as strings, or a single value as a
+// list of one.
+func toStrings(v interface{}) []string {
+	if v == nil {
+		return nil
+	}
+	l := toList(v)
+	if l == nil {
+		return []string{fmt.Sprint(v)}
+	}
+	out := make([]string, len(l))
+	for i, x := range l {
+		out[i] = fmt.Sprint(x)
+	}
+	return out
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+func toFloat64(v interface{}) float64 {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		f, _ := strconv.ParseFloat(rv.String(), 64)
+		return f
+	case reflect.Bool:
+		return boolFloat(rv.Bool())
+	}
+	return 0
+}
+
+// toInt64 reports v as an integer when it is one: an integer type, or a
+// string that parses as one.
+func toInt64(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() <= math.MaxInt64 {
+			return int64(rv.Uint()), true
+		}
+	case reflect.String:
+		i, err := strconv.ParseInt(rv.String(), 10, 64)
+		return i, err == nil
+	case reflect.Bool:
+		return int64(boolFloat(rv.Bool())), true
+	case reflect.Invalid:
+		return 0, true
+	}
+	return 0, false
+}
+
+// arith applies the integer op when both operands are integers and the
+// float one otherwise.
+func arith(a, b interface{}, ints func(x, y int64) int64, floats func(x, y float64) float64) interface{} {
+	x, aok := toInt64(a)
+	y, bok := toInt64(b)
+	if aok && bok {
+		return ints(x, y)
+	}
+	return floats(toFloat64(a), toFloat64(b))
+}
+
+func safeDiv(a, b int64) int64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+func safeMod(a, b int64) int64 {
+	if b == 0 {
+		return 0
+	}
+	return a % b
+}
+
+func safeDivf(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+func safeModf(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return math.Mod(a, b)
+}
+
+// mapIndex looks key up in any map whose keys are strings.
+func mapIndex(m interface{}, key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return reflect.Value{}, false
+	}
+	e := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+	return e, e.IsValid()
+}
+
+// toTime accepts a time or unix seconds, the form timestamps take in
+// incidents and events.
+func toTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case *time.Time:
+		if t != nil {
+			return *t
+		}
+		return time.Time{}
+	}
+	return unixTime(toFloat64(v)).UTC()
+}
+
+// templateRender is the body of POST /api/v1/templates/render.
+type templateRender struct {
+	Template string `json:"template"`
+	Kind     string `json:"kind"` // message (default), html or report
+	Site     string `json:"site"`
+	Event    string `json:"event"`
+	Tenant   string `json:"tenant"`
+	Period   string `json:"period"`
+}
+
+// handleTemplateRender previews a template. Messages are rendered for
+// the site's open or latest incident, or a made-up one when it has none;
+// reports for the tenant's last full period.
+func handleTemplateRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if apiPrincipal(r) == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req templateRender
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		out string
+		err error
+	)
+	switch req.Kind {
+	case "", "message", "html":
+		out, err = previewMessage(req)
+	case "report":
+		out, err = previewReport(req)
+	default:
+		err = fmt.Errorf("kind must be message, html or report")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"output": out})
+}
+
+func previewMessage(req templateRender) (string, error) {
+	if req.Site == "" {
+		return "", fmt.Errorf("site is required")
+	}
+	if req.Event == "" {
+		req.Event = eventIncidentOpened
+	}
+	now := time.Now()
+	ev := events.Event{Type: req.Event, Time: now, Site: req.Site}
+	if strings.HasPrefix(req.Event, "incident.") {
+		list := incidents.List(req.Site, "", 0, float64(now.Unix()))
+		inc := Incident{ID: "inc-preview", Site: req.Site, Status: incidentOpen, Start: float64(now.Add(-time.Hour).Unix()), Opened: float64(now.Unix()), Duration: 3600}
+		if len(list) > 0 {
+			inc = list[len(list)-1]
+		}
+		ev.Data = inc
+	}
+	data := eventMessage(ev)
+	if req.Kind == "html" {
+		t, err := parseHTMLTemplate("preview", req.Template)
+		if err != nil {
+			return "", err
+		}
+		return renderTemplate(t, data)
+	}
+	t, err := parseMessageTemplate("preview", req.Template)
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(t, data)
+}
+
+func previewReport(req templateRender) (string, error) {
+	tenant, ok := reports.tenant(req.Tenant)
+	if !ok {
+		return "", fmt.Errorf("no tenant %q in REPORTS_CONFIG", req.Tenant)
+	}
+	period := req.Period
+	if period == "" {
+		period = reports.Period
+	}
+	from, to := periodBounds(period, time.Now())
+	report, err := buildSLAReport(tenant, period, from, to)
+	if err != nil {
+		return "", err
+	}
+	t, err := parseHTMLTemplate("preview", req.Template)
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(t, reportMessage(report))
+}
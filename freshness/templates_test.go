@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	_ "time/tzdata"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"N":        7,
+		"F":        2.5,
+		"Big":      int64(1<<62 + 1),
+		"List":     []string{"b", "c", "a"},
+		"Empty":    []string{},
+		"Metadata": map[string]string{"tier": "T1", "region": "eu"},
+		"Nested":   map[string]interface{}{"k": 1},
+		"When":     float64(1700000000),
+	}
+	for _, tc := range []struct {
+		tmpl, want string
+	}{
+		// integers stay integers, any float makes the result a float
+		{`{{add 1 2}}`, "3"},
+		{`{{add 1.5 2}}`, "3.5"},
+		{`{{add .F .N}}`, "9.5"},
+		{`{{add "2" 3}}`, "5"},
+		{`{{add "2.5" 3}}`, "5.5"},
+		{`{{add .Big 1}}`, "4611686018427387906"},
+		{`{{add1 .N}}`, "8"},
+		{`{{add1 .F}}`, "3.5"},
+		{`{{sub 2 5}}`, "-3"},
+		{`{{sub 5 .F}}`, "2.5"},
+		{`{{mul 3 4}}`, "12"},
+		{`{{mul 3 .F}}`, "7.5"},
+		{`{{div 7 2}}`, "3"},
+		{`{{div 7.0 2}}`, "3.5"},
+		{`{{div 7 0}}`, "0"},
+		{`{{div 7.5 0}}`, "0"},
+		{`{{mod 7 3}}`, "1"},
+		{`{{mod 7.5 2}}`, "1.5"},
+		{`{{mod 7 0}}`, "0"},
+		{`{{max 2 .F}}`, "2.5"},
+		{`{{max 2 3}}`, "3"},
+		{`{{min 3 -1}}`, "-1"},
+		{`{{min 0.5 1}}`, "0.5"},
+		{`{{addf 1 2}}`, "3"},
+		{`{{divf 1 4}}`, "0.25"},
+		{`{{floor 2.7}} {{ceil 2.1}}`, "2 3"},
+		{`{{round 3.14159 2}}`, "3.14"},
+
+		// strings, argument last as in sprig
+		{`{{upper "abc"}} {{lower "ABC"}} {{title "hello world"}}`, "ABC abc Hello World"},
+		{`{{trim "  x  "}}|{{trimAll "-" "--x--"}}`, "x|x"},
+		{`{{trimPrefix "SITE_" "SITE_A"}} {{trimSuffix ".root" "f.root"}}`, "A f"},
+		{`{{replace "a" "o" "banana"}}`, "bonono"},
+		{`{{contains "an" "banana"}} {{hasPrefix "ba" "banana"}} {{hasSuffix "x" "banana"}}`, "true true false"},
+		{`{{repeat 3 "ab"}}|{{repeat -1 "ab"}}`, "ababab|"},
+		{`{{quote "a\"b"}} {{squote 1}}`, `"a\"b" '1'`},
+		{`{{indent 2 "a\nb"}}`, "  a\n  b"},
+		{`{{nindent 2 "a"}}`, "\n  a"},
+
+		// trunc and abbrev count runes
+		{`{{trunc 3 "héllo wörld"}}`, "hél"},
+		{`{{trunc -3 "héllo wörld"}}`, "rld"},
+		{`{{trunc -5 "héllo wörld"}}`, "wörld"},
+		{`{{trunc 20 "héllo"}}|{{trunc -20 "héllo"}}`, "héllo|héllo"},
+		{`{{trunc 0 "héllo"}}`, ""},
+		{`{{abbrev 6 "héllo wörld"}}`, "hél..."},
+		{`{{abbrev 3 "héllo wörld"}}`, "héllo wörld"},
+		{`{{abbrev 11 "héllo wörld"}}`, "héllo wörld"},
+		{`{{trunc 2 "日本語"}}`, "日本"},
+
+		// lists
+		{`{{join ", " .List}}`, "b, c, a"},
+		{`{{join ", " "solo"}}|{{join ", " .Empty}}`, "solo|"},
+		{`{{join "-" (splitList "," "a,b,c")}}`, "a-b-c"},
+		{`{{first .List}} {{last .List}}`, "b a"},
+		{`{{first .Empty}}`, "<no value>"},
+		{`{{has "c" .List}} {{has "z" .List}}`, "true false"},
+		{`{{sortAlpha .List}}`, "[a b c]"},
+		{`{{join "," (list 1 "x" 2.5)}}`, "1,x,2.5"},
+
+		// maps of any string-keyed type
+		{`{{get .Metadata "tier"}}`, "T1"},
+		{`{{get .Metadata "missing"}}|`, "|"},
+		{`{{get .Nested "k"}}`, "1"},
+		{`{{get (dict "a" 1 "b" 2) "b"}}`, "2"},
+		{`{{get .List "x"}}|`, "|"},
+		{`{{hasKey .Metadata "region"}} {{hasKey .Metadata "zone"}} {{hasKey .List "a"}}`, "true false false"},
+		{`{{keys .Metadata}}`, "[region tier]"},
+
+		// defaults and conversions
+		{`{{default "none" ""}} {{default "none" "x"}} {{default 5 0}}`, "none x 5"},
+		{`{{default "none" .Empty}} {{default "none" .Missing}}`, "none none"},
+		{`{{empty ""}} {{empty 0}} {{empty .List}} {{empty .Empty}}`, "true true false true"},
+		{`{{coalesce "" 0 "x" "y"}}`, "x"},
+		{`{{ternary "yes" "no" true}} {{ternary "yes" "no" false}}`, "yes no"},
+		{`{{toString 1.5}}`, "1.5"},
+		{`{{toJson .Metadata}}`, `{"region":"eu","tier":"T1"}`},
+		{`{{toPrettyJson .List}}`, "[\n  \"b\",\n  \"c\",\n  \"a\"\n]"},
+
+		// dates take a time or unix seconds
+		{`{{date "2006-01-02 15:04" .When}}`, "2023-11-14 22:13"},
+		{`{{dateInZone "2006-01-02 15:04" .When "Europe/Zurich"}}`, "2023-11-14 23:13"},
+		{`{{dateInZone "15:04" .When "Nowhere/Special"}}`, "22:13"},
+		{`{{duration 95}} {{duration 0.4}}`, "1m35s 0s"},
+
+		// dtms
+		{`{{pct 0.987}}`, "98.70%"},
+		{`{{humanDuration 3700}}`, "1h1m40s"},
+	} {
+		t.Run(tc.tmpl, func(t *testing.T) {
+			tmpl, err := parseMessageTemplate("test", tc.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := renderTemplate(tmpl, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval bounds how often a certificate's files are stat'ed
+// for rotation.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a key pair from disk and reloads it when either file
+// changes, so cert-manager rotations and renewed grid proxies are picked
+// up without a restart. A pair that fails to load is logged and the
+// previous one kept.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestMod is the newer of the two files' modification times.
+func (r *certReloader) latestMod() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	mod, err := r.latestMod()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, mod
+	return nil
+}
+
+func (r *certReloader) current() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		if mod, err := r.latestMod(); err == nil && !mod.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				fmt.Printf("[tls] reloading %s: %v\n", r.certFile, err)
+			} else {
+				fmt.Printf("[tls] reloaded %s\n", r.certFile)
+			}
+		}
+	}
+	return r.cert
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// loadTLSConfig builds a client TLS config from PEM files, reloading the
+// client certificate when it rotates. It returns nil when neither a CA nor
+// a client certificate is configured.
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			// grid proxies keep the key in the same file
+			keyFile = certFile
+		}
+		r, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+// httpClientFor returns the shared client, or a dedicated one when the
+// caller needs its own CA or client certificate. Dedicated clients with the
+// same files share a connection pool (see transport.go).
+func httpClientFor(caFile, certFile, keyFile string) (*http.Client, error) {
+	cfg, err := loadTLSConfig(caFile, certFile, keyFile)
+	if err != nil || cfg == nil {
+		return client, err
+	}
+	tr := tlsTransportFor([3]string{caFile, certFile, keyFile}, cfg)
+	return &http.Client{Transport: upstreamTransport(tr), Timeout: 30 * time.Second}, nil
+}
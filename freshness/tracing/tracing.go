@@ -0,0 +1,416 @@
+// Package tracing records spans and sends them to an OpenTelemetry
+// collector over OTLP/HTTP, JSON encoded, without pulling in the OTel SDK.
+// Spans are built whole, start and end known, which suits the services'
+// use: stages of a transfer reconstructed from its recorded history.
+//
+//	exp := tracing.NewExporter(tracing.ConfigFromEnv("dtms-worker"), tracing.Hooks{})
+//	go exp.Run(ctx)
+//	parent, _ := tracing.ParseTraceparent(req.Traceparent)
+//	s := parent.Child("worker.copy", start)
+//	s.Attr("backend", "rclone")
+//	s.Finish(time.Now(), err)
+//	exp.Export(s)
+//
+// Contexts cross process boundaries as W3C traceparent values. A nil
+// *Exporter, as NewExporter returns without an endpoint, drops everything.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpanContext identifies a span within its trace, as hex strings.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Valid reports whether c names a span.
+func (c SpanContext) Valid() bool {
+	return isHex(c.TraceID, 32) && isHex(c.SpanID, 16)
+}
+
+// Traceparent formats c as a sampled W3C traceparent.
+func (c SpanContext) Traceparent() string {
+	if !c.Valid() {
+		return ""
+	}
+	return "00-" + c.TraceID + "-" + c.SpanID + "-01"
+}
+
+// Child starts a span below c.
+func (c SpanContext) Child(name string, start time.Time) *Span {
+	return &Span{TraceID: c.TraceID, SpanID: NewSpanID(), ParentID: c.SpanID, Name: name, Start: start}
+}
+
+// ParseTraceparent reads a W3C traceparent header value.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	c := SpanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}
+	if !c.Valid() || strings.Trim(c.TraceID, "0") == "" || strings.Trim(c.SpanID, "0") == "" {
+		return SpanContext{}, false
+	}
+	return c, true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewSpanID returns a random span ID.
+func NewSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// DerivedSpanID returns a span ID fixed by the trace and parts, for spans
+// that must be named before they are recorded, possibly by another
+// process or after a restart.
+func DerivedSpanID(traceID string, parts ...string) string {
+	sum := sha256.Sum256([]byte(traceID + "/" + strings.Join(parts, "/")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Span kinds, as OTLP numbers them.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is one timed operation.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Events   []SpanEvent
+	Error    string
+}
+
+// SpanEvent is a point in time within a span.
+type SpanEvent struct {
+	Name  string
+	Time  time.Time
+	Attrs map[string]interface{}
+}
+
+// Context returns the span's context, to parent other spans.
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// Attr sets an attribute: a string, bool, integer or float.
+func (s *Span) Attr(key string, v interface{}) *Span {
+	if s.Attrs == nil {
+		s.Attrs = map[string]interface{}{}
+	}
+	s.Attrs[key] = v
+	return s
+}
+
+// Event records something that happened at t.
+func (s *Span) Event(name string, t time.Time, attrs map[string]interface{}) {
+	s.Events = append(s.Events, SpanEvent{Name: name, Time: t, Attrs: attrs})
+}
+
+// Finish ends the span at t, failed when err is not nil.
+func (s *Span) Finish(t time.Time, err error) *Span {
+	s.End = t
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// Config says where spans go. Without an Endpoint tracing is off.
+type Config struct {
+	Endpoint string // full URL of the OTLP/HTTP traces endpoint
+	Headers  map[string]string
+	Service  string
+	Batch    int
+	Interval time.Duration
+}
+
+// ConfigFromEnv reads the standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT (to which /v1/traces is added),
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME, which defaults to
+// service.
+func ConfigFromEnv(service string) Config {
+	c := Config{Service: service, Headers: map[string]string{}, Batch: 512, Interval: 5 * time.Second}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		c.Service = v
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+		c.Endpoint = v
+	} else if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		c.Endpoint = strings.TrimSuffix(v, "/") + "/v1/traces"
+	}
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok && k != "" {
+			c.Headers[k] = v
+		}
+	}
+	return c
+}
+
+// Hooks report what happens to spans; any may be nil.
+type Hooks struct {
+	Exported func(n int)
+	Dropped  func(n int)
+	Failed   func(n int, err error)
+}
+
+// Exporter batches spans and posts them to the collector. A span that
+// finds the buffer full, or whose batch the collector refuses, is lost:
+// tracing must never hold up the work it describes.
+type Exporter struct {
+	cfg    Config
+	hooks  Hooks
+	queue  chan *Span
+	client *http.Client
+}
+
+// NewExporter returns an exporter for cfg, or nil when cfg has no endpoint.
+func NewExporter(cfg Config, hooks Hooks) *Exporter {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.Batch <= 0 {
+		cfg.Batch = 512
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	return &Exporter{cfg: cfg, hooks: hooks, queue: make(chan *Span, 8*cfg.Batch), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Enabled reports whether spans go anywhere.
+func (e *Exporter) Enabled() bool { return e != nil }
+
+// Export queues finished spans.
+func (e *Exporter) Export(spans ...*Span) {
+	if e == nil {
+		return
+	}
+	for _, s := range spans {
+		select {
+		case e.queue <- s:
+		default:
+			if e.hooks.Dropped != nil {
+				e.hooks.Dropped(1)
+			}
+		}
+	}
+}
+
+// Run sends queued spans until ctx is done, then flushes what is left.
+func (e *Exporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	t := time.NewTicker(e.cfg.Interval)
+	defer t.Stop()
+	var batch []*Span
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		err := e.post(ctx, batch)
+		switch {
+		case err != nil && e.hooks.Failed != nil:
+			e.hooks.Failed(len(batch), err)
+		case err == nil && e.hooks.Exported != nil:
+			e.hooks.Exported(len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= e.cfg.Batch {
+				flush(ctx)
+			}
+		case <-t.C:
+			flush(ctx)
+		case <-ctx.Done():
+		drain:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					break drain
+				}
+			}
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			flush(final)
+			cancel()
+			return
+		}
+	}
+}
+
+func (e *Exporter) post(ctx context.Context, spans []*Span) error {
+	raw, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The OTLP JSON encoding: ids in hex, 64-bit integers as strings.
+type (
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+)
+
+func (e *Exporter) payload(spans []*Span) interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		kind := s.Kind
+		if kind == 0 {
+			kind = KindInternal
+		}
+		o := otlpSpan{
+			TraceID: s.TraceID, SpanID: s.SpanID, ParentSpanID: s.ParentID,
+			Name: s.Name, Kind: kind,
+			StartTimeUnixNano: nanos(s.Start), EndTimeUnixNano: nanos(s.End),
+			Attributes: attributes(s.Attrs),
+			Status:     otlpStatus{Code: 1},
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		for _, ev := range s.Events {
+			o.Events = append(o.Events, otlpEvent{TimeUnixNano: nanos(ev.Time), Name: ev.Name, Attributes: attributes(ev.Attrs)})
+		}
+		out = append(out, o)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes(map[string]interface{}{"service.name": e.cfg.Service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/youruser/dtms-fresh/tracing"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func attributes(m map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpKeyValue, 0, len(m))
+	for _, k := range keys {
+		v := m[k]
+		var val otlpValue
+		switch v := v.(type) {
+		case string:
+			val.StringValue = &v
+		case bool:
+			val.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			val.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			val.IntValue = &s
+		case float64:
+			val.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			val.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: val})
+	}
+	return out
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transfer requests turn DTMS from a monitor into an orchestrator: a
+// request asks for a dataset to be copied from one site to another and
+// moves through
+//
+//	queued -> running -> done | failed
+//	running -> queued (retry, expired lease)
+//	queued | running -> cancelled
+//
+// The queue is ordered by priority (higher first), then deadline (earlier
+// first, none last), then age. Requests are kept in TRANSFER_REQUESTS_FILE.
+//
+// Failed attempts are handed to the retry policies (RETRY_POLICIES_CONFIG),
+// which may requeue the request after a backoff, possibly from another
+// source. Executor workers claim the head of the queue and hold a lease they renew
+// with every progress report; a request whose lease runs out
+// (TRANSFER_LEASE_SECONDS) goes back to the queue for another worker.
+// Each request is traced from submission to its end (transfertrace.go).
+var (
+	transferRequestsFile = envOr("TRANSFER_REQUESTS_FILE", filepath.Join(dataDir, "transfer-requests.json"))
+	transferLease        = time.Duration(envOrInt("TRANSFER_LEASE_SECONDS", 300)) * time.Second
+)
+
+const (
+	requestQueued    = "queued"
+	requestRunning   = "running"
+	requestDone      = "done"
+	requestFailed    = "failed"
+	requestCancelled = "cancelled"
+)
+
+var (
+	errRequestNotFound = errors.New("transfer request not found")
+	errQuotaExceeded   = errors.New("quota exceeded")
+)
+
+type TransferRequest struct {
+	ID           string          `json:"id"`
+	Source       string          `json:"source"`
+	Destination  string          `json:"destination"`
+	Dataset      string          `json:"dataset"`
+	Tenant       string          `json:"tenant"`
+	Bytes        int64           `json:"bytes,omitempty"`
+	Priority     int             `json:"priority"`
+	Deadline     float64         `json:"deadline,omitempty"`
+	Status       string          `json:"status"`
+	Error        string          `json:"error,omitempty"`
+	Created      float64         `json:"created"`
+	Updated      float64         `json:"updated"`
+	Worker       string          `json:"worker,omitempty"`
+	Attempts     int             `json:"attempts"`
+	NotBefore    float64         `json:"not_before,omitempty"`
+	TriedSources []string        `json:"tried_sources,omitempty"`
+	LeaseExpiry  float64         `json:"lease_expiry,omitempty"`
+	Bandwidth    int64           `json:"bandwidth_limit,omitempty"`
+	Progress     *Progress       `json:"progress,omitempty"`
+	History      []RequestStatus `json:"history"`
+	TraceID      string          `json:"trace_id,omitempty"`
+	ParentSpanID string          `json:"parent_span_id,omitempty"`
+	// Traceparent is set in claim responses only: the attempt's span
+	// context, for the worker's spans (transfertrace.go).
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// Progress is the latest report from the worker running a request.
+type Progress struct {
+	Bytes     int64   `json:"bytes"`
+	Files     int64   `json:"files"`
+	Rate      float64 `json:"bytes_per_second"`
+	Message   string  `json:"message,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// RequestStatus records one status transition.
+type RequestStatus struct {
+	Status    string  `json:"status"`
+	Timestamp float64 `json:"timestamp"`
+	Message   string  `json:"message,omitempty"`
+}
+
+var gaugeTransferRequests = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "dtms_transfer_requests", Help: "Transfer requests by status"},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(gaugeTransferRequests)
+}
+
+type requestStore struct {
+	mu       sync.Mutex
+	path     string
+	requests map[string]*TransferRequest
+}
+
+var transferRequests = &requestStore{path: transferRequestsFile, requests: map[string]*TransferRequest{}}
+
+func (s *requestStore) Load() error {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*TransferRequest
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range list {
+		if r.Tenant == "" {
+			r.Tenant = "default"
+		}
+		s.requests[r.ID] = r
+	}
+	s.publish()
+	return nil
+}
+
+// running returns the running requests; callers hold mu.
+func (s *requestStore) running() []*TransferRequest {
+	var out []*TransferRequest
+	for _, r := range s.requests {
+		if r.Status == requestRunning {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// save persists the store; callers hold mu.
+func (s *requestStore) save() error {
+	list := make([]*TransferRequest, 0, len(s.requests))
+	for _, r := range s.requests {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	s.publish()
+	return writeFileAtomic(s.path, raw)
+}
+
+func (s *requestStore) publish() {
+	counts := map[string]int{requestQueued: 0, requestRunning: 0, requestDone: 0, requestFailed: 0, requestCancelled: 0}
+	var running []*TransferRequest
+	for _, r := range s.requests {
+		counts[r.Status]++
+		if r.Status == requestRunning {
+			running = append(running, r)
+		}
+	}
+	publishUsage(running)
+	for status, n := range counts {
+		gaugeTransferRequests.WithLabelValues(status).Set(float64(n))
+	}
+}
+
+// Create queues r. traceparent, if any, is the submitter's span context.
+func (s *requestStore) Create(r TransferRequest, traceparent string) (TransferRequest, error) {
+	if r.Source == "" || r.Destination == "" || r.Dataset == "" {
+		return r, errors.New("source, destination and dataset are required")
+	}
+	if r.Source == r.Destination {
+		return r, errors.New("source and destination must differ")
+	}
+	if r.Tenant == "" {
+		r.Tenant = "default"
+	}
+	ok, warning := quotas.Check(r.Destination, r.Tenant, r.Bytes)
+	if !ok {
+		return r, fmt.Errorf("%w: %s", errQuotaExceeded, warning)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := float64(time.Now().Unix())
+	r.ID = "tr-" + hex.EncodeToString(id)
+	r.Created, r.Error, r.History, r.Traceparent = now, "", nil, ""
+	r.startTrace(traceparent)
+	r.setStatus(requestQueued, now, warning)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.ID] = &r
+	return r, s.save()
+}
+
+func (r *TransferRequest) setStatus(status string, now float64, msg string) {
+	r.Status, r.Updated = status, now
+	r.History = append(r.History, RequestStatus{Status: status, Timestamp: now, Message: msg})
+}
+
+func (s *requestStore) Get(id string) (TransferRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return TransferRequest{}, errRequestNotFound
+	}
+	return *r, nil
+}
+
+// Transition moves a request to status. Finished requests cannot change.
+func (s *requestStore) Transition(id, status, msg string) (TransferRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return TransferRequest{}, errRequestNotFound
+	}
+	if r.finished() {
+		return *r, fmt.Errorf("request is already %s", r.Status)
+	}
+	now := time.Now()
+	if r.Status == requestRunning {
+		traceAttempt(r, now, status, "")
+	}
+	r.setStatus(status, float64(now.Unix()), msg)
+	if status == requestFailed {
+		r.Error = msg
+	}
+	if r.finished() {
+		traceRequest(r, now)
+	}
+	bandwidth.rebalance(s.running())
+	return *r, s.save()
+}
+
+func (r *TransferRequest) finished() bool {
+	return r.Status == requestDone || r.Status == requestFailed || r.Status == requestCancelled
+}
+
+// Claim hands the next request, by fair share across tenants and queue
+// order within them, to worker and starts its lease.
+func (s *requestStore) Claim(worker string) (TransferRequest, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var queued, running []*TransferRequest
+	for _, r := range s.requests {
+		switch {
+		case r.Status == requestRunning:
+			running = append(running, r)
+		case r.Status == requestQueued && r.NotBefore <= float64(now.Unix()):
+			queued = append(queued, r)
+		}
+	}
+	head := bandwidth.pickFairShare(queued, running)
+	if head == nil {
+		return TransferRequest{}, false, nil
+	}
+	traceQueued(head, now)
+	head.NotBefore = 0
+	head.Worker = worker
+	head.Attempts++
+	head.LeaseExpiry = float64(now.Add(transferLease).Unix())
+	head.Progress = nil
+	head.setStatus(requestRunning, float64(now.Unix()), "claimed by "+worker)
+	bandwidth.rebalance(append(running, head))
+	claimed := *head
+	claimed.Traceparent = head.attemptSpan().Traceparent()
+	return claimed, true, s.save()
+}
+
+// Report records progress from the worker holding the request and renews
+// its lease. The returned request carries its current bandwidth limit.
+func (s *requestStore) Report(id, worker string, p Progress) (TransferRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return TransferRequest{}, errRequestNotFound
+	}
+	if r.Status != requestRunning || r.Worker != worker {
+		return *r, fmt.Errorf("request is %s and not held by %s", r.Status, worker)
+	}
+	now := time.Now()
+	p.Timestamp = float64(now.Unix())
+	if prev := r.Progress; prev != nil && p.Timestamp > prev.Timestamp && p.Bytes >= prev.Bytes {
+		p.Rate = float64(p.Bytes-prev.Bytes) / (p.Timestamp - prev.Timestamp)
+	}
+	r.Progress = &p
+	r.Updated = p.Timestamp
+	r.LeaseExpiry = float64(now.Add(transferLease).Unix())
+	return *r, s.save()
+}
+
+// Finish ends the worker's attempt with done or failed.
+func (s *requestStore) Finish(id, worker, status, msg string) (TransferRequest, error) {
+	if status != requestDone && status != requestFailed {
+		return TransferRequest{}, fmt.Errorf("cannot finish with status %q", status)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return TransferRequest{}, errRequestNotFound
+	}
+	if r.Status != requestRunning || r.Worker != worker {
+		return *r, fmt.Errorf("request is %s and not held by %s", r.Status, worker)
+	}
+	now := time.Now()
+	r.LeaseExpiry = 0
+	traceAttempt(r, now, status, msg)
+	switch {
+	case status == requestDone:
+		if r.Attempts > 1 {
+			if p := policyFor(r); p != nil {
+				retryOutcomes.WithLabelValues(p.Name, "recovered").Inc()
+			}
+		}
+		r.setStatus(requestDone, float64(now.Unix()), msg)
+		traceRequest(r, now)
+	default:
+		r.Error = msg
+		// the failed source counts as tried before a new one is picked
+		r.TriedSources = append(removeString(r.TriedSources, r.Source), r.Source)
+		d := decideRetry(r, msg, now)
+		retryOutcomes.WithLabelValues(d.policy, d.outcome).Inc()
+		if !d.retry {
+			r.setStatus(requestFailed, float64(now.Unix()), msg+"; "+d.message)
+			traceRequest(r, now)
+			break
+		}
+		r.Source, r.Worker = d.source, ""
+		r.NotBefore = float64(now.Add(d.delay).Unix())
+		r.setStatus(requestQueued, float64(now.Unix()), msg+"; "+d.message)
+	}
+	bandwidth.rebalance(s.running())
+	return *r, s.save()
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// expireLeases requeues running requests whose worker went silent.
+func (s *requestStore) expireLeases(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, r := range s.requests {
+		if r.Status == requestRunning && r.LeaseExpiry > 0 && float64(now.Unix()) > r.LeaseExpiry {
+			traceAttempt(r, now, "lease expired", "lease held by "+r.Worker+" expired")
+			r.setStatus(requestQueued, float64(now.Unix()), "lease held by "+r.Worker+" expired")
+			r.Worker, r.LeaseExpiry = "", 0
+			changed = true
+		}
+	}
+	if changed {
+		bandwidth.rebalance(s.running())
+		if err := s.save(); err != nil {
+			fmt.Printf("[transfers] save: %v\n", err)
+		}
+	}
+}
+
+func (s *requestStore) leaseLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.expireLeases(time.Now())
+		}
+	}
+}
+
+// List returns requests filtered by status and dataset, in queue order.
+func (s *requestStore) List(status, dataset string) []TransferRequest {
+	s.mu.Lock()
+	out := []TransferRequest{}
+	for _, r := range s.requests {
+		if (status == "" || r.Status == status) && (dataset == "" || r.Dataset == dataset) {
+			out = append(out, *r)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return queueLess(out[i], out[j]) })
+	return out
+}
+
+// queueLess is the scheduling order.
+func queueLess(a, b TransferRequest) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if (a.Deadline == 0) != (b.Deadline == 0) {
+		return a.Deadline != 0
+	}
+	if a.Deadline != b.Deadline {
+		return a.Deadline < b.Deadline
+	}
+	return a.Created < b.Created
+}
+
+// handleTransferRequests serves GET (list, ?status=&dataset=) and POST
+// (create, joining the trace of a traceparent header) on
+// /api/v1/transfer-requests.
+func handleTransferRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"requests": transferRequests.List(q.Get("status"), q.Get("dataset")),
+		})
+	case http.MethodPost:
+		if !apiAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req TransferRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := transferRequests.Create(req, r.Header.Get("traceparent"))
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTransferRequest serves the per-request endpoints:
+//
+//	GET  /api/v1/transfer-requests/{id}
+//	POST /api/v1/transfer-requests/{id}/cancel
+//	POST /api/v1/transfer-requests/claim           {"worker"}
+//	POST /api/v1/transfer-requests/{id}/progress   {"worker","bytes","files","message"}
+//	POST /api/v1/transfer-requests/{id}/finish     {"worker","status","error"}
+func handleTransferRequest(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/transfer-requests/"), "/")
+	if r.Method == http.MethodGet && action == "" {
+		req, err := transferRequests.Get(id)
+		writeRequestResult(w, req, err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Worker string `json:"worker"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Progress
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if action != "cancel" && body.Worker == "" {
+		http.Error(w, "worker is required", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		req TransferRequest
+		err error
+	)
+	switch {
+	case id == "claim" && action == "":
+		var ok bool
+		if req, ok, err = transferRequests.Claim(body.Worker); err == nil && !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case action == "cancel":
+		req, err = transferRequests.Transition(id, requestCancelled, "cancelled via API")
+	case action == "progress":
+		req, err = transferRequests.Report(id, body.Worker, body.Progress)
+	case action == "finish":
+		req, err = transferRequests.Finish(id, body.Worker, body.Status, body.Error)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeRequestResult(w, req, err)
+}
+
+func writeRequestResult(w http.ResponseWriter, req TransferRequest, err error) {
+	switch {
+	case errors.Is(err, errRequestNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, req)
+	}
+}
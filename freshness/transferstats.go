@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TRANSFER_RATE_WINDOWS lists the windows the rolling throughput gauges are
+// averaged over, e.g. "5m,1h,24h".
+var transferRateWindows = parseRateWindows(envOr("TRANSFER_RATE_WINDOWS", "5m,1h"))
+
+var (
+	transferBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_transfer_bytes_total", Help: "Bytes moved by successful ingested transfers"},
+		[]string{"site", "link"},
+	)
+	transferFiles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_transfer_files_total", Help: "Ingested transfers by status"},
+		[]string{"site", "link", "status"},
+	)
+	gaugeTransferRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_transfer_throughput_bytes_per_second", Help: "Successful transfer volume averaged over a rolling window"},
+		[]string{"site", "link", "window"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(transferBytes, transferFiles, gaugeTransferRate)
+}
+
+func parseRateWindows(s string) []time.Duration {
+	var out []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f)
+		if err != nil || d <= 0 {
+			fmt.Printf("[transfers] ignoring rate window %q\n", f)
+			continue
+		}
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// transferLink names the path an event travelled; events without a source
+// site are accounted to the destination alone.
+func transferLink(ev TransferEvent) string {
+	if ev.Source == "" {
+		return ""
+	}
+	return ev.Source + "->" + ev.Site
+}
+
+type rateKey struct{ site, link string }
+
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// transferRates keeps the successful transfers inside the longest rate
+// window so the throughput gauges can be recomputed as the window slides.
+type transferRates struct {
+	mu      sync.Mutex
+	samples map[rateKey][]rateSample
+}
+
+var rates = &transferRates{samples: map[rateKey][]rateSample{}}
+
+// observeTransfer updates the volume metrics for one accepted event.
+func observeTransfer(ev TransferEvent) {
+	link := transferLink(ev)
+	if ev.Status == eventDeleted {
+		return
+	}
+	transferFiles.WithLabelValues(ev.Site, link, ev.Status).Inc()
+	if ev.Status != "success" {
+		transferFailures.WithLabelValues(ev.Site, classifyFailure(ev.Reason)).Inc()
+		return
+	}
+	transferBytes.WithLabelValues(ev.Site, link).Add(float64(ev.Bytes))
+	rates.add(rateKey{ev.Site, link}, rateSample{at: unixTime(ev.Timestamp), bytes: ev.Bytes})
+}
+
+func (r *transferRates) add(k rateKey, s rateSample) {
+	if len(transferRateWindows) == 0 || time.Since(s.at) > transferRateWindows[len(transferRateWindows)-1] {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[k] = append(r.samples[k], s)
+}
+
+// refresh drops samples older than the longest window and republishes the
+// rate gauges; idle keys decay to zero rather than freezing.
+func (r *transferRates) refresh(now time.Time) {
+	if len(transferRateWindows) == 0 {
+		return
+	}
+	longest := transferRateWindows[len(transferRateWindows)-1]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, samples := range r.samples {
+		keep := samples[:0]
+		for _, s := range samples {
+			if now.Sub(s.at) <= longest {
+				keep = append(keep, s)
+			}
+		}
+		for _, w := range transferRateWindows {
+			var total int64
+			for _, s := range keep {
+				if now.Sub(s.at) <= w {
+					total += s.bytes
+				}
+			}
+			gaugeTransferRate.WithLabelValues(k.site, k.link, w.String()).Set(float64(total) / w.Seconds())
+		}
+		if len(keep) == 0 {
+			delete(r.samples, k)
+		} else {
+			r.samples[k] = keep
+		}
+	}
+}
+
+func transferRatesLoop(ctx context.Context) {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rates.refresh(time.Now())
+		}
+	}
+}
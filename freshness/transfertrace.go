@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/tracing"
+)
+
+// Every transfer request carries a trace. Its ID comes from the traceparent
+// header of the request that submitted it, so the trace joins the
+// submitter's, or is made up when there is none. With an OTLP endpoint
+// configured (OTEL_EXPORTER_OTLP_ENDPOINT, see the tracing package) the
+// service records a span for each stage as the stage ends:
+//
+//	transfer             submission to done, failed or cancelled
+//	  transfer.queued    each wait in the queue, retry backoffs included
+//	  transfer.attempt   each claim by a worker, to its finish or lease expiry
+//	    worker.execute   the worker's side, exported by dtms-worker
+//
+// The claim response hands the worker the attempt's traceparent. Stage
+// boundaries come from the request's history, so spans have one-second
+// resolution and survive restarts.
+var tracer *tracing.Exporter
+
+var traceSpans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_trace_spans_total", Help: "Trace spans by what became of them"},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(traceSpans)
+}
+
+func newTracer() *tracing.Exporter {
+	return tracing.NewExporter(tracing.ConfigFromEnv("dtms-freshness"), tracing.Hooks{
+		Exported: func(n int) { traceSpans.WithLabelValues("exported").Add(float64(n)) },
+		Dropped:  func(n int) { traceSpans.WithLabelValues("dropped").Add(float64(n)) },
+		Failed: func(n int, err error) {
+			traceSpans.WithLabelValues("failed").Add(float64(n))
+			fmt.Printf("[tracing] export of %d spans failed: %v\n", n, err)
+		},
+	})
+}
+
+// startTrace gives a new request its trace, below the submitter's span
+// when traceparent names one.
+func (r *TransferRequest) startTrace(traceparent string) {
+	if parent, ok := tracing.ParseTraceparent(traceparent); ok {
+		r.TraceID, r.ParentSpanID = parent.TraceID, parent.SpanID
+		return
+	}
+	if r.TraceID == "" {
+		r.TraceID = tracing.NewTraceID()
+	}
+}
+
+func (r *TransferRequest) rootSpan() tracing.SpanContext {
+	return tracing.SpanContext{TraceID: r.TraceID, SpanID: tracing.DerivedSpanID(r.TraceID, r.ID)}
+}
+
+// attemptSpan names the span of the current attempt, which the worker
+// parents its own spans on.
+func (r *TransferRequest) attemptSpan() tracing.SpanContext {
+	return tracing.SpanContext{TraceID: r.TraceID, SpanID: tracing.DerivedSpanID(r.TraceID, r.ID, "attempt", fmt.Sprint(r.Attempts))}
+}
+
+// lastStatus returns when the request last entered status.
+func (r *TransferRequest) lastStatus(status string) time.Time {
+	for i := len(r.History) - 1; i >= 0; i-- {
+		if r.History[i].Status == status {
+			return unixTime(r.History[i].Timestamp)
+		}
+	}
+	return unixTime(r.Created)
+}
+
+func (r *TransferRequest) spanAttrs(s *tracing.Span) *tracing.Span {
+	return s.Attr("dtms.request_id", r.ID).
+		Attr("dtms.dataset", r.Dataset).
+		Attr("dtms.source", r.Source).
+		Attr("dtms.destination", r.Destination).
+		Attr("dtms.tenant", r.Tenant).
+		Attr("dtms.priority", r.Priority)
+}
+
+// traceQueued records the wait that ends as r is claimed; r is still
+// queued.
+func traceQueued(r *TransferRequest, now time.Time) {
+	if !tracer.Enabled() || r.TraceID == "" {
+		return
+	}
+	s := r.rootSpan().Child("transfer.queued", r.lastStatus(requestQueued))
+	r.spanAttrs(s).Attr("dtms.attempt", r.Attempts+1)
+	if r.NotBefore > 0 {
+		s.Attr("dtms.retry_not_before", time.Unix(int64(r.NotBefore), 0).UTC().Format(time.RFC3339))
+	}
+	tracer.Export(s.Finish(now, nil))
+}
+
+// traceAttempt records the attempt that ends with r still running; errMsg
+// is empty for a successful one.
+func traceAttempt(r *TransferRequest, now time.Time, outcome, errMsg string) {
+	if !tracer.Enabled() || r.TraceID == "" {
+		return
+	}
+	ctx := r.attemptSpan()
+	s := &tracing.Span{TraceID: ctx.TraceID, SpanID: ctx.SpanID, ParentID: r.rootSpan().SpanID, Name: "transfer.attempt", Start: r.lastStatus(requestRunning)}
+	r.spanAttrs(s).Attr("dtms.attempt", r.Attempts).Attr("dtms.worker", r.Worker).Attr("dtms.outcome", outcome)
+	if r.Bandwidth > 0 {
+		s.Attr("dtms.bandwidth_limit", r.Bandwidth)
+	}
+	if p := r.Progress; p != nil {
+		s.Attr("dtms.bytes", p.Bytes).Attr("dtms.files", p.Files)
+	}
+	var err error
+	if errMsg != "" {
+		err = fmt.Errorf("%s", errMsg)
+	}
+	tracer.Export(s.Finish(now, err))
+}
+
+// traceRequest records the whole request once it is finished.
+func traceRequest(r *TransferRequest, now time.Time) {
+	if !tracer.Enabled() || r.TraceID == "" {
+		return
+	}
+	ctx := r.rootSpan()
+	s := &tracing.Span{TraceID: ctx.TraceID, SpanID: ctx.SpanID, ParentID: r.ParentSpanID, Name: "transfer", Kind: tracing.KindServer, Start: unixTime(r.Created)}
+	r.spanAttrs(s).Attr("dtms.status", r.Status).Attr("dtms.attempts", r.Attempts)
+	var err error
+	if r.Status == requestFailed {
+		err = fmt.Errorf("%s", r.Error)
+	}
+	tracer.Export(s.Finish(now, err))
+}
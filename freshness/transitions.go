@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// FreshnessTransition is a site turning stale or fresh again, as seen by
+// the first evaluation in its new state.
+type FreshnessTransition struct {
+	Site       string  `json:"site"`
+	Timestamp  float64 `json:"timestamp"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Threshold  float64 `json:"threshold_seconds"`
+	// PreviousDuration is how long the site had been in From; it is
+	// Partial when that state began before the history that was read.
+	PreviousDuration float64 `json:"previous_duration_seconds"`
+	Partial          bool    `json:"previous_partial,omitempty"`
+	// Duration is how long the site stayed in To, up to its last sample
+	// in range while it is Ongoing.
+	Duration float64 `json:"duration_seconds"`
+	Ongoing  bool    `json:"ongoing,omitempty"`
+}
+
+// transitionLookback is how much history before the range is read to
+// know each site's state at its start and how long it had been in it.
+const transitionLookback = 7 * 24 * time.Hour
+
+func freshnessState(ok bool) string {
+	if ok {
+		return "fresh"
+	}
+	return "stale"
+}
+
+// transitionsFrom derives the transitions in (from, to] from samples
+// ordered by timestamp; samples before from only set the starting state.
+func transitionsFrom(samples []HistorySample, from float64) []FreshnessTransition {
+	bySite := map[string][]HistorySample{}
+	for _, s := range samples {
+		bySite[s.Site] = append(bySite[s.Site], s)
+	}
+	out := []FreshnessTransition{}
+	for site, ss := range bySite {
+		since, partial := ss[0].Timestamp, true
+		open := -1 // the site's latest transition in out
+		for i := 1; i < len(ss); i++ {
+			prev, cur := ss[i-1], ss[i]
+			if cur.Ok == prev.Ok {
+				continue
+			}
+			if open >= 0 {
+				out[open].Duration, out[open].Ongoing = cur.Timestamp-out[open].Timestamp, false
+			}
+			if cur.Timestamp > from {
+				out = append(out, FreshnessTransition{
+					Site:             site,
+					Timestamp:        cur.Timestamp,
+					From:             freshnessState(prev.Ok),
+					To:               freshnessState(cur.Ok),
+					AgeSeconds:       cur.AgeSeconds,
+					Threshold:        siteRegistry().lookup(site).Threshold,
+					PreviousDuration: cur.Timestamp - since,
+					Partial:          partial,
+					Duration:         ss[len(ss)-1].Timestamp - cur.Timestamp,
+					Ongoing:          true,
+				})
+				open = len(out) - 1
+			}
+			since, partial = cur.Timestamp, false
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Timestamp != out[j].Timestamp {
+			return out[i].Timestamp < out[j].Timestamp
+		}
+		return out[i].Site < out[j].Site
+	})
+	return out
+}
+
+// handleTransitions serves GET /api/v1/transitions?site=&tags=&from=&to=,
+// every fresh↔stale transition between from and to (unix seconds, the
+// last day by default) derived from the evaluation history, with how long
+// the site had spent in the state it left and stayed in the one it
+// entered. ?to_state=stale or fresh keeps one direction. Unlike
+// incidents, which open only after INCIDENT_OPEN_AFTER_MINUTES and merge flaps,
+// this is every flip the evaluator made, which is what postmortem
+// timelines are built from.
+func handleTransitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state := r.URL.Query().Get("to_state")
+	if state != "" && state != "stale" && state != "fresh" {
+		http.Error(w, "to_state must be stale or fresh", http.StatusBadRequest)
+		return
+	}
+	from, to := queryRange(r)
+	if from >= to {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	samples, err := history.Query(r.URL.Query().Get("site"), unixTime(from).Add(-transitionLookback), unixTime(to))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := transitionsFrom(samples, from)
+	kept := list[:0]
+	for _, t := range list {
+		if sel.selects(t.Site) && (state == "" || t.To == state) {
+			kept = append(kept, t)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":        from,
+		"to":          to,
+		"transitions": kept,
+	})
+}
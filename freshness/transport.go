@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outbound HTTP shares one connection pool per TLS identity, kept across
+// polls and targets, so a collector hitting the same host every cycle
+// reuses its connections instead of handshaking again. The pool is tuned
+// with:
+//
+//	HTTP_MAX_IDLE_CONNS                  idle connections kept in total (100)
+//	HTTP_MAX_IDLE_CONNS_PER_HOST         idle connections kept per host (16)
+//	HTTP_MAX_CONNS_PER_HOST              connections per host, 0 for no limit
+//	HTTP_IDLE_CONN_TIMEOUT_SECONDS       how long an idle connection is kept (90)
+//	HTTP_KEEPALIVE_SECONDS               TCP keep-alive period, -1 to disable (30)
+//	HTTP_DIAL_TIMEOUT_SECONDS            connect timeout (10)
+//	HTTP_TLS_HANDSHAKE_TIMEOUT_SECONDS   TLS handshake timeout (10)
+//	HTTP_RESPONSE_HEADER_TIMEOUT_SECONDS wait for response headers, 0 for none
+//	HTTP_ENABLE_HTTP2                    negotiate HTTP/2 with TLS servers (true)
+//	HTTP_CLIENT_TIMEOUT_SECONDS          whole-request timeout of the shared client (10)
+var (
+	httpMaxIdleConns        = envOrInt("HTTP_MAX_IDLE_CONNS", 100)
+	httpMaxIdleConnsPerHost = envOrInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 16)
+	httpMaxConnsPerHost     = envOrInt("HTTP_MAX_CONNS_PER_HOST", 0)
+	httpIdleConnTimeout     = time.Duration(envOrInt("HTTP_IDLE_CONN_TIMEOUT_SECONDS", 90)) * time.Second
+	httpKeepAlive           = time.Duration(envOrInt("HTTP_KEEPALIVE_SECONDS", 30)) * time.Second
+	httpDialTimeout         = time.Duration(envOrInt("HTTP_DIAL_TIMEOUT_SECONDS", 10)) * time.Second
+	httpTLSTimeout          = time.Duration(envOrInt("HTTP_TLS_HANDSHAKE_TIMEOUT_SECONDS", 10)) * time.Second
+	httpHeaderTimeout       = time.Duration(envOrInt("HTTP_RESPONSE_HEADER_TIMEOUT_SECONDS", 0)) * time.Second
+	httpEnableHTTP2         = envOr("HTTP_ENABLE_HTTP2", "true") == "true"
+	httpClientTimeout       = time.Duration(envOrInt("HTTP_CLIENT_TIMEOUT_SECONDS", 10)) * time.Second
+)
+
+var upstreamConns = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_upstream_connections_total", Help: "Connections used by outbound requests, by host and whether an idle one was reused"},
+	[]string{"host", "reused"},
+)
+
+func init() {
+	prometheus.MustRegister(upstreamConns)
+}
+
+// newUpstreamTransport builds a transport with the configured tuning;
+// tlsCfg may be nil for the system defaults.
+func newUpstreamTransport(tlsCfg *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: httpDialTimeout, KeepAlive: httpKeepAlive}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsCfg,
+		MaxIdleConns:          httpMaxIdleConns,
+		MaxIdleConnsPerHost:   httpMaxIdleConnsPerHost,
+		MaxConnsPerHost:       httpMaxConnsPerHost,
+		IdleConnTimeout:       httpIdleConnTimeout,
+		TLSHandshakeTimeout:   httpTLSTimeout,
+		ResponseHeaderTimeout: httpHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     httpEnableHTTP2,
+	}
+	if !httpEnableHTTP2 {
+		// a non-nil empty map is how net/http is told not to upgrade
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return tr
+}
+
+// connTracingTransport counts new and reused connections per host.
+type connTracingTransport struct{ next http.RoundTripper }
+
+func (t connTracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConns.WithLabelValues(host, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// sharedTransport carries every request made with the shared client.
+var sharedTransport http.RoundTripper = connTracingTransport{newUpstreamTransport(nil)}
+
+// tlsTransports holds one transport per CA and client certificate
+// combination, so sources configured with the same files share a pool.
+var tlsTransports = struct {
+	sync.Mutex
+	m map[[3]string]http.RoundTripper
+}{m: map[[3]string]http.RoundTripper{}}
+
+func tlsTransportFor(key [3]string, cfg *tls.Config) http.RoundTripper {
+	tlsTransports.Lock()
+	defer tlsTransports.Unlock()
+	tr, ok := tlsTransports.m[key]
+	if !ok {
+		tr = connTracingTransport{newUpstreamTransport(cfg)}
+		tlsTransports.m[key] = tr
+	}
+	return tr
+}
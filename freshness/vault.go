@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With VAULT_ADDR set, secrets are fetched from HashiCorp Vault at startup
+// instead of being passed in the environment. VAULT_SECRETS maps
+// environment variables to Vault paths and fields, separated by ';':
+//
+//	API_TOKEN=secret/data/dtms#api_token;PG_PASSWORD=database/creds/dtms-ro#password
+//
+// Every setting is read through getenv, and the first read logs in and
+// exports the values into the environment, so they are there before any
+// setting is evaluated: any variable can come from Vault, as can ${VAR}
+// in the YAML configs. KV version 2 paths (…/data/…) are unwrapped;
+// fields read from the same path share one response, so a dynamic
+// database credential's username and password stay a pair.
+//
+// VAULT_AUTH picks the login: token (VAULT_TOKEN), approle (VAULT_ROLE_ID
+// and VAULT_SECRET_ID or VAULT_SECRET_ID_FILE) or kubernetes (VAULT_ROLE,
+// with the pod's service account token). VAULT_AUTH_MOUNT overrides the
+// mount path and VAULT_NAMESPACE sets the Enterprise namespace.
+//
+// The login token and renewable leases are renewed in the background. A
+// lease that reaches its max TTL is read again and the environment updated;
+// settings read at startup keep the old value until the next restart.
+//
+// Vault's own settings are read straight from the environment, and it is
+// reached with a client of its own rather than the shared one, whose
+// settings would come from Vault.
+var (
+	vaultAddr      = os.Getenv("VAULT_ADDR")
+	vaultAuth      = vaultEnvOr("VAULT_AUTH", "token")
+	vaultAuthMount = os.Getenv("VAULT_AUTH_MOUNT")
+	vaultNamespace = os.Getenv("VAULT_NAMESPACE")
+	vaultSecrets   = os.Getenv("VAULT_SECRETS")
+	vaultHTTP      = &http.Client{Timeout: 30 * time.Second}
+)
+
+var (
+	vaultOnce sync.Once
+	vaultErr  error
+)
+
+func vaultEnvOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getenv reads an environment variable, with the Vault secrets in place.
+func getenv(key string) string {
+	vaultOnce.Do(loadVaultOnce)
+	return os.Getenv(key)
+}
+
+// vaultLoaded returns the error, if any, from fetching the secrets.
+func vaultLoaded() error {
+	vaultOnce.Do(loadVaultOnce)
+	return vaultErr
+}
+
+func loadVaultOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	vaultErr = loadVault(ctx)
+}
+
+const vaultK8sTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+type vaultSecretRef struct {
+	env, path, field string
+}
+
+type vaultLease struct {
+	id        string
+	path      string
+	renewable bool
+	ttl       time.Duration
+	expires   time.Time
+}
+
+type vaultClient struct {
+	refs   []vaultSecretRef
+	token  string
+	tokTTL time.Duration
+	tokAt  time.Time
+	// renewableToken is false for root and periodic-less static tokens.
+	renewableToken bool
+	leases         map[string]*vaultLease // by path
+}
+
+var vault = &vaultClient{leases: map[string]*vaultLease{}}
+
+func parseVaultSecrets(s string) ([]vaultSecretRef, error) {
+	var out []vaultSecretRef
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		env, ref, ok := strings.Cut(entry, "=")
+		path, field, ok2 := strings.Cut(ref, "#")
+		if !ok || !ok2 || env == "" || path == "" || field == "" {
+			return nil, fmt.Errorf("bad VAULT_SECRETS entry %q, want ENV=path#field", entry)
+		}
+		out = append(out, vaultSecretRef{env, strings.Trim(path, "/"), field})
+	}
+	return out, nil
+}
+
+// loadVault logs in and exports the configured secrets.
+func loadVault(ctx context.Context) error {
+	if vaultAddr == "" {
+		return nil
+	}
+	refs, err := parseVaultSecrets(vaultSecrets)
+	if err != nil {
+		return err
+	}
+	vault.refs = refs
+	if err := vault.login(ctx); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	return vault.fetch(ctx, nil)
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var raw []byte
+	if body != nil {
+		raw, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(vaultAddr, "/")+"/v1/"+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if vaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", vaultNamespace)
+	}
+	resp, err := vaultHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (v *vaultClient) login(ctx context.Context) error {
+	var body map[string]string
+	mount := vaultAuthMount
+	switch vaultAuth {
+	case "token":
+		v.token = os.Getenv("VAULT_TOKEN")
+		if v.token == "" {
+			return fmt.Errorf("VAULT_TOKEN is not set")
+		}
+		var self struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &self); err != nil {
+			return err
+		}
+		v.tokAt, v.tokTTL = time.Now(), time.Duration(self.Data.TTL)*time.Second
+		v.renewableToken = self.Data.Renewable
+		return nil
+	case "approle":
+		if mount == "" {
+			mount = "approle"
+		}
+		secretID := os.Getenv("VAULT_SECRET_ID")
+		if f := os.Getenv("VAULT_SECRET_ID_FILE"); f != "" {
+			raw, err := os.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			secretID = strings.TrimSpace(string(raw))
+		}
+		body = map[string]string{"role_id": os.Getenv("VAULT_ROLE_ID"), "secret_id": secretID}
+	case "kubernetes":
+		if mount == "" {
+			mount = "kubernetes"
+		}
+		jwt, err := os.ReadFile(vaultK8sTokenPath)
+		if err != nil {
+			return err
+		}
+		body = map[string]string{"role": os.Getenv("VAULT_ROLE"), "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return fmt.Errorf("unknown VAULT_AUTH %q", vaultAuth)
+	}
+	v.token = ""
+	var res vaultAuthResponse
+	if err := v.do(ctx, http.MethodPost, "auth/"+mount+"/login", body, &res); err != nil {
+		return err
+	}
+	v.token = res.Auth.ClientToken
+	v.tokAt, v.tokTTL = time.Now(), time.Duration(res.Auth.LeaseDuration)*time.Second
+	v.renewableToken = res.Auth.Renewable
+	return nil
+}
+
+// fetch reads the secrets, or only those under the given paths, and
+// exports them.
+func (v *vaultClient) fetch(ctx context.Context, only map[string]bool) error {
+	type secret struct {
+		LeaseID       string                 `json:"lease_id"`
+		LeaseDuration int                    `json:"lease_duration"`
+		Renewable     bool                   `json:"renewable"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	read := map[string]map[string]interface{}{}
+	for _, ref := range v.refs {
+		if only != nil && !only[ref.path] {
+			continue
+		}
+		data, ok := read[ref.path]
+		if !ok {
+			var s secret
+			if err := v.do(ctx, http.MethodGet, ref.path, nil, &s); err != nil {
+				return err
+			}
+			data = s.Data
+			if inner, ok := data["data"].(map[string]interface{}); ok && strings.Contains(ref.path, "/data/") {
+				data = inner
+			}
+			read[ref.path] = data
+			if s.LeaseID != "" {
+				ttl := time.Duration(s.LeaseDuration) * time.Second
+				v.leases[ref.path] = &vaultLease{
+					id:        s.LeaseID,
+					path:      ref.path,
+					renewable: s.Renewable,
+					ttl:       ttl,
+					expires:   time.Now().Add(ttl),
+				}
+			}
+		}
+		val, ok := data[ref.field]
+		if !ok {
+			return fmt.Errorf("%s: no field %q", ref.path, ref.field)
+		}
+		os.Setenv(ref.env, fmt.Sprint(val))
+	}
+	return nil
+}
+
+// renew keeps the login token and the secret leases alive, logging in
+// again or re-reading secrets when they can no longer be extended.
+func (v *vaultClient) renew(ctx context.Context, now time.Time) {
+	if v.tokTTL > 0 && now.Sub(v.tokAt) > v.tokTTL/2 {
+		var res vaultAuthResponse
+		err := fmt.Errorf("token not renewable")
+		if v.renewableToken {
+			err = v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &res)
+		}
+		if err == nil {
+			v.tokAt, v.tokTTL = now, time.Duration(res.Auth.LeaseDuration)*time.Second
+		} else if vaultAuth != "token" {
+			fmt.Printf("[vault] token renewal: %v; logging in again\n", err)
+			if err := v.login(ctx); err != nil {
+				fmt.Printf("[vault] login: %v\n", err)
+			}
+		} else {
+			fmt.Printf("[vault] token renewal: %v\n", err)
+		}
+	}
+
+	reread := map[string]bool{}
+	for path, l := range v.leases {
+		if l.expires.Sub(now) > l.ttl/2 {
+			continue
+		}
+		if !l.renewable {
+			reread[path] = true
+			continue
+		}
+		var res struct {
+			LeaseDuration int `json:"lease_duration"`
+		}
+		err := v.do(ctx, http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": l.id}, &res)
+		ttl := time.Duration(res.LeaseDuration) * time.Second
+		// Near the max TTL Vault grants less than asked; read afresh then.
+		if err != nil || ttl < 2*time.Minute {
+			reread[path] = true
+			continue
+		}
+		l.ttl, l.expires = ttl, now.Add(ttl)
+	}
+	if len(reread) > 0 {
+		for path := range reread {
+			delete(v.leases, path)
+			fmt.Printf("[vault] lease for %s ended; reading new credentials (applied on restart)\n", path)
+		}
+		if err := v.fetch(ctx, reread); err != nil {
+			fmt.Printf("[vault] %v\n", err)
+		}
+	}
+}
+
+func (v *vaultClient) loop(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			v.renew(ctx, now)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// fakeVault answers token lookups and KV v2 reads of secret/data/dtms.
+func fakeVault(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": 0}})
+		case "/v1/secret/data/dtms":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data": map[string]interface{}{"key": "from-vault", "n": 42},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func withVault(t *testing.T, addr, secrets string) {
+	savedAddr, savedSecrets, savedAuth := vaultAddr, vaultSecrets, vaultAuth
+	t.Cleanup(func() {
+		vaultAddr, vaultSecrets, vaultAuth = savedAddr, savedSecrets, savedAuth
+		vaultOnce, vaultErr = sync.Once{}, nil
+		vault = &vaultClient{leases: map[string]*vaultLease{}}
+	})
+	vaultAddr, vaultSecrets, vaultAuth = addr, secrets, "token"
+	vaultOnce, vaultErr = sync.Once{}, nil
+	t.Setenv("VAULT_TOKEN", "root")
+}
+
+// The first setting read fetches the secrets, so settings captured in
+// package variables see them whatever they are.
+func TestVaultBeforeSettings(t *testing.T) {
+	srv := fakeVault(t)
+	withVault(t, srv.URL, "DTMS_TEST_KEY=secret/data/dtms#key; DTMS_TEST_N=secret/data/dtms#n")
+	t.Setenv("DTMS_TEST_KEY", "from-env")
+	t.Setenv("DTMS_TEST_N", "")
+	if got := envOr("DTMS_TEST_KEY", ""); got != "from-vault" {
+		t.Errorf("DTMS_TEST_KEY = %q, want the Vault value", got)
+	}
+	if got := envOrInt("DTMS_TEST_N", 0); got != 42 {
+		t.Errorf("DTMS_TEST_N = %d", got)
+	}
+	if err := vaultLoaded(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	srv := fakeVault(t)
+	for _, tc := range []struct{ name, secrets, token string }{
+		{"bad entry", "DTMS_TEST_KEY=secret/data/dtms", "root"},
+		{"no such field", "DTMS_TEST_KEY=secret/data/dtms#nope", "root"},
+		{"no such path", "DTMS_TEST_KEY=secret/data/other#key", "root"},
+		{"login refused", "DTMS_TEST_KEY=secret/data/dtms#key", "wrong"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withVault(t, srv.URL, tc.secrets)
+			t.Setenv("VAULT_TOKEN", tc.token)
+			t.Setenv("DTMS_TEST_KEY", "")
+			if err := vaultLoaded(); err == nil {
+				t.Error("no error")
+			}
+			if v := os.Getenv("DTMS_TEST_KEY"); v != "" {
+				t.Errorf("DTMS_TEST_KEY set to %q", v)
+			}
+		})
+	}
+}
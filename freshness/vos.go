@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transfers belong to a virtual organisation (VO), the experiment whose
+// data they move, and a site usually serves several. A site lists the VOs
+// it serves under `vos:` in SITES_CONFIG; they become its "vo" tag, which
+// a selector term vo=NAME matches when NAME is any of them, and ?vo=NAME
+// adds that term to every ?tags= filter. Events carry their VO in "vo";
+// one that arrives without it is given its site's VO when the site serves
+// exactly one.
+//
+// Each VO's flows into each site are counted from ingested events and kept
+// in VO_FLOWS_FILE: GET /api/v1/vos?vo=&site= lists them with the time of
+// the last arrival, and they are exported as dtms_vo_* with vo and site
+// labels. The event stream, accounting and report tenants (`vo:`) take a
+// VO too, so an experiment can be shown only its own data.
+var voFlowsPath = envOr("VO_FLOWS_FILE", filepath.Join(dataDir, "vo-flows.json"))
+
+// voTagKey is the tag holding a site's VOs, comma-separated.
+const voTagKey = "vo"
+
+// hasVO reports whether the comma-separated list vos includes vo.
+func hasVO(vos, vo string) bool {
+	for _, v := range strings.Split(vos, ",") {
+		if v == vo {
+			return true
+		}
+	}
+	return false
+}
+
+// siteVO is the VO of site's transfers when it serves only one.
+func siteVO(site string) string {
+	vos := siteRegistry().lookup(site).Metadata[voTagKey]
+	if vos == "" || strings.Contains(vos, ",") {
+		return ""
+	}
+	return vos
+}
+
+// VOFlow is one VO's transfers into one site.
+type VOFlow struct {
+	VO          string  `json:"vo"`
+	Site        string  `json:"site"`
+	Transfers   int64   `json:"transfers"`
+	Failed      int64   `json:"failed"`
+	Bytes       int64   `json:"bytes"`
+	LastArrival float64 `json:"last_arrival,omitempty"`
+	LastFailure float64 `json:"last_failure,omitempty"`
+	// AgeSeconds is the time since LastArrival, set when listed.
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+}
+
+type voFlowKey struct{ vo, site string }
+
+type voFlowStore struct {
+	mu    sync.Mutex
+	flows map[voFlowKey]*VOFlow
+	dirty bool
+}
+
+var voFlows = &voFlowStore{flows: map[voFlowKey]*VOFlow{}}
+
+var (
+	voLabels       = []string{"vo", "site"}
+	voTransfers    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dtms_vo_transfers_total", Help: "Ingested transfers by VO, site and status"}, []string{"vo", "site", "status"})
+	voBytes        = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dtms_vo_transferred_bytes_total", Help: "Bytes of a VO's successful transfers into a site"}, voLabels)
+	gaugeVOArrival = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_vo_last_arrival_timestamp_seconds", Help: "When a VO's data last arrived at a site"}, voLabels)
+	gaugeVOSite    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dtms_vo_site_info", Help: "1 for every site SITES_CONFIG says serves a VO"}, voLabels)
+)
+
+func init() {
+	prometheus.MustRegister(voTransfers, voBytes, gaugeVOArrival, gaugeVOSite)
+}
+
+func (s *voFlowStore) Load() error {
+	raw, err := os.ReadFile(voFlowsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*VOFlow
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", voFlowsPath, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range list {
+		s.flows[voFlowKey{f.VO, f.Site}] = f
+		if f.LastArrival > 0 {
+			gaugeVOArrival.WithLabelValues(f.VO, f.Site).Set(f.LastArrival)
+		}
+	}
+	return nil
+}
+
+// Observe counts an accepted transfer event against its VO.
+func (s *voFlowStore) Observe(ev TransferEvent) {
+	if ev.VO == "" || (ev.Status != "success" && ev.Status != "failed") {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := voFlowKey{ev.VO, ev.Site}
+	f := s.flows[k]
+	if f == nil {
+		f = &VOFlow{VO: ev.VO, Site: ev.Site}
+		s.flows[k] = f
+	}
+	voTransfers.WithLabelValues(ev.VO, ev.Site, ev.Status).Inc()
+	if ev.Status == "failed" {
+		f.Failed++
+		f.LastFailure = max(f.LastFailure, ev.Timestamp)
+	} else {
+		f.Transfers++
+		f.Bytes += ev.Bytes
+		voBytes.WithLabelValues(ev.VO, ev.Site).Add(float64(ev.Bytes))
+		if ev.Timestamp > f.LastArrival {
+			f.LastArrival = ev.Timestamp
+			gaugeVOArrival.WithLabelValues(ev.VO, ev.Site).Set(ev.Timestamp)
+		}
+	}
+	s.dirty = true
+}
+
+// List returns the flows of vo into site, either empty for all, and the
+// flows sites are configured for but have not seen yet, at now.
+func (s *voFlowStore) List(vo, site string, now time.Time) []VOFlow {
+	s.mu.Lock()
+	out := []VOFlow{}
+	seen := map[voFlowKey]bool{}
+	for k, f := range s.flows {
+		if (vo == "" || k.vo == vo) && (site == "" || k.site == site) {
+			out = append(out, *f)
+			seen[k] = true
+		}
+	}
+	s.mu.Unlock()
+	reg := siteRegistry()
+	for name := range reg.Sites {
+		if site != "" && name != site {
+			continue
+		}
+		for _, v := range strings.Split(reg.lookup(name).Metadata[voTagKey], ",") {
+			if v != "" && (vo == "" || v == vo) && !seen[voFlowKey{v, name}] {
+				out = append(out, VOFlow{VO: v, Site: name})
+			}
+		}
+	}
+	for i := range out {
+		if out[i].LastArrival > 0 {
+			age := now.Sub(unixTime(out[i].LastArrival)).Seconds()
+			out[i].AgeSeconds = &age
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].VO != out[j].VO {
+			return out[i].VO < out[j].VO
+		}
+		return out[i].Site < out[j].Site
+	})
+	return out
+}
+
+// publishSiteVOs exports which sites serve which VO.
+func publishSiteVOs(r *sitesFile) {
+	gaugeVOSite.Reset()
+	for name := range r.Sites {
+		for _, v := range strings.Split(r.lookup(name).Metadata[voTagKey], ",") {
+			if v != "" {
+				gaugeVOSite.WithLabelValues(v, name).Set(1)
+			}
+		}
+	}
+}
+
+func (s *voFlowStore) flushLoop(ctx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		if s.dirty {
+			list := make([]*VOFlow, 0, len(s.flows))
+			for _, f := range s.flows {
+				list = append(list, f)
+			}
+			raw, err := json.Marshal(list)
+			if err == nil {
+				err = writeFileAtomic(voFlowsPath, raw)
+			}
+			if err != nil {
+				fmt.Printf("[vos] save: %v\n", err)
+			} else {
+				s.dirty = false
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleVOs serves GET /api/v1/vos?vo=&site=, grouping the flows by VO.
+func handleVOs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	type voSummary struct {
+		VO          string   `json:"vo"`
+		Transfers   int64    `json:"transfers"`
+		Failed      int64    `json:"failed"`
+		Bytes       int64    `json:"bytes"`
+		LastArrival float64  `json:"last_arrival,omitempty"`
+		Sites       []VOFlow `json:"sites"`
+	}
+	out := []*voSummary{}
+	for _, f := range voFlows.List(q.Get("vo"), q.Get("site"), time.Now()) {
+		if len(out) == 0 || out[len(out)-1].VO != f.VO {
+			out = append(out, &voSummary{VO: f.VO})
+		}
+		v := out[len(out)-1]
+		v.Transfers += f.Transfers
+		v.Failed += f.Failed
+		v.Bytes += f.Bytes
+		v.LastArrival = max(v.LastArrival, f.LastArrival)
+		v.Sites = append(v.Sites, f)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"vos": out})
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/youruser/dtms-fresh/internal/yamlenv"
+	"gopkg.in/yaml.v3"
+)
+
+// WAREHOUSE_CONFIG lists sinks that receive every ingested transfer event
+// and an hourly per-site freshness rollup, for joining DTMS data with other
+// datasets:
+//
+//	sinks:
+//	  - name: analytics
+//	    type: bigquery
+//	    project: my-project
+//	    dataset: dtms
+//	    credentials_file: /secrets/bq.json   # metadata server when unset
+//	  - name: dwh
+//	    type: sql
+//	    dsn: postgres://dtms@dwh/analytics
+//
+// Rows go to the tables transfer_events and freshness_hourly, and alerts
+// posted to /api/v1/incidents/alerts to alert_events. A sink's `tables`
+// map renames them; an empty name skips the table. Each sink buffers up to
+// WAREHOUSE_BUFFER_ROWS and writes batches of WAREHOUSE_BATCH_ROWS every
+// WAREHOUSE_FLUSH_SECONDS; failed batches stay buffered and the oldest rows
+// are dropped once it is full. New sink types register with registerSink.
+var (
+	warehouseConfigPath = envOr("WAREHOUSE_CONFIG", "")
+	warehouseStatePath  = envOr("WAREHOUSE_STATE", filepath.Join(dataDir, "warehouse-state.json"))
+	warehouseBuffer     = envOrInt("WAREHOUSE_BUFFER_ROWS", 100000)
+	warehouseBatch      = envOrInt("WAREHOUSE_BATCH_ROWS", 500)
+	warehouseFlush      = time.Duration(envOrInt("WAREHOUSE_FLUSH_SECONDS", 10)) * time.Second
+)
+
+const (
+	tableTransferEvents  = "transfer_events"
+	tableFreshnessHourly = "freshness_hourly"
+	tableAlertEvents     = "alert_events"
+	// warehouseBackfill bounds how many missed hours are rolled up after a
+	// restart.
+	warehouseBackfill = 48 * time.Hour
+)
+
+// warehouseRow is one row for a table; insertID lets sinks that support it
+// drop redelivered rows, and at is the time the row describes.
+type warehouseRow struct {
+	table    string
+	insertID string
+	at       time.Time
+	values   map[string]interface{}
+}
+
+// warehouseSink writes batches of rows, all for the same table.
+type warehouseSink interface {
+	Name() string
+	Insert(ctx context.Context, table string, rows []warehouseRow) error
+}
+
+type sinkFactory func(name string, params *yaml.Node) (warehouseSink, error)
+
+var sinkFactories = map[string]sinkFactory{}
+
+func registerSink(typ string, f sinkFactory) {
+	if _, dup := sinkFactories[typ]; dup {
+		panic("duplicate sink type " + typ)
+	}
+	sinkFactories[typ] = f
+}
+
+var (
+	warehouseRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_warehouse_rows_total", Help: "Rows handed to warehouse sinks by result (written, failed, rejected, dropped)"},
+		[]string{"sink", "table", "result"},
+	)
+	warehouseBuffered = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_warehouse_buffered_rows", Help: "Rows waiting to be written to a warehouse sink"},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(warehouseRows, warehouseBuffered)
+}
+
+// bufferedSink queues rows for one sink so a slow or failing warehouse
+// never holds up ingestion or the other sinks.
+type bufferedSink struct {
+	warehouseSink
+	tables map[string]string
+
+	mu    sync.Mutex
+	queue []warehouseRow
+}
+
+func (b *bufferedSink) enqueue(rows ...warehouseRow) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range rows {
+		if name, ok := b.tables[r.table]; !ok || name != "" {
+			b.queue = append(b.queue, r)
+		}
+	}
+	if over := len(b.queue) - warehouseBuffer; over > 0 {
+		for _, r := range b.queue[:over] {
+			warehouseRows.WithLabelValues(b.Name(), r.table, "dropped").Inc()
+		}
+		b.queue = append([]warehouseRow(nil), b.queue[over:]...)
+	}
+	warehouseBuffered.WithLabelValues(b.Name()).Set(float64(len(b.queue)))
+}
+
+// flush writes the queue head in per-table batches until it is empty or a
+// batch fails.
+func (b *bufferedSink) flush(ctx context.Context) {
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		table := b.queue[0].table
+		var batch []warehouseRow
+		for _, r := range b.queue {
+			if r.table != table || len(batch) == warehouseBatch {
+				break
+			}
+			batch = append(batch, r)
+		}
+		b.mu.Unlock()
+
+		name := table
+		if t, ok := b.tables[table]; ok {
+			name = t
+		}
+		if err := b.Insert(ctx, name, batch); err != nil {
+			warehouseRows.WithLabelValues(b.Name(), table, "failed").Add(float64(len(batch)))
+			fmt.Printf("[warehouse] %s: insert %d rows into %s: %v\n", b.Name(), len(batch), name, err)
+			return
+		}
+		warehouseRows.WithLabelValues(b.Name(), table, "written").Add(float64(len(batch)))
+		b.mu.Lock()
+		// enqueue may have dropped rows from the front meanwhile.
+		if n := len(batch); len(b.queue) >= n && b.queue[0].insertID == batch[0].insertID {
+			b.queue = b.queue[n:]
+		}
+		warehouseBuffered.WithLabelValues(b.Name()).Set(float64(len(b.queue)))
+		b.mu.Unlock()
+	}
+}
+
+type warehouseExport struct {
+	sinks []*bufferedSink
+
+	mu         sync.Mutex
+	LastRollup time.Time `json:"last_rollup"`
+}
+
+var warehouse = &warehouseExport{}
+
+func loadWarehouse() error {
+	if warehouseConfigPath == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(warehouseConfigPath)
+	if err != nil {
+		return err
+	}
+	// Sink entries have the same name/type/params shape as sources.
+	var doc struct {
+		Sinks []sourceConfig `yaml:"sinks"`
+	}
+	if err := yamlenv.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("%s: %w", warehouseConfigPath, err)
+	}
+	for _, c := range doc.Sinks {
+		factory, ok := sinkFactories[c.Type]
+		if !ok {
+			return fmt.Errorf("sink %q: unknown type %q", c.Name, c.Type)
+		}
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		sink, err := factory(c.Name, &c.params)
+		if err != nil {
+			return fmt.Errorf("sink %q: %w", c.Name, err)
+		}
+		var opts struct {
+			Tables map[string]string `yaml:"tables"`
+		}
+		c.params.Decode(&opts)
+		warehouse.sinks = append(warehouse.sinks, &bufferedSink{warehouseSink: sink, tables: opts.Tables})
+	}
+	if raw, err := os.ReadFile(warehouseStatePath); err == nil {
+		json.Unmarshal(raw, warehouse)
+	}
+	return nil
+}
+
+func (w *warehouseExport) enqueue(rows ...warehouseRow) {
+	for _, s := range w.sinks {
+		s.enqueue(rows...)
+	}
+}
+
+// Observe queues one accepted transfer event.
+func (w *warehouseExport) Observe(ev TransferEvent) {
+	if len(w.sinks) == 0 {
+		return
+	}
+	w.enqueue(warehouseRow{table: tableTransferEvents, insertID: ev.ID, at: unixTime(ev.Timestamp), values: map[string]interface{}{
+		"id":        ev.ID,
+		"timestamp": unixTime(ev.Timestamp).Format(time.RFC3339Nano),
+		"site":      ev.Site,
+		"source":    ev.Source,
+		"tenant":    ev.Tenant,
+		"bytes":     ev.Bytes,
+		"duration":  ev.Duration,
+		"status":    ev.Status,
+		"reason":    ev.Reason,
+		"dataset":   ev.Dataset,
+		"file":      ev.File,
+	}})
+}
+
+// alertEvent is one alert of an Alertmanager webhook notification.
+type alertEvent struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// ObserveAlert queues one alert notification; a firing alert and its
+// resolution are separate rows.
+func (w *warehouseExport) ObserveAlert(a alertEvent) {
+	if len(w.sinks) == 0 {
+		return
+	}
+	at := a.StartsAt
+	if a.Status == "resolved" {
+		at = a.EndsAt
+	}
+	w.enqueue(warehouseRow{table: tableAlertEvents, insertID: a.Fingerprint + "@" + a.Status + "@" + a.StartsAt.Format(time.RFC3339), at: at, values: map[string]interface{}{
+		"timestamp":   at.UTC().Format(time.RFC3339Nano),
+		"alertname":   a.Labels["alertname"],
+		"site":        a.Labels["site"],
+		"severity":    a.Labels["severity"],
+		"status":      a.Status,
+		"fingerprint": a.Fingerprint,
+		"summary":     a.Annotations["summary"],
+		"starts_at":   a.StartsAt.UTC().Format(time.RFC3339Nano),
+	}})
+}
+
+// rollup queues freshness_hourly rows for every complete hour since the
+// last one, from history.
+func (w *warehouseExport) rollup(now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	end := now.UTC().Truncate(time.Hour)
+	hour := w.LastRollup
+	if hour.Before(end.Add(-warehouseBackfill)) {
+		hour = end.Add(-warehouseBackfill)
+	}
+	if !hour.Before(end) {
+		return nil
+	}
+	samples, err := history.Query("", hour, end.Add(-time.Millisecond))
+	if err != nil {
+		return err
+	}
+	type agg struct {
+		n, ok       int
+		sum, maxAge float64
+	}
+	byHour := map[time.Time]map[string]*agg{}
+	for _, s := range samples {
+		h := unixTime(s.Timestamp).Truncate(time.Hour)
+		if byHour[h] == nil {
+			byHour[h] = map[string]*agg{}
+		}
+		a := byHour[h][s.Site]
+		if a == nil {
+			a = &agg{}
+			byHour[h][s.Site] = a
+		}
+		a.n++
+		a.sum += s.AgeSeconds
+		if s.Ok {
+			a.ok++
+		}
+		if s.AgeSeconds > a.maxAge {
+			a.maxAge = s.AgeSeconds
+		}
+	}
+	var rows []warehouseRow
+	for h, sites := range byHour {
+		for site, a := range sites {
+			rows = append(rows, warehouseRow{table: tableFreshnessHourly, insertID: site + "@" + h.Format(time.RFC3339), at: h, values: map[string]interface{}{
+				"hour":             h.Format(time.RFC3339),
+				"site":             site,
+				"samples":          a.n,
+				"ok_ratio":         float64(a.ok) / float64(a.n),
+				"mean_age_seconds": a.sum / float64(a.n),
+				"max_age_seconds":  a.maxAge,
+			}})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].insertID < rows[j].insertID })
+	w.enqueue(rows...)
+	w.LastRollup = end
+	raw, _ := json.Marshal(w)
+	return writeFileAtomic(warehouseStatePath, raw)
+}
+
+func (w *warehouseExport) loop(ctx context.Context) {
+	t := time.NewTicker(warehouseFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := w.rollup(time.Now()); err != nil {
+			fmt.Printf("[warehouse] rollup: %v\n", err)
+		}
+		for _, s := range w.sinks {
+			s.flush(ctx)
+		}
+	}
+}
+
+// sqlSink inserts into existing tables of a PostgreSQL or MySQL database,
+// with DSNs in the DB_TARGETS format. Columns are the row's keys.
+type sqlSink struct {
+	name string
+	DSN  string `yaml:"dsn"`
+	db   *sql.DB
+	pg   bool
+}
+
+func init() {
+	registerSink("sql", func(name string, params *yaml.Node) (warehouseSink, error) {
+		s := &sqlSink{name: name}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		driver, dsn := "postgres", s.DSN
+		if rest, ok := strings.CutPrefix(dsn, "mysql:"); ok {
+			driver, dsn = "mysql", rest
+		}
+		db, err := sql.Open(driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		s.db, s.pg = db, driver == "postgres"
+		return s, nil
+	})
+}
+
+func (s *sqlSink) Name() string { return s.name }
+
+func (s *sqlSink) Insert(ctx context.Context, table string, rows []warehouseRow) error {
+	cols := make([]string, 0, len(rows[0].values))
+	for c := range rows[0].values {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	var q strings.Builder
+	fmt.Fprintf(&q, "INSERT INTO %s (%s) VALUES ", table, strings.Join(cols, ", "))
+	args := make([]interface{}, 0, len(rows)*len(cols))
+	for i, r := range rows {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		q.WriteString("(")
+		for j, c := range cols {
+			if j > 0 {
+				q.WriteString(", ")
+			}
+			args = append(args, r.values[c])
+			if s.pg {
+				fmt.Fprintf(&q, "$%d", len(args))
+			} else {
+				q.WriteString("?")
+			}
+		}
+		q.WriteString(")")
+	}
+	_, err := s.db.ExecContext(ctx, q.String(), args...)
+	return err
+}
+
+// bigQuerySink streams rows with tabledata.insertAll, using insert IDs for
+// BigQuery's best-effort de-duplication. Credentials come from a service
+// account key file, else the GCE/GKE metadata server.
+type bigQuerySink struct {
+	name            string
+	Project         string `yaml:"project"`
+	Dataset         string `yaml:"dataset"`
+	CredentialsFile string `yaml:"credentials_file"`
+	Endpoint        string `yaml:"endpoint"`
+
+	tokens *googleTokenSource
+}
+
+func init() {
+	registerSink("bigquery", func(name string, params *yaml.Node) (warehouseSink, error) {
+		s := &bigQuerySink{name: name, Endpoint: "https://bigquery.googleapis.com"}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.Project == "" || s.Dataset == "" {
+			return nil, fmt.Errorf("project and dataset are required")
+		}
+		s.tokens = &googleTokenSource{scope: "https://www.googleapis.com/auth/bigquery.insertdata"}
+		if s.CredentialsFile != "" {
+			if err := s.tokens.loadKey(s.CredentialsFile); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	})
+}
+
+func (s *bigQuerySink) Name() string { return s.name }
+
+func (s *bigQuerySink) Insert(ctx context.Context, table string, rows []warehouseRow) error {
+	type insertRow struct {
+		InsertID string                 `json:"insertId"`
+		JSON     map[string]interface{} `json:"json"`
+	}
+	body := struct {
+		Rows []insertRow `json:"rows"`
+	}{}
+	for _, r := range rows {
+		body.Rows = append(body.Rows, insertRow{r.insertID, r.values})
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	tok, err := s.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+		strings.TrimRight(s.Endpoint, "/"), url.PathEscape(s.Project), url.PathEscape(s.Dataset), url.PathEscape(table))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("insertAll: %s", resp.Status)
+	}
+	var out struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return err
+	}
+	// Rejected rows would be rejected again, so they are reported and
+	// counted rather than retried.
+	for _, e := range out.InsertErrors {
+		warehouseRows.WithLabelValues(s.name, table, "rejected").Inc()
+		if len(e.Errors) > 0 {
+			fmt.Printf("[warehouse] %s: row %s rejected: %s\n", s.name, rows[e.Index].insertID, e.Errors[0].Message)
+		}
+	}
+	return nil
+}
+
+// googleTokenSource mints OAuth2 access tokens from a service account key
+// (JWT bearer grant) or, without one, asks the metadata server.
+type googleTokenSource struct {
+	scope    string
+	email    string
+	tokenURL string
+	key      *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (g *googleTokenSource) loadKey(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("%s: no private key", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an RSA key", path)
+	}
+	g.email, g.key, g.tokenURL = sa.ClientEmail, key, sa.TokenURI
+	if g.tokenURL == "" {
+		g.tokenURL = "https://oauth2.googleapis.com/token"
+	}
+	return nil
+}
+
+func (g *googleTokenSource) Token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expires.Add(-time.Minute)) {
+		return g.token, nil
+	}
+	var req *http.Request
+	var err error
+	if g.key == nil {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(g.scope), nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	} else {
+		var assertion string
+		if assertion, err = g.assertion(time.Now()); err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, g.tokenURL, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	g.token = tok.AccessToken
+	g.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return g.token, nil
+}
+
+// assertion is the RS256-signed JWT exchanged for an access token.
+func (g *googleTokenSource) assertion(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": g.email, "scope": g.scope, "aud": g.tokenURL,
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(nil, g.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
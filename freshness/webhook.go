@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	webhookToken    = envOr("WEBHOOK_TOKEN", "")
+	webhookTokens   = parseKeyValues(envOr("WEBHOOK_TOKENS", ""))
+	webhookMaxBytes = int64(envOrInt("WEBHOOK_MAX_BYTES", 1<<20))
+)
+
+// webhookTranslator converts one notification body into transfer events.
+// Translators may leave ID empty; one is derived from the payload.
+type webhookTranslator func(r *http.Request, body []byte) ([]TransferEvent, error)
+
+var webhookTranslators = map[string]webhookTranslator{
+	"dtms":   translateDTMS,
+	"rclone": translateRclone,
+	"rsync":  translateRsyncStats,
+}
+
+// handleWebhook serves POST /webhooks/{source}.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	source := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	translate, ok := webhookTranslators[source]
+	if !ok {
+		http.Error(w, "unknown webhook source", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBytes+1))
+	var tooLarge *http.MaxBytesError
+	if err != nil && !errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > webhookMaxBytes || tooLarge != nil {
+		webhookRejections.WithLabelValues(source, "too_large").Inc()
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	reason, scope := webhookVerify(source, r, body)
+	if reason != "" {
+		webhookRejections.WithLabelValues(source, reason).Inc()
+		http.Error(w, "unauthorized: "+reason, http.StatusUnauthorized)
+		return
+	}
+	// signatures cover the body as sent, so decompress only after checking
+	if body, err = decodeBody(r, body, webhookMaxDecodedBytes); err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedEncoding):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.As(err, &tooLarge):
+			webhookRejections.WithLabelValues(source, "too_large").Inc()
+			http.Error(w, "decoded payload too large", http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	origin := "webhook:" + source
+	events, err := translate(r, body)
+	if err != nil {
+		ingestEvents.WithLabelValues(origin, "invalid").Inc()
+		deadLetters.Add(origin, deadLetterInvalid, body, fmt.Errorf("%w: %v", errInvalidEvent, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scope != "" {
+		for _, ev := range events {
+			if ev.Site != scope {
+				webhookRejections.WithLabelValues(source, "scope").Inc()
+				http.Error(w, "agent token is not valid for site "+ev.Site, http.StatusForbidden)
+				return
+			}
+		}
+	}
+	// Queue the whole request before waiting on any of it. If the queue
+	// fills part way, the sender retries the request and the events that
+	// did get in are dropped as redeliveries.
+	tickets := make([]ingestTicket, 0, len(events))
+	for i := range events {
+		if events[i].ID == "" {
+			sum := sha256.Sum256(append([]byte(fmt.Sprintf("%s/%d/", source, i)), body...))
+			events[i].ID = source + ":" + hex.EncodeToString(sum[:12])
+		}
+		t, err := ingest.TrySubmit(origin, events[i])
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		tickets = append(tickets, t)
+	}
+	for _, t := range tickets {
+		if err := t.Wait(); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errInvalidEvent) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"accepted": len(events)})
+}
+
+// webhookTokenValid checks the bearer token configured for source, falling
+// back to WEBHOOK_TOKEN. Sources without any token are rejected.
+func webhookTokenValid(source string, r *http.Request) bool {
+	want := webhookTokens[source]
+	if want == "" {
+		want = webhookToken
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// translateDTMS accepts native TransferEvent JSON, a single object or an array.
+func translateDTMS(_ *http.Request, body []byte) ([]TransferEvent, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var events []TransferEvent
+		err := json.Unmarshal(body, &events)
+		return events, err
+	}
+	var ev TransferEvent
+	err := json.Unmarshal(body, &ev)
+	return []TransferEvent{ev}, err
+}
+
+// translateRclone accepts the output of `rclone rc job/status`, optionally
+// with the job's `core/stats` embedded under "stats". The site comes from
+// the ?site= query parameter.
+func translateRclone(r *http.Request, body []byte) ([]TransferEvent, error) {
+	var job struct {
+		ID       int64   `json:"id"`
+		Finished bool    `json:"finished"`
+		Success  bool    `json:"success"`
+		Error    string  `json:"error"`
+		EndTime  string  `json:"endTime"`
+		Duration float64 `json:"duration"`
+		Stats    struct {
+			Bytes int64 `json:"bytes"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(body, &job); err != nil {
+		return nil, err
+	}
+	if !job.Finished {
+		return nil, errors.New("rclone job not finished")
+	}
+	end, err := time.Parse(time.RFC3339Nano, job.EndTime)
+	if err != nil {
+		return nil, fmt.Errorf("endTime: %w", err)
+	}
+	status := "success"
+	if !job.Success {
+		status = "failed"
+	}
+	site := r.URL.Query().Get("site")
+	return []TransferEvent{{
+		ID:        fmt.Sprintf("rclone:%s:%d:%d", site, job.ID, end.Unix()),
+		Site:      site,
+		Timestamp: float64(end.UnixNano()) / 1e9,
+		Bytes:     job.Stats.Bytes,
+		Duration:  job.Duration,
+		Status:    status,
+		Reason:    job.Error,
+	}}, nil
+}
+
+// translateRsyncStats accepts the text printed by `rsync --stats`, posted
+// by a wrapper script with ?site=, &exit_code= and &duration= set, and
+// optionally &dataset=, &file= and &id=. Without an id, the event's is
+// made of the site, file or dataset, bytes and second, so a wrapper
+// running several transfers at once should pass one.
+func translateRsyncStats(r *http.Request, body []byte) ([]TransferEvent, error) {
+	q := r.URL.Query()
+	now := time.Now().Unix()
+	ev := TransferEvent{
+		ID:        q.Get("id"),
+		Site:      q.Get("site"),
+		Timestamp: float64(now),
+		Status:    "success",
+		Dataset:   q.Get("dataset"),
+		File:      q.Get("file"),
+	}
+	if code := q.Get("exit_code"); code != "" && code != "0" {
+		ev.Status = "failed"
+		ev.Reason = "rsync exit code " + code
+		if msg, ok := rsyncExitReasons[code]; ok {
+			ev.Reason += ": " + msg
+		}
+	}
+	ev.Duration, _ = strconv.ParseFloat(q.Get("duration"), 64)
+
+	found := false
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok || strings.TrimSpace(name) != "Total transferred file size" {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			break
+		}
+		ev.Bytes, _ = strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64)
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no rsync --stats summary in body")
+	}
+	if ev.ID == "" {
+		what := ev.File
+		if what == "" {
+			what = ev.Dataset
+		}
+		ev.ID = fmt.Sprintf("rsync:%s:%s:%d:%d", ev.Site, what, ev.Bytes, now)
+	}
+	return []TransferEvent{ev}, nil
+}
+
+// rsyncExitReasons are the rsync(1) exit codes worth classifying.
+var rsyncExitReasons = map[string]string{
+	"5":  "error starting client-server protocol",
+	"10": "error in socket I/O",
+	"11": "error in file I/O",
+	"12": "error in rsync protocol data stream",
+	"23": "partial transfer due to error",
+	"30": "timeout in data send/receive",
+	"35": "timeout waiting for daemon connection",
+}
+
+// parseKeyValues parses "a=1,b=2" style environment values.
+func parseKeyValues(s string) map[string]string {
+	out := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if ok && k != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
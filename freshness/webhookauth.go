@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Besides bearer tokens, a webhook source can be required to sign its
+// requests or present a client certificate:
+//
+//	WEBHOOK_HMAC_SECRETS=rclone=s3cr3t,dtms=...
+//	    X-DTMS-Timestamp: <unix seconds>
+//	    X-DTMS-Nonce:     <optional, unique per request>
+//	    X-DTMS-Signature: sha256=<hex HMAC-SHA256 of "timestamp.nonce.body">
+//	WEBHOOK_CLIENT_CERTS=rsync=mover1.example.org|mover2.example.org
+//	    the request must arrive over TLS with a certificate, verified
+//	    against WEBHOOK_CLIENT_CA_FILE, whose CN or a DNS name is listed
+//
+// Every method configured for a source must pass. A source with neither
+// falls back to its WEBHOOK_TOKENS entry, WEBHOOK_TOKEN or an agent token
+// (see agenttokens.go). Signed requests older or newer than
+// WEBHOOK_MAX_SKEW_SECONDS are refused, and a signature seen within that
+// window is refused as a replay.
+var (
+	webhookHMACSecrets  = parseKeyValues(envOr("WEBHOOK_HMAC_SECRETS", ""))
+	webhookClientCerts  = parseKeyValues(envOr("WEBHOOK_CLIENT_CERTS", ""))
+	webhookClientCAFile = envOr("WEBHOOK_CLIENT_CA_FILE", "")
+	webhookMaxSkew      = time.Duration(envOrInt("WEBHOOK_MAX_SKEW_SECONDS", 300)) * time.Second
+)
+
+var webhookRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "dtms_webhook_rejections_total", Help: "Webhook requests refused by source and reason"},
+	[]string{"source", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(webhookRejections)
+}
+
+// webhookClientCAs is the pool client certificates are verified against,
+// or nil when WEBHOOK_CLIENT_CA_FILE is unset.
+func webhookClientCAs() (*x509.CertPool, error) {
+	if webhookClientCAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(webhookClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", webhookClientCAFile)
+	}
+	return pool, nil
+}
+
+// replayGuard remembers signatures until they fall out of the skew window.
+type replayGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var webhookReplays = &replayGuard{seen: map[string]time.Time{}}
+
+// fresh records sig and reports whether it had not been seen.
+func (g *replayGuard) fresh(sig string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, exp := range g.seen {
+		if now.After(exp) {
+			delete(g.seen, k)
+		}
+	}
+	if _, ok := g.seen[sig]; ok {
+		return false
+	}
+	g.seen[sig] = now.Add(2 * webhookMaxSkew)
+	return true
+}
+
+// webhookVerify authorizes a request for source, returning the rejection
+// reason or "" when it may proceed. A request carrying an agent token may
+// only write events for scope, its site.
+func webhookVerify(source string, r *http.Request, body []byte) (reason, scope string) {
+	secret, signed := webhookHMACSecrets[source]
+	names, pinned := webhookClientCerts[source]
+	if signed {
+		if reason := verifyWebhookSignature(secret, r, body, time.Now()); reason != "" {
+			return reason, ""
+		}
+	}
+	if pinned && !webhookCertAllowed(r, strings.Split(names, "|")) {
+		return "client_cert", ""
+	}
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(bearer, agentTokenPrefix) {
+		site, err := parseAgentToken(bearer, time.Now())
+		if err != nil {
+			return "agent_token", ""
+		}
+		return "", site
+	}
+	if !signed && !pinned && !webhookTokenValid(source, r) {
+		return "unauthorized", ""
+	}
+	return "", ""
+}
+
+func verifyWebhookSignature(secret string, r *http.Request, body []byte, now time.Time) string {
+	ts, err := strconv.ParseInt(r.Header.Get("X-DTMS-Timestamp"), 10, 64)
+	if err != nil {
+		return "bad_signature"
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > webhookMaxSkew || skew < -webhookMaxSkew {
+		return "stale"
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("X-DTMS-Signature"), "sha256=")
+	if !ok {
+		return "bad_signature"
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s.", ts, r.Header.Get("X-DTMS-Nonce"))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(got)), []byte(want)) != 1 {
+		return "bad_signature"
+	}
+	if !webhookReplays.fresh(want, now) {
+		return "replay"
+	}
+	return ""
+}
+
+// webhookCertAllowed checks the verified client certificate's CN and DNS
+// names against names.
+func webhookCertAllowed(r *http.Request, names []string) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, n := range names {
+		if n == leaf.Subject.CommonName {
+			return true
+		}
+		for _, dns := range leaf.DNSNames {
+			if n == dns {
+				return true
+			}
+		}
+	}
+	return false
+}
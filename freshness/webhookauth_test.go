@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signWebhook(secret string, ts int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s.", ts, nonce)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"site":"SITE_A"}`)
+	ts := now.Unix()
+	for _, tc := range []struct {
+		name      string
+		timestamp string
+		nonce     string
+		signature string
+		body      []byte
+		want      string
+	}{
+		{"valid", fmt.Sprint(ts), "", signWebhook("s3cr3t", ts, "", body), body, ""},
+		{"valid with nonce", fmt.Sprint(ts), "n1", signWebhook("s3cr3t", ts, "n1", body), body, ""},
+		{"upper-case hex", fmt.Sprint(ts), "n2", "sha256=" + strings.ToUpper(strings.TrimPrefix(signWebhook("s3cr3t", ts, "n2", body), "sha256=")), body, ""},
+		{"within skew", fmt.Sprint(ts - 299), "", signWebhook("s3cr3t", ts-299, "", body), body, ""},
+		{"too old", fmt.Sprint(ts - 301), "", signWebhook("s3cr3t", ts-301, "", body), body, "stale"},
+		{"from the future", fmt.Sprint(ts + 301), "", signWebhook("s3cr3t", ts+301, "", body), body, "stale"},
+		{"wrong secret", fmt.Sprint(ts), "n3", signWebhook("other", ts, "n3", body), body, "bad_signature"},
+		{"tampered body", fmt.Sprint(ts), "n4", signWebhook("s3cr3t", ts, "n4", body), []byte(`{"site":"SITE_B"}`), "bad_signature"},
+		{"nonce not the signed one", fmt.Sprint(ts), "n5", signWebhook("s3cr3t", ts, "n6", body), body, "bad_signature"},
+		{"timestamp not the signed one", fmt.Sprint(ts - 1), "n7", signWebhook("s3cr3t", ts, "n7", body), body, "bad_signature"},
+		{"missing scheme", fmt.Sprint(ts), "n8", strings.TrimPrefix(signWebhook("s3cr3t", ts, "n8", body), "sha256="), body, "bad_signature"},
+		{"missing timestamp", "", "", signWebhook("s3cr3t", ts, "", body), body, "bad_signature"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			webhookReplays = &replayGuard{seen: map[string]time.Time{}}
+			r, _ := http.NewRequest(http.MethodPost, "/webhooks/dtms", nil)
+			r.Header.Set("X-DTMS-Timestamp", tc.timestamp)
+			r.Header.Set("X-DTMS-Nonce", tc.nonce)
+			r.Header.Set("X-DTMS-Signature", tc.signature)
+			if got := verifyWebhookSignature("s3cr3t", r, tc.body, now); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookSignatureReplay(t *testing.T) {
+	webhookReplays = &replayGuard{seen: map[string]time.Time{}}
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{}`)
+	r, _ := http.NewRequest(http.MethodPost, "/webhooks/dtms", nil)
+	r.Header.Set("X-DTMS-Timestamp", fmt.Sprint(now.Unix()))
+	r.Header.Set("X-DTMS-Signature", signWebhook("k", now.Unix(), "", body))
+	for i, want := range []string{"", "replay"} {
+		if got := verifyWebhookSignature("k", r, body, now); got != want {
+			t.Fatalf("delivery %d: got %q, want %q", i+1, got, want)
+		}
+	}
+	// the guard forgets signatures once they could no longer pass the
+	// skew check anyway
+	if !webhookReplays.fresh("other", now.Add(3*webhookMaxSkew)) || len(webhookReplays.seen) != 1 {
+		t.Errorf("old signatures kept: %v", webhookReplays.seen)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// xrootdSource listens for XRootD summary monitoring packets (xrd.report).
+// The packets are unauthenticated UDP, so the site comes from servers, a
+// table of sender addresses, CIDR ranges or host names (resolved at
+// start) to sites, never from the packet; packets from any other sender
+// are dropped. A server's freshness is the last report in which its link
+// byte counters moved.
+//
+//	type: xrootd
+//	listen: ":9931"
+//	servers:
+//	  xrootd.site-a.example.org: SITE_A
+//	  192.0.2.0/28: SITE_B
+type xrootdSource struct {
+	name    string
+	Listen  string            `yaml:"listen"`
+	Servers map[string]string `yaml:"servers"`
+
+	senders []xrootdSender
+	mu      sync.Mutex
+	servers map[string]*xrootdServer
+}
+
+// xrootdSender maps a range of sender addresses to a site.
+type xrootdSender struct {
+	ips  *net.IPNet
+	site string
+}
+
+type xrootdServer struct {
+	site         string
+	lastTod      int64
+	lastIn       float64
+	lastOut      float64
+	lastActivity time.Time
+}
+
+type xrootdSummary struct {
+	Tod   int64  `xml:"tod,attr"`
+	Src   string `xml:"src,attr"`
+	Stats []struct {
+		ID  string  `xml:"id,attr"`
+		In  float64 `xml:"in"`
+		Out float64 `xml:"out"`
+	} `xml:"stats"`
+}
+
+var (
+	gaugeXRootDRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_xrootd_bytes_per_second", Help: "XRootD server transfer rate between the last two summary reports"},
+		[]string{"server", "direction"},
+	)
+	gaugeXRootDLastActivity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "dtms_xrootd_last_activity_timestamp_seconds", Help: "Report time at which an XRootD server last moved bytes"},
+		[]string{"server"},
+	)
+	xrootdDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dtms_xrootd_packets_dropped_total", Help: "XRootD summary packets ignored, by reason"},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gaugeXRootDRate, gaugeXRootDLastActivity, xrootdDropped)
+	registerSource("xrootd", func(name string, params *yaml.Node) (Source, error) {
+		s := &xrootdSource{name: name, Listen: ":9931", servers: map[string]*xrootdServer{}}
+		if err := params.Decode(s); err != nil {
+			return nil, err
+		}
+		if len(s.Servers) == 0 {
+			return nil, fmt.Errorf("xrootd needs servers, the sender to site table")
+		}
+		for addr, site := range s.Servers {
+			if site == "" {
+				return nil, fmt.Errorf("xrootd server %q has no site", addr)
+			}
+		}
+		return s, nil
+	})
+}
+
+func (s *xrootdSource) Name() string { return s.name }
+
+// resolveSenders compiles the servers table; a host name stands for the
+// addresses it resolves to now.
+func (s *xrootdSource) resolveSenders(lookup func(string) ([]net.IP, error)) {
+	s.senders = nil
+	for addr, site := range s.Servers {
+		if _, ips, err := net.ParseCIDR(addr); err == nil {
+			s.senders = append(s.senders, xrootdSender{ips, site})
+			continue
+		}
+		ips, err := lookup(addr)
+		if err != nil {
+			fmt.Printf("[%s] server %s: %v\n", s.name, addr, err)
+			continue
+		}
+		for _, ip := range ips {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			s.senders = append(s.senders, xrootdSender{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, site})
+		}
+	}
+}
+
+// senderSite is the site of the most specific servers entry holding ip.
+func (s *xrootdSource) senderSite(ip net.IP) (string, bool) {
+	site, best := "", -1
+	for _, snd := range s.senders {
+		if ones, _ := snd.ips.Mask.Size(); snd.ips.Contains(ip) && ones > best {
+			site, best = snd.site, ones
+		}
+	}
+	return site, best >= 0
+}
+
+// lookupIP resolves a servers entry, literal addresses without DNS.
+func lookupIP(addr string) ([]net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(addr)
+}
+
+func (s *xrootdSource) Start(ctx context.Context) {
+	conn, err := net.ListenPacket("udp", s.Listen)
+	if err != nil {
+		fmt.Printf("[%s] listen %s: %v\n", s.name, s.Listen, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	s.resolveSenders(lookupIP)
+	fmt.Printf("[%s] listening for summary packets on udp %s from %d servers\n", s.name, s.Listen, len(s.senders))
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("[%s] read error: %v\n", s.name, err)
+			continue
+		}
+		udp, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		site, ok := s.senderSite(udp.IP)
+		if !ok {
+			xrootdDropped.WithLabelValues("unknown_sender").Inc()
+			continue
+		}
+		var sum xrootdSummary
+		if err := xml.Unmarshal(buf[:n], &sum); err != nil {
+			xrootdDropped.WithLabelValues("malformed").Inc()
+			continue
+		}
+		s.record(site, udp.IP.String(), sum)
+	}
+}
+
+// record takes a summary from sender, an address the servers table maps
+// to site. Servers are told apart by the packet's src within a site only,
+// so no sender can move another site's server.
+func (s *xrootdSource) record(site, sender string, sum xrootdSummary) {
+	var in, out float64
+	found := false
+	for _, st := range sum.Stats {
+		if st.ID == "link" {
+			in, out, found = st.In, st.Out, true
+		}
+	}
+	if !found {
+		xrootdDropped.WithLabelValues("malformed").Inc()
+		return
+	}
+	server := sender
+	if sum.Src != "" {
+		server = sum.Src
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			server = host
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := site + " " + server
+	srv := s.servers[key]
+	if srv == nil {
+		srv = &xrootdServer{site: site}
+		s.servers[key] = srv
+	}
+	tod := time.Unix(sum.Tod, 0)
+	if srv.lastTod > 0 && sum.Tod > srv.lastTod && in >= srv.lastIn && out >= srv.lastOut {
+		dt := float64(sum.Tod - srv.lastTod)
+		gaugeXRootDRate.WithLabelValues(server, "in").Set((in - srv.lastIn) / dt)
+		gaugeXRootDRate.WithLabelValues(server, "out").Set((out - srv.lastOut) / dt)
+		if in > srv.lastIn || out > srv.lastOut {
+			srv.lastActivity = tod
+		}
+	}
+	if srv.lastActivity.IsZero() {
+		// first report: assume active now rather than stale forever
+		srv.lastActivity = tod
+	}
+	gaugeXRootDLastActivity.WithLabelValues(server).Set(float64(srv.lastActivity.Unix()))
+	srv.lastTod, srv.lastIn, srv.lastOut = sum.Tod, in, out
+}
+
+func (s *xrootdSource) Collect(context.Context) ([]SiteFresh, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	out := make([]SiteFresh, 0, len(s.servers))
+	for _, srv := range s.servers {
+		out = append(out, SiteFresh{
+			Site:            srv.site,
+			LatestTimestamp: float64(srv.lastActivity.Unix()),
+			AgeSeconds:      now.Sub(srv.lastActivity).Seconds(),
+		})
+	}
+	return out, nil
+}
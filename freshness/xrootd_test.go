@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestXRootDSenderSite(t *testing.T) {
+	s := &xrootdSource{name: "xrootd", Servers: map[string]string{
+		"xrootd.site-a.example.org": "SITE_A",
+		"192.0.2.0/24":              "SITE_B",
+		"192.0.2.17":                "SITE_C",
+		"2001:db8::/32":             "SITE_D",
+		"gone.example.org":          "SITE_E",
+	}}
+	s.resolveSenders(func(addr string) ([]net.IP, error) {
+		switch addr {
+		case "xrootd.site-a.example.org":
+			return []net.IP{net.ParseIP("198.51.100.7"), net.ParseIP("2001:db9::7")}, nil
+		case "gone.example.org":
+			return nil, fmt.Errorf("no such host")
+		}
+		return lookupIP(addr)
+	})
+	for _, tc := range []struct {
+		ip, want string
+	}{
+		{"198.51.100.7", "SITE_A"},
+		{"2001:db9::7", "SITE_A"},
+		{"192.0.2.1", "SITE_B"},
+		{"192.0.2.17", "SITE_C"}, // the single address beats its range
+		{"::ffff:192.0.2.17", "SITE_C"},
+		{"2001:db8::1", "SITE_D"},
+		{"198.51.100.8", ""},
+		{"10.0.0.1", ""},
+	} {
+		t.Run(tc.ip, func(t *testing.T) {
+			got, ok := s.senderSite(net.ParseIP(tc.ip))
+			if got != tc.want || ok != (tc.want != "") {
+				t.Fatalf("senderSite = %q, %v, want %q", got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestXRootDRecord(t *testing.T) {
+	s := &xrootdSource{name: "xrootd", servers: map[string]*xrootdServer{}}
+	packet := func(tod int64, src string, in, out float64) xrootdSummary {
+		return xrootdSummary{Tod: tod, Src: src, Stats: []struct {
+			ID  string  `xml:"id,attr"`
+			In  float64 `xml:"in"`
+			Out float64 `xml:"out"`
+		}{{ID: "link", In: in, Out: out}}}
+	}
+	s.record("SITE_A", "198.51.100.7", packet(1000, "xrootd.site-a.example.org:1094", 10, 10))
+	s.record("SITE_A", "198.51.100.7", packet(1060, "xrootd.site-a.example.org:1094", 20, 10))
+	s.record("SITE_A", "198.51.100.7", packet(1120, "xrootd.site-a.example.org:1094", 20, 10))
+	// another site's sender naming SITE_A's server gets a server of its own
+	s.record("SITE_B", "192.0.2.1", packet(5000, "xrootd.site-a.example.org:1094", 0, 0))
+	// no src: the sender is the server
+	s.record("SITE_C", "192.0.2.17", packet(2000, "", 1, 1))
+	// no link stats
+	s.record("SITE_C", "192.0.2.17", xrootdSummary{Tod: 3000, Src: "x"})
+
+	got := map[string]float64{}
+	sites, _ := s.Collect(context.Background())
+	for _, f := range sites {
+		got[f.Site] = f.LatestTimestamp
+	}
+	want := map[string]float64{"SITE_A": 1060, "SITE_B": 5000, "SITE_C": 2000}
+	if len(got) != len(want) {
+		t.Fatalf("sites %v, want %v", got, want)
+	}
+	for site, ts := range want {
+		if got[site] != ts {
+			t.Errorf("%s last active at %v, want %v", site, got[site], ts)
+		}
+	}
+}
+
+func TestXRootDConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, yaml string
+		ok         bool
+	}{
+		{"servers", "servers: {192.0.2.0/24: SITE_B}", true},
+		{"no servers", "listen: ':9931'", false},
+		{"server without a site", "servers: {192.0.2.1: ''}", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var node yaml.Node
+			if err := yaml.Unmarshal([]byte(tc.yaml), &node); err != nil {
+				t.Fatal(err)
+			}
+			_, err := sourceFactories["xrootd"]("xrootd", node.Content[0])
+			if (err == nil) != tc.ok {
+				t.Fatalf("err = %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}